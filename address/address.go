@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"strings"
 
 	"github.com/frankh/nano/types"
 	"github.com/frankh/nano/utils"
@@ -26,12 +27,31 @@ func ValidateAddress(account types.Account) bool {
 	return err == nil
 }
 
+// Parse is the way to turn untrusted input into an Account. The result is
+// always a well formed nano_ address, with xrb_ addresses converted.
+func Parse(s string) (types.Account, error) {
+	pub, err := AddressToPub(types.Account(s))
+	if err != nil {
+		return "", err
+	}
+	return PubKeyToAddress(pub), nil
+}
+
+// Like Parse, but panics on invalid input. For constants and tests.
+func MustParse(s string) types.Account {
+	account, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return account
+}
+
 func AddressToPub(account types.Account) (public_key []byte, err error) {
 	address := string(account)
 
-	if address[:4] == "xrb_" {
+	if strings.HasPrefix(address, "xrb_") {
 		address = address[4:]
-	} else if address[:5] == "nano_" {
+	} else if strings.HasPrefix(address, "nano_") {
 		address = address[5:]
 	} else {
 		return nil, errors.New("Invalid address format")
@@ -49,6 +49,26 @@ func TestValidateAddress(t *testing.T) {
 	}
 }
 
+func TestParse(t *testing.T) {
+	for _, addr := range valid_addresses {
+		account, err := Parse(string(addr))
+		if err != nil || account[:5] != "nano_" || account[5:] != addr[len(addr)-60:] {
+			t.Errorf("Failed to parse %s: %s %v", addr, account, err)
+		}
+	}
+
+	for _, addr := range invalid_addresses {
+		if _, err := Parse(string(addr)); err == nil {
+			t.Errorf("Parsed invalid address %s", addr)
+		}
+	}
+
+	// The classic mix up of a hex public key for an address
+	if _, err := Parse("e89208dd038fbb269987689621d52292ae9c35941a7484756ecced92a65093ba"); err == nil {
+		t.Errorf("Parsed a public key as an address")
+	}
+}
+
 func TestKeypairFromSeed(t *testing.T) {
 	seed := "1234567890123456789012345678901234567890123456789012345678901234"
 
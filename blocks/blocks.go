@@ -1,13 +1,19 @@
 package blocks
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"strings"
+	"time"
 
 	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/protocol"
 	"github.com/frankh/nano/types"
 	"github.com/frankh/nano/uint128"
 	"github.com/frankh/nano/utils"
@@ -21,7 +27,28 @@ const LiveGenesisBlockHash types.BlockHash = "991CF190094C00F0B68E2E5F75F6BEE95A
 const LiveGenesisSourceHash types.BlockHash = "E89208DD038FBB269987689621D52292AE9C35941A7484756ECCED92A65093BA"
 
 var GenesisAmount uint128.Uint128 = uint128.FromInts(0xffffffffffffffff, 0xffffffffffffffff)
-var WorkThreshold = uint64(0xffffffc000000000)
+var WorkThreshold = protocol.WorkLiveThreshold
+
+// From epoch 2, state blocks that receive only need 1/ReceiveWorkDivisor
+// of the work of other blocks. Legacy receives and opens get no discount.
+var ReceiveWorkDivisor = protocol.WorkReceiveDivisor
+
+// An account's version moves up at an epoch, which changes the work its
+// later blocks need. Blocks from before keep the threshold they were made
+// under.
+type AccountVersion int
+
+const (
+	Epoch1 AccountVersion = iota + 1
+	Epoch2
+)
+
+// The latest version, that accounts are upgraded to.
+const CurrentVersion = Epoch2
+
+// Blocks need this many times the work from epoch 2, less the discount
+// for state receives.
+var Epoch2WorkMultiplier = protocol.WorkEpoch2Multiplier
 
 const TestPrivateKey string = "34F0A37AAD20F4A260F0A5B3CB3D7FB50673212263E58A380BC10474BB039CE4"
 
@@ -50,6 +77,7 @@ const (
 	Receive           = "receive"
 	Send              = "send"
 	Change            = "change"
+	State             = "state"
 )
 
 type Block interface {
@@ -93,6 +121,22 @@ type ChangeBlock struct {
 	CommonBlock
 }
 
+// A StateBlock holds the whole state of its account, so whether it sends,
+// receives or changes representative is only known from the ledger.
+type StateBlock struct {
+	Account types.Account
+	// All zeros for the account's first block
+	PreviousHash   types.BlockHash
+	Representative types.Account
+	Balance        uint128.Uint128
+	// The source for a receive, the destination's public key for a send
+	Link types.BlockHash
+	CommonBlock
+}
+
+// The previous of an account's first state block
+var ZeroHash = types.BlockHash(strings.Repeat("0", types.BlockHashLength))
+
 func (b *OpenBlock) Hash() types.BlockHash {
 	return types.BlockHashFromBytes(HashOpen(b.SourceHash, b.Representative, b.Account))
 }
@@ -105,6 +149,10 @@ func (b *ChangeBlock) Hash() types.BlockHash {
 	return types.BlockHashFromBytes(HashChange(b.PreviousHash, b.Representative))
 }
 
+func (b *StateBlock) Hash() types.BlockHash {
+	return types.BlockHashFromBytes(HashState(b.Account, b.PreviousHash, b.Representative, b.Balance, b.Link))
+}
+
 func (b *SendBlock) Hash() types.BlockHash {
 	return types.BlockHashFromBytes(HashSend(b.PreviousHash, b.Destination, b.Balance))
 }
@@ -121,6 +169,10 @@ func (b *SendBlock) PreviousBlockHash() types.BlockHash {
 	return b.PreviousHash
 }
 
+func (b *StateBlock) PreviousBlockHash() types.BlockHash {
+	return b.PreviousHash
+}
+
 func (b *OpenBlock) PreviousBlockHash() types.BlockHash {
 	return b.SourceHash
 }
@@ -138,6 +190,14 @@ func (b *ChangeBlock) RootHash() types.BlockHash {
 	return b.PreviousHash
 }
 
+func (b *StateBlock) RootHash() types.BlockHash {
+	if b.PreviousHash == ZeroHash {
+		pub, _ := address.AddressToPub(b.Account)
+		return types.BlockHashFromBytes(pub)
+	}
+	return b.PreviousHash
+}
+
 func (b *SendBlock) RootHash() types.BlockHash {
 	return b.PreviousHash
 }
@@ -166,12 +226,33 @@ func (*ReceiveBlock) Type() BlockType {
 	return Receive
 }
 
+func (*StateBlock) Type() BlockType {
+	return State
+}
+
 func (b *OpenBlock) VerifySignature() (bool, error) {
 	pub, _ := address.AddressToPub(b.Account)
 	res := ed25519.Verify(pub, b.Hash().ToBytes(), b.Signature.ToBytes())
 	return res, nil
 }
 
+func (b *StateBlock) VerifySignature() (bool, error) {
+	pub, err := address.AddressToPub(b.Account)
+	if err != nil {
+		return false, err
+	}
+	return VerifyBlockSignature(b, pub), nil
+}
+
+// Checks the block was signed by the account with the given public key.
+func VerifyBlockSignature(b Block, pub ed25519.PublicKey) bool {
+	sig := b.GetSignature()
+	if sig.Validate() != nil {
+		return false
+	}
+	return ed25519.Verify(pub, b.Hash().ToBytes(), sig.ToBytes())
+}
+
 type RawBlock struct {
 	Type           BlockType
 	Source         types.BlockHash
@@ -182,11 +263,209 @@ type RawBlock struct {
 	Previous       types.BlockHash
 	Balance        uint128.Uint128
 	Destination    types.Account
+	Link           types.BlockHash
+}
+
+func validateHashField(field string, hash types.BlockHash) error {
+	if err := hash.Validate(); err != nil {
+		return fmt.Errorf("Invalid %s: %s", field, err)
+	}
+	return nil
 }
 
+func validateAccountField(field string, account types.Account) error {
+	if _, err := address.AddressToPub(account); err != nil {
+		return fmt.Errorf("Invalid %s: %s", field, err)
+	}
+	return nil
+}
+
+// Checks every field used by the block type is well formed, so nothing
+// invalid can reach hashing or serialization.
+func (b RawBlock) Validate() error {
+	var errs []error
+
+	switch b.Type {
+	case Open:
+		errs = append(errs,
+			validateHashField("source", b.Source),
+			validateAccountField("representative", b.Representative),
+			validateAccountField("account", b.Account),
+		)
+	case Send:
+		errs = append(errs,
+			validateHashField("previous", b.Previous),
+			validateAccountField("destination", b.Destination),
+		)
+	case Receive:
+		errs = append(errs,
+			validateHashField("previous", b.Previous),
+			validateHashField("source", b.Source),
+		)
+	case Change:
+		errs = append(errs,
+			validateHashField("previous", b.Previous),
+			validateAccountField("representative", b.Representative),
+		)
+	case State:
+		errs = append(errs,
+			validateAccountField("account", b.Account),
+			validateHashField("previous", b.Previous),
+			validateAccountField("representative", b.Representative),
+			validateHashField("link", b.Link),
+		)
+	default:
+		return fmt.Errorf("Unknown block type %q", b.Type)
+	}
+
+	if err := b.Work.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("Invalid work: %s", err))
+	}
+	if err := b.Signature.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("Invalid signature: %s", err))
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Block JSON larger than this is rejected before it's decoded. Blocks
+// are well under 1KB even pretty printed.
+const MaxBlockJSONSize = 4096
+
+// Balance is the only nested field
+const maxBlockJSONDepth = 2
+const maxBlockJSONFields = 16
+
+// The longest address, with the nano_ prefix
+const maxAccountLength = 65
+
+var ErrBlockJSONTooLarge = errors.New("Block JSON too large")
+
+// Checks no field is longer than a valid one could be, so an oversized
+// string is reported as such rather than run through validation.
+func (b RawBlock) checkLengths() error {
+	fields := []struct {
+		name  string
+		value string
+		max   int
+	}{
+		{"type", string(b.Type), len(Receive)},
+		{"source", string(b.Source), types.BlockHashLength},
+		{"representative", string(b.Representative), maxAccountLength},
+		{"account", string(b.Account), maxAccountLength},
+		{"work", string(b.Work), types.WorkLength},
+		{"signature", string(b.Signature), types.SignatureLength},
+		{"previous", string(b.Previous), types.BlockHashLength},
+		{"destination", string(b.Destination), maxAccountLength},
+		{"link", string(b.Link), types.BlockHashLength},
+	}
+	for _, f := range fields {
+		if len(f.value) > f.max {
+			return fmt.Errorf("Invalid %s: %d characters, at most %d", f.name, len(f.value), f.max)
+		}
+	}
+	return nil
+}
+
+// Parses and validates a block from external JSON input. Input over
+// MaxBlockJSONSize, nested too deeply, with too many or unknown fields is
+// rejected.
+func ParseJson(b []byte) (Block, error) {
+	if len(b) > MaxBlockJSONSize {
+		return nil, ErrBlockJSONTooLarge
+	}
+	if err := utils.CheckJSONShape(b, maxBlockJSONDepth, maxBlockJSONFields); err != nil {
+		return nil, err
+	}
+	var in jsonBlock
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&in)
+	if err != nil {
+		return nil, err
+	}
+	raw := in.RawBlock
+	if err = raw.decodeBalance(in.Balance); err != nil {
+		return nil, err
+	}
+
+	err = raw.checkLengths()
+	if err != nil {
+		return nil, err
+	}
+	err = raw.Validate()
+	if err != nil {
+		return nil, err
+	}
+	if in.LinkAsAccount != "" {
+		if err = raw.checkLinkAsAccount(in.LinkAsAccount); err != nil {
+			return nil, err
+		}
+	}
+
+	return raw.ToBlock(), nil
+}
+
+// A block as ParseJson reads it. The reference node writes a state
+// block's balance in decimal and repeats its link as an account.
+type jsonBlock struct {
+	RawBlock
+	Balance       json.RawMessage
+	LinkAsAccount types.Account `json:"link_as_account"`
+}
+
+// State balances are decimal strings, as the reference node writes them.
+// Legacy balances, and any balance written as RawBlock encodes it, go
+// through Uint128's own decoding.
+func (b *RawBlock) decodeBalance(data json.RawMessage) error {
+	if len(data) == 0 {
+		return nil
+	}
+	var s string
+	if b.Type == State && json.Unmarshal(data, &s) == nil {
+		balance, err := uint128.FromDecimal(s)
+		if err != nil {
+			return fmt.Errorf("Invalid balance: %s", err)
+		}
+		b.Balance = balance
+		return nil
+	}
+	return json.Unmarshal(data, &b.Balance)
+}
+
+func (b RawBlock) checkLinkAsAccount(account types.Account) error {
+	if b.Type != State {
+		return fmt.Errorf("Unexpected link_as_account for a %s block", b.Type)
+	}
+	if len(account) > maxAccountLength {
+		return fmt.Errorf("Invalid link_as_account: %d characters, at most %d", len(account), maxAccountLength)
+	}
+	pub, err := address.AddressToPub(account)
+	if err != nil {
+		return fmt.Errorf("Invalid link_as_account: %s", err)
+	}
+	if !strings.EqualFold(string(b.Link), hex.EncodeToString(pub)) {
+		return errors.New("Invalid link_as_account: doesn't match link")
+	}
+	return nil
+}
+
+// Like ParseJson but panics on invalid input, for trusted blocks
+// such as the genesis blocks.
 func FromJson(b []byte) (block Block) {
-	var raw RawBlock
-	json.Unmarshal(b, &raw)
+	block, err := ParseJson(b)
+	if err != nil {
+		panic(err)
+	}
+	return block
+}
+
+func (raw RawBlock) ToBlock() (block Block) {
 	common := CommonBlock{
 		Work:      raw.Work,
 		Signature: raw.Signature,
@@ -223,6 +502,16 @@ func FromJson(b []byte) (block Block) {
 			common,
 		}
 		block = &b
+	case State:
+		b := StateBlock{
+			raw.Account,
+			raw.Previous,
+			raw.Representative,
+			raw.Balance,
+			raw.Link,
+			common,
+		}
+		block = &b
 	default:
 		panic("Unknown block type")
 	}
@@ -231,6 +520,38 @@ func FromJson(b []byte) (block Block) {
 
 }
 
+// The inverse of ToBlock, e.g. to write a block out as JSON.
+func ToRaw(block Block) RawBlock {
+	var raw RawBlock
+	raw.Type = block.Type()
+	raw.Work = block.GetWork()
+	raw.Signature = block.GetSignature()
+
+	switch b := block.(type) {
+	case *OpenBlock:
+		raw.Source = b.SourceHash
+		raw.Representative = b.Representative
+		raw.Account = b.Account
+	case *SendBlock:
+		raw.Previous = b.PreviousHash
+		raw.Destination = b.Destination
+		raw.Balance = b.Balance
+	case *ReceiveBlock:
+		raw.Previous = b.PreviousHash
+		raw.Source = b.SourceHash
+	case *ChangeBlock:
+		raw.Previous = b.PreviousHash
+		raw.Representative = b.Representative
+	case *StateBlock:
+		raw.Account = b.Account
+		raw.Previous = b.PreviousHash
+		raw.Representative = b.Representative
+		raw.Balance = b.Balance
+		raw.Link = b.Link
+	}
+	return raw
+}
+
 func (b RawBlock) Hash() (result []byte) {
 	switch b.Type {
 	case Open:
@@ -241,6 +562,8 @@ func (b RawBlock) Hash() (result []byte) {
 		return HashReceive(b.Previous, b.Source)
 	case Change:
 		return HashChange(b.Previous, b.Representative)
+	case State:
+		return HashState(b.Account, b.Previous, b.Representative, b.Balance, b.Link)
 	default:
 		panic("Unknown block type! " + b.Type)
 	}
@@ -295,13 +618,22 @@ func HashOpen(source types.BlockHash, representative types.Account, account type
 	return HashBytes(source_bytes, repr_bytes, account_bytes)
 }
 
-// ValidateWork takes the "work" value (little endian from hex)
-// and block hash and verifies that the work passes the difficulty.
-// To verify this, we create a new 8 byte hash of the
-// work and the block hash and convert this to a uint64
-// which must be higher (or equal) than the difficulty
-// (0xffffffc000000000) to be valid.
-func ValidateWork(block_hash []byte, work []byte) bool {
+// State blocks hash a preamble first, so no state block's hash can be
+// that of a legacy block.
+var statePreamble = append(make([]byte, 31), 6)
+
+func HashState(account types.Account, previous types.BlockHash, representative types.Account, balance uint128.Uint128, link types.BlockHash) (result []byte) {
+	account_bytes, _ := address.AddressToPub(account)
+	previous_bytes, _ := hex.DecodeString(string(previous))
+	repr_bytes, _ := address.AddressToPub(representative)
+	link_bytes, _ := hex.DecodeString(string(link))
+	return HashBytes(statePreamble, account_bytes, previous_bytes, repr_bytes, balance.GetBytes(), link_bytes)
+}
+
+// WorkValue takes the "work" value (little endian from hex)
+// and block hash and creates a new 8 byte hash of the
+// work and the block hash, converted to a uint64.
+func WorkValue(block_hash []byte, work []byte) uint64 {
 	hash, err := blake2b.New(8, nil)
 	if err != nil {
 		panic("Unable to create hash")
@@ -314,25 +646,171 @@ func ValidateWork(block_hash []byte, work []byte) bool {
 	hash.Write(block_hash)
 
 	work_value := hash.Sum(nil)
-	work_value_int := binary.LittleEndian.Uint64(work_value)
+	return binary.LittleEndian.Uint64(work_value)
+}
+
+// ValidateWork verifies that the work value is higher (or equal)
+// than the difficulty (protocol.WorkLiveThreshold on the live network).
+func ValidateWork(block_hash []byte, work []byte) bool {
+	return WorkValue(block_hash, work) >= WorkThreshold
+}
+
+func BlockWorkValue(b Block) uint64 {
+	return RootWorkValue(b.RootHash(), b.GetWork())
+}
+
+// The difficulty work achieves for a block with this root.
+func RootWorkValue(root types.BlockHash, work types.Work) uint64 {
+	work_bytes, err := hex.DecodeString(string(work))
+	if err != nil || len(work_bytes) != 8 {
+		return 0
+	}
 
-	return work_value_int >= WorkThreshold
+	return WorkValue(root.ToBytes(), utils.Reversed(work_bytes))
 }
 
+// Whether the block has enough work to be valid at any account version.
+// Enough to drop junk before the block's account is known.
 func ValidateBlockWork(b Block) bool {
-	hash_bytes := b.RootHash().ToBytes()
-	work_bytes, _ := hex.DecodeString(string(b.GetWork()))
+	return BlockWorkValue(b) >= WorkThresholdFor(b.Type())
+}
+
+func ValidateBlockWorkAt(b Block, version AccountVersion) bool {
+	return BlockWorkValue(b) >= RequiredDifficulty(version)
+}
+
+// The lowest threshold a block of type t can be valid at.
+func WorkThresholdFor(t BlockType) uint64 {
+	// Only the ledger can tell whether a state block receives, so it may
+	// need as little as a receive
+	if t == State {
+		return StateReceiveDifficulty(CurrentVersion)
+	}
+	return RequiredDifficulty(Epoch1)
+}
+
+// The threshold a block must meet in an account at version, unless it's
+// a state block that receives. It's the same whatever the block's type.
+// Generation and validation must both go through this so they agree.
+// Unknown versions get the current rules.
+func RequiredDifficulty(version AccountVersion) uint64 {
+	if version == Epoch1 {
+		return WorkThreshold
+	}
+	return RaisedThreshold(WorkThreshold, Epoch2WorkMultiplier)
+}
+
+// The threshold a state block that receives must meet in an account at
+// version. Only from epoch 2 is it less than other blocks'.
+func StateReceiveDifficulty(version AccountVersion) uint64 {
+	if version == Epoch1 {
+		return WorkThreshold
+	}
+	return ReducedThreshold(RequiredDifficulty(version), ReceiveWorkDivisor)
+}
+
+// Returns a threshold needing multiplier times the expected attempts of
+// threshold, topping out just short of 2^64.
+func RaisedThreshold(threshold uint64, multiplier uint64) uint64 {
+	if multiplier < 2 {
+		return threshold
+	}
+	gap := -threshold
+	if threshold == 0 {
+		// The gap is 2^64, which doesn't fit
+		gap = math.MaxUint64
+	}
+	gap /= multiplier
+	if gap == 0 {
+		gap = 1
+	}
+	return -gap
+}
 
-	res := ValidateWork(hash_bytes, utils.Reversed(work_bytes))
-	return res
+// Returns a threshold needing 1/divisor of the expected attempts of
+// threshold, bottoming out at zero.
+func ReducedThreshold(threshold uint64, divisor uint64) uint64 {
+	if divisor < 2 {
+		return threshold
+	}
+	// Attempts needed are inversely proportional to the gap to 2^64
+	gap := -threshold
+	if gap > math.MaxUint64/divisor {
+		return 0
+	}
+	return -(gap * divisor)
 }
 
 func GenerateWorkForHash(b types.BlockHash) types.Work {
-	block_hash := b.ToBytes()
-	work := []byte{0, 0, 0, 0, 0, 0, 0, 0}
-	for {
-		if ValidateWork(block_hash, work) {
-			return types.Work(fmt.Sprintf("%x", utils.Reversed(work)))
+	return GenerateWorkThreshold(b, WorkThreshold)
+}
+
+// Times work generation. Set from the metrics package unless built light.
+var timeWork = func(start time.Time) {}
+
+func GenerateWorkThreshold(b types.BlockHash, threshold uint64) types.Work {
+	work, _ := GenerateWorkContext(context.Background(), b, threshold)
+	return work
+}
+
+// Attempts between checks for cancellation
+const workCheckInterval = 1 << 14
+
+// GenerateWorkContext is GenerateWorkThreshold, giving up with ctx's
+// error once it's done.
+func GenerateWorkContext(ctx context.Context, b types.BlockHash, threshold uint64) (types.Work, error) {
+	defer timeWork(time.Now())
+	return searchWork(ctx, b.ToBytes(), threshold, make([]byte, 8))
+}
+
+// GenerateWorkParallel is GenerateWorkContext searching on workers
+// goroutines at once, up to 256.
+func GenerateWorkParallel(ctx context.Context, b types.BlockHash, threshold uint64, workers int) (types.Work, error) {
+	if workers <= 1 {
+		return GenerateWorkContext(ctx, b, threshold)
+	}
+	if workers > 256 {
+		workers = 256
+	}
+	defer timeWork(time.Now())
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	found := make(chan types.Work, workers)
+	for i := 0; i < workers; i++ {
+		// Each worker has its own top byte, which counting never reaches
+		start := make([]byte, 8)
+		start[7] = byte(i)
+		go func() {
+			work, err := searchWork(ctx, b.ToBytes(), threshold, start)
+			if err == nil {
+				found <- work
+				cancel()
+			}
+		}()
+	}
+	select {
+	case work := <-found:
+		return work, nil
+	case <-ctx.Done():
+		// Work may have been found just as ctx was done
+		select {
+		case work := <-found:
+			return work, nil
+		default:
+			return "", ctx.Err()
+		}
+	}
+}
+
+// Counts up from work until it meets threshold or ctx is done.
+func searchWork(ctx context.Context, block_hash []byte, threshold uint64, work []byte) (types.Work, error) {
+	for i := 1; ; i++ {
+		if WorkValue(block_hash, work) >= threshold {
+			return types.Work(fmt.Sprintf("%x", utils.Reversed(work))), nil
+		}
+		if i%workCheckInterval == 0 && ctx.Err() != nil {
+			return "", ctx.Err()
 		}
 		incrementWork(work)
 	}
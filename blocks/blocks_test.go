@@ -1,12 +1,20 @@
 package blocks
 
 import (
+	"context"
 	"encoding/hex"
+	"encoding/json"
+	"math"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/protocol"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
 	"github.com/frankh/nano/utils"
+	"github.com/golang/crypto/blake2b"
 )
 
 func TestSignMessage(t *testing.T) {
@@ -35,6 +43,21 @@ func TestGenerateWork(t *testing.T) {
 	GenerateWork(LiveGenesisBlock)
 }
 
+func TestGenerateWorkParallel(t *testing.T) {
+	root := LiveGenesisBlock.Hash()
+	work, err := GenerateWorkParallel(context.Background(), root, 0xfff0000000000000, 4)
+	if err != nil || RootWorkValue(root, work) < 0xfff0000000000000 {
+		t.Errorf("Bad work %s: %v", work, err)
+	}
+
+	// Work no nonce can meet is given up on
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := GenerateWorkParallel(ctx, root, math.MaxUint64, 4); err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline, got %v", err)
+	}
+}
+
 func BenchmarkGenerateWork(b *testing.B) {
 	WorkThreshold = 0xfff0000000000000
 	for n := 0; n < b.N; n++ {
@@ -43,7 +66,7 @@ func BenchmarkGenerateWork(b *testing.B) {
 }
 
 func TestValidateWork(t *testing.T) {
-	WorkThreshold = 0xffffffc000000000
+	WorkThreshold = protocol.WorkLiveThreshold
 
 	live_block_hash, _ := address.AddressToPub(LiveGenesisBlock.Account)
 	live_work_bytes, _ := hex.DecodeString(string(LiveGenesisBlock.Work))
@@ -70,3 +93,413 @@ func TestHashOpen(t *testing.T) {
 		t.Errorf("Genesis block hash is not correct, expected %s, got %s", LiveGenesisBlockHash, LiveGenesisBlock.Hash())
 	}
 }
+
+var sendJson = `{
+	"type":        "send",
+	"previous":    "991CF190094C00F0B68E2E5F75F6BEE95A2E0BD93CEAA4A6734DB9F19B728948",
+	"destination": "nano_3e3j5tkog48pnny9dmfzj1r16pg8t1e76dz5tmac6iq689wyjfpiij4txtdo",
+	"work":        "9680625b39d3363d",
+	"signature":   "ECDA914373A2F0CA1296475BAEE40500A7F0A7AD72A5A80C81D7FAB7F6C802B2CC7DB50F5DD0FB25B2EF11761FA7344A158DD5A700B21BD47DE5BD0F63153A02"
+}`
+
+// A send as the reference node writes it, the balance in hex, with work
+// for the live threshold
+var referenceSendJson = `{
+	"type":        "send",
+	"previous":    "04270D7F11C4B2B472F2854C5A59F2A7E84226CE9ED799DE75744BD7D85FC9D9",
+	"destination": "nano_355z4uz75gjfjcb5ndydx9j5s5h9tko158hu47ff4eeyqajem5zjfhgzuo8m",
+	"balance":     "FFFFCEB239BB726CC73EA4F5FFFFD2A0",
+	"work":        "00000000005000df",
+	"signature":   "C552C5A1B60B6BCD6972C08368CF9DF0D1865D59FE9101E6CC12BC1D5E90E12E66B859379ED1C67565C26D2AADB1DC1CD86026E1C332330DE915AC97F99D4407"
+}`
+
+func FuzzParseJson(f *testing.F) {
+	genesis, _ := json.Marshal(ToRaw(TestGenesisBlock))
+	for _, seed := range []string{sendJson, referenceSendJson, string(genesis), `{}`, `{"type": "send", "previous": "12"}`} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		block, err := ParseJson(data)
+		if err != nil {
+			return
+		}
+		// Anything that parses must be safe to hash and write back out
+		if err = ToRaw(block).Validate(); err != nil {
+			t.Errorf("Parsed block doesn't validate: %s", err)
+		}
+		block.Hash()
+		if _, err = json.Marshal(ToRaw(block)); err != nil {
+			t.Errorf("Parsed block doesn't marshal: %s", err)
+		}
+	})
+}
+
+// A state block laid out as the reference node writes it, the balance in
+// decimal and the link repeated as an account, signed with TestPrivateKey
+var referenceStateJson = `{
+	"type":            "state",
+	"account":         "nano_3e3j5tkog48pnny9dmfzj1r16pg8t1e76dz5tmac6iq689wyjfpiij4txtdo",
+	"previous":        "991CF190094C00F0B68E2E5F75F6BEE95A2E0BD93CEAA4A6734DB9F19B728948",
+	"representative":  "nano_355z4uz75gjfjcb5ndydx9j5s5h9tko158hu47ff4eeyqajem5zjfhgzuo8m",
+	"balance":         "1000000000000000000000000000000",
+	"link":            "04270D7F11C4B2B472F2854C5A59F2A7E84226CE9ED799DE75744BD7D85FC9D9",
+	"link_as_account": "nano_13393ozj5j7kpjsh73cedbez7bzaaamex9pqm9h9cx4dtze7zkgswn7679cm",
+	"signature":       "BF9360090ABDE803C3A92C07B3D4B55A1C1CC7B27B7D12C847D090556B1FF24B0BD81BF5898124C99CA266CB238A057DEFE8A6A5D6CADF6413622A2613797505",
+	"work":            "7202df8a7c380578"
+}`
+
+func TestStateBlockJson(t *testing.T) {
+	block, err := ParseJson([]byte(referenceStateJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := block.(*StateBlock)
+	if expected, _ := uint128.FromString("0000000c9f2c9cd04674edea40000000"); state.Balance != expected {
+		t.Errorf("Wrong balance %s", state.Balance.Decimal())
+	}
+
+	// The hash of the preamble and fields laid out by hand
+	preimage, _ := hex.DecodeString(strings.Repeat("0", 62) + "06" +
+		"b0311ea55708d6a53c75cdbf88300259c6d018522fe3d4d0a242e431f9e8b6d0" +
+		"991cf190094c00f0b68e2e5f75f6bee95a2e0bd93ceaa4a6734db9f19b728948" +
+		"8c7f16fe51ba2d8a923a2fcbe9e23c8de7d4aa0199fb115ad1319eba22c98ff1" +
+		"0000000c9f2c9cd04674edea40000000" +
+		"04270d7f11c4b2b472f2854c5a59f2a7e84226ce9ed799de75744bd7d85fc9d9")
+	sum := blake2b.Sum256(preimage)
+	if block.Hash() != "B76F9F062A4F11C38AFD2EB3DC3F390170B8B92BB813EC9CA09457CF76F5CBF9" || block.Hash() != types.BlockHashFromBytes(sum[:]) {
+		t.Errorf("Wrong hash %s", block.Hash())
+	}
+	if ok, _ := state.VerifySignature(); !ok {
+		t.Errorf("Signature failed to verify")
+	}
+
+	for name, input := range map[string]string{
+		"hex balance":            strings.Replace(referenceStateJson, `"1000000000000000000000000000000"`, `"0000000C9F2C9CD04674EDEA40000000"`, 1),
+		"negative balance":       strings.Replace(referenceStateJson, `"1000000000000000000000000000000"`, `"-1"`, 1),
+		"balance over 128 bits":  strings.Replace(referenceStateJson, `"1000000000000000000000000000000"`, `"340282366920938463463374607431768211456"`, 1),
+		"wrong link_as_account":  strings.Replace(referenceStateJson, `"nano_13393ozj5j7kpjsh73cedbez7bzaaamex9pqm9h9cx4dtze7zkgswn7679cm"`, `"nano_3e3j5tkog48pnny9dmfzj1r16pg8t1e76dz5tmac6iq689wyjfpiij4txtdo"`, 1),
+		"legacy link_as_account": strings.Replace(referenceSendJson, `"work"`, `"link_as_account": "nano_13393ozj5j7kpjsh73cedbez7bzaaamex9pqm9h9cx4dtze7zkgswn7679cm", "work"`, 1),
+	} {
+		if _, err := ParseJson([]byte(input)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	// Without link_as_account the link alone is enough
+	without := strings.Replace(referenceStateJson, `"link_as_account": "nano_13393ozj5j7kpjsh73cedbez7bzaaamex9pqm9h9cx4dtze7zkgswn7679cm",`, "", 1)
+	if parsed, err := ParseJson([]byte(without)); err != nil || parsed.Hash() != block.Hash() {
+		t.Errorf("Failed to parse without link_as_account: %v", err)
+	}
+}
+
+func TestStateBlock(t *testing.T) {
+	pub, priv := address.KeypairFromPrivateKey(TestPrivateKey)
+	account := address.PubKeyToAddress(pub)
+	first := &StateBlock{account, ZeroHash, account, GenesisAmount, LiveGenesisSourceHash, CommonBlock{Work: "9680625b39d3363d"}}
+	first.Signature = first.Hash().Sign(priv)
+
+	if first.RootHash() != types.BlockHashFromBytes(pub) {
+		t.Errorf("Expected the first block's root to be its account, got %s", first.RootHash())
+	}
+	if ok, _ := first.VerifySignature(); !ok {
+		t.Errorf("Signature failed to verify")
+	}
+	// The preamble keeps it from hashing like a legacy block of the same
+	// fields
+	if first.Hash() == types.BlockHashFromBytes(HashBytes(pub, ZeroHash.ToBytes(), pub, GenesisAmount.GetBytes(), LiveGenesisSourceHash.ToBytes())) {
+		t.Errorf("State block hashed without its preamble")
+	}
+
+	next := &StateBlock{account, first.Hash(), account, uint128.FromInts(0, 1), types.BlockHashFromBytes(pub), first.CommonBlock}
+	if next.RootHash() != first.Hash() || next.Hash() == first.Hash() {
+		t.Errorf("Expected the next block rooted on the first")
+	}
+
+	for _, block := range []*StateBlock{first, next} {
+		encoded, _ := json.Marshal(ToRaw(block))
+		parsed, err := ParseJson(encoded)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %s", encoded, err)
+		}
+		if parsed.Hash() != block.Hash() || *parsed.(*StateBlock) != *block {
+			t.Errorf("State block didn't round trip\n%+v\n%+v", block, parsed)
+		}
+	}
+	for _, field := range []string{"account", "previous", "representative", "link"} {
+		raw := ToRaw(first)
+		switch field {
+		case "account":
+			raw.Account = "nano_bad"
+		case "previous":
+			raw.Previous = "XYZ"
+		case "representative":
+			raw.Representative = ""
+		case "link":
+			raw.Link = raw.Link[1:]
+		}
+		if raw.Validate() == nil {
+			t.Errorf("Expected a bad %s to fail validation", field)
+		}
+	}
+
+	if WorkThresholdFor(State) != StateReceiveDifficulty(CurrentVersion) || RequiredDifficulty(Epoch1) != WorkThreshold {
+		t.Errorf("Expected state blocks to be checked against receive work, got %x", WorkThresholdFor(State))
+	}
+}
+
+func TestParseJson(t *testing.T) {
+	if _, err := ParseJson([]byte(sendJson)); err != nil {
+		t.Errorf("Failed to parse valid send: %s", err)
+	}
+
+	defer func() { WorkThreshold = protocol.WorkLiveThreshold }()
+	WorkThreshold = protocol.WorkLiveThreshold
+	block, err := ParseJson([]byte(referenceSendJson))
+	if err != nil {
+		t.Fatalf("Failed to parse reference send: %s", err)
+	}
+	send := block.(*SendBlock)
+	if send.Hash() != "2582C595E0F12A53F8A994920EA2966A95EAABD5E0AB13709D7A68692A252952" || send.Balance.Decimal() != "340281366920938463463374607431768199840" {
+		t.Errorf("Wrong reference send %s with balance %s", send.Hash(), send.Balance.Decimal())
+	}
+	if !ValidateBlockWork(send) {
+		t.Errorf("Reference send's work is against its previous block")
+	}
+	if _, err = ParseJson([]byte(strings.Replace(referenceSendJson, "FFFFCEB239BB726CC73EA4F5FFFFD2A0", "1000", 1))); err == nil {
+		t.Errorf("Parsed a balance that isn't 32 hex digits")
+	}
+
+	cases := map[string]string{
+		"previous":    `"previous":    "991CF190094C00F0B68E2E5F75F6BEE95A2E0BD93CEAA4A6734DB9F19B72894"`,
+		"destination": `"destination": "nano_3e3j5tkog48pnny9dmfzj1r16pg8t1e76dz5tmac6iq689wyjfpiij4txtd"`,
+		"work":        `"work":        "9680625b39d3363x"`,
+		"signature":   `"signature":   ""`,
+	}
+	lines := strings.Split(sendJson, "\n")
+
+	for field, replacement := range cases {
+		mutated := make([]string, len(lines))
+		copy(mutated, lines)
+		for i, line := range mutated {
+			if strings.Contains(line, `"`+field+`"`) {
+				mutated[i] = "\t" + replacement
+				if strings.HasSuffix(line, ",") {
+					mutated[i] += ","
+				}
+			}
+		}
+		_, err := ParseJson([]byte(strings.Join(mutated, "\n")))
+		if err == nil || !strings.Contains(err.Error(), field) {
+			t.Errorf("Expected error mentioning %s, got %v", field, err)
+		}
+	}
+
+	if _, err := ParseJson([]byte(`{"type": "bogus"}`)); err == nil {
+		t.Errorf("Unknown block type should fail")
+	}
+}
+
+func TestParseJsonLimits(t *testing.T) {
+	raw, _ := json.Marshal(ToRaw(TestGenesisBlock))
+	if block, err := ParseJson(raw); err != nil || block.Hash() != TestGenesisBlock.Hash() {
+		t.Errorf("Failed to parse a block's own raw JSON: %v", err)
+	}
+
+	withField := func(field string) string {
+		return strings.Replace(sendJson, "{", "{"+field+",", 1)
+	}
+	long := strings.Repeat("A", 1000)
+	cases := map[string]string{
+		sendJson + strings.Repeat(" ", MaxBlockJSONSize):            ErrBlockJSONTooLarge.Error(),
+		withField(`"balance": {"Hi": {"Lo": 1}}`):                   utils.ErrJSONTooDeep.Error(),
+		withField(`"hash": "` + string(LiveGenesisBlockHash) + `"`): "unknown field",
+		strings.Replace(sendJson, "991CF190", long, 1):              "Invalid previous: 1056 characters",
+		strings.Replace(sendJson, "nano_3e3j", "nano_"+long, 1):     "Invalid destination",
+		strings.Replace(sendJson, `"send"`, `"`+long+`"`, 1):        "Invalid type",
+	}
+	for input, expected := range cases {
+		if _, err := ParseJson([]byte(input)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected error containing %q, got %v", expected, err)
+		}
+	}
+}
+
+// Truncating any prefix of the input must give an error or a block whose
+// fields are all valid, never a panic.
+func TestParseJsonTruncated(t *testing.T) {
+	for i := 0; i < len(sendJson); i++ {
+		block, err := ParseJson([]byte(sendJson[:i] + `"}`))
+		if err == nil {
+			block.Hash()
+		}
+	}
+}
+
+func TestReceiveWorkThreshold(t *testing.T) {
+	WorkThreshold = protocol.WorkTestThreshold
+	defer func() { WorkThreshold = protocol.WorkLiveThreshold }()
+
+	if StateReceiveDifficulty(Epoch2) != 0xf800000000000000 || WorkThresholdFor(State) != 0xf800000000000000 {
+		t.Errorf("Wrong receive threshold %x", StateReceiveDifficulty(Epoch2))
+	}
+	// Only state receives get the discount
+	for _, bt := range []BlockType{Open, Receive, Send, Change} {
+		if WorkThresholdFor(bt) != WorkThreshold {
+			t.Errorf("%s should need the full threshold", bt)
+		}
+	}
+	if StateReceiveDifficulty(Epoch1) != WorkThreshold {
+		t.Errorf("State receives shouldn't get a discount before epoch 2")
+	}
+	if ReducedThreshold(0x8000000000000000, 4) != 0 {
+		t.Errorf("Reduced threshold should bottom out at zero")
+	}
+
+	previous := LiveGenesisBlock.Hash()
+	receive := &ReceiveBlock{previous, LiveGenesisSourceHash, CommonBlock{}}
+	state := &StateBlock{
+		Account:        LiveGenesisBlock.Account,
+		PreviousHash:   previous,
+		Representative: LiveGenesisBlock.Account,
+		Balance:        GenesisAmount,
+		Link:           LiveGenesisSourceHash,
+	}
+
+	// Find a nonce good enough for a state receive but not a legacy one
+	work := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+	for {
+		value := WorkValue(previous.ToBytes(), work)
+		if value >= WorkThresholdFor(State) && value < WorkThreshold {
+			break
+		}
+		incrementWork(work)
+	}
+	state.Work = types.Work(hex.EncodeToString(utils.Reversed(work)))
+	receive.Work = state.Work
+
+	if !ValidateBlockWork(state) {
+		t.Errorf("State receive work rejected")
+	}
+	if ValidateBlockWork(receive) {
+		t.Errorf("State receive work accepted for a legacy receive")
+	}
+
+	// And work generated for a receive validates as one
+	receive.Work = GenerateWorkThreshold(previous, WorkThresholdFor(Receive))
+	if !ValidateBlockWork(receive) {
+		t.Errorf("Generated receive work rejected")
+	}
+}
+
+func TestRequiredDifficulty(t *testing.T) {
+	defer func() { WorkThreshold = protocol.WorkLiveThreshold }()
+
+	tests := []struct {
+		threshold uint64
+		version   AccountVersion
+		expected  uint64
+	}{
+		{protocol.WorkLiveThreshold, Epoch1, 0xffffffc000000000},
+		{protocol.WorkLiveThreshold, Epoch2, 0xfffffff800000000},
+		// Unknown versions get the current rules
+		{protocol.WorkLiveThreshold, 0, 0xfffffff800000000},
+		{protocol.WorkLiveThreshold, CurrentVersion + 1, 0xfffffff800000000},
+		{protocol.WorkTestThreshold, Epoch1, 0xff00000000000000},
+		{protocol.WorkTestThreshold, Epoch2, 0xffe0000000000000},
+		// No work at all still needs some once raised
+		{0, Epoch1, 0},
+		{0, Epoch2, 0xe000000000000001},
+	}
+	for _, test := range tests {
+		WorkThreshold = test.threshold
+		if d := RequiredDifficulty(test.version); d != test.expected {
+			t.Errorf("%x at version %d: got %x, expected %x", test.threshold, test.version, d, test.expected)
+		}
+	}
+
+	receives := []struct {
+		threshold uint64
+		version   AccountVersion
+		expected  uint64
+	}{
+		{protocol.WorkLiveThreshold, Epoch1, 0xffffffc000000000},
+		{protocol.WorkLiveThreshold, Epoch2, 0xfffffe0000000000},
+		{protocol.WorkLiveThreshold, CurrentVersion + 1, 0xfffffe0000000000},
+		{protocol.WorkTestThreshold, Epoch2, 0xf800000000000000},
+		{0, Epoch2, 0},
+	}
+	for _, test := range receives {
+		WorkThreshold = test.threshold
+		if d := StateReceiveDifficulty(test.version); d != test.expected {
+			t.Errorf("State receive at %x version %d: got %x, expected %x", test.threshold, test.version, d, test.expected)
+		}
+	}
+
+	// Work made for the current version is valid at every version
+	WorkThreshold = protocol.WorkTestThreshold
+	for v := Epoch1; v <= CurrentVersion; v++ {
+		if RequiredDifficulty(v) > RequiredDifficulty(CurrentVersion) {
+			t.Errorf("Version %d needs more work than the current one", v)
+		}
+	}
+	for _, bt := range []BlockType{Open, Receive, Send, Change} {
+		if WorkThresholdFor(bt) != RequiredDifficulty(Epoch1) {
+			t.Errorf("Prefilter threshold for %s isn't the lowest", bt)
+		}
+	}
+	if RaisedThreshold(0xfffffffffffffffe, 4) != 0xffffffffffffffff {
+		t.Errorf("Raised threshold should top out short of 2^64")
+	}
+}
+
+func TestExplainOffline(t *testing.T) {
+	send, _ := ParseJson([]byte(sendJson))
+	genesis := TestGenesisBlock.Hash()
+	rep := TestGenesisBlock.Account
+	cases := []struct {
+		block     Block
+		roles     []string
+		signature string
+		height    uint64
+		notes     int
+	}{
+		{TestGenesisBlock, []string{RoleAccount, RoleRepresentative}, ExplainYes, 1, 1},
+		{send, []string{RoleDestination}, ExplainUnknown, 0, 3},
+		{&ReceiveBlock{PreviousHash: genesis, SourceHash: send.Hash()}, nil, ExplainUnknown, 0, 3},
+		{&ChangeBlock{PreviousHash: genesis, Representative: rep}, []string{RoleRepresentative}, ExplainUnknown, 0, 2},
+	}
+	for _, c := range cases {
+		e := Explain(c.block, ExplainSource{})
+		var roles []string
+		for _, a := range e.Accounts {
+			roles = append(roles, a.Role)
+		}
+		if strings.Join(roles, ",") != strings.Join(c.roles, ",") || e.Signature != c.signature || e.Height != c.height || len(e.Notes) != c.notes {
+			t.Errorf("Unexpected offline explanation of %s: %+v", c.block.Type(), e)
+		}
+		if e.Confirmed != ExplainUnknown || e.Amount != "" {
+			t.Errorf("%s explained with the ledger's answers offline", c.block.Type())
+		}
+		if !strings.HasPrefix(e.String(), string(c.block.Type())+" block "+string(c.block.Hash())) {
+			t.Errorf("Unexpected rendering %s", e)
+		}
+	}
+
+	if e := Explain(TestGenesisBlock, ExplainSource{Alias: func(types.Account) string { return "genesis" }}); e.Accounts[0].Alias != "genesis" || !strings.Contains(e.String(), "(genesis)") {
+		t.Errorf("Alias not shown in %s", e)
+	}
+}
+
+func TestMnano(t *testing.T) {
+	for raw, expected := range map[string]string{
+		"0":                                "0",
+		"1":                                "0.000000000000000000000000000001",
+		"1000000000000000000000000000000":  "1",
+		"1500000000000000000000000000000":  "1.5",
+		"12000000000000000000000000000000": "12",
+	} {
+		amount, _ := uint128.FromDecimal(raw)
+		if m := Mnano(amount); m != expected {
+			t.Errorf("%s raw is %s Mnano, expected %s", raw, m, expected)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package blocks
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+)
+
+// Where Explain looks up what a block alone doesn't say. Every lookup is
+// optional: the zero ExplainSource explains a block offline, from its own
+// fields.
+type ExplainSource struct {
+	FetchBlock func(hash types.BlockHash) Block
+	// Balance after a stored block
+	Balance func(block Block) (uint128.Uint128, bool)
+	// The account a block belongs to and its height in the account's
+	// chain, starting at 1 for the open
+	Position  func(block Block) (account types.Account, height uint64, ok bool)
+	Confirmed func(hash types.BlockHash) bool
+	// A name for an account, e.g. from an address book, or ""
+	Alias func(account types.Account) string
+}
+
+// Roles of the accounts a block involves
+const (
+	RoleAccount        = "account"
+	RoleDestination    = "destination"
+	RoleRepresentative = "representative"
+	// Of the send a receive or open claims
+	RoleSender = "sender"
+)
+
+type ExplainedAccount struct {
+	Role    string        `json:"role"`
+	Account types.Account `json:"account"`
+	Alias   string        `json:"alias,omitempty"`
+}
+
+// Yes, no, or couldn't tell without a lookup
+const (
+	ExplainYes     = "yes"
+	ExplainNo      = "no"
+	ExplainUnknown = "unknown"
+)
+
+// An Explanation is what Explain makes of a block, for people to read
+// through ExplainTemplate or a UI's own rendering.
+type Explanation struct {
+	Hash types.BlockHash `json:"hash"`
+	Type BlockType       `json:"type"`
+	// What the block does. Legacy blocks only do what their type says.
+	Subtype  string             `json:"subtype"`
+	Accounts []ExplainedAccount `json:"accounts"`
+	Previous types.BlockHash    `json:"previous,omitempty"`
+	Source   types.BlockHash    `json:"source,omitempty"`
+	// Sent or received, empty if unknown
+	Amount      string `json:"amount,omitempty"`
+	AmountMnano string `json:"amount_mnano,omitempty"`
+	Balance     string `json:"balance,omitempty"`
+
+	WorkValue uint64 `json:"work_value"`
+	// The threshold for the block's type at the current account version
+	WorkThreshold uint64 `json:"work_threshold"`
+	WorkValid     bool   `json:"work_valid"`
+	Signature     string `json:"signature"`
+
+	// Zero if unknown
+	Height    uint64 `json:"height,omitempty"`
+	Confirmed string `json:"confirmed"`
+	// What couldn't be worked out, and why
+	Notes []string `json:"notes,omitempty"`
+}
+
+// Mnano formats raw as Mnano, 10^30 raw, without trailing zeros.
+func Mnano(raw uint128.Uint128) string {
+	digits := raw.Decimal()
+	if len(digits) <= 30 {
+		digits = strings.Repeat("0", 31-len(digits)) + digits
+	}
+	whole, fraction := digits[:len(digits)-30], strings.TrimRight(digits[len(digits)-30:], "0")
+	if fraction == "" {
+		return whole
+	}
+	return whole + "." + fraction
+}
+
+func (e *Explanation) note(note string) {
+	e.Notes = append(e.Notes, note)
+}
+
+func (e *Explanation) addAccount(role string, account types.Account, lookups ExplainSource) {
+	a := ExplainedAccount{Role: role, Account: account}
+	if lookups.Alias != nil {
+		a.Alias = lookups.Alias(account)
+	}
+	e.Accounts = append(e.Accounts, a)
+}
+
+// The balance after hash, if the block and its balance can be looked up.
+func balanceAt(hash types.BlockHash, lookups ExplainSource) (Block, uint128.Uint128, bool) {
+	if lookups.FetchBlock == nil || lookups.Balance == nil {
+		return nil, uint128.Uint128{}, false
+	}
+	block := lookups.FetchBlock(hash)
+	if block == nil {
+		return nil, uint128.Uint128{}, false
+	}
+	balance, ok := lookups.Balance(block)
+	return block, balance, ok
+}
+
+// The amount a send sent, from the balance before it.
+func sentAmount(send *SendBlock, lookups ExplainSource) (uint128.Uint128, bool) {
+	_, before, ok := balanceAt(send.PreviousHash, lookups)
+	if !ok || before.Compare(send.Balance) < 0 {
+		return uint128.Uint128{}, false
+	}
+	return before.Sub(send.Balance), true
+}
+
+// Explain describes a block, looking up its account, amount, position and
+// confirmation with lookups where it can, and noting what it couldn't.
+func Explain(b Block, lookups ExplainSource) Explanation {
+	e := Explanation{
+		Hash:          b.Hash(),
+		Type:          b.Type(),
+		Subtype:       string(b.Type()),
+		WorkValue:     BlockWorkValue(b),
+		WorkThreshold: WorkThresholdFor(b.Type()),
+		Signature:     ExplainUnknown,
+		Confirmed:     ExplainUnknown,
+	}
+	e.WorkValid = e.WorkValue >= e.WorkThreshold
+	if b.Type() != Open {
+		e.Previous = b.PreviousBlockHash()
+	}
+
+	// The account, from the block for opens and state blocks, otherwise
+	// from its chain
+	var account types.Account
+	switch block := b.(type) {
+	case *OpenBlock:
+		account = block.Account
+	case *StateBlock:
+		account = block.Account
+	}
+	if lookups.Position != nil {
+		if a, height, ok := lookups.Position(b); ok {
+			account, e.Height = a, height
+		}
+	}
+	if account != "" {
+		e.addAccount(RoleAccount, account, lookups)
+		if pub, err := address.AddressToPub(account); err == nil {
+			e.Signature = ExplainNo
+			if VerifyBlockSignature(b, pub) {
+				e.Signature = ExplainYes
+			}
+		}
+	} else {
+		e.note("Account unknown without its chain, so the signature wasn't checked")
+	}
+	if e.Height == 0 && b.Type() != Open {
+		e.note("Position in the chain unknown")
+	} else if e.Height == 0 {
+		e.Height = 1
+	}
+
+	var source types.BlockHash
+	switch block := b.(type) {
+	case *SendBlock:
+		e.addAccount(RoleDestination, block.Destination, lookups)
+		e.Balance = block.Balance.Decimal()
+		if amount, ok := sentAmount(block, lookups); ok {
+			e.Amount, e.AmountMnano = amount.Decimal(), Mnano(amount)
+		}
+	case *ReceiveBlock:
+		source = block.SourceHash
+	case *OpenBlock:
+		source = block.SourceHash
+		e.addAccount(RoleRepresentative, block.Representative, lookups)
+	case *ChangeBlock:
+		e.addAccount(RoleRepresentative, block.Representative, lookups)
+	case *StateBlock:
+		e.addAccount(RoleRepresentative, block.Representative, lookups)
+		e.Balance = block.Balance.Decimal()
+	}
+
+	if source != "" {
+		e.Source = source
+		var send *SendBlock
+		if lookups.FetchBlock != nil {
+			send, _ = lookups.FetchBlock(source).(*SendBlock)
+		}
+		if send != nil && lookups.Position != nil {
+			if sender, _, ok := lookups.Position(send); ok {
+				e.addAccount(RoleSender, sender, lookups)
+			}
+		}
+		if send != nil {
+			if amount, ok := sentAmount(send, lookups); ok {
+				e.Amount, e.AmountMnano = amount.Decimal(), Mnano(amount)
+			}
+		}
+	}
+	if e.Amount == "" && b.Type() != Change {
+		e.note("Amount unknown without the ledger")
+	}
+	if b.Type() != Send {
+		if _, balance, ok := balanceAt(e.Hash, lookups); ok {
+			e.Balance = balance.Decimal()
+		}
+	}
+
+	if lookups.Confirmed != nil {
+		e.Confirmed = ExplainNo
+		if lookups.Confirmed(e.Hash) {
+			e.Confirmed = ExplainYes
+		}
+	}
+	return e
+}
+
+// The default rendering of an Explanation. UIs can render the same
+// structure with their own template.
+var ExplainTemplate = template.Must(template.New("explain").Parse(
+	`{{.Type}} block {{.Hash}}
+{{range .Accounts}}  {{printf "%-15s" .Role}} {{.Account}}{{if .Alias}} ({{.Alias}}){{end}}
+{{end}}{{if .Previous}}  previous        {{.Previous}}
+{{end}}{{if .Source}}  source          {{.Source}}
+{{end}}{{if .Amount}}  amount          {{.AmountMnano}} Mnano ({{.Amount}} raw)
+{{end}}{{if .Balance}}  balance         {{.Balance}} raw
+{{end}}  work            {{if .WorkValid}}meets{{else}}below{{end}} the current threshold ({{printf "%016x" .WorkValue}} against {{printf "%016x" .WorkThreshold}})
+  signature valid {{.Signature}}
+{{if .Height}}  height          {{.Height}}
+{{end}}  confirmed       {{.Confirmed}}
+{{range .Notes}}  note: {{.}}
+{{end}}`))
+
+func (e Explanation) String() string {
+	var buf bytes.Buffer
+	if err := ExplainTemplate.Execute(&buf, e); err != nil {
+		return err.Error()
+	}
+	return buf.String()
+}
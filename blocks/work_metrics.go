@@ -0,0 +1,10 @@
+//go:build !light
+// +build !light
+
+package blocks
+
+import "github.com/frankh/nano/metrics"
+
+func init() {
+	timeWork = metrics.WorkDuration.With("cpu").Since
+}
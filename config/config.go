@@ -0,0 +1,361 @@
+//go:build !light
+// +build !light
+
+// Package config reads the node's JSON config file and applies changes to
+// it while the node runs.
+//
+// Fields that take effect on reload: memory_budget_mb, max_peers,
+// max_peers_per_subnet, max_learned_peers_per_minute, peer_expiry_seconds,
+// processor_capacity, processor_account_share, backlog_rate,
+// webhook_breaker_threshold, webhook_max_retry_age_seconds,
+// trace_sample_rate, disk_soft_limit_mb, disk_hard_limit_mb,
+// sync_behind_blocks, sync_behind_cemented, health_required and
+// health_min_peers. Changes to store_path, network, block_log_dir,
+// block_log_retention_hours, rpc_max_request_kb,
+// rpc_replica_staleness_seconds and vote_retention_hours need a restart
+// and are rejected by Reconfigure.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/metrics"
+	"github.com/frankh/nano/node"
+	"github.com/frankh/nano/rpc"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/utils"
+	"github.com/frankh/nano/wallet"
+	"github.com/pkg/errors"
+)
+
+type Config struct {
+	StorePath string `json:"store_path"`
+	// Where every accepted block is logged for ReplayLog, empty for
+	// nowhere, and how long its files are kept
+	BlockLogDir            string `json:"block_log_dir"`
+	BlockLogRetentionHours int64  `json:"block_log_retention_hours"`
+	// live or test
+	Network string `json:"network"`
+	// Larger rpc requests are rejected
+	RPCMaxRequestKB int64 `json:"rpc_max_request_kb"`
+	// How stale a snapshot of the store the rpc may serve block lookups
+	// from, refreshed twice as often. Zero reads everything from the store.
+	RPCReplicaStalenessSeconds int64 `json:"rpc_replica_staleness_seconds"`
+	// How long votes are kept per root, after which only hourly counts
+	// are. Zero keeps them.
+	VoteRetentionHours int64 `json:"vote_retention_hours"`
+
+	// Zero for no budget
+	MemoryBudgetMB            int64   `json:"memory_budget_mb"`
+	MaxPeers                  int     `json:"max_peers"`
+	MaxPeersPerSubnet         int     `json:"max_peers_per_subnet"`
+	MaxLearnedPeersPerMinute  int     `json:"max_learned_peers_per_minute"`
+	PeerExpirySeconds         int64   `json:"peer_expiry_seconds"`
+	ProcessorCapacity         float64 `json:"processor_capacity"`
+	ProcessorAccountShare     float64 `json:"processor_account_share"`
+	BacklogRate               int     `json:"backlog_rate"`
+	WebhookBreakerThreshold   int     `json:"webhook_breaker_threshold"`
+	WebhookMaxRetryAgeSeconds int64   `json:"webhook_max_retry_age_seconds"`
+	// Share of blocks whose stages are traced, from 0 to 1
+	TraceSampleRate float64 `json:"trace_sample_rate"`
+	// Free space under which the node warns, and stops storing blocks
+	DiskSoftLimitMB int64 `json:"disk_soft_limit_mb"`
+	DiskHardLimitMB int64 `json:"disk_hard_limit_mb"`
+	// Blocks and cemented blocks the ledger can be short of its peers'
+	// before it counts as behind
+	SyncBehindBlocks   uint64 `json:"sync_behind_blocks"`
+	SyncBehindCemented uint64 `json:"sync_behind_cemented"`
+	// Comma separated health checks the node needs passing to be ready,
+	// and the peers it needs
+	HealthRequired string `json:"health_required"`
+	HealthMinPeers int    `json:"health_min_peers"`
+}
+
+// What fields left out of a config file are
+var Default = Config{
+	StorePath:                 "DATA",
+	BlockLogRetentionHours:    int64(store.DefaultBlockLogOptions.Retention / time.Hour),
+	Network:                   "live",
+	RPCMaxRequestKB:           rpc.DefaultMaxRequestSize >> 10,
+	VoteRetentionHours:        int64(store.DefaultVoteRetention / time.Hour),
+	MaxPeers:                  node.MaxPeers,
+	MaxPeersPerSubnet:         node.MaxPeersPerSubnet,
+	MaxLearnedPeersPerMinute:  node.MaxLearnedPerMinute,
+	PeerExpirySeconds:         int64(node.PeerExpiry / time.Second),
+	ProcessorCapacity:         node.DefaultProcessorCapacity,
+	ProcessorAccountShare:     node.DefaultAccountShare,
+	BacklogRate:               node.DefaultBacklogRate,
+	WebhookBreakerThreshold:   wallet.WebhookBreakerThreshold,
+	WebhookMaxRetryAgeSeconds: int64(wallet.MaxWebhookRetryAge / time.Second),
+	TraceSampleRate:           metrics.DefaultTraceSampleRate,
+	DiskSoftLimitMB:           node.DefaultDiskSoftLimit >> 20,
+	DiskHardLimitMB:           node.DefaultDiskHardLimit >> 20,
+	SyncBehindBlocks:          node.DefaultSyncBehindBlocks,
+	SyncBehindCemented:        node.DefaultSyncBehindCemented,
+	HealthRequired:            strings.Join(node.DefaultHealthRequired, ","),
+	HealthMinPeers:            node.HealthMinPeers,
+}
+
+func Parse(data []byte) (Config, error) {
+	cfg := Default
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, errors.Wrap(err, "Bad config")
+	}
+	return cfg, cfg.Validate()
+}
+
+func Load(path string) (Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	return Parse(data)
+}
+
+func (c Config) Validate() error {
+	switch {
+	case c.Network != "live" && c.Network != "test":
+		return errors.Errorf("Bad network %q", c.Network)
+	case c.BlockLogRetentionHours < 0:
+		return errors.New("Bad block_log_retention_hours")
+	case c.RPCMaxRequestKB <= 0:
+		return errors.New("Bad rpc_max_request_kb")
+	case c.RPCReplicaStalenessSeconds < 0:
+		return errors.New("Bad rpc_replica_staleness_seconds")
+	case c.VoteRetentionHours < 0:
+		return errors.New("Bad vote_retention_hours")
+	case c.MemoryBudgetMB < 0:
+		return errors.New("Bad memory_budget_mb")
+	case c.MaxPeers < 0 || c.MaxPeersPerSubnet < 0 || c.MaxLearnedPeersPerMinute < 0 || c.PeerExpirySeconds <= 0:
+		return errors.New("Bad peer limit")
+	case c.ProcessorCapacity <= 0 || c.ProcessorAccountShare <= 0 || c.ProcessorAccountShare > 1:
+		return errors.New("Bad processor quota")
+	case c.BacklogRate <= 0:
+		return errors.New("Bad backlog_rate")
+	case c.WebhookBreakerThreshold <= 0 || c.WebhookMaxRetryAgeSeconds <= 0:
+		return errors.New("Bad webhook limit")
+	case c.TraceSampleRate < 0 || c.TraceSampleRate > 1:
+		return errors.New("Bad trace_sample_rate")
+	case c.DiskHardLimitMB < 0 || c.DiskSoftLimitMB < c.DiskHardLimitMB:
+		return errors.New("Bad disk limit")
+	case c.HealthMinPeers < 0:
+		return errors.New("Bad health_min_peers")
+	}
+	return nil
+}
+
+// RequiredHealthChecks splits health_required into check names.
+func (c Config) RequiredHealthChecks() []string {
+	var names []string
+	for _, name := range strings.Split(c.HealthRequired, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+type field struct {
+	name    string
+	restart bool
+	get     func(Config) interface{}
+	apply   func(Config)
+}
+
+// Every field, with how to apply it to a running node
+var fields = []field{
+	{"store_path", true, func(c Config) interface{} { return c.StorePath }, nil},
+	{"block_log_dir", true, func(c Config) interface{} { return c.BlockLogDir }, nil},
+	{"block_log_retention_hours", true, func(c Config) interface{} { return c.BlockLogRetentionHours }, nil},
+	{"network", true, func(c Config) interface{} { return c.Network }, nil},
+	{"rpc_max_request_kb", true, func(c Config) interface{} { return c.RPCMaxRequestKB }, nil},
+	{"rpc_replica_staleness_seconds", true, func(c Config) interface{} { return c.RPCReplicaStalenessSeconds }, nil},
+	{"vote_retention_hours", true, func(c Config) interface{} { return c.VoteRetentionHours }, nil},
+	{"memory_budget_mb", false, func(c Config) interface{} { return c.MemoryBudgetMB }, func(c Config) {
+		utils.SetMemoryBudget(c.MemoryBudgetMB << 20)
+	}},
+	{"max_peers", false, func(c Config) interface{} { return c.MaxPeers }, func(c Config) {
+		node.MaxPeers = c.MaxPeers
+	}},
+	{"max_peers_per_subnet", false, func(c Config) interface{} { return c.MaxPeersPerSubnet }, func(c Config) {
+		node.MaxPeersPerSubnet = c.MaxPeersPerSubnet
+	}},
+	{"max_learned_peers_per_minute", false, func(c Config) interface{} { return c.MaxLearnedPeersPerMinute }, func(c Config) {
+		node.MaxLearnedPerMinute = c.MaxLearnedPeersPerMinute
+	}},
+	{"peer_expiry_seconds", false, func(c Config) interface{} { return c.PeerExpirySeconds }, func(c Config) {
+		node.PeerExpiry = time.Duration(c.PeerExpirySeconds) * time.Second
+	}},
+	{"processor_capacity", false, func(c Config) interface{} { return c.ProcessorCapacity }, func(c Config) {
+		node.Processor.SetQuota(c.ProcessorCapacity, c.ProcessorAccountShare)
+	}},
+	{"processor_account_share", false, func(c Config) interface{} { return c.ProcessorAccountShare }, func(c Config) {
+		node.Processor.SetQuota(c.ProcessorCapacity, c.ProcessorAccountShare)
+	}},
+	{"backlog_rate", false, func(c Config) interface{} { return c.BacklogRate }, func(c Config) {
+		node.Backlog.SetRate(c.BacklogRate)
+	}},
+	{"webhook_breaker_threshold", false, func(c Config) interface{} { return c.WebhookBreakerThreshold }, func(c Config) {
+		wallet.WebhookBreakerThreshold = c.WebhookBreakerThreshold
+	}},
+	{"webhook_max_retry_age_seconds", false, func(c Config) interface{} { return c.WebhookMaxRetryAgeSeconds }, func(c Config) {
+		wallet.MaxWebhookRetryAge = time.Duration(c.WebhookMaxRetryAgeSeconds) * time.Second
+	}},
+	{"trace_sample_rate", false, func(c Config) interface{} { return c.TraceSampleRate }, func(c Config) {
+		metrics.Traces.SetSampleRate(c.TraceSampleRate)
+	}},
+	{"disk_soft_limit_mb", false, func(c Config) interface{} { return c.DiskSoftLimitMB }, func(c Config) {
+		node.Disk.SetLimits(uint64(c.DiskSoftLimitMB)<<20, uint64(c.DiskHardLimitMB)<<20)
+	}},
+	{"disk_hard_limit_mb", false, func(c Config) interface{} { return c.DiskHardLimitMB }, func(c Config) {
+		node.Disk.SetLimits(uint64(c.DiskSoftLimitMB)<<20, uint64(c.DiskHardLimitMB)<<20)
+	}},
+	{"sync_behind_blocks", false, func(c Config) interface{} { return c.SyncBehindBlocks }, func(c Config) {
+		node.Sync.SetThresholds(c.SyncBehindBlocks, c.SyncBehindCemented)
+	}},
+	{"sync_behind_cemented", false, func(c Config) interface{} { return c.SyncBehindCemented }, func(c Config) {
+		node.Sync.SetThresholds(c.SyncBehindBlocks, c.SyncBehindCemented)
+	}},
+	{"health_required", false, func(c Config) interface{} { return c.HealthRequired }, func(c Config) {
+		node.Health.SetRequired(c.RequiredHealthChecks())
+	}},
+	{"health_min_peers", false, func(c Config) interface{} { return c.HealthMinPeers }, func(c Config) {
+		node.HealthMinPeers = c.HealthMinPeers
+	}},
+}
+
+type Change struct {
+	Field string
+	Old   interface{}
+	New   interface{}
+}
+
+// What a reload did with each changed field.
+type Report struct {
+	Applied []Change
+	// Changes that need a restart, left as they were
+	Rejected []Change
+}
+
+func (r Report) String() string {
+	if len(r.Applied) == 0 && len(r.Rejected) == 0 {
+		return "No config changes"
+	}
+	var lines []string
+	for _, c := range r.Applied {
+		lines = append(lines, fmt.Sprintf("%s: %v -> %v", c.Field, c.Old, c.New))
+	}
+	for _, c := range r.Rejected {
+		lines = append(lines, fmt.Sprintf("%s: %v -> %v needs a restart, not applied", c.Field, c.Old, c.New))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Lifecycle holds the config a running node was started with and applies
+// later versions of it.
+type Lifecycle struct {
+	lock    sync.Mutex
+	current Config
+}
+
+// Start applies every reloadable field of cfg.
+func Start(cfg Config) *Lifecycle {
+	for _, f := range fields {
+		if f.apply != nil {
+			f.apply(cfg)
+		}
+	}
+	return &Lifecycle{current: cfg}
+}
+
+func (l *Lifecycle) Current() Config {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.current
+}
+
+// Reconfigure applies the fields that differ in cfg and can change at
+// runtime. Those that need a restart keep their old value.
+func (l *Lifecycle) Reconfigure(cfg Config) (Report, error) {
+	if err := cfg.Validate(); err != nil {
+		return Report{}, err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var report Report
+	for _, f := range fields {
+		old, updated := f.get(l.current), f.get(cfg)
+		if old == updated {
+			continue
+		}
+		if f.restart {
+			report.Rejected = append(report.Rejected, Change{f.name, old, updated})
+		} else {
+			report.Applied = append(report.Applied, Change{f.name, old, updated})
+		}
+	}
+
+	next := cfg
+	next.StorePath, next.Network = l.current.StorePath, l.current.Network
+	for _, f := range fields {
+		if f.apply != nil && f.get(l.current) != f.get(next) {
+			f.apply(next)
+		}
+	}
+	l.current = next
+	return report, nil
+}
+
+// An edit to a watched config file: the new config, or why it couldn't
+// be read.
+type Event struct {
+	Config Config
+	Err    error
+}
+
+// Watch sends an event each time the file at path changes, checking every
+// interval, until done is closed.
+func Watch(path string, interval time.Duration, done chan bool) <-chan Event {
+	events := make(chan Event)
+	modified := func() (time.Time, int64) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return info.ModTime(), info.Size()
+	}
+
+	go func() {
+		defer close(events)
+		lastTime, lastSize := modified()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			t, size := modified()
+			if t.Equal(lastTime) && size == lastSize {
+				continue
+			}
+			lastTime, lastSize = t, size
+
+			cfg, err := Load(path)
+			select {
+			case events <- Event{cfg, err}:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return events
+}
@@ -0,0 +1,162 @@
+//go:build !light
+// +build !light
+
+package config
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/frankh/nano/metrics"
+	"github.com/frankh/nano/node"
+	"github.com/frankh/nano/utils"
+	"github.com/frankh/nano/wallet"
+)
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse([]byte(`{"max_peers": 10}`))
+	if err != nil || cfg.MaxPeers != 10 || cfg.StorePath != Default.StorePath || cfg.BacklogRate != Default.BacklogRate {
+		t.Errorf("Unexpected config %+v, %v", cfg, err)
+	}
+	cfg, _ = Parse([]byte(`{"health_required": "store, rpc,,"}`))
+	if names := cfg.RequiredHealthChecks(); !reflect.DeepEqual(names, []string{"store", "rpc"}) {
+		t.Errorf("Unexpected required health checks %v", names)
+	}
+	for _, bad := range []string{`{`, `{"network": "beta"}`, `{"processor_account_share": 2}`, `{"backlog_rate": 0}`, `{"rpc_max_request_kb": 0}`, `{"health_min_peers": -1}`} {
+		if _, err := Parse([]byte(bad)); err == nil {
+			t.Errorf("Accepted %s", bad)
+		}
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	defer Start(Default)
+	dir, _ := ioutil.TempDir("", "config")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(path, []byte(`{}`), 0600)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := Start(cfg)
+	done := make(chan bool)
+	defer close(done)
+	events := Watch(path, 5*time.Millisecond, done)
+
+	defer func(peers []node.Peer, set map[string]bool) { node.PeerList, node.PeerSet = peers, set }(node.PeerList, node.PeerSet)
+	node.PeerList, node.PeerSet = nil, map[string]bool{}
+	learn := func(i byte) {
+		keepAlive := node.MessageKeepAlive{Peers: []node.Peer{{net.IPv4(10, 0, 0, i), 7075, nil}}}
+		keepAlive.Handle()
+	}
+	learn(1)
+
+	// Make sure the edit gets a new modification time
+	time.Sleep(10 * time.Millisecond)
+	ioutil.WriteFile(path, []byte(`{
+		"store_path": "ELSEWHERE",
+		"memory_budget_mb": 64,
+		"max_peers": 1,
+		"max_learned_peers_per_minute": 3,
+		"peer_expiry_seconds": 3600,
+		"processor_capacity": 500,
+		"processor_account_share": 0.5,
+		"backlog_rate": 7,
+		"webhook_breaker_threshold": 2,
+		"webhook_max_retry_age_seconds": 60,
+		"trace_sample_rate": 0.5
+	}`), 0600)
+
+	var e Event
+	select {
+	case e = <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Edit not seen")
+	}
+	if e.Err != nil {
+		t.Fatal(e.Err)
+	}
+	report, err := l.Reconfigure(e.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Applied) != 10 || len(report.Rejected) != 1 || report.Rejected[0].Field != "store_path" {
+		t.Errorf("Unexpected report:\n%s", report)
+	}
+	if !strings.Contains(report.String(), "store_path: DATA -> ELSEWHERE needs a restart") {
+		t.Errorf("Rejection not reported:\n%s", report)
+	}
+	if l.Current().StorePath != "DATA" || l.Current().MaxPeers != 1 {
+		t.Errorf("Unexpected current config %+v", l.Current())
+	}
+
+	// Each applied change takes effect straight away
+	learn(2)
+	if len(node.PeerList) != 1 {
+		t.Errorf("Peer cap not lowered, have %d peers", len(node.PeerList))
+	}
+	if utils.GetMemoryStats().Budget != 64<<20 {
+		t.Errorf("Memory budget not applied")
+	}
+	if node.MaxLearnedPerMinute != 3 || node.PeerExpiry != time.Hour || node.Processor.Capacity != 500 || node.Processor.Share != 0.5 || node.Backlog.Rate != 7 {
+		t.Errorf("Node limits not applied")
+	}
+	if wallet.WebhookBreakerThreshold != 2 || wallet.MaxWebhookRetryAge != time.Minute {
+		t.Errorf("Webhook limits not applied")
+	}
+	if metrics.Traces.SampleRate() != 0.5 {
+		t.Errorf("Trace sample rate not applied")
+	}
+
+	report, err = l.Reconfigure(l.Current())
+	if err != nil || len(report.Applied) != 0 || report.String() != "No config changes" {
+		t.Errorf("Reloading the same config changed %s", report)
+	}
+	if _, err = l.Reconfigure(Config{}); err == nil {
+		t.Errorf("Invalid config applied")
+	}
+}
+
+func TestCrashLog(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "crashes")
+	defer os.RemoveAll(dir)
+	crashes := NewCrashLog(filepath.Join(dir, "NODE.CRASHES"))
+
+	// Each start that isn't cleaned up counts as a crash
+	for i := 0; i < crashes.Limit; i++ {
+		r, err := crashes.Start()
+		if err != nil || r.Crashes != i || r.Safe {
+			t.Fatalf("Start %d: %+v, %v", i, r, err)
+		}
+	}
+	r, err := crashes.Start()
+	if err != nil || r.Crashes != crashes.Limit || !r.Safe || r.LastStart.IsZero() {
+		t.Fatalf("Expected safe mode at the limit, got %+v, %v", r, err)
+	}
+	if r, _ := crashes.Record(); r.Crashes != crashes.Limit+1 || r.Safe {
+		t.Errorf("Unexpected record %+v", r)
+	}
+
+	if err := crashes.Clean(); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := crashes.Start(); r.Crashes != 0 || r.Safe {
+		t.Errorf("Clean didn't reset the count: %+v", r)
+	}
+
+	crashes.Limit = 0
+	for i := 0; i < 5; i++ {
+		if r, _ := crashes.Start(); r.Safe {
+			t.Fatalf("Safe mode with no limit: %+v", r)
+		}
+	}
+}
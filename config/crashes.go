@@ -0,0 +1,94 @@
+//go:build !light
+// +build !light
+
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Starts in a row that crash before running cleanly, after which the
+// node boots into safe mode
+const DefaultCrashLimit = 3
+
+// How long a start must run to count as clean
+const DefaultCleanRun = 10 * time.Minute
+
+// A CrashLog counts the node's starts that haven't run cleanly, in a file
+// that outlives them. A start counts as a crash until Clean is called, so
+// a crash loop adds up without the crashes having to record anything.
+type CrashLog struct {
+	Path  string
+	Limit int
+	// How long a start must run before the caller calls Clean
+	CleanRun time.Duration
+}
+
+// What a CrashLog's file holds.
+type crashFile struct {
+	// Starts since the last clean run
+	Starts    int
+	LastStart time.Time
+}
+
+type CrashRecord struct {
+	// Starts in a row that haven't run cleanly. Read back while the node
+	// is running, that includes the running start.
+	Crashes int
+	// When the latest of them started
+	LastStart time.Time
+	// Whether to boot into safe mode, as Start decides
+	Safe bool
+}
+
+func NewCrashLog(path string) CrashLog {
+	return CrashLog{Path: path, Limit: DefaultCrashLimit, CleanRun: DefaultCleanRun}
+}
+
+func (c CrashLog) read() (crashFile, error) {
+	var f crashFile
+	data, err := ioutil.ReadFile(c.Path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return f, err
+	}
+	return f, json.Unmarshal(data, &f)
+}
+
+func (c CrashLog) write(f crashFile) error {
+	data, _ := json.Marshal(f)
+	return ioutil.WriteFile(c.Path, data, 0600)
+}
+
+// Record reads the count without starting.
+func (c CrashLog) Record() (CrashRecord, error) {
+	f, err := c.read()
+	return CrashRecord{Crashes: f.Starts, LastStart: f.LastStart}, err
+}
+
+// Start counts a start, as a crash until Clean, and says whether the
+// node should boot into safe mode: once Limit starts in a row have
+// crashed. An unreadable file counts as no crashes.
+func (c CrashLog) Start() (CrashRecord, error) {
+	f, err := c.read()
+	// Every start not cleared by Clean crashed
+	r := CrashRecord{Crashes: f.Starts, LastStart: f.LastStart}
+	r.Safe = c.Limit > 0 && r.Crashes >= c.Limit
+	f.Starts++
+	f.LastStart = time.Now()
+	if werr := c.write(f); err == nil {
+		err = werr
+	}
+	return r, err
+}
+
+// Clean records that the current start ran cleanly, or that an operator
+// took the node out of safe mode, clearing the count.
+func (c CrashLog) Clean() error {
+	return c.write(crashFile{})
+}
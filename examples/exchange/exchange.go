@@ -0,0 +1,254 @@
+// Package exchange is a worked example of the most common commercial use
+// of the node: an exchange with per user deposit addresses, a hot wallet
+// and cold storage. It's kept small so it can be read top to bottom.
+package exchange
+
+import (
+	"encoding/hex"
+	"sync"
+
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/node"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/frankh/nano/wallet"
+	"github.com/pkg/errors"
+)
+
+// Decides whether a deposit is final enough to credit.
+type ConfirmationPolicy func(send *blocks.SendBlock) bool
+
+// Credits a deposit once it's cemented, or the weight of the
+// representatives voting for it reaches quorum. Counting votes isn't
+// enough: one key can send any number of them.
+func QuorumConfirmed() ConfirmationPolicy {
+	return func(send *blocks.SendBlock) bool {
+		if store.IsCemented(send.Hash()) {
+			return true
+		}
+		e, ok := node.GetElectionStats(send.Hash())
+		return ok && e.Confirmed
+	}
+}
+
+// Credits a deposit once its send meets one of the wallet's policies,
+// e.g. wallet.CementedPlusDelay. Pending deposits are looked at again on
+// every Process, so a deposit waiting on time is credited once it's up.
+func WalletConfirmed(policy wallet.ConfirmationPolicy) ConfirmationPolicy {
+	return func(send *blocks.SendBlock) bool {
+		return policy.Confirmed(send.Hash())
+	}
+}
+
+type deposit struct {
+	user   string
+	wallet *wallet.Wallet
+}
+
+type Exchange struct {
+	sync.Mutex
+	seed           string
+	Representative types.Account
+	Hot            *wallet.Wallet
+	Cold           types.Account
+	// Anything in the hot wallet above this is sent to cold storage
+	SweepThreshold uint128.Uint128
+	Confirmed      ConfirmationPolicy
+
+	nextIndex   uint32
+	addresses   map[string]types.Account
+	deposits    map[types.Account]*deposit
+	balances    map[string]uint128.Uint128
+	pending     []*blocks.SendBlock
+	credited    map[types.BlockHash]bool
+	withdrawals map[string]types.BlockHash
+}
+
+// New creates an exchange whose hot wallet is index 0 of seed and whose
+// deposit addresses are the following indexes.
+func New(seed string, cold types.Account, threshold uint128.Uint128, confirmed ConfirmationPolicy) *Exchange {
+	e := &Exchange{
+		seed:           seed,
+		Cold:           cold,
+		SweepThreshold: threshold,
+		Confirmed:      confirmed,
+		nextIndex:      1,
+		addresses:      make(map[string]types.Account),
+		deposits:       make(map[types.Account]*deposit),
+		balances:       make(map[string]uint128.Uint128),
+		credited:       make(map[types.BlockHash]bool),
+		withdrawals:    make(map[string]types.BlockHash),
+	}
+	e.Hot = e.wallet(0)
+	e.Representative = e.Hot.Address()
+	return e
+}
+
+func (e *Exchange) wallet(index uint32) *wallet.Wallet {
+	_, priv := address.KeypairFromSeed(e.seed, index)
+	w := wallet.New(hex.EncodeToString(priv))
+	return &w
+}
+
+// Returns the user's deposit address, allocating one the first time.
+func (e *Exchange) DepositAddress(user string) types.Account {
+	e.Lock()
+	defer e.Unlock()
+
+	account, ok := e.addresses[user]
+	if ok {
+		return account
+	}
+
+	w := e.wallet(e.nextIndex)
+	e.nextIndex++
+	account = w.Address()
+	e.addresses[user] = account
+	e.deposits[account] = &deposit{user, w}
+	return account
+}
+
+func (e *Exchange) Balance(user string) uint128.Uint128 {
+	e.Lock()
+	defer e.Unlock()
+	return e.balances[user]
+}
+
+// Notify is called for every send the node sees. Sends to a deposit
+// address are held until the confirmation policy accepts them.
+func (e *Exchange) Notify(send *blocks.SendBlock) {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.deposits[send.Destination] == nil || e.credited[send.Hash()] {
+		return
+	}
+	for _, p := range e.pending {
+		if p.Hash() == send.Hash() {
+			return
+		}
+	}
+	e.pending = append(e.pending, send)
+}
+
+// Process credits every confirmed deposit, forwards it to the hot wallet
+// and sweeps the hot wallet down to the threshold.
+func (e *Exchange) Process() error {
+	e.Lock()
+	defer e.Unlock()
+
+	var waiting []*blocks.SendBlock
+	for i, send := range e.pending {
+		if !e.Confirmed(send) {
+			waiting = append(waiting, send)
+			continue
+		}
+
+		err := e.credit(send)
+		if err != nil {
+			if !e.credited[send.Hash()] {
+				waiting = append(waiting, send)
+			}
+			e.pending = append(waiting, e.pending[i+1:]...)
+			return err
+		}
+	}
+	e.pending = waiting
+
+	return e.sweep()
+}
+
+func (e *Exchange) credit(send *blocks.SendBlock) error {
+	d := e.deposits[send.Destination]
+	amount := store.GetBalance(store.FetchBlock(send.PreviousHash)).Sub(send.Balance)
+
+	var err error
+	if d.wallet.Head == nil {
+		err = publish(d.wallet, func() (blocks.Block, error) {
+			return d.wallet.Open(send.Hash(), e.Representative)
+		})
+	} else {
+		err = publish(d.wallet, func() (blocks.Block, error) {
+			return d.wallet.Receive(send.Hash())
+		})
+	}
+	if err != nil {
+		return errors.Wrap(err, "Failed to receive deposit")
+	}
+
+	e.credited[send.Hash()] = true
+	e.balances[d.user] = e.balances[d.user].Add(amount)
+
+	var forward *blocks.SendBlock
+	err = publish(d.wallet, func() (b blocks.Block, err error) {
+		forward, err = d.wallet.Send(e.Hot.Address(), d.wallet.GetBalance())
+		return forward, err
+	})
+	if err != nil {
+		return errors.Wrap(err, "Failed to forward deposit")
+	}
+
+	err = publish(e.Hot, func() (blocks.Block, error) {
+		if e.Hot.Head == nil {
+			return e.Hot.Open(forward.Hash(), e.Representative)
+		}
+		return e.Hot.Receive(forward.Hash())
+	})
+	return errors.Wrap(err, "Failed to receive forwarded deposit")
+}
+
+func (e *Exchange) sweep() error {
+	balance := e.Hot.GetBalance()
+	if balance.Compare(e.SweepThreshold) <= 0 {
+		return nil
+	}
+
+	return publish(e.Hot, func() (blocks.Block, error) {
+		return e.Hot.Send(e.Cold, balance.Sub(e.SweepThreshold))
+	})
+}
+
+// Withdraw sends amount from the hot wallet to destination. Retrying with
+// the same id returns the original send instead of paying out twice.
+func (e *Exchange) Withdraw(id string, user string, destination types.Account, amount uint128.Uint128) (types.BlockHash, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	if hash, ok := e.withdrawals[id]; ok {
+		return hash, nil
+	}
+
+	if amount.Compare(e.balances[user]) > 0 {
+		return "", errors.Errorf("Insufficient balance for %s", user)
+	}
+
+	var send blocks.Block
+	err := publish(e.Hot, func() (b blocks.Block, err error) {
+		send, err = e.Hot.Send(destination, amount)
+		return send, err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	e.balances[user] = e.balances[user].Sub(amount)
+	e.withdrawals[id] = send.Hash()
+	return send.Hash(), nil
+}
+
+// Generates work, creates the block and stores it.
+func publish(w *wallet.Wallet, create func() (blocks.Block, error)) error {
+	err := w.GeneratePowSync()
+	if err != nil {
+		return err
+	}
+
+	block, err := create()
+	if err != nil {
+		return err
+	}
+
+	return store.StoreBlock(block)
+}
@@ -0,0 +1,143 @@
+package exchange
+
+import (
+	"encoding/hex"
+	"os"
+	"testing"
+
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/protocol"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/frankh/nano/wallet"
+)
+
+const testSeed = "1234567890123456789012345678901234567890123456789012345678901234"
+
+func TestExchange(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+
+	coldPub, _ := address.GenerateKey()
+	cold := address.PubKeyToAddress(coldPub)
+	customerPub, customerPriv := address.GenerateKey()
+
+	confirmed := make(map[types.BlockHash]bool)
+	e := New(testSeed, cold, uint128.FromInts(0, 100), func(send *blocks.SendBlock) bool {
+		return confirmed[send.Hash()]
+	})
+
+	alice := e.DepositAddress("alice")
+	if e.DepositAddress("alice") != alice || e.DepositAddress("bob") == alice {
+		t.Fatalf("Deposit addresses should be stable and unique per user")
+	}
+
+	genesis := wallet.New(blocks.TestPrivateKey)
+	deposit := func(amount uint128.Uint128) *blocks.SendBlock {
+		genesis.GeneratePowSync()
+		send, err := genesis.Send(alice, amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = store.StoreBlock(send); err != nil {
+			t.Fatal(err)
+		}
+		e.Notify(send)
+		return send
+	}
+
+	first := deposit(uint128.FromInts(0, 150))
+	e.Notify(first)
+	if err := e.Process(); err != nil {
+		t.Fatal(err)
+	}
+	if !isZero(e.Balance("alice")) {
+		t.Errorf("Credited a deposit before it was confirmed")
+	}
+
+	confirmed[first.Hash()] = true
+	if err := e.Process(); err != nil {
+		t.Fatal(err)
+	}
+	if e.Balance("alice") != uint128.FromInts(0, 150) {
+		t.Errorf("Deposit not credited, balance %s", e.Balance("alice"))
+	}
+	// 50 over the threshold should have gone to cold storage
+	if e.Hot.GetBalance() != uint128.FromInts(0, 100) {
+		t.Errorf("Hot wallet not swept, balance %s", e.Hot.GetBalance())
+	}
+
+	second := deposit(uint128.FromInts(0, 30))
+	confirmed[second.Hash()] = true
+	e.Process()
+	e.Notify(second)
+	e.Process()
+	if e.Balance("alice") != uint128.FromInts(0, 180) {
+		t.Errorf("Second deposit not credited exactly once, balance %s", e.Balance("alice"))
+	}
+
+	customer := address.PubKeyToAddress(customerPub)
+	hash, err := e.Withdraw("w1", "alice", customer, uint128.FromInts(0, 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	retry, err := e.Withdraw("w1", "alice", customer, uint128.FromInts(0, 80))
+	if err != nil || retry != hash {
+		t.Errorf("Retried withdrawal should return the original send")
+	}
+	if e.Balance("alice") != uint128.FromInts(0, 100) {
+		t.Errorf("Withdrawal debited wrongly, balance %s", e.Balance("alice"))
+	}
+
+	_, err = e.Withdraw("w2", "alice", customer, uint128.FromInts(0, 101))
+	if err == nil {
+		t.Errorf("Withdrew more than the user's balance")
+	}
+
+	// The customer can pick the withdrawal up with their own wallet
+	w := wallet.New(hex.EncodeToString(customerPriv))
+	w.GeneratePowSync()
+	open, err := w.Open(hash, customer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.StoreBlock(open); err != nil {
+		t.Fatal(err)
+	}
+	if w.GetBalance() != uint128.FromInts(0, 80) {
+		t.Errorf("Customer received %s", w.GetBalance())
+	}
+}
+
+func isZero(u uint128.Uint128) bool {
+	return u.Hi == 0 && u.Lo == 0
+}
+
+func TestQuorumConfirmed(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+
+	genesis := wallet.New(blocks.TestPrivateKey)
+	genesis.GeneratePowSync()
+	send, _ := genesis.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 1))
+	if err := store.StoreBlock(send); err != nil {
+		t.Fatal(err)
+	}
+
+	confirmed := QuorumConfirmed()
+	if confirmed(send) {
+		t.Errorf("Credited a deposit nobody voted for")
+	}
+	cementer, _ := store.NewConfirmationHeightProcessor(10, nil)
+	cementer.Add(send.Hash())
+	if err := cementer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !confirmed(send) {
+		t.Errorf("Cemented deposit not credited")
+	}
+}
@@ -0,0 +1,182 @@
+// Command corpusgen writes a test corpus for client developers: a small
+// ledger built by nanotest.Build from a seed, as a snapshot, with the rpc
+// responses to a list of standard queries against it and the event
+// stream its confirmations produce. The same seed always gives
+// byte-identical files, so client tests can pin hashes.
+//
+//	corpusgen [-seed seed] [-out dir]
+//
+// It writes:
+//   - corpus.json, the accounts with their private keys, and where the
+//     ledger's fork, upgrade, dust and pruned account are
+//   - ledger.snapshot, signed with the test genesis key
+//   - rpc.json, each query with the node's response
+//   - events.ndjson, as GET /events streams them
+//
+// The snapshot is taken before the emptied account is pruned, as
+// snapshots carry whole chains; the rpc responses are from after.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/nanotest"
+	"github.com/frankh/nano/node"
+	"github.com/frankh/nano/protocol"
+	"github.com/frankh/nano/rpc"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/utils"
+)
+
+// Where the corpus's clocks start, 2020-01-01 UTC in unix seconds
+const corpusStart = 1577836800
+
+// A query and the node's response, both as sent
+type exchange struct {
+	Request  json.RawMessage `json:"request"`
+	Response json.RawMessage `json:"response"`
+}
+
+func main() {
+	seed := flag.String("seed", "nano", "Seed the corpus is generated from")
+	out := flag.String("out", "corpus", "Directory to write the corpus to")
+	flag.Parse()
+	if err := generate(*seed, *out); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func generate(seed string, out string) error {
+	dir, err := ioutil.TempDir("", "corpusgen")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	store.Init(store.Config{Path: dir, GenesisBlock: blocks.TestGenesisBlock})
+
+	threshold, clock := blocks.WorkThreshold, store.Clock
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	store.Clock = utils.NewFakeClock(time.Unix(corpusStart, 0))
+	defer func() { blocks.WorkThreshold, store.Clock = threshold, clock }()
+
+	ledger, err := nanotest.Build(seed)
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string][]byte)
+	var snapshot bytes.Buffer
+	_, genesisKey := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	if err = store.ExportSnapshot(&snapshot, genesisKey); err != nil {
+		return err
+	}
+	files["ledger.snapshot"] = snapshot.Bytes()
+	if files["events.ndjson"], err = events(ledger); err != nil {
+		return err
+	}
+
+	ledger.Prune()
+	if files["rpc.json"], err = responses(ledger); err != nil {
+		return err
+	}
+	if files["corpus.json"], err = json.MarshalIndent(ledger, "", "  "); err != nil {
+		return err
+	}
+	files["corpus.json"] = append(files["corpus.json"], '\n')
+
+	if err = os.MkdirAll(out, 0755); err != nil {
+		return err
+	}
+	for name, data := range files {
+		if err = ioutil.WriteFile(filepath.Join(out, name), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The events a node streams as it confirms the ledger's blocks in order,
+// a second apart, between summaries.
+func events(ledger *nanotest.Ledger) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	at := time.Unix(corpusStart, 0)
+	publish := func(e node.Event) error {
+		e.Time = at.UnixNano() / int64(time.Millisecond)
+		at = at.Add(time.Second)
+		return encoder.Encode(e)
+	}
+
+	if err := publish(node.Event{Type: node.EventSummary}); err != nil {
+		return nil, err
+	}
+	for _, hash := range ledger.Blocks {
+		if err := publish(node.ConfirmationEvent(hash)); err != nil {
+			return nil, err
+		}
+		if hash != ledger.ForkKept {
+			continue
+		}
+		proof, _ := store.FetchForkProof(ledger.ForkRoot)
+		if err := publish(node.Event{Type: node.EventFork, Hash: proof.Root, Account: proof.Account}); err != nil {
+			return nil, err
+		}
+	}
+	summary := node.Event{Type: node.EventSummary, Confirmations: uint64(len(ledger.Blocks))}
+	if err := publish(summary); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// The standard queries: each account's info, history and pending, the
+// representatives, the fork proof, an explanation of every block and the
+// unchecked blocks.
+func queries(ledger *nanotest.Ledger) []map[string]string {
+	var list []map[string]string
+	accounts := append([]nanotest.Account{ledger.Genesis}, ledger.Accounts...)
+	for _, a := range accounts {
+		account := string(a.Address)
+		list = append(list,
+			map[string]string{"action": "account_info", "account": account, "receivable": "true"},
+			map[string]string{"action": "account_history", "account": account},
+			map[string]string{"action": "pending", "account": account},
+		)
+	}
+	list = append(list,
+		map[string]string{"action": "representatives"},
+		map[string]string{"action": "fork_proof", "root": string(ledger.ForkRoot)},
+	)
+	for _, hash := range append([]types.BlockHash{blocks.TestGenesisBlock.Hash()}, ledger.Blocks...) {
+		list = append(list, map[string]string{"action": "block_explain", "hash": string(hash)})
+	}
+	return append(list, map[string]string{"action": "unchecked"})
+}
+
+func responses(ledger *nanotest.Ledger) ([]byte, error) {
+	server := rpc.NewServer(false)
+	var exchanges []exchange
+	for _, query := range queries(ledger) {
+		request, err := json.Marshal(query)
+		if err != nil {
+			return nil, err
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest("POST", "/", bytes.NewReader(request)))
+		exchanges = append(exchanges, exchange{request, bytes.TrimSpace(rec.Body.Bytes())})
+	}
+	data, err := json.MarshalIndent(exchanges, "", "  ")
+	return append(data, '\n'), err
+}
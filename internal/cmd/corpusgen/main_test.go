@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/frankh/crypto/ed25519"
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/protocol"
+	"github.com/frankh/nano/store"
+)
+
+var corpusFiles = []string{"corpus.json", "ledger.snapshot", "rpc.json", "events.ndjson"}
+
+func TestDeterministic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "corpusgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, run := range []string{"a", "b", "other"} {
+		seed := "seed"
+		if run == "other" {
+			seed = "other"
+		}
+		if err := generate(seed, filepath.Join(dir, run)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range corpusFiles {
+		a, _ := ioutil.ReadFile(filepath.Join(dir, "a", name))
+		b, _ := ioutil.ReadFile(filepath.Join(dir, "b", name))
+		other, _ := ioutil.ReadFile(filepath.Join(dir, "other", name))
+		if len(a) == 0 || !bytes.Equal(a, b) {
+			t.Errorf("%s differs between runs with the same seed", name)
+		}
+		if bytes.Equal(a, other) {
+			t.Errorf("%s is the same for different seeds", name)
+		}
+	}
+
+	// The snapshot loads into an empty node that trusts the genesis key
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = protocol.WorkLiveThreshold }()
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	snapshot, _ := ioutil.ReadFile(filepath.Join(dir, "a", "ledger.snapshot"))
+	pub, _ := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	if _, err := store.ImportSnapshot(bytes.NewReader(snapshot), []ed25519.PublicKey{pub}); err != nil {
+		t.Errorf("Snapshot doesn't import: %s", err)
+	}
+}
@@ -0,0 +1,23 @@
+// Command sizecheck is the smallest light client: it derives an account
+// and prepares a wallet for signing, without a node. Its test checks that
+// built with the light tag it leaves out the node's network and storage
+// packages.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/wallet"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println("usage: sizecheck <private key>")
+		os.Exit(1)
+	}
+	pub, _ := address.KeypairFromPrivateKey(os.Args[1])
+	w := wallet.New(os.Args[1])
+	fmt.Println(address.PubKeyToAddress(pub), w.DescribeBalance())
+}
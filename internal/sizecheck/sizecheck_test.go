@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Packages a light client must not pull in
+var heavy = []string{
+	"github.com/frankh/nano/config",
+	"github.com/frankh/nano/metrics",
+	"github.com/frankh/nano/node",
+	"github.com/frankh/nano/rpc",
+	"github.com/frankh/nano/rpcclient",
+	"github.com/frankh/nano/store",
+	"github.com/dgraph-io/badger",
+	"net",
+	"net/http",
+}
+
+// The core data packages, which may only import each other, the standard
+// library and the crypto they're built on
+var core = []string{
+	"github.com/frankh/nano/address",
+	"github.com/frankh/nano/blocks",
+	"github.com/frankh/nano/protocol",
+	"github.com/frankh/nano/types",
+	"github.com/frankh/nano/uint128",
+	"github.com/frankh/nano/utils",
+}
+
+var crypto = []string{
+	"github.com/frankh/crypto/ed25519",
+	"github.com/golang/crypto/blake2b",
+}
+
+func goTool(t *testing.T, args ...string) string {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("No go tool")
+	}
+	out, err := exec.Command("go", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("go %s: %s\n%s", strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+func TestLightBuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sizecheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	goTool(t, "build", "-tags", "light", "-o", filepath.Join(dir, "sizecheck"), ".")
+
+	deps := make(map[string]bool)
+	for _, dep := range strings.Fields(goTool(t, "list", "-tags", "light", "-deps", ".")) {
+		deps[dep] = true
+	}
+	if !deps["github.com/frankh/nano/wallet"] {
+		t.Fatalf("Wallet missing from the dependencies")
+	}
+	for _, pkg := range heavy {
+		if deps[pkg] {
+			t.Errorf("Light build pulls in %s", pkg)
+		}
+	}
+}
+
+func TestCoreImports(t *testing.T) {
+	allowed := make(map[string]bool)
+	for _, pkg := range append(append([]string{}, core...), crypto...) {
+		allowed[pkg] = true
+	}
+	args := append([]string{"list", "-tags", "light", "-f", `{{.ImportPath}} {{join .Imports " "}}`}, core...)
+	for _, line := range strings.Split(strings.TrimSpace(goTool(t, args...)), "\n") {
+		imports := strings.Fields(line)
+		for _, imp := range imports[1:] {
+			standard := !strings.Contains(strings.Split(imp, "/")[0], ".")
+			if !standard && !allowed[imp] {
+				t.Errorf("%s imports %s", imports[0], imp)
+			}
+		}
+	}
+}
+
+// Everything, tests included, must still build with the light tag, so
+// code left out of light builds can't be used from code that isn't.
+// Unkeyed fields are the repo's style, so that check's left out.
+func TestLightVet(t *testing.T) {
+	goTool(t, "vet", "-tags", "light", "-composites=false", "../../...")
+}
@@ -0,0 +1,223 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds x2 apart from start.
+func ExponentialBuckets(start time.Duration, count int) []time.Duration {
+	bounds := make([]time.Duration, count)
+	for i := range bounds {
+		bounds[i] = start << uint(i)
+	}
+	return bounds
+}
+
+// 1µs to ~16ms, for decoding and handling messages
+var MicroBuckets = ExponentialBuckets(time.Microsecond, 15)
+
+// 100µs to ~13s, for block processing and store commits
+var MilliBuckets = ExponentialBuckets(100*time.Microsecond, 18)
+
+// 10ms to ~11 minutes, for work generation and elections
+var SecondBuckets = ExponentialBuckets(10*time.Millisecond, 17)
+
+// Histogram is one series of a HistogramVec. Observe doesn't allocate or
+// lock.
+type Histogram struct {
+	// First for 64 bit alignment of atomics
+	sum    int64
+	count  uint64
+	bounds []time.Duration
+	// One more than bounds, the last is +Inf
+	counts []uint64
+}
+
+func newHistogram(bounds []time.Duration) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *Histogram) bucket(d time.Duration) int {
+	lo, hi := 0, len(h.bounds)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if h.bounds[mid] >= d {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return lo
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	atomic.AddUint64(&h.counts[h.bucket(d)], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+	atomic.AddUint64(&h.count, 1)
+}
+
+// Observes the time since start.
+func (h *Histogram) Since(start time.Time) {
+	h.Observe(time.Since(start))
+}
+
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+// HistogramVec is a histogram partitioned by one label. Look series up
+// with With once, outside the hot path.
+type HistogramVec struct {
+	Name   string
+	Help   string
+	Label  string
+	bounds []time.Duration
+	lock   sync.Mutex
+	series map[string]*Histogram
+}
+
+var registry struct {
+	lock   sync.Mutex
+	vecs   []*HistogramVec
+	gauges []*GaugeFunc
+}
+
+// Registers a histogram for the exporter. An empty label gives a single
+// series, looked up with With("").
+func NewHistogramVec(name string, help string, label string, bounds []time.Duration) *HistogramVec {
+	v := &HistogramVec{
+		Name:   name,
+		Help:   help,
+		Label:  label,
+		bounds: bounds,
+		series: make(map[string]*Histogram),
+	}
+
+	registry.lock.Lock()
+	registry.vecs = append(registry.vecs, v)
+	registry.lock.Unlock()
+	return v
+}
+
+func (v *HistogramVec) With(value string) *Histogram {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	h := v.series[value]
+	if h == nil {
+		h = newHistogram(v.bounds)
+		v.series[value] = h
+	}
+	return h
+}
+
+// GaugeFunc reports values read when scraped, one series per label
+// value, for state that's already tracked elsewhere.
+type GaugeFunc struct {
+	Name  string
+	Help  string
+	Label string
+	fn    func() map[string]float64
+}
+
+func NewGaugeFunc(name string, help string, label string, fn func() map[string]float64) *GaugeFunc {
+	g := &GaugeFunc{Name: name, Help: help, Label: label, fn: fn}
+
+	registry.lock.Lock()
+	registry.gauges = append(registry.gauges, g)
+	registry.lock.Unlock()
+	return g
+}
+
+var MessageDuration = NewHistogramVec("nano_message_handling_seconds", "Time to decode and handle a message.", "type", MicroBuckets)
+var ProcessDuration = NewHistogramVec("nano_block_process_seconds", "Time to validate and store a block.", "result", MilliBuckets)
+var CommitDuration = NewHistogramVec("nano_store_commit_seconds", "Time to commit a store transaction.", "", MilliBuckets)
+var WorkDuration = NewHistogramVec("nano_work_generation_seconds", "Time to generate proof of work.", "provider", SecondBuckets)
+var ElectionDuration = NewHistogramVec("nano_election_seconds", "Time from first seeing a block to its confirmation.", "", SecondBuckets)
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'g', -1, 64)
+}
+
+func (v *HistogramVec) write(w *bufio.Writer) {
+	v.lock.Lock()
+	values := make([]string, 0, len(v.series))
+	for value := range v.series {
+		values = append(values, value)
+	}
+	v.lock.Unlock()
+	sort.Strings(values)
+
+	fmt.Fprintf(w, "# HELP %s %s\n", v.Name, v.Help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", v.Name)
+
+	for _, value := range values {
+		h := v.With(value)
+		labels := ""
+		if v.Label != "" {
+			labels = fmt.Sprintf("%s=%q,", v.Label, value)
+		}
+
+		var cumulative uint64
+		for i, bound := range h.bounds {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", v.Name, labels, seconds(bound), cumulative)
+		}
+		cumulative += atomic.LoadUint64(&h.counts[len(h.bounds)])
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", v.Name, labels, cumulative)
+
+		labels = ""
+		if v.Label != "" {
+			labels = fmt.Sprintf("{%s=%q}", v.Label, value)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.Name, labels, seconds(time.Duration(atomic.LoadInt64(&h.sum))))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.Name, labels, cumulative)
+	}
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	series := g.fn()
+	values := make([]string, 0, len(series))
+	for value := range series {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	fmt.Fprintf(w, "# HELP %s %s\n", g.Name, g.Help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", g.Name)
+	for _, value := range values {
+		labels := ""
+		if g.Label != "" {
+			labels = fmt.Sprintf("{%s=%q}", g.Label, value)
+		}
+		fmt.Fprintf(w, "%s%s %s\n", g.Name, labels, strconv.FormatFloat(series[value], 'g', -1, 64))
+	}
+}
+
+// Handler serves every registered histogram and gauge in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w := bufio.NewWriter(rw)
+		defer w.Flush()
+
+		registry.lock.Lock()
+		vecs := append([]*HistogramVec{}, registry.vecs...)
+		gauges := append([]*GaugeFunc{}, registry.gauges...)
+		registry.lock.Unlock()
+
+		for _, v := range vecs {
+			v.write(w)
+		}
+		for _, g := range gauges {
+			g.write(w)
+		}
+	})
+}
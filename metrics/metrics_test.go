@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/frankh/nano/types"
+)
+
+func TestBucket(t *testing.T) {
+	h := newHistogram(ExponentialBuckets(time.Millisecond, 3))
+	cases := map[time.Duration]int{
+		0:                    0,
+		time.Millisecond:     0,
+		time.Millisecond + 1: 1,
+		4 * time.Millisecond: 2,
+		time.Second:          3,
+	}
+	for d, bucket := range cases {
+		if b := h.bucket(d); b != bucket {
+			t.Errorf("%s in bucket %d, expected %d", d, b, bucket)
+		}
+	}
+}
+
+func TestObserveDoesntAllocate(t *testing.T) {
+	h := NewHistogramVec("test_alloc_seconds", "Test.", "", MicroBuckets).With("")
+	allocs := testing.AllocsPerRun(100, func() { h.Observe(3 * time.Microsecond) })
+	if allocs != 0 {
+		t.Errorf("Observe allocated %f times", allocs)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	v := NewHistogramVec("test_seconds", "Test.", "kind", ExponentialBuckets(time.Millisecond, 2))
+	v.With("a").Observe(time.Millisecond)
+	v.With("a").Observe(time.Second)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, line := range []string{
+		`# TYPE test_seconds histogram`,
+		`test_seconds_bucket{kind="a",le="0.001"} 1`,
+		`test_seconds_bucket{kind="a",le="0.002"} 1`,
+		`test_seconds_bucket{kind="a",le="+Inf"} 2`,
+		`test_seconds_sum{kind="a"} 1.001`,
+		`test_seconds_count{kind="a"} 2`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Missing %s in\n%s", line, body)
+		}
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	NewGaugeFunc("test_bytes", "Test.", "kind", func() map[string]float64 {
+		return map[string]float64{"b": 1.5, "a": 2048}
+	})
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	expected := "# HELP test_bytes Test.\n# TYPE test_bytes gauge\ntest_bytes{kind=\"a\"} 2048\ntest_bytes{kind=\"b\"} 1.5\n"
+	if !strings.Contains(body, expected) {
+		t.Errorf("Missing gauge in\n%s", body)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	hash := types.BlockHash(strings.Repeat("AB", 32))
+	start := time.Unix(1000, 0)
+
+	none := NewTracer(10, 0)
+	none.RecordAt(hash, StageReceived, start)
+	if _, ok := none.Timeline(hash); ok {
+		t.Errorf("Traced with a sample rate of 0")
+	}
+
+	tracer := NewTracer(2, 1)
+	processed := StageDuration.With(StageProcessed).Count()
+	tracer.RecordAt(hash, StageReceived, start)
+	tracer.RecordAt(hash, StageProcessed, start.Add(5*time.Millisecond))
+	tracer.RecordAt(hash, StageProcessed, start.Add(time.Second))
+	events, ok := tracer.Timeline(hash)
+	if !ok || len(events) != 2 || events[1].Stage != StageProcessed || !events[1].Time.Equal(start.Add(5*time.Millisecond)) {
+		t.Errorf("Wrong timeline %v", events)
+	}
+	if StageDuration.With(StageProcessed).Count() != processed+1 {
+		t.Errorf("Stage duration not observed once")
+	}
+
+	// The oldest trace goes once full
+	tracer.Record(types.BlockHash(strings.Repeat("CD", 32)), StageReceived)
+	tracer.Record(types.BlockHash(strings.Repeat("EF", 32)), StageReceived)
+	if _, ok := tracer.Timeline(hash); ok {
+		t.Errorf("Oldest trace not evicted")
+	}
+}
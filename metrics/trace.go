@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/types"
+)
+
+// Stages of a block's way through the node, in the order they're usually
+// reached
+const (
+	StageReceived    = "received"
+	StageDecoded     = "decoded"
+	StageWorkChecked = "work_checked"
+	StageProcessed   = "processed"
+	StageElection    = "election_started"
+	StageConfirmed   = "confirmed"
+	StageCemented    = "cemented"
+	StageCallback    = "callback_delivered"
+)
+
+// Blocks whose timelines are kept
+const DefaultTraceSize = 10000
+
+const DefaultTraceSampleRate = 0.01
+
+var StageDuration = NewHistogramVec("nano_block_stage_seconds", "Time from a traced block's previous stage to each stage.", "stage", MilliBuckets)
+
+type TraceEvent struct {
+	Stage string
+	Time  time.Time
+}
+
+// A Tracer records when sampled blocks reach each stage, keeping the
+// most recent blocks' timelines. The time since a block's previous stage
+// goes to StageDuration. A nil Tracer records nothing.
+type Tracer struct {
+	lock sync.Mutex
+	// Sampled hashes below this, of the 32 bit hash space
+	threshold uint64
+	max       int
+	traces    map[types.BlockHash][]TraceEvent
+	// Oldest first, for evicting once full
+	order []types.BlockHash
+}
+
+func NewTracer(max int, sampleRate float64) *Tracer {
+	t := &Tracer{max: max, traces: make(map[types.BlockHash][]TraceEvent)}
+	t.SetSampleRate(sampleRate)
+	return t
+}
+
+var Traces = NewTracer(DefaultTraceSize, DefaultTraceSampleRate)
+
+// SetSampleRate sets the share of blocks traced, from 0 to 1.
+func (t *Tracer) SetSampleRate(rate float64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.threshold = uint64(math.Max(0, math.Min(1, rate)) * (1 << 32))
+}
+
+func (t *Tracer) SampleRate() float64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return float64(t.threshold) / (1 << 32)
+}
+
+// Whether hash is traced. Decided by the hash, so every stage of a block
+// agrees.
+func (t *Tracer) sampled(hash types.BlockHash) bool {
+	h := fnv.New32a()
+	h.Write([]byte(hash))
+	return uint64(h.Sum32()) < t.threshold
+}
+
+func (t *Tracer) Record(hash types.BlockHash, stage string) {
+	t.RecordAt(hash, stage, time.Now())
+}
+
+// RecordAt records that hash reached stage at a time, for stages only
+// known to have been reached once the hash is. Only the first time a
+// block reaches each stage counts.
+func (t *Tracer) RecordAt(hash types.BlockHash, stage string, at time.Time) {
+	if t == nil || hash == "" {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.sampled(hash) {
+		return
+	}
+
+	events, ok := t.traces[hash]
+	if !ok {
+		if len(t.order) >= t.max {
+			delete(t.traces, t.order[0])
+			t.order = t.order[1:]
+		}
+		t.order = append(t.order, hash)
+	}
+	for _, e := range events {
+		if e.Stage == stage {
+			return
+		}
+	}
+	if len(events) > 0 {
+		StageDuration.With(stage).Observe(at.Sub(events[len(events)-1].Time))
+	}
+	t.traces[hash] = append(events, TraceEvent{stage, at})
+}
+
+// Timeline returns the stages hash has reached, in the order recorded.
+func (t *Tracer) Timeline(hash types.BlockHash) ([]TraceEvent, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	events, ok := t.traces[hash]
+	return append([]TraceEvent{}, events...), ok
+}
@@ -0,0 +1,266 @@
+// Package nanotest builds small ledgers for tests and fixtures. The same
+// seed always gives the same accounts, blocks and hashes, so tests built
+// on them can pin hashes.
+package nanotest
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/frankh/crypto/ed25519"
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/golang/crypto/blake2b"
+	"github.com/pkg/errors"
+)
+
+// Names of the accounts Build creates, after the genesis account
+var AccountNames = []string{"alice", "bob", "carol", "dave", "rep"}
+
+type Account struct {
+	Name    string        `json:"name"`
+	Address types.Account `json:"address"`
+	// Hex, as wallet.New takes it
+	Private string `json:"private"`
+}
+
+// A Ledger is what Build stored, and where to find its interesting parts.
+type Ledger struct {
+	Seed     string    `json:"seed"`
+	Genesis  Account   `json:"genesis"`
+	Accounts []Account `json:"accounts"`
+	// Every block stored after the genesis block, in order
+	Blocks []types.BlockHash `json:"blocks"`
+	// A fork on ForkRoot, which ForkKept won over ForkLost
+	ForkRoot types.BlockHash `json:"fork_root"`
+	ForkKept types.BlockHash `json:"fork_kept"`
+	ForkLost types.BlockHash `json:"fork_lost"`
+	// Moved to the current version part way through its chain
+	Upgraded types.Account `json:"upgraded"`
+	// Sends left pending below store.DustThreshold
+	Dust []types.BlockHash `json:"dust"`
+	// Emptied so Prune has something to prune
+	Empty types.Account `json:"empty"`
+}
+
+func (l *Ledger) Account(name string) Account {
+	for _, a := range l.Accounts {
+		if a.Name == name {
+			return a
+		}
+	}
+	return Account{}
+}
+
+// Builds chains on the store's heads, with work for each account's version.
+type builder struct {
+	ledger   *Ledger
+	keys     map[types.Account]ed25519.PrivateKey
+	heads    map[types.Account]blocks.Block
+	versions map[types.Account]blocks.AccountVersion
+}
+
+// Mnano in raw
+var mnano, _ = uint128.FromDecimal("1000000000000000000000000000000")
+
+// Key derives the private key of an account from the seed.
+func Key(seed string, index uint32) ed25519.PrivateKey {
+	hash := blake2b.Sum256([]byte(seed))
+	_, priv := address.KeypairFromSeed(hex.EncodeToString(hash[:]), index)
+	return priv
+}
+
+func newAccount(name string, priv ed25519.PrivateKey) Account {
+	pub := priv.Public().(ed25519.PublicKey)
+	return Account{name, address.PubKeyToAddress(pub), strings.ToUpper(hex.EncodeToString(priv[:32]))}
+}
+
+// Build stores a small ledger on the store's genesis block, which must be
+// blocks.TestGenesisBlock. Between its accounts it has:
+//   - opens, sends, receives and changes
+//   - an account upgraded to the current version part way through
+//   - a fork, recorded with its proof, that the first block won
+//   - dust left pending, and an account with only pending sends
+//   - an emptied account, for Prune
+//
+// All work is generated, so use the test work threshold. There are no
+// state blocks here, nor epoch blocks: the upgrade is only recorded in
+// the store, as store.UpgradeAccount does.
+func Build(seed string) (*Ledger, error) {
+	genesis := blocks.TestGenesisBlock
+	if store.Conf == nil || store.Conf.GenesisBlock.Hash() != genesis.Hash() {
+		return nil, errors.New("Store isn't on the test genesis block")
+	}
+	_, genesisKey := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	l := &Ledger{Seed: seed, Genesis: newAccount("genesis", genesisKey)}
+	b := &builder{
+		ledger:   l,
+		keys:     map[types.Account]ed25519.PrivateKey{genesis.Account: genesisKey},
+		heads:    map[types.Account]blocks.Block{genesis.Account: genesis},
+		versions: make(map[types.Account]blocks.AccountVersion),
+	}
+	for i, name := range AccountNames {
+		a := newAccount(name, Key(seed, uint32(i)))
+		b.keys[a.Address] = Key(seed, uint32(i))
+		l.Accounts = append(l.Accounts, a)
+	}
+	g, alice, bob := genesis.Account, l.Account("alice").Address, l.Account("bob").Address
+	carol, dave, rep := l.Account("carol").Address, l.Account("dave").Address, l.Account("rep").Address
+
+	// Amounts vary with the seed, so different seeds differ in more than
+	// their keys
+	hash := blake2b.Sum256([]byte(seed))
+	amount := func(i int, unit uint128.Uint128) uint128.Uint128 {
+		return mul(unit, uint64(hash[i%len(hash)])%9+1)
+	}
+	dust := store.DustThreshold.Sub(uint128.FromInts(0, 1))
+
+	steps := []func() error{
+		func() error { return b.transfer(g, alice, amount(0, mul(mnano, 100)), rep) },
+		func() error { return b.transfer(g, bob, amount(1, mul(mnano, 10)), rep) },
+		func() error { return b.transfer(g, rep, amount(2, mnano), rep) },
+		func() error { return b.transfer(alice, bob, amount(3, mnano), "") },
+		func() error { return b.change(bob, alice) },
+		func() error { return b.upgrade(alice) },
+		func() error { return b.transfer(alice, bob, amount(4, mnano), "") },
+		func() error { return b.fork(bob, alice, carol, amount(5, mnano)) },
+		func() error { return b.transfer(g, dave, amount(6, mnano), rep) },
+		func() error { return b.transfer(alice, dave, amount(7, mnano), "") },
+		func() error { return b.change(dave, alice) },
+		func() error { return b.empty(dave, alice) },
+		// carol never opens
+		func() error { _, err := b.send(g, carol, amount(8, mnano)); return err },
+		func() error { return b.dust(g, carol, uint128.FromInts(0, 1)) },
+		func() error { return b.dust(alice, bob, dust) },
+		func() error { return b.dust(g, bob, amount(9, uint128.FromInts(0, 1000000))) },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Prune prunes the emptied account's history, returning the blocks
+// pruned. Snapshots can't carry pruned chains, so export first.
+func (l *Ledger) Prune() int {
+	return store.PruneEmptyAccounts()
+}
+
+func mul(a uint128.Uint128, n uint64) uint128.Uint128 {
+	var result uint128.Uint128
+	for i := uint64(0); i < n; i++ {
+		result = result.Add(a)
+	}
+	return result
+}
+
+// Signs and works a block for account, and stores it.
+func (b *builder) store(account types.Account, block blocks.Block, common *blocks.CommonBlock) error {
+	threshold := blocks.RequiredDifficulty(b.version(account))
+	common.Work = blocks.GenerateWorkThreshold(block.RootHash(), threshold)
+	common.Signature = block.Hash().Sign(b.keys[account])
+	if err := store.StoreBlock(block); err != nil {
+		return errors.Wrapf(err, "Storing %s block for %s", block.Type(), account)
+	}
+	b.heads[account] = block
+	b.ledger.Blocks = append(b.ledger.Blocks, block.Hash())
+	return nil
+}
+
+func (b *builder) version(account types.Account) blocks.AccountVersion {
+	if v, ok := b.versions[account]; ok {
+		return v
+	}
+	return blocks.Epoch1
+}
+
+func (b *builder) balance(account types.Account) uint128.Uint128 {
+	if head := b.heads[account]; head != nil {
+		return store.GetBalance(head)
+	}
+	return uint128.Uint128{}
+}
+
+func (b *builder) sendBlock(from, to types.Account, amount uint128.Uint128) *blocks.SendBlock {
+	return &blocks.SendBlock{
+		PreviousHash: b.heads[from].Hash(),
+		Destination:  to,
+		Balance:      b.balance(from).Sub(amount),
+	}
+}
+
+func (b *builder) send(from, to types.Account, amount uint128.Uint128) (*blocks.SendBlock, error) {
+	send := b.sendBlock(from, to, amount)
+	return send, b.store(from, send, &send.CommonBlock)
+}
+
+// Receives source, opening the account with representative if it's new.
+func (b *builder) receive(account types.Account, source types.BlockHash, representative types.Account) error {
+	if head := b.heads[account]; head != nil {
+		receive := &blocks.ReceiveBlock{PreviousHash: head.Hash(), SourceHash: source}
+		return b.store(account, receive, &receive.CommonBlock)
+	}
+	open := &blocks.OpenBlock{SourceHash: source, Representative: representative, Account: account}
+	return b.store(account, open, &open.CommonBlock)
+}
+
+func (b *builder) transfer(from, to types.Account, amount uint128.Uint128, representative types.Account) error {
+	send, err := b.send(from, to, amount)
+	if err != nil {
+		return err
+	}
+	return b.receive(to, send.Hash(), representative)
+}
+
+func (b *builder) change(account, representative types.Account) error {
+	change := &blocks.ChangeBlock{PreviousHash: b.heads[account].Hash(), Representative: representative}
+	return b.store(account, change, &change.CommonBlock)
+}
+
+func (b *builder) upgrade(account types.Account) error {
+	if err := store.UpgradeAccount(account, blocks.CurrentVersion); err != nil {
+		return err
+	}
+	b.versions[account] = blocks.CurrentVersion
+	b.ledger.Upgraded = account
+	return nil
+}
+
+// Sends to to, then offers the store a second send on the same root to
+// other, which loses.
+func (b *builder) fork(from, to, other types.Account, amount uint128.Uint128) error {
+	lost := b.sendBlock(from, other, amount)
+	kept, err := b.send(from, to, amount)
+	if err != nil {
+		return err
+	}
+	lost.Work = blocks.GenerateWorkThreshold(lost.RootHash(), blocks.RequiredDifficulty(b.version(from)))
+	lost.Signature = lost.Hash().Sign(b.keys[from])
+	if err = store.StoreBlock(lost); err != store.ErrFork {
+		return errors.Errorf("Expected a fork storing %s, got %v", lost.Hash(), err)
+	}
+	b.ledger.ForkRoot, b.ledger.ForkKept, b.ledger.ForkLost = kept.RootHash(), kept.Hash(), lost.Hash()
+	return b.receive(to, kept.Hash(), "")
+}
+
+// Sends everything account has to to.
+func (b *builder) empty(account, to types.Account) error {
+	if err := b.transfer(account, to, b.balance(account), ""); err != nil {
+		return err
+	}
+	b.ledger.Empty = account
+	return nil
+}
+
+func (b *builder) dust(from, to types.Account, amount uint128.Uint128) error {
+	send, err := b.send(from, to, amount)
+	if err == nil {
+		b.ledger.Dust = append(b.ledger.Dust, send.Hash())
+	}
+	return err
+}
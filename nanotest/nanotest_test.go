@@ -0,0 +1,53 @@
+package nanotest
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/protocol"
+	"github.com/frankh/nano/store"
+)
+
+func TestBuild(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = protocol.WorkLiveThreshold }()
+	defer os.RemoveAll(store.TestConfig.Path)
+
+	build := func(seed string) *Ledger {
+		os.RemoveAll(store.TestConfig.Path)
+		store.Init(store.TestConfig)
+		l, err := Build(seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	other := build("other")
+	l := build("seed")
+
+	if errs := store.Verify(store.VerifyOptions{}); len(errs) > 0 {
+		t.Errorf("Built ledger doesn't verify: %v", errs)
+	}
+	if proof, ok := store.FetchForkProof(l.ForkRoot); !ok || proof.Verify() != nil || len(proof.Blocks) != 2 {
+		t.Errorf("Expected a fork proof on %s", l.ForkRoot)
+	}
+	status := store.GetAccountStatus(l.Account("carol").Address)
+	if status.State != store.AccountPendingOnly || status.Dust != 1 {
+		t.Errorf("Expected carol to have only pending sends, one of them dust, got %+v", status)
+	}
+	if empty := store.EmptyAccounts(); len(empty) != 1 || empty[0].Account != l.Empty {
+		t.Errorf("Expected %s to be the only empty account, got %v", l.Empty, empty)
+	}
+	if pruned := l.Prune(); pruned != 2 {
+		t.Errorf("Expected the emptied account's receive and change pruned, pruned %d", pruned)
+	}
+
+	if again := build("seed"); !reflect.DeepEqual(again, l) {
+		t.Errorf("Same seed built a different ledger")
+	}
+	if other.Blocks[0] == l.Blocks[0] || other.Accounts[0] == l.Accounts[0] {
+		t.Errorf("Different seeds built the same ledger")
+	}
+}
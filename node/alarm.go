@@ -2,6 +2,8 @@ package node
 
 import (
 	"time"
+
+	"github.com/frankh/nano/utils"
 )
 
 type AlarmFn func([]interface{})
@@ -11,10 +13,12 @@ type Alarm struct {
 	fnParams []interface{}
 	duration time.Duration
 	done     chan bool
+	guard    *utils.Guard
 }
 
 func NewAlarm(fn AlarmFn, fnParams []interface{}, d time.Duration) *Alarm {
-	a := &Alarm{fn, fnParams, d, make(chan bool)}
+	// A panicking alarm keeps running
+	a := &Alarm{fn, fnParams, d, make(chan bool), utils.NewGuard("alarm", 0)}
 
 	go a.Run()
 
@@ -30,7 +34,7 @@ func (a *Alarm) Run() {
 		case <-a.done:
 			return
 		case _ = <-ticker.C:
-			a.fn(a.fnParams)
+			a.guard.Call(func() { a.fn(a.fnParams) })
 		}
 	}
 
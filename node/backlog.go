@@ -0,0 +1,158 @@
+package node
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/protocol"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+)
+
+// Accounts looked at per second by a backlog scan
+const DefaultBacklogRate = 200
+const DefaultBacklogInterval = 5 * time.Minute
+
+type BacklogStats struct {
+	// Completed scans
+	Passes int
+	// Progress through the current or last scan
+	Scanned  int
+	Accounts int
+	// Confirm requests sent, over all scans
+	Requested uint64
+	// Frontiers requested that haven't had a vote yet
+	Backlog int
+}
+
+// BacklogScanner finds frontiers above their account's confirmation
+// height, e.g. left unconfirmed by a restart, and asks our peers to vote
+// on them so they don't wait for new traffic to mention them.
+type BacklogScanner struct {
+	// Accounts per second, so a scan doesn't swamp a node that has just
+	// started
+	Rate  int
+	lock  sync.Mutex
+	stats BacklogStats
+	// Frontiers requested and not yet voted for
+	waiting map[types.BlockHash]bool
+}
+
+func NewBacklogScanner(rate int) *BacklogScanner {
+	return &BacklogScanner{Rate: rate, waiting: make(map[types.BlockHash]bool)}
+}
+
+var Backlog = NewBacklogScanner(DefaultBacklogRate)
+
+// Asks peers to vote on a block.
+func requestConfirmation(block blocks.Block) error {
+	publish, err := CreatePublish(block)
+	if err != nil {
+		return err
+	}
+	req := MessageConfirmReq{publish.MessageHeader, publish.MessageBlock}
+	req.MessageHeader.MessageType = protocol.MessageConfirmReq
+
+	var buf bytes.Buffer
+	if err = req.Write(&buf); err != nil {
+		return err
+	}
+	return transport().Broadcast(buf.Bytes())
+}
+
+func voted(hash types.BlockHash) bool {
+	e, ok := GetElectionStats(hash)
+	return ok && e.Votes > 0
+}
+
+// Scan goes through every unconfirmed frontier once, at Rate accounts a
+// second, starting an election for each that has no votes and requesting
+// confirmation. Closing done stops it early.
+func (s *BacklogScanner) Scan(done chan bool) {
+	frontiers := store.UnconfirmedFrontiers()
+	s.lock.Lock()
+	s.stats.Scanned, s.stats.Accounts = 0, len(frontiers)
+	rate := s.Rate
+	s.lock.Unlock()
+
+	if rate <= 0 {
+		rate = DefaultBacklogRate
+	}
+	pause := time.Second / time.Duration(rate)
+	for i, f := range frontiers {
+		if i > 0 {
+			select {
+			case <-done:
+				return
+			case <-time.After(pause):
+			}
+		}
+
+		s.lock.Lock()
+		s.stats.Scanned++
+		s.lock.Unlock()
+		if voted(f.Frontier) {
+			continue
+		}
+		block := store.FetchBlock(f.Frontier)
+		if block == nil {
+			continue
+		}
+
+		startElection(f.Frontier, observeBlock(f.Frontier))
+		if requestConfirmation(block) != nil {
+			continue
+		}
+		s.lock.Lock()
+		s.stats.Requested++
+		if len(s.waiting) < maxTrackedBlocks {
+			s.waiting[f.Frontier] = true
+		}
+		s.lock.Unlock()
+	}
+
+	s.lock.Lock()
+	s.stats.Passes++
+	s.lock.Unlock()
+}
+
+// Job scans straight away, for what a restart left unconfirmed, then
+// every interval. A scan paces itself, so it's done in one slice.
+func (s *BacklogScanner) Job(interval time.Duration) MaintenanceJob {
+	return MaintenanceJob{
+		Name:  "backlog_scan",
+		Every: interval,
+		Slice: func() (bool, error) {
+			s.Scan(nil)
+			return true, nil
+		},
+	}
+}
+
+// SetRate changes the rate from the next scan.
+func (s *BacklogScanner) SetRate(rate int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Rate = rate
+}
+
+func (s *BacklogScanner) Stats() BacklogStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for hash := range s.waiting {
+		// Frontiers the election table forgot are requested again next scan
+		if e, ok := GetElectionStats(hash); !ok || e.Votes > 0 {
+			delete(s.waiting, hash)
+		}
+	}
+	stats := s.stats
+	stats.Backlog = len(s.waiting)
+	return stats
+}
+
+func GetBacklogStats() BacklogStats {
+	return Backlog.Stats()
+}
@@ -0,0 +1,308 @@
+package node
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/protocol"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/utils"
+)
+
+const bulkPullSize = 32 + 32
+
+// How long a bootstrap client waits on each read before giving up
+const DefaultBootstrapTimeout = 30 * time.Second
+
+// Blocks a bootstrap client takes from one bulk_pull before giving up on it
+const DefaultMaxPullBlocks = 1 << 20
+
+// Retries of connecting to a bootstrap peer
+var BootstrapRetry = utils.RetryPolicy{
+	Component:      "bootstrap",
+	Base:           100 * time.Millisecond,
+	Max:            2 * time.Second,
+	MaxAttempts:    3,
+	AttemptTimeout: 5 * time.Second,
+}
+
+type MessageBulkPull struct {
+	MessageHeader
+	Start [32]byte
+	// Hash to stop at, zero for the whole chain
+	End [32]byte
+}
+
+func CreateBulkPull(start [32]byte, end [32]byte) *MessageBulkPull {
+	var m MessageBulkPull
+	m.MessageHeader.MagicNumber = MagicNumber
+	m.MessageHeader.VersionMax = protocol.VersionMax
+	m.MessageHeader.VersionUsing = protocol.VersionUsing
+	m.MessageHeader.VersionMin = protocol.VersionMin
+	m.MessageHeader.MessageType = protocol.MessageBulkPull
+	m.MessageHeader.BlockType = protocol.BlockTypeNotABlock
+	m.Start = start
+	m.End = end
+	return &m
+}
+
+func (m *MessageBulkPull) Read(r io.Reader) error {
+	err := m.MessageHeader.readHeader(r, protocol.MessageBulkPull)
+	if err != nil {
+		return err
+	}
+	return readFields(r, m.Start[:], m.End[:])
+}
+
+func (m *MessageBulkPull) Write(w io.Writer) error {
+	err := m.MessageHeader.WriteHeader(w)
+	if err != nil {
+		return err
+	}
+	return writeFields(w, m.Start[:], m.End[:])
+}
+
+// Dials peer's bootstrap port. The connection is closed if ctx is done
+// first, and by calling hangUp.
+func dialBootstrap(ctx context.Context, peer Peer) (conn net.Conn, hangUp func(), err error) {
+	addr := net.JoinHostPort(peer.IP.String(), strconv.Itoa(int(peer.Port)))
+	err = BootstrapRetry.Do(ctx, func(ctx context.Context) error {
+		conn, err = dialOutbound(ctx, addr)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	done := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	var once sync.Once
+	return conn, func() {
+		once.Do(func() {
+			close(done)
+			conn.Close()
+		})
+	}, nil
+}
+
+// Fails reads that take longer than timeout
+type deadlineReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r deadlineReader) Read(p []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	return r.conn.Read(p)
+}
+
+// Reads a bulk_pull response, each block its type then its body, up to
+// the not_a_block that ends it.
+func readBlocks(r io.Reader, fn func(blocks.Block) error) error {
+	blockType := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, blockType); err != nil {
+			return err
+		}
+		if blockType[0] == protocol.BlockTypeNotABlock {
+			return nil
+		}
+		size, ok := blockSize(blockType[0])
+		if !ok {
+			return ErrUnknownBlockType
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(r, body); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		var m MessageBlock
+		if err := m.Read(blockType[0], bytes.NewBuffer(body)); err != nil {
+			return err
+		}
+		if err := fn(m.ToBlock()); err != nil {
+			return err
+		}
+	}
+}
+
+// A BootstrapClient pulls frontiers and account chains from a peer's
+// bootstrap port, each request on its own connection.
+type BootstrapClient struct {
+	Peer    Peer
+	Timeout time.Duration
+	// Where what's pulled is counted, started afresh by each Frontiers
+	Progress *BootstrapProgress
+	// Caps each pulled chain and catches blocks sent twice in one
+	Guard *store.ChainGuard
+
+	lock sync.Mutex
+	err  error
+}
+
+func NewBootstrapClient(peer Peer) *BootstrapClient {
+	return &BootstrapClient{
+		Peer:     peer,
+		Timeout:  DefaultBootstrapTimeout,
+		Progress: Bootstrap,
+		Guard:    store.NewChainGuard(DefaultMaxPullBlocks),
+	}
+}
+
+// A bootstrap event for count frontiers or blocks of account, with the
+// progress so far.
+func (c *BootstrapClient) event(account types.Account, count int) Event {
+	status := c.Progress.Status()
+	return Event{
+		Type:     EventBootstrap,
+		Peer:     c.Peer.String(),
+		Account:  account,
+		Count:    count,
+		Basis:    status.Basis,
+		Progress: status.Progress,
+		Rate:     status.BlockRate,
+		ETA:      int64(status.ETA / time.Second),
+	}
+}
+
+// Err returns why the last stream to close ended early, if it did.
+func (c *BootstrapClient) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// Sends m and decodes the response with read in the background, keeping
+// the error that ends it for Err before calling finish.
+func (c *BootstrapClient) stream(ctx context.Context, m Message, read func(io.Reader) error, finish func()) error {
+	if InSafeMode() {
+		return ErrSafeMode
+	}
+	conn, hangUp, err := dialBootstrap(ctx, c.Peer)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	m.Write(&buf)
+	conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+	if _, err = conn.Write(buf.Bytes()); err != nil {
+		hangUp()
+		return err
+	}
+
+	c.lock.Lock()
+	c.err = nil
+	c.lock.Unlock()
+	go func() {
+		defer hangUp()
+		err := read(bufio.NewReader(deadlineReader{conn, c.Timeout}))
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		c.lock.Lock()
+		c.err = err
+		c.lock.Unlock()
+		finish()
+	}()
+	return nil
+}
+
+// Frontiers asks the peer for every account's frontier, with its block
+// count if the peer speaks protocol.CapabilityFrontierCounts, and starts
+// the client's progress on them. They're sent on the channel in account
+// order, which is closed at the end of the response or when it fails,
+// with Err saying why.
+func (c *BootstrapClient) Frontiers(ctx context.Context) (<-chan store.Frontier, error) {
+	out := make(chan store.Frontier)
+	count := 0
+	req := CreateFrontierReq([32]byte{}, AllFrontiers)
+	req.countsFor(PeerVersion(c.Peer))
+	c.Progress.Start()
+	err := c.stream(ctx, req, func(r io.Reader) error {
+		return readFrontiers(r, req, func(f wireFrontier) error {
+			select {
+			case out <- f.frontier():
+				c.Progress.AddFrontier(f.frontier())
+				count++
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}, func() {
+		if c.Err() == nil {
+			c.Progress.FrontiersDone()
+		}
+		Events.Publish(c.event("", count))
+		close(out)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// BulkPull asks the peer for account's chain, from its frontier back to
+// end, or to its open block if end is empty. The blocks are sent on the
+// channel newest first, and it's closed at the end of the response or
+// when it fails, with Err saying why. A block sent twice, or more blocks
+// than the Guard allows, ends the pull.
+func (c *BootstrapClient) BulkPull(ctx context.Context, account types.Account, end types.BlockHash) (<-chan blocks.Block, error) {
+	var start, stop [32]byte
+	pub, err := address.AddressToPub(account)
+	if err != nil {
+		return nil, err
+	}
+	copy(start[:], pub)
+	if end != "" {
+		if err = end.Validate(); err != nil {
+			return nil, err
+		}
+		copy(stop[:], end.ToBytes())
+	}
+
+	out := make(chan blocks.Block)
+	count := 0
+	err = c.stream(ctx, CreateBulkPull(start, stop), func(r io.Reader) error {
+		return readBlocks(r, func(block blocks.Block) error {
+			if err := c.Guard.Check(account, block.Hash()); err != nil {
+				return err
+			}
+			select {
+			case out <- block:
+				c.Progress.AddBlocks(1)
+				count++
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}, func() {
+		c.Guard.Done(account)
+		if c.Err() == nil {
+			c.Progress.AccountDone()
+		}
+		Events.Publish(c.event(account, count))
+		close(out)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,242 @@
+package node
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+	"github.com/golang/crypto/blake2b"
+)
+
+// Chains pulled from one peer at once by a BootstrapPool
+const DefaultPullsPerPeer = 4
+
+var ErrNoBootstrapPeers = errors.New("No peers to bootstrap from")
+
+// How much of an account's pulls a peer gets: less the more it has
+// misbehaved, and more while we're behind and it's ahead.
+func bootstrapWeight(peer Peer) float64 {
+	weight := 1 / float64(1+MisbehaviorScore(peer))
+	if Sync.Ahead(peer) {
+		weight *= syncAheadWeight
+	}
+	return weight
+}
+
+// A pseudo-random score for account on peer, above 0 and below 1, the
+// same wherever it's worked out.
+func rendezvousScore(account types.Account, peer Peer) float64 {
+	hash, _ := blake2b.New(8, nil)
+	pub, _ := address.AddressToPub(account)
+	hash.Write(pub)
+	hash.Write(peer.IP.To16())
+	binary.Write(hash, binary.LittleEndian, peer.Port)
+	// The top 53 bits, as many as a float64 holds exactly
+	n := binary.LittleEndian.Uint64(hash.Sum(nil)) >> 11
+	return (float64(n) + 0.5) / (1 << 53)
+}
+
+// RankPeers orders peers by who should serve account, best first, by
+// rendezvous hashing: each peer's score for the account is random but
+// fixed, scaled by its weight. Every node ranks an account's peers the
+// same way, so pulls for different accounts spread across peers in
+// proportion to their weights, and a peer leaving only moves the accounts
+// it was first for. Weights must be positive; nil weighs peers by
+// their misbehavior.
+func RankPeers(account types.Account, peers []Peer, weight func(Peer) float64) []Peer {
+	if weight == nil {
+		weight = bootstrapWeight
+	}
+	type ranked struct {
+		peer  Peer
+		score float64
+	}
+	ranking := make([]ranked, len(peers))
+	for i, peer := range peers {
+		// Weighted rendezvous: -w/ln(u) keeps each peer's share of first
+		// places proportional to its weight
+		ranking[i] = ranked{peer, -weight(peer) / math.Log(rendezvousScore(account, peer))}
+	}
+	sort.SliceStable(ranking, func(i, j int) bool { return ranking[i].score > ranking[j].score })
+	result := make([]Peer, len(peers))
+	for i, r := range ranking {
+		result[i] = r.peer
+	}
+	return result
+}
+
+// A BootstrapPool pulls account chains from several peers at once. Each
+// account goes to its best ranked peer with a pull to spare, and after a
+// failure to the next, so retries spread out the same way.
+type BootstrapPool struct {
+	Peers []Peer
+	// Pulls at once from each peer
+	PerPeer int
+	// Weighs peers for RankPeers, nil for by misbehavior
+	Weight func(Peer) float64
+	// Where pulled blocks are counted
+	Progress *BootstrapProgress
+
+	lock   sync.Mutex
+	active map[string]int
+	// Closed when a pull ends, for those waiting on a busy peer
+	freed chan bool
+}
+
+func NewBootstrapPool(peers []Peer) *BootstrapPool {
+	return &BootstrapPool{Peers: peers, PerPeer: DefaultPullsPerPeer, Progress: Bootstrap}
+}
+
+// Takes a pull on the best of ranking not yet tried that has one spare,
+// waiting if they're all busy. ok is false when every peer's been tried.
+func (p *BootstrapPool) acquire(ctx context.Context, ranking []Peer, tried map[string]bool) (peer Peer, ok bool, err error) {
+	for {
+		p.lock.Lock()
+		if p.active == nil {
+			p.active, p.freed = make(map[string]int), make(chan bool)
+		}
+		remaining := false
+		for _, peer := range ranking {
+			if tried[peer.String()] {
+				continue
+			}
+			remaining = true
+			if p.active[peer.String()] < p.PerPeer {
+				p.active[peer.String()]++
+				p.lock.Unlock()
+				return peer, true, nil
+			}
+		}
+		freed := p.freed
+		p.lock.Unlock()
+		if !remaining {
+			return Peer{}, false, nil
+		}
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return Peer{}, false, ctx.Err()
+		}
+	}
+}
+
+func (p *BootstrapPool) release(peer Peer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.active[peer.String()]--
+	close(p.freed)
+	p.freed = make(chan bool)
+}
+
+// Pull pulls account's chain back to end, as BootstrapClient.BulkPull
+// does, from the best ranked peer that can take it, trying the rest in
+// order until one sends the whole chain. Safe to call concurrently.
+func (p *BootstrapPool) Pull(ctx context.Context, account types.Account, end types.BlockHash) ([]blocks.Block, error) {
+	if len(p.Peers) == 0 {
+		return nil, ErrNoBootstrapPeers
+	}
+	ranking := RankPeers(account, p.Peers, p.Weight)
+	tried := make(map[string]bool)
+	var lastErr error
+	for {
+		// Pulled blocks couldn't be stored while the ledger's read only
+		select {
+		case <-store.Writable():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		peer, ok, err := p.acquire(ctx, ranking, tried)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("Pulling %s: %v", account, lastErr)
+		}
+		tried[peer.String()] = true
+
+		client := NewBootstrapClient(peer)
+		client.Progress = p.Progress
+		var chain []blocks.Block
+		pulled, err := client.BulkPull(ctx, account, end)
+		if err == nil {
+			for block := range pulled {
+				chain = append(chain, block)
+			}
+			err = client.Err()
+		}
+		p.release(peer)
+		if err == nil {
+			return chain, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		lastErr = err
+	}
+}
+
+// PullAll pulls every account's whole chain, as many at once as the
+// peers allow, calling fn with each as it arrives. It stops at the first
+// account no peer could send, or fn's first error.
+func (p *BootstrapPool) PullAll(ctx context.Context, accounts []types.Account, fn func(types.Account, []blocks.Block) error) error {
+	workers := len(p.Peers) * p.PerPeer
+	if workers == 0 {
+		return ErrNoBootstrapPeers
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	work := make(chan types.Account)
+	errs := make(chan error, 1)
+	fail := func(err error) {
+		select {
+		case errs <- err:
+			cancel()
+		default:
+		}
+	}
+
+	var wg sync.WaitGroup
+	var fnLock sync.Mutex
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for account := range work {
+				chain, err := p.Pull(ctx, account, "")
+				if err == nil {
+					fnLock.Lock()
+					err = fn(account, chain)
+					fnLock.Unlock()
+				}
+				if err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+feed:
+	for _, account := range accounts {
+		select {
+		case work <- account:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return ctx.Err()
+	}
+}
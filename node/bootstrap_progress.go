@@ -0,0 +1,188 @@
+package node
+
+import (
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/store"
+)
+
+// What a bootstrap's progress is measured in
+const (
+	// Blocks pulled against the block counts the peer sent with its
+	// frontiers
+	BootstrapByBlocks = "blocks"
+	// Accounts pulled against the frontiers, when the peer sent no
+	// counts. Accounts vary in length, so this is rougher.
+	BootstrapByAccounts = "accounts"
+)
+
+// Shortest time between samples of the pull rate
+const bootstrapSampleInterval = time.Second
+
+// How much each sample moves the average rate
+const bootstrapRateWeight = 0.2
+
+// BootstrapProgress estimates how far a bootstrap has got and how long
+// it has left, from the frontiers it's pulling and the blocks pulled so
+// far. Rates are moving averages, so a burst or a stall only shifts the
+// ETA gradually.
+type BootstrapProgress struct {
+	lock sync.Mutex
+	bootstrapCounts
+}
+
+// What Start clears
+type bootstrapCounts struct {
+	started time.Time
+	// When anything was last received
+	moved time.Time
+	// Frontiers received, how many came with block counts, and the sum
+	// of those counts
+	accounts, counted, blocks uint64
+	frontiersDone             bool
+	accountsDone, pulled      uint64
+
+	// Per second, and what they were counted from
+	blockRate, accountRate float64
+	rated                  bool
+	sampled                time.Time
+	sampledBlocks          uint64
+	sampledAccounts        uint64
+}
+
+// The progress of the bootstrap BootstrapClients report to by default
+var Bootstrap = new(BootstrapProgress)
+
+// A BootstrapStatus is a BootstrapProgress at one moment.
+type BootstrapStatus struct {
+	// Zero if no bootstrap has started
+	Started time.Time
+	// BootstrapByBlocks or BootstrapByAccounts
+	Basis         string
+	Accounts      uint64
+	AccountsDone  uint64
+	FrontiersDone bool
+	// Blocks the peer counted on its frontiers, zero without counts
+	Blocks uint64
+	Pulled uint64
+	// Of Basis, from 0 to 1
+	Progress float64
+	// Moving averages, per second
+	BlockRate   float64
+	AccountRate float64
+	// Until done at the current rate, zero while it can't be told: before
+	// all frontiers are in, or before there's a rate
+	ETA time.Duration
+}
+
+// Start clears the progress for a new bootstrap.
+func (p *BootstrapProgress) Start() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := Clock.Now()
+	p.bootstrapCounts = bootstrapCounts{started: now, moved: now, sampled: now}
+}
+
+// AddFrontier counts an account to pull, and its blocks if the peer sent
+// how many.
+func (p *BootstrapProgress) AddFrontier(f store.Frontier) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.accounts++
+	p.moved = Clock.Now()
+	if f.Blocks > 0 {
+		p.counted++
+		p.blocks += f.Blocks
+	}
+}
+
+// FrontiersDone marks every frontier received, so the totals are final.
+func (p *BootstrapProgress) FrontiersDone() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.frontiersDone = true
+	p.moved = Clock.Now()
+}
+
+// AddBlocks counts blocks pulled.
+func (p *BootstrapProgress) AddBlocks(n int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.pulled += uint64(n)
+	p.moved = Clock.Now()
+	p.sample()
+}
+
+// AccountDone counts an account whose chain has been pulled.
+func (p *BootstrapProgress) AccountDone() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.accountsDone++
+	p.moved = Clock.Now()
+	p.sample()
+}
+
+// Averages in the rates since the last sample, if it's been long enough.
+// Called with the lock held.
+func (p *BootstrapProgress) sample() {
+	now := Clock.Now()
+	elapsed := now.Sub(p.sampled).Seconds()
+	if p.started.IsZero() || elapsed < bootstrapSampleInterval.Seconds() {
+		return
+	}
+	blockRate := float64(p.pulled-p.sampledBlocks) / elapsed
+	accountRate := float64(p.accountsDone-p.sampledAccounts) / elapsed
+	if !p.rated {
+		// The first sample is all there is to go on
+		p.blockRate, p.accountRate, p.rated = blockRate, accountRate, true
+	} else {
+		p.blockRate += bootstrapRateWeight * (blockRate - p.blockRate)
+		p.accountRate += bootstrapRateWeight * (accountRate - p.accountRate)
+	}
+	p.sampled, p.sampledBlocks, p.sampledAccounts = now, p.pulled, p.accountsDone
+}
+
+// Status is the progress so far. It's measured by blocks only when every
+// frontier came with a count.
+func (p *BootstrapProgress) Status() BootstrapStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.sample()
+	s := BootstrapStatus{
+		Started:       p.started,
+		Basis:         BootstrapByAccounts,
+		Accounts:      p.accounts,
+		AccountsDone:  p.accountsDone,
+		FrontiersDone: p.frontiersDone,
+		Blocks:        p.blocks,
+		Pulled:        p.pulled,
+		BlockRate:     p.blockRate,
+		AccountRate:   p.accountRate,
+	}
+	done, total, rate := float64(p.accountsDone), float64(p.accounts), p.accountRate
+	if p.accounts > 0 && p.counted == p.accounts {
+		s.Basis = BootstrapByBlocks
+		done, total, rate = float64(p.pulled), float64(p.blocks), p.blockRate
+	}
+	if total > 0 {
+		s.Progress = done / total
+		if s.Progress > 1 {
+			// Chains grew since their frontiers were sent
+			s.Progress = 1
+		}
+	}
+	if p.frontiersDone && rate > 0 && done < total {
+		s.ETA = time.Duration((total - done) / rate * float64(time.Second))
+	}
+	return s
+}
+
+// Stalled is whether a bootstrap is under way but nothing has come in for
+// it for d.
+func (p *BootstrapProgress) Stalled(d time.Duration) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	finished := p.frontiersDone && p.accountsDone >= p.accounts
+	return !p.started.IsZero() && !finished && Clock.Now().Sub(p.moved) > d
+}
@@ -0,0 +1,21 @@
+package node
+
+import (
+	"log"
+	"time"
+
+	"github.com/frankh/nano/store"
+)
+
+const DefaultCementInterval = time.Second
+
+// Cementer cements blocks as they reach quorum, passing each cemented
+// block on to store.Confirmations.
+var Cementer, _ = store.NewConfirmationHeightProcessor(store.DefaultCementBatchSize, store.Confirmations.Publish)
+
+// Cements the blocks confirmed since the last call, for an Alarm.
+func CementConfirmed([]interface{}) {
+	if err := Cementer.Flush(); err != nil {
+		log.Printf("Failed to cement confirmed blocks: %s", err)
+	}
+}
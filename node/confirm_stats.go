@@ -0,0 +1,331 @@
+package node
+
+import (
+	"math"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/metrics"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+)
+
+const maxTrackedBlocks = 10000
+const latencyBuckets = 80
+const latencyWindows = 10
+const latencyWindowLength = time.Minute
+
+// A block confirms once the weight of the representatives voting for it
+// reaches QuorumPercent of the online weight.
+var QuorumPercent int64 = 67
+
+// The online weight is taken as at least this, so a few small reps can't
+// confirm blocks on a quiet network. 60M nano, as the reference node.
+var OnlineWeightMinimum = uint128.FromInts(0x2d239465031da916, 0x05b947c000000000)
+
+// Representatives count towards the online weight for this long after
+// their last vote.
+const onlineWeightWindow = 5 * time.Minute
+
+// Bucket upper bounds grow by 2^(1/4) from 1ms, topping out at ~17 minutes.
+var latencyBounds = func() (bounds [latencyBuckets]time.Duration) {
+	for i := range bounds {
+		bounds[i] = time.Duration(float64(time.Millisecond) * math.Pow(2, float64(i)/4))
+	}
+	return bounds
+}()
+
+// LatencyHistogram is a fixed bucket streaming quantile estimator over a
+// sliding window made of latencyWindows sub-windows.
+type LatencyHistogram struct {
+	windows [latencyWindows][latencyBuckets + 1]uint64
+	starts  [latencyWindows]time.Time
+}
+
+func latencyBucket(d time.Duration) int {
+	return sort.Search(latencyBuckets, func(i int) bool {
+		return latencyBounds[i] >= d
+	})
+}
+
+func (h *LatencyHistogram) window(t time.Time) int {
+	start := t.Truncate(latencyWindowLength)
+	i := int(start.Unix()/int64(latencyWindowLength/time.Second)) % latencyWindows
+	if !h.starts[i].Equal(start) {
+		h.starts[i] = start
+		h.windows[i] = [latencyBuckets + 1]uint64{}
+	}
+	return i
+}
+
+func (h *LatencyHistogram) Add(t time.Time, d time.Duration) {
+	h.windows[h.window(t)][latencyBucket(d)]++
+}
+
+// Returns the upper bound of the bucket holding quantile q of the samples
+// seen in the window ending at t, and the number of samples.
+func (h *LatencyHistogram) Quantile(t time.Time, q float64) (time.Duration, uint64) {
+	var counts [latencyBuckets + 1]uint64
+	var total uint64
+	cutoff := t.Add(-latencyWindows * latencyWindowLength)
+
+	for w := range h.windows {
+		if !h.starts[w].After(cutoff) {
+			continue
+		}
+		for i, c := range h.windows[w] {
+			counts[i] += c
+			total += c
+		}
+	}
+
+	if total == 0 {
+		return 0, 0
+	}
+
+	rank := uint64(math.Ceil(q * float64(total)))
+	var seen uint64
+	for i, c := range counts {
+		seen += c
+		if seen >= rank && i < latencyBuckets {
+			return latencyBounds[i], total
+		}
+	}
+	// Longer than the largest bucket
+	return latencyBounds[latencyBuckets-1], total
+}
+
+type ElectionStats struct {
+	FirstSeen store.Timestamp
+	FirstVote store.Timestamp
+	LastVote  store.Timestamp
+	Votes     int
+	// Weight of the distinct representatives that voted, where known
+	Tally uint128.Uint128
+	// Whether Tally has reached quorum
+	Confirmed bool
+	// Votes that arrived before the block
+	Hinted int
+	// Representatives that voted, each counted once
+	voters map[types.Account]bool
+}
+
+// Time from first seeing the block to the latest vote for it.
+func (e *ElectionStats) Duration() time.Duration {
+	if e.Votes == 0 {
+		return 0
+	}
+	return e.LastVote.Sub(e.FirstSeen)
+}
+
+type ConfirmationStats struct {
+	P50, P95, P99 time.Duration
+	Samples       uint64
+}
+
+type confirmationSampler struct {
+	sync.Mutex
+	elections map[types.BlockHash]*ElectionStats
+	max       int
+	// Insertion order, oldest first, for evicting once full
+	order         []types.BlockHash
+	latency       LatencyHistogram
+	participation repParticipation
+}
+
+var confirmations = newConfirmationSampler()
+
+var electionDuration = metrics.ElectionDuration.With("")
+
+func newConfirmationSampler() *confirmationSampler {
+	return &confirmationSampler{
+		elections:     make(map[types.BlockHash]*ElectionStats),
+		max:           maxTrackedBlocks,
+		participation: newRepParticipation(),
+	}
+}
+
+func (s *confirmationSampler) seen(hash types.BlockHash, ts store.Timestamp) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.elections[hash] != nil {
+		return
+	}
+
+	if len(s.order) >= s.max {
+		delete(s.elections, s.order[0])
+		s.order = s.order[1:]
+	}
+
+	s.elections[hash] = &ElectionStats{FirstSeen: ts}
+	s.order = append(s.order, hash)
+	s.participation.election(ts.Time())
+}
+
+func (s *confirmationSampler) len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.order)
+}
+
+// Forgets the oldest blocks over the new size.
+func (s *confirmationSampler) setMax(max int) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.max = max
+	for len(s.order) > max {
+		delete(s.elections, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+// Counts rep's vote, of weight, for a block we've seen. Each rep's weight
+// is tallied once. Returns whether the vote brought the tally to quorum,
+// confirming the block.
+func (s *confirmationSampler) vote(hash types.BlockHash, rep types.Account, weight uint128.Uint128, quorum uint128.Uint128, ts store.Timestamp) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	e := s.elections[hash]
+	if e == nil {
+		return false
+	}
+
+	if e.Votes == 0 {
+		e.FirstVote = ts
+	}
+	e.LastVote = ts
+	e.Votes++
+	s.tally(e, rep, weight, ts)
+	return s.confirm(hash, e, quorum, ts)
+}
+
+// Adds rep's weight to the tally and counts its participation, the first
+// time it votes for each block we've seen. Only reps with weight, so
+// anyone signing votes can't grow the bookkeeping.
+func (s *confirmationSampler) tally(e *ElectionStats, rep types.Account, weight uint128.Uint128, ts store.Timestamp) {
+	if weight == (uint128.Uint128{}) || e.voters[rep] {
+		return
+	}
+	if e.voters == nil {
+		e.voters = make(map[types.Account]bool)
+	}
+	e.voters[rep] = true
+	e.Tally = e.Tally.Add(weight)
+	s.participation.vote(rep, ts.Time())
+}
+
+// Confirms the block once its tally reaches quorum. Returns whether it
+// just did.
+func (s *confirmationSampler) confirm(hash types.BlockHash, e *ElectionStats, quorum uint128.Uint128, ts store.Timestamp) bool {
+	if e.Confirmed || e.Tally == (uint128.Uint128{}) || e.Tally.Compare(quorum) < 0 {
+		return false
+	}
+	e.Confirmed = true
+	Processor.Tracer.Record(hash, metrics.StageConfirmed)
+	s.latency.Add(ts.Time(), ts.Sub(e.FirstSeen))
+	electionDuration.Observe(ts.Sub(e.FirstSeen))
+	return true
+}
+
+// Counts votes that arrived before the block as if they came with it, so
+// an election with enough hinted weight confirms as soon as it starts.
+// Returns whether that confirmed it.
+func (s *confirmationSampler) hinted(hash types.BlockHash, hints []VoteHint, quorum uint128.Uint128) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	e := s.elections[hash]
+	if e == nil {
+		return false
+	}
+
+	if e.Votes == 0 {
+		e.FirstVote, e.LastVote = e.FirstSeen, e.FirstSeen
+	}
+	for _, h := range hints {
+		s.tally(e, h.Rep, h.Weight, e.FirstSeen)
+	}
+	e.Votes += len(hints)
+	e.Hinted += len(hints)
+	return s.confirm(hash, e, quorum, e.FirstSeen)
+}
+
+// Representatives seen voting since cutoff.
+func (s *confirmationSampler) online(cutoff time.Time) []types.Account {
+	s.Lock()
+	defer s.Unlock()
+
+	var reps []types.Account
+	for rep, last := range s.participation.last {
+		if !last.Before(cutoff) {
+			reps = append(reps, rep)
+		}
+	}
+	return reps
+}
+
+// The weight of representatives voting lately, at least
+// OnlineWeightMinimum.
+func onlineWeight() uint128.Uint128 {
+	var online uint128.Uint128
+	for _, rep := range confirmations.online(Clock.Now().Add(-onlineWeightWindow)) {
+		online = online.Add(repWeight(rep))
+	}
+	if online.Compare(OnlineWeightMinimum) < 0 {
+		return OnlineWeightMinimum
+	}
+	return online
+}
+
+// The tally a block needs to confirm.
+func quorumWeight() uint128.Uint128 {
+	n := new(big.Int).SetBytes(onlineWeight().GetBytes())
+	n.Mul(n, big.NewInt(QuorumPercent))
+	n.Div(n, big.NewInt(100))
+	return uint128.FromBytes(n.FillBytes(make([]byte, 16)))
+}
+
+func confirmed(hash types.BlockHash) bool {
+	e, ok := confirmations.election(hash)
+	return ok && e.Confirmed
+}
+
+func (s *confirmationSampler) stats(t time.Time) ConfirmationStats {
+	s.Lock()
+	defer s.Unlock()
+
+	var c ConfirmationStats
+	c.P50, c.Samples = s.latency.Quantile(t, 0.50)
+	c.P95, _ = s.latency.Quantile(t, 0.95)
+	c.P99, _ = s.latency.Quantile(t, 0.99)
+	return c
+}
+
+func (s *confirmationSampler) election(hash types.BlockHash) (ElectionStats, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	e := s.elections[hash]
+	if e == nil {
+		return ElectionStats{}, false
+	}
+	stats := *e
+	stats.voters = nil
+	return stats, true
+}
+
+// Confirmation latency percentiles over the last 10 minutes.
+func GetConfirmationStats() ConfirmationStats {
+	return confirmations.stats(Clock.Now())
+}
+
+// Vote count and duration for a recently seen block.
+func GetElectionStats(hash types.BlockHash) (ElectionStats, bool) {
+	return confirmations.election(hash)
+}
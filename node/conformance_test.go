@@ -0,0 +1,229 @@
+//go:build conformance
+// +build conformance
+
+package node
+
+// Conformance tests against an official nano_node on the test network.
+// Run with
+//
+//	NANO_NODE_ADDR=127.0.0.1:54000 NANO_NODE_RPC=http://127.0.0.1:55000 go test -tags conformance ./node
+//
+// The node must be able to send UDP back to this machine.
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/protocol"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+)
+
+const conformanceTimeout = 10 * time.Second
+
+type conformancePeer struct {
+	t    *testing.T
+	conn *net.UDPConn
+	addr *net.UDPAddr
+	rpc  string
+}
+
+func newConformancePeer(t *testing.T) *conformancePeer {
+	nodeAddr := os.Getenv("NANO_NODE_ADDR")
+	if nodeAddr == "" {
+		t.Skip("NANO_NODE_ADDR not set")
+	}
+	TestNetwork.Activate()
+
+	addr, err := net.ResolveUDPAddr("udp", nodeAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &conformancePeer{t, conn, addr, os.Getenv("NANO_NODE_RPC")}
+}
+
+func (p *conformancePeer) Close() {
+	p.conn.Close()
+	LiveNetwork.Activate()
+}
+
+func (p *conformancePeer) send(m Message) {
+	var buf bytes.Buffer
+	err := m.Write(&buf)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	_, err = p.conn.WriteToUDP(buf.Bytes(), p.addr)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// Waits for a message of one of the given types, returning its raw
+// packet, or nil on timeout.
+func (p *conformancePeer) receive(messageTypes ...byte) []byte {
+	deadline := time.Now().Add(conformanceTimeout)
+	buf := make([]byte, packetSize)
+
+	for time.Now().Before(deadline) {
+		p.conn.SetReadDeadline(deadline)
+		n, _, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+
+		var header MessageHeader
+		header.ReadHeader(bytes.NewBuffer(buf[:n]))
+		for _, t := range messageTypes {
+			if header.MessageType == t {
+				return append([]byte{}, buf[:n]...)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *conformancePeer) call(request map[string]string, response interface{}) {
+	if p.rpc == "" {
+		p.t.Skip("NANO_NODE_RPC not set")
+	}
+
+	body, _ := json.Marshal(request)
+	resp, err := http.Post(p.rpc, "application/json", bytes.NewReader(body))
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(response)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+func TestConformanceKeepAlive(t *testing.T) {
+	p := newConformancePeer(t)
+	defer p.Close()
+
+	p.send(CreateKeepAlive(nil))
+	packet := p.receive(protocol.MessageKeepalive)
+	if packet == nil {
+		t.Fatalf("Keepalive not answered")
+	}
+
+	var m MessageKeepAlive
+	err := m.Read(bytes.NewBuffer(packet))
+	if err != nil {
+		t.Fatalf("Failed to read keepalive %x: %s", packet, err)
+	}
+
+	var buf bytes.Buffer
+	m.Write(&buf)
+	if !bytes.Equal(buf.Bytes(), packet) {
+		t.Errorf("Keepalive didn't round trip\n%x\n%x", packet, buf.Bytes())
+	}
+}
+
+// Sends 1 raw from the test genesis account and checks the node stores it.
+func TestConformancePublish(t *testing.T) {
+	p := newConformancePeer(t)
+	defer p.Close()
+
+	var info struct {
+		Frontier string
+		Balance  string
+		Error    string
+	}
+	p.call(map[string]string{"action": "account_info", "account": string(blocks.TestGenesisBlock.Account)}, &info)
+	if info.Error != "" {
+		t.Fatalf("account_info failed: %s", info.Error)
+	}
+
+	raw, ok := new(big.Int).SetString(info.Balance, 10)
+	if !ok {
+		t.Fatalf("Bad balance %s", info.Balance)
+	}
+	balanceBytes := make([]byte, 16)
+	copy(balanceBytes[16-len(raw.Bytes()):], raw.Bytes())
+	balance := uint128.FromBytes(balanceBytes)
+
+	_, priv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	send := &blocks.SendBlock{
+		PreviousHash: types.BlockHash(info.Frontier),
+		Destination:  blocks.TestGenesisBlock.Account,
+		Balance:      balance.Sub(uint128.FromInts(0, 1)),
+	}
+	send.Work = blocks.GenerateWorkForHash(send.RootHash())
+	send.Signature = send.Hash().Sign(priv)
+
+	m, err := CreatePublish(send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.send(m)
+
+	deadline := time.Now().Add(conformanceTimeout)
+	for time.Now().Before(deadline) {
+		var block struct {
+			Contents string
+			Error    string
+		}
+		p.call(map[string]string{"action": "block", "hash": string(send.Hash())}, &block)
+		if block.Error == "" && block.Contents != "" {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	var buf bytes.Buffer
+	m.Write(&buf)
+	t.Errorf("Published block not stored by the node, packet %s", hex.EncodeToString(buf.Bytes()))
+}
+
+// Anything the node floods to us must parse.
+func TestConformanceParse(t *testing.T) {
+	p := newConformancePeer(t)
+	defer p.Close()
+
+	p.send(CreateKeepAlive(nil))
+	packet := p.receive(protocol.MessagePublish, protocol.MessageConfirmAck)
+	if packet == nil {
+		t.Skip("Node sent no publish or vote")
+	}
+
+	var err error
+	if packet[5] == protocol.MessagePublish {
+		var m MessagePublish
+		err = m.Read(bytes.NewBuffer(packet))
+	} else {
+		var m MessageConfirmAck
+		err = m.Read(bytes.NewBuffer(packet))
+	}
+	if err != nil {
+		t.Fatalf("Failed to read %x: %s", packet, err)
+	}
+}
+
+func TestConformanceHandshake(t *testing.T) {
+	newConformancePeer(t).Close()
+	t.Skip("Node ID handshake is not implemented")
+}
+
+func TestConformanceBootstrap(t *testing.T) {
+	newConformancePeer(t).Close()
+	t.Skip("Bootstrap client is not implemented")
+}
@@ -0,0 +1,147 @@
+package node
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/metrics"
+	"github.com/frankh/nano/store"
+)
+
+// Bytes free under which DiskMonitor warns, and makes the ledger read
+// only
+const (
+	DefaultDiskSoftLimit = 2 << 30
+	DefaultDiskHardLimit = 512 << 20
+)
+
+const DefaultDiskCheckInterval = 30 * time.Second
+
+// DiskUsage is the space on one monitored path's filesystem.
+type DiskUsage struct {
+	Path  string
+	Free  uint64
+	Total uint64
+	// Why it couldn't be read, if it couldn't
+	Err string
+}
+
+// DiskMonitor checks the free space where the store and wallets write,
+// warning when any path drops below Soft bytes and making the ledger read
+// only below Hard, before a write can fail halfway and corrupt it. The
+// ledger is writable again once every path is back over Soft, so it
+// doesn't flap around Hard.
+type DiskMonitor struct {
+	Paths []string
+	Soft  uint64
+	Hard  uint64
+	// Free and total bytes on path's filesystem, statfs if nil
+	Probe func(path string) (free uint64, total uint64, err error)
+
+	lock  sync.Mutex
+	usage []DiskUsage
+	// Whether paths were under Soft at the last check, so each drop is
+	// only warned of once
+	low map[string]bool
+	// Whether the monitor made the ledger read only
+	full bool
+}
+
+var Disk = &DiskMonitor{Soft: DefaultDiskSoftLimit, Hard: DefaultDiskHardLimit}
+
+// SetLimits changes the limits, taking effect at the next check.
+func (m *DiskMonitor) SetLimits(soft uint64, hard uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.Soft, m.Hard = soft, hard
+}
+
+func (m *DiskMonitor) Limits() (soft uint64, hard uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.Soft, m.Hard
+}
+
+// Usage is each path's space at the last check.
+func (m *DiskMonitor) Usage() []DiskUsage {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]DiskUsage{}, m.usage...)
+}
+
+// Check reads every path's free space and switches the ledger's mode if
+// it's crossed a limit. Paths that can't be read are left out.
+func (m *DiskMonitor) Check() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	probe := m.Probe
+	if probe == nil {
+		probe = diskSpace
+	}
+	if m.low == nil {
+		m.low = make(map[string]bool)
+	}
+
+	m.usage = m.usage[:0]
+	var full []DiskUsage
+	recovered := true
+	for _, path := range m.Paths {
+		u := DiskUsage{Path: path}
+		var err error
+		if u.Free, u.Total, err = probe(path); err != nil {
+			u.Err = err.Error()
+			m.usage = append(m.usage, u)
+			continue
+		}
+		m.usage = append(m.usage, u)
+
+		low := u.Free < m.Soft
+		if low && !m.low[path] {
+			log.Printf("Disk space low: %d bytes free on %s", u.Free, path)
+			Events.Publish(Event{Type: EventDiskLow, Path: path, Free: u.Free})
+		}
+		m.low[path] = low
+		recovered = recovered && !low
+		if u.Free < m.Hard {
+			full = append(full, u)
+		}
+	}
+
+	switch {
+	case len(full) > 0 && !store.ReadOnly():
+		u := full[0]
+		store.SetReadOnly(fmt.Sprintf("%d bytes free on %s, under the limit of %d", u.Free, u.Path, m.Hard))
+		m.full = true
+		log.Printf("Ledger read only: %s", store.Mode().Reason)
+		Events.Publish(Event{Type: EventReadOnly, Path: u.Path, Free: u.Free})
+	case recovered && m.full:
+		store.SetWritable()
+		m.full = false
+		log.Printf("Ledger writable again, disk space recovered")
+		Events.Publish(Event{Type: EventWritable})
+	}
+}
+
+// Checks Disk, for an Alarm.
+func CheckDiskSpace([]interface{}) {
+	Disk.Check()
+}
+
+var diskFreeGauge = metrics.NewGaugeFunc("nano_disk_free_bytes", "Free space on the filesystems the node writes to, by path.", "path", func() map[string]float64 {
+	series := make(map[string]float64)
+	for _, u := range Disk.Usage() {
+		if u.Err == "" {
+			series[u.Path] = float64(u.Free)
+		}
+	}
+	return series
+})
+
+var ledgerModeGauge = metrics.NewGaugeFunc("nano_ledger_read_only", "Whether the ledger is refusing blocks for lack of disk space.", "", func() map[string]float64 {
+	if store.ReadOnly() {
+		return map[string]float64{"": 1}
+	}
+	return map[string]float64{"": 0}
+})
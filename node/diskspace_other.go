@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!dragonfly
+
+package node
+
+import "errors"
+
+func diskSpace(path string) (free uint64, total uint64, err error) {
+	return 0, 0, errors.New("Reading free disk space is not supported on this platform")
+}
@@ -0,0 +1,71 @@
+package node
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+)
+
+// Broadcaster carries serialized messages to peers. Embedders without
+// sockets set Transport to their own, e.g. one publishing to a message
+// broker, and feed what arrives back in with Inject.
+type Broadcaster interface {
+	Send(peer Peer, packet []byte) error
+	// Floods a packet to every known peer
+	Broadcast(packet []byte) error
+}
+
+// Nil sends over udp
+var Transport Broadcaster
+
+// Udp sockets opened, for checking embedded nodes open none
+var udpSockets uint64
+
+type udpTransport struct{}
+
+func (udpTransport) Send(peer Peer, packet []byte) error {
+	if ProxyOnly {
+		return ErrUdpDisabled
+	}
+	atomic.AddUint64(&udpSockets, 1)
+	outConn, err := net.DialUDP("udp", nil, peer.Addr())
+	if err != nil {
+		return err
+	}
+	defer outConn.Close()
+
+	_, err = outConn.Write(packet)
+	return err
+}
+
+func (t udpTransport) Broadcast(packet []byte) error {
+	for _, peer := range PeerList {
+		// Learned peers get nothing but their probe until they answer
+		if peerFilters.onProbation(peer) {
+			continue
+		}
+		t.Send(peer, packet)
+	}
+	return nil
+}
+
+func transport() Broadcaster {
+	if Transport == nil {
+		return udpTransport{}
+	}
+	return Transport
+}
+
+// Inject handles a message as if it was read off the udp socket from
+// peer, for nodes embedded without one.
+func Inject(m Message, from Peer) error {
+	var buf bytes.Buffer
+	err := m.Write(&buf)
+	if err != nil {
+		return err
+	}
+	if from.IP != nil {
+		heardFrom(from)
+	}
+	return packetGuard.Call(func() { handleMessageFrom(&buf, from) })
+}
@@ -0,0 +1,168 @@
+package node
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+)
+
+// Kinds of Event
+const (
+	EventConfirmation = "confirmation"
+	EventVote         = "vote"
+	EventFork         = "fork"
+	EventPeerAdded    = "peer_added"
+	EventPeerRemoved  = "peer_removed"
+	EventBootstrap    = "bootstrap"
+	EventSummary      = "summary"
+	// Disk space under DiskMonitor's soft limit, and the ledger read only
+	// for being under its hard limit, or writable again
+	EventDiskLow  = "disk_low"
+	EventReadOnly = "read_only"
+	EventWritable = "writable"
+	// SyncMonitor's status changed
+	EventSyncStatus = "sync_status"
+)
+
+// Events a subscriber can fall behind by before new ones are dropped
+const DefaultEventBuffer = 1000
+
+// An Event is something the node did, for watching it live. Only the
+// fields that apply to its type are set.
+type Event struct {
+	Type string `json:"type"`
+	// Unix milliseconds
+	Time           int64           `json:"time"`
+	Hash           types.BlockHash `json:"hash,omitempty"`
+	Account        types.Account   `json:"account,omitempty"`
+	Representative types.Account   `json:"representative,omitempty"`
+	// Raw, of a confirmed send
+	Amount string `json:"amount,omitempty"`
+	Peer   string `json:"peer,omitempty"`
+	// Frontiers or blocks a bootstrap pulled
+	Count int `json:"count,omitempty"`
+	// Bootstrap events only: how far the whole bootstrap has got, by
+	// Basis, its pull rate in blocks a second and the seconds it has
+	// left, as BootstrapStatus has them
+	Basis    string  `json:"basis,omitempty"`
+	Progress float64 `json:"progress,omitempty"`
+	Rate     float64 `json:"rate,omitempty"`
+	ETA      int64   `json:"eta,omitempty"`
+	// Disk events only: the path short of space, and bytes free on it
+	Path string `json:"path,omitempty"`
+	Free uint64 `json:"free,omitempty"`
+	// Sync events only: the new status, with Count the peers it's from
+	Status string `json:"status,omitempty"`
+
+	// Summary events only
+	Confirmations uint64 `json:"confirmations,omitempty"`
+	Peers         int    `json:"peers,omitempty"`
+	Backlog       int    `json:"backlog,omitempty"`
+}
+
+// EventFeed passes events on to subscribers without waiting for them:
+// a subscriber whose buffer is full misses the event.
+type EventFeed struct {
+	lock    sync.Mutex
+	subs    map[*EventSubscription]bool
+	dropped uint64
+}
+
+func NewEventFeed() *EventFeed {
+	return &EventFeed{subs: make(map[*EventSubscription]bool)}
+}
+
+var Events = NewEventFeed()
+
+type EventSubscription struct {
+	feed *EventFeed
+	C    chan Event
+}
+
+func (f *EventFeed) Subscribe(buffer int) *EventSubscription {
+	s := &EventSubscription{feed: f, C: make(chan Event, buffer)}
+	f.lock.Lock()
+	f.subs[s] = true
+	f.lock.Unlock()
+	return s
+}
+
+func (s *EventSubscription) Close() {
+	s.feed.lock.Lock()
+	delete(s.feed.subs, s)
+	s.feed.lock.Unlock()
+}
+
+// Whether anyone is subscribed, to skip building events nobody sees.
+func (f *EventFeed) watched() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.subs) > 0
+}
+
+func (f *EventFeed) Publish(e Event) {
+	if e.Time == 0 {
+		e.Time = Clock.Now().UnixNano() / 1e6
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for s := range f.subs {
+		select {
+		case s.C <- e:
+		default:
+			f.dropped++
+		}
+	}
+}
+
+// Events missed by subscribers that fell behind.
+func (f *EventFeed) Dropped() uint64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.dropped
+}
+
+// Blocks confirmed since startup
+var confirmedCount uint64
+
+// Publishes a block's confirmation, once the votes for it reach quorum,
+// and queues it for cementing.
+func publishConfirmation(hash types.BlockHash) {
+	atomic.AddUint64(&confirmedCount, 1)
+	Cementer.Add(hash)
+	if !Events.watched() {
+		return
+	}
+	Events.Publish(ConfirmationEvent(hash))
+}
+
+// ConfirmationEvent is the event for a stored block's confirmation, with
+// its account and, for sends, the amount. Time is left for Publish.
+func ConfirmationEvent(hash types.BlockHash) Event {
+	e := Event{Type: EventConfirmation, Hash: hash}
+	if block := store.FetchBlock(hash); block != nil {
+		account, before, ok := store.BlockAccount(block)
+		e.Account = account
+		if send, isSend := block.(*blocks.SendBlock); isSend && ok {
+			e.Amount = before.Sub(send.Balance).Decimal()
+		}
+	}
+	return e
+}
+
+// SummaryEvent reports totals for watchers to show alongside the events.
+func SummaryEvent() Event {
+	peersLock.Lock()
+	peers := len(PeerList)
+	peersLock.Unlock()
+	return Event{
+		Type:          EventSummary,
+		Time:          Clock.Now().UnixNano() / 1e6,
+		Confirmations: atomic.LoadUint64(&confirmedCount),
+		Peers:         peers,
+		Backlog:       GetBacklogStats().Backlog,
+	}
+}
@@ -0,0 +1,430 @@
+package node
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/protocol"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+)
+
+// Frontiers read from the store per transaction while serving a
+// frontier_req
+var FrontierChunk = 1000
+
+// Frontiers asked for per frontier_req when fetching a page at a time
+const DefaultFrontierPage = 10000
+
+// A frontier_req count asking for every account
+const AllFrontiers = math.MaxUint32
+
+const frontierReqSize = 32 + 4 + 4
+const frontierSize = 32 + 32
+
+// With ExtensionFrontierCounts, each frontier is followed by its
+// account's block count
+const frontierCountSize = 8
+
+// Header extension bit on a frontier_req asking for each account's block
+// count after its frontier, so the requester can tell how much there is
+// to pull. Only sent to peers speaking protocol.CapabilityFrontierCounts.
+const ExtensionFrontierCounts byte = 0x80
+
+var ErrFrontierRegression = errors.New("Peer sent frontiers out of order")
+var ErrTooManyFrontiers = errors.New("Peer sent more frontiers than asked for")
+
+// Where frontiers, and with ExtensionFrontierCounts their heights, are
+// served from
+var frontiers = store.Frontiers
+var frontierHeight = store.ChainHeight
+var frontierModified = store.AccountModified
+
+type MessageFrontierReq struct {
+	MessageHeader
+	Start [32]byte
+	// Seconds since an account last changed, AllFrontiers for any
+	Age   uint32
+	Count uint32
+}
+
+func CreateFrontierReq(start [32]byte, count uint32) *MessageFrontierReq {
+	var m MessageFrontierReq
+	m.MessageHeader.MagicNumber = MagicNumber
+	m.MessageHeader.VersionMax = protocol.VersionMax
+	m.MessageHeader.VersionUsing = protocol.VersionUsing
+	m.MessageHeader.VersionMin = protocol.VersionMin
+	m.MessageHeader.MessageType = protocol.MessageFrontierReq
+	m.MessageHeader.BlockType = protocol.BlockTypeNotABlock
+	m.Start = start
+	m.Age = AllFrontiers
+	m.Count = count
+	return &m
+}
+
+// Whether the response carries block counts.
+func (m *MessageFrontierReq) Counts() bool {
+	return m.MessageHeader.Extensions&ExtensionFrontierCounts != 0
+}
+
+// Asks for block counts, if a peer speaking version understands them.
+func (m *MessageFrontierReq) countsFor(version byte) {
+	if protocol.CapabilityFrontierCounts.SupportedBy(version) {
+		m.MessageHeader.VersionUsing = version
+		m.MessageHeader.Extensions |= ExtensionFrontierCounts
+	}
+}
+
+// The size of each entry in the response.
+func (m *MessageFrontierReq) entrySize() int {
+	if m.Counts() {
+		return frontierSize + frontierCountSize
+	}
+	return frontierSize
+}
+
+func (m *MessageFrontierReq) Read(r io.Reader) error {
+	err := m.MessageHeader.readHeader(r, protocol.MessageFrontierReq)
+	if err != nil {
+		return err
+	}
+
+	body := make([]byte, frontierReqSize)
+	if err = readFields(r, body); err != nil {
+		return err
+	}
+	copy(m.Start[:], body)
+	m.Age = binary.LittleEndian.Uint32(body[32:])
+	m.Count = binary.LittleEndian.Uint32(body[36:])
+	return nil
+}
+
+func (m *MessageFrontierReq) Write(w io.Writer) error {
+	err := m.MessageHeader.WriteHeader(w)
+	if err != nil {
+		return err
+	}
+
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint32(body, m.Age)
+	binary.LittleEndian.PutUint32(body[4:], m.Count)
+	return writeFields(w, m.Start[:], body)
+}
+
+// ServeFrontierReq writes frontiers from m's start account on, at most
+// its count, then the all zero entry that ends the response. They're
+// read from the store FrontierChunk at a time, each chunk in its own
+// transaction. With an age only accounts that changed here within it are
+// sent, and the count is of those. With ExtensionFrontierCounts each
+// frontier is followed by its height.
+func ServeFrontierReq(w io.Writer, m *MessageFrontierReq) error {
+	bw := bufio.NewWriter(w)
+	start := address.PubKeyToAddress(m.Start[:])
+	remaining := m.Count
+	var cutoff time.Time
+	if m.Age != AllFrontiers {
+		cutoff = Clock.Now().Add(-time.Duration(m.Age) * time.Second)
+	}
+	for remaining > 0 {
+		n := FrontierChunk
+		if remaining != AllFrontiers && uint32(n) > remaining {
+			n = int(remaining)
+		}
+		page, next, err := frontiers(start, n)
+		if err != nil {
+			return err
+		}
+		sent := 0
+		for _, f := range page {
+			// Accounts with no record of changing are sent to be safe
+			if !cutoff.IsZero() {
+				if modified, ok := frontierModified(f.Hash); ok && modified.Before(cutoff) {
+					continue
+				}
+			}
+			pub, err := address.AddressToPub(f.Account)
+			if err != nil {
+				return err
+			}
+			bw.Write(pub)
+			bw.Write(f.Hash.ToBytes())
+			if m.Counts() {
+				height, _ := frontierHeight(f.Hash)
+				binary.Write(bw, binary.LittleEndian, height)
+			}
+			sent++
+		}
+		if err = bw.Flush(); err != nil {
+			return err
+		}
+		if remaining != AllFrontiers {
+			remaining -= uint32(sent)
+		}
+		if next == "" {
+			break
+		}
+		start = next
+	}
+	bw.Write(make([]byte, m.entrySize()))
+	return bw.Flush()
+}
+
+// ServeBootstrap answers the bootstrap requests sent on conn, for use
+// with TcpListener.Serve. It hangs up in safe mode.
+func ServeBootstrap(conn net.Conn) {
+	if InSafeMode() {
+		return
+	}
+	packet := make([]byte, headerSize+frontierReqSize)
+	for {
+		if _, err := io.ReadFull(conn, packet[:headerSize]); err != nil {
+			return
+		}
+		if packet[5] != protocol.MessageFrontierReq {
+			log.Printf("Ignored bootstrap %s", protocol.MessageTypeName(packet[5]))
+			return
+		}
+		if _, err := io.ReadFull(conn, packet[headerSize:]); err != nil {
+			return
+		}
+		m, err := ReadMessage(bytes.NewBuffer(packet))
+		if err != nil {
+			log.Printf("Failed to read frontier_req: %s", err)
+			return
+		}
+		if err = ServeFrontierReq(conn, m.(*MessageFrontierReq)); err != nil {
+			log.Printf("Failed to serve frontiers: %s", err)
+			return
+		}
+	}
+}
+
+// ListenForBootstrap serves bootstrap requests over tcp on ListenPort.
+func ListenForBootstrap() error {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", ListenPort))
+	if err != nil {
+		return err
+	}
+	return NewTcpListener(ln, DefaultConnLimits).Serve(ServeBootstrap)
+}
+
+type wireFrontier struct {
+	account [32]byte
+	hash    [32]byte
+	// Zero unless asked for with ExtensionFrontierCounts
+	blocks uint64
+}
+
+func (f wireFrontier) frontier() store.Frontier {
+	return store.Frontier{
+		Account: address.PubKeyToAddress(f.account[:]),
+		Hash:    types.BlockHashFromBytes(f.hash[:]),
+		Blocks:  f.blocks,
+	}
+}
+
+// Reads the response to req up to its all zero terminator, which must be
+// in account order and no longer than its count.
+func readFrontiers(r io.Reader, req *MessageFrontierReq, fn func(wireFrontier) error) error {
+	count := req.Count
+	entry := make([]byte, req.entrySize())
+	var last wireFrontier
+	for n := uint32(0); ; n++ {
+		if _, err := io.ReadFull(r, entry); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		var f wireFrontier
+		copy(f.account[:], entry)
+		copy(f.hash[:], entry[32:])
+		if req.Counts() {
+			f.blocks = binary.LittleEndian.Uint64(entry[frontierSize:])
+		}
+		if f == (wireFrontier{}) {
+			return nil
+		}
+		if n > 0 && bytes.Compare(f.account[:], last.account[:]) <= 0 {
+			return ErrFrontierRegression
+		}
+		if n >= count {
+			return ErrTooManyFrontiers
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+		last = f
+	}
+}
+
+// Sends a frontier_req to peer for accounts changed within age seconds
+// and reads its response.
+func requestFrontiers(ctx context.Context, peer Peer, start [32]byte, count uint32, age uint32) ([]wireFrontier, error) {
+	conn, hangUp, err := dialBootstrap(ctx, peer)
+	if err != nil {
+		return nil, err
+	}
+	defer hangUp()
+
+	var buf bytes.Buffer
+	req := CreateFrontierReq(start, count)
+	req.Age = age
+	req.countsFor(PeerVersion(peer))
+	req.Write(&buf)
+	if _, err = conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	var page []wireFrontier
+	err = readFrontiers(bufio.NewReader(conn), req, func(f wireFrontier) error {
+		page = append(page, f)
+		return nil
+	})
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// FetchFrontiers reads all of peer's frontiers, a frontier_req of up to
+// pageSize for each page, calling fn with each in account order, with
+// its block count if the peer speaks protocol.CapabilityFrontierCounts.
+// Every page after the first starts at the last account received, which
+// is skipped. A peer that goes backwards or repeats itself gets a
+// misbehavior point and the fetch stops.
+func FetchFrontiers(ctx context.Context, peer Peer, pageSize uint32, fn func(store.Frontier) error) error {
+	return fetchFrontiers(ctx, peer, pageSize, AllFrontiers, fn)
+}
+
+func fetchFrontiers(ctx context.Context, peer Peer, pageSize uint32, age uint32, fn func(store.Frontier) error) error {
+	if pageSize < 2 {
+		return errors.New("Frontier pages must hold at least two")
+	}
+	var start, last [32]byte
+	received := false
+	count := 0
+	for {
+		page, err := requestFrontiers(ctx, peer, start, pageSize, age)
+		if err == ErrFrontierRegression || err == ErrTooManyFrontiers {
+			misbehaved(peer)
+		}
+		if err != nil {
+			return err
+		}
+
+		for i, f := range page {
+			if received {
+				c := bytes.Compare(f.account[:], last[:])
+				if i == 0 && c == 0 {
+					continue
+				}
+				if c <= 0 {
+					misbehaved(peer)
+					return ErrFrontierRegression
+				}
+			}
+			if err = fn(f.frontier()); err != nil {
+				return err
+			}
+			last, received = f.account, true
+			count++
+		}
+		Events.Publish(Event{Type: EventBootstrap, Peer: peer.String(), Count: count})
+		if uint32(len(page)) < pageSize {
+			return nil
+		}
+		start = last
+	}
+}
+
+// Where when each peer's frontiers were last listed in full is kept, by
+// its address
+const frontierSyncPrefix = "frontiersync"
+
+const (
+	// Added to the age an incremental FrontierSync asks for, for clocks
+	// that disagree and blocks that reached the peer late
+	DefaultFrontierSyncMargin = 10 * time.Minute
+	// Past this since the last listing, a FrontierSync lists everything
+	DefaultFrontierSyncMaxAge = 24 * time.Hour
+)
+
+// A FrontierSync lists a peer's frontiers to compare with ours. After
+// one complete listing, the next only asks for accounts that changed on
+// the peer since it started, with a margin, rather than the whole
+// ledger. It lists everything again when there's no complete listing
+// recorded for the peer, or it was longer ago than MaxAge.
+type FrontierSync struct {
+	Peer     Peer
+	PageSize uint32
+	Margin   time.Duration
+	MaxAge   time.Duration
+}
+
+func NewFrontierSync(peer Peer) *FrontierSync {
+	return &FrontierSync{
+		Peer:     peer,
+		PageSize: DefaultFrontierPage,
+		Margin:   DefaultFrontierSyncMargin,
+		MaxAge:   DefaultFrontierSyncMaxAge,
+	}
+}
+
+// The age to ask for, AllFrontiers for a full listing.
+func (s *FrontierSync) age(now time.Time) uint32 {
+	var last int64
+	if store.FetchMeta(frontierSyncPrefix, []byte(s.Peer.String()), &last) != nil {
+		return AllFrontiers
+	}
+	age := now.Sub(time.Unix(last, 0)) + s.Margin
+	if age < 0 || age > s.MaxAge || age/time.Second >= AllFrontiers {
+		return AllFrontiers
+	}
+	// Rounded up, so nothing at the edge is missed
+	return uint32((age + time.Second - 1) / time.Second)
+}
+
+// Run lists the peer's frontiers as FetchFrontiers does, only those that
+// changed since the last listing if it can. incremental says which it
+// did. The listing counts for the next one only if it completes.
+func (s *FrontierSync) Run(ctx context.Context, fn func(store.Frontier) error) (incremental bool, err error) {
+	start := Clock.Now()
+	age := s.age(start)
+	if err = fetchFrontiers(ctx, s.Peer, s.PageSize, age, fn); err != nil {
+		return age != AllFrontiers, err
+	}
+	return age != AllFrontiers, store.StoreMeta(frontierSyncPrefix, []byte(s.Peer.String()), start.Unix())
+}
+
+// Points against peers for breaking the protocol, by address
+var misbehavior = struct {
+	sync.Mutex
+	scores map[string]int
+}{scores: make(map[string]int)}
+
+func misbehaved(peer Peer) {
+	misbehavior.Lock()
+	misbehavior.scores[peer.IP.String()]++
+	misbehavior.Unlock()
+}
+
+func MisbehaviorScore(peer Peer) int {
+	misbehavior.Lock()
+	defer misbehavior.Unlock()
+	return misbehavior.scores[peer.IP.String()]
+}
@@ -0,0 +1,58 @@
+package node
+
+import (
+	"sync"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/utils"
+)
+
+type blockHandler struct {
+	guard *utils.Guard
+	fn    func(blocks.Block)
+}
+
+var blockHandlers struct {
+	lock     sync.Mutex
+	handlers []*blockHandler
+}
+
+// Guards the packet handler itself, never disabled
+var packetGuard = utils.NewGuard("packets", 0)
+
+// OnBlock registers fn to be called with every block stored from the
+// network. A handler that keeps panicking is removed.
+func OnBlock(name string, fn func(blocks.Block)) *utils.Guard {
+	blockHandlers.lock.Lock()
+	defer blockHandlers.lock.Unlock()
+
+	h := &blockHandler{utils.NewGuard(name, utils.DefaultMaxPanics), fn}
+	blockHandlers.handlers = append(blockHandlers.handlers, h)
+	return h.guard
+}
+
+func RemoveBlockHandler(name string) {
+	blockHandlers.lock.Lock()
+	defer blockHandlers.lock.Unlock()
+
+	handlers := blockHandlers.handlers[:0]
+	for _, h := range blockHandlers.handlers {
+		if h.guard.Name != name {
+			handlers = append(handlers, h)
+		}
+	}
+	blockHandlers.handlers = handlers
+}
+
+func notifyBlockHandlers(block blocks.Block) {
+	blockHandlers.lock.Lock()
+	handlers := append([]*blockHandler{}, blockHandlers.handlers...)
+	blockHandlers.lock.Unlock()
+
+	for _, h := range handlers {
+		h.guard.Call(func() { h.fn(block) })
+		if h.guard.Disabled() {
+			RemoveBlockHandler(h.guard.Name)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/metrics"
+	"github.com/frankh/nano/store"
+)
+
+// Names of the health checks. The rpc's is registered where the rpc is
+// started, the rest by the node.
+const (
+	HealthStore     = "store"
+	HealthPeers     = "peers"
+	HealthBootstrap = "bootstrap"
+	HealthDisk      = "disk"
+	HealthClock     = "clock"
+	HealthRPC       = "rpc"
+)
+
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	// Results in a row it takes for a check to change state
+	DefaultHealthFailAfter = 3
+	DefaultHealthPassAfter = 3
+)
+
+// Checks readiness waits for unless configured otherwise
+var DefaultHealthRequired = []string{HealthStore, HealthPeers, HealthDisk, HealthClock}
+
+// Peers the node needs to count as ready
+var HealthMinPeers = 1
+
+// A bootstrap receiving nothing for this long counts as wedged
+var BootstrapStallTime = 10 * time.Minute
+
+// The wall clock counts as insane if it's before this, or for a while
+// after it steps by more than clockMaxStep
+var clockFloor = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const clockMaxStep = time.Minute
+const clockSteadyTime = 10 * time.Minute
+
+var ErrHealthNotRegistered = errors.New("Not registered")
+
+// A HealthCheck returns why a component is unhealthy, nil if it's fine.
+type HealthCheck func() error
+
+// HealthStatus is the state of one health check as of its last run.
+type HealthStatus struct {
+	Name     string `json:"name"`
+	Required bool   `json:"required"`
+	Healthy  bool   `json:"healthy"`
+	// From the last run, which Healthy only follows once it's held for a
+	// few runs
+	Error string `json:"error,omitempty"`
+	// When Healthy last changed
+	Since time.Time `json:"since"`
+}
+
+type healthCheck struct {
+	check   HealthCheck
+	ran     bool
+	healthy bool
+	err     error
+	// Results in a row against healthy
+	streak int
+	since  time.Time
+}
+
+// A HealthRegistry runs components' health checks for liveness and
+// readiness probes. A check only changes state once it's had the same
+// result FailAfter or PassAfter times in a row, so one that flaps doesn't
+// flap readiness. The node is ready while every required check is
+// healthy.
+type HealthRegistry struct {
+	FailAfter int
+	PassAfter int
+
+	lock     sync.Mutex
+	checks   map[string]*healthCheck
+	required map[string]bool
+	ready    bool
+}
+
+func NewHealthRegistry() *HealthRegistry {
+	h := &HealthRegistry{
+		FailAfter: DefaultHealthFailAfter,
+		PassAfter: DefaultHealthPassAfter,
+		checks:    make(map[string]*healthCheck),
+	}
+	h.SetRequired(DefaultHealthRequired)
+	return h
+}
+
+// The node's health, with its own checks registered
+var Health = newNodeHealth()
+
+func newNodeHealth() *HealthRegistry {
+	h := NewHealthRegistry()
+	h.Register(HealthStore, store.CheckWritable)
+	h.Register(HealthPeers, checkPeerCount)
+	h.Register(HealthBootstrap, checkBootstrap)
+	h.Register(HealthDisk, checkDisk)
+	h.Register(HealthClock, clockCheck(Clock.Now(), Clock.Monotonic()))
+	return h
+}
+
+// Register adds a check, replacing any of the same name.
+func (h *HealthRegistry) Register(name string, check HealthCheck) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.checks[name] = &healthCheck{check: check}
+}
+
+// SetRequired sets the checks readiness waits for. Naming one that isn't
+// registered keeps the node from being ready, so a typo doesn't go
+// unnoticed.
+func (h *HealthRegistry) SetRequired(names []string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.required = make(map[string]bool)
+	for _, name := range names {
+		h.required[name] = true
+	}
+}
+
+// Run runs every check, logging when readiness changes.
+func (h *HealthRegistry) Run() {
+	h.lock.Lock()
+	checks := make(map[string]HealthCheck, len(h.checks))
+	for name, c := range h.checks {
+		checks[name] = c.check
+	}
+	h.lock.Unlock()
+
+	// Outside the lock, since checks can be slow
+	results := make(map[string]error, len(checks))
+	for name, check := range checks {
+		results[name] = check()
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for name, err := range results {
+		if c, ok := h.checks[name]; ok {
+			h.record(name, c, err)
+		}
+	}
+	ready, failing := h.readiness()
+	if ready != h.ready {
+		if ready {
+			log.Printf("Node is ready")
+		} else {
+			log.Printf("Node isn't ready: %s", strings.Join(failing, ", "))
+		}
+		h.ready = ready
+	}
+}
+
+// Called with the lock held.
+func (h *HealthRegistry) record(name string, c *healthCheck, err error) {
+	c.err = err
+	if !c.ran {
+		// Nothing to smooth yet
+		c.ran, c.healthy, c.since = true, err == nil, Clock.Now()
+		return
+	}
+	if (err == nil) == c.healthy {
+		c.streak = 0
+		return
+	}
+	c.streak++
+	needed := h.FailAfter
+	if !c.healthy {
+		needed = h.PassAfter
+	}
+	if c.streak >= needed {
+		c.healthy, c.streak, c.since = !c.healthy, 0, Clock.Now()
+		if c.healthy {
+			log.Printf("Health check %s is passing", name)
+		} else {
+			log.Printf("Health check %s is failing: %s", name, err)
+		}
+	}
+}
+
+// Whether every required check is healthy, and which aren't. Called with
+// the lock held.
+func (h *HealthRegistry) readiness() (bool, []string) {
+	var failing []string
+	for name := range h.required {
+		if c, ok := h.checks[name]; !ok || !c.ran || !c.healthy {
+			failing = append(failing, name)
+		}
+	}
+	sort.Strings(failing)
+	return len(failing) == 0, failing
+}
+
+// Status is whether the node is ready, and every check's state by name.
+// Required checks that aren't registered are included as failing.
+func (h *HealthRegistry) Status() (bool, []HealthStatus) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var statuses []HealthStatus
+	for name, c := range h.checks {
+		status := HealthStatus{Name: name, Required: h.required[name], Healthy: c.ran && c.healthy, Since: c.since}
+		if c.err != nil {
+			status.Error = c.err.Error()
+		} else if !c.ran {
+			status.Error = "Not run yet"
+		}
+		statuses = append(statuses, status)
+	}
+	for name := range h.required {
+		if _, ok := h.checks[name]; !ok {
+			statuses = append(statuses, HealthStatus{Name: name, Required: true, Error: ErrHealthNotRegistered.Error()})
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	ready, _ := h.readiness()
+	return ready, statuses
+}
+
+// ServeHTTP answers liveness probes on /health, which pass whenever the
+// process can answer, and readiness probes on /ready, which fail with 503
+// until every required check is healthy. Both reply in JSON, readiness
+// with each check's state.
+func (h *HealthRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/health":
+		json.NewEncoder(w).Encode(struct {
+			Status string `json:"status"`
+		}{"up"})
+	case "/ready":
+		ready, checks := h.Status()
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(struct {
+			Ready  bool           `json:"ready"`
+			Checks []HealthStatus `json:"checks"`
+		}{ready, checks})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Runs Health's checks, for an Alarm.
+func CheckHealth([]interface{}) {
+	Health.Run()
+}
+
+func checkPeerCount() error {
+	peersLock.Lock()
+	count := len(PeerList)
+	peersLock.Unlock()
+	if count < HealthMinPeers {
+		return fmt.Errorf("%d peers, fewer than %d", count, HealthMinPeers)
+	}
+	return nil
+}
+
+func checkBootstrap() error {
+	if Bootstrap.Stalled(BootstrapStallTime) {
+		return fmt.Errorf("Bootstrap has received nothing for %s", BootstrapStallTime)
+	}
+	return nil
+}
+
+func checkDisk() error {
+	if mode := store.Mode(); mode.Mode == store.LedgerReadOnly {
+		return errors.New(mode.Reason)
+	}
+	for _, u := range Disk.Usage() {
+		if u.Err != "" {
+			return fmt.Errorf("Can't read free space on %s: %s", u.Path, u.Err)
+		}
+	}
+	return nil
+}
+
+// Checks the wall clock is plausible and hasn't stepped by more than
+// clockMaxStep in the last clockSteadyTime, against monotonic time from
+// the given start.
+func clockCheck(wall time.Time, mono time.Duration) HealthCheck {
+	var lock sync.Mutex
+	// Wall time less monotonic time, which only changes when the wall
+	// clock steps
+	offset := wall.Sub(clockFloor) - mono
+	var stepped bool
+	var steppedBy, steppedAt time.Duration
+	return func() error {
+		lock.Lock()
+		defer lock.Unlock()
+		now, elapsed := Clock.Now(), Clock.Monotonic()
+		if now.Before(clockFloor) {
+			return fmt.Errorf("Wall clock is at %s", now.UTC().Format(time.RFC3339))
+		}
+		current := now.Sub(clockFloor) - elapsed
+		if step := current - offset; step > clockMaxStep || step < -clockMaxStep {
+			stepped, steppedBy, steppedAt = true, step, elapsed
+		}
+		offset = current
+		if stepped && elapsed-steppedAt < clockSteadyTime {
+			return fmt.Errorf("Wall clock stepped by %s", steppedBy)
+		}
+		return nil
+	}
+}
+
+var healthGauge = metrics.NewGaugeFunc("nano_health", "Whether each health check is passing, and whether the node is ready, by check.", "check", func() map[string]float64 {
+	ready, checks := Health.Status()
+	series := map[string]float64{"ready": 0}
+	if ready {
+		series["ready"] = 1
+	}
+	for _, c := range checks {
+		series[c.Name] = 0
+		if c.Healthy {
+			series[c.Name] = 1
+		}
+	}
+	return series
+})
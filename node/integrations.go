@@ -0,0 +1,23 @@
+//go:build !light
+// +build !light
+
+package node
+
+import (
+	"context"
+	"net"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/utils"
+	"github.com/frankh/nano/wallet"
+)
+
+// Makes an outbound tcp connection, through the proxy if one's set.
+func dialOutbound(ctx context.Context, addr string) (net.Conn, error) {
+	return utils.Outbound.DialContext(ctx, "tcp", addr)
+}
+
+// Tells the wallet's webhooks of a newly stored block.
+func notifyWebhooks(block blocks.Block) {
+	wallet.Webhooks.NotifyBlock(block)
+}
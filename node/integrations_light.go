@@ -0,0 +1,21 @@
+//go:build light
+// +build light
+
+package node
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/frankh/nano/blocks"
+)
+
+// Light builds leave out the proxy, so connect directly.
+func dialOutbound(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// Light builds leave out webhooks.
+func notifyWebhooks(block blocks.Block) {}
@@ -0,0 +1,212 @@
+package node
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Limits for inbound TCP connections, e.g. bootstrap serving. Zero means
+// unlimited.
+type ConnLimits struct {
+	MaxConns      int
+	MaxConnsPerIP int
+	// Reset on every read and write
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+}
+
+var DefaultConnLimits = ConnLimits{
+	MaxConns:      512,
+	MaxConnsPerIP: 8,
+	IdleTimeout:   30 * time.Second,
+	MaxLifetime:   30 * time.Minute,
+}
+
+const maxAcceptBackoff = time.Second
+
+type ListenerStats struct {
+	Accepted      uint64
+	Active        int
+	Rejected      uint64
+	RejectedPerIP uint64
+	TimedOut      uint64
+}
+
+// TcpListener accepts connections within its limits and closes the rest
+// straight away.
+type TcpListener struct {
+	ln     net.Listener
+	lock   sync.Mutex
+	limits ConnLimits
+	perIP  map[string]int
+	stats  ListenerStats
+}
+
+func NewTcpListener(ln net.Listener, limits ConnLimits) *TcpListener {
+	return &TcpListener{
+		ln:     ln,
+		limits: limits,
+		perIP:  make(map[string]int),
+	}
+}
+
+func (l *TcpListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+func (l *TcpListener) Close() error {
+	return l.ln.Close()
+}
+
+// SetLimits applies to new connections and to the next read or write of
+// existing ones.
+func (l *TcpListener) SetLimits(limits ConnLimits) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.limits = limits
+}
+
+func (l *TcpListener) Limits() ConnLimits {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.limits
+}
+
+func (l *TcpListener) Stats() ListenerStats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.stats
+}
+
+// Serve runs handler in its own goroutine for each accepted connection,
+// closing it when handler returns. Returns when the listener is closed.
+func (l *TcpListener) Serve(handler func(net.Conn)) error {
+	var backoff time.Duration
+
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if backoff == 0 {
+					backoff = 5 * time.Millisecond
+				} else {
+					backoff *= 2
+				}
+				if backoff > maxAcceptBackoff {
+					backoff = maxAcceptBackoff
+				}
+				time.Sleep(backoff)
+				continue
+			}
+			return err
+		}
+		backoff = 0
+
+		limited := l.admit(conn)
+		if limited == nil {
+			conn.Close()
+			continue
+		}
+
+		go func() {
+			defer limited.Close()
+			handler(limited)
+		}()
+	}
+}
+
+func (l *TcpListener) admit(conn net.Conn) *limitedConn {
+	ip := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.limits.MaxConns > 0 && l.stats.Active >= l.limits.MaxConns {
+		l.stats.Rejected++
+		return nil
+	}
+	if l.limits.MaxConnsPerIP > 0 && l.perIP[ip] >= l.limits.MaxConnsPerIP {
+		l.stats.Rejected++
+		l.stats.RejectedPerIP++
+		return nil
+	}
+
+	l.stats.Accepted++
+	l.stats.Active++
+	l.perIP[ip]++
+
+	c := &limitedConn{Conn: conn, listener: l, ip: ip}
+	if l.limits.MaxLifetime > 0 {
+		c.expires = time.Now().Add(l.limits.MaxLifetime)
+	}
+	return c
+}
+
+func (l *TcpListener) release(ip string, timedOut bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.stats.Active--
+	l.perIP[ip]--
+	if l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+	if timedOut {
+		l.stats.TimedOut++
+	}
+}
+
+type limitedConn struct {
+	net.Conn
+	listener *TcpListener
+	ip       string
+	// Zero if there's no maximum lifetime
+	expires  time.Time
+	timedOut bool
+	once     sync.Once
+}
+
+// Pushes the deadline out by the idle timeout, but never past the end of
+// the connection's lifetime.
+func (c *limitedConn) extend() {
+	var deadline time.Time
+	if idle := c.listener.Limits().IdleTimeout; idle > 0 {
+		deadline = time.Now().Add(idle)
+	}
+	if !c.expires.IsZero() && (deadline.IsZero() || c.expires.Before(deadline)) {
+		deadline = c.expires
+	}
+	c.Conn.SetDeadline(deadline)
+}
+
+func (c *limitedConn) check(err error) {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		c.timedOut = true
+	}
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	c.extend()
+	n, err := c.Conn.Read(b)
+	c.check(err)
+	return n, err
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	c.extend()
+	n, err := c.Conn.Write(b)
+	c.check(err)
+	return n, err
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.listener.release(c.ip, c.timedOut)
+	})
+	return err
+}
@@ -0,0 +1,208 @@
+package node
+
+import (
+	"sync"
+	"time"
+)
+
+const DefaultPeerCutoff = 5 * time.Minute
+const DefaultProbeFailures = 3
+const maxCooldown = 6 * time.Hour
+
+// Peers not heard from in this long are dropped from the peer list
+var PeerExpiry = 24 * time.Hour
+
+type PeerState int
+
+const (
+	PeerLive PeerState = iota
+	// Not heard from in half the cutoff, being sent direct probes
+	PeerProbing
+	// Dead, retried with exponential backoff until it answers
+	PeerCooldown
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerLive:
+		return "live"
+	case PeerProbing:
+		return "probing"
+	case PeerCooldown:
+		return "cooldown"
+	default:
+		return "unknown"
+	}
+}
+
+type PeerStatus struct {
+	Peer     string
+	State    PeerState
+	LastSeen time.Duration
+	Failures int
+	// When a peer in cooldown is next probed
+	Retry time.Duration
+}
+
+type peerLiveness struct {
+	peer     Peer
+	state    PeerState
+	lastSeen time.Duration
+	probed   time.Duration
+	failures int
+	backoff  time.Duration
+	retry    time.Duration
+}
+
+// Liveness tells apart peers that are merely quiet from peers that can't
+// be reached, by probing quiet peers directly and counting the probes
+// that go unanswered.
+type Liveness struct {
+	lock        sync.Mutex
+	cutoff      time.Duration
+	maxFailures int
+	probe       func(Peer) error
+	peers       map[string]*peerLiveness
+}
+
+func NewLiveness(cutoff time.Duration, maxFailures int, probe func(Peer) error) *Liveness {
+	return &Liveness{
+		cutoff:      cutoff,
+		maxFailures: maxFailures,
+		probe:       probe,
+		peers:       make(map[string]*peerLiveness),
+	}
+}
+
+var PeerLiveness = NewLiveness(DefaultPeerCutoff, DefaultProbeFailures, SendKeepAlive)
+
+// Starts tracking a peer, counting it as just heard from.
+func (l *Liveness) Add(peer Peer) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.peers[peer.String()] == nil {
+		l.peers[peer.String()] = &peerLiveness{peer: peer, lastSeen: Clock.Monotonic()}
+	}
+}
+
+// Heard marks any message from the peer, bringing it back from probing
+// or cooldown. Only peers already tracked are refreshed, so a packet from
+// an address that isn't in the peer table can't add it here.
+func (l *Liveness) Heard(peer Peer) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	p := l.peers[peer.String()]
+	if p == nil {
+		return
+	}
+	p.state = PeerLive
+	p.lastSeen = Clock.Monotonic()
+	p.failures = 0
+	p.backoff = 0
+}
+
+// Tick sends any probes that are due and marks peers dead once they've
+// missed too many. It should run more often than half the cutoff.
+func (l *Liveness) Tick() {
+	l.lock.Lock()
+	now := Clock.Monotonic()
+	interval := l.cutoff / 2
+	var due []Peer
+
+	for _, p := range l.peers {
+		switch p.state {
+		case PeerLive:
+			if now-p.lastSeen < interval {
+				continue
+			}
+			p.state = PeerProbing
+			p.probed = now
+			due = append(due, p.peer)
+
+		case PeerProbing:
+			// Spread the probes over the second half of the cutoff
+			if now-p.probed < interval/time.Duration(l.maxFailures) {
+				continue
+			}
+			p.failures++
+			if p.failures >= l.maxFailures {
+				p.state = PeerCooldown
+				p.backoff = l.cutoff
+				p.retry = now + p.backoff
+				continue
+			}
+			p.probed = now
+			due = append(due, p.peer)
+
+		case PeerCooldown:
+			if now < p.retry {
+				continue
+			}
+			p.backoff *= 2
+			if p.backoff > maxCooldown {
+				p.backoff = maxCooldown
+			}
+			p.retry = now + p.backoff
+			due = append(due, p.peer)
+		}
+	}
+	l.lock.Unlock()
+
+	// Probing outside the lock so a slow send can't block Heard
+	for _, peer := range due {
+		l.probe(peer)
+	}
+}
+
+// Expire stops tracking peers not heard from within timeout, returning
+// them.
+func (l *Liveness) Expire(timeout time.Duration) []Peer {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := Clock.Monotonic()
+	var expired []Peer
+	for key, p := range l.peers {
+		if now-p.lastSeen >= timeout {
+			expired = append(expired, p.peer)
+			delete(l.peers, key)
+		}
+	}
+	return expired
+}
+
+func (l *Liveness) Remove(peer Peer) {
+	l.lock.Lock()
+	delete(l.peers, peer.String())
+	l.lock.Unlock()
+}
+
+func (l *Liveness) State(peer Peer) (PeerState, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	p := l.peers[peer.String()]
+	if p == nil {
+		return PeerLive, false
+	}
+	return p.state, true
+}
+
+// Statuses of all tracked peers, for the peers RPC.
+func (l *Liveness) Statuses() []PeerStatus {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	statuses := make([]PeerStatus, 0, len(l.peers))
+	for key, p := range l.peers {
+		statuses = append(statuses, PeerStatus{key, p.state, p.lastSeen, p.failures, p.retry})
+	}
+	return statuses
+}
+
+func ProbePeers(params []interface{}) {
+	PeerLiveness.Tick()
+	ExpirePeers()
+}
@@ -0,0 +1,297 @@
+package node
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/utils"
+)
+
+// Foreground load past which maintenance jobs wait
+const DefaultMaxQueueDepth = contendedDepth
+const DefaultMaxStoreLatency = 50 * time.Millisecond
+
+const DefaultMaintenanceBackoff = time.Second
+const DefaultSliceGap = 10 * time.Millisecond
+
+// How often the scheduler checks for due jobs
+const maintenanceTick = time.Second
+
+var ErrUnknownJob = errors.New("Unknown maintenance job")
+var ErrDuplicateJob = errors.New("Maintenance job already registered")
+
+// A MaintenanceJob is background work done a small slice at a time, so
+// the scheduler can pause it between slices while the node is busy.
+type MaintenanceJob struct {
+	Name string
+	// Jobs in the same group never run at once, e.g. compaction and
+	// backup. Empty for none.
+	Group string
+	// Runs this long after the last run started. Zero for only when
+	// triggered.
+	Every time.Duration
+	// Does a slice of the work, returning true once the run is finished
+	Slice func() (finished bool, err error)
+}
+
+// Statuses of a maintenance job
+const (
+	JobIdle       = "idle"
+	JobRunning    = "running"
+	JobBackingOff = "backing_off"
+	// Waiting for another job in its group
+	JobWaiting = "waiting"
+	JobFailed  = "failed"
+)
+
+type MaintenanceStatus struct {
+	Name         string
+	Group        string
+	Status       string
+	LastRun      time.Time
+	LastDuration time.Duration
+	LastError    string
+	Runs         uint64
+	Slices       uint64
+	// Times it waited for the foreground load to drop
+	Backoffs uint64
+}
+
+type scheduledJob struct {
+	MaintenanceJob
+	status    MaintenanceStatus
+	running   bool
+	triggered bool
+	// A panicking slice fails the run, not the node
+	guard *utils.Guard
+}
+
+// MaintenanceScheduler runs background jobs when they're due, a slice at
+// a time, backing off while the block processor's queue or the store's
+// write latency is over its limit.
+type MaintenanceScheduler struct {
+	MaxQueueDepth   int
+	MaxStoreLatency time.Duration
+	// How long to wait for the load to drop before checking again
+	Backoff time.Duration
+	// Pause between slices even when idle, to bound a job's share of the
+	// cpu and disk
+	SliceGap time.Duration
+	// The foreground load, the processor queue and store latency if nil
+	Load func() (queued int, latency time.Duration)
+
+	lock sync.Mutex
+	jobs map[string]*scheduledJob
+	// The job running in each group
+	groups map[string]string
+	// Signalled as jobs finish
+	idle *sync.Cond
+}
+
+func NewMaintenanceScheduler() *MaintenanceScheduler {
+	s := &MaintenanceScheduler{
+		MaxQueueDepth:   DefaultMaxQueueDepth,
+		MaxStoreLatency: DefaultMaxStoreLatency,
+		Backoff:         DefaultMaintenanceBackoff,
+		SliceGap:        DefaultSliceGap,
+		jobs:            make(map[string]*scheduledJob),
+		groups:          make(map[string]string),
+	}
+	s.idle = sync.NewCond(&s.lock)
+	return s
+}
+
+var Maintenance = NewMaintenanceScheduler()
+
+func (s *MaintenanceScheduler) Register(job MaintenanceJob) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.jobs[job.Name]; ok {
+		return ErrDuplicateJob
+	}
+	s.jobs[job.Name] = &scheduledJob{
+		MaintenanceJob: job,
+		status:         MaintenanceStatus{Name: job.Name, Group: job.Group, Status: JobIdle},
+		guard:          utils.NewGuard("maintenance "+job.Name, 0),
+	}
+	return nil
+}
+
+// Trigger runs a job now, or once its current run finishes.
+func (s *MaintenanceScheduler) Trigger(name string) error {
+	s.lock.Lock()
+	j, ok := s.jobs[name]
+	if ok {
+		j.triggered = true
+	}
+	s.lock.Unlock()
+	if !ok {
+		return ErrUnknownJob
+	}
+	s.startDue(Clock.Now())
+	return nil
+}
+
+// Status of every job, by name.
+func (s *MaintenanceScheduler) Status() []MaintenanceStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var result []MaintenanceStatus
+	for _, j := range s.jobs {
+		result = append(result, j.status)
+	}
+	sort.Slice(result, func(i, k int) bool { return result[i].Name < result[k].Name })
+	return result
+}
+
+// Run starts due jobs until done is closed.
+func (s *MaintenanceScheduler) Run(done chan bool) {
+	ticker := time.NewTicker(maintenanceTick)
+	defer ticker.Stop()
+	for {
+		s.startDue(Clock.Now())
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *MaintenanceScheduler) due(j *scheduledJob, now time.Time) bool {
+	if j.running {
+		return false
+	}
+	if j.triggered {
+		return true
+	}
+	return j.Every > 0 && !now.Before(j.status.LastRun.Add(j.Every))
+}
+
+func (s *MaintenanceScheduler) startDue(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.startDueLocked(now)
+}
+
+// Starts the jobs that are due and whose group is free.
+func (s *MaintenanceScheduler) startDueLocked(now time.Time) {
+	var names []string
+	for name := range s.jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		j := s.jobs[name]
+		if !s.due(j, now) {
+			continue
+		}
+		if j.Group != "" && s.groups[j.Group] != "" {
+			j.status.Status = JobWaiting
+			continue
+		}
+		if j.Group != "" {
+			s.groups[j.Group] = j.Name
+		}
+		j.running, j.triggered = true, false
+		j.status.Status = JobRunning
+		j.status.LastRun = now
+		go s.run(j)
+	}
+}
+
+func (s *MaintenanceScheduler) overloaded() bool {
+	load := s.Load
+	if load == nil {
+		load = foregroundLoad
+	}
+	queued, latency := load()
+	return queued > s.MaxQueueDepth || latency > s.MaxStoreLatency
+}
+
+func foregroundLoad() (int, time.Duration) {
+	return Processor.Stats().Queued, store.WriteLatency()
+}
+
+func (s *MaintenanceScheduler) setStatus(j *scheduledJob, status string) {
+	s.lock.Lock()
+	j.status.Status = status
+	if status == JobBackingOff {
+		j.status.Backoffs++
+	}
+	s.lock.Unlock()
+}
+
+func (s *MaintenanceScheduler) run(j *scheduledJob) {
+	start := time.Now()
+	var err error
+	for {
+		if s.overloaded() {
+			s.setStatus(j, JobBackingOff)
+			time.Sleep(s.Backoff)
+			continue
+		}
+		s.setStatus(j, JobRunning)
+
+		var finished bool
+		guardErr := j.guard.Call(func() { finished, err = j.Slice() })
+		if err == nil {
+			err = guardErr
+		}
+		s.lock.Lock()
+		j.status.Slices++
+		s.lock.Unlock()
+		if finished || err != nil {
+			break
+		}
+		time.Sleep(s.SliceGap)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	j.running = false
+	j.status.Runs++
+	j.status.LastDuration = time.Since(start)
+	j.status.Status, j.status.LastError = JobIdle, ""
+	if err != nil {
+		j.status.Status, j.status.LastError = JobFailed, err.Error()
+	}
+	if j.Group != "" {
+		delete(s.groups, j.Group)
+		// Whatever was waiting for the group goes next
+		s.startDueLocked(Clock.Now())
+	}
+	s.idle.Broadcast()
+}
+
+// Waits until no job is running.
+func (s *MaintenanceScheduler) wait() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for {
+		running := false
+		for _, j := range s.jobs {
+			running = running || j.running
+		}
+		if !running {
+			return
+		}
+		s.idle.Wait()
+	}
+}
+
+// ColdPendingJob moves dust out of the pending index every interval, a
+// batch per slice.
+func ColdPendingJob(policy store.ColdPendingPolicy, interval time.Duration) MaintenanceJob {
+	return MaintenanceJob{
+		Name:  "cold_pending",
+		Every: interval,
+		Slice: func() (bool, error) {
+			_, done := store.SweepColdPending(policy, time.Now())
+			return done, nil
+		},
+	}
+}
@@ -0,0 +1,33 @@
+package node
+
+import (
+	"github.com/frankh/nano/utils"
+)
+
+// Rough bytes per entry, including map and list overheads
+const (
+	publishEntrySize  = 500
+	voteEntrySize     = 320
+	electionEntrySize = 300
+	peerEntrySize     = 250
+	hintEntrySize     = 400
+)
+
+func init() {
+	utils.RegisterMemory("publish_cache", publishEntrySize, publishCacheSize,
+		func() int { return publishPackets.len() },
+		func(limit int) { publishPackets.setMax(limit) })
+	utils.RegisterMemory("rebroadcast_votes", voteEntrySize, maxTrackedVotes,
+		func() int { return rebroadcastVotes.len() },
+		func(limit int) { rebroadcastVotes.setMax(limit) })
+	utils.RegisterMemory("elections", electionEntrySize, maxTrackedBlocks,
+		func() int { return confirmations.len() },
+		func(limit int) { confirmations.setMax(limit) })
+	utils.RegisterMemory("vote_hints", hintEntrySize, maxVoteHints,
+		func() int { return voteHints.len() },
+		func(limit int) { voteHints.setMax(limit) })
+	// Known peers are kept, a lower limit only stops new ones being added
+	utils.RegisterMemory("peers", peerEntrySize, MaxPeers,
+		func() int { return len(PeerList) },
+		func(limit int) { MaxPeers = limit })
+}
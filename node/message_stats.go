@@ -0,0 +1,132 @@
+package node
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/frankh/nano/metrics"
+	"github.com/frankh/nano/protocol"
+)
+
+// Why packets are dropped, as MessageStats counts them
+const (
+	DropShort          = "short"
+	DropBadMagic       = "bad_magic"
+	DropBadVersion     = "bad_version"
+	DropUnknownMessage = "unknown_message"
+	DropUnknownBlock   = "unknown_block"
+	DropBadSignature   = "bad_signature"
+	DropSafeMode       = "safe_mode"
+	// Any other failure to decode
+	DropMalformed = "malformed"
+)
+
+var dropReasons = [...]string{DropShort, DropBadMagic, DropBadVersion, DropUnknownMessage, DropUnknownBlock, DropBadSignature, DropSafeMode, DropMalformed}
+
+// MessageStats counts what the node has received, since it started.
+// Everything is keyed by its name on the wire, e.g. "confirm_ack".
+type MessageStats struct {
+	// Messages decoded, by message type
+	Messages map[string]uint64
+	// Publishes decoded, by block type
+	Publishes map[string]uint64
+	// Packets dropped, by reason
+	Dropped map[string]uint64
+}
+
+var messageCounters struct {
+	messages  [256]uint64
+	publishes [256]uint64
+	dropped   [len(dropReasons)]uint64
+}
+
+// OnPacket, if set, is called with every packet received, before it's
+// decoded, e.g. to trace traffic. header is as read, so may be garbage,
+// and from is nil for packets from nowhere in particular. The packet is
+// the hook's to keep. It's called on the packet handler, so must be
+// quick.
+var OnPacket func(header MessageHeader, packet []byte, from *net.UDPAddr)
+
+func tracePacket(header MessageHeader, packet []byte, from Peer) {
+	if OnPacket == nil {
+		return
+	}
+	var addr *net.UDPAddr
+	if from.IP != nil {
+		addr = from.Addr()
+	}
+	OnPacket(header, append([]byte{}, packet...), addr)
+}
+
+func countMessage(header MessageHeader) {
+	atomic.AddUint64(&messageCounters.messages[header.MessageType], 1)
+	if header.MessageType == protocol.MessagePublish {
+		atomic.AddUint64(&messageCounters.publishes[header.BlockType], 1)
+	}
+}
+
+func countDrop(reason string) {
+	for i, r := range dropReasons {
+		if r == reason {
+			atomic.AddUint64(&messageCounters.dropped[i], 1)
+			return
+		}
+	}
+}
+
+// The reason for dropping a packet ReadMessage failed on.
+func dropReason(err error) string {
+	switch err {
+	case ErrShortMessage:
+		return DropShort
+	case ErrBadMagic:
+		return DropBadMagic
+	case ErrBadVersion:
+		return DropBadVersion
+	case ErrUnknownMessageType:
+		return DropUnknownMessage
+	case ErrUnknownBlockType:
+		return DropUnknownBlock
+	}
+	return DropMalformed
+}
+
+func GetMessageStats() MessageStats {
+	stats := MessageStats{
+		Messages:  make(map[string]uint64),
+		Publishes: make(map[string]uint64),
+		Dropped:   make(map[string]uint64),
+	}
+	for t := range messageCounters.messages {
+		if n := atomic.LoadUint64(&messageCounters.messages[t]); n > 0 {
+			stats.Messages[protocol.MessageTypeName(byte(t))] = n
+		}
+		if n := atomic.LoadUint64(&messageCounters.publishes[t]); n > 0 {
+			stats.Publishes[protocol.BlockTypeName(byte(t))] = n
+		}
+	}
+	for i, reason := range dropReasons {
+		stats.Dropped[reason] = atomic.LoadUint64(&messageCounters.dropped[i])
+	}
+	return stats
+}
+
+func floatCounts(counts map[string]uint64) map[string]float64 {
+	series := make(map[string]float64, len(counts))
+	for k, v := range counts {
+		series[k] = float64(v)
+	}
+	return series
+}
+
+var messagesGauge = metrics.NewGaugeFunc("nano_messages_received", "Messages decoded since starting, by type.", "type", func() map[string]float64 {
+	return floatCounts(GetMessageStats().Messages)
+})
+
+var publishesGauge = metrics.NewGaugeFunc("nano_publishes_received", "Publishes decoded since starting, by block type.", "block_type", func() map[string]float64 {
+	return floatCounts(GetMessageStats().Publishes)
+})
+
+var droppedPacketsGauge = metrics.NewGaugeFunc("nano_packets_dropped", "Packets dropped since starting, by reason.", "reason", func() map[string]float64 {
+	return floatCounts(GetMessageStats().Dropped)
+})
@@ -0,0 +1,112 @@
+package node
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/protocol"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+)
+
+// A Network groups everything that distinguishes one nano network
+// from another, so private networks can be run for testing.
+type Network struct {
+	Name          string
+	MagicNumber   [2]byte
+	Port          uint16
+	WorkThreshold uint64
+	Genesis       *blocks.OpenBlock
+}
+
+var LiveNetwork = Network{
+	"live",
+	protocol.MagicLive,
+	7075,
+	protocol.WorkLiveThreshold,
+	blocks.LiveGenesisBlock,
+}
+
+// The official nano_node test network
+var TestNetwork = Network{
+	"test",
+	protocol.MagicTest,
+	54000,
+	protocol.WorkTestThreshold,
+	blocks.TestGenesisBlock,
+}
+
+var ListenPort uint16 = LiveNetwork.Port
+
+// Creates a network, checking the genesis block is valid for it.
+func NewNetwork(name string, magic [2]byte, port uint16, workThreshold uint64, genesis *blocks.OpenBlock) (*Network, error) {
+	n := Network{name, magic, port, workThreshold, genesis}
+	err := n.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// The genesis open block must have a valid signature and work,
+// and be self referential: its source is its own account's public key.
+func (n *Network) Validate() error {
+	g := n.Genesis
+	if g == nil {
+		return errors.New("Missing genesis block")
+	}
+
+	if !address.ValidateAddress(g.Account) || !address.ValidateAddress(g.Representative) {
+		return errors.New("Invalid genesis account")
+	}
+
+	if !strings.EqualFold(string(g.SourceHash), string(g.RootHash())) {
+		return errors.New("Genesis source must be the genesis account's public key")
+	}
+
+	if g.Signature.Validate() != nil {
+		return errors.New("Invalid genesis signature")
+	}
+	if valid, _ := g.VerifySignature(); !valid {
+		return errors.New("Invalid genesis signature")
+	}
+
+	if g.Work.Validate() != nil || blocks.BlockWorkValue(g) < n.WorkThreshold {
+		return errors.New("Invalid genesis work")
+	}
+
+	return nil
+}
+
+// Switches the node's header validation, listening port and
+// work validation over to this network.
+func (n *Network) Activate() {
+	MagicNumber = n.MagicNumber
+	ListenPort = n.Port
+	blocks.WorkThreshold = n.WorkThreshold
+}
+
+func (n *Network) StoreConfig(path string) store.Config {
+	return store.Config{path, n.Genesis}
+}
+
+// Creates and signs a genesis block for the first account of a seed.
+func GenerateGenesis(seed string, workThreshold uint64) *blocks.OpenBlock {
+	pub, priv := address.KeypairFromSeed(seed, 0)
+	account := address.PubKeyToAddress(pub)
+	source := types.BlockHash(strings.ToUpper(hex.EncodeToString(pub)))
+
+	block := blocks.OpenBlock{
+		source,
+		account,
+		account,
+		blocks.CommonBlock{},
+	}
+	block.Work = blocks.GenerateWorkThreshold(block.RootHash(), workThreshold)
+	block.Signature = block.Hash().Sign(priv)
+
+	return &block
+}
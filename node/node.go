@@ -5,40 +5,19 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"time"
 
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/metrics"
+	"github.com/frankh/nano/protocol"
 	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/uint128"
 )
 
-var MagicNumber = [2]byte{'R', 'C'}
-
-const VersionMax = 0x05
-const VersionUsing = 0x05
-const VersionMin = 0x04
-
-// Non-idiomatic constant names to keep consistent with reference implentation
-const (
-	Message_invalid byte = iota
-	Message_not_a_type
-	Message_keepalive
-	Message_publish
-	Message_confirm_req
-	Message_confirm_ack
-	Message_bulk_pull
-	Message_bulk_push
-	Message_frontier_req
-)
-
-const (
-	BlockType_invalid byte = iota
-	BlockType_not_a_block
-	BlockType_send
-	BlockType_receive
-	BlockType_open
-	BlockType_change
-)
+var MagicNumber = LiveNetwork.MagicNumber
 
 type Peer struct {
 	IP           net.IP
@@ -59,6 +38,10 @@ type MessageHeader struct {
 type MessageKeepAlive struct {
 	MessageHeader
 	Peers []Peer
+	// With ExtensionSignedPeers, the sender's node key signs the peers
+	// and the unix time they were sent
+	Timestamp uint64
+	Signature [64]byte
 }
 
 type MessageConfirmAck struct {
@@ -77,16 +60,17 @@ type MessagePublish struct {
 }
 
 type Message interface {
-	Write(buf *bytes.Buffer) error
+	Write(w io.Writer) error
 }
 
 func CreateKeepAlive(peers []Peer) *MessageKeepAlive {
 	var m MessageKeepAlive
 	m.MessageHeader.MagicNumber = MagicNumber
-	m.MessageHeader.VersionMax = VersionMax
-	m.MessageHeader.VersionUsing = VersionUsing
-	m.MessageHeader.VersionMin = VersionMin
-	m.MessageHeader.MessageType = Message_keepalive
+	m.MessageHeader.VersionMax = protocol.VersionMax
+	m.MessageHeader.VersionUsing = protocol.VersionUsing
+	m.MessageHeader.VersionMin = protocol.VersionMin
+	m.MessageHeader.MessageType = protocol.MessageKeepalive
+	m.Peers = peers
 	return &m
 }
 
@@ -99,131 +83,328 @@ func (p *Peer) String() string {
 	return fmt.Sprintf("%s:%d", p.IP.String(), p.Port)
 }
 
+// Looked up once so timing messages doesn't allocate
+var messageDurations = func() (durations [protocol.MessageFrontierReq + 1]*metrics.Histogram) {
+	for t := range durations {
+		durations[t] = metrics.MessageDuration.With(protocol.MessageTypeName(byte(t)))
+	}
+	return durations
+}()
+
+var unknownMessageDuration = metrics.MessageDuration.With("unknown")
+
+func messageDuration(messageType byte) *metrics.Histogram {
+	if int(messageType) >= len(messageDurations) {
+		return unknownMessageDuration
+	}
+	return messageDurations[messageType]
+}
+
 func handleMessage(buf *bytes.Buffer) {
+	handleMessageFrom(buf, Peer{})
+}
+
+// Handles a message from peer, or from nowhere in particular if it has no
+// IP.
+func handleMessageFrom(buf *bytes.Buffer, from Peer) {
+	start := time.Now()
 	var header MessageHeader
 	header.ReadHeader(bytes.NewBuffer(buf.Bytes()))
-	if header.MagicNumber != MagicNumber {
-		log.Printf("Ignored message. Wrong magic number %s", header.MagicNumber)
+	defer messageDuration(header.MessageType).Since(start)
+	tracePacket(header, buf.Bytes(), from)
+
+	message, err := ReadMessage(buf)
+	if err != nil {
+		countDrop(dropReason(err))
+		log.Printf("Ignored %s message: %s", protocol.MessageTypeName(header.MessageType), err)
+		return
+	}
+	if from.IP != nil {
+		peerVersions.heard(from, header.VersionMax)
+	}
+	if _, ok := message.(*MessageKeepAlive); !ok && InSafeMode() {
+		countDrop(DropSafeMode)
 		return
 	}
+	countMessage(header)
 
-	switch header.MessageType {
-	case Message_keepalive:
-		var m MessageKeepAlive
-		err := m.Read(buf)
-		if err != nil {
-			log.Printf("Failed to read keepalive: %s", err)
-		}
+	switch m := message.(type) {
+	case *MessageKeepAlive:
 		log.Println("Read keepalive")
-		err = m.Handle()
+		err = m.HandleFrom(from)
 		if err != nil {
 			log.Printf("Failed to handle keepalive")
 		}
-	case Message_publish:
-		var m MessagePublish
-		err := m.Read(buf)
-		if err != nil {
-			log.Printf("Failed to read publish: %s", err)
-		} else {
-			store.StoreBlock(m.ToBlock())
+	case *MessagePublish:
+		block := m.ToBlock()
+		Processor.Tracer.RecordAt(block.Hash(), metrics.StageReceived, start)
+		Processor.Tracer.Record(block.Hash(), metrics.StageDecoded)
+		startElection(block.Hash(), observeBlock(block.Hash()))
+		Processor.Add(block)
+	case *MessageConfirmAck:
+		if !m.VerifyVote() {
+			countDrop(DropBadSignature)
+			log.Printf("Dropped vote with a bad signature from %s", voteRep(&m.MessageVote))
+			return
 		}
-	case Message_confirm_ack:
-		var m MessageConfirmAck
-		err := m.Read(buf)
-		if err != nil {
-			log.Printf("Failed to read confirm: %s", err)
-		} else {
-			store.StoreBlock(m.ToBlock())
+		block := m.ToBlock()
+		Processor.Tracer.RecordAt(block.Hash(), metrics.StageReceived, start)
+		Processor.Tracer.Record(block.Hash(), metrics.StageDecoded)
+		switch store.StoreBlock(block) {
+		case nil:
+		case store.ErrMissingParent, store.ErrMissingSource, store.ErrUnconnectedPoolFull:
+			// Can't be validated yet, so there's no election to count it in
+			hintVote(block.Hash(), &m.MessageVote)
+			return
+		default:
+			return
+		}
+		startElection(block.Hash(), observeBlock(block.Hash()))
+		rep := voteRep(&m.MessageVote)
+		weight := repWeight(rep)
+		if confirmations.vote(block.Hash(), rep, weight, quorumWeight(), now()) {
+			publishConfirmation(block.Hash())
+		}
+		if weight != (uint128.Uint128{}) {
+			recordVote(block, m.Vote())
 		}
+		Events.Publish(Event{Type: EventVote, Hash: block.Hash(), Representative: rep})
 	default:
-		log.Printf("Ignored message. Cannot handle message type %d\n", header.MessageType)
+		log.Printf("Ignored message. Cannot handle message type %s\n", protocol.MessageTypeName(header.MessageType))
 	}
 }
 
+func wrongMessageType(got byte, expected byte) error {
+	return fmt.Errorf("Tried to read %s message as %s", protocol.MessageTypeName(got), protocol.MessageTypeName(expected))
+}
+
+var ErrShortMessage = errors.New("Message too short")
+var ErrBadMagic = errors.New("Wrong magic number")
+var ErrBadVersion = errors.New("No protocol version in common")
+var ErrUnknownMessageType = errors.New("Unknown message type")
+var ErrUnknownBlockType = errors.New("Unknown block type")
+
+const headerSize = 8
+const peerSize = net.IPv6len + 2
+const voteSize = 32 + 64 + 8
+
+// Bytes in a block of the given type on the wire, if it's one we know.
+func blockSize(blockType byte) (int, bool) {
+	const common = 64 + 8
+	switch blockType {
+	case protocol.BlockTypeSend:
+		return 32 + 32 + 16 + common, true
+	case protocol.BlockTypeReceive, protocol.BlockTypeChange:
+		return 32 + 32 + common, true
+	case protocol.BlockTypeOpen:
+		return 32 + 32 + 32 + common, true
+	case protocol.BlockTypeState:
+		return 32 + 32 + 32 + 16 + 32 + common, true
+	}
+	return 0, false
+}
+
+// ReadMessage reads a message of whichever type its header says: a
+// *MessageKeepAlive, *MessagePublish, *MessageConfirmReq,
+// *MessageConfirmAck, *MessageFrontierReq or *MessageBulkPull.
+func ReadMessage(buf *bytes.Buffer) (Message, error) {
+	if buf.Len() < headerSize {
+		return nil, ErrShortMessage
+	}
+	var header MessageHeader
+	header.ReadHeader(bytes.NewBuffer(buf.Bytes()[:headerSize]))
+	if err := header.Validate(); err != nil {
+		return nil, err
+	}
+
+	var m interface {
+		Message
+		Read(r io.Reader) error
+	}
+	body := buf.Len() - headerSize
+	switch header.MessageType {
+	case protocol.MessageKeepalive:
+		if header.Extensions&ExtensionSignedPeers != 0 {
+			if body < numberOfPeersToShare*peerSize+signedPeersSize {
+				return nil, ErrShortMessage
+			}
+		} else if body%peerSize != 0 {
+			return nil, ErrShortMessage
+		}
+		m = new(MessageKeepAlive)
+	case protocol.MessagePublish, protocol.MessageConfirmReq, protocol.MessageConfirmAck:
+		size, ok := blockSize(header.BlockType)
+		if !ok {
+			return nil, ErrUnknownBlockType
+		}
+		switch header.MessageType {
+		case protocol.MessagePublish:
+			m = new(MessagePublish)
+		case protocol.MessageConfirmReq:
+			m = new(MessageConfirmReq)
+		default:
+			size += voteSize
+			m = new(MessageConfirmAck)
+		}
+		if body < size {
+			return nil, ErrShortMessage
+		}
+	case protocol.MessageFrontierReq:
+		if body < frontierReqSize {
+			return nil, ErrShortMessage
+		}
+		m = new(MessageFrontierReq)
+	case protocol.MessageBulkPull:
+		if body < bulkPullSize {
+			return nil, ErrShortMessage
+		}
+		m = new(MessageBulkPull)
+	default:
+		return nil, ErrUnknownMessageType
+	}
+
+	if err := m.Read(buf); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReadPublishMessage reads a publish message's block, of whichever type
+// its header says.
+func ReadPublishMessage(buf *bytes.Buffer) (blocks.Block, error) {
+	if buf.Len() >= headerSize {
+		var header MessageHeader
+		header.ReadHeader(bytes.NewBuffer(buf.Bytes()[:headerSize]))
+		if header.Validate() == nil && header.MessageType != protocol.MessagePublish {
+			return nil, wrongMessageType(header.MessageType, protocol.MessagePublish)
+		}
+	}
+	m, err := ReadMessage(buf)
+	if err != nil {
+		return nil, err
+	}
+	return m.(*MessagePublish).ToBlock(), nil
+}
+
 func (m *MessageKeepAlive) Handle() error {
+	return m.HandleFrom(Peer{})
+}
+
+// HandleFrom adds the peers listed in a keepalive from a peer. Those are
+// filtered and rate limited, and only get a probe until they answer.
+//
+// Peers signed by a verified sender are preferred: unsigned ones only
+// take up MaxUnsignedShare of the list, and are evicted for signed ones
+// once it's full. No subnet gets more than MaxPeersPerSubnet.
+func (m *MessageKeepAlive) HandleFrom(from Peer) error {
+	learned := from.IP != nil
+	signed := learned && m.signedBy(from)
+	peersLock.Lock()
+	defer peersLock.Unlock()
 	for _, peer := range m.Peers {
-		if !PeerSet[peer.String()] {
-			PeerSet[peer.String()] = true
-			PeerList = append(PeerList, peer)
-			log.Printf("Added new peer to list: %s, now %d peers", peer.String(), len(PeerList))
+		if PeerSet[peer.String()] {
+			if signed {
+				confirmLearned(peer)
+			}
+			continue
+		}
+		if !subnetRoom(peer) {
+			continue
+		}
+		if !learned {
+			if len(PeerList) >= MaxPeers {
+				continue
+			}
+		} else if !hasRoom(signed) || !peerFilters.learn(from, peer) {
+			continue
+		} else {
+			addLearned(peer, signed)
 		}
+		PeerSet[peer.String()] = true
+		PeerList = append(PeerList, peer)
+		PeerLiveness.Add(peer)
+		Events.Publish(Event{Type: EventPeerAdded, Peer: peer.String()})
+		log.Printf("Added new peer to list: %s, now %d peers", peer.String(), len(PeerList))
 	}
 	return nil
 }
 
-func (m *MessageKeepAlive) Read(buf *bytes.Buffer) error {
+func (m *MessageKeepAlive) Read(r io.Reader) error {
 	var header MessageHeader
-	err := header.ReadHeader(buf)
-	if err != nil {
+	if err := header.readHeader(r, protocol.MessageKeepalive); err != nil {
 		return err
 	}
-
-	if header.MessageType != Message_keepalive {
-		return errors.New("Tried to read wrong message type")
-	}
-
 	m.MessageHeader = header
 	m.Peers = make([]Peer, 0)
 
-	for {
+	// Signed keepalives always have all the slots, then the signature
+	for slot := 0; !m.Signed() || slot < numberOfPeersToShare; slot++ {
 		peerPort := make([]byte, 2)
 		peerIp := make(net.IP, net.IPv6len)
-		n, err := buf.Read(peerIp)
-		if n == 0 {
+		// Unsigned ones end with the packet
+		if _, err := io.ReadFull(r, peerIp); err == io.EOF && !m.Signed() {
 			break
+		} else if err != nil {
+			return readError(err)
 		}
-		if err != nil {
+		if err := readFields(r, peerPort); err != nil {
 			return err
 		}
-		n2, err := buf.Read(peerPort)
-		if err != nil {
-			return err
-		}
-		if n < net.IPv6len || n2 < 2 {
-			return errors.New("Not enough ip bytes")
-		}
 
-		m.Peers = append(m.Peers, Peer{peerIp, binary.LittleEndian.Uint16(peerPort), nil})
+		port := binary.LittleEndian.Uint16(peerPort)
+		// Unused slot
+		if peerIp.IsUnspecified() && port == 0 {
+			continue
+		}
+		m.Peers = append(m.Peers, Peer{peerIp, port, nil})
 	}
 
+	if m.Signed() {
+		timestamp := make([]byte, 8)
+		if err := readFields(r, timestamp, m.Signature[:]); err != nil {
+			return err
+		}
+		m.Timestamp = binary.LittleEndian.Uint64(timestamp)
+	}
 	return nil
 }
 
-func (m *MessageKeepAlive) Write(buf *bytes.Buffer) error {
-	err := m.MessageHeader.WriteHeader(buf)
+func (m *MessageKeepAlive) Write(w io.Writer) error {
+	err := m.MessageHeader.WriteHeader(w)
 	if err != nil {
 		return err
 	}
 
-	for _, peer := range m.Peers {
-		_, err = buf.Write(peer.IP)
-		if err != nil {
-			return err
-		}
+	// Always all the slots, the unused ones zeroed
+	for i := 0; i < numberOfPeersToShare; i++ {
+		ip := make(net.IP, net.IPv6len)
 		portBytes := make([]byte, 2)
-		binary.LittleEndian.PutUint16(portBytes, peer.Port)
-		if err != nil {
-			return err
+		if i < len(m.Peers) {
+			if ip16 := m.Peers[i].IP.To16(); ip16 != nil {
+				ip = ip16
+			}
+			binary.LittleEndian.PutUint16(portBytes, m.Peers[i].Port)
 		}
-		_, err = buf.Write(portBytes)
-		if err != nil {
+		if err = writeFields(w, ip, portBytes); err != nil {
 			return err
 		}
 	}
 
+	if m.Signed() {
+		timestamp := make([]byte, 8)
+		binary.LittleEndian.PutUint64(timestamp, m.Timestamp)
+		return writeFields(w, timestamp, m.Signature[:])
+	}
 	return nil
 }
 
-func (m *MessageConfirmAck) Read(buf *bytes.Buffer) error {
-	err := m.MessageHeader.ReadHeader(buf)
+func (m *MessageConfirmAck) Read(r io.Reader) error {
+	err := m.MessageHeader.readHeader(r, protocol.MessageConfirmAck)
 	if err != nil {
 		return err
 	}
-
-	if m.MessageHeader.MessageType != Message_confirm_ack {
-		return errors.New("Tried to read wrong message type")
-	}
-	err = m.MessageVote.Read(m.MessageHeader.BlockType, buf)
+	m.Timestamped = protocol.CapabilityVoteTimestamp.SupportedBy(m.MessageHeader.VersionUsing)
+	err = m.MessageVote.Read(m.MessageHeader.BlockType, r)
 	if err != nil {
 		return err
 	}
@@ -231,13 +412,13 @@ func (m *MessageConfirmAck) Read(buf *bytes.Buffer) error {
 	return nil
 }
 
-func (m *MessageConfirmAck) Write(buf *bytes.Buffer) error {
-	err := m.MessageHeader.WriteHeader(buf)
+func (m *MessageConfirmAck) Write(w io.Writer) error {
+	err := m.MessageHeader.WriteHeader(w)
 	if err != nil {
 		return err
 	}
 
-	err = m.MessageVote.Write(buf)
+	err = m.MessageVote.Write(w)
 	if err != nil {
 		return err
 	}
@@ -245,16 +426,12 @@ func (m *MessageConfirmAck) Write(buf *bytes.Buffer) error {
 	return nil
 }
 
-func (m *MessageConfirmReq) Read(buf *bytes.Buffer) error {
-	err := m.MessageHeader.ReadHeader(buf)
+func (m *MessageConfirmReq) Read(r io.Reader) error {
+	err := m.MessageHeader.readHeader(r, protocol.MessageConfirmReq)
 	if err != nil {
 		return err
 	}
-
-	if m.MessageHeader.MessageType != Message_confirm_req {
-		return errors.New("Tried to read wrong message type")
-	}
-	err = m.MessageBlock.Read(m.MessageHeader.BlockType, buf)
+	err = m.MessageBlock.Read(m.MessageHeader.BlockType, r)
 	if err != nil {
 		return err
 	}
@@ -262,13 +439,13 @@ func (m *MessageConfirmReq) Read(buf *bytes.Buffer) error {
 	return nil
 }
 
-func (m *MessageConfirmReq) Write(buf *bytes.Buffer) error {
-	err := m.MessageHeader.WriteHeader(buf)
+func (m *MessageConfirmReq) Write(w io.Writer) error {
+	err := m.MessageHeader.WriteHeader(w)
 	if err != nil {
 		return err
 	}
 
-	err = m.MessageBlock.Write(buf)
+	err = m.MessageBlock.Write(w)
 	if err != nil {
 		return err
 	}
@@ -276,16 +453,12 @@ func (m *MessageConfirmReq) Write(buf *bytes.Buffer) error {
 	return nil
 }
 
-func (m *MessagePublish) Read(buf *bytes.Buffer) error {
-	err := m.MessageHeader.ReadHeader(buf)
+func (m *MessagePublish) Read(r io.Reader) error {
+	err := m.MessageHeader.readHeader(r, protocol.MessagePublish)
 	if err != nil {
 		return err
 	}
-
-	if m.MessageHeader.MessageType != Message_publish {
-		return errors.New("Tried to read wrong message type")
-	}
-	err = m.MessageBlock.Read(m.MessageHeader.BlockType, buf)
+	err = m.MessageBlock.Read(m.MessageHeader.BlockType, r)
 	if err != nil {
 		return err
 	}
@@ -293,13 +466,13 @@ func (m *MessagePublish) Read(buf *bytes.Buffer) error {
 	return nil
 }
 
-func (m *MessagePublish) Write(buf *bytes.Buffer) error {
-	err := m.MessageHeader.WriteHeader(buf)
+func (m *MessagePublish) Write(w io.Writer) error {
+	err := m.MessageHeader.WriteHeader(w)
 	if err != nil {
 		return err
 	}
 
-	err = m.MessageBlock.Write(buf)
+	err = m.MessageBlock.Write(w)
 	if err != nil {
 		return err
 	}
@@ -307,50 +480,74 @@ func (m *MessagePublish) Write(buf *bytes.Buffer) error {
 	return nil
 }
 
-func (m *MessageHeader) WriteHeader(buf *bytes.Buffer) error {
-	var errs []error
-	errs = append(errs,
-		buf.WriteByte(m.MagicNumber[0]),
-		buf.WriteByte(m.MagicNumber[1]),
-		buf.WriteByte(m.VersionMax),
-		buf.WriteByte(m.VersionUsing),
-		buf.WriteByte(m.VersionMin),
-		buf.WriteByte(m.MessageType),
-		buf.WriteByte(m.Extensions),
-		buf.WriteByte(m.BlockType),
-	)
-
-	for _, err := range errs {
-		if err != nil {
-			return err
+func (m *MessageHeader) WriteHeader(w io.Writer) error {
+	return writeFields(w, []byte{
+		m.MagicNumber[0],
+		m.MagicNumber[1],
+		m.VersionMax,
+		m.VersionUsing,
+		m.VersionMin,
+		m.MessageType,
+		m.Extensions,
+		m.BlockType,
+	})
+}
+
+func (m *MessageHeader) ReadHeader(r io.Reader) error {
+	var header [headerSize]byte
+	if err := readFields(r, header[:]); err != nil {
+		return err
+	}
+	m.MagicNumber = [2]byte{header[0], header[1]}
+	m.VersionMax, m.VersionUsing, m.VersionMin = header[2], header[3], header[4]
+	m.MessageType, m.Extensions, m.BlockType = header[5], header[6], header[7]
+	return nil
+}
+
+// Validate checks the header is for our network, from a peer speaking a
+// version we do. ReadMessage checks it, message Reads don't.
+func (m *MessageHeader) Validate() error {
+	if m.MagicNumber != MagicNumber {
+		return ErrBadMagic
+	}
+	if m.VersionMin > m.VersionMax || m.VersionMax < protocol.VersionMin || m.VersionMin > protocol.VersionMax {
+		return ErrBadVersion
+	}
+	return nil
+}
+
+// Reads a header, checking it's for a message of messageType.
+func (m *MessageHeader) readHeader(r io.Reader, messageType byte) error {
+	if err := m.ReadHeader(r); err != nil {
+		return err
+	}
+	if m.MessageType != messageType {
+		return wrongMessageType(m.MessageType, messageType)
+	}
+	return nil
+}
+
+// Reads each field in full. Running out part way is ErrShortMessage,
+// other failures are the reader's.
+func readFields(r io.Reader, fields ...[]byte) error {
+	for _, field := range fields {
+		if _, err := io.ReadFull(r, field); err != nil {
+			return readError(err)
 		}
 	}
 	return nil
 }
 
-func (m *MessageHeader) ReadHeader(buf *bytes.Buffer) error {
-	var errs []error
-	var err error
-	// I really hate go error handling sometimes
-	m.MagicNumber[0], err = buf.ReadByte()
-	errs = append(errs, err)
-	m.MagicNumber[1], err = buf.ReadByte()
-	errs = append(errs, err)
-	m.VersionMax, err = buf.ReadByte()
-	errs = append(errs, err)
-	m.VersionUsing, err = buf.ReadByte()
-	errs = append(errs, err)
-	m.VersionMin, err = buf.ReadByte()
-	errs = append(errs, err)
-	m.MessageType, err = buf.ReadByte()
-	errs = append(errs, err)
-	m.Extensions, err = buf.ReadByte()
-	errs = append(errs, err)
-	m.BlockType, err = buf.ReadByte()
-	errs = append(errs, err)
-
-	for _, err := range errs {
-		if err != nil {
+func readError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrShortMessage
+	}
+	return err
+}
+
+func writeFields(w io.Writer, fields ...[]byte) error {
+	for _, field := range fields {
+		if _, err := w.Write(field); err != nil {
 			return err
 		}
 	}
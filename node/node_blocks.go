@@ -1,12 +1,14 @@
 package node
 
 import (
-	"bytes"
 	"encoding/hex"
 	"errors"
+	"io"
+	"strings"
 
 	"github.com/frankh/nano/address"
 	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/protocol"
 	"github.com/frankh/nano/types"
 	"github.com/frankh/nano/uint128"
 	"github.com/frankh/nano/utils"
@@ -20,94 +22,70 @@ type MessageBlockCommon struct {
 type MessageBlock struct {
 	Type             byte
 	SourceOrPrevious [32]byte // Source for open, previous for others
-	RepDestOrSource  [32]byte // Rep for open/change, dest for send, source for receive
-	Account          [32]byte // Account for open
-	Balance          [16]byte // Balance for send
+	RepDestOrSource  [32]byte // Rep for open/change/state, dest for send, source for receive
+	Account          [32]byte // Account for open/state
+	Balance          [16]byte // Balance for send/state
+	Link             [32]byte // Link for state
 	MessageBlockCommon
 }
 
-func (m *MessageBlockCommon) ReadCommon(buf *bytes.Buffer) error {
-	n, err := buf.Read(m.Signature[:])
-
-	if n != len(m.Signature) {
-		return errors.New("Wrong number of bytes in signature")
-	}
-	if err != nil {
-		return err
-	}
-
+func (m *MessageBlockCommon) ReadCommon(r io.Reader) error {
 	work := make([]byte, 8)
-	n, err = buf.Read(work)
-	work = utils.Reversed(work)
-
-	copy(m.Work[:], work)
-
-	if n != len(m.Work) {
-		return errors.New("Wrong number of bytes in work")
-	}
-	if err != nil {
+	if err := readFields(r, m.Signature[:], work); err != nil {
 		return err
 	}
-
+	copy(m.Work[:], utils.Reversed(work))
 	return nil
 }
 
-func (m *MessageBlockCommon) WriteCommon(buf *bytes.Buffer) error {
-	n, err := buf.Write(m.Signature[:])
-
-	if n != len(m.Signature) {
-		return errors.New("Wrong number of bytes in signature")
-	}
-	if err != nil {
-		return err
-	}
-
-	n, err = buf.Write(utils.Reversed(m.Work[:]))
-
-	if n != len(m.Work) {
-		return errors.New("Wrong number of bytes in work")
-	}
-	if err != nil {
-		return err
-	}
-
-	return nil
+func (m *MessageBlockCommon) WriteCommon(w io.Writer) error {
+	return writeFields(w, m.Signature[:], utils.Reversed(m.Work[:]))
 }
 
 func (m *MessageBlock) ToBlock() blocks.Block {
 	common := blocks.CommonBlock{
 		Work:      types.Work(hex.EncodeToString(m.Work[:])),
-		Signature: types.Signature(hex.EncodeToString(m.Signature[:])),
+		Signature: types.Signature(strings.ToUpper(hex.EncodeToString(m.Signature[:]))),
 	}
 
 	switch m.Type {
-	case BlockType_open:
+	case protocol.BlockTypeOpen:
 		block := blocks.OpenBlock{
-			types.BlockHash(hex.EncodeToString(m.SourceOrPrevious[:])),
+			types.BlockHashFromBytes(m.SourceOrPrevious[:]),
 			address.PubKeyToAddress(m.RepDestOrSource[:]),
 			address.PubKeyToAddress(m.Account[:]),
 			common,
 		}
 		return &block
-	case BlockType_send:
+	case protocol.BlockTypeSend:
 		block := blocks.SendBlock{
-			types.BlockHash(hex.EncodeToString(m.SourceOrPrevious[:])),
+			types.BlockHashFromBytes(m.SourceOrPrevious[:]),
 			address.PubKeyToAddress(m.RepDestOrSource[:]),
 			uint128.FromBytes(m.Balance[:]),
 			common,
 		}
 		return &block
-	case BlockType_receive:
+	case protocol.BlockTypeReceive:
 		block := blocks.ReceiveBlock{
-			types.BlockHash(hex.EncodeToString(m.SourceOrPrevious[:])),
-			types.BlockHash(hex.EncodeToString(m.RepDestOrSource[:])),
+			types.BlockHashFromBytes(m.SourceOrPrevious[:]),
+			types.BlockHashFromBytes(m.RepDestOrSource[:]),
 			common,
 		}
 		return &block
-	case BlockType_change:
+	case protocol.BlockTypeChange:
 		block := blocks.ChangeBlock{
-			types.BlockHash(hex.EncodeToString(m.SourceOrPrevious[:])),
+			types.BlockHashFromBytes(m.SourceOrPrevious[:]),
+			address.PubKeyToAddress(m.RepDestOrSource[:]),
+			common,
+		}
+		return &block
+	case protocol.BlockTypeState:
+		block := blocks.StateBlock{
+			address.PubKeyToAddress(m.Account[:]),
+			types.BlockHashFromBytes(m.SourceOrPrevious[:]),
 			address.PubKeyToAddress(m.RepDestOrSource[:]),
+			uint128.FromBytes(m.Balance[:]),
+			types.BlockHashFromBytes(m.Link[:]),
 			common,
 		}
 		return &block
@@ -116,66 +94,124 @@ func (m *MessageBlock) ToBlock() blocks.Block {
 	}
 }
 
-func (m *MessageBlock) Read(messageBlockType byte, buf *bytes.Buffer) error {
-	m.Type = messageBlockType
-
-	n1, err1 := buf.Read(m.SourceOrPrevious[:])
-	n2, err2 := buf.Read(m.RepDestOrSource[:])
-
-	if messageBlockType == BlockType_open {
-		n, err := buf.Read(m.Account[:])
-		if err != nil || n != 32 {
-			return errors.New("Failed to read account")
+// FromBlock is the inverse of ToBlock, for sending our own blocks. Hashes,
+// accounts, signature and work must all be well formed.
+func FromBlock(b blocks.Block) (*MessageBlock, error) {
+	var m MessageBlock
+	var err error
+
+	switch block := b.(type) {
+	case *blocks.OpenBlock:
+		m.Type = protocol.BlockTypeOpen
+		err = copyHash(m.SourceOrPrevious[:], block.SourceHash)
+		if err == nil {
+			err = copyAccount(m.RepDestOrSource[:], block.Representative)
+		}
+		if err == nil {
+			err = copyAccount(m.Account[:], block.Account)
+		}
+	case *blocks.SendBlock:
+		m.Type = protocol.BlockTypeSend
+		err = copyHash(m.SourceOrPrevious[:], block.PreviousHash)
+		if err == nil {
+			err = copyAccount(m.RepDestOrSource[:], block.Destination)
 		}
+		copy(m.Balance[:], block.Balance.GetBytes())
+	case *blocks.ReceiveBlock:
+		m.Type = protocol.BlockTypeReceive
+		err = copyHash(m.SourceOrPrevious[:], block.PreviousHash)
+		if err == nil {
+			err = copyHash(m.RepDestOrSource[:], block.SourceHash)
+		}
+	case *blocks.ChangeBlock:
+		m.Type = protocol.BlockTypeChange
+		err = copyHash(m.SourceOrPrevious[:], block.PreviousHash)
+		if err == nil {
+			err = copyAccount(m.RepDestOrSource[:], block.Representative)
+		}
+	case *blocks.StateBlock:
+		m.Type = protocol.BlockTypeState
+		err = copyAccount(m.Account[:], block.Account)
+		if err == nil {
+			err = copyHash(m.SourceOrPrevious[:], block.PreviousHash)
+		}
+		if err == nil {
+			err = copyAccount(m.RepDestOrSource[:], block.Representative)
+		}
+		if err == nil {
+			err = copyHash(m.Link[:], block.Link)
+		}
+		copy(m.Balance[:], block.Balance.GetBytes())
+	default:
+		return nil, errors.New("Unknown block type")
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	if messageBlockType == BlockType_send {
-		n, err := buf.Read(m.Balance[:])
-		if err != nil || n != 16 {
-			return errors.New("Failed to read balance")
-		}
+	if b.GetSignature().Validate() != nil || b.GetWork().Validate() != nil {
+		return nil, errors.New("Block is missing signature or work")
 	}
+	copy(m.Signature[:], b.GetSignature().ToBytes())
+	work, _ := hex.DecodeString(string(b.GetWork()))
+	copy(m.Work[:], work)
 
-	err3 := m.MessageBlockCommon.ReadCommon(buf)
+	return &m, nil
+}
 
-	if err1 != nil || err2 != nil || err3 != nil {
-		return errors.New("Failed to read block")
+func copyHash(dst []byte, hash types.BlockHash) error {
+	if err := hash.Validate(); err != nil {
+		return err
 	}
+	copy(dst, hash.ToBytes())
+	return nil
+}
 
-	if n1 != 32 || n2 != 32 {
-		return errors.New("Wrong number of bytes read")
+func copyAccount(dst []byte, account types.Account) error {
+	pub, err := address.AddressToPub(account)
+	if err != nil {
+		return err
 	}
-
+	copy(dst, pub)
 	return nil
 }
 
-func (m *MessageBlock) Write(buf *bytes.Buffer) error {
-	n1, err1 := buf.Write(m.SourceOrPrevious[:])
-	n2, err2 := buf.Write(m.RepDestOrSource[:])
-
-	if m.Type == BlockType_open {
-		n, err := buf.Write(m.Account[:])
-		if err != nil || n != 32 {
-			return errors.New("Failed to write account")
-		}
+func (m *MessageBlock) Read(messageBlockType byte, r io.Reader) error {
+	if _, ok := blockSize(messageBlockType); !ok {
+		return ErrUnknownBlockType
 	}
-
-	if m.Type == BlockType_send {
-		n, err := buf.Write(m.Balance[:])
-		if err != nil || n != 16 {
-			return errors.New("Failed to write balance")
-		}
+	m.Type = messageBlockType
+	if err := readFields(r, m.fields()...); err != nil {
+		return err
 	}
-
-	err3 := m.MessageBlockCommon.WriteCommon(buf)
-
-	if err1 != nil || err2 != nil || err3 != nil {
-		return errors.New("Failed to write block")
+	if messageBlockType == protocol.BlockTypeState {
+		return nil
 	}
+	return m.MessageBlockCommon.ReadCommon(r)
+}
 
-	if n1 != 32 || n2 != 32 {
-		return errors.New("Wrong number of bytes written")
+func (m *MessageBlock) Write(w io.Writer) error {
+	if err := writeFields(w, m.fields()...); err != nil {
+		return err
+	}
+	if m.Type == protocol.BlockTypeState {
+		return nil
 	}
+	return m.MessageBlockCommon.WriteCommon(w)
+}
 
-	return nil
+// The block's fields in wire order, without the signature and work for
+// legacy blocks. State blocks are laid out in hashing order, and unlike
+// legacy blocks their work is big endian on the wire.
+func (m *MessageBlock) fields() [][]byte {
+	switch m.Type {
+	case protocol.BlockTypeOpen:
+		return [][]byte{m.SourceOrPrevious[:], m.RepDestOrSource[:], m.Account[:]}
+	case protocol.BlockTypeSend:
+		return [][]byte{m.SourceOrPrevious[:], m.RepDestOrSource[:], m.Balance[:]}
+	case protocol.BlockTypeState:
+		return [][]byte{m.Account[:], m.SourceOrPrevious[:], m.RepDestOrSource[:], m.Balance[:], m.Link[:], m.Signature[:], m.Work[:]}
+	default:
+		return [][]byte{m.SourceOrPrevious[:], m.RepDestOrSource[:]}
+	}
 }
@@ -2,9 +2,12 @@ package node
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"log"
-	"math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,66 +21,127 @@ var DefaultPeer = Peer{
 }
 
 var PeerList = []Peer{DefaultPeer}
-var PeerSet = map[string]bool{DefaultPeer.String(): true}
 
-func (p *Peer) SendMessage(m Message) error {
-	now := time.Now()
-	p.LastReachout = &now
+// Peers learned from keepalives beyond this are ignored
+var MaxPeers = 5000
 
-	outConn, err := net.DialUDP("udp", nil, p.Addr())
-	if err != nil {
-		return err
-	}
+// Set when all traffic must go through the outbound proxy. Udp can't be
+// proxied over SOCKS5, so it's switched off entirely, and as the node
+// has no tcp realtime transport yet it only serves local requests.
+var ProxyOnly = false
+
+var ErrUdpDisabled = errors.New("Udp is disabled in proxy only mode")
+var PeerSet = map[string]bool{DefaultPeer.String(): true}
+
+// Guards changes to PeerList and PeerSet
+var peersLock sync.Mutex
 
+func (p *Peer) SendMessage(m Message) error {
 	buf := bytes.NewBuffer(nil)
-	err = m.Write(buf)
+	err := m.Write(buf)
 	if err != nil {
 		return err
 	}
-	outConn.Write(buf.Bytes())
 
-	return nil
+	return p.SendPacket(buf.Bytes())
+}
+
+// Sends an already serialized message.
+func (p *Peer) SendPacket(packet []byte) error {
+	now := time.Now()
+	if !peerFilters.allowSend(*p) {
+		return ErrPeerOnProbation
+	}
+	p.LastReachout = &now
+	return transport().Send(*p, packet)
 }
 
 func ListenForUdp() {
-	log.Printf("Listening for udp packets on 7075")
-	ln, err := net.ListenPacket("udp", ":7075")
+	if ProxyOnly {
+		log.Printf("Proxy only mode, not listening for udp")
+		return
+	}
+	log.Printf("Listening for udp packets on %d", ListenPort)
+	atomic.AddUint64(&udpSockets, 1)
+	ln, err := net.ListenPacket("udp", fmt.Sprintf(":%d", ListenPort))
 	if err != nil {
 		panic(err)
 	}
+	if conn, ok := ln.(*net.UDPConn); ok {
+		configureUdpSocket(conn, UdpReadBuffer, UdpWriteBuffer)
+	}
+	go sampleUdpDrops(ListenPort)
 
 	buf := make([]byte, packetSize)
 
 	for {
-		n, _, err := ln.ReadFrom(buf)
+		n, addr, err := ln.ReadFrom(buf)
 		if err != nil {
 			continue
 		}
+		var from Peer
+		if udpAddr, ok := addr.(*net.UDPAddr); ok {
+			from = Peer{udpAddr.IP, uint16(udpAddr.Port), nil}
+			heardFrom(from)
+		}
 		if n > 0 {
-			handleMessage(bytes.NewBuffer(buf[:n]))
+			packetGuard.Call(func() { handleMessageFrom(bytes.NewBuffer(buf[:n]), from) })
 		}
 	}
 }
 
-func SendKeepAlive(peer Peer) error {
-	randomPeers := make([]Peer, 0)
-	randIndices := rand.Perm(len(PeerList))
-	for n, i := range randIndices {
-		if n == numberOfPeersToShare {
-			break
+// RandomPeers picks up to n known peers to share, leaving out those that
+// haven't answered yet, and spreading them over as many subnets as it
+// can.
+func RandomPeers(n int) []Peer {
+	peersLock.Lock()
+	defer peersLock.Unlock()
+
+	answered := make([]Peer, 0, len(PeerList))
+	for _, peer := range PeerList {
+		// Only vouch for peers that have answered
+		if !peerFilters.onProbation(peer) {
+			answered = append(answered, peer)
 		}
-		randomPeers = append(randomPeers, PeerList[i])
 	}
+	return diversePeers(answered, n)
+}
 
-	m := CreateKeepAlive(randomPeers)
+func SendKeepAlive(peer Peer) error {
+	m := CreateKeepAlive(RandomPeers(numberOfPeersToShare))
+	if _, ok := verifiedKey(peer); ok {
+		m.Sign(NodeKey)
+	}
 	return peer.SendMessage(m)
 }
 
+// ExpirePeers forgets peers not heard from within PeerExpiry, returning
+// how many.
+func ExpirePeers() int {
+	expired := PeerLiveness.Expire(PeerExpiry)
+	if len(expired) == 0 {
+		return 0
+	}
+	gone := make(map[string]bool)
+	for _, peer := range expired {
+		gone[peer.String()] = true
+	}
+
+	peersLock.Lock()
+	defer peersLock.Unlock()
+	dropPeers(gone)
+	return len(expired)
+}
+
 func SendKeepAlives(params []interface{}) {
 	peers := params[0].([]Peer)
 	timeCutoff := time.Now().Add(-5 * time.Minute)
 
 	for _, peer := range peers {
+		// Dead peers are retried by the liveness probes instead
+		if state, _ := PeerLiveness.State(peer); state == PeerCooldown {
+			continue
+		}
 		if peer.LastReachout == nil || peer.LastReachout.Before(timeCutoff) {
 			SendKeepAlive(peer)
 		}
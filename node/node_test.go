@@ -1,14 +1,42 @@
 package node
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/frankh/crypto/ed25519"
+	"github.com/frankh/nano/address"
 	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/metrics"
+	"github.com/frankh/nano/protocol"
 	"github.com/frankh/nano/store"
 	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/frankh/nano/utils"
+	"github.com/frankh/nano/wallet"
 )
 
 var publishSend, _ = hex.DecodeString("5243050501030002B6460102018F076CC32FF2F65AD397299C47F8CA2BE784D5DE394D592C22BE8BFFBE91872F1D2A2BCC1CB47FB854D6D31E43C6391EADD5750BB9689E5DF0D6CB0000003D11C83DBCFF748EB4B7F7A3C059DDEEE5C8ECCC8F20DEF3AF3C4F0726F879082ED051D0C62A54CD69C4A66B020369B7033C5B0F77654173AB24D5C7A64CC4FFF0BDB368FCC989E41A656569047627C49A2A6D2FBC")
@@ -89,6 +117,43 @@ func TestReadWriteConfirmAck(t *testing.T) {
 	}
 }
 
+func TestVerifyVote(t *testing.T) {
+	m, err := ReadMessage(bytes.NewBuffer(confirmAck))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack := m.(*MessageConfirmAck)
+	vote := ack.Vote()
+	if vote.Account != "nano_34fcz5kz59u1xh6ngusr7pzg6opyormbdf5s8jr1u8ofb9e8sks6noh3kw1j" {
+		t.Errorf("Wrong representative %s", vote.Account)
+	}
+	if vote.Sequence != 30416284 || vote.Signature.Validate() != nil {
+		t.Errorf("Wrong sequence or signature %d %s", vote.Sequence, vote.Signature)
+	}
+	if !ack.VerifyVote() {
+		t.Errorf("Genuine vote failed verification")
+	}
+
+	tampered := *ack
+	tampered.Signature[10] ^= 1
+	if tampered.VerifyVote() {
+		t.Errorf("Tampered signature verified")
+	}
+	tampered = *ack
+	tampered.Sequence[0]++
+	if tampered.VerifyVote() {
+		t.Errorf("Tampered sequence verified")
+	}
+
+	// An ack must carry a block
+	packet := append([]byte{}, confirmAck...)
+	packet[7] = protocol.BlockTypeNotABlock
+	var notABlock MessageConfirmAck
+	if err = notABlock.Read(bytes.NewBuffer(packet)); err != ErrUnknownBlockType {
+		t.Errorf("Expected an unknown block type, got %v", err)
+	}
+}
+
 func TestReadWriteConfirmReq(t *testing.T) {
 	var m MessageConfirmReq
 	buf := bytes.NewBuffer(confirmReq)
@@ -194,11 +259,156 @@ func TestReadPublish(t *testing.T) {
 	}
 }
 
+func TestReadMessage(t *testing.T) {
+	for _, packet := range [][]byte{publishSend, publishReceive, publishOpen, publishChange, confirmReq, confirmAck, keepAlive} {
+		m, err := ReadMessage(bytes.NewBuffer(packet))
+		if err != nil {
+			t.Fatalf("Failed to read %x: %s", packet[:8], err)
+		}
+		var writeBuf bytes.Buffer
+		if err = m.Write(&writeBuf); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Compare(packet, writeBuf.Bytes()) != 0 {
+			t.Errorf("Wrote %T badly", m)
+		}
+	}
+
+	var frontierReq bytes.Buffer
+	CreateFrontierReq([32]byte{1, 2, 3}, 77).Write(&frontierReq)
+	if m, err := ReadMessage(&frontierReq); err != nil || m.(*MessageFrontierReq).Count != 77 || m.(*MessageFrontierReq).Start[2] != 3 {
+		t.Errorf("Failed to read frontier_req: %v", err)
+	}
+	var bulkPull bytes.Buffer
+	CreateBulkPull([32]byte{1}, [32]byte{2}).Write(&bulkPull)
+	if m, err := ReadMessage(&bulkPull); err != nil || m.(*MessageBulkPull).Start[0] != 1 || m.(*MessageBulkPull).End[0] != 2 {
+		t.Errorf("Failed to read bulk_pull: %v", err)
+	}
+
+	if m, _ := ReadMessage(bytes.NewBuffer(publishChange)); m.(*MessagePublish).ToBlock().Type() != blocks.Change {
+		t.Errorf("Read the wrong block type")
+	}
+	if m, _ := ReadMessage(bytes.NewBuffer(confirmAck)); m.(*MessageConfirmAck).ToBlock().Type() != blocks.Send {
+		t.Errorf("Read the wrong vote block type")
+	}
+	for i, blockType := range []blocks.BlockType{blocks.Send, blocks.Receive, blocks.Open, blocks.Change} {
+		packet := [][]byte{publishSend, publishReceive, publishOpen, publishChange}[i]
+		if block, err := ReadPublishMessage(bytes.NewBuffer(packet)); err != nil || block.Type() != blockType {
+			t.Errorf("Failed to read %s publish: %v", blockType, err)
+		}
+	}
+	if _, err := ReadPublishMessage(bytes.NewBuffer(confirmReq)); err == nil {
+		t.Errorf("Expected a confirm_req not to read as a publish")
+	}
+
+	unknownBlock := append([]byte{}, publishChange...)
+	unknownBlock[7] = 9
+	oldPeer := append([]byte{}, publishChange...)
+	oldPeer[2], oldPeer[4] = protocol.VersionMin-1, 1
+	newPeer := append([]byte{}, publishChange...)
+	newPeer[2], newPeer[4] = protocol.VersionMax+2, protocol.VersionMax+1
+	unknownMessage := append([]byte{}, publishChange...)
+	unknownMessage[5] = 0x20
+	cases := []struct {
+		packet []byte
+		err    error
+	}{
+		{publishChange[:5], ErrShortMessage},
+		{publishChange[:100], ErrShortMessage},
+		{confirmAck[:len(confirmAck)-1], ErrShortMessage},
+		{keepAlive[:len(keepAlive)-3], ErrShortMessage},
+		{publishWrongBlock[:len(publishWrongBlock)-1], ErrShortMessage},
+		{publishWrongMagic, ErrBadMagic},
+		{oldPeer, ErrBadVersion},
+		{newPeer, ErrBadVersion},
+		{unknownBlock, ErrUnknownBlockType},
+		{unknownMessage, ErrUnknownMessageType},
+	}
+	for i, c := range cases {
+		if _, err := ReadMessage(bytes.NewBuffer(c.packet)); err != c.err {
+			t.Errorf("Case %d: expected %v, got %v", i, c.err, err)
+		}
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func TestReadStream(t *testing.T) {
+	// Messages read one after another off a stream, as from a connection
+	var bulkPull bytes.Buffer
+	CreateBulkPull([32]byte{1}, [32]byte{2}).Write(&bulkPull)
+	stream := io.MultiReader(bytes.NewReader(publishSend), bytes.NewReader(publishOpen), &bulkPull)
+	var send, open MessagePublish
+	var pull MessageBulkPull
+	if send.Read(stream) != nil || open.Read(stream) != nil || pull.Read(stream) != nil {
+		t.Fatal("Failed to read the stream")
+	}
+	if send.ToBlock().Type() != blocks.Send || open.ToBlock().Type() != blocks.Open || pull.End[0] != 2 {
+		t.Errorf("Read the stream badly")
+	}
+
+	// Running out part way is a short message, wherever it stops
+	for _, n := range []int{0, 3, headerSize, headerSize + 40, len(confirmAck) - 1} {
+		var ack MessageConfirmAck
+		if err := ack.Read(bytes.NewReader(confirmAck[:n])); err != ErrShortMessage {
+			t.Errorf("Expected %d bytes to be short, got %v", n, err)
+		}
+	}
+	// Other failures are the reader's
+	stream = io.MultiReader(bytes.NewReader(confirmReq[:headerSize+10]), failingReader{})
+	var req MessageConfirmReq
+	if err := req.Read(stream); err != io.ErrClosedPipe {
+		t.Errorf("Expected the reader's error, got %v", err)
+	}
+}
+
 func TestHandleMessage(t *testing.T) {
 	store.Init(store.TestConfig)
 	handleMessage(bytes.NewBuffer(publishTest))
 }
 
+func TestMessageStats(t *testing.T) {
+	store.Init(store.TestConfig)
+	var traced []byte
+	var tracedFrom *net.UDPAddr
+	var tracedType byte
+	OnPacket = func(header MessageHeader, packet []byte, from *net.UDPAddr) {
+		traced, tracedFrom, tracedType = packet, from, header.MessageType
+	}
+	defer func() { OnPacket = nil }()
+
+	before := GetMessageStats()
+	packet := append([]byte{}, publishTest...)
+	handleMessageFrom(bytes.NewBuffer(packet), Peer{net.IPv4(10, 0, 0, 1), 7075, nil})
+	handleMessage(bytes.NewBuffer(publishWrongMagic))
+	handleMessage(bytes.NewBuffer(publishTest[:headerSize+10]))
+	after := GetMessageStats()
+
+	if after.Messages["publish"]-before.Messages["publish"] != 1 || after.Publishes["receive"]-before.Publishes["receive"] != 1 {
+		t.Errorf("Publish not counted: %v", after)
+	}
+	if after.Dropped[DropBadMagic]-before.Dropped[DropBadMagic] != 1 || after.Dropped[DropShort]-before.Dropped[DropShort] != 1 {
+		t.Errorf("Drops not counted: %v", after.Dropped)
+	}
+
+	handleMessageFrom(bytes.NewBuffer(packet), Peer{net.IPv4(10, 0, 0, 1), 7075, nil})
+	if tracedType != protocol.MessagePublish || tracedFrom == nil || tracedFrom.Port != 7075 || !bytes.Equal(traced, publishTest) {
+		t.Fatalf("Unexpected trace of %d from %v", tracedType, tracedFrom)
+	}
+	traced[0] = 0
+	if packet[0] == 0 {
+		t.Errorf("Hook was handed the packet itself")
+	}
+	handleMessage(bytes.NewBuffer(publishWrongMagic))
+	if tracedFrom != nil {
+		t.Errorf("Expected no address for a packet from nowhere, got %v", tracedFrom)
+	}
+}
+
 func TestReadWriteHeader(t *testing.T) {
 	var message MessageHeader
 	buf := bytes.NewBuffer(publishOpen)
@@ -220,7 +430,7 @@ func TestReadWriteHeader(t *testing.T) {
 		t.Errorf("Wrong VersionMin")
 	}
 
-	if message.MessageType != Message_publish {
+	if message.MessageType != protocol.MessagePublish {
 		t.Errorf("Wrong Message Type")
 	}
 
@@ -228,7 +438,7 @@ func TestReadWriteHeader(t *testing.T) {
 		t.Errorf("Wrong Extension")
 	}
 
-	if message.BlockType != BlockType_open {
+	if message.BlockType != protocol.BlockTypeOpen {
 		t.Errorf("Wrong Blocktype")
 	}
 
@@ -238,3 +448,2980 @@ func TestReadWriteHeader(t *testing.T) {
 		t.Errorf("Wrote header badly")
 	}
 }
+
+func TestConfirmationStats(t *testing.T) {
+	s := newConfirmationSampler()
+	start := time.Now()
+	at := func(d time.Duration) store.Timestamp {
+		return store.Timestamp{start.Add(d).UnixNano(), 1, int64(d)}
+	}
+	rep, weight := blocks.TestGenesisBlock.Account, uint128.FromInts(0, 1)
+
+	for i := 0; i < 100; i++ {
+		hash := types.BlockHash(fmt.Sprintf("%064X", i))
+		s.seen(hash, at(0))
+		s.vote(hash, rep, weight, weight, at(time.Duration(i+1)*10*time.Millisecond))
+		s.vote(hash, rep, weight, weight, at(2*time.Second))
+	}
+
+	stats := s.stats(start.Add(2 * time.Second))
+	if stats.Samples != 100 {
+		t.Errorf("Wrong number of latency samples %d", stats.Samples)
+	}
+	// Buckets are 2^(1/4) apart so estimates are within ~19% of the real value
+	if stats.P50 < 500*time.Millisecond || stats.P50 > 600*time.Millisecond {
+		t.Errorf("Bad p50 %s", stats.P50)
+	}
+	if stats.P99 < 990*time.Millisecond || stats.P99 > 1200*time.Millisecond {
+		t.Errorf("Bad p99 %s", stats.P99)
+	}
+
+	e, ok := s.election(types.BlockHash(fmt.Sprintf("%064X", 0)))
+	if !ok || e.Votes != 2 || e.Duration() != 2*time.Second {
+		t.Errorf("Bad election stats %+v", e)
+	}
+
+	if s.stats(start.Add(time.Hour)).Samples != 0 {
+		t.Errorf("Samples should expire from the sliding window")
+	}
+
+	for i := 0; i < maxTrackedBlocks; i++ {
+		s.seen(types.BlockHash(fmt.Sprintf("%064X", i+100)), at(0))
+	}
+	if len(s.elections) != maxTrackedBlocks {
+		t.Errorf("Tracked blocks not bounded, %d", len(s.elections))
+	}
+	if _, ok := s.election(types.BlockHash(fmt.Sprintf("%064X", 0))); ok {
+		t.Errorf("Oldest block should have been evicted")
+	}
+}
+
+func TestVoteQuorum(t *testing.T) {
+	s := newConfirmationSampler()
+	ts := store.Timestamp{time.Now().UnixNano(), 1, 0}
+	hash := types.BlockHash(fmt.Sprintf("%064X", 1))
+	a, b, c := types.Account("a"), types.Account("b"), types.Account("c")
+	quorum := uint128.FromInts(0, 10)
+	s.seen(hash, ts)
+
+	// Repeats and reps without weight add nothing
+	if s.vote(hash, a, uint128.FromInts(0, 6), quorum, ts) || s.vote(hash, a, uint128.FromInts(0, 6), quorum, ts) {
+		t.Errorf("Confirmed short of quorum")
+	}
+	for i := 0; i < 10; i++ {
+		if s.vote(hash, b, uint128.Uint128{}, quorum, ts) {
+			t.Errorf("Confirmed by a rep without weight")
+		}
+	}
+	if !s.vote(hash, c, uint128.FromInts(0, 4), quorum, ts) {
+		t.Errorf("Not confirmed at quorum")
+	}
+	if s.vote(hash, b, uint128.FromInts(0, 4), quorum, ts) {
+		t.Errorf("Confirmed twice")
+	}
+	if e, _ := s.election(hash); !e.Confirmed || e.Tally != uint128.FromInts(0, 14) || e.Votes != 14 {
+		t.Errorf("Wrong election %+v", e)
+	}
+
+	// Nothing online still needs most of the minimum
+	if quorumWeight().Compare(OnlineWeightMinimum) >= 0 || quorumWeight().Compare(uint128.FromInts(OnlineWeightMinimum.Hi/2, 0)) <= 0 {
+		t.Errorf("Wrong quorum %s for the minimum %s", quorumWeight().Decimal(), OnlineWeightMinimum.Decimal())
+	}
+}
+
+// Confirms a block we've seen, as a vote from the genesis representative,
+// which holds all the weight, would.
+func confirmBlock(hash types.BlockHash) {
+	confirmations.vote(hash, blocks.TestGenesisBlock.Account, blocks.GenesisAmount, quorumWeight(), now())
+}
+
+func TestRepParticipation(t *testing.T) {
+	s := newConfirmationSampler()
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) store.Timestamp {
+		return store.Timestamp{start.Add(d).UnixNano(), 1, int64(d)}
+	}
+	a, b := blocks.TestGenesisBlock.Account, types.Account("nano_3t6k35gi95xu6tergt6p69ck76ogmitsa8mnijtpxm9fkcm736xtoncuohr3")
+	one := uint128.FromInts(0, 1)
+	voter := func(hash types.BlockHash, rep types.Account, ts store.Timestamp) {
+		s.vote(hash, rep, one, one, ts)
+	}
+
+	for i := 0; i < 10; i++ {
+		hash := types.BlockHash(fmt.Sprintf("%064X", i))
+		s.seen(hash, at(0))
+		voter(hash, a, at(time.Minute))
+		voter(hash, a, at(time.Minute))
+		if i%2 == 0 {
+			voter(hash, b, at(time.Minute))
+		}
+	}
+	// Hints count, except from reps without weight
+	hinted := types.BlockHash(fmt.Sprintf("%064X", 10))
+	s.seen(hinted, at(0))
+	s.hinted(hinted, []VoteHint{{b, at(0), one}, {a, at(0), uint128.Uint128{}}}, one)
+	voter(hinted, a, at(time.Hour))
+
+	p := &s.participation
+	if rate := p.rate(a, start.Add(2*time.Hour)); rate != 1 {
+		t.Errorf("Wrong participation %f for a rep voting on every election", rate)
+	}
+	if rate := p.rate(b, start.Add(2*time.Hour)); rate != 6.0/11 {
+		t.Errorf("Wrong participation %f", rate)
+	}
+	if uptime := p.uptime(a, start.Add(2*time.Hour)); uptime != float64(59)/119 {
+		t.Errorf("Wrong uptime %f", uptime)
+	}
+	if p.rate(a, start.Add(25*time.Hour)) != 0 {
+		t.Errorf("Participation should expire from the window")
+	}
+	if e, _ := s.election(hinted); e.voters != nil {
+		t.Errorf("Election stats shouldn't share the voters")
+	}
+}
+
+func TestLocalTimestamps(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+
+	clock := utils.NewFakeClock(time.Now())
+	Clock = clock
+	defer func() { Clock = utils.SystemClock{} }()
+
+	first := types.BlockHash(fmt.Sprintf("%064X", 1))
+	second := types.BlockHash(fmt.Sprintf("%064X", 2))
+
+	observeBlock(first)
+	// The wall clock jumps back an hour while 5 seconds really pass
+	clock.Step(-time.Hour)
+	clock.Advance(5 * time.Second)
+	observeBlock(second)
+
+	a, ok := store.LocalTimestamp(first)
+	b, ok2 := store.LocalTimestamp(second)
+	if !ok || !ok2 {
+		t.Fatalf("Timestamps not stored")
+	}
+	if b.Sub(a) != 5*time.Second {
+		t.Errorf("Clock step affected elapsed time: %s", b.Sub(a))
+	}
+
+	// Observing again keeps the first timestamp
+	clock.Advance(time.Minute)
+	if observeBlock(first) != a {
+		t.Errorf("Timestamp overwritten on second observation")
+	}
+}
+
+func TestBuiltinNetworks(t *testing.T) {
+	for _, n := range []Network{LiveNetwork, TestNetwork} {
+		if err := n.Validate(); err != nil {
+			t.Errorf("%s network invalid: %s", n.Name, err)
+		}
+	}
+}
+
+func TestPrivateNetwork(t *testing.T) {
+	seed := "1234567890123456789012345678901234567890123456789012345678901234"
+	threshold := uint64(protocol.WorkTestThreshold)
+	genesis := GenerateGenesis(seed, threshold)
+
+	network, err := NewNetwork("private", [2]byte{'P', 'N'}, 17075, threshold, genesis)
+	if err != nil {
+		t.Fatalf("Failed to create private network: %s", err)
+	}
+	network.Activate()
+	defer LiveNetwork.Activate()
+
+	if CreateKeepAlive(nil).MagicNumber != [2]byte{'P', 'N'} {
+		t.Errorf("Network magic number not used")
+	}
+
+	tampered := *genesis
+	tampered.Signature = blocks.TestGenesisBlock.Signature
+	if _, err := NewNetwork("private", [2]byte{'P', 'N'}, 17075, threshold, &tampered); err == nil {
+		t.Errorf("Accepted genesis with bad signature")
+	}
+
+	if _, err := NewNetwork("private", [2]byte{'P', 'N'}, 17075, 0xffffffffffffffff, genesis); err == nil {
+		t.Errorf("Accepted genesis with insufficient work")
+	}
+
+	store.Init(network.StoreConfig(store.TestConfig.Path))
+	defer os.RemoveAll(store.TestConfig.Path)
+
+	_, priv := address.KeypairFromSeed(seed, 0)
+	genesisWallet := wallet.New(hex.EncodeToString(priv))
+	if genesisWallet.GetBalance() != blocks.GenesisAmount {
+		t.Fatalf("Genesis account not funded")
+	}
+
+	_, priv = address.KeypairFromSeed(seed, 1)
+	second := wallet.New(hex.EncodeToString(priv))
+	amount := uint128.FromInts(0, 1000)
+
+	genesisWallet.GeneratePowSync()
+	send, err := genesisWallet.Send(second.Address(), amount)
+	if err != nil {
+		t.Fatalf("Failed to send: %s", err)
+	}
+	if err = store.StoreBlock(send); err != nil {
+		t.Fatalf("Failed to store send: %s", err)
+	}
+
+	second.GeneratePowSync()
+	open, err := second.Open(send.Hash(), second.Address())
+	if err != nil {
+		t.Fatalf("Failed to open: %s", err)
+	}
+	if err = store.StoreBlock(open); err != nil {
+		t.Fatalf("Failed to store open: %s", err)
+	}
+
+	if store.GetBalance(store.FetchOpen(second.Address())) != amount {
+		t.Errorf("Second account not funded")
+	}
+}
+
+func TestVoteSpacing(t *testing.T) {
+	clock := utils.NewFakeClock(time.Now())
+	Clock = clock
+	defer func() { Clock = utils.SystemClock{} }()
+
+	s := NewVoteSpacing(10*time.Second, 2)
+	root := types.BlockHash(fmt.Sprintf("%064X", 1))
+	a := types.BlockHash(fmt.Sprintf("%064X", 2))
+	b := types.BlockHash(fmt.Sprintf("%064X", 3))
+
+	if !s.Vote(root, a, false) {
+		t.Errorf("First vote on a root should be allowed")
+	}
+
+	clock.Advance(10*time.Second - 1)
+	if s.Vote(root, a, true) {
+		t.Errorf("Identical re-vote within interval allowed")
+	}
+	if s.Vote(root, b, false) {
+		t.Errorf("Vote for another candidate allowed without switching")
+	}
+	if !s.Vote(root, b, true) {
+		t.Errorf("Switching candidates should be allowed immediately")
+	}
+
+	clock.Advance(10 * time.Second)
+	if !s.Vote(root, b, false) {
+		t.Errorf("Re-vote not allowed once interval has passed")
+	}
+
+	// Wall clock steps don't shorten the interval
+	clock.Step(time.Hour)
+	if s.Vote(root, b, false) {
+		t.Errorf("Clock step allowed early re-vote")
+	}
+
+	s.Vote(a, a, false)
+	s.Vote(b, b, false)
+	if len(s.votes) != 2 || !s.Vote(root, b, false) {
+		t.Errorf("Oldest root should have been evicted")
+	}
+}
+
+func TestShouldRebroadcast(t *testing.T) {
+	var m MessageConfirmAck
+	m.Read(bytes.NewBuffer(confirmAck))
+
+	rebroadcastVotes = newRecentSet(1)
+	defer func() { rebroadcastVotes = newRecentSet(maxTrackedVotes) }()
+
+	if !ShouldRebroadcast(&m.MessageVote) {
+		t.Errorf("New vote should be rebroadcast")
+	}
+	if ShouldRebroadcast(&m.MessageVote) {
+		t.Errorf("Vote rebroadcast twice")
+	}
+
+	m.Sequence[0]++
+	if !ShouldRebroadcast(&m.MessageVote) {
+		t.Errorf("Vote with new sequence should be rebroadcast")
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	clock := utils.NewFakeClock(time.Now())
+	Clock = clock
+	defer func() { Clock = utils.SystemClock{} }()
+
+	probes := 0
+	l := NewLiveness(time.Minute, 3, func(p Peer) error {
+		probes++
+		return nil
+	})
+	peer := Peer{net.ParseIP("::1"), 7075, nil}
+	l.Add(peer)
+
+	expect := func(state PeerState, n int) {
+		t.Helper()
+		l.Tick()
+		got, _ := l.State(peer)
+		if got != state || probes != n {
+			t.Errorf("Expected %s after %d probes, got %s after %d", state, n, got, probes)
+		}
+	}
+
+	clock.Advance(29 * time.Second)
+	expect(PeerLive, 0)
+	clock.Advance(time.Second)
+	expect(PeerProbing, 1)
+
+	// A restarted peer answers and is live again
+	clock.Advance(5 * time.Second)
+	l.Heard(peer)
+	expect(PeerLive, 1)
+
+	// Then the route breaks
+	clock.Advance(30 * time.Second)
+	expect(PeerProbing, 2)
+	clock.Advance(10 * time.Second)
+	expect(PeerProbing, 3)
+	clock.Advance(10 * time.Second)
+	expect(PeerProbing, 4)
+	clock.Advance(10 * time.Second)
+	expect(PeerCooldown, 4)
+
+	// Retried after the backoff, which then doubles
+	clock.Advance(59 * time.Second)
+	expect(PeerCooldown, 4)
+	clock.Advance(time.Second)
+	expect(PeerCooldown, 5)
+	clock.Advance(119 * time.Second)
+	expect(PeerCooldown, 5)
+	clock.Advance(time.Second)
+	expect(PeerCooldown, 6)
+
+	l.Heard(peer)
+	expect(PeerLive, 6)
+
+	// Packets from outside the peer table don't start tracking their source
+	stranger := Peer{net.ParseIP("::1"), 7076, nil}
+	l.Heard(stranger)
+	if _, ok := l.State(stranger); ok {
+		t.Errorf("Untracked peer added by a packet")
+	}
+
+	statuses := l.Statuses()
+	if len(statuses) != 1 || statuses[0].Failures != 0 || statuses[0].State.String() != "live" {
+		t.Errorf("Unexpected statuses %v", statuses)
+	}
+}
+
+func TestFromBlock(t *testing.T) {
+	for _, packet := range [][]byte{publishSend, publishReceive, publishOpen, publishChange} {
+		var m MessagePublish
+		if err := m.Read(bytes.NewBuffer(packet)); err != nil {
+			t.Fatal(err)
+		}
+
+		block, err := FromBlock(m.ToBlock())
+		if err != nil {
+			t.Fatalf("Failed to convert block: %s", err)
+		}
+		var buf bytes.Buffer
+		block.Write(&buf)
+		if !bytes.Equal(buf.Bytes(), packet[8:]) {
+			t.Errorf("Block didn't round trip\n%x\n%x", packet[8:], buf.Bytes())
+		}
+	}
+}
+
+func TestGenerateWork(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = LiveNetwork.WorkThreshold }()
+
+	var root [32]byte
+	copy(root[:], blocks.TestGenesisBlock.Hash().ToBytes())
+	work, err := GenerateWork(context.Background(), root)
+	if err != nil || !ValidateWork(root, work) {
+		t.Fatalf("Bad work %x: %v", work, err)
+	}
+	// Held as a block's work, it's valid for the block with that root
+	send := &blocks.SendBlock{PreviousHash: blocks.TestGenesisBlock.Hash(), Destination: blocks.TestGenesisBlock.Account}
+	send.Work = types.Work(hex.EncodeToString(work[:]))
+	if !blocks.ValidateBlockWork(send) {
+		t.Errorf("Work %s rejected for a block", send.Work)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	blocks.WorkThreshold = math.MaxUint64
+	if _, err := GenerateWork(ctx, root); err != context.Canceled {
+		t.Errorf("Expected generation cancelled, got %v", err)
+	}
+}
+
+func TestCreatePublishRoundTrip(t *testing.T) {
+	pub, priv := address.GenerateKey()
+	account := address.PubKeyToAddress(pub)
+	previous := blocks.TestGenesisBlock.Hash()
+	common := func(hash types.BlockHash) blocks.CommonBlock {
+		return blocks.CommonBlock{Work: "9680625b39d3363d", Signature: hash.Sign(priv)}
+	}
+
+	var built []blocks.Block
+	for _, balance := range []uint128.Uint128{uint128.FromInts(0, 0), uint128.FromInts(0, 1), blocks.GenesisAmount} {
+		send := &blocks.SendBlock{PreviousHash: previous, Destination: account, Balance: balance}
+		send.CommonBlock = common(send.Hash())
+		built = append(built, send)
+	}
+	open := &blocks.OpenBlock{SourceHash: previous, Representative: account, Account: account}
+	open.CommonBlock = common(open.Hash())
+	receive := &blocks.ReceiveBlock{PreviousHash: previous, SourceHash: open.Hash()}
+	receive.CommonBlock = common(receive.Hash())
+	change := &blocks.ChangeBlock{PreviousHash: previous, Representative: account}
+	change.CommonBlock = common(change.Hash())
+	state := &blocks.StateBlock{account, previous, account, blocks.GenesisAmount, open.Hash(), blocks.CommonBlock{}}
+	state.CommonBlock = common(state.Hash())
+	built = append(built, open, receive, change, state)
+
+	for _, block := range built {
+		m, err := CreatePublish(block)
+		if err != nil {
+			t.Fatalf("Failed to create publish: %s", err)
+		}
+		var buf bytes.Buffer
+		m.Write(&buf)
+		read, err := ReadMessage(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if back := read.(*MessagePublish).ToBlock(); !reflect.DeepEqual(back, block) {
+			t.Errorf("Block didn't round trip\n%+v\n%+v", block, back)
+		}
+	}
+
+	// State block work goes out big endian, after the rest in hash order
+	m, _ := CreatePublish(state)
+	var buf bytes.Buffer
+	m.Write(&buf)
+	if size, _ := blockSize(protocol.BlockTypeState); buf.Len() != headerSize+size {
+		t.Errorf("Wrote a %d byte state block", buf.Len()-headerSize)
+	}
+	if work := hex.EncodeToString(buf.Bytes()[buf.Len()-8:]); work != string(state.Work) {
+		t.Errorf("Wrote work %s for %s", work, state.Work)
+	}
+	if block, err := ReadPublishMessage(&buf); err != nil || block.Hash() != state.Hash() {
+		t.Errorf("Failed to read the state block back: %v", err)
+	}
+
+	// A different last character breaks the address's checksum
+	badAccount := account[:len(account)-1] + "1"
+	if badAccount == account {
+		badAccount = account[:len(account)-1] + "3"
+	}
+	for name, block := range map[string]blocks.Block{
+		"bad hash":      &blocks.ReceiveBlock{"XYZ", previous, common(previous)},
+		"short hash":    &blocks.ReceiveBlock{previous[:62], previous, common(previous)},
+		"bad address":   &blocks.SendBlock{previous, "xrb_notanaddress", blocks.GenesisAmount, common(previous)},
+		"bad account":   &blocks.OpenBlock{previous, account, badAccount, common(previous)},
+		"no work":       &blocks.ChangeBlock{previous, account, blocks.CommonBlock{Signature: previous.Sign(priv)}},
+		"bad signature": &blocks.ChangeBlock{previous, account, blocks.CommonBlock{Work: "9680625b39d3363d", Signature: "ECDA"}},
+	} {
+		if _, err := CreatePublish(block); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// A state block's body laid out by hand: account, previous,
+// representative, balance, link, signature, then the work big endian
+func TestStateBlockWire(t *testing.T) {
+	block, err := blocks.ParseJson([]byte(`{"type":"state","account":"nano_3e3j5tkog48pnny9dmfzj1r16pg8t1e76dz5tmac6iq689wyjfpiij4txtdo","previous":"991CF190094C00F0B68E2E5F75F6BEE95A2E0BD93CEAA4A6734DB9F19B728948","representative":"nano_355z4uz75gjfjcb5ndydx9j5s5h9tko158hu47ff4eeyqajem5zjfhgzuo8m","balance":"1000000000000000000000000000000","link":"04270D7F11C4B2B472F2854C5A59F2A7E84226CE9ED799DE75744BD7D85FC9D9","signature":"BF9360090ABDE803C3A92C07B3D4B55A1C1CC7B27B7D12C847D090556B1FF24B0BD81BF5898124C99CA266CB238A057DEFE8A6A5D6CADF6413622A2613797505","work":"7202df8a7c380578"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "b0311ea55708d6a53c75cdbf88300259c6d018522fe3d4d0a242e431f9e8b6d0" +
+		"991cf190094c00f0b68e2e5f75f6bee95a2e0bd93ceaa4a6734db9f19b728948" +
+		"8c7f16fe51ba2d8a923a2fcbe9e23c8de7d4aa0199fb115ad1319eba22c98ff1" +
+		"0000000c9f2c9cd04674edea40000000" +
+		"04270d7f11c4b2b472f2854c5a59f2a7e84226ce9ed799de75744bd7d85fc9d9" +
+		"bf9360090abde803c3a92c07b3d4b55a1c1cc7b27b7d12c847d090556b1ff24b" +
+		"0bd81bf5898124c99ca266cb238a057defe8a6a5d6cadf6413622a2613797505" +
+		"7202df8a7c380578"
+
+	m, err := CreatePublish(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	m.Write(&buf)
+	if body := hex.EncodeToString(buf.Bytes()[headerSize:]); body != expected {
+		t.Errorf("Wrote\n%s\nexpected\n%s", body, expected)
+	}
+	read, err := ReadPublishMessage(&buf)
+	if err != nil || read.Hash() != "B76F9F062A4F11C38AFD2EB3DC3F390170B8B92BB813EC9CA09457CF76F5CBF9" {
+		t.Errorf("Failed to read the state block back: %v", err)
+	}
+}
+
+func TestPublishCache(t *testing.T) {
+	publishPackets = newPublishCache(1)
+	defer func() { publishPackets = newPublishCache(publishCacheSize) }()
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = LiveNetwork.WorkThreshold }()
+
+	var m MessagePublish
+	m.Read(bytes.NewBuffer(publishOpen))
+	block := m.ToBlock()
+
+	first, err := PublishPacket(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := PublishPacket(block)
+	if !bytes.Equal(first, second) || GetPublishCacheStats() != (PublishCacheStats{1, 1}) {
+		t.Errorf("Second publish should hit the cache, stats %+v", GetPublishCacheStats())
+	}
+
+	InvalidatePublish(block.Hash())
+	PublishPacket(block)
+	if GetPublishCacheStats().Misses != 2 {
+		t.Errorf("Invalidated packet served from cache")
+	}
+
+	var reread MessagePublish
+	if err = reread.Read(bytes.NewBuffer(first)); err != nil || reread.ToBlock().Hash() != block.Hash() {
+		t.Errorf("Cached packet doesn't decode to the block")
+	}
+}
+
+func BenchmarkRepublish(b *testing.B) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = LiveNetwork.WorkThreshold }()
+
+	var blockList []blocks.Block
+	for i := 0; i < 100; i++ {
+		block := &blocks.ChangeBlock{
+			PreviousHash:   types.BlockHash(fmt.Sprintf("%064X", i)),
+			Representative: blocks.TestGenesisBlock.Account,
+		}
+		block.Work = blocks.GenerateWorkForHash(block.RootHash())
+		block.Signature = types.Signature(fmt.Sprintf("%0128X", i))
+		blockList = append(blockList, block)
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := 0; i < 10000; i++ {
+			PublishPacket(blockList[i%len(blockList)])
+		}
+	}
+}
+
+func TestTcpListenerLimits(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewTcpListener(ln, ConnLimits{MaxConnsPerIP: 3, IdleTimeout: time.Second})
+	defer l.Close()
+
+	// Echo one byte at a time until the client hangs up
+	go l.Serve(func(conn net.Conn) {
+		buf := make([]byte, 1)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+			conn.Write(buf)
+		}
+	})
+
+	served := func(from string) bool {
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(from)}}
+		conn, err := dialer.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(500 * time.Millisecond))
+		buf := []byte{1}
+		conn.Write(buf)
+		_, err = conn.Read(buf)
+		return err == nil
+	}
+
+	for i := 0; i < 3; i++ {
+		if !served("127.0.0.1") {
+			t.Fatalf("Connection %d under the per-IP cap not served", i)
+		}
+	}
+	if served("127.0.0.1") {
+		t.Errorf("Connection over the per-IP cap was served")
+	}
+	if !served("127.0.0.2") {
+		t.Errorf("Connection from another address not served")
+	}
+
+	stats := l.Stats()
+	if stats.RejectedPerIP != 1 || stats.Accepted != 4 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	// Idle connections are dropped and their slots freed
+	l.SetLimits(ConnLimits{MaxConnsPerIP: 3, IdleTimeout: 50 * time.Millisecond})
+	time.Sleep(1200 * time.Millisecond)
+	if stats = l.Stats(); stats.Active != 0 || stats.TimedOut != 4 {
+		t.Errorf("Idle connections not timed out %+v", stats)
+	}
+	if !served("127.0.0.1") {
+		t.Errorf("Slots not freed after idle timeout")
+	}
+}
+
+func TestPanickingBlockHandler(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = LiveNetwork.WorkThreshold }()
+	os.RemoveAll(store.TestConfig.Path)
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+
+	bad := OnBlock("bad", func(b blocks.Block) { panic("handler bug") })
+	received := 0
+	OnBlock("good", func(b blocks.Block) { received++ })
+	defer RemoveBlockHandler("good")
+
+	w := wallet.New(blocks.TestPrivateKey)
+	for i := 0; i < utils.DefaultMaxPanics+2; i++ {
+		w.GeneratePowSync()
+		send, err := w.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, _ := CreatePublish(send)
+		var buf bytes.Buffer
+		m.Write(&buf)
+		handleMessage(&buf)
+	}
+
+	if received != utils.DefaultMaxPanics+2 {
+		t.Errorf("Packets stopped being processed after a handler panic, %d received", received)
+	}
+	if bad.Panics() != utils.DefaultMaxPanics || !bad.Disabled() {
+		t.Errorf("Panicking handler not disabled, %d panics", bad.Panics())
+	}
+}
+
+func scrapeMetrics(t *testing.T, url string) map[string]float64 {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	values := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		values[line[:i]], _ = strconv.ParseFloat(line[i+1:], 64)
+	}
+	return values
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = LiveNetwork.WorkThreshold }()
+	os.RemoveAll(store.TestConfig.Path)
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+
+	server := httptest.NewServer(metrics.Handler())
+	defer server.Close()
+	before := scrapeMetrics(t, server.URL)
+
+	const n = 20
+	w := wallet.New(blocks.TestPrivateKey)
+	for i := 0; i < n; i++ {
+		w.GeneratePowSync()
+		send, _ := w.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 1))
+		m, _ := CreatePublish(send)
+		var buf bytes.Buffer
+		m.Write(&buf)
+		handleMessage(&buf)
+		confirmBlock(send.Hash())
+	}
+	// Replaying a block with a missing parent is a gap
+	w.Head = &blocks.SendBlock{PreviousHash: types.BlockHash(strings.Repeat("1", 64))}
+	w.GeneratePowSync()
+	gap, _ := w.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 0))
+	store.StoreBlock(gap)
+
+	after := scrapeMetrics(t, server.URL)
+	delta := func(series string) float64 { return after[series] - before[series] }
+
+	for series, min := range map[string]float64{
+		`nano_message_handling_seconds_count{type="publish"}`: n,
+		`nano_block_process_seconds_count{result="progress"}`: n,
+		`nano_block_process_seconds_count{result="gap"}`:      1,
+		`nano_store_commit_seconds_count`:                     n,
+		`nano_work_generation_seconds_count{provider="cpu"}`:  n + 1,
+		`nano_election_seconds_count`:                         n,
+	} {
+		if delta(series) < min {
+			t.Errorf("Expected %s to grow by at least %.0f, grew by %.0f", series, min, delta(series))
+		}
+	}
+
+	// Buckets are cumulative and handling a message takes well under a second
+	count := after[`nano_message_handling_seconds_count{type="publish"}`]
+	if after[`nano_message_handling_seconds_bucket{type="publish",le="+Inf"}`] != count {
+		t.Errorf("+Inf bucket doesn't match count")
+	}
+	if after[`nano_message_handling_seconds_bucket{type="publish",le="0.016384"}`] == 0 {
+		t.Errorf("No publish handled within 16ms")
+	}
+	if after[`nano_message_handling_seconds_sum{type="publish"}`] > count {
+		t.Errorf("Publish handling averaged over a second")
+	}
+}
+
+func TestUdpSocketBuffers(t *testing.T) {
+	ln, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	stats := configureUdpSocket(ln, 1<<16, 1<<15)
+	if stats != GetUdpSocketStats() {
+		t.Errorf("Socket stats not recorded")
+	}
+	if stats.ReadBufferRequested != 1<<16 || stats.WriteBufferRequested != 1<<15 {
+		t.Errorf("Wrong requested sizes %d, %d", stats.ReadBufferRequested, stats.WriteBufferRequested)
+	}
+	if _, _, err := socketBuffers(ln); err == nil && (stats.ReadBufferActual == 0 || stats.WriteBufferActual == 0) {
+		t.Errorf("Granted sizes not read")
+	}
+}
+
+func TestKernelDrops(t *testing.T) {
+	f, err := os.Open("testdata/proc_net_udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// The connected socket with 7075 as its remote port isn't counted
+	drops, found, err := parseProcNetUdp(f, 7075)
+	if err != nil || !found || drops != 17 {
+		t.Errorf("Parsed %d drops, found %t: %v", drops, found, err)
+	}
+
+	defer func(paths []string) { procNetUdp = paths }(procNetUdp)
+	procNetUdp = []string{"testdata/proc_net_udp", "testdata/proc_net_udp6", "testdata/missing"}
+	if drops, err := readKernelDrops(7075); err != nil || drops != 22 {
+		t.Errorf("Read %d drops over udp and udp6: %v", drops, err)
+	}
+	if _, err := readKernelDrops(7076); err != errNoDropCounters {
+		t.Errorf("Found drops for an unbound port")
+	}
+
+	defer func(fn func(uint64, UdpSocketStats)) { OnUdpDrops = fn }(OnUdpDrops)
+	var warnings []uint64
+	OnUdpDrops = func(dropped uint64, stats UdpSocketStats) { warnings = append(warnings, dropped) }
+
+	counter := uint64(100)
+	s := dropSampler{read: func() (uint64, error) { return counter, nil }}
+	start := time.Now()
+	s.sample(start)
+	counter = 110
+	s.sample(start.Add(DropSampleInterval))
+	// Rate limited, but still counted
+	counter = 115
+	s.sample(start.Add(2 * DropSampleInterval))
+	s.sample(start.Add(DropSampleInterval + DropWarningInterval))
+	if len(warnings) != 2 || warnings[0] != 10 || warnings[1] != 5 {
+		t.Errorf("Wrong drop warnings %v", warnings)
+	}
+	if GetUdpSocketStats().KernelDrops != 115 {
+		t.Errorf("Kernel drops not exposed in stats")
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+
+	// A peer answering keepalives and a work server accepting connections
+	peer, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer peer.Close()
+	go func() {
+		buf := make([]byte, packetSize)
+		n, addr, err := peer.ReadFrom(buf)
+		if err == nil {
+			peer.WriteTo(buf[:n], addr)
+		}
+	}()
+	workServer, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer workServer.Close()
+
+	cfg := DefaultSelfTestConfig
+	cfg.Peers = []Peer{{net.IPv4(127, 0, 0, 1), uint16(peer.LocalAddr().(*net.UDPAddr).Port), nil}}
+	cfg.WorkServers = []string{"http://user:hunter2@" + workServer.Addr().String()}
+	cfg.StoreLatency = time.Second
+	report := SelfTest(context.Background(), cfg)
+
+	if len(report.Checks) != len(selfTestChecks) || report.Failed() {
+		t.Errorf("Self test failed:\n%s", report)
+	}
+	for _, c := range report.Checks {
+		if c.Status != CheckPass {
+			t.Errorf("Check %s didn't pass: %s", c.Name, c.Detail)
+		}
+	}
+	text := report.String()
+	for _, secret := range []string{"hunter2", blocks.TestPrivateKey, selfTestSeed} {
+		if strings.Contains(strings.ToUpper(text), strings.ToUpper(secret)) {
+			t.Errorf("Report contains a secret: %s", text)
+		}
+	}
+
+	workServer.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report = SelfTest(ctx, cfg)
+	if !report.Failed() || report.Checks[0].Detail != "Cancelled" {
+		t.Errorf("Cancelled self test didn't fail:\n%s", report)
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = LiveNetwork.WorkThreshold }()
+	os.RemoveAll(store.TestConfig.Path)
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	defer func(peers []Peer, set map[string]bool) { PeerList, PeerSet = peers, set }(PeerList, PeerSet)
+	PeerSet = map[string]bool{}
+	for _, peer := range PeerList {
+		PeerSet[peer.String()] = true
+	}
+
+	const budget = 200 << 10
+	utils.SetMemoryBudget(budget)
+	defer utils.SetMemoryBudget(0)
+	if stats := utils.GetMemoryStats(); stats.LimitBytes > budget || len(stats.Structures) < 6 {
+		t.Fatalf("Limits not within the budget: %+v", stats)
+	}
+
+	var vote MessageConfirmAck
+	vote.Read(bytes.NewBuffer(confirmAck))
+	for i := 0; i < 1000; i++ {
+		// Gaps fill the unchecked pool, the election table and the
+		// publish cache
+		block := &blocks.ChangeBlock{
+			PreviousHash:   types.BlockHash(fmt.Sprintf("%064X", i+1)),
+			Representative: blocks.TestGenesisBlock.Account,
+		}
+		block.Work = blocks.GenerateWorkForHash(block.RootHash())
+		block.Signature = types.Signature(fmt.Sprintf("%0128X", i))
+		packet, err := PublishPacket(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handleMessage(bytes.NewBuffer(packet))
+
+		vote.Sequence[0], vote.Sequence[1] = byte(i), byte(i>>8)
+		ShouldRebroadcast(&vote.MessageVote)
+		hintVote(block.Hash(), &vote.MessageVote)
+
+		ip := net.IPv4(10, 0, byte(i>>8), byte(i))
+		keepAlive := MessageKeepAlive{Peers: []Peer{{ip, 7075, nil}}}
+		keepAlive.Handle()
+
+		pub := types.BlockHash(fmt.Sprintf("%064X", i)).ToBytes()
+		wallet.Works.Put(pub, block.PreviousHash, block.Work)
+
+		if i%100 == 99 {
+			stats := utils.GetMemoryStats()
+			if stats.Bytes > budget {
+				t.Fatalf("Using %d bytes over a budget of %d: %+v", stats.Bytes, budget, stats.Structures)
+			}
+		}
+	}
+
+	for _, usage := range utils.GetMemoryStats().Structures {
+		if usage.Entries == 0 {
+			t.Errorf("Nothing accounted for %s", usage.Name)
+		}
+		if usage.Entries > usage.Limit {
+			t.Errorf("%s has %d entries over its limit of %d", usage.Name, usage.Entries, usage.Limit)
+		}
+	}
+}
+
+type recordingTransport struct {
+	sent [][]byte
+}
+
+func (t *recordingTransport) Send(peer Peer, packet []byte) error {
+	t.sent = append(t.sent, packet)
+	return nil
+}
+
+func (t *recordingTransport) Broadcast(packet []byte) error {
+	t.sent = append(t.sent, packet)
+	return nil
+}
+
+func TestInject(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = LiveNetwork.WorkThreshold }()
+	os.RemoveAll(store.TestConfig.Path)
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	fake := &recordingTransport{}
+	Transport = fake
+	defer func() { Transport = nil }()
+	// Without confirmations queued by earlier tests
+	saved := Cementer
+	Cementer, _ = store.NewConfirmationHeightProcessor(store.DefaultCementBatchSize, store.Confirmations.Publish)
+	defer func() { Cementer = saved }()
+	sockets := atomic.LoadUint64(&udpSockets)
+
+	w := wallet.New(blocks.TestPrivateKey)
+	w.GeneratePowSync()
+	send, _ := w.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 1))
+	from := Peer{net.ParseIP("::ffff:10.0.0.1"), 7075, nil}
+
+	publish, _ := CreatePublish(send)
+	if err := Inject(publish, from); err != nil {
+		t.Fatal(err)
+	}
+	if store.FetchBlock(send.Hash()) == nil {
+		t.Fatalf("Injected publish wasn't stored")
+	}
+
+	var ack MessageConfirmAck
+	ack.MessageHeader = publish.MessageHeader
+	ack.MessageType = protocol.MessageConfirmAck
+	ack.MessageBlock = publish.MessageBlock
+
+	// A valid vote from a key without weight doesn't confirm anything
+	sub := Events.Subscribe(4)
+	defer sub.Close()
+	_, nobody := address.GenerateKey()
+	copy(ack.Account[:], nobody.Public().(ed25519.PublicKey))
+	copy(ack.Signature[:], ed25519.Sign(nobody, ack.MessageVote.Hash()))
+	Inject(&ack, from)
+	if e, ok := GetElectionStats(send.Hash()); !ok || e.Votes != 1 || e.Confirmed {
+		t.Errorf("Vote without weight confirmed the block: %+v", e)
+	}
+	if e := <-sub.C; e.Type != EventVote || len(sub.C) != 0 {
+		t.Errorf("Expected only a vote event, got %+v", e)
+	}
+
+	_, priv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	copy(ack.Account[:], priv.Public().(ed25519.PublicKey))
+	copy(ack.Signature[:], ed25519.Sign(priv, ack.MessageVote.Hash()))
+	if err := Inject(&ack, from); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := GetElectionStats(send.Hash()); !ok || e.Votes != 2 || !e.Confirmed {
+		t.Errorf("Injected vote didn't confirm the block: %+v", e)
+	}
+	if state, ok := PeerLiveness.State(from); !ok || state != PeerLive {
+		t.Errorf("Sender not marked alive, %v", state)
+	}
+
+	// Once confirmed it's cemented with the genesis block below it, and
+	// passed on to subscribers
+	var cemented []store.CementEvent
+	cementSub := store.Confirmations.Subscribe(blocks.TestGenesisBlock.Account, func(e store.CementEvent) {
+		cemented = append(cemented, e)
+	})
+	defer cementSub.Close()
+	CementConfirmed(nil)
+	if !store.IsCemented(send.Hash()) || len(cemented) != 2 || cemented[1].Hash != send.Hash() {
+		t.Errorf("Confirmed block not cemented, got %+v", cemented)
+	}
+
+	// Outgoing messages go to the embedder's transport
+	if err := Broadcast(send); err != nil || len(fake.sent) != 1 {
+		t.Errorf("Broadcast not sent through the transport: %v", err)
+	}
+	from.SendMessage(publish)
+	if len(fake.sent) != 2 {
+		t.Errorf("Message not sent through the transport")
+	}
+	if atomic.LoadUint64(&udpSockets) != sockets {
+		t.Errorf("Opened a udp socket")
+	}
+}
+
+// Peers still on the old protocol get votes with sequence numbers, and
+// upgraded ones timestamped votes, each verifiable by its receiver.
+func TestMixedVersionVotes(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = LiveNetwork.WorkThreshold }()
+	os.RemoveAll(store.TestConfig.Path)
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	fake := &recordingTransport{}
+	Transport = fake
+	defer func() { Transport = nil }()
+	clock := utils.NewFakeClock(time.Unix(1500000000, 0))
+	Clock = clock
+	defer func() { Clock = utils.SystemClock{} }()
+
+	old := Peer{net.ParseIP("::ffff:10.0.1.1"), 7075, nil}
+	upgraded := Peer{net.ParseIP("::ffff:10.0.1.2"), 7075, nil}
+	silent := Peer{net.ParseIP("::ffff:10.0.1.3"), 7075, nil}
+	oldHello := CreateKeepAlive(nil)
+	oldHello.VersionMax, oldHello.VersionUsing = 5, 5
+	Inject(oldHello, old)
+	Inject(CreateKeepAlive(nil), upgraded)
+	defer peerVersions.forget(old)
+	defer peerVersions.forget(upgraded)
+	if PeerVersion(old) != 5 || PeerVersion(upgraded) != protocol.VersionMax || PeerVersion(silent) != protocol.VersionUsing {
+		t.Fatalf("Wrong peer versions %d %d %d", PeerVersion(old), PeerVersion(upgraded), PeerVersion(silent))
+	}
+
+	w := wallet.New(blocks.TestPrivateKey)
+	w.GeneratePowSync()
+	send, _ := w.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 1))
+	_, priv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	vote := CreateVote(send, priv, 7)
+
+	received := func(peer Peer) *MessageConfirmAck {
+		fake.sent = nil
+		if err := peer.SendBuilt(vote); err != nil || len(fake.sent) != 1 {
+			t.Fatalf("Vote not sent to %s: %v", peer.String(), err)
+		}
+		m, err := ReadMessage(bytes.NewBuffer(fake.sent[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ack := m.(*MessageConfirmAck)
+		if !ack.VerifyVote() {
+			t.Errorf("%s can't verify its vote", peer.String())
+		}
+		return ack
+	}
+
+	for _, peer := range []Peer{old, silent} {
+		ack := received(peer)
+		if ack.VersionUsing != 5 || ack.Timestamped || ack.Vote().Sequence != 7 {
+			t.Errorf("%s should get a sequenced vote: %+v", peer.String(), ack.Vote())
+		}
+	}
+	ack := received(upgraded)
+	if ack.VersionUsing != 6 || !ack.Timestamped || ack.Vote().Timestamp != 1500000000000 || ack.Vote().Sequence != 0 {
+		t.Errorf("Upgraded peer should get a timestamped vote: %+v", ack.Vote())
+	}
+	// Read as an old peer would, the timestamped vote doesn't verify
+	ack.Timestamped = false
+	if ack.VerifyVote() {
+		t.Errorf("Timestamped vote verified as a sequenced one")
+	}
+
+	// Each encoding is built once however many peers speak it
+	peersLock.Lock()
+	saved := PeerList
+	PeerList = []Peer{old, upgraded, silent}
+	peersLock.Unlock()
+	defer func() { peersLock.Lock(); PeerList = saved; peersLock.Unlock() }()
+	fake.sent = nil
+	BroadcastBuilt(vote)
+	if len(fake.sent) != 3 || !bytes.Equal(fake.sent[0], fake.sent[2]) || bytes.Equal(fake.sent[0], fake.sent[1]) {
+		t.Errorf("Expected the old encoding twice and the new once, got %d packets", len(fake.sent))
+	}
+
+	// We accept both
+	publish, _ := CreatePublish(send)
+	Inject(publish, old)
+	before, _ := GetElectionStats(send.Hash())
+	for i, packet := range fake.sent[:2] {
+		m, _ := ReadMessage(bytes.NewBuffer(packet))
+		Inject(m, upgraded)
+		if e, ok := GetElectionStats(send.Hash()); !ok || e.Votes != before.Votes+i+1 {
+			t.Errorf("Vote %d not counted: %+v", i, e)
+		}
+	}
+}
+
+func TestVoteHints(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = LiveNetwork.WorkThreshold }()
+	os.RemoveAll(store.TestConfig.Path)
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	weights.byRep = nil
+	voteHints = newVoteHintCache(maxVoteHints, voteHintTTL)
+
+	var pulls []types.BlockHash
+	LazyPull = func(hash types.BlockHash) { pulls = append(pulls, hash) }
+	defer func() { LazyPull = nil }()
+
+	w := wallet.New(blocks.TestPrivateKey)
+	w.GeneratePowSync()
+	first, _ := w.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 1))
+	w.GeneratePowSync()
+	second, _ := w.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 1))
+	publishFirst, _ := CreatePublish(first)
+	publishSecond, _ := CreatePublish(second)
+
+	_, priv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	var ack MessageConfirmAck
+	ack.MessageHeader = publishSecond.MessageHeader
+	ack.MessageType = protocol.MessageConfirmAck
+	ack.MessageBlock = publishSecond.MessageBlock
+	copy(ack.Account[:], priv.Public().(ed25519.PublicKey))
+	copy(ack.Signature[:], ed25519.Sign(priv, ack.MessageVote.Hash()))
+
+	// The vote arrives before the block it builds on, twice
+	from := Peer{net.ParseIP("::ffff:10.0.0.1"), 7075, nil}
+	Inject(&ack, from)
+	Inject(&ack, from)
+	if _, ok := GetElectionStats(second.Hash()); ok {
+		t.Errorf("Election started for a block that couldn't be stored")
+	}
+	if len(pulls) != 1 || pulls[0] != second.Hash() {
+		t.Errorf("Heavily voted unknown block should be pulled once, got %v", pulls)
+	}
+
+	Inject(publishFirst, from)
+	Inject(publishSecond, from)
+	e, ok := GetElectionStats(second.Hash())
+	if !ok || e.Votes != 1 || e.Hinted != 1 || e.Duration() != 0 || !e.Confirmed {
+		t.Errorf("Hinted vote should confirm the block as it arrives: %+v", e)
+	}
+	if e.Tally != store.GetBalance(store.FetchBlock(blocks.TestGenesisBlock.Hash())) {
+		t.Errorf("Tally should be the genesis weight, got %s", e.Tally)
+	}
+	stats := GetVoteHintStats()
+	if stats.Hits != 1 || stats.Hashes != 0 {
+		t.Errorf("Expected a cache hit and an empty cache, got %+v", stats)
+	}
+
+	c := newVoteHintCache(2, time.Minute)
+	for i := 0; i < 3; i++ {
+		c.add(types.BlockHash(fmt.Sprintf("%064X", i)), VoteHint{At: now()})
+	}
+	if c.len() != 2 || c.take(types.BlockHash(fmt.Sprintf("%064X", 0)), time.Now()) != nil {
+		t.Errorf("Oldest hint should have been evicted")
+	}
+	if c.take(types.BlockHash(fmt.Sprintf("%064X", 1)), time.Now().Add(time.Hour)) != nil || c.getStats().Expired != 1 {
+		t.Errorf("Hints should expire")
+	}
+}
+
+func TestBacklogScan(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = LiveNetwork.WorkThreshold }()
+	os.RemoveAll(store.TestConfig.Path)
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	fake := &recordingTransport{}
+	Transport = fake
+	defer func() { Transport = nil }()
+
+	// Genesis sends to two accounts that open, the second is cemented
+	genesis := wallet.New(blocks.TestPrivateKey)
+	var opens []blocks.Block
+	for i := 1; i <= 2; i++ {
+		w := wallet.New(strings.Repeat(fmt.Sprintf("%02x", i), 32))
+		genesis.GeneratePowSync()
+		send, _ := genesis.Send(w.Address(), uint128.FromInts(0, 1))
+		store.StoreBlock(send)
+		w.GeneratePowSync()
+		open, _ := w.Open(send.Hash(), w.Address())
+		store.StoreBlock(open)
+		opens = append(opens, open)
+	}
+	cementer, _ := store.NewConfirmationHeightProcessor(store.DefaultCementBatchSize, nil)
+	cementer.Add(opens[1].Hash())
+	if err := cementer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Cementing the open cemented the send it receives, so genesis needs
+	// a newer block
+	genesis.GeneratePowSync()
+	send, _ := genesis.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 1))
+	store.StoreBlock(send)
+
+	unconfirmed := store.UnconfirmedFrontiers()
+	if len(unconfirmed) != 2 {
+		t.Fatalf("Expected genesis and the first account unconfirmed, got %+v", unconfirmed)
+	}
+
+	// Restart: the store is reopened and the elections are gone
+	store.Init(store.TestConfig)
+	confirmations = newConfirmationSampler()
+	s := NewBacklogScanner(20)
+	start := time.Now()
+	s.Scan(nil)
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("Scan wasn't throttled")
+	}
+	stats := s.Stats()
+	if len(fake.sent) != 2 || stats.Requested != 2 || stats.Backlog != 2 || stats.Scanned != 2 || stats.Passes != 1 {
+		t.Fatalf("Expected confirm requests for both frontiers, got %d sent and %+v", len(fake.sent), stats)
+	}
+
+	// Our peers answer the requests, with no new client activity
+	_, priv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	from := Peer{net.ParseIP("::ffff:10.0.0.1"), 7075, nil}
+	for _, packet := range fake.sent {
+		var req MessageConfirmReq
+		if err := req.Read(bytes.NewBuffer(packet)); err != nil {
+			t.Fatal(err)
+		}
+		var ack MessageConfirmAck
+		ack.MessageHeader = req.MessageHeader
+		ack.MessageType = protocol.MessageConfirmAck
+		ack.MessageBlock = req.MessageBlock
+		copy(ack.Account[:], priv.Public().(ed25519.PublicKey))
+		copy(ack.Signature[:], ed25519.Sign(priv, ack.MessageVote.Hash()))
+		Inject(&ack, from)
+	}
+	for _, f := range unconfirmed {
+		if e, ok := GetElectionStats(f.Frontier); !ok || e.Votes == 0 {
+			t.Errorf("Frontier %s not confirmed", f.Frontier)
+		}
+	}
+	if stats = s.Stats(); stats.Backlog != 0 {
+		t.Errorf("Backlog should be empty, got %d", stats.Backlog)
+	}
+
+	s.Scan(nil)
+	if len(fake.sent) != 2 {
+		t.Errorf("Confirmed frontiers requested again")
+	}
+}
+
+func TestReconcileRepublish(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = LiveNetwork.WorkThreshold }()
+	os.RemoveAll(store.TestConfig.Path)
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	fake := &recordingTransport{}
+	Transport = fake
+	defer func() { Transport = nil }()
+
+	degraded := true
+	r := NewWalletReconciler(2)
+	r.Degraded = func() bool { return degraded }
+	wallet.OnBuilt = r.Built
+	defer func() { wallet.OnBuilt = nil }()
+
+	// Built during the partition: a send that's stored here, and one on
+	// top of it that another wallet beats to the root
+	w := wallet.New(blocks.TestPrivateKey)
+	w.GeneratePowSync()
+	send, _ := w.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 1))
+	store.StoreBlock(send)
+	w.GeneratePowSync()
+	lost, _ := w.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 2))
+	r.Check()
+	if len(fake.sent) != 0 || r.Stats().Tracked != 2 {
+		t.Fatalf("Expected both blocks kept and nothing sent while degraded, got %d sent, %+v", len(fake.sent), r.Stats())
+	}
+
+	degraded = false
+	other := wallet.New(blocks.TestPrivateKey)
+	other.Head = send
+	other.GeneratePowSync()
+	winner, _ := other.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 3))
+	store.StoreBlock(winner)
+	startElection(winner.Hash(), now())
+	confirmBlock(winner.Hash())
+	if r.Stats().Tracked != 2 {
+		t.Fatal("Expected blocks built while healthy not to be kept")
+	}
+
+	// Healed: the send is republished, the lost block reported
+	r.Check()
+	stats := r.Stats()
+	if len(fake.sent) != 2 || stats.Republished != 1 || stats.Tracked != 1 {
+		t.Fatalf("Expected the send published and put to a vote, got %d sent, %+v", len(fake.sent), stats)
+	}
+	if len(stats.Conflicts) != 1 || stats.Conflicts[0] != (ReconcileConflict{lost.Hash(), send.Hash(), winner.Hash()}) {
+		t.Fatalf("Expected the lost block reported, got %+v", stats.Conflicts)
+	}
+
+	confirmBlock(send.Hash())
+	r.Check()
+	if stats = r.Stats(); stats.Tracked != 0 || stats.Confirmed != 1 || len(fake.sent) != 2 {
+		t.Fatalf("Expected the confirmed send dropped, got %+v", stats)
+	}
+
+	// A block that never confirms is given up on after Attempts
+	degraded = true
+	w.GeneratePowSync()
+	change, _ := w.Change(blocks.TestGenesisBlock.Account)
+	degraded = false
+	for i := 0; i < 3; i++ {
+		r.Check()
+	}
+	if stats = r.Stats(); len(stats.Abandoned) != 1 || stats.Abandoned[0] != change.Hash() || stats.Republished != 3 {
+		t.Fatalf("Expected the change abandoned after two republishes, got %+v", stats)
+	}
+}
+
+func TestKeepaliveSanitization(t *testing.T) {
+	defer func(peers []Peer, set map[string]bool) { PeerList, PeerSet = peers, set }(PeerList, PeerSet)
+	PeerList, PeerSet = nil, map[string]bool{}
+	defer func() { peerFilters = newPeerFilter() }()
+	peerFilters = newPeerFilter()
+	defer func() { Transport = nil }()
+	sent := &recordingTransport{}
+	Transport = sent
+	// The flood comes from one subnet, see TestPeerSubnets for its limit
+	defer func(n int) { MaxPeersPerSubnet = n }(MaxPeersPerSubnet)
+	MaxPeersPerSubnet = 0
+
+	public := Peer{net.ParseIP("203.0.113.1"), 7075, nil}
+	before := GetPeerFilterCounters()
+	keepAlive := MessageKeepAlive{Peers: []Peer{
+		{net.ParseIP("10.1.2.3"), 7075, nil},
+		{net.ParseIP("192.168.1.1"), 7075, nil},
+		{net.ParseIP("169.254.0.1"), 7075, nil},
+		{net.ParseIP("fd00::1"), 7075, nil},
+		{net.ParseIP("127.0.0.1"), 7075, nil},
+		{net.ParseIP("::1"), 7075, nil},
+		{net.ParseIP("224.0.0.1"), 7075, nil},
+		{net.ParseIP("ff02::1"), 7075, nil},
+		{net.ParseIP("0.0.0.0"), 7075, nil},
+		{net.ParseIP("::"), 7075, nil},
+		{net.ParseIP("198.51.100.1"), 0, nil},
+	}}
+	keepAlive.HandleFrom(public)
+	if len(PeerList) != 0 {
+		t.Fatalf("Filtered ranges were added: %v", PeerList)
+	}
+	after := GetPeerFilterCounters()
+	if after.Private-before.Private != 4 || after.Loopback-before.Loopback != 2 ||
+		after.Multicast-before.Multicast != 2 || after.Unspecified-before.Unspecified != 3 {
+		t.Errorf("Wrong rejection counts: %+v then %+v", before, after)
+	}
+
+	// A local peer can tell us about other local peers
+	local := MessageKeepAlive{Peers: []Peer{{net.ParseIP("10.1.2.3"), 7075, nil}}}
+	local.HandleFrom(Peer{net.ParseIP("192.168.1.2"), 7075, nil})
+	if len(PeerList) != 1 {
+		t.Errorf("Local peer from a local peer not added")
+	}
+	PeerList, PeerSet = nil, map[string]bool{}
+
+	// A new address gets a single probe until it answers
+	learned := Peer{net.ParseIP("198.51.100.7"), 7075, nil}
+	(&MessageKeepAlive{Peers: []Peer{learned}}).HandleFrom(public)
+	if len(PeerList) != 1 {
+		t.Fatalf("Public peer not added")
+	}
+	if err := SendKeepAlive(learned); err != nil {
+		t.Fatal(err)
+	}
+	if err := SendKeepAlive(learned); err != ErrPeerOnProbation {
+		t.Errorf("Second packet to an unanswered peer: %v", err)
+	}
+	if len(sent.sent) != 1 {
+		t.Errorf("Sent %d packets to a peer on probation", len(sent.sent))
+	}
+	Inject(CreateKeepAlive(nil), learned)
+	if err := SendKeepAlive(learned); err != nil {
+		t.Errorf("Answered peer still on probation: %v", err)
+	}
+
+	// New addresses from one source are rate limited
+	clock := utils.NewFakeClock(time.Now())
+	Clock = clock
+	defer func() { Clock = utils.SystemClock{} }()
+	var flood MessageKeepAlive
+	for i := 0; i < MaxLearnedPerMinute+5; i++ {
+		flood.Peers = append(flood.Peers, Peer{net.IPv4(198, 18, 0, byte(i)), 7075, nil})
+	}
+	limited := GetPeerFilterCounters().RateLimited
+	flood.HandleFrom(Peer{net.ParseIP("203.0.113.9"), 7075, nil})
+	if len(PeerList) != 1+MaxLearnedPerMinute || GetPeerFilterCounters().RateLimited-limited != 5 {
+		t.Errorf("Learned %d peers from one source", len(PeerList)-1)
+	}
+	clock.Advance(time.Minute)
+	flood.HandleFrom(Peer{net.ParseIP("203.0.113.9"), 7075, nil})
+	if len(PeerList) != 1+MaxLearnedPerMinute+5 {
+		t.Errorf("Rate limit didn't reset after a minute")
+	}
+}
+
+func TestProcessorQuotas(t *testing.T) {
+	const flood = 1000
+	spammer, innocent := types.Account("xrb_spammer"), types.Account("xrb_innocent")
+	change := func(i int) blocks.Block {
+		return &blocks.ChangeBlock{PreviousHash: types.BlockHash(fmt.Sprintf("%064X", i))}
+	}
+
+	// Worst latency of the innocent account's blocks while the spammer
+	// floods
+	run := func(share float64, exempt func(types.Account) bool) (time.Duration, ProcessorStats) {
+		p := NewBlockProcessor(10000, share)
+		p.Local = exempt
+		added := make(map[blocks.Block]time.Time)
+		var lock sync.Mutex
+		var worst time.Duration
+		done := make(chan bool)
+		p.account = func(block blocks.Block) (types.Account, uint128.Uint128, bool) {
+			if block.PreviousBlockHash() >= types.BlockHash(fmt.Sprintf("%064X", flood)) {
+				return innocent, uint128.Uint128{}, true
+			}
+			return spammer, uint128.Uint128{}, true
+		}
+		processed := 0
+		p.process = func(block blocks.Block) {
+			time.Sleep(100 * time.Microsecond)
+			lock.Lock()
+			defer lock.Unlock()
+			if start, ok := added[block]; ok && time.Since(start) > worst {
+				worst = time.Since(start)
+			}
+			if processed++; processed == flood+flood/100 {
+				close(done)
+			}
+		}
+		p.Start()
+		defer p.Stop()
+
+		for i := 0; i < flood; i++ {
+			p.Add(change(i))
+			if i%100 == 0 {
+				block := change(flood + i)
+				lock.Lock()
+				added[block] = time.Now()
+				lock.Unlock()
+				p.Add(block)
+			}
+		}
+		select {
+		case <-done:
+		case <-time.After(30 * time.Second):
+			t.Fatalf("Blocks not all processed")
+		}
+		return worst, p.Stats()
+	}
+
+	unlimited, _ := run(1, nil)
+	limited, stats := run(0.01, nil)
+	if limited > unlimited/4 {
+		t.Errorf("Innocent latency %s with quotas, %s without", limited, unlimited)
+	}
+	if stats.Deferrals[blocks.Change] == 0 || stats.Processed != flood+flood/100 || stats.Deferred != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	exempt, stats := run(0.01, func(a types.Account) bool { return a == spammer })
+	if stats.Deferrals[blocks.Change] != 0 || stats.Exempted["local"] == 0 || exempt < limited {
+		t.Errorf("Local account was deferred: %+v", stats)
+	}
+}
+
+func TestFrontierPaging(t *testing.T) {
+	// 100k accounts in key order, each its own frontier
+	const accounts = 100000
+	ledger := make([]store.Frontier, accounts)
+	pubs := make([][]byte, accounts)
+	for i := range ledger {
+		pub := make([]byte, 32)
+		binary.BigEndian.PutUint64(pub, uint64(i)*7+1)
+		pubs[i] = pub
+		ledger[i] = store.Frontier{Account: address.PubKeyToAddress(pub), Hash: types.BlockHashFromBytes(pub)}
+	}
+	var chunks int32
+	defer func(f func(types.Account, int) ([]store.Frontier, types.Account, error)) { frontiers = f }(frontiers)
+	frontiers = func(start types.Account, count int) ([]store.Frontier, types.Account, error) {
+		atomic.AddInt32(&chunks, 1)
+		seek, _ := address.AddressToPub(start)
+		i := sort.Search(accounts, func(i int) bool { return bytes.Compare(pubs[i], seek) >= 0 })
+		end := i + count
+		if end >= accounts {
+			return ledger[i:], "", nil
+		}
+		return ledger[i:end], ledger[end].Account, nil
+	}
+	defer func(n int) { FrontierChunk = n }(FrontierChunk)
+	FrontierChunk = 333
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewTcpListener(ln, ConnLimits{})
+	defer l.Close()
+	go l.Serve(ServeBootstrap)
+	port, _ := strconv.Atoi(strings.Split(ln.Addr().String(), ":")[1])
+	peer := Peer{net.ParseIP("127.0.0.1"), uint16(port), nil}
+
+	// Count is a strict limit
+	page, err := requestFrontiers(context.Background(), peer, [32]byte{}, 1000, AllFrontiers)
+	if err != nil || len(page) != 1000 {
+		t.Fatalf("Expected 1000 frontiers, got %d: %v", len(page), err)
+	}
+	if chunks != 4 {
+		t.Errorf("Expected 4 chunks, read %d", chunks)
+	}
+
+	var got []store.Frontier
+	err = FetchFrontiers(context.Background(), peer, 7919, func(f store.Frontier) error {
+		got = append(got, f)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != accounts {
+		t.Fatalf("Expected %d frontiers, got %d", accounts, len(got))
+	}
+	for i := range got {
+		if got[i] != ledger[i] {
+			t.Fatalf("Frontier %d is %v, expected %v", i, got[i], ledger[i])
+		}
+	}
+
+	// A peer that ignores the start account goes backwards on its second
+	// page
+	frontiers = func(start types.Account, count int) ([]store.Frontier, types.Account, error) {
+		return ledger[:count], ledger[count].Account, nil
+	}
+	before := MisbehaviorScore(peer)
+	err = FetchFrontiers(context.Background(), peer, 100, func(store.Frontier) error { return nil })
+	if err != ErrFrontierRegression {
+		t.Errorf("Expected a regression, got %v", err)
+	}
+	if MisbehaviorScore(peer) != before+1 {
+		t.Errorf("Regression not scored")
+	}
+}
+
+func TestKeepAlivePeers(t *testing.T) {
+	defer func(peers []Peer, set map[string]bool) { PeerList, PeerSet = peers, set }(PeerList, PeerSet)
+	PeerList, PeerSet = nil, map[string]bool{}
+	defer func(l *Liveness) { PeerLiveness = l }(PeerLiveness)
+	PeerLiveness = NewLiveness(DefaultPeerCutoff, DefaultProbeFailures, func(Peer) error { return nil })
+	clock := utils.NewFakeClock(time.Now())
+	Clock = clock
+	defer func() { Clock = utils.SystemClock{} }()
+
+	// Unused slots are zeroed, and IPv4 addresses are sent mapped
+	var buf bytes.Buffer
+	CreateKeepAlive([]Peer{{net.IPv4(73, 177, 62, 38).To4(), 7075, nil}}).Write(&buf)
+	if buf.Len() != headerSize+8*peerSize {
+		t.Fatalf("Wrote %d bytes", buf.Len())
+	}
+	if !bytes.Equal(buf.Bytes()[headerSize:headerSize+peerSize], keepAlive[headerSize:headerSize+peerSize]) {
+		t.Errorf("Peer written badly: %x", buf.Bytes()[headerSize:headerSize+peerSize])
+	}
+	if !bytes.Equal(buf.Bytes()[headerSize+peerSize:], make([]byte, 7*peerSize)) {
+		t.Errorf("Unused slots not zeroed")
+	}
+	m, err := ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := m.(*MessageKeepAlive).Peers
+	if len(peers) != 1 || peers[0].IP.String() != "73.177.62.38" || peers[0].Port != 7075 {
+		t.Errorf("Expected the one peer back, got %v", peers)
+	}
+
+	// The same peer, plain and mapped, is only added once
+	mapped := net.ParseIP("::ffff:203.0.113.7")
+	keepAlive := MessageKeepAlive{Peers: []Peer{{mapped.To4(), 7075, nil}, {mapped, 7075, nil}, {mapped, 7076, nil}}}
+	keepAlive.Handle()
+	keepAlive.Handle()
+	if len(PeerList) != 2 {
+		t.Errorf("Expected 2 peers, got %v", PeerList)
+	}
+	if shared := RandomPeers(1); len(shared) != 1 {
+		t.Errorf("Expected one random peer, got %v", shared)
+	}
+
+	// Peers not heard from within the expiry are forgotten
+	clock.Advance(PeerExpiry / 2)
+	PeerLiveness.Heard(PeerList[1])
+	clock.Advance(PeerExpiry / 2)
+	if n := ExpirePeers(); n != 1 || len(PeerList) != 1 || PeerSet[keepAlive.Peers[0].String()] {
+		t.Errorf("Expected one peer expired, got %d leaving %v", n, PeerList)
+	}
+	keepAlive.Handle()
+	if len(PeerList) != 2 {
+		t.Errorf("Expired peer not relearned: %v", PeerList)
+	}
+}
+
+func TestSignedPeerAdvertisements(t *testing.T) {
+	defer func(peers []Peer, set map[string]bool) { PeerList, PeerSet = peers, set }(PeerList, PeerSet)
+	PeerList, PeerSet = nil, map[string]bool{}
+	defer func(l *Liveness) { PeerLiveness = l }(PeerLiveness)
+	PeerLiveness = NewLiveness(DefaultPeerCutoff, DefaultProbeFailures, func(Peer) error { return nil })
+	defer func(n int) { MaxPeers = n }(MaxPeers)
+	MaxPeers = 20
+	// Peers come from a few subnets, see TestPeerSubnets for their limit
+	defer func(n int) { MaxPeersPerSubnet = n }(MaxPeersPerSubnet)
+	MaxPeersPerSubnet = 0
+	reset := func() {
+		peerFilters = newPeerFilter()
+		learnedPeers.signed, learnedPeers.unsigned = make(map[string]bool), nil
+	}
+	reset()
+	defer reset()
+	clock := utils.NewFakeClock(time.Now())
+	Clock = clock
+	defer func() { Clock = utils.SystemClock{} }()
+
+	advertised := func(network string, n int) []Peer {
+		peers := make([]Peer, n)
+		for i := range peers {
+			peers[i] = Peer{net.ParseIP(fmt.Sprintf("%s.%d", network, len(PeerList)*10+i+1)), 7075, nil}
+		}
+		return peers
+	}
+
+	// An attacker flooding from many sources only fills the unsigned share
+	for i := 1; i <= 10; i++ {
+		attacker := Peer{net.IPv4(198, 51, 100, byte(i)), 7075, nil}
+		keepAlive := CreateKeepAlive(advertised("203.0.113", numberOfPeersToShare))
+		keepAlive.Sign(NodeKey)
+		keepAlive.HandleFrom(attacker)
+	}
+	if len(PeerList) != unsignedLimit() || len(learnedPeers.unsigned) != unsignedLimit() {
+		t.Fatalf("Expected %d unsigned peers, got %v", unsignedLimit(), PeerList)
+	}
+
+	// Signed by a verified peer, and read back off the wire
+	friend := Peer{net.IPv4(192, 0, 2, 1), 7075, nil}
+	MarkVerified(friend, NodeID)
+	var buf bytes.Buffer
+	keepAlive := CreateKeepAlive(advertised("192.0.2", numberOfPeersToShare))
+	keepAlive.Sign(NodeKey)
+	keepAlive.Write(&buf)
+	if buf.Len() != headerSize+numberOfPeersToShare*peerSize+signedPeersSize {
+		t.Fatalf("Wrote %d bytes", buf.Len())
+	}
+	m, err := ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := m.(*MessageKeepAlive)
+	if !signed.signedBy(friend) || signed.Timestamp != keepAlive.Timestamp {
+		t.Fatalf("Signature didn't survive the round trip")
+	}
+
+	// Tampered, stale, or from an unverified peer is unsigned
+	tampered := *signed
+	tampered.Peers = append([]Peer{}, signed.Peers...)
+	tampered.Peers[0].Port++
+	if tampered.signedBy(friend) || signed.signedBy(Peer{net.IPv4(192, 0, 2, 2), 7075, nil}) {
+		t.Errorf("Bad signature accepted")
+	}
+	clock.Advance(maxAdvertisementAge + time.Second)
+	if signed.signedBy(friend) {
+		t.Errorf("Stale signature accepted")
+	}
+	tampered.HandleFrom(friend)
+	if len(PeerList) != unsignedLimit() {
+		t.Errorf("Unsigned peers beyond the cap: %v", PeerList)
+	}
+
+	// Signed peers fill the list, then take the place of unsigned ones
+	before := GetPeerFilterCounters().Evicted
+	for len(PeerList) < MaxPeers {
+		keepAlive = CreateKeepAlive(advertised("192.0.2", numberOfPeersToShare))
+		keepAlive.Sign(NodeKey)
+		keepAlive.HandleFrom(friend)
+	}
+	evicted := int(GetPeerFilterCounters().Evicted - before)
+	if evicted == 0 || len(learnedPeers.unsigned) != unsignedLimit()-evicted {
+		t.Errorf("Expected unsigned peers evicted, got %d leaving %v", evicted, learnedPeers.unsigned)
+	}
+	if len(PeerList) != MaxPeers || len(PeerSet) != MaxPeers {
+		t.Errorf("Peer list out of step: %d listed, %d in set", len(PeerList), len(PeerSet))
+	}
+
+	// Re-advertising an unsigned peer with a signature keeps it
+	keepAlive = CreateKeepAlive([]Peer{PeerList[0]})
+	keepAlive.Sign(NodeKey)
+	keepAlive.HandleFrom(friend)
+	if len(learnedPeers.unsigned) != unsignedLimit()-evicted-1 || !learnedPeers.signed[PeerList[0].String()] {
+		t.Errorf("Peer not upgraded to signed: %v", learnedPeers.unsigned)
+	}
+}
+
+// Serves one canned response per connection, in order, recording the
+// requests. Connections are left open after the response if hang is set.
+func replayBootstrap(t *testing.T, hang bool, responses ...[]byte) (Peer, chan Message, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := make(chan Message, len(responses))
+	var lock sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for _, response := range responses {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			conns = append(conns, conn)
+			lock.Unlock()
+			packet := make([]byte, headerSize+bulkPullSize)
+			io.ReadFull(conn, packet[:headerSize])
+			if packet[5] == protocol.MessageFrontierReq {
+				packet = packet[:headerSize+frontierReqSize]
+			}
+			io.ReadFull(conn, packet[headerSize:])
+			m, _ := ReadMessage(bytes.NewBuffer(packet))
+			requests <- m
+			conn.Write(response)
+			if !hang {
+				conn.Close()
+			}
+		}
+	}()
+	port, _ := strconv.Atoi(strings.Split(ln.Addr().String(), ":")[1])
+	return Peer{net.ParseIP("127.0.0.1"), uint16(port), nil}, requests, func() {
+		ln.Close()
+		lock.Lock()
+		defer lock.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+}
+
+func TestBootstrapClient(t *testing.T) {
+	var frontierStream []byte
+	for i := byte(1); i <= 3; i++ {
+		frontierStream = append(frontierStream, bytes.Repeat([]byte{i}, frontierSize)...)
+	}
+	var blockStream []byte
+	for _, packet := range [][]byte{publishSend, publishChange} {
+		blockStream = append(append(blockStream, packet[7]), packet[headerSize:]...)
+	}
+	terminated := append(append([]byte{}, blockStream...), protocol.BlockTypeNotABlock)
+	unknown := append(append([]byte{}, blockStream...), 9)
+
+	peer, requests, stop := replayBootstrap(t, false,
+		append(append([]byte{}, frontierStream...), make([]byte, frontierSize)...),
+		terminated,
+		frontierStream,
+		blockStream[:len(blockStream)-20],
+		unknown,
+	)
+	defer stop()
+	client := NewBootstrapClient(peer)
+	account := blocks.TestGenesisBlock.Account
+	ctx := context.Background()
+
+	frontiers, err := client.Frontiers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []store.Frontier
+	for f := range frontiers {
+		got = append(got, f)
+	}
+	if len(got) != 3 || got[2].Hash != types.BlockHashFromBytes(bytes.Repeat([]byte{3}, 32)) || client.Err() != nil {
+		t.Errorf("Expected 3 frontiers, got %v: %v", got, client.Err())
+	}
+	if req := (<-requests).(*MessageFrontierReq); req.Count != AllFrontiers || req.Start != [32]byte{} {
+		t.Errorf("Unexpected frontier_req %+v", req)
+	}
+
+	end := blocks.TestGenesisBlock.Hash()
+	pulled, err := client.BulkPull(ctx, account, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chain []blocks.Block
+	for block := range pulled {
+		chain = append(chain, block)
+	}
+	if len(chain) != 2 || chain[0].Type() != blocks.Send || chain[1].Type() != blocks.Change || client.Err() != nil {
+		t.Errorf("Expected a send and a change, got %v: %v", chain, client.Err())
+	}
+	pub, _ := address.AddressToPub(account)
+	if req := (<-requests).(*MessageBulkPull); !bytes.Equal(req.Start[:], pub) || types.BlockHashFromBytes(req.End[:]) != end {
+		t.Errorf("Unexpected bulk_pull %+v", req)
+	}
+
+	// Streams that end early or carry an unknown block type are errors
+	frontiers, _ = client.Frontiers(ctx)
+	for range frontiers {
+	}
+	if client.Err() != io.ErrUnexpectedEOF {
+		t.Errorf("Expected an unterminated frontier stream, got %v", client.Err())
+	}
+	for i, expected := range []error{io.ErrUnexpectedEOF, ErrUnknownBlockType} {
+		pulled, _ = client.BulkPull(ctx, account, "")
+		n := 0
+		for range pulled {
+			n++
+		}
+		if n != i+1 || client.Err() != expected {
+			t.Errorf("Expected %v after %d blocks, got %v after %d", expected, i+1, client.Err(), n)
+		}
+	}
+
+	if _, err = client.BulkPull(ctx, "nano_1111", ""); err == nil {
+		t.Errorf("Pulled a bad account")
+	}
+}
+
+func TestBulkPullGuard(t *testing.T) {
+	var blockStream []byte
+	for _, packet := range [][]byte{publishSend, publishChange, publishSend} {
+		blockStream = append(append(blockStream, packet[7]), packet[headerSize:]...)
+	}
+	terminated := append(blockStream, protocol.BlockTypeNotABlock)
+	peer, _, stop := replayBootstrap(t, false, terminated, terminated, terminated)
+	defer stop()
+	client := NewBootstrapClient(peer)
+	account := blocks.TestGenesisBlock.Account
+
+	// The repeated send ends the pull, twice over: the guard forgets the
+	// account once each pull is done
+	for i := 0; i < 2; i++ {
+		pulled, err := client.BulkPull(context.Background(), account, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for range pulled {
+			n++
+		}
+		if n != 2 || client.Err() != store.ErrChainCycle {
+			t.Errorf("Expected a cycle after 2 blocks, got %v after %d", client.Err(), n)
+		}
+	}
+
+	client.Guard = store.NewChainGuard(1)
+	pulled, _ := client.BulkPull(context.Background(), account, "")
+	n := 0
+	for range pulled {
+		n++
+	}
+	if n != 1 || client.Err() != store.ErrChainTooLong {
+		t.Errorf("Expected the chain cut off after 1 block, got %v after %d", client.Err(), n)
+	}
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func TestBootstrapProgress(t *testing.T) {
+	clock := utils.NewFakeClock(time.Now())
+	Clock = clock
+	defer func() { Clock = utils.SystemClock{} }()
+
+	p := new(BootstrapProgress)
+	p.Start()
+	for _, blocks := range []uint64{10, 20, 30, 40} {
+		p.AddFrontier(store.Frontier{Blocks: blocks})
+	}
+	if status := p.Status(); status.Basis != BootstrapByBlocks || status.Blocks != 100 || status.ETA != 0 {
+		t.Errorf("Unexpected status before the frontiers are done %+v", status)
+	}
+	p.FrontiersDone()
+
+	// 10 blocks in the first second, then 30 in the next
+	clock.Advance(time.Second)
+	p.AddBlocks(10)
+	status := p.Status()
+	if status.Progress != 0.1 || status.BlockRate != 10 || status.ETA != 9*time.Second {
+		t.Errorf("Unexpected status after a second %+v", status)
+	}
+	clock.Advance(time.Second)
+	p.AddBlocks(30)
+	p.AccountDone()
+	status = p.Status()
+	// The average moves a fifth of the way to 30
+	if status.Progress != 0.4 || !near(status.BlockRate, 14) || !near(status.ETA.Seconds(), 60.0/14) {
+		t.Errorf("Unexpected status after two seconds %+v", status)
+	}
+	// A stall slows it down, gradually
+	clock.Advance(time.Second)
+	if status = p.Status(); !near(status.BlockRate, 11.2) {
+		t.Errorf("Expected the rate to fall to 11.2, got %v", status.BlockRate)
+	}
+
+	// Without counts for every frontier it's by accounts
+	p.Start()
+	p.AddFrontier(store.Frontier{Blocks: 5})
+	p.AddFrontier(store.Frontier{})
+	p.FrontiersDone()
+	clock.Advance(2 * time.Second)
+	p.AccountDone()
+	p.AddBlocks(7)
+	status = p.Status()
+	if status.Basis != BootstrapByAccounts || status.Progress != 0.5 || status.AccountRate != 0.5 || status.ETA != 2*time.Second {
+		t.Errorf("Unexpected status by accounts %+v", status)
+	}
+}
+
+func TestFrontierCounts(t *testing.T) {
+	// Only asked of peers that understand it, and kept on the wire
+	for version, expected := range map[byte]bool{protocol.VersionUsing: false, protocol.CapabilityFrontierCounts.Version: true} {
+		req := CreateFrontierReq([32]byte{}, AllFrontiers)
+		req.countsFor(version)
+		var buf bytes.Buffer
+		req.Write(&buf)
+		m, err := ReadMessage(&buf)
+		if err != nil || m.(*MessageFrontierReq).Counts() != expected {
+			t.Errorf("Version %d: expected counts %v, got %+v: %v", version, expected, m, err)
+		}
+	}
+
+	ledger := make([]store.Frontier, 3)
+	for i := range ledger {
+		ledger[i] = store.Frontier{Account: address.PubKeyToAddress(bytes.Repeat([]byte{byte(i + 1)}, 32)), Hash: types.BlockHashFromBytes(bytes.Repeat([]byte{byte(i + 1)}, 32))}
+	}
+	defer func(f func(types.Account, int) ([]store.Frontier, types.Account, error)) { frontiers = f }(frontiers)
+	frontiers = func(start types.Account, count int) ([]store.Frontier, types.Account, error) {
+		return ledger, "", nil
+	}
+	defer func(f func(types.BlockHash) (uint64, bool)) { frontierHeight = f }(frontierHeight)
+	frontierHeight = func(hash types.BlockHash) (uint64, bool) {
+		return uint64(hash.ToBytes()[0]) * 100, true
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewTcpListener(ln, ConnLimits{})
+	defer l.Close()
+	go l.Serve(ServeBootstrap)
+	port, _ := strconv.Atoi(strings.Split(ln.Addr().String(), ":")[1])
+	peer := Peer{net.ParseIP("127.0.0.1"), uint16(port), nil}
+	defer peerVersions.forget(peer)
+
+	fetch := func() []store.Frontier {
+		var got []store.Frontier
+		err := FetchFrontiers(context.Background(), peer, 10, func(f store.Frontier) error {
+			got = append(got, f)
+			return nil
+		})
+		if err != nil || len(got) != len(ledger) {
+			t.Fatalf("Expected %d frontiers, got %v: %v", len(ledger), got, err)
+		}
+		return got
+	}
+	for _, f := range fetch() {
+		if f.Blocks != 0 {
+			t.Errorf("Counts sent to a peer that didn't ask: %+v", f)
+		}
+	}
+
+	peerVersions.heard(peer, protocol.CapabilityFrontierCounts.Version)
+	for i, f := range fetch() {
+		if f.Account != ledger[i].Account || f.Hash != ledger[i].Hash || f.Blocks != uint64(i+1)*100 {
+			t.Errorf("Frontier %d is %+v", i, f)
+		}
+	}
+
+	// The client's progress is by blocks
+	client := NewBootstrapClient(peer)
+	client.Progress = new(BootstrapProgress)
+	received, err := client.Frontiers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range received {
+	}
+	if status := client.Progress.Status(); status.Basis != BootstrapByBlocks || status.Blocks != 600 || !status.FrontiersDone || client.Err() != nil {
+		t.Errorf("Unexpected progress %+v: %v", status, client.Err())
+	}
+}
+
+func TestFrontierAge(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	start := time.Unix(1600000000, 0)
+	clock := utils.NewFakeClock(start)
+	Clock = clock
+	defer func() { Clock = utils.SystemClock{} }()
+
+	// Two accounts untouched for two hours, one changed half an hour ago
+	ledger := make([]store.Frontier, 3)
+	modified := make(map[types.BlockHash]time.Time)
+	for i := range ledger {
+		ledger[i] = store.Frontier{Account: address.PubKeyToAddress(bytes.Repeat([]byte{byte(i + 1)}, 32)), Hash: types.BlockHashFromBytes(bytes.Repeat([]byte{byte(i + 1)}, 32))}
+		modified[ledger[i].Hash] = start.Add(-2 * time.Hour)
+	}
+	modified[ledger[2].Hash] = start.Add(-30 * time.Minute)
+	defer func(f func(types.Account, int) ([]store.Frontier, types.Account, error)) { frontiers = f }(frontiers)
+	frontiers = func(start types.Account, count int) ([]store.Frontier, types.Account, error) {
+		return ledger, "", nil
+	}
+	defer func(f func(types.BlockHash) (time.Time, bool)) { frontierModified = f }(frontierModified)
+	frontierModified = func(hash types.BlockHash) (time.Time, bool) {
+		t, ok := modified[hash]
+		return t, ok
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewTcpListener(ln, ConnLimits{})
+	defer l.Close()
+	go l.Serve(ServeBootstrap)
+	port, _ := strconv.Atoi(strings.Split(ln.Addr().String(), ":")[1])
+	peer := Peer{net.ParseIP("127.0.0.1"), uint16(port), nil}
+
+	page, err := requestFrontiers(context.Background(), peer, [32]byte{}, AllFrontiers, 3600)
+	if err != nil || len(page) != 1 || page[0].frontier().Hash != ledger[2].Hash {
+		t.Fatalf("Expected only the account changed within the hour, got %v: %v", page, err)
+	}
+
+	fs := NewFrontierSync(peer)
+	run := func(expectIncremental bool) []store.Frontier {
+		var got []store.Frontier
+		incremental, err := fs.Run(context.Background(), func(f store.Frontier) error {
+			got = append(got, f)
+			return nil
+		})
+		if err != nil || incremental != expectIncremental {
+			t.Fatalf("Expected incremental %v, got %v: %v", expectIncremental, incremental, err)
+		}
+		return got
+	}
+	if got := run(false); len(got) != len(ledger) {
+		t.Errorf("First sync should list every account, got %v", got)
+	}
+
+	// The peer moves on an account we listed, which the next sync only
+	// asks about changes since the last for
+	clock.Advance(30 * time.Minute)
+	ledger[1].Hash = types.BlockHashFromBytes(bytes.Repeat([]byte{0x42}, 32))
+	modified[ledger[1].Hash] = clock.Now()
+	clock.Advance(30 * time.Minute)
+	got := run(true)
+	if len(got) != 1 || got[0].Account != ledger[1].Account || got[0].Hash != ledger[1].Hash {
+		t.Errorf("Expected only the diverged account, got %v", got)
+	}
+
+	// Too long since the last to trust a window
+	clock.Advance(DefaultFrontierSyncMaxAge)
+	if got := run(false); len(got) != len(ledger) {
+		t.Errorf("Expected a full sync after a long gap, got %v", got)
+	}
+}
+
+func TestRankPeers(t *testing.T) {
+	var peers []Peer
+	for i := 1; i <= 5; i++ {
+		peers = append(peers, Peer{net.IPv4(10, 0, 0, byte(i)), 7075, nil})
+	}
+	accounts := make([]types.Account, 10000)
+	for i := range accounts {
+		pub := make([]byte, 32)
+		binary.BigEndian.PutUint64(pub, uint64(i))
+		accounts[i] = address.PubKeyToAddress(pub)
+	}
+	even := func(Peer) float64 { return 1 }
+	assign := func(peers []Peer, weight func(Peer) float64) (map[types.Account]string, map[string]int) {
+		first, shares := make(map[types.Account]string), make(map[string]int)
+		for _, account := range accounts {
+			peer := RankPeers(account, peers, weight)[0]
+			first[account] = peer.String()
+			shares[peer.String()]++
+		}
+		return first, shares
+	}
+
+	// Within 5% of an even share each
+	first, shares := assign(peers, even)
+	for _, peer := range peers {
+		if n := shares[peer.String()]; n < 1900 || n > 2100 {
+			t.Errorf("%s first for %d of 10000 accounts", peer.String(), n)
+		}
+	}
+
+	// Losing a peer only moves its own accounts
+	moved, _ := assign(peers[1:], even)
+	for _, account := range accounts {
+		if first[account] != peers[0].String() && moved[account] != first[account] {
+			t.Fatalf("%s moved from %s to %s", account, first[account], moved[account])
+		}
+	}
+
+	// Weights scale the shares, and the default weighs by misbehavior
+	_, shares = assign(peers[:2], func(peer Peer) float64 {
+		if peer.IP.Equal(peers[0].IP) {
+			return 3
+		}
+		return 1
+	})
+	if n := shares[peers[0].String()]; n < 7250 || n > 7750 {
+		t.Errorf("Peer weighted 3 to 1 first for %d of 10000", n)
+	}
+	misbehaved(peers[1])
+	misbehaved(peers[1])
+	defer func() {
+		misbehavior.Lock()
+		delete(misbehavior.scores, peers[1].IP.String())
+		misbehavior.Unlock()
+	}()
+	if _, shares = assign(peers[:2], nil); shares[peers[1].String()] > 3000 {
+		t.Errorf("Misbehaving peer first for %d of 10000", shares[peers[1].String()])
+	}
+}
+
+func TestBootstrapPool(t *testing.T) {
+	defer func(retry utils.RetryPolicy) { BootstrapRetry = retry }(BootstrapRetry)
+	BootstrapRetry.MaxAttempts = 1
+
+	chain := append(append([]byte{publishSend[7]}, publishSend[headerSize:]...), protocol.BlockTypeNotABlock)
+	live, _, stop := replayBootstrap(t, false, chain)
+	defer stop()
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	port, _ := strconv.Atoi(strings.Split(ln.Addr().String(), ":")[1])
+	ln.Close()
+	dead := Peer{net.ParseIP("127.0.0.1"), uint16(port), nil}
+
+	// An account the dead peer ranks first for is retried on the next
+	pool := NewBootstrapPool([]Peer{dead, live})
+	pool.Weight = func(Peer) float64 { return 1 }
+	pool.Progress = new(BootstrapProgress)
+	var account types.Account
+	for i := byte(1); account == ""; i++ {
+		a := address.PubKeyToAddress(bytes.Repeat([]byte{i}, 32))
+		if RankPeers(a, pool.Peers, pool.Weight)[0].String() == dead.String() {
+			account = a
+		}
+	}
+	pulled, err := pool.Pull(context.Background(), account, "")
+	if err != nil || len(pulled) != 1 || pulled[0].Type() != blocks.Send {
+		t.Errorf("Expected the send from the live peer, got %v: %v", pulled, err)
+	}
+	if pool.Progress.Status().Pulled != 1 {
+		t.Errorf("Pull not counted")
+	}
+	stop()
+	if _, err = pool.Pull(context.Background(), account, ""); err == nil {
+		t.Errorf("Pulled with no peer left to serve it")
+	}
+
+	err = NewBootstrapPool(nil).PullAll(context.Background(), []types.Account{account}, func(types.Account, []blocks.Block) error { return nil })
+	if err != ErrNoBootstrapPeers {
+		t.Errorf("Expected no peers, got %v", err)
+	}
+
+	// A peer at its cap is passed over, and waited on when all are
+	pool.PerPeer = 1
+	ranking := []Peer{dead, live}
+	first, _, _ := pool.acquire(context.Background(), ranking, map[string]bool{})
+	second, _, _ := pool.acquire(context.Background(), ranking, map[string]bool{})
+	if first.String() != dead.String() || second.String() != live.String() {
+		t.Errorf("Expected both peers in rank order, got %s and %s", first.String(), second.String())
+	}
+	acquired := make(chan Peer)
+	go func() {
+		peer, _, _ := pool.acquire(context.Background(), ranking, map[string]bool{})
+		acquired <- peer
+	}()
+	select {
+	case <-acquired:
+		t.Fatalf("Acquired a pull past the cap")
+	case <-time.After(20 * time.Millisecond):
+	}
+	pool.release(second)
+	if peer := <-acquired; peer.String() != live.String() {
+		t.Errorf("Expected the freed peer, got %s", peer.String())
+	}
+}
+
+// Serves each account's chain from chains, keyed by its public key, to
+// bulk_pulls on as many connections at once as are made.
+func serveChains(t *testing.T, chains map[[32]byte][]byte) (Peer, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				packet := make([]byte, headerSize+bulkPullSize)
+				if _, err := io.ReadFull(conn, packet); err != nil {
+					return
+				}
+				m, _ := ReadMessage(bytes.NewBuffer(packet))
+				if pull, ok := m.(*MessageBulkPull); ok {
+					conn.Write(append(chains[pull.Start], protocol.BlockTypeNotABlock))
+				}
+			}()
+		}
+	}()
+	port, _ := strconv.Atoi(strings.Split(ln.Addr().String(), ":")[1])
+	return Peer{net.ParseIP("127.0.0.1"), uint16(port), nil}, func() { ln.Close() }
+}
+
+// Legacy chains, in the reference node's JSON with work for the live
+// threshold, pulled in parallel from two peers and stored as they arrive,
+// in whatever order that is.
+func TestBootstrapLegacyChains(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	defer func() { blocks.WorkThreshold = protocol.WorkLiveThreshold }()
+	blocks.WorkThreshold = protocol.WorkLiveThreshold
+
+	fixture, err := ioutil.ReadFile("testdata/legacy_chains.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []struct {
+		Hash         types.BlockHash `json:"hash"`
+		BlockAccount types.Account   `json:"block_account"`
+		Amount       string          `json:"amount"`
+		Balance      string          `json:"balance"`
+		Contents     json.RawMessage `json:"contents"`
+	}
+	if err = json.Unmarshal(fixture, &expected); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bulk pulls send chains newest first
+	chains := make(map[[32]byte][]byte)
+	var accounts []types.Account
+	for _, e := range expected {
+		block, err := blocks.ParseJson(e.Contents)
+		if err != nil || block.Hash() != e.Hash {
+			t.Fatalf("Parsing %s gave %v: %v", e.Hash, block, err)
+		}
+		m, err := FromBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		buf.WriteByte(m.Type)
+		m.Write(&buf)
+		var key [32]byte
+		pub, _ := address.AddressToPub(e.BlockAccount)
+		copy(key[:], pub)
+		if chains[key] == nil {
+			accounts = append(accounts, e.BlockAccount)
+		}
+		chains[key] = append(buf.Bytes(), chains[key]...)
+	}
+	first, stop := serveChains(t, chains)
+	defer stop()
+	second, stop := serveChains(t, chains)
+	defer stop()
+
+	pool := NewBootstrapPool([]Peer{first, second})
+	pool.Progress = new(BootstrapProgress)
+	err = pool.PullAll(context.Background(), accounts, func(account types.Account, chain []blocks.Block) error {
+		for i := len(chain) - 1; i >= 0; i-- {
+			if store.FetchBlock(chain[i].Hash()) != nil {
+				continue
+			}
+			switch err := store.StoreBlock(chain[i]); err {
+			case nil, store.ErrMissingParent, store.ErrMissingSource:
+			default:
+				return fmt.Errorf("Storing %s: %s", chain[i].Hash(), err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pulled := pool.Progress.Status().Pulled; pulled != uint64(len(expected)) {
+		t.Errorf("Expected %d blocks pulled, got %d", len(expected), pulled)
+	}
+
+	if errs := store.Verify(store.VerifyOptions{}); len(errs) != 0 {
+		t.Errorf("Ledger failed verification: %v", errs)
+	}
+	for _, e := range expected {
+		block := store.FetchBlock(e.Hash)
+		if block == nil {
+			t.Errorf("Block %s not stored", e.Hash)
+			continue
+		}
+		explained := blocks.Explain(block, store.ExplainSource())
+		if explained.Balance != e.Balance || (explained.Amount != e.Amount && block.Type() != blocks.Change) {
+			t.Errorf("Expected %s to leave %s after %s, got %s after %s", e.Hash, e.Balance, e.Amount, explained.Balance, explained.Amount)
+		}
+	}
+}
+
+func TestBootstrapClientTimeout(t *testing.T) {
+	// Cut off mid-block, without closing the connection
+	peer, _, stop := replayBootstrap(t, true, append([]byte{protocol.BlockTypeSend}, publishSend[headerSize:50]...))
+	defer stop()
+	client := NewBootstrapClient(peer)
+	client.Timeout = 50 * time.Millisecond
+
+	pulled, err := client.BulkPull(context.Background(), blocks.TestGenesisBlock.Account, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range pulled {
+	}
+	if err, ok := client.Err().(net.Error); !ok || !err.Timeout() {
+		t.Errorf("Expected a timeout, got %v", client.Err())
+	}
+}
+
+func TestEventFeed(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = protocol.WorkLiveThreshold }()
+
+	feed := NewEventFeed()
+	sub := feed.Subscribe(1)
+	feed.Publish(Event{Type: EventVote})
+	feed.Publish(Event{Type: EventFork})
+	if e := <-sub.C; e.Type != EventVote || e.Time == 0 {
+		t.Errorf("Wrong event %+v", e)
+	}
+	if feed.Dropped() != 1 {
+		t.Errorf("Event past the buffer not dropped")
+	}
+	sub.Close()
+	feed.Publish(Event{Type: EventVote})
+	if len(sub.C) != 0 {
+		t.Errorf("Event sent after closing")
+	}
+
+	w := wallet.New(blocks.TestPrivateKey)
+	w.GeneratePowSync()
+	send, _ := w.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 7))
+	store.StoreBlock(send)
+	sub = Events.Subscribe(1)
+	defer sub.Close()
+	before := SummaryEvent().Confirmations
+	publishConfirmation(send.Hash())
+	if e := <-sub.C; e.Type != EventConfirmation || e.Account != blocks.TestGenesisBlock.Account || e.Amount != "7" {
+		t.Errorf("Wrong confirmation %+v", e)
+	}
+	if SummaryEvent().Confirmations != before+1 {
+		t.Errorf("Confirmation not counted")
+	}
+}
+
+func TestMaintenanceScheduler(t *testing.T) {
+	clock := utils.NewFakeClock(time.Unix(1500000000, 0))
+	Clock = clock
+	defer func() { Clock = utils.SystemClock{} }()
+	s := NewMaintenanceScheduler()
+	s.Backoff, s.SliceGap = time.Millisecond, 0
+
+	// The foreground load spikes partway through a run
+	var lock sync.Mutex
+	spike, queued := 0, 0
+	s.Load = func() (int, time.Duration) {
+		lock.Lock()
+		defer lock.Unlock()
+		queued = 0
+		if spike > 0 {
+			spike--
+			queued = s.MaxQueueDepth + 1
+		}
+		return queued, 0
+	}
+	slices, busySlices := 0, 0
+	s.Register(MaintenanceJob{Name: "sweep", Every: time.Minute, Slice: func() (bool, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if queued > 0 {
+			busySlices++
+		}
+		slices++
+		if slices == 2 {
+			spike = 3
+		}
+		return slices%5 == 0, nil
+	}})
+
+	s.startDue(clock.Now())
+	s.wait()
+	status := s.Status()[0]
+	if slices != 5 || busySlices != 0 || status.Slices != 5 || status.Backoffs != 3 || status.Runs != 1 || status.Status != JobIdle {
+		t.Errorf("Expected five slices around three backoffs, got %d %d %+v", slices, busySlices, status)
+	}
+
+	// Periodic
+	s.startDue(clock.Now())
+	s.wait()
+	if slices != 5 {
+		t.Errorf("Ran again before it was due")
+	}
+	clock.Advance(time.Minute)
+	s.startDue(clock.Now())
+	s.wait()
+	if slices != 10 || !s.Status()[0].LastRun.Equal(clock.Now()) {
+		t.Errorf("Didn't run when due, %d slices", slices)
+	}
+
+	if s.Trigger("nonsense") != ErrUnknownJob {
+		t.Errorf("Expected unknown job")
+	}
+	s.Register(MaintenanceJob{Name: "broken", Slice: func() (bool, error) { return false, errors.New("Disk full") }})
+	s.Trigger("broken")
+	s.wait()
+	if status := s.Status()[0]; status.Name != "broken" || status.Status != JobFailed || status.LastError != "Disk full" {
+		t.Errorf("Expected a failed run, got %+v", status)
+	}
+}
+
+// Compaction and backup share a group, so never overlap.
+func TestMaintenanceGroups(t *testing.T) {
+	s := NewMaintenanceScheduler()
+	s.SliceGap = 0
+	s.Load = func() (int, time.Duration) { return 0, 0 }
+
+	var running, overlaps int32
+	release := make(chan bool)
+	slice := func() (bool, error) {
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		<-release
+		atomic.AddInt32(&running, -1)
+		return true, nil
+	}
+	s.Register(MaintenanceJob{Name: "backup", Group: "disk", Slice: slice})
+	s.Register(MaintenanceJob{Name: "compact", Group: "disk", Slice: slice})
+
+	s.Trigger("compact")
+	s.Trigger("backup")
+	if status := s.Status()[0]; status.Status != JobWaiting {
+		t.Errorf("Backup should wait for compaction, got %s", status.Status)
+	}
+	release <- true
+	release <- true
+	s.wait()
+	for _, status := range s.Status() {
+		if status.Runs != 1 || status.Status != JobIdle {
+			t.Errorf("Expected one run each, got %+v", status)
+		}
+	}
+	if overlaps != 0 {
+		t.Errorf("Grouped jobs overlapped")
+	}
+}
+
+func TestDiskMonitor(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	defer store.SetWritable()
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = protocol.WorkLiveThreshold }()
+
+	free := map[string]uint64{"store": 200, "wallet": 200}
+	m := &DiskMonitor{Paths: []string{"store", "wallet"}, Soft: 100, Hard: 50}
+	m.Probe = func(path string) (uint64, uint64, error) { return free[path], 1000, nil }
+	sub := Events.Subscribe(10)
+	defer sub.Close()
+	next := func(kind string) Event {
+		select {
+		case e := <-sub.C:
+			if e.Type != kind {
+				t.Fatalf("Expected a %s event, got %+v", kind, e)
+			}
+			return e
+		default:
+			t.Fatalf("No %s event", kind)
+		}
+		return Event{}
+	}
+
+	m.Check()
+	if len(sub.C) > 0 || store.ReadOnly() || len(m.Usage()) != 2 || m.Usage()[1].Free != 200 {
+		t.Fatalf("Unexpected state with space to spare: %v", m.Usage())
+	}
+
+	// Warned once per drop below the soft limit
+	free["wallet"] = 80
+	m.Check()
+	m.Check()
+	if e := next(EventDiskLow); e.Path != "wallet" || e.Free != 80 {
+		t.Errorf("Unexpected warning %+v", e)
+	}
+	if len(sub.C) > 0 || store.ReadOnly() {
+		t.Errorf("Read only above the hard limit")
+	}
+
+	w := wallet.New(blocks.TestPrivateKey)
+	w.GeneratePowSync()
+	send, _ := w.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 1))
+	free["store"] = 40
+	m.Check()
+	next(EventDiskLow)
+	if e := next(EventReadOnly); e.Path != "store" || e.Free != 40 {
+		t.Errorf("Unexpected read only event %+v", e)
+	}
+	if mode := store.Mode(); mode.Mode != store.LedgerReadOnly || !strings.Contains(mode.Reason, "store") {
+		t.Errorf("Unexpected mode %+v", mode)
+	}
+	if err := store.StoreBlock(send); err != store.ErrDiskFull {
+		t.Errorf("Expected ErrDiskFull storing a block, got %v", err)
+	}
+	if _, err := w.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 1)); err != wallet.ErrLedgerReadOnly {
+		t.Errorf("Wallet built a block while read only: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	pool := NewBootstrapPool([]Peer{{net.ParseIP("127.0.0.1"), 1, nil}})
+	if _, err := pool.Pull(ctx, blocks.TestGenesisBlock.Account, ""); err != context.DeadlineExceeded {
+		t.Errorf("Bootstrap didn't pause while read only: %v", err)
+	}
+
+	// Only writable again once clear of the soft limit
+	free["store"] = 90
+	m.Check()
+	if !store.ReadOnly() || len(sub.C) > 0 {
+		t.Errorf("Writable again under the soft limit")
+	}
+	free["store"], free["wallet"] = 150, 150
+	m.Check()
+	next(EventWritable)
+	if store.ReadOnly() {
+		t.Fatalf("Still read only with space recovered")
+	}
+	select {
+	case <-store.Writable():
+	default:
+		t.Errorf("Writable channel still open")
+	}
+	if err := store.StoreBlock(send); err != nil {
+		t.Errorf("Failed to store after recovering: %v", err)
+	}
+}
+
+func TestSafeMode(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = LiveNetwork.WorkThreshold }()
+	os.RemoveAll(store.TestConfig.Path)
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	defer func() { PeerList, PeerSet = nil, map[string]bool{} }()
+	received := 0
+	OnBlock("safe", func(b blocks.Block) { received++ })
+	defer RemoveBlockHandler("safe")
+	exited := 0
+	defer func() { OnSafeModeExit = nil }()
+	OnSafeModeExit = func() { exited++ }
+
+	EnterSafeMode(SafeModeReport{Crashes: 3, StoreErr: "corrupt"})
+	defer ExitSafeMode()
+	if active, report := SafeModeStatus(); !active || report.Crashes != 3 || report.Since.IsZero() {
+		t.Fatalf("Unexpected safe mode status %v %+v", active, report)
+	}
+
+	w := wallet.New(blocks.TestPrivateKey)
+	w.GeneratePowSync()
+	send, err := w.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish := func() {
+		m, _ := CreatePublish(send)
+		var buf bytes.Buffer
+		m.Write(&buf)
+		handleMessage(&buf)
+	}
+	before := GetMessageStats()
+	publish()
+	if received != 0 {
+		t.Errorf("Published block handled in safe mode")
+	}
+	after := GetMessageStats()
+	if after.Dropped[DropSafeMode]-before.Dropped[DropSafeMode] != 1 || after.Messages["publish"] != before.Messages["publish"] {
+		t.Errorf("Safe mode drop counted wrong: %v %v", after.Dropped, after.Messages)
+	}
+
+	// Keepalives still go through
+	var buf bytes.Buffer
+	keepAlive := MessageKeepAlive{Peers: []Peer{{net.ParseIP("10.1.2.3"), 7075, nil}}}
+	keepAlive.Write(&buf)
+	handleMessageFrom(&buf, Peer{net.ParseIP("192.168.1.2"), 7075, nil})
+	if len(PeerList) != 1 {
+		t.Errorf("Keepalive not handled in safe mode: %v", PeerList)
+	}
+
+	client := NewBootstrapClient(Peer{net.ParseIP("127.0.0.1"), 7075, nil})
+	if _, err := client.Frontiers(context.Background()); err != ErrSafeMode {
+		t.Errorf("Expected to refuse to bootstrap, got %v", err)
+	}
+
+	ExitSafeMode()
+	ExitSafeMode()
+	if InSafeMode() || exited != 1 {
+		t.Fatalf("Safe mode not left once, exit hook called %d times", exited)
+	}
+	publish()
+	if received != 1 {
+		t.Errorf("Published block not handled after safe mode")
+	}
+}
+
+func TestSyncMonitor(t *testing.T) {
+	local := store.LedgerCounts{Blocks: 1000, Cemented: 900, Accounts: 100}
+	m := &SyncMonitor{BehindBlocks: 50, BehindCemented: 50, MinPeers: 3, Local: func() store.LedgerCounts { return local }}
+	sub := Events.Subscribe(10)
+	defer sub.Close()
+	next := func(status string) {
+		select {
+		case e := <-sub.C:
+			if e.Type != EventSyncStatus || e.Status != status {
+				t.Fatalf("Expected a %s sync event, got %+v", status, e)
+			}
+		default:
+			t.Fatalf("No %s sync event", status)
+		}
+	}
+	var peers []Peer
+	for i := 1; i <= 4; i++ {
+		peer := Peer{net.IPv4(203, 0, 113, byte(i)), 7075, nil}
+		peers = append(peers, peer)
+		MarkVerified(peer, NodeID)
+	}
+	report := func(blocks uint64, cemented uint64) {
+		for i, peer := range peers[:3] {
+			// Honest peers differ a little
+			c := store.LedgerCounts{Blocks: blocks + uint64(i), Cemented: cemented + uint64(i), Accounts: 100}
+			if !m.Report(peer, c) {
+				t.Fatalf("Report from verified peer %s refused", peer.String())
+			}
+		}
+	}
+
+	// Unverified peers aren't counted, and too few peers can't tell
+	if m.Report(Peer{net.ParseIP("198.51.100.1"), 7075, nil}, local) {
+		t.Errorf("Report from an unverified peer taken")
+	}
+	m.Check()
+	if s := m.Status(); s.Status != SyncUnknown || len(sub.C) > 0 {
+		t.Fatalf("Expected unknown status without reports, got %+v", s)
+	}
+
+	report(1010, 905)
+	m.Check()
+	next(SyncSynced)
+	if s := m.Status(); s.Peers != 3 || s.Network.Blocks != 1011 || s.Since.IsZero() {
+		t.Errorf("Unexpected status %+v", s)
+	}
+
+	// One peer claiming a far larger ledger is left out
+	m.Report(peers[3], store.LedgerCounts{Blocks: 1000000, Cemented: 1000000, Accounts: 100})
+	m.Check()
+	if s := m.Status(); s.Status != SyncSynced || s.Outliers != 1 || s.Peers != 3 || len(sub.C) > 0 {
+		t.Fatalf("Lying peer changed the status: %+v", s)
+	}
+
+	// Falling behind weighs peers ahead up for bootstrapping
+	report(2000, 1900)
+	m.Check()
+	next(SyncBehind)
+	defer func(sync *SyncMonitor) { Sync = sync }(Sync)
+	Sync = m
+	if !m.Ahead(peers[0]) || m.Ahead(peers[3]) || bootstrapWeight(peers[0]) != syncAheadWeight*bootstrapWeight(peers[3]) {
+		t.Errorf("Peers ahead not weighed up for bootstrapping")
+	}
+
+	// More blocks than the network is fine while confirming, but not once
+	// confirmations stall
+	local = store.LedgerCounts{Blocks: 3000, Cemented: 1900, Accounts: 100}
+	m.Check()
+	next(SyncSynced)
+	m.Check()
+	next(SyncDiverged)
+	if s := m.Status(); s.Advice == "" || m.Ahead(peers[0]) {
+		t.Errorf("Unexpected diverged status %+v", s)
+	}
+	local.Cemented += 100
+	m.Check()
+	next(SyncSynced)
+}
+
+func TestPeerSubnets(t *testing.T) {
+	if Subnet(net.ParseIP("203.0.113.77")) != "203.0.113.0/24" || Subnet(net.ParseIP("2001:db8:1:2::7")) != "2001:db8:1::/48" {
+		t.Fatalf("Wrong subnets %s %s", Subnet(net.ParseIP("203.0.113.77")), Subnet(net.ParseIP("2001:db8:1:2::7")))
+	}
+	defer func(peers []Peer, set map[string]bool, max int, perSubnet int) {
+		PeerList, PeerSet, MaxPeers, MaxPeersPerSubnet = peers, set, max, perSubnet
+	}(PeerList, PeerSet, MaxPeers, MaxPeersPerSubnet)
+	defer func() { peerFilters = newPeerFilter() }()
+
+	random := rand.New(rand.NewSource(1))
+	for round := 0; round < 20; round++ {
+		PeerList, PeerSet = nil, map[string]bool{}
+		MaxPeers, MaxPeersPerSubnet = 50+random.Intn(100), 1+random.Intn(6)
+		before := GetPeerFilterCounters()
+
+		// Most candidates come from a handful of ranges, the rest from
+		// anywhere, IPv4 and IPv6
+		var candidates []Peer
+		subnets := make(map[string]int)
+		for i := 0; i < 1000; i++ {
+			var ip net.IP
+			switch random.Intn(4) {
+			case 0, 1:
+				ip = net.IPv4(203, 0, byte(random.Intn(3)), byte(random.Intn(256)))
+			case 2:
+				ip = net.IPv4(byte(1+random.Intn(100)), byte(random.Intn(256)), byte(random.Intn(256)), byte(random.Intn(256)))
+			default:
+				ip = make(net.IP, 16)
+				ip[0], ip[1], ip[5], ip[15] = 0x20, 0x01, byte(random.Intn(50)), byte(random.Intn(256))
+			}
+			peer := Peer{ip, 7075, nil}
+			if !PeerSet[peer.String()] {
+				PeerSet[peer.String()] = true
+				candidates = append(candidates, peer)
+				subnets[Subnet(ip)]++
+			}
+		}
+		PeerSet = map[string]bool{}
+		capacity := 0
+		for _, n := range subnets {
+			if n > MaxPeersPerSubnet {
+				n = MaxPeersPerSubnet
+			}
+			capacity += n
+		}
+		if capacity > MaxPeers {
+			capacity = MaxPeers
+		}
+
+		for i := 0; i < len(candidates); i += numberOfPeersToShare {
+			end := i + numberOfPeersToShare
+			if end > len(candidates) {
+				end = len(candidates)
+			}
+			(&MessageKeepAlive{Peers: candidates[i:end]}).Handle()
+		}
+		for subnet, n := range PeersBySubnet() {
+			if n > MaxPeersPerSubnet {
+				t.Fatalf("Round %d: %d peers from %s, over the limit of %d", round, n, subnet, MaxPeersPerSubnet)
+			}
+		}
+		if len(PeerList) != capacity {
+			t.Fatalf("Round %d: %d peers, expected the list filled to %d", round, len(PeerList), capacity)
+		}
+		if GetPeerFilterCounters().SameSubnet == before.SameSubnet {
+			t.Errorf("Round %d: same subnet rejections not counted", round)
+		}
+
+		// Shared peers cover as many subnets as they can
+		n := 1 + random.Intn(2*numberOfPeersToShare)
+		covered := make(map[string]bool)
+		for _, peer := range RandomPeers(n) {
+			covered[Subnet(peer.IP)] = true
+		}
+		want := len(PeersBySubnet())
+		if want > n {
+			want = n
+		}
+		if len(covered) != want {
+			t.Errorf("Round %d: %d random peers cover %d subnets, expected %d", round, n, len(covered), want)
+		}
+	}
+
+	// Local peers aren't limited
+	PeerList, PeerSet, MaxPeers, MaxPeersPerSubnet = nil, map[string]bool{}, 100, 2
+	for i := 1; i <= 5; i++ {
+		(&MessageKeepAlive{Peers: []Peer{{net.IPv4(192, 168, 1, byte(i)), 7075, nil}}}).Handle()
+	}
+	if len(PeerList) != 5 {
+		t.Errorf("Local peers limited by subnet: %v", PeerList)
+	}
+
+	// When full, an unsigned peer from the most crowded subnet goes first
+	PeerList = []Peer{{net.ParseIP("198.51.100.1"), 7075, nil}, {net.ParseIP("203.0.113.1"), 7075, nil}, {net.ParseIP("203.0.113.2"), 7075, nil}}
+	if evicted := mostCrowded([]string{"198.51.100.1:7075", "203.0.113.2:7075", "203.0.113.1:7075"}); evicted != "203.0.113.2:7075" {
+		t.Errorf("Evicted %s rather than the oldest of the most crowded subnet", evicted)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	h := NewHealthRegistry()
+	h.FailAfter, h.PassAfter = 2, 3
+	var storeErr, extraErr error
+	h.Register(HealthStore, func() error { return storeErr })
+	h.Register("extra", func() error { return extraErr })
+	h.SetRequired([]string{HealthStore})
+
+	type readiness struct {
+		Ready  bool
+		Checks []HealthStatus
+	}
+	probe := func(path string) (int, readiness) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		var r readiness
+		json.Unmarshal(rec.Body.Bytes(), &r)
+		return rec.Code, r
+	}
+	expect := func(step string, ready bool, storeHealthy bool, storeError string) {
+		code, r := probe("/ready")
+		if ready != (code == http.StatusOK) || r.Ready != ready || len(r.Checks) != 2 {
+			t.Fatalf("%s: expected ready %v, got %d %+v", step, ready, code, r)
+		}
+		c := r.Checks[1]
+		if c.Name != HealthStore || !c.Required || c.Healthy != storeHealthy || c.Error != storeError {
+			t.Fatalf("%s: unexpected store check %+v", step, c)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"up"`) {
+		t.Errorf("Liveness failed: %d %s", rec.Code, rec.Body)
+	}
+	expect("before running", false, false, "Not run yet")
+	h.Run()
+	expect("passing", true, true, "")
+
+	// One failure isn't enough to flip it
+	storeErr = errors.New("Write failed")
+	h.Run()
+	expect("failed once", true, true, "Write failed")
+	h.Run()
+	expect("failed twice", false, false, "Write failed")
+	storeErr = nil
+	h.Run()
+	h.Run()
+	expect("passed twice", false, false, "")
+	h.Run()
+	expect("recovered", true, true, "")
+
+	// Flapping doesn't flap readiness
+	for i := 0; i < 10; i++ {
+		if i%2 == 0 {
+			storeErr = errors.New("Flapping")
+		} else {
+			storeErr = nil
+		}
+		h.Run()
+		if code, _ := probe("/ready"); code != http.StatusOK {
+			t.Fatalf("Readiness flapped on run %d", i)
+		}
+	}
+	storeErr = nil
+
+	// Failing checks that aren't required don't count, unregistered
+	// ones that are do
+	extraErr = errors.New("Broken")
+	for i := 0; i < 3; i++ {
+		h.Run()
+	}
+	_, r := probe("/ready")
+	if !r.Ready || r.Checks[0].Name != "extra" || r.Checks[0].Healthy || r.Checks[0].Required {
+		t.Errorf("Unexpected optional check %+v", r)
+	}
+	h.SetRequired([]string{HealthStore, "missing"})
+	if code, r := probe("/ready"); code != http.StatusServiceUnavailable || len(r.Checks) != 3 || r.Checks[1].Error != ErrHealthNotRegistered.Error() {
+		t.Errorf("Unregistered required check didn't fail readiness: %d %+v", code, r)
+	}
+
+	// The clock check fails while the wall clock has recently stepped
+	defer func() { Clock = utils.SystemClock{} }()
+	fake := utils.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	Clock = fake
+	check := clockCheck(fake.Now(), fake.Monotonic())
+	fake.Advance(time.Hour)
+	if err := check(); err != nil {
+		t.Errorf("Clock failed without a step: %s", err)
+	}
+	fake.Step(-2 * time.Hour)
+	if check() == nil {
+		t.Errorf("Clock step not noticed")
+	}
+	fake.Advance(clockSteadyTime + time.Second)
+	if err := check(); err != nil {
+		t.Errorf("Clock failed once steady: %s", err)
+	}
+	fake.Step(-10 * 365 * 24 * time.Hour)
+	if check() == nil {
+		t.Errorf("Clock before %s passed", clockFloor)
+	}
+
+	// A bootstrap is wedged once nothing comes in for it
+	p := new(BootstrapProgress)
+	if p.Stalled(0) {
+		t.Errorf("Stalled without a bootstrap")
+	}
+	p.Start()
+	fake.Advance(BootstrapStallTime + time.Second)
+	if !p.Stalled(BootstrapStallTime) {
+		t.Errorf("Bootstrap not stalled")
+	}
+	p.AddBlocks(1)
+	if p.Stalled(BootstrapStallTime) {
+		t.Errorf("Bootstrap stalled right after a pull")
+	}
+}
+
+func TestVoteHistoryExport(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	defer func() { Clock = utils.SystemClock{} }()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := utils.NewFakeClock(start)
+	Clock = fake
+
+	rep := blocks.TestGenesisBlock.Account
+	recordVote(blocks.TestGenesisBlock, Vote{Account: rep, Timestamp: 1})
+	fake.Advance(time.Minute)
+	recordVote(blocks.TestGenesisBlock, Vote{Account: rep, Sequence: 2})
+
+	report, err := ExportVoteHistory(rep, start, start.Add(time.Hour), VoteReportJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifyVoteReport(report.Body, report.NodeID, report.Signature); err != nil {
+		t.Errorf("Report signature didn't verify: %s", err)
+	}
+	var body struct {
+		NodeID string             `json:"node_id"`
+		Votes  []store.VoteRecord `json:"votes"`
+		Hours  []store.VoteHour   `json:"hours"`
+	}
+	json.Unmarshal(report.Body, &body)
+	if body.NodeID != report.NodeID || len(body.Votes) != 2 || body.Votes[1].Sequence != 2 || len(body.Hours) != 1 || body.Hours[0].Votes != 2 {
+		t.Errorf("Unexpected report %s", report.Body)
+	}
+
+	tampered := bytes.Replace(report.Body, []byte(`"Sequence":2`), []byte(`"Sequence":3`), 1)
+	if VerifyVoteReport(tampered, report.NodeID, report.Signature) != ErrBadReportSignature {
+		t.Errorf("Tampered report verified")
+	}
+	otherID, _ := address.GenerateKey()
+	if VerifyVoteReport(report.Body, hex.EncodeToString(otherID), report.Signature) != ErrBadReportSignature {
+		t.Errorf("Report verified against another node's key")
+	}
+
+	report, err = ExportVoteHistory(rep, start, start.Add(time.Hour), VoteReportCSV)
+	if err != nil || VerifyVoteReport(report.Body, report.NodeID, report.Signature) != nil {
+		t.Fatalf("CSV report didn't verify: %v", err)
+	}
+	rows, err := csv.NewReader(bytes.NewReader(report.Body)).ReadAll()
+	if err != nil || len(rows) != 5 || rows[0][1] != report.NodeID || rows[2][0] != "vote" || rows[4][7] != "2" {
+		t.Errorf("Unexpected CSV report %q, %v", rows, err)
+	}
+	if _, err = ExportVoteHistory(rep, start, start.Add(time.Hour), "xml"); err != ErrBadReportFormat {
+		t.Errorf("Expected a bad format error, got %v", err)
+	}
+}
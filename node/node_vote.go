@@ -1,60 +1,117 @@
 package node
 
 import (
-	"bytes"
-	"errors"
-
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"strings"
+
+	"github.com/frankh/crypto/ed25519"
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/protocol"
+	"github.com/frankh/nano/types"
 	"github.com/golang/crypto/blake2b"
 )
 
 type MessageVote struct {
 	Account   [32]byte
 	Signature [64]byte
-	Sequence  [8]byte
+	// With protocol.CapabilityVoteTimestamp, the unix milliseconds the
+	// vote was made instead
+	Sequence [8]byte
 	MessageBlock
+	// Not on the wire: set from the header's version when read
+	Timestamped bool
+}
+
+// A representative's vote, as carried by a confirm_ack. Votes from peers
+// speaking protocol.CapabilityVoteTimestamp have a Timestamp, older ones
+// a Sequence.
+type Vote struct {
+	Account   types.Account
+	Sequence  uint64
+	Signature types.Signature
+	// Unix milliseconds
+	Timestamp uint64
 }
 
+func (m *MessageVote) Vote() Vote {
+	v := Vote{
+		Account:   address.PubKeyToAddress(ed25519.PublicKey(m.Account[:])),
+		Signature: types.Signature(strings.ToUpper(hex.EncodeToString(m.Signature[:]))),
+	}
+	if m.Timestamped {
+		v.Timestamp = binary.LittleEndian.Uint64(m.Sequence[:])
+	} else {
+		v.Sequence = binary.LittleEndian.Uint64(m.Sequence[:])
+	}
+	return v
+}
+
+// VerifyVote checks the vote is signed by its representative, over the
+// block's hash and the sequence number or timestamp.
+func (m *MessageVote) VerifyVote() bool {
+	if m.MessageBlock.ToBlock() == nil {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(m.Account[:]), m.Hash(), m.Signature[:])
+}
+
+// Timestamped votes are signed with a prefix, so neither kind of vote
+// can be passed off as the other.
+var timestampedVotePrefix = []byte("vote ")
+
 func (m *MessageVote) Hash() []byte {
 	hash, _ := blake2b.New(32, nil)
 
+	if m.Timestamped {
+		hash.Write(timestampedVotePrefix)
+	}
 	hash.Write(m.MessageBlock.ToBlock().Hash().ToBytes())
 	hash.Write(m.Sequence[:])
 
 	return hash.Sum(nil)
 }
 
-func (m *MessageVote) Read(messageBlockType byte, buf *bytes.Buffer) error {
-	n1, err1 := buf.Read(m.Account[:])
-	n2, err2 := buf.Read(m.Signature[:])
-	n3, err3 := buf.Read(m.Sequence[:])
-
-	err4 := m.MessageBlock.Read(messageBlockType, buf)
-
-	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
-		return errors.New("Failed to read message vote")
-	}
-
-	if n1 != 32 || n2 != 64 || n3 != 8 {
-		return errors.New("Failed to read message vote")
+// CreateVote returns a builder for a confirm_ack voting for block, signed
+// by priv, in the encoding each peer understands: the sequence number
+// for peers without protocol.CapabilityVoteTimestamp, the time now for
+// those with it.
+func CreateVote(block blocks.Block, priv ed25519.PrivateKey, sequence uint64) MessageBuilder {
+	timestamp := uint64(Clock.Now().UnixNano() / 1e6)
+	return func(version byte) (Message, error) {
+		publish, err := CreatePublish(block)
+		if err != nil {
+			return nil, err
+		}
+		var m MessageConfirmAck
+		m.MessageHeader = publish.MessageHeader
+		m.MessageType = protocol.MessageConfirmAck
+		m.VersionUsing = version
+		m.MessageBlock = publish.MessageBlock
+		m.Timestamped = protocol.CapabilityVoteTimestamp.SupportedBy(version)
+		if m.Timestamped {
+			binary.LittleEndian.PutUint64(m.Sequence[:], timestamp)
+		} else {
+			binary.LittleEndian.PutUint64(m.Sequence[:], sequence)
+		}
+		copy(m.Account[:], priv.Public().(ed25519.PublicKey))
+		copy(m.Signature[:], ed25519.Sign(priv, m.MessageVote.Hash()))
+		return &m, nil
 	}
-
-	return nil
 }
 
-func (m *MessageVote) Write(buf *bytes.Buffer) error {
-	n1, err1 := buf.Write(m.Account[:])
-	n2, err2 := buf.Write(m.Signature[:])
-	n3, err3 := buf.Write(m.Sequence[:])
-
-	err4 := m.MessageBlock.Write(buf)
-
-	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
-		return errors.New("Failed to read message vote")
+func (m *MessageVote) Read(messageBlockType byte, r io.Reader) error {
+	if err := readFields(r, m.Account[:], m.Signature[:], m.Sequence[:]); err != nil {
+		return err
 	}
+	return m.MessageBlock.Read(messageBlockType, r)
+}
 
-	if n1 != 32 || n2 != 64 || n3 != 8 {
-		return errors.New("Failed to read message vote")
+func (m *MessageVote) Write(w io.Writer) error {
+	if err := writeFields(w, m.Account[:], m.Signature[:], m.Sequence[:]); err != nil {
+		return err
 	}
-
-	return nil
+	return m.MessageBlock.Write(w)
 }
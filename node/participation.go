@@ -0,0 +1,116 @@
+package node
+
+import (
+	"math"
+	"time"
+
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/wallet"
+)
+
+// Representatives' votes are counted against the elections seen over a
+// rolling day, an hour per window.
+const participationWindows = 24
+const participationWindowLength = time.Hour
+
+type participationWindow struct {
+	start     time.Time
+	elections int
+	votes     map[types.Account]int
+}
+
+// Which elections each representative votes in, kept by the
+// confirmationSampler under its lock.
+type repParticipation struct {
+	windows [participationWindows]participationWindow
+	// When each representative was first and last seen voting
+	first map[types.Account]time.Time
+	last  map[types.Account]time.Time
+}
+
+func newRepParticipation() repParticipation {
+	return repParticipation{first: make(map[types.Account]time.Time), last: make(map[types.Account]time.Time)}
+}
+
+func (p *repParticipation) window(t time.Time) *participationWindow {
+	start := t.Truncate(participationWindowLength)
+	w := &p.windows[int(start.Unix()/int64(participationWindowLength/time.Second))%participationWindows]
+	if !w.start.Equal(start) {
+		*w = participationWindow{start: start, votes: make(map[types.Account]int)}
+	}
+	return w
+}
+
+func (p *repParticipation) election(t time.Time) {
+	p.window(t).elections++
+}
+
+// Counts rep's vote in an election, once per election.
+func (p *repParticipation) vote(rep types.Account, t time.Time) {
+	p.window(t).votes[rep]++
+	if _, ok := p.first[rep]; !ok {
+		p.first[rep] = t
+	}
+	p.last[rep] = t
+}
+
+// Share of the elections in the window ending at t that rep voted in.
+func (p *repParticipation) rate(rep types.Account, t time.Time) float64 {
+	cutoff := t.Add(-participationWindows * participationWindowLength)
+	var elections, votes int
+	for _, w := range p.windows {
+		if !w.start.After(cutoff) {
+			continue
+		}
+		elections += w.elections
+		votes += w.votes[rep]
+	}
+	if elections == 0 {
+		return 0
+	}
+	// Votes can land in a later window than their election
+	return math.Min(1, float64(votes)/float64(elections))
+}
+
+// Share of the time since rep's first vote that it's been seen voting,
+// judged by when it last voted. A rep that stopped voting an hour into a
+// day scores 1/24.
+func (p *repParticipation) uptime(rep types.Account, t time.Time) float64 {
+	first, ok := p.first[rep]
+	if !ok {
+		return 0
+	}
+	span := t.Sub(first)
+	if span <= 0 {
+		return 1
+	}
+	return math.Min(1, float64(p.last[rep].Sub(first))/float64(span))
+}
+
+// RepresentativeMetrics lists every representative with weight and what
+// we've observed of its voting, heaviest first.
+func RepresentativeMetrics() []wallet.RepresentativeMetrics {
+	weights := store.RepresentativeWeights()
+	t := Clock.Now()
+
+	confirmations.Lock()
+	defer confirmations.Unlock()
+	p := &confirmations.participation
+	var result []wallet.RepresentativeMetrics
+	for _, w := range weights {
+		result = append(result, wallet.RepresentativeMetrics{
+			Representative: w.Representative,
+			Weight:         w.Weight,
+			Participation:  p.rate(w.Representative, t),
+			Uptime:         p.uptime(w.Representative, t),
+			FirstVote:      p.first[w.Representative],
+			LastVote:       p.last[w.Representative],
+		})
+	}
+	return result
+}
+
+func init() {
+	wallet.RepresentativeSource = RepresentativeMetrics
+}
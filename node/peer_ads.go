@@ -0,0 +1,177 @@
+package node
+
+import (
+	"encoding/binary"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/frankh/crypto/ed25519"
+	"github.com/frankh/nano/address"
+	"github.com/golang/crypto/blake2b"
+)
+
+// Header extension bit for keepalives whose peers are signed by the
+// sender's node key. Only sent to peers that have verified our key.
+const ExtensionSignedPeers byte = 0x80
+
+// Timestamp and signature after the peer slots
+const signedPeersSize = 8 + 64
+
+// Signed advertisements older than this count as unsigned
+const maxAdvertisementAge = 10 * time.Minute
+
+// Share of MaxPeers that peers learned from unsigned advertisements may
+// take up
+var MaxUnsignedShare = 0.25
+
+// This node's identity key, for signing the peers it advertises
+var NodeID, NodeKey = address.GenerateKey()
+
+// Node keys of peers verified by handshake, by address
+var verifiedPeers = struct {
+	sync.Mutex
+	keys map[string]ed25519.PublicKey
+}{keys: make(map[string]ed25519.PublicKey)}
+
+// MarkVerified records peer's node key once a handshake has proven it.
+// Signed keepalives from the peer are then trusted, and ours to it are
+// signed.
+func MarkVerified(peer Peer, key ed25519.PublicKey) {
+	verifiedPeers.Lock()
+	verifiedPeers.keys[peer.String()] = key
+	verifiedPeers.Unlock()
+}
+
+func verifiedKey(peer Peer) (ed25519.PublicKey, bool) {
+	verifiedPeers.Lock()
+	defer verifiedPeers.Unlock()
+	key, ok := verifiedPeers.keys[peer.String()]
+	return key, ok
+}
+
+func (m *MessageKeepAlive) Signed() bool {
+	return m.MessageHeader.Extensions&ExtensionSignedPeers != 0
+}
+
+// What's signed: each peer's address and port, then the timestamp.
+func (m *MessageKeepAlive) signedHash() []byte {
+	hash, _ := blake2b.New(32, nil)
+	for _, peer := range m.Peers {
+		hash.Write(peer.IP.To16())
+		binary.Write(hash, binary.LittleEndian, peer.Port)
+	}
+	binary.Write(hash, binary.LittleEndian, m.Timestamp)
+	return hash.Sum(nil)
+}
+
+// Sign marks the keepalive as signed and signs its peers with key.
+func (m *MessageKeepAlive) Sign(key ed25519.PrivateKey) {
+	if len(m.Peers) > numberOfPeersToShare {
+		m.Peers = m.Peers[:numberOfPeersToShare]
+	}
+	m.MessageHeader.Extensions |= ExtensionSignedPeers
+	m.Timestamp = uint64(Clock.Now().Unix())
+	copy(m.Signature[:], ed25519.Sign(key, m.signedHash()))
+}
+
+// Whether the keepalive's peers were signed recently by from's verified
+// node key.
+func (m *MessageKeepAlive) signedBy(from Peer) bool {
+	if !m.Signed() {
+		return false
+	}
+	key, ok := verifiedKey(from)
+	if !ok {
+		return false
+	}
+	age := Clock.Now().Sub(time.Unix(int64(m.Timestamp), 0))
+	if age > maxAdvertisementAge || age < -maxAdvertisementAge {
+		return false
+	}
+	return ed25519.Verify(key, m.signedHash(), m.Signature[:])
+}
+
+// Peers learned from keepalives, by how they were advertised. Guarded by
+// peersLock, like the peer list.
+var learnedPeers = struct {
+	signed map[string]bool
+	// Oldest first, the first to be evicted
+	unsigned []string
+}{signed: make(map[string]bool)}
+
+func unsignedLimit() int {
+	return int(float64(MaxPeers) * MaxUnsignedShare)
+}
+
+// Whether a peer advertised this way could be added, evicting an
+// unsigned one for a signed one if the list is full.
+func hasRoom(signed bool) bool {
+	if signed {
+		return len(PeerList) < MaxPeers || len(learnedPeers.unsigned) > 0
+	}
+	if len(learnedPeers.unsigned) >= unsignedLimit() {
+		atomic.AddUint64(&peerFilterCounters.UnsignedFull, 1)
+		return false
+	}
+	return len(PeerList) < MaxPeers
+}
+
+// Adds a peer learned from a keepalive, evicting an unsigned one if the
+// list is full: the oldest from the most crowded subnet.
+func addLearned(peer Peer, signed bool) {
+	if len(PeerList) >= MaxPeers && len(learnedPeers.unsigned) > 0 {
+		evicted := mostCrowded(learnedPeers.unsigned)
+		dropPeers(map[string]bool{evicted: true})
+		atomic.AddUint64(&peerFilterCounters.Evicted, 1)
+		log.Printf("Evicted unsigned peer %s for a signed one", evicted)
+	}
+	if signed {
+		learnedPeers.signed[peer.String()] = true
+	} else {
+		learnedPeers.unsigned = append(learnedPeers.unsigned, peer.String())
+	}
+}
+
+// A known peer was advertised with a signature, so it's no longer first
+// to go.
+func confirmLearned(peer Peer) {
+	key := peer.String()
+	for i, unsigned := range learnedPeers.unsigned {
+		if unsigned == key {
+			learnedPeers.unsigned = append(learnedPeers.unsigned[:i], learnedPeers.unsigned[i+1:]...)
+			learnedPeers.signed[key] = true
+			return
+		}
+	}
+}
+
+// Removes peers from the peer list and everything tracking them. Called
+// with peersLock held.
+func dropPeers(gone map[string]bool) {
+	kept := PeerList[:0]
+	for _, peer := range PeerList {
+		if !gone[peer.String()] {
+			kept = append(kept, peer)
+			continue
+		}
+		delete(PeerSet, peer.String())
+		PeerLiveness.Remove(peer)
+		peerFilters.forget(peer)
+		peerVersions.forget(peer)
+		Events.Publish(Event{Type: EventPeerRemoved, Peer: peer.String()})
+	}
+	PeerList = kept
+
+	unsigned := learnedPeers.unsigned[:0]
+	for _, key := range learnedPeers.unsigned {
+		if !gone[key] {
+			unsigned = append(unsigned, key)
+		}
+	}
+	learnedPeers.unsigned = unsigned
+	for key := range gone {
+		delete(learnedPeers.signed, key)
+	}
+}
@@ -0,0 +1,179 @@
+package node
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// New addresses accepted from one peer's keepalives per minute
+var MaxLearnedPerMinute = 16
+
+const learnedWindow = time.Minute
+
+// Sources tracked for rate limiting before stale ones are dropped
+const maxLearnedSources = 10000
+
+var ErrPeerOnProbation = errors.New("Peer hasn't answered its probe yet")
+
+// Counts of keepalive peer entries dropped, by reason
+type PeerFilterCounters struct {
+	Private     uint64
+	Loopback    uint64
+	Multicast   uint64
+	Unspecified uint64
+	RateLimited uint64
+	// Unsigned advertisements dropped for MaxUnsignedShare
+	UnsignedFull uint64
+	// Unsigned peers evicted for signed ones
+	Evicted uint64
+	// Dropped for MaxPeersPerSubnet
+	SameSubnet uint64
+}
+
+var peerFilterCounters PeerFilterCounters
+
+func GetPeerFilterCounters() PeerFilterCounters {
+	return PeerFilterCounters{
+		atomic.LoadUint64(&peerFilterCounters.Private),
+		atomic.LoadUint64(&peerFilterCounters.Loopback),
+		atomic.LoadUint64(&peerFilterCounters.Multicast),
+		atomic.LoadUint64(&peerFilterCounters.Unspecified),
+		atomic.LoadUint64(&peerFilterCounters.RateLimited),
+		atomic.LoadUint64(&peerFilterCounters.UnsignedFull),
+		atomic.LoadUint64(&peerFilterCounters.Evicted),
+		atomic.LoadUint64(&peerFilterCounters.SameSubnet),
+	}
+}
+
+type learnedCount struct {
+	start time.Duration
+	count int
+}
+
+// Keeps keepalives from turning us into a reflector: addresses learned
+// from a peer get a single probe, and nothing else, until they answer.
+type peerFilter struct {
+	lock    sync.Mutex
+	learned map[string]*learnedCount
+	// Learned peers not heard from yet, and whether they've been probed
+	probation map[string]bool
+}
+
+func newPeerFilter() *peerFilter {
+	return &peerFilter{
+		learned:   make(map[string]*learnedCount),
+		probation: make(map[string]bool),
+	}
+}
+
+var peerFilters = newPeerFilter()
+
+func isLocal(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast()
+}
+
+// Checks a peer's range, counting it if it's dropped. Private and
+// loopback peers are only taken from peers that are themselves local.
+func allowedRange(from Peer, peer Peer) bool {
+	ip := peer.IP
+	switch {
+	case ip == nil || ip.IsUnspecified() || peer.Port == 0:
+		atomic.AddUint64(&peerFilterCounters.Unspecified, 1)
+	case ip.IsMulticast() || ip.Equal(net.IPv4bcast):
+		atomic.AddUint64(&peerFilterCounters.Multicast, 1)
+	case isLocal(from.IP):
+		return true
+	case ip.IsLoopback():
+		atomic.AddUint64(&peerFilterCounters.Loopback, 1)
+	case ip.IsPrivate() || ip.IsLinkLocalUnicast():
+		atomic.AddUint64(&peerFilterCounters.Private, 1)
+	default:
+		return true
+	}
+	return false
+}
+
+// Takes one of from's learned addresses for this minute, if it has any
+// left.
+func (f *peerFilter) take(from Peer) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	now := Clock.Monotonic()
+	if len(f.learned) >= maxLearnedSources {
+		for source, c := range f.learned {
+			if now-c.start >= learnedWindow {
+				delete(f.learned, source)
+			}
+		}
+	}
+	key := from.IP.String()
+	c, ok := f.learned[key]
+	if !ok || now-c.start >= learnedWindow {
+		c = &learnedCount{start: now}
+		f.learned[key] = c
+	}
+	if c.count >= MaxLearnedPerMinute {
+		atomic.AddUint64(&peerFilterCounters.RateLimited, 1)
+		return false
+	}
+	c.count++
+	return true
+}
+
+// Whether a peer listed in from's keepalive can be learned. Learned
+// peers are on probation until heard from.
+func (f *peerFilter) learn(from Peer, peer Peer) bool {
+	if !allowedRange(from, peer) || !f.take(from) {
+		return false
+	}
+	f.lock.Lock()
+	f.probation[peer.String()] = false
+	f.lock.Unlock()
+	return true
+}
+
+func (f *peerFilter) heard(peer Peer) {
+	f.lock.Lock()
+	delete(f.probation, peer.String())
+	f.lock.Unlock()
+}
+
+// Drops an expired peer's probation, so it's probed again if relearned.
+func (f *peerFilter) forget(peer Peer) {
+	f.lock.Lock()
+	delete(f.probation, peer.String())
+	f.lock.Unlock()
+}
+
+func (f *peerFilter) onProbation(peer Peer) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	_, ok := f.probation[peer.String()]
+	return ok
+}
+
+// Whether a packet may go to peer, using up a probation peer's probe.
+func (f *peerFilter) allowSend(peer Peer) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	probed, ok := f.probation[peer.String()]
+	if !ok {
+		return true
+	}
+	if probed {
+		return false
+	}
+	f.probation[peer.String()] = true
+	return true
+}
+
+// A packet arrived from peer.
+func heardFrom(peer Peer) {
+	PeerLiveness.Heard(peer)
+	peerFilters.heard(peer)
+}
@@ -0,0 +1,110 @@
+package node
+
+import (
+	"math/rand"
+	"net"
+	"sync/atomic"
+)
+
+// Peers kept from one subnet, so one operator's address range can't fill
+// the peer list and eclipse the node. Zero for no limit.
+var MaxPeersPerSubnet = 8
+
+var (
+	ipv4Subnet = net.CIDRMask(24, 32)
+	ipv6Subnet = net.CIDRMask(48, 128)
+)
+
+// Subnet is the /24 of an IPv4 address or the /48 of an IPv6 one, about
+// what one operator is likely to hold.
+func Subnet(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(ipv4Subnet), Mask: ipv4Subnet}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(ipv6Subnet), Mask: ipv6Subnet}).String()
+}
+
+// Local peers share a subnet for good reason, e.g. a test network on a
+// LAN, so aren't limited.
+func subnetLimited(ip net.IP) bool {
+	return MaxPeersPerSubnet > 0 && ip != nil && !isLocal(ip)
+}
+
+// Peers in the list by subnet. Called with peersLock held.
+func subnetCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, peer := range PeerList {
+		counts[Subnet(peer.IP)]++
+	}
+	return counts
+}
+
+// PeersBySubnet counts the peer list by subnet.
+func PeersBySubnet() map[string]int {
+	peersLock.Lock()
+	defer peersLock.Unlock()
+	return subnetCounts()
+}
+
+// Whether the peer's subnet has room in the list, counting it if not.
+// Called with peersLock held.
+func subnetRoom(peer Peer) bool {
+	if !subnetLimited(peer.IP) {
+		return true
+	}
+	subnet := Subnet(peer.IP)
+	count := 0
+	for _, p := range PeerList {
+		if Subnet(p.IP) == subnet {
+			count++
+		}
+	}
+	if count < MaxPeersPerSubnet {
+		return true
+	}
+	atomic.AddUint64(&peerFilterCounters.SameSubnet, 1)
+	return false
+}
+
+// The one of keys, oldest first, whose subnet has the most peers in the
+// list, the oldest of those if there's a tie. Called with peersLock held.
+func mostCrowded(keys []string) string {
+	subnets := make(map[string]string, len(PeerList))
+	for _, peer := range PeerList {
+		subnets[peer.String()] = Subnet(peer.IP)
+	}
+	counts := subnetCounts()
+	best := keys[0]
+	for _, key := range keys[1:] {
+		if counts[subnets[key]] > counts[subnets[best]] {
+			best = key
+		}
+	}
+	return best
+}
+
+// Picks up to n of peers at random, spread over as many subnets as they
+// cover: one from each subnet before a second from any.
+func diversePeers(peers []Peer, n int) []Peer {
+	var picked, rest []Peer
+	seen := make(map[string]bool)
+	for _, i := range rand.Perm(len(peers)) {
+		if len(picked) == n {
+			return picked
+		}
+		subnet := Subnet(peers[i].IP)
+		if seen[subnet] {
+			rest = append(rest, peers[i])
+			continue
+		}
+		seen[subnet] = true
+		picked = append(picked, peers[i])
+	}
+	for _, peer := range rest {
+		if len(picked) == n {
+			break
+		}
+		picked = append(picked, peer)
+	}
+	return picked
+}
@@ -0,0 +1,100 @@
+package node
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/frankh/nano/protocol"
+)
+
+// A MessageBuilder encodes a message for a peer speaking version, for
+// messages whose encoding depends on it. See protocol.Capability.
+type MessageBuilder func(version byte) (Message, error)
+
+// The highest protocol version each peer has said it speaks, from the
+// headers of its messages.
+type peerVersionTable struct {
+	lock   sync.Mutex
+	byPeer map[string]byte
+}
+
+var peerVersions = peerVersionTable{byPeer: make(map[string]byte)}
+
+func (t *peerVersionTable) heard(peer Peer, versionMax byte) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	_, known := t.byPeer[peer.String()]
+	// Anyone can send us a packet, so only so many are remembered
+	if !known && len(t.byPeer) >= MaxPeers {
+		return
+	}
+	t.byPeer[peer.String()] = versionMax
+}
+
+func (t *peerVersionTable) forget(peer Peer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.byPeer, peer.String())
+}
+
+// PeerVersion is the protocol version to speak to peer: the highest both
+// of us support, or VersionUsing if we haven't heard from it.
+func PeerVersion(peer Peer) byte {
+	peerVersions.lock.Lock()
+	defer peerVersions.lock.Unlock()
+	version, ok := peerVersions.byPeer[peer.String()]
+	if !ok {
+		return protocol.VersionUsing
+	}
+	if version > protocol.VersionMax {
+		return protocol.VersionMax
+	}
+	return version
+}
+
+func buildPacket(build MessageBuilder, version byte) ([]byte, error) {
+	m, err := build(version)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = m.Write(&buf)
+	return buf.Bytes(), err
+}
+
+// SendBuilt sends peer the message build makes for the version it speaks.
+func (p *Peer) SendBuilt(build MessageBuilder) error {
+	packet, err := buildPacket(build, PeerVersion(*p))
+	if err != nil {
+		return err
+	}
+	return p.SendPacket(packet)
+}
+
+// BroadcastBuilt sends each known peer the message build makes for the
+// version it speaks, building each encoding once. Unlike Broadcast it
+// goes peer by peer, through the transport's Send.
+func BroadcastBuilt(build MessageBuilder) error {
+	peersLock.Lock()
+	peers := append([]Peer{}, PeerList...)
+	peersLock.Unlock()
+
+	packets := make(map[byte][]byte)
+	for _, peer := range peers {
+		if peerFilters.onProbation(peer) {
+			continue
+		}
+		version := PeerVersion(peer)
+		packet, ok := packets[version]
+		if !ok {
+			var err error
+			packet, err = buildPacket(build, version)
+			if err != nil {
+				return err
+			}
+			packets[version] = packet
+		}
+		peer.SendPacket(packet)
+	}
+	return nil
+}
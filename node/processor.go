@@ -0,0 +1,314 @@
+package node
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/metrics"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+)
+
+// Blocks a second the processor is expected to keep up with
+const DefaultProcessorCapacity = 1000
+
+// Most of the capacity one account may use while the queue is contended
+const DefaultAccountShare = 0.05
+
+// Blocks queued beyond these are dropped
+const maxProcessorQueue = 10000
+const maxDeferredBlocks = 10000
+
+// Queued blocks from which the processor counts as contended
+const contendedDepth = 64
+
+// Account buckets kept, the least recently used are forgotten beyond
+const maxAccountBuckets = 10000
+
+type ProcessorStats struct {
+	Processed uint64
+	Queued    int
+	Deferred  int
+	// Blocks over their account's quota sent to the deferred queue, by
+	// block type
+	Deferrals map[blocks.BlockType]uint64
+	// Blocks over quota that were let through, by reason: "local" or
+	// "balance"
+	Exempted map[string]uint64
+	Dropped  uint64
+}
+
+type deferredBlock struct {
+	block   blocks.Block
+	account types.Account
+}
+
+type accountBucket struct {
+	account types.Account
+	tokens  float64
+	updated time.Duration
+}
+
+// BlockProcessor stores blocks from the network in arrival order, except
+// that while it's behind no account may use more than Share of its
+// Capacity. Blocks over an account's quota are deferred, not dropped,
+// and processed when the main queue is empty.
+type BlockProcessor struct {
+	Capacity float64
+	Share    float64
+	// Accounts holding at least this are never deferred. Zero exempts
+	// none.
+	ExemptBalance uint128.Uint128
+	// Whether an account is one of our wallets', which are never
+	// deferred. Nil for none.
+	Local func(types.Account) bool
+	// Where the stages of blocks from the network are recorded, up to
+	// their elections. Nil for none.
+	Tracer *metrics.Tracer
+
+	lock     sync.Mutex
+	queue    []blocks.Block
+	deferred []deferredBlock
+	// Blocks waiting in the deferred queue by account, so an account's
+	// later blocks queue behind them
+	deferredBy map[types.Account]int
+	buckets    map[types.Account]*list.Element
+	// Most recently used at the front
+	order   *list.List
+	running bool
+	wake    chan bool
+	done    chan bool
+	stats   ProcessorStats
+
+	process func(blocks.Block)
+	// Called by Add under contention, so must be cheap: the store's is an
+	// index lookup
+	account func(blocks.Block) (types.Account, uint128.Uint128, bool)
+}
+
+func NewBlockProcessor(capacity float64, share float64) *BlockProcessor {
+	p := &BlockProcessor{
+		Capacity:   capacity,
+		Share:      share,
+		deferredBy: make(map[types.Account]int),
+		buckets:    make(map[types.Account]*list.Element),
+		order:      list.New(),
+		wake:       make(chan bool, 1),
+		stats: ProcessorStats{
+			Deferrals: make(map[blocks.BlockType]uint64),
+			Exempted:  make(map[string]uint64),
+		},
+		Tracer:  metrics.Traces,
+		account: store.BlockAccount,
+	}
+	p.process = p.processBlock
+	return p
+}
+
+var Processor = NewBlockProcessor(DefaultProcessorCapacity, DefaultAccountShare)
+
+func (p *BlockProcessor) processBlock(block blocks.Block) {
+	if store.StoreBlock(block) == nil {
+		p.Tracer.Record(block.Hash(), metrics.StageProcessed)
+		notifyWebhooks(block)
+		notifyBlockHandlers(block)
+	}
+}
+
+// Start processes added blocks on their own goroutine. Until then Add
+// processes them straight away.
+func (p *BlockProcessor) Start() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.running {
+		return
+	}
+	p.running = true
+	p.done = make(chan bool)
+	go p.run(p.done)
+}
+
+func (p *BlockProcessor) Stop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.running {
+		p.running = false
+		close(p.done)
+	}
+}
+
+func (p *BlockProcessor) run(done chan bool) {
+	for {
+		block, account, deferred := p.next()
+		if block == nil {
+			select {
+			case <-done:
+				return
+			case <-p.wake:
+			}
+			continue
+		}
+
+		p.process(block)
+		p.lock.Lock()
+		p.stats.Processed++
+		if deferred {
+			if p.deferredBy[account]--; p.deferredBy[account] <= 0 {
+				delete(p.deferredBy, account)
+			}
+		}
+		p.lock.Unlock()
+	}
+}
+
+// The next block, deferred ones only once the queue is empty.
+func (p *BlockProcessor) next() (block blocks.Block, account types.Account, deferred bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.queue) > 0 {
+		block = p.queue[0]
+		p.queue[0] = nil
+		p.queue = p.queue[1:]
+		return block, "", false
+	}
+	if len(p.deferred) > 0 {
+		d := p.deferred[0]
+		p.deferred[0] = deferredBlock{}
+		p.deferred = p.deferred[1:]
+		return d.block, d.account, true
+	}
+	return nil, "", false
+}
+
+// Add queues a block, or defers it if the processor is contended and the
+// block's account is over its quota.
+func (p *BlockProcessor) Add(block blocks.Block) {
+	p.lock.Lock()
+	running, contended := p.running, len(p.queue) >= contendedDepth
+	p.lock.Unlock()
+	if !running {
+		p.process(block)
+		return
+	}
+
+	var account types.Account
+	var balance uint128.Uint128
+	if contended || p.deferring() {
+		// Blocks we can't place yet share the unknown account's quota
+		account, balance, _ = p.account(block)
+	}
+
+	p.lock.Lock()
+	if p.deferredBy[account] > 0 || (contended && !p.allow(account, balance)) {
+		if len(p.deferred) >= maxDeferredBlocks {
+			p.stats.Dropped++
+		} else {
+			p.deferred = append(p.deferred, deferredBlock{block, account})
+			p.deferredBy[account]++
+			p.stats.Deferrals[block.Type()]++
+		}
+	} else if len(p.queue) >= maxProcessorQueue {
+		p.stats.Dropped++
+	} else {
+		p.queue = append(p.queue, block)
+	}
+	p.lock.Unlock()
+
+	select {
+	case p.wake <- true:
+	default:
+	}
+}
+
+func (p *BlockProcessor) deferring() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.deferredBy) > 0
+}
+
+// SetQuota changes the capacity and per-account share while running.
+func (p *BlockProcessor) SetQuota(capacity float64, share float64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.Capacity, p.Share = capacity, share
+}
+
+// Takes a token from the account's bucket. Called with the lock held.
+func (p *BlockProcessor) allow(account types.Account, balance uint128.Uint128) bool {
+	rate := p.Capacity * p.Share
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	now := Clock.Monotonic()
+
+	e, ok := p.buckets[account]
+	if ok {
+		p.order.MoveToFront(e)
+	} else {
+		if p.order.Len() >= maxAccountBuckets {
+			oldest := p.order.Back()
+			p.order.Remove(oldest)
+			delete(p.buckets, oldest.Value.(*accountBucket).account)
+		}
+		e = p.order.PushFront(&accountBucket{account, burst, now})
+		p.buckets[account] = e
+	}
+
+	b := e.Value.(*accountBucket)
+	b.tokens += rate * (now - b.updated).Seconds()
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true
+	}
+
+	if p.Local != nil && account != "" && p.Local(account) {
+		p.stats.Exempted["local"]++
+		return true
+	}
+	if !p.ExemptBalance.Equal(uint128.Uint128{}) && balance.Compare(p.ExemptBalance) >= 0 {
+		p.stats.Exempted["balance"]++
+		return true
+	}
+	return false
+}
+
+func (p *BlockProcessor) Stats() ProcessorStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	stats := p.stats
+	stats.Queued, stats.Deferred = len(p.queue), len(p.deferred)
+	stats.Deferrals = make(map[blocks.BlockType]uint64)
+	for k, v := range p.stats.Deferrals {
+		stats.Deferrals[k] = v
+	}
+	stats.Exempted = make(map[string]uint64)
+	for k, v := range p.stats.Exempted {
+		stats.Exempted[k] = v
+	}
+	return stats
+}
+
+func GetProcessorStats() ProcessorStats {
+	return Processor.Stats()
+}
+
+var processorDeferralGauge = metrics.NewGaugeFunc("nano_processor_deferrals", "Blocks deferred for being over their account's quota, by block type.", "type", func() map[string]float64 {
+	series := make(map[string]float64)
+	for _, t := range []blocks.BlockType{blocks.Open, blocks.Send, blocks.Receive, blocks.Change} {
+		series[string(t)] = 0
+	}
+	for t, n := range GetProcessorStats().Deferrals {
+		series[string(t)] = float64(n)
+	}
+	return series
+})
@@ -0,0 +1,169 @@
+package node
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"sync"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/protocol"
+	"github.com/frankh/nano/types"
+)
+
+const publishCacheSize = 1000
+
+type cachedPacket struct {
+	hash   types.BlockHash
+	packet []byte
+}
+
+// publishCache holds serialized publish packets so rebroadcasting a block
+// doesn't re-check its work and re-serialize it every time.
+type publishCache struct {
+	lock    sync.Mutex
+	max     int
+	entries map[types.BlockHash]*list.Element
+	// Most recently used at the front
+	order  *list.List
+	hits   uint64
+	misses uint64
+}
+
+func newPublishCache(max int) *publishCache {
+	return &publishCache{
+		max:     max,
+		entries: make(map[types.BlockHash]*list.Element),
+		order:   list.New(),
+	}
+}
+
+var publishPackets = newPublishCache(publishCacheSize)
+
+func (c *publishCache) get(hash types.BlockHash) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[hash]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(e)
+	return e.Value.(*cachedPacket).packet, true
+}
+
+func (c *publishCache) add(hash types.BlockHash, packet []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if e, ok := c.entries[hash]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+	if c.order.Len() >= c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedPacket).hash)
+	}
+	c.entries[hash] = c.order.PushFront(&cachedPacket{hash, packet})
+}
+
+func (c *publishCache) len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.order.Len()
+}
+
+// Drops the least recently used entries over the new size.
+func (c *publishCache) setMax(max int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.max = max
+	for c.order.Len() > max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedPacket).hash)
+	}
+}
+
+func (c *publishCache) remove(hash types.BlockHash) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if e, ok := c.entries[hash]; ok {
+		c.order.Remove(e)
+		delete(c.entries, hash)
+	}
+}
+
+func CreatePublish(b blocks.Block) (*MessagePublish, error) {
+	block, err := FromBlock(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var m MessagePublish
+	m.MessageHeader.MagicNumber = MagicNumber
+	m.MessageHeader.VersionMax = protocol.VersionMax
+	m.MessageHeader.VersionUsing = protocol.VersionUsing
+	m.MessageHeader.VersionMin = protocol.VersionMin
+	m.MessageHeader.MessageType = protocol.MessagePublish
+	m.MessageHeader.BlockType = block.Type
+	m.MessageBlock = *block
+	return &m, nil
+}
+
+// PublishPacket returns the serialized publish message for a block,
+// checking its work only the first time. All rebroadcast paths should go
+// through this.
+func PublishPacket(b blocks.Block) ([]byte, error) {
+	hash := b.Hash()
+	packet, ok := publishPackets.get(hash)
+	if ok {
+		return packet, nil
+	}
+
+	if !blocks.ValidateBlockWork(b) {
+		return nil, errors.New("Invalid work for block")
+	}
+
+	m, err := CreatePublish(b)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = m.Write(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	publishPackets.add(hash, buf.Bytes())
+	return buf.Bytes(), nil
+}
+
+// Drops a block's cached packet, e.g. when it's rolled back.
+func InvalidatePublish(hash types.BlockHash) {
+	publishPackets.remove(hash)
+}
+
+type PublishCacheStats struct {
+	Hits, Misses uint64
+}
+
+func GetPublishCacheStats() PublishCacheStats {
+	publishPackets.lock.Lock()
+	defer publishPackets.lock.Unlock()
+	return PublishCacheStats{publishPackets.hits, publishPackets.misses}
+}
+
+// Broadcast publishes a block to every known peer.
+func Broadcast(b blocks.Block) error {
+	packet, err := PublishPacket(b)
+	if err != nil {
+		return err
+	}
+	return transport().Broadcast(packet)
+}
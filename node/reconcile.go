@@ -0,0 +1,160 @@
+package node
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+)
+
+const DefaultReconcileInterval = time.Minute
+
+// Times a block is republished before it's given up on
+const DefaultReconcileAttempts = 5
+
+// A ReconcileConflict is a wallet block that can't confirm, as a different
+// block on its root already has.
+type ReconcileConflict struct {
+	Hash      types.BlockHash
+	Root      types.BlockHash
+	Confirmed types.BlockHash
+}
+
+type ReconcileStats struct {
+	// Blocks waiting on the network, or republished and not yet confirmed
+	Tracked     int
+	Republished uint64
+	Confirmed   uint64
+	// Blocks that need an operator: those that lost their root, and those
+	// still unconfirmed after every attempt
+	Conflicts []ReconcileConflict
+	Abandoned []types.BlockHash
+}
+
+type reconcileEntry struct {
+	block    blocks.Block
+	attempts int
+}
+
+// WalletReconciler keeps the blocks wallets build while the network is
+// degraded, by too few peers or a sync status that isn't synced, as those
+// may never have reached the rest of the network. Once it's healthy again
+// each is republished and put to an election until it's confirmed, unless
+// a different block on its root was confirmed meanwhile, which is left
+// for the operator.
+type WalletReconciler struct {
+	Attempts int
+	// Whether the network is degraded, by peers and sync status if nil
+	Degraded func() bool
+	lock     sync.Mutex
+	tracked  map[types.BlockHash]*reconcileEntry
+	stats    ReconcileStats
+}
+
+func NewWalletReconciler(attempts int) *WalletReconciler {
+	return &WalletReconciler{Attempts: attempts, tracked: make(map[types.BlockHash]*reconcileEntry)}
+}
+
+var Reconciler = NewWalletReconciler(DefaultReconcileAttempts)
+
+func networkDegraded() bool {
+	if checkPeerCount() != nil {
+		return true
+	}
+	status := Sync.Status().Status
+	return status == SyncBehind || status == SyncDiverged
+}
+
+func (r *WalletReconciler) degraded() bool {
+	if r.Degraded != nil {
+		return r.Degraded()
+	}
+	return networkDegraded()
+}
+
+func blockConfirmed(hash types.BlockHash) bool {
+	return store.IsCemented(hash) || confirmed(hash)
+}
+
+// Built is for wallet.OnBuilt, keeping block if the network is degraded.
+func (r *WalletReconciler) Built(block blocks.Block) {
+	if !r.degraded() {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.tracked) < maxTrackedBlocks {
+		r.tracked[block.Hash()] = &reconcileEntry{block: block}
+	}
+}
+
+// Check does nothing while the network is degraded. Otherwise it drops
+// the blocks kept that have confirmed, reports those whose root went to
+// another block, and republishes the rest.
+func (r *WalletReconciler) Check() {
+	if r.degraded() || InSafeMode() {
+		return
+	}
+	r.lock.Lock()
+	pending := make([]*reconcileEntry, 0, len(r.tracked))
+	for _, entry := range r.tracked {
+		pending = append(pending, entry)
+	}
+	r.lock.Unlock()
+
+	// Outside the lock, as wallets call Built with their own locks held
+	for _, entry := range pending {
+		block := entry.block
+		hash := block.Hash()
+		if blockConfirmed(hash) {
+			r.drop(hash, func(s *ReconcileStats) { s.Confirmed++ })
+			continue
+		}
+		if stored := store.Conflicting(block); stored != nil && stored.Hash() != hash && blockConfirmed(stored.Hash()) {
+			conflict := ReconcileConflict{hash, block.RootHash(), stored.Hash()}
+			log.Printf("Wallet block %s lost root %s to confirmed %s", hash, conflict.Root, conflict.Confirmed)
+			r.drop(hash, func(s *ReconcileStats) { s.Conflicts = append(s.Conflicts, conflict) })
+			continue
+		}
+		if entry.attempts >= r.Attempts {
+			log.Printf("Wallet block %s still unconfirmed after %d republishes", hash, entry.attempts)
+			r.drop(hash, func(s *ReconcileStats) { s.Abandoned = append(s.Abandoned, hash) })
+			continue
+		}
+		startElection(hash, observeBlock(hash))
+		if err := Broadcast(block); err != nil {
+			log.Printf("Failed to republish %s: %s", hash, err)
+			continue
+		}
+		requestConfirmation(block)
+		r.lock.Lock()
+		entry.attempts++
+		r.stats.Republished++
+		r.lock.Unlock()
+	}
+}
+
+func (r *WalletReconciler) drop(hash types.BlockHash, record func(*ReconcileStats)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.tracked, hash)
+	record(&r.stats)
+}
+
+func (r *WalletReconciler) Stats() ReconcileStats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	stats := r.stats
+	stats.Tracked = len(r.tracked)
+	stats.Conflicts = append([]ReconcileConflict(nil), r.stats.Conflicts...)
+	stats.Abandoned = append([]types.BlockHash(nil), r.stats.Abandoned...)
+	return stats
+}
+
+// Checks Reconciler, for an Alarm.
+func CheckReconcile([]interface{}) {
+	Reconciler.Check()
+}
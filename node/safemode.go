@@ -0,0 +1,75 @@
+package node
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/utils"
+)
+
+var ErrSafeMode = errors.New("Node is in safe mode")
+
+// A SafeModeReport is what the node knew booting into safe mode, for
+// operators to work out why it kept crashing.
+type SafeModeReport struct {
+	Since time.Time
+	// Starts in a row that crashed
+	Crashes   int
+	LastPanic *utils.PanicRecord
+	// Why the store didn't open or the config didn't validate, empty if
+	// they were fine
+	StoreErr  string
+	ConfigErr string
+}
+
+// In safe mode the node only exchanges keepalives: no blocks, votes or
+// elections, and no bootstrapping in either direction. It stays up for
+// operators to read its report until ExitSafeMode.
+var safeMode struct {
+	sync.Mutex
+	active bool
+	report SafeModeReport
+}
+
+// Called after ExitSafeMode takes the node out of safe mode, e.g. to
+// clear the crash count and start what safe mode held back
+var OnSafeModeExit func()
+
+func EnterSafeMode(report SafeModeReport) {
+	safeMode.Lock()
+	defer safeMode.Unlock()
+	if report.Since.IsZero() {
+		report.Since = Clock.Now()
+	}
+	safeMode.active, safeMode.report = true, report
+}
+
+// ExitSafeMode returns the node to normal running. It's a no-op outside
+// safe mode.
+func ExitSafeMode() {
+	safeMode.Lock()
+	if !safeMode.active {
+		safeMode.Unlock()
+		return
+	}
+	safeMode.active = false
+	safeMode.Unlock()
+	if OnSafeModeExit != nil {
+		OnSafeModeExit()
+	}
+}
+
+func InSafeMode() bool {
+	safeMode.Lock()
+	defer safeMode.Unlock()
+	return safeMode.active
+}
+
+// SafeModeStatus is whether the node is in safe mode, and the report it
+// entered with.
+func SafeModeStatus() (bool, SafeModeReport) {
+	safeMode.Lock()
+	defer safeMode.Unlock()
+	return safeMode.active, safeMode.report
+}
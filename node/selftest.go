@@ -0,0 +1,389 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/protocol"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/frankh/nano/utils"
+)
+
+type CheckStatus int
+
+const (
+	CheckPass CheckStatus = iota
+	CheckWarn
+	CheckFail
+)
+
+func (s CheckStatus) String() string {
+	switch s {
+	case CheckPass:
+		return "PASS"
+	case CheckWarn:
+		return "WARN"
+	default:
+		return "FAIL"
+	}
+}
+
+type CheckResult struct {
+	Name     string
+	Status   CheckStatus
+	Detail   string
+	Duration time.Duration
+}
+
+// SelfTestReport is meant to be pasted into bug reports, so it never
+// holds keys, seeds or credentials.
+type SelfTestReport struct {
+	Started time.Time
+	Network string
+	Checks  []CheckResult
+}
+
+func (r SelfTestReport) Failed() bool {
+	for _, c := range r.Checks {
+		if c.Status == CheckFail {
+			return true
+		}
+	}
+	return false
+}
+
+func (r SelfTestReport) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "nano self test, %s network, %s\n", r.Network, r.Started.UTC().Format(time.RFC3339))
+	for _, c := range r.Checks {
+		fmt.Fprintf(&buf, "%-4s  %-20s %8s  %s\n", c.Status, c.Name, c.Duration.Round(time.Millisecond), c.Detail)
+	}
+	return buf.String()
+}
+
+type SelfTestConfig struct {
+	// Peers sent a keepalive, passing if any of them answers
+	Peers []Peer
+	// Work server URLs, only dialed
+	WorkServers []string
+	// Store round trips slower than this warn, and ten times it fail
+	StoreLatency time.Duration
+	// How long to wait on each network check
+	Timeout time.Duration
+}
+
+var DefaultSelfTestConfig = SelfTestConfig{
+	StoreLatency: 50 * time.Millisecond,
+	Timeout:      5 * time.Second,
+}
+
+// Seed and addresses from the official RaiBlocks wallet
+const selfTestSeed = "1234567890123456789012345678901234567890123456789012345678901234"
+
+var selfTestAddresses = []types.Account{
+	"nano_3iwi45me3cgo9aza9wx5f7rder37hw11xtc1ek8psqxw5oxb8cujjad6qp9y",
+	"nano_3a9d1h6wt3zp8cqd6dhhgoyizmk1ciemqkrw97ysrphn7anm6xko1wxakaa1",
+}
+
+type selfTestCheck struct {
+	name string
+	run  func(ctx context.Context, cfg SelfTestConfig) (CheckStatus, string)
+}
+
+var selfTestChecks = []selfTestCheck{
+	{"key_derivation", checkKeyDerivation},
+	{"work", checkWork},
+	{"block_signature", checkBlockSignature},
+	{"loopback_transaction", checkLoopbackTransaction},
+	{"store_latency", checkStoreLatency},
+	{"peers", checkPeers},
+	{"work_servers", checkWorkServers},
+}
+
+// SelfTest runs every check in turn, stopping early if ctx is done.
+// Nothing it does touches the running node's chain: blocks are made up
+// on the test network and only sent over loopback.
+func SelfTest(ctx context.Context, cfg SelfTestConfig) SelfTestReport {
+	report := SelfTestReport{Started: time.Now(), Network: networkName()}
+	guard := utils.NewGuard("selftest", len(selfTestChecks)+1)
+	for _, check := range selfTestChecks {
+		if ctx.Err() != nil {
+			report.Checks = append(report.Checks, CheckResult{check.name, CheckFail, "Cancelled", 0})
+			continue
+		}
+		start := time.Now()
+		var status CheckStatus
+		var detail string
+		err := guard.Call(func() { status, detail = check.run(ctx, cfg) })
+		if err != nil {
+			status, detail = CheckFail, err.Error()
+		}
+		report.Checks = append(report.Checks, CheckResult{check.name, status, detail, time.Since(start)})
+	}
+	return report
+}
+
+func networkName() string {
+	switch MagicNumber {
+	case LiveNetwork.MagicNumber:
+		return LiveNetwork.Name
+	case TestNetwork.MagicNumber:
+		return TestNetwork.Name
+	default:
+		return "private"
+	}
+}
+
+func checkKeyDerivation(ctx context.Context, cfg SelfTestConfig) (CheckStatus, string) {
+	for i, expected := range selfTestAddresses {
+		pub, _ := address.KeypairFromSeed(selfTestSeed, uint32(i))
+		if address.PubKeyToAddress(pub) != expected {
+			return CheckFail, fmt.Sprintf("Account %d doesn't match the reference wallet", i)
+		}
+	}
+	return CheckPass, fmt.Sprintf("%d reference accounts derived", len(selfTestAddresses))
+}
+
+// A throwaway keypair, never shown.
+func throwawayKey(index uint32) ([]byte, []byte) {
+	seed := make([]byte, 32)
+	rand.Read(seed)
+	pub, priv := address.KeypairFromSeed(hex.EncodeToString(seed), index)
+	return pub, priv
+}
+
+func testWork(root types.BlockHash) types.Work {
+	return blocks.GenerateWorkThreshold(root, protocol.WorkTestThreshold)
+}
+
+func checkWork(ctx context.Context, cfg SelfTestConfig) (CheckStatus, string) {
+	pub, _ := throwawayKey(0)
+	root := types.BlockHashFromBytes(pub)
+	start := time.Now()
+	work := testWork(root)
+	elapsed := time.Since(start)
+	if blocks.RootWorkValue(root, work) < protocol.WorkTestThreshold {
+		return CheckFail, "Generated work doesn't meet its threshold"
+	}
+	if elapsed > time.Second {
+		return CheckWarn, fmt.Sprintf("Test difficulty work took %s, live work will be very slow", elapsed)
+	}
+	return CheckPass, "Test difficulty work generated and validated"
+}
+
+func checkBlockSignature(ctx context.Context, cfg SelfTestConfig) (CheckStatus, string) {
+	pub, priv := throwawayKey(0)
+	account := address.PubKeyToAddress(pub)
+	block := &blocks.ChangeBlock{PreviousHash: types.BlockHashFromBytes(pub), Representative: account}
+	block.Signature = block.Hash().Sign(priv)
+	if !blocks.VerifyBlockSignature(block, pub) {
+		return CheckFail, "Signed block doesn't verify"
+	}
+	block.Representative = blocks.TestGenesisBlock.Account
+	if blocks.VerifyBlockSignature(block, pub) {
+		return CheckFail, "Changed block still verifies"
+	}
+	return CheckPass, "Signed and verified a block"
+}
+
+// Two loopback sockets stand in for a pair of nodes: one publishes a
+// send from the test genesis and the open receiving it, the other
+// decodes and checks them and asks for the open to be confirmed back.
+func checkLoopbackTransaction(ctx context.Context, cfg SelfTestConfig) (CheckStatus, string) {
+	pub, priv := throwawayKey(0)
+	account := address.PubKeyToAddress(pub)
+	genesisPub, genesisPriv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+
+	send := &blocks.SendBlock{
+		PreviousHash: blocks.TestGenesisBlock.Hash(),
+		Destination:  account,
+		Balance:      blocks.GenesisAmount.Sub(uint128.FromInts(0, 1)),
+	}
+	send.Work = testWork(send.RootHash())
+	send.Signature = send.Hash().Sign(genesisPriv)
+	open := &blocks.OpenBlock{SourceHash: send.Hash(), Representative: account, Account: account}
+	open.Work = testWork(open.RootHash())
+	open.Signature = open.Hash().Sign(priv)
+
+	a, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return CheckFail, err.Error()
+	}
+	defer a.Close()
+	b, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return CheckFail, err.Error()
+	}
+	defer b.Close()
+	deadline := time.Now().Add(cfg.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	a.SetDeadline(deadline)
+	b.SetDeadline(deadline)
+
+	for _, block := range []blocks.Block{send, open} {
+		m, err := CreatePublish(block)
+		if err != nil {
+			return CheckFail, err.Error()
+		}
+		var buf bytes.Buffer
+		m.Write(&buf)
+		_, err = a.WriteTo(buf.Bytes(), b.LocalAddr())
+		if err != nil {
+			return CheckFail, err.Error()
+		}
+	}
+
+	packet := make([]byte, packetSize)
+	for i, expected := range []blocks.Block{send, open} {
+		n, _, err := b.ReadFrom(packet)
+		if err != nil {
+			return CheckFail, "Publish not received over loopback: " + err.Error()
+		}
+		var m MessagePublish
+		err = m.Read(bytes.NewBuffer(packet[:n]))
+		if err != nil {
+			return CheckFail, err.Error()
+		}
+		block := m.ToBlock()
+		if block.Hash() != expected.Hash() || blocks.RootWorkValue(block.RootHash(), block.GetWork()) < protocol.WorkTestThreshold {
+			return CheckFail, fmt.Sprintf("Block %d changed in transit", i)
+		}
+		signer := genesisPub
+		if i == 1 {
+			signer = pub
+		}
+		if !blocks.VerifyBlockSignature(block, signer) {
+			return CheckFail, fmt.Sprintf("Block %d signature doesn't verify", i)
+		}
+	}
+
+	m, _ := CreatePublish(open)
+	req := MessageConfirmReq{m.MessageHeader, m.MessageBlock}
+	req.MessageHeader.MessageType = protocol.MessageConfirmReq
+	var buf bytes.Buffer
+	req.Write(&buf)
+	_, err = b.WriteTo(buf.Bytes(), a.LocalAddr())
+	if err != nil {
+		return CheckFail, err.Error()
+	}
+	n, _, err := a.ReadFrom(packet)
+	if err != nil {
+		return CheckFail, "Confirm request not received over loopback: " + err.Error()
+	}
+	var received MessageConfirmReq
+	err = received.Read(bytes.NewBuffer(packet[:n]))
+	if err != nil || received.ToBlock().Hash() != open.Hash() {
+		return CheckFail, "Bad confirm request for the open block"
+	}
+	return CheckPass, "Send and open published, verified and confirm requested over loopback"
+}
+
+func checkStoreLatency(ctx context.Context, cfg SelfTestConfig) (CheckStatus, string) {
+	if store.Conf == nil {
+		return CheckWarn, "Store not open"
+	}
+	key := []byte("selftest")
+	start := time.Now()
+	err := store.StoreMeta("selftest", key, time.Now().UnixNano())
+	var stored int64
+	if err == nil {
+		err = store.FetchMeta("selftest", key, &stored)
+	}
+	if err == nil {
+		err = store.DeleteMeta("selftest", key)
+	}
+	elapsed := time.Since(start)
+	if err != nil {
+		return CheckFail, err.Error()
+	}
+
+	detail := fmt.Sprintf("Write, read and delete took %s", elapsed.Round(time.Microsecond))
+	switch {
+	case elapsed > 10*cfg.StoreLatency:
+		return CheckFail, detail
+	case elapsed > cfg.StoreLatency:
+		return CheckWarn, detail
+	}
+	return CheckPass, detail
+}
+
+// Peers answer keepalives to the address they came from.
+func checkPeers(ctx context.Context, cfg SelfTestConfig) (CheckStatus, string) {
+	if len(cfg.Peers) == 0 {
+		return CheckWarn, "No peers configured"
+	}
+	if ProxyOnly {
+		return CheckWarn, "Udp is disabled in proxy only mode"
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return CheckFail, err.Error()
+	}
+	defer conn.Close()
+
+	var buf bytes.Buffer
+	CreateKeepAlive(nil).Write(&buf)
+	for _, peer := range cfg.Peers {
+		conn.WriteTo(buf.Bytes(), peer.Addr())
+	}
+
+	conn.SetReadDeadline(time.Now().Add(cfg.Timeout))
+	packet := make([]byte, packetSize)
+	for ctx.Err() == nil {
+		n, _, err := conn.ReadFrom(packet)
+		if err != nil {
+			return CheckWarn, fmt.Sprintf("None of %d peers answered within %s", len(cfg.Peers), cfg.Timeout)
+		}
+		var header MessageHeader
+		if header.ReadHeader(bytes.NewBuffer(packet[:n])) == nil {
+			return CheckPass, fmt.Sprintf("A peer answered, of %d tried", len(cfg.Peers))
+		}
+	}
+	return CheckFail, "Cancelled"
+}
+
+func checkWorkServers(ctx context.Context, cfg SelfTestConfig) (CheckStatus, string) {
+	if len(cfg.WorkServers) == 0 {
+		return CheckPass, "None configured"
+	}
+	var failed []string
+	for i, server := range cfg.WorkServers {
+		u, err := url.Parse(server)
+		if err != nil || u.Host == "" {
+			failed = append(failed, fmt.Sprintf("#%d: bad url", i+1))
+			continue
+		}
+		host := u.Host
+		if u.Port() == "" && u.Scheme == "https" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+		dialCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+		conn, err := dialOutbound(dialCtx, host)
+		cancel()
+		if err != nil {
+			// Never the url, which may hold credentials
+			failed = append(failed, err.Error())
+			continue
+		}
+		conn.Close()
+	}
+	if len(failed) > 0 {
+		return CheckFail, strings.Join(failed, "; ")
+	}
+	return CheckPass, fmt.Sprintf("%d reachable", len(cfg.WorkServers))
+}
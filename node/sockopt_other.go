@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package node
+
+import (
+	"errors"
+	"net"
+)
+
+func socketBuffers(conn *net.UDPConn) (read int, write int, err error) {
+	return 0, 0, errors.New("Reading socket buffer sizes is not supported on this platform")
+}
@@ -0,0 +1,278 @@
+package node
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/metrics"
+	"github.com/frankh/nano/store"
+)
+
+// Statuses of SyncMonitor
+const (
+	// Too few peers have reported to tell
+	SyncUnknown = "unknown"
+	SyncSynced  = "synced"
+	// The network has more blocks or more cemented than us
+	SyncBehind = "behind"
+	// We have more blocks than the network but aren't confirming any, so
+	// the ledger may have taken blocks the network didn't
+	SyncDiverged = "diverged"
+)
+
+const (
+	DefaultSyncBehindBlocks   = 10000
+	DefaultSyncBehindCemented = 10000
+	DefaultSyncMinPeers       = 3
+	DefaultSyncCheckInterval  = time.Minute
+)
+
+// Peers' reports older than this are left out
+const syncReportAge = 10 * time.Minute
+
+// How much more peers ahead of us weigh for bootstrap pulls while behind
+const syncAheadWeight = 4
+
+// Outliers are further from the median than this many median absolute
+// deviations, or than the lag allowed if that's more
+const syncOutlierDeviations = 3
+
+const syncDivergedAdvice = "Our ledger has more blocks than the network's while confirmations have stalled: verify the ledger"
+
+// A SyncStatus is how our ledger compares with the network's, as of the
+// last check.
+type SyncStatus struct {
+	Status  string
+	Local   store.LedgerCounts
+	Network store.LedgerCounts
+	// Peers the network's counts are the median of, and those left out
+	// as outliers
+	Peers    int
+	Outliers int
+	// When Status last changed
+	Since time.Time
+	// What to do about it, if anything
+	Advice string
+}
+
+type syncReport struct {
+	peer   Peer
+	counts store.LedgerCounts
+	at     time.Time
+}
+
+// SyncMonitor compares our ledger's counts with those verified peers
+// report, to notice when we fall behind or silently diverge. The network's
+// counts are the median of the peers' after leaving out outliers, so one
+// peer lying can't raise an alert.
+type SyncMonitor struct {
+	// Blocks and cemented blocks we can be short of the network's and still
+	// count as synced, or over it before counting as diverged
+	BehindBlocks   uint64
+	BehindCemented uint64
+	// Peers needed, after outliers, to tell
+	MinPeers int
+	// Our counts, store.Counts if nil
+	Local func() store.LedgerCounts
+
+	lock    sync.Mutex
+	reports map[string]syncReport
+	status  SyncStatus
+	// Peers ahead of us at the last check, to weigh up for bootstrapping
+	ahead map[string]bool
+	// Our cemented count at the last check, to tell if confirmations have
+	// stalled
+	cemented uint64
+	checked  bool
+}
+
+var Sync = &SyncMonitor{
+	BehindBlocks:   DefaultSyncBehindBlocks,
+	BehindCemented: DefaultSyncBehindCemented,
+	MinPeers:       DefaultSyncMinPeers,
+}
+
+// SetThresholds changes how far behind counts as behind, taking effect
+// at the next check.
+func (m *SyncMonitor) SetThresholds(blocks uint64, cemented uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.BehindBlocks, m.BehindCemented = blocks, cemented
+}
+
+// Report records a peer's counts, e.g. from its telemetry. Only peers
+// whose node key is verified are counted, so false is returned for the
+// rest.
+func (m *SyncMonitor) Report(peer Peer, counts store.LedgerCounts) bool {
+	if _, ok := verifiedKey(peer); !ok {
+		return false
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.reports == nil {
+		m.reports = make(map[string]syncReport)
+	}
+	m.reports[peer.String()] = syncReport{peer, counts, Clock.Now()}
+	return true
+}
+
+// The lower median, so it's always a value a peer reported.
+func median(values []uint64) uint64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]uint64{}, values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[(len(sorted)-1)/2]
+}
+
+func distance(a uint64, b uint64) uint64 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// Which values are further from their median than the spread allowed.
+func outliers(values []uint64, tolerance uint64) []bool {
+	mid := median(values)
+	deviations := make([]uint64, len(values))
+	for i, v := range values {
+		deviations[i] = distance(v, mid)
+	}
+	spread := syncOutlierDeviations * median(deviations)
+	if spread < tolerance {
+		spread = tolerance
+	}
+	result := make([]bool, len(values))
+	for i, d := range deviations {
+		result[i] = d > spread
+	}
+	return result
+}
+
+// The median of recent reports, leaving out peers that are outliers in
+// any count.
+func (m *SyncMonitor) network() (counts store.LedgerCounts, kept []syncReport, dropped int) {
+	var recent []syncReport
+	for key, r := range m.reports {
+		if Clock.Now().Sub(r.at) > syncReportAge {
+			delete(m.reports, key)
+			continue
+		}
+		recent = append(recent, r)
+	}
+	if len(recent) == 0 {
+		return counts, nil, 0
+	}
+	field := func(reports []syncReport, get func(store.LedgerCounts) uint64) []uint64 {
+		values := make([]uint64, len(reports))
+		for i, r := range reports {
+			values[i] = get(r.counts)
+		}
+		return values
+	}
+	getBlocks := func(c store.LedgerCounts) uint64 { return c.Blocks }
+	getCemented := func(c store.LedgerCounts) uint64 { return c.Cemented }
+	getAccounts := func(c store.LedgerCounts) uint64 { return c.Accounts }
+
+	blocks := outliers(field(recent, getBlocks), m.BehindBlocks)
+	cemented := outliers(field(recent, getCemented), m.BehindCemented)
+	accounts := outliers(field(recent, getAccounts), m.BehindBlocks)
+	for i, r := range recent {
+		if blocks[i] || cemented[i] || accounts[i] {
+			dropped++
+			continue
+		}
+		kept = append(kept, r)
+	}
+	counts = store.LedgerCounts{
+		Blocks:   median(field(kept, getBlocks)),
+		Cemented: median(field(kept, getCemented)),
+		Accounts: median(field(kept, getAccounts)),
+	}
+	return counts, kept, dropped
+}
+
+// Check compares our counts with the network's, logging and publishing a
+// sync_status event when the status changes.
+func (m *SyncMonitor) Check() {
+	local := m.Local
+	if local == nil {
+		local = store.Counts
+	}
+	counts := local()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	network, kept, dropped := m.network()
+	stalled := m.checked && counts.Cemented <= m.cemented
+	m.cemented, m.checked = counts.Cemented, true
+
+	status := SyncStatus{Local: counts, Network: network, Peers: len(kept), Outliers: dropped}
+	m.ahead = make(map[string]bool)
+	switch {
+	case len(kept) == 0 || len(kept) < m.MinPeers:
+		status.Status = SyncUnknown
+	case network.Blocks > counts.Blocks+m.BehindBlocks || network.Cemented > counts.Cemented+m.BehindCemented:
+		status.Status = SyncBehind
+		for _, r := range kept {
+			if r.counts.Blocks > counts.Blocks || r.counts.Cemented > counts.Cemented {
+				m.ahead[r.peer.String()] = true
+			}
+		}
+	case counts.Blocks > network.Blocks+m.BehindBlocks && stalled:
+		status.Status = SyncDiverged
+		status.Advice = syncDivergedAdvice
+	default:
+		status.Status = SyncSynced
+	}
+
+	status.Since = m.status.Since
+	if status.Status != m.status.Status {
+		status.Since = Clock.Now()
+		if m.status.Status != "" || status.Status != SyncUnknown {
+			log.Printf("Sync status %s: %d blocks and %d cemented, the network has %d and %d", status.Status,
+				counts.Blocks, counts.Cemented, network.Blocks, network.Cemented)
+			Events.Publish(Event{Type: EventSyncStatus, Status: status.Status, Count: len(kept)})
+		}
+	}
+	m.status = status
+}
+
+// Status is the result of the last check.
+func (m *SyncMonitor) Status() SyncStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.status.Status == "" {
+		return SyncStatus{Status: SyncUnknown}
+	}
+	return m.status
+}
+
+// Ahead is whether we're behind and peer reported more than us, so should
+// be pulled from first.
+func (m *SyncMonitor) Ahead(peer Peer) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.ahead[peer.String()]
+}
+
+// Checks Sync, for an Alarm.
+func CheckSync([]interface{}) {
+	Sync.Check()
+}
+
+var syncStatusGauge = metrics.NewGaugeFunc("nano_sync_status", "Whether the ledger is synced with, behind or diverged from its peers', by status.", "status", func() map[string]float64 {
+	current := Sync.Status().Status
+	series := make(map[string]float64)
+	for _, status := range []string{SyncUnknown, SyncSynced, SyncBehind, SyncDiverged} {
+		series[status] = 0
+		if status == current {
+			series[status] = 1
+		}
+	}
+	return series
+})
@@ -0,0 +1,24 @@
+package node
+
+import (
+	"time"
+
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/utils"
+)
+
+// Swapped out in tests to simulate clock steps
+var Clock utils.Clock = utils.SystemClock{}
+
+// Monotonic offsets are only comparable within one process run
+var session = time.Now().UnixNano()
+
+func now() store.Timestamp {
+	return store.Timestamp{Clock.Now().UnixNano(), session, int64(Clock.Monotonic())}
+}
+
+// Records when a block was first seen, returning that time.
+func observeBlock(hash types.BlockHash) store.Timestamp {
+	return store.StoreTimestamp(hash, now())
+}
@@ -0,0 +1,189 @@
+package node
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Socket buffer sizes requested for the udp listener. 0 keeps the OS
+// default.
+var UdpReadBuffer = 0
+var UdpWriteBuffer = 0
+
+const DropSampleInterval = 10 * time.Second
+
+// Kernel drop warnings are logged at most this often
+const DropWarningInterval = 5 * time.Minute
+
+// Where kernel udp drop counters are read from, on Linux
+var procNetUdp = []string{"/proc/net/udp", "/proc/net/udp6"}
+
+var errNoDropCounters = errors.New("No kernel drop counters for socket")
+
+// Called when the kernel has dropped datagrams since the last sample,
+// rate limited by DropWarningInterval.
+var OnUdpDrops = func(dropped uint64, stats UdpSocketStats) {
+	log.Printf("Kernel dropped %d udp packets; consider raising the receive buffer (granted %d bytes) or adding packet workers", dropped, stats.ReadBufferActual)
+}
+
+type UdpSocketStats struct {
+	ReadBufferRequested  int
+	ReadBufferActual     int
+	WriteBufferRequested int
+	WriteBufferActual    int
+	// Datagrams the kernel dropped on our socket, -1 where unknown
+	KernelDrops int64
+}
+
+var udpStats = struct {
+	lock  sync.Mutex
+	stats UdpSocketStats
+}{stats: UdpSocketStats{KernelDrops: -1}}
+
+func GetUdpSocketStats() UdpSocketStats {
+	udpStats.lock.Lock()
+	defer udpStats.lock.Unlock()
+	return udpStats.stats
+}
+
+// Applies the requested buffer sizes and records what the kernel
+// actually granted, which may be clamped or, on Linux, doubled.
+func configureUdpSocket(conn *net.UDPConn, read, write int) UdpSocketStats {
+	stats := UdpSocketStats{
+		ReadBufferRequested:  read,
+		WriteBufferRequested: write,
+		KernelDrops:          -1,
+	}
+	if read > 0 {
+		if err := conn.SetReadBuffer(read); err != nil {
+			log.Printf("Failed to set udp receive buffer to %d: %s", read, err)
+		}
+	}
+	if write > 0 {
+		if err := conn.SetWriteBuffer(write); err != nil {
+			log.Printf("Failed to set udp send buffer to %d: %s", write, err)
+		}
+	}
+
+	var err error
+	stats.ReadBufferActual, stats.WriteBufferActual, err = socketBuffers(conn)
+	if err != nil {
+		log.Printf("Unable to read udp buffer sizes: %s", err)
+	} else {
+		log.Printf("Udp buffers: receive %d bytes (requested %d), send %d bytes (requested %d)",
+			stats.ReadBufferActual, read, stats.WriteBufferActual, write)
+	}
+
+	udpStats.lock.Lock()
+	udpStats.stats = stats
+	udpStats.lock.Unlock()
+	return stats
+}
+
+// Parses /proc/net/udp or /proc/net/udp6, summing the drop counters of
+// sockets bound to port.
+func parseProcNetUdp(r io.Reader, port uint16) (drops uint64, found bool, err error) {
+	scanner := bufio.NewScanner(r)
+	// Header
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 13 {
+			return 0, false, errors.New("Bad udp socket line")
+		}
+		local := strings.Split(fields[1], ":")
+		if len(local) != 2 {
+			return 0, false, errors.New("Bad udp local address")
+		}
+		localPort, err := strconv.ParseUint(local[1], 16, 16)
+		if err != nil {
+			return 0, false, err
+		}
+		if uint16(localPort) != port {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[12], 10, 64)
+		if err != nil {
+			return 0, false, err
+		}
+		drops += n
+		found = true
+	}
+	return drops, found, scanner.Err()
+}
+
+func readKernelDrops(port uint16) (uint64, error) {
+	var total uint64
+	any := false
+	for _, path := range procNetUdp {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		drops, found, err := parseProcNetUdp(f, port)
+		f.Close()
+		if err != nil {
+			return 0, err
+		}
+		total += drops
+		any = any || found
+	}
+	if !any {
+		return 0, errNoDropCounters
+	}
+	return total, nil
+}
+
+type dropSampler struct {
+	read        func() (uint64, error)
+	last        uint64
+	sampled     bool
+	lastWarning time.Time
+}
+
+// Records the current drop count, warning if it rose. Returns false
+// once counters turn out to be unavailable.
+func (s *dropSampler) sample(now time.Time) bool {
+	drops, err := s.read()
+	if err != nil {
+		return false
+	}
+
+	udpStats.lock.Lock()
+	udpStats.stats.KernelDrops = int64(drops)
+	stats := udpStats.stats
+	udpStats.lock.Unlock()
+
+	// Drops are counted from the last warning, so those seen while
+	// rate limited are reported with the next one
+	switch {
+	case !s.sampled || drops < s.last:
+		s.last = drops
+	case drops > s.last && now.Sub(s.lastWarning) >= DropWarningInterval:
+		OnUdpDrops(drops-s.last, stats)
+		s.last = drops
+		s.lastWarning = now
+	}
+	s.sampled = true
+	return true
+}
+
+func sampleUdpDrops(port uint16) {
+	s := dropSampler{read: func() (uint64, error) { return readKernelDrops(port) }}
+	if !s.sample(time.Now()) {
+		return
+	}
+	for range time.Tick(DropSampleInterval) {
+		if !s.sample(time.Now()) {
+			return
+		}
+	}
+}
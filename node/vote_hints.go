@@ -0,0 +1,224 @@
+package node
+
+import (
+	"sync"
+	"time"
+
+	"github.com/frankh/crypto/ed25519"
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/metrics"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+)
+
+const maxVoteHints = 10000
+const voteHintTTL = 5 * time.Minute
+const weightRefresh = time.Minute
+
+// A vote for a block we couldn't store yet.
+type VoteHint struct {
+	Rep    types.Account
+	At     store.Timestamp
+	Weight uint128.Uint128
+}
+
+type VoteHintStats struct {
+	Hashes int
+	// Elections started with hinted votes
+	Hits    int
+	Expired int
+}
+
+// Holds votes for unknown blocks until the block arrives and its election
+// starts, so the quorum they carry isn't lost.
+type voteHintCache struct {
+	lock  sync.Mutex
+	max   int
+	ttl   time.Duration
+	hints map[types.BlockHash][]VoteHint
+	// Hashes oldest first, for evicting once full
+	order  []types.BlockHash
+	pulled map[types.BlockHash]bool
+	stats  VoteHintStats
+}
+
+func newVoteHintCache(max int, ttl time.Duration) *voteHintCache {
+	return &voteHintCache{
+		max:    max,
+		ttl:    ttl,
+		hints:  make(map[types.BlockHash][]VoteHint),
+		pulled: make(map[types.BlockHash]bool),
+	}
+}
+
+var voteHints = newVoteHintCache(maxVoteHints, voteHintTTL)
+
+// Called once for a hash when the hinted weight for it reaches
+// LazyPullWeight: the network clearly has the block and we don't. Nil
+// disables the trigger.
+var LazyPull func(hash types.BlockHash)
+
+// 10^36 raw
+var LazyPullWeight = uint128.FromInts(0xc097ce7bc90715, 0xb34b9f1000000000)
+
+func (c *voteHintCache) evict() {
+	hash := c.order[0]
+	c.order = c.order[1:]
+	delete(c.hints, hash)
+	delete(c.pulled, hash)
+}
+
+// Records a hint, returning the total hinted weight for hash. A rep's
+// repeated vote replaces its earlier one.
+func (c *voteHintCache) add(hash types.BlockHash, hint VoteHint) uint128.Uint128 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	hints, ok := c.hints[hash]
+	if !ok {
+		if len(c.order) >= c.max {
+			c.evict()
+		}
+		c.order = append(c.order, hash)
+	}
+
+	total := hint.Weight
+	replaced := false
+	for i, h := range hints {
+		if h.Rep == hint.Rep {
+			hints[i] = hint
+			replaced = true
+		} else {
+			total = total.Add(h.Weight)
+		}
+	}
+	if !replaced {
+		hints = append(hints, hint)
+	}
+	c.hints[hash] = hints
+	return total
+}
+
+// Removes and returns the hints for hash that are still fresh at t.
+func (c *voteHintCache) take(hash types.BlockHash, t time.Time) []VoteHint {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	hints, ok := c.hints[hash]
+	if !ok {
+		return nil
+	}
+	delete(c.hints, hash)
+	delete(c.pulled, hash)
+	for i, h := range c.order {
+		if h == hash {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+
+	var fresh []VoteHint
+	for _, h := range hints {
+		if t.Sub(h.At.Time()) > c.ttl {
+			c.stats.Expired++
+			continue
+		}
+		fresh = append(fresh, h)
+	}
+	if len(fresh) > 0 {
+		c.stats.Hits++
+	}
+	return fresh
+}
+
+// Returns true the first time it's called for hash.
+func (c *voteHintCache) pull(hash types.BlockHash) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.pulled[hash] || c.hints[hash] == nil {
+		return false
+	}
+	c.pulled[hash] = true
+	return true
+}
+
+func (c *voteHintCache) len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.order)
+}
+
+// Forgets the oldest hashes over the new size.
+func (c *voteHintCache) setMax(max int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.max = max
+	for len(c.order) > max {
+		c.evict()
+	}
+}
+
+func (c *voteHintCache) getStats() VoteHintStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stats := c.stats
+	stats.Hashes = len(c.order)
+	return stats
+}
+
+func GetVoteHintStats() VoteHintStats {
+	return voteHints.getStats()
+}
+
+// Representative weights, recomputed at most every weightRefresh since
+// it means scanning the store.
+var weights struct {
+	sync.Mutex
+	byRep   map[types.Account]uint128.Uint128
+	updated time.Time
+}
+
+func repWeight(rep types.Account) uint128.Uint128 {
+	weights.Lock()
+	defer weights.Unlock()
+
+	if weights.byRep == nil || Clock.Now().Sub(weights.updated) > weightRefresh {
+		weights.byRep = make(map[types.Account]uint128.Uint128)
+		for _, w := range store.RepresentativeWeights() {
+			weights.byRep[w.Representative] = w.Weight
+		}
+		weights.updated = Clock.Now()
+	}
+	return weights.byRep[rep]
+}
+
+func voteRep(vote *MessageVote) types.Account {
+	return address.PubKeyToAddress(ed25519.PublicKey(vote.Account[:]))
+}
+
+// Keeps a vote for a block that couldn't be stored, asking for the block
+// once enough weight has voted for it.
+func hintVote(hash types.BlockHash, vote *MessageVote) {
+	rep := voteRep(vote)
+	total := voteHints.add(hash, VoteHint{rep, now(), repWeight(rep)})
+	if LazyPull != nil && total.Compare(LazyPullWeight) >= 0 && voteHints.pull(hash) {
+		LazyPull(hash)
+	}
+}
+
+// Starts tracking the election for a block, counting votes that arrived
+// before it.
+func startElection(hash types.BlockHash, ts store.Timestamp) {
+	if InSafeMode() {
+		return
+	}
+	Processor.Tracer.Record(hash, metrics.StageElection)
+	confirmations.seen(hash, ts)
+	if hints := voteHints.take(hash, ts.Time()); len(hints) > 0 && confirmations.hinted(hash, hints, quorumWeight()) {
+		publishConfirmation(hash)
+	}
+}
@@ -0,0 +1,150 @@
+package node
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/frankh/crypto/ed25519"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+)
+
+// Formats of a vote history report
+const (
+	VoteReportJSON = "json"
+	VoteReportCSV  = "csv"
+)
+
+var ErrBadReportFormat = errors.New("Bad report format")
+var ErrBadReportSignature = errors.New("Bad report signature")
+
+// Whether votes from representatives with weight are kept for
+// ExportVoteHistory
+var RecordVotes = true
+
+// A VoteReport is vote history signed by the node's identity key, so
+// whoever it's passed to can check it came from the node with NodeID.
+type VoteReport struct {
+	Format string
+	Body   []byte
+	// Hex of the node's public key, and of its signature of Body
+	NodeID    string
+	Signature string
+}
+
+// What a JSON report holds. A CSV report has the same, the range on its
+// first row.
+type voteReportBody struct {
+	NodeID         string             `json:"node_id"`
+	Representative types.Account      `json:"representative,omitempty"`
+	From           time.Time          `json:"from"`
+	To             time.Time          `json:"to"`
+	Votes          []store.VoteRecord `json:"votes"`
+	Hours          []store.VoteHour   `json:"hours"`
+}
+
+func recordVote(block blocks.Block, vote Vote) {
+	if !RecordVotes {
+		return
+	}
+	record := store.VoteRecord{
+		Root:           block.RootHash(),
+		Hash:           block.Hash(),
+		Representative: vote.Account,
+		Timestamp:      vote.Timestamp,
+		Sequence:       vote.Sequence,
+		Received:       Clock.Now(),
+	}
+	store.StoreVote(record)
+}
+
+// ExportVoteHistory reports the votes kept that were received from from
+// up to to, with the hourly counts over the range, in format. They're
+// only rep's if it's set.
+func ExportVoteHistory(rep types.Account, from time.Time, to time.Time, format string) (VoteReport, error) {
+	votes, hours, err := store.VoteHistory(rep, from, to)
+	if err != nil {
+		return VoteReport{}, err
+	}
+	report := voteReportBody{strings.ToUpper(hex.EncodeToString(NodeID)), rep, from.UTC(), to.UTC(), votes, hours}
+	if report.Votes == nil {
+		report.Votes = []store.VoteRecord{}
+	}
+	if report.Hours == nil {
+		report.Hours = []store.VoteHour{}
+	}
+
+	var body []byte
+	switch format {
+	case VoteReportJSON:
+		body, err = json.Marshal(report)
+	case VoteReportCSV:
+		body, err = report.csv()
+	default:
+		return VoteReport{}, ErrBadReportFormat
+	}
+	if err != nil {
+		return VoteReport{}, err
+	}
+	return VoteReport{
+		Format:    format,
+		Body:      body,
+		NodeID:    report.NodeID,
+		Signature: strings.ToUpper(hex.EncodeToString(ed25519.Sign(NodeKey, body))),
+	}, nil
+}
+
+// A row for the report's range, then one per vote and per hour, each
+// row's kind first.
+func (r voteReportBody) csv() ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	format := func(t time.Time) string {
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	w.Write([]string{"report", r.NodeID, string(r.Representative), format(r.From), format(r.To), "", "", ""})
+	w.Write([]string{"kind", "time", "representative", "root", "hash", "timestamp", "sequence", "votes"})
+	for _, v := range r.Votes {
+		w.Write([]string{"vote", format(v.Received), string(v.Representative), string(v.Root), string(v.Hash),
+			strconv.FormatUint(v.Timestamp, 10), strconv.FormatUint(v.Sequence, 10), ""})
+	}
+	for _, h := range r.Hours {
+		w.Write([]string{"hour", format(h.Hour), string(h.Representative), "", "", "", "", strconv.FormatUint(h.Votes, 10)})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// VerifyVoteReport checks body was signed by the node with the hex
+// nodeID.
+func VerifyVoteReport(body []byte, nodeID string, signature string) error {
+	key, err := hex.DecodeString(nodeID)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return ErrBadReportSignature
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize || !ed25519.Verify(ed25519.PublicKey(key), body, sig) {
+		return ErrBadReportSignature
+	}
+	return nil
+}
+
+// VoteCompactionJob drops per root votes older than retention every
+// interval, a batch per slice, keeping the hourly counts.
+func VoteCompactionJob(retention time.Duration, interval time.Duration) MaintenanceJob {
+	return MaintenanceJob{
+		Name:  "vote_compaction",
+		Every: interval,
+		Slice: func() (bool, error) {
+			_, done := store.CompactVotes(retention, Clock.Now())
+			return done, nil
+		},
+	}
+}
@@ -0,0 +1,121 @@
+package node
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/types"
+)
+
+// Minimum time between our votes on the same root
+const DefaultVoteSpacing = 15 * time.Second
+const maxTrackedRoots = 10000
+const maxTrackedVotes = 50000
+
+type lastVote struct {
+	hash types.BlockHash
+	at   time.Duration
+}
+
+// VoteSpacing stops a representative voting on the same root more
+// often than the spacing interval.
+type VoteSpacing struct {
+	lock     sync.Mutex
+	interval time.Duration
+	max      int
+	votes    map[types.BlockHash]lastVote
+	// Roots oldest first, for evicting once full
+	order []types.BlockHash
+}
+
+func NewVoteSpacing(interval time.Duration, max int) *VoteSpacing {
+	return &VoteSpacing{
+		interval: interval,
+		max:      max,
+		votes:    make(map[types.BlockHash]lastVote),
+	}
+}
+
+// Returns whether we may vote for hash on root now, and if so records
+// the vote. Within the interval an identical vote is always suppressed,
+// and a vote for a different candidate is only allowed when switching
+// is set by the election deciding the winner changed.
+func (s *VoteSpacing) Vote(root types.BlockHash, hash types.BlockHash, switching bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := Clock.Monotonic()
+	last, ok := s.votes[root]
+	if ok && now-last.at < s.interval {
+		if last.hash == hash || !switching {
+			return false
+		}
+	}
+
+	if !ok {
+		if len(s.order) >= s.max {
+			delete(s.votes, s.order[0])
+			s.order = s.order[1:]
+		}
+		s.order = append(s.order, root)
+	}
+	s.votes[root] = lastVote{hash, now}
+	return true
+}
+
+// Remembers recently seen keys, forgetting the oldest once full.
+type recentSet struct {
+	lock  sync.Mutex
+	max   int
+	seen  map[string]bool
+	order []string
+}
+
+func newRecentSet(max int) *recentSet {
+	return &recentSet{max: max, seen: make(map[string]bool)}
+}
+
+// Returns false if key was already in the set.
+func (r *recentSet) add(key string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.seen[key] {
+		return false
+	}
+
+	if len(r.order) >= r.max {
+		delete(r.seen, r.order[0])
+		r.order = r.order[1:]
+	}
+	r.seen[key] = true
+	r.order = append(r.order, key)
+	return true
+}
+
+func (r *recentSet) len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.order)
+}
+
+// Forgets the oldest keys over the new size.
+func (r *recentSet) setMax(max int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.max = max
+	for len(r.order) > max {
+		delete(r.seen, r.order[0])
+		r.order = r.order[1:]
+	}
+}
+
+var rebroadcastVotes = newRecentSet(maxTrackedVotes)
+
+// Returns whether a vote from another representative should be flooded
+// on to our peers, which is only the first time we see it.
+func ShouldRebroadcast(vote *MessageVote) bool {
+	return rebroadcastVotes.add(hex.EncodeToString(vote.Account[:]) + hex.EncodeToString(vote.Hash()))
+}
@@ -0,0 +1,30 @@
+package node
+
+import (
+	"context"
+	"encoding/hex"
+	"runtime"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+)
+
+// ValidateWork checks work, in the order MessageBlockCommon holds it,
+// meets the network's threshold for a block with root.
+func ValidateWork(root [32]byte, work [8]byte) bool {
+	value := blocks.RootWorkValue(types.BlockHashFromBytes(root[:]), types.Work(hex.EncodeToString(work[:])))
+	return value >= blocks.WorkThreshold
+}
+
+// GenerateWork finds work for root meeting the network's threshold, on
+// GOMAXPROCS goroutines, giving up with ctx's error once it's done.
+func GenerateWork(ctx context.Context, root [32]byte) ([8]byte, error) {
+	var work [8]byte
+	found, err := blocks.GenerateWorkParallel(ctx, types.BlockHashFromBytes(root[:]), blocks.WorkThreshold, runtime.GOMAXPROCS(0))
+	if err != nil {
+		return work, err
+	}
+	decoded, _ := hex.DecodeString(string(found))
+	copy(work[:], decoded)
+	return work, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// The generated file must match the table, so nobody edits it by hand.
+func TestGeneratedUpToDate(t *testing.T) {
+	def, err := ioutil.ReadFile("../protocol.def")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := generate(def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, _ := ioutil.ReadFile("../protocol_gen.go")
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("protocol_gen.go is out of date with protocol.def, run go generate ./protocol")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, def := range []string{"message keepalive", "colour red 1", "magic live R", "capability x confirm_ack", "capability x nope 6", "message confirm_ack 5\ncapability x confirm_ack v6"} {
+		if _, err := generate([]byte(def)); err == nil {
+			t.Errorf("Expected error for %q", def)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Generates protocol_gen.go from protocol.def. Run with go generate in
+// the protocol directory.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+)
+
+type kind struct {
+	prefix string
+	typ    string
+	// Name of the generated name lookup, if any
+	lookup string
+}
+
+var kinds = map[string]kind{
+	"message": {"Message", "byte", "MessageTypeName"},
+	"block":   {"BlockType", "byte", "BlockTypeName"},
+	"version": {"Version", "byte", ""},
+	"work":    {"Work", "uint64", ""},
+	"magic":   {"Magic", "[2]byte", ""},
+	// Changes to a message's encoding, with the message they apply to
+	"capability": {"Capability", "Capability", ""},
+}
+
+// Output order of the kinds
+var kindOrder = []string{"message", "block", "version", "work", "magic", "capability"}
+
+type entry struct {
+	name  string
+	value string
+	// The message type of a capability
+	message string
+}
+
+func camel(name string) string {
+	parts := strings.Split(name, "_")
+	for i, p := range parts {
+		parts[i] = strings.ToUpper(p[:1]) + p[1:]
+	}
+	return strings.Join(parts, "")
+}
+
+func parse(def []byte) (map[string][]entry, error) {
+	entries := make(map[string][]entry)
+	scanner := bufio.NewScanner(bytes.NewReader(def))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) > 0 && fields[0] == "capability" {
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("Line %d: expected capability, name, message and version", line)
+			}
+			if !hasEntry(entries["message"], fields[2]) {
+				return nil, fmt.Errorf("Line %d: unknown message %s", line, fields[2])
+			}
+			if _, err := strconv.ParseUint(fields[3], 0, 8); err != nil {
+				return nil, fmt.Errorf("Line %d: bad version %s", line, fields[3])
+			}
+			entries["capability"] = append(entries["capability"], entry{fields[1], fields[3], fields[2]})
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Line %d: expected kind, name and value", line)
+		}
+		if _, ok := kinds[fields[0]]; !ok {
+			return nil, fmt.Errorf("Line %d: unknown kind %s", line, fields[0])
+		}
+		if fields[0] == "magic" && len(fields[2]) != 2 {
+			return nil, fmt.Errorf("Line %d: magic numbers are two characters", line)
+		}
+		entries[fields[0]] = append(entries[fields[0]], entry{name: fields[1], value: fields[2]})
+	}
+	return entries, scanner.Err()
+}
+
+func hasEntry(entries []entry, name string) bool {
+	for _, e := range entries {
+		if e.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func generate(def []byte) ([]byte, error) {
+	entries, err := parse(def)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by protocol/gen from protocol.def. DO NOT EDIT.\n\npackage protocol\n\nimport \"fmt\"\n")
+
+	for _, name := range kindOrder {
+		k := kinds[name]
+		if len(entries[name]) == 0 {
+			continue
+		}
+
+		if k.typ == "[2]byte" {
+			buf.WriteString("\nvar (\n")
+			for _, e := range entries[name] {
+				fmt.Fprintf(&buf, "%s%s = [2]byte{'%c', '%c'}\n", k.prefix, camel(e.name), e.value[0], e.value[1])
+			}
+			buf.WriteString(")\n")
+			continue
+		}
+
+		if k.typ == "Capability" {
+			buf.WriteString("\nvar (\n")
+			for _, e := range entries[name] {
+				fmt.Fprintf(&buf, "%s%s = Capability{%q, Message%s, %s}\n", k.prefix, camel(e.name), e.name, camel(e.message), e.value)
+			}
+			buf.WriteString(")\n")
+			buf.WriteString("\n// By the message type they change\nvar capabilities = map[byte][]Capability{\n")
+			for _, message := range entries["message"] {
+				var names []string
+				for _, e := range entries[name] {
+					if e.message == message.name {
+						names = append(names, k.prefix+camel(e.name))
+					}
+				}
+				if len(names) > 0 {
+					fmt.Fprintf(&buf, "Message%s: {%s},\n", camel(message.name), strings.Join(names, ", "))
+				}
+			}
+			buf.WriteString("}\n")
+			continue
+		}
+
+		buf.WriteString("\nconst (\n")
+		for _, e := range entries[name] {
+			fmt.Fprintf(&buf, "%s%s %s = %s\n", k.prefix, camel(e.name), k.typ, e.value)
+		}
+		buf.WriteString(")\n")
+
+		if k.lookup == "" {
+			continue
+		}
+		names := strings.ToLower(k.prefix[:1]) + k.prefix[1:] + "Names"
+		fmt.Fprintf(&buf, "\nvar %s = map[%s]string{\n", names, k.typ)
+		for _, e := range entries[name] {
+			fmt.Fprintf(&buf, "%s%s: %q,\n", k.prefix, camel(e.name), e.name)
+		}
+		buf.WriteString("}\n")
+		fmt.Fprintf(&buf, "\n// For logs, metric labels and errors.\nfunc %s(t %s) string {\nif name, ok := %s[t]; ok {\nreturn name\n}\nreturn fmt.Sprintf(\"unknown_%%d\", t)\n}\n", k.lookup, k.typ, names)
+	}
+
+	return format.Source(buf.Bytes())
+}
+
+func main() {
+	def, err := ioutil.ReadFile("protocol.def")
+	if err != nil {
+		log.Fatal(err)
+	}
+	out, err := generate(def)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ioutil.WriteFile("protocol_gen.go", out, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
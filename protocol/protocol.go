@@ -0,0 +1,23 @@
+// Package protocol holds the constants of the nano wire protocol.
+package protocol
+
+//go:generate go run ./gen
+
+// A Capability is a change to how a message is encoded, which only peers
+// speaking Version or later understand. While the network moves over,
+// messages are encoded for each peer by the version it speaks.
+type Capability struct {
+	Name        string
+	MessageType byte
+	Version     byte
+}
+
+// Whether a peer speaking version understands c.
+func (c Capability) SupportedBy(version byte) bool {
+	return version >= c.Version
+}
+
+// MessageCapabilities lists the encoding changes to a message type.
+func MessageCapabilities(messageType byte) []Capability {
+	return capabilities[messageType]
+}
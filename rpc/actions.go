@@ -0,0 +1,818 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/metrics"
+	"github.com/frankh/nano/node"
+	"github.com/frankh/nano/rpcclient"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/frankh/nano/utils"
+	"github.com/frankh/nano/wallet"
+	"github.com/pkg/errors"
+)
+
+// Blocks read by one account_activity call at most
+const MaxActivityBlocks = 100000
+
+func registerActions(s *Server) {
+	s.Handle("account_activity", true, accountActivity)
+	s.Handle("account_history", false, accountHistory)
+	s.Handle("account_info", false, accountInfo)
+	s.Handle("block_explain", false, s.blockExplain)
+	s.Handle("block_info", false, s.blockInfo)
+	s.Handle("bootstrap_status", false, bootstrapStatus)
+	s.Handle("disk_space", false, diskSpace)
+	s.Handle("events_ack", false, s.eventsAck)
+	s.Handle("fork_proof", false, forkProof)
+	s.Handle("maintenance_run", true, maintenanceRun)
+	s.Handle("maintenance_status", false, maintenanceStatus)
+	s.Handle("memory", false, memory)
+	s.Handle("payment_status", false, s.paymentStatus)
+	s.Handle("peers", false, peers)
+	s.Handle("pending", false, pending)
+	s.Handle("process", false, process)
+	s.Handle("representatives", false, representatives)
+	s.Handle("representatives_recommended", false, representativesRecommended)
+	s.Handle("safe_mode", false, safeMode)
+	s.Handle("safe_mode_exit", true, safeModeExit)
+	s.Handle("sync_status", false, syncStatus)
+	s.Handle("trace", false, trace)
+	s.Handle("unchecked", false, unchecked)
+	s.Handle("vote_history", false, voteHistory)
+	s.Handle("webhooks", true, webhooks)
+}
+
+func accountInfo(req Request) (interface{}, error) {
+	account, err := address.Parse(req["account"])
+	if err != nil {
+		return nil, rpcclient.ErrBadAccount
+	}
+
+	status := store.GetAccountStatus(account)
+	receivable := Object{
+		{"receivable", Amount(status.ReceivableTotal)},
+		{"receivable_blocks", strconv.Itoa(len(status.Receivable))},
+	}
+
+	switch status.State {
+	case store.AccountUnknown:
+		return nil, rpcclient.ErrAccountNotFound
+	case store.AccountPendingOnly:
+		// Funds sent to an account that was never opened
+		return append(Object{{"error", rpcclient.ErrAccountNotFound.Error()}}, receivable...), nil
+	}
+
+	info := Object{
+		{"frontier", status.Frontier},
+		{"open_block", status.OpenBlock},
+		{"balance", Amount(status.Balance)},
+		{"block_count", strconv.Itoa(status.BlockCount)},
+	}
+	if req["receivable"] == "true" || req["pending"] == "true" {
+		info = append(info, receivable...)
+	}
+	if req["include_confirmed"] == "true" {
+		policy, err := confirmationPolicy(req)
+		if err != nil {
+			return nil, err
+		}
+		confirmed := store.FetchConfirmationHeight(account)
+		info = append(info,
+			Field{"confirmed_balance", Amount(wallet.ConfirmedBalance(account, policy))},
+			Field{"confirmed_height", strconv.FormatUint(confirmed.Height, 10)},
+			Field{"confirmed_frontier", confirmed.Frontier},
+		)
+	}
+	return info, nil
+}
+
+// The request's "confirmation_policy", as wallet.ParseConfirmationPolicy
+// reads it, or cemented.
+func confirmationPolicy(req Request) (wallet.ConfirmationPolicy, error) {
+	if req["confirmation_policy"] == "" {
+		return wallet.Cemented, nil
+	}
+	policy, err := wallet.ParseConfirmationPolicy(req["confirmation_policy"])
+	if err != nil {
+		return nil, errors.New("Bad confirmation_policy")
+	}
+	return policy, nil
+}
+
+func accountActivity(req Request) (interface{}, error) {
+	account, err := address.Parse(req["account"])
+	if err != nil {
+		return nil, rpcclient.ErrBadAccount
+	}
+	count, err := req.Int("count", MaxActivityBlocks)
+	if err != nil {
+		return nil, err
+	}
+	if count <= 0 || count > MaxActivityBlocks {
+		count = MaxActivityBlocks
+	}
+
+	activity, err := store.GetAccountActivity(account, count)
+	if err != nil {
+		return nil, err
+	}
+
+	counterparties := strconv.Itoa(activity.Counterparties)
+	if activity.MoreCounterparties {
+		counterparties = fmt.Sprintf("more than %d", store.MaxCounterparties)
+	}
+	timestamp := func(ts store.Timestamp) string {
+		if ts.Wall == 0 {
+			return ""
+		}
+		return strconv.FormatInt(ts.Time().Unix(), 10)
+	}
+
+	return Object{
+		{"account", activity.Account},
+		{"first_active", timestamp(activity.FirstActive)},
+		{"last_active", timestamp(activity.LastActive)},
+		{"block_count", strconv.Itoa(activity.Blocks)},
+		{"counterparties", counterparties},
+		{"received", Amount(activity.Received)},
+		{"sent", Amount(activity.Sent)},
+		{"largest", Amount(activity.Largest)},
+		{"truncated", strconv.FormatBool(activity.Truncated)},
+	}, nil
+}
+
+// A block hash cursor, for lists keyed by block hash.
+func hashCursor(cursor []byte) (types.BlockHash, error) {
+	if cursor == nil {
+		return "", nil
+	}
+	if len(cursor) != 32 {
+		return "", errors.New("Bad cursor")
+	}
+	return types.BlockHashFromBytes(cursor), nil
+}
+
+// Blocks newest first.
+func accountHistory(req Request) (interface{}, error) {
+	account, err := address.Parse(req["account"])
+	if err != nil {
+		return nil, rpcclient.ErrBadAccount
+	}
+	count, cursor, err := req.Page()
+	if err != nil {
+		return nil, err
+	}
+	before, err := hashCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	page, more, err := store.AccountHistory(account, before, count)
+	if err != nil {
+		return nil, err
+	}
+	history := []Object{}
+	for _, entry := range page {
+		history = append(history, Object{
+			{"type", string(entry.Type)},
+			{"account", entry.Account},
+			{"amount", Amount(entry.Amount)},
+			{"hash", entry.Hash},
+		})
+	}
+
+	var last []byte
+	if more {
+		last = page[len(page)-1].Hash.ToBytes()
+	}
+	return withCursor(Object{{"account", account}, {"history", history}}, more, last), nil
+}
+
+// Unreceived sends in hash order, as hash to amount. "cold": "true" lists
+// the old dust moved out of the way by the cold pending sweeper instead.
+func pending(req Request) (interface{}, error) {
+	account, err := address.Parse(req["account"])
+	if err != nil {
+		return nil, rpcclient.ErrBadAccount
+	}
+	count, cursor, err := req.Page()
+	if err != nil {
+		return nil, err
+	}
+	after, err := hashCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	list := store.PendingPage
+	if req["cold"] == "true" {
+		list = store.ColdPendingPage
+	}
+	page, more, err := list(account, after, count)
+	if err != nil {
+		return nil, err
+	}
+	blocks := Object{}
+	for _, r := range page {
+		blocks = append(blocks, Field{string(r.Hash), Amount(r.Amount)})
+	}
+
+	var last []byte
+	if more {
+		last = page[len(page)-1].Hash.ToBytes()
+	}
+	return withCursor(Object{{"blocks", blocks}}, more, last), nil
+}
+
+// Heaviest first, ties by account.
+func representatives(req Request) (interface{}, error) {
+	count, cursor, err := req.Page()
+	if err != nil {
+		return nil, err
+	}
+
+	weights := store.RepresentativeWeights()
+	// Sorts like the list: inverted weight, then account
+	key := func(i int) []byte {
+		weight := weights[i].Weight.GetBytes()
+		for j := range weight {
+			weight[j] = ^weight[j]
+		}
+		return append(weight, weights[i].Representative...)
+	}
+	start, end, more := pageAfter(len(weights), key, cursor, count)
+
+	result := Object{}
+	for _, w := range weights[start:end] {
+		result = append(result, Field{string(w.Representative), Amount(w.Weight)})
+	}
+	var last []byte
+	if more {
+		last = key(end - 1)
+	}
+	return withCursor(Object{{"representatives", result}}, more, last), nil
+}
+
+// Representatives to delegate to, best first, scored on what this node has
+// seen of their voting.
+func representativesRecommended(req Request) (interface{}, error) {
+	count, err := req.Int("count", 10)
+	if err != nil || count < 1 {
+		return nil, errors.New("Bad count")
+	}
+
+	ratio := func(f float64) string { return strconv.FormatFloat(f, 'f', 4, 64) }
+	result := []Object{}
+	for _, m := range wallet.RankRepresentatives(count, req["exclude_top"] == "true", nil) {
+		result = append(result, Object{
+			{"account", m.Representative},
+			{"weight", Amount(m.Weight)},
+			{"weight_share", ratio(m.WeightShare)},
+			{"participation", ratio(m.Participation)},
+			{"uptime", ratio(m.Uptime)},
+			{"concentrated", strconv.FormatBool(m.Concentrated)},
+			{"score", ratio(m.Score)},
+		})
+	}
+	return Object{{"representatives", result}}, nil
+}
+
+// Blocks waiting on a missing parent in hash order, as hash to the
+// previous block they wait for.
+func unchecked(req Request) (interface{}, error) {
+	count, cursor, err := req.Page()
+	if err != nil {
+		return nil, err
+	}
+
+	waiting := store.UncheckedBlocks()
+	key := func(i int) []byte { return waiting[i].Hash().ToBytes() }
+	start, end, more := pageAfter(len(waiting), key, cursor, count)
+
+	result := Object{}
+	for _, block := range waiting[start:end] {
+		result = append(result, Field{string(block.Hash()), block.PreviousBlockHash()})
+	}
+	var last []byte
+	if more {
+		last = key(end - 1)
+	}
+	return withCursor(Object{{"blocks", result}}, more, last), nil
+}
+
+// Whether a block counts as confirmed under the request's
+// "confirmation_policy", so each payment can be checked under the policy
+// its integrator chose. cemented_at is in unix milliseconds, 0 if the
+// time wasn't recorded or the block isn't cemented.
+func (s *Server) paymentStatus(req Request) (interface{}, error) {
+	hash := types.BlockHash(strings.ToUpper(req["hash"]))
+	if hash.Validate() != nil {
+		return nil, rpcclient.ErrBadHash
+	}
+	policy, err := confirmationPolicy(req)
+	if err != nil {
+		return nil, err
+	}
+	block := s.reader(req).FetchBlock(hash)
+	if block == nil {
+		return nil, errors.New("Block not found")
+	}
+	account, _, _ := store.BlockAccount(block)
+	cement, cemented := store.FetchCemented(hash)
+	cementedAt := "0"
+	if cemented && !cement.Time.IsZero() {
+		cementedAt = strconv.FormatInt(cement.Time.UnixNano()/int64(time.Millisecond), 10)
+	}
+	return Object{
+		{"hash", hash},
+		{"account", account},
+		{"policy", policy.String()},
+		{"cemented", strconv.FormatBool(cemented)},
+		{"cemented_at", cementedAt},
+		{"confirmed", strconv.FormatBool(policy.Confirmed(hash))},
+	}, nil
+}
+
+// Stores a block given as json once its signature checks out, and
+// publishes it to peers. A block already stored is an "Old block" error,
+// as from the reference node.
+func process(req Request) (interface{}, error) {
+	block, err := blocks.ParseJson([]byte(req["block"]))
+	if err != nil {
+		return nil, errors.New("Bad block")
+	}
+	hash := block.Hash()
+	if store.FetchBlock(hash) != nil {
+		return nil, rpcclient.ErrOldBlock
+	}
+	account, _, ok := store.BlockAccount(block)
+	if !ok {
+		return nil, rpcclient.ErrGapPrevious
+	}
+	pub, err := address.AddressToPub(account)
+	if err != nil || !blocks.VerifyBlockSignature(block, pub) {
+		return nil, rpcclient.ErrBadSignature
+	}
+	if err = store.StoreBlock(block); err != nil {
+		return nil, err
+	}
+	if err = node.Broadcast(block); err != nil {
+		return nil, err
+	}
+	return Object{{"hash", hash}}, nil
+}
+
+// Peer addresses in string order.
+func peers(req Request) (interface{}, error) {
+	count, cursor, err := req.Page()
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []string
+	for _, peer := range node.PeerList {
+		addresses = append(addresses, peer.String())
+	}
+	sort.Strings(addresses)
+	key := func(i int) []byte { return []byte(addresses[i]) }
+	start, end, more := pageAfter(len(addresses), key, cursor, count)
+
+	result := append([]string{}, addresses[start:end]...)
+	var last []byte
+	if more {
+		last = key(end - 1)
+	}
+	// The whole list by subnet, however it's paged
+	counts := node.PeersBySubnet()
+	var subnets []string
+	for subnet := range counts {
+		subnets = append(subnets, subnet)
+	}
+	sort.Strings(subnets)
+	bySubnet := Object{}
+	for _, subnet := range subnets {
+		bySubnet = append(bySubnet, Field{subnet, strconv.Itoa(counts[subnet])})
+	}
+	return withCursor(Object{{"peers", result}, {"subnets", bySubnet}}, more, last), nil
+}
+
+// Approximate bytes used by each bounded structure, against its limit
+// under the memory budget.
+func memory(req Request) (interface{}, error) {
+	stats := utils.GetMemoryStats()
+	structures := Object{}
+	for _, usage := range stats.Structures {
+		structures = append(structures, Field{usage.Name, Object{
+			{"entries", strconv.Itoa(usage.Entries)},
+			{"limit", strconv.Itoa(usage.Limit)},
+			{"bytes", strconv.FormatInt(usage.Bytes, 10)},
+			{"limit_bytes", strconv.FormatInt(usage.LimitBytes, 10)},
+		}})
+	}
+	return Object{
+		{"budget", strconv.FormatInt(stats.Budget, 10)},
+		{"bytes", strconv.FormatInt(stats.Bytes, 10)},
+		{"limit_bytes", strconv.FormatInt(stats.LimitBytes, 10)},
+		{"structures", structures},
+	}, nil
+}
+
+// The conflicting blocks seen on a root, kept block first, with whether
+// the proof checks out.
+// What a block does, for debugging: a stored block by "hash", or any
+// block given as json in "block".
+func (s *Server) blockExplain(req Request) (interface{}, error) {
+	var block blocks.Block
+	if req["block"] != "" {
+		var err error
+		if block, err = blocks.ParseJson([]byte(req["block"])); err != nil {
+			return nil, errors.New("Bad block")
+		}
+	} else {
+		hash := types.BlockHash(strings.ToUpper(req["hash"]))
+		if hash.Validate() != nil {
+			return nil, rpcclient.ErrBadHash
+		}
+		if block = s.reader(req).FetchBlock(hash); block == nil {
+			return nil, errors.New("Block not found")
+		}
+	}
+
+	e := blocks.Explain(block, store.ExplainSource())
+	accounts := []Object{}
+	for _, a := range e.Accounts {
+		accounts = append(accounts, Object{{"role", a.Role}, {"account", a.Account}})
+	}
+	notes := e.Notes
+	if notes == nil {
+		notes = []string{}
+	}
+	return Object{
+		{"hash", e.Hash},
+		{"type", string(e.Type)},
+		{"subtype", e.Subtype},
+		{"accounts", accounts},
+		{"previous", e.Previous},
+		{"source", e.Source},
+		{"amount", e.Amount},
+		{"amount_mnano", e.AmountMnano},
+		{"balance", e.Balance},
+		{"work_value", fmt.Sprintf("%016x", e.WorkValue)},
+		{"work_threshold", fmt.Sprintf("%016x", e.WorkThreshold)},
+		{"work_valid", strconv.FormatBool(e.WorkValid)},
+		{"signature", e.Signature},
+		{"height", strconv.FormatUint(e.Height, 10)},
+		{"confirmed", e.Confirmed},
+		{"notes", notes},
+		{"text", e.String()},
+	}, nil
+}
+
+// A stored block with its account, amount, balance after it and height,
+// as the reference rpc has them. Its contents are a JSON string unless
+// "json_block" is "true".
+func (s *Server) blockInfo(req Request) (interface{}, error) {
+	hash := types.BlockHash(strings.ToUpper(req["hash"]))
+	if hash.Validate() != nil {
+		return nil, rpcclient.ErrBadHash
+	}
+	block := s.reader(req).FetchBlock(hash)
+	if block == nil {
+		return nil, errors.New("Block not found")
+	}
+
+	e := blocks.Explain(block, store.ExplainSource())
+	var account types.Account
+	for _, a := range e.Accounts {
+		if a.Role == blocks.RoleAccount {
+			account = a.Account
+		}
+	}
+	// Changes move nothing, so have no amount
+	amount, _ := uint128.FromDecimal(e.Amount)
+	balance, _ := uint128.FromDecimal(e.Balance)
+	var contents interface{} = blockContents(blocks.ToRaw(block))
+	if req["json_block"] != "true" {
+		encoded, err := json.Marshal(contents)
+		if err != nil {
+			return nil, err
+		}
+		contents = string(encoded)
+	}
+	return Object{
+		{"block_account", account},
+		{"amount", Amount(amount)},
+		{"balance", Amount(balance)},
+		{"height", strconv.FormatUint(e.Height, 10)},
+		{"confirmed", strconv.FormatBool(e.Confirmed == blocks.ExplainYes)},
+		{"contents", contents},
+	}, nil
+}
+
+func forkProof(req Request) (interface{}, error) {
+	root := types.BlockHash(strings.ToUpper(req["root"]))
+	if root.Validate() != nil {
+		return nil, errors.New("Bad root")
+	}
+	proof, ok := store.FetchForkProof(root)
+	if !ok {
+		return nil, errors.New("No fork proof for root")
+	}
+
+	list := []Object{}
+	for _, raw := range proof.Blocks {
+		list = append(list, blockObject(raw))
+	}
+	return Object{
+		{"root", proof.Root},
+		{"account", proof.Account},
+		{"recorded", strconv.FormatInt(proof.Recorded/int64(time.Second), 10)},
+		{"valid", strconv.FormatBool(proof.Verify() == nil)},
+		{"blocks", list},
+	}, nil
+}
+
+// The stages a sampled block has reached, with unix milliseconds and the
+// milliseconds since it was first traced.
+func trace(req Request) (interface{}, error) {
+	hash := types.BlockHash(strings.ToUpper(req["hash"]))
+	if hash.Validate() != nil {
+		return nil, rpcclient.ErrBadHash
+	}
+	events, ok := metrics.Traces.Timeline(hash)
+	if !ok {
+		return nil, errors.New("Block not traced")
+	}
+
+	stages := []Object{}
+	for _, e := range events {
+		stages = append(stages, Object{
+			{"stage", e.Stage},
+			{"time", strconv.FormatInt(e.Time.UnixNano()/int64(time.Millisecond), 10)},
+			{"elapsed_ms", strconv.FormatFloat(e.Time.Sub(events[0].Time).Seconds()*1000, 'f', 3, 64)},
+		})
+	}
+	return Object{{"hash", hash}, {"stages", stages}}, nil
+}
+
+// A block's fields as the reference rpc names them, only those its type
+// has, with its hash after the type.
+func blockObject(raw blocks.RawBlock) Object {
+	contents := blockContents(raw)
+	return append(Object{contents[0], {"hash", raw.ToBlock().Hash()}}, contents[1:]...)
+}
+
+// A block as the reference node writes it: hashes and signature in upper
+// case hex, work in lower case, and a legacy send's balance as 32 hex
+// digits rather than a decimal amount. State blocks have a decimal balance,
+// their link as an account too, and the signature before the work.
+func blockContents(raw blocks.RawBlock) Object {
+	hash := func(h types.BlockHash) string {
+		return strings.ToUpper(string(h))
+	}
+	o := Object{{"type", string(raw.Type)}}
+	switch raw.Type {
+	case blocks.State:
+		return append(o,
+			Field{"account", raw.Account},
+			Field{"previous", hash(raw.Previous)},
+			Field{"representative", raw.Representative},
+			Field{"balance", raw.Balance.Decimal()},
+			Field{"link", hash(raw.Link)},
+			Field{"link_as_account", address.PubKeyToAddress(raw.Link.ToBytes())},
+			Field{"signature", strings.ToUpper(string(raw.Signature))},
+			Field{"work", strings.ToLower(string(raw.Work))},
+		)
+	case blocks.Open:
+		o = append(o, Field{"source", hash(raw.Source)}, Field{"representative", raw.Representative}, Field{"account", raw.Account})
+	case blocks.Send:
+		o = append(o, Field{"previous", hash(raw.Previous)}, Field{"destination", raw.Destination}, Field{"balance", strings.ToUpper(raw.Balance.String())})
+	case blocks.Receive:
+		o = append(o, Field{"previous", hash(raw.Previous)}, Field{"source", hash(raw.Source)})
+	case blocks.Change:
+		o = append(o, Field{"previous", hash(raw.Previous)}, Field{"representative", raw.Representative})
+	}
+	return append(o, Field{"work", strings.ToLower(string(raw.Work))}, Field{"signature", strings.ToUpper(string(raw.Signature))})
+}
+
+// How far the bootstrap has got. Progress is a percentage of "basis":
+// blocks when the peer sent block counts with its frontiers, otherwise
+// accounts. The rate is blocks a second, and the eta is in seconds, 0
+// until it can be told.
+func bootstrapStatus(req Request) (interface{}, error) {
+	status := node.Bootstrap.Status()
+	started := "0"
+	if !status.Started.IsZero() {
+		started = strconv.FormatInt(status.Started.UnixNano()/int64(time.Millisecond), 10)
+	}
+	return Object{
+		{"started", started},
+		{"basis", status.Basis},
+		{"progress", strconv.FormatFloat(status.Progress*100, 'f', 2, 64)},
+		{"accounts", strconv.FormatUint(status.Accounts, 10)},
+		{"accounts_done", strconv.FormatUint(status.AccountsDone, 10)},
+		{"frontiers_done", strconv.FormatBool(status.FrontiersDone)},
+		{"blocks", strconv.FormatUint(status.Blocks, 10)},
+		{"pulled", strconv.FormatUint(status.Pulled, 10)},
+		{"rate", strconv.FormatFloat(status.BlockRate, 'f', 1, 64)},
+		{"eta", strconv.FormatInt(int64(status.ETA/time.Second), 10)},
+	}, nil
+}
+
+// Free space where the node writes, and whether the ledger has gone read
+// only for the lack of it.
+func diskSpace(req Request) (interface{}, error) {
+	mode := store.Mode()
+	since := "0"
+	if !mode.Since.IsZero() {
+		since = strconv.FormatInt(mode.Since.UnixNano()/int64(time.Millisecond), 10)
+	}
+	paths := []Object{}
+	for _, u := range node.Disk.Usage() {
+		path := Object{{"path", u.Path}}
+		if u.Err != "" {
+			path = append(path, Field{"error", u.Err})
+		} else {
+			path = append(path, Field{"free", strconv.FormatUint(u.Free, 10)}, Field{"total", strconv.FormatUint(u.Total, 10)})
+		}
+		paths = append(paths, path)
+	}
+	soft, hard := node.Disk.Limits()
+	result := Object{
+		{"mode", mode.Mode},
+		{"since", since},
+		{"soft_limit", strconv.FormatUint(soft, 10)},
+		{"hard_limit", strconv.FormatUint(hard, 10)},
+		{"paths", paths},
+	}
+	if mode.Reason != "" {
+		result = append(result, Field{"reason", mode.Reason})
+	}
+	return result, nil
+}
+
+func counts(c store.LedgerCounts) Object {
+	return Object{
+		{"blocks", strconv.FormatUint(c.Blocks, 10)},
+		{"cemented", strconv.FormatUint(c.Cemented, 10)},
+		{"accounts", strconv.FormatUint(c.Accounts, 10)},
+	}
+}
+
+// How the ledger compares with its peers': synced, behind or diverged,
+// or unknown until enough have reported.
+func syncStatus(req Request) (interface{}, error) {
+	status := node.Sync.Status()
+	since := "0"
+	if !status.Since.IsZero() {
+		since = strconv.FormatInt(status.Since.UnixNano()/int64(time.Millisecond), 10)
+	}
+	result := Object{
+		{"status", status.Status},
+		{"since", since},
+		{"local", counts(status.Local)},
+		{"network", counts(status.Network)},
+		{"peers", strconv.Itoa(status.Peers)},
+		{"outliers", strconv.Itoa(status.Outliers)},
+	}
+	if status.Advice != "" {
+		result = append(result, Field{"advice", status.Advice})
+	}
+	return result, nil
+}
+
+// Each background job's last run, in name order.
+func maintenanceStatus(req Request) (interface{}, error) {
+	jobs := []Object{}
+	for _, j := range node.Maintenance.Status() {
+		lastRun := "0"
+		if !j.LastRun.IsZero() {
+			lastRun = strconv.FormatInt(j.LastRun.UnixNano()/int64(time.Millisecond), 10)
+		}
+		job := Object{
+			{"name", j.Name},
+			{"group", j.Group},
+			{"status", j.Status},
+			{"runs", strconv.FormatUint(j.Runs, 10)},
+			{"slices", strconv.FormatUint(j.Slices, 10)},
+			{"backoffs", strconv.FormatUint(j.Backoffs, 10)},
+			{"last_run", lastRun},
+			{"last_duration_ms", strconv.FormatInt(int64(j.LastDuration/time.Millisecond), 10)},
+		}
+		if j.LastError != "" {
+			job = append(job, Field{"error", j.LastError})
+		}
+		jobs = append(jobs, job)
+	}
+	return Object{{"jobs", jobs}}, nil
+}
+
+// Whether the node is in safe mode after crashing repeatedly, and what
+// it found booting into it.
+func safeMode(req Request) (interface{}, error) {
+	active, report := node.SafeModeStatus()
+	result := Object{{"safe_mode", strconv.FormatBool(active)}}
+	if !active {
+		return result, nil
+	}
+	result = append(result,
+		Field{"since", strconv.FormatInt(report.Since.UnixNano()/int64(time.Millisecond), 10)},
+		Field{"crashes", strconv.Itoa(report.Crashes)},
+		Field{"store", okOr(report.StoreErr)},
+		Field{"config", okOr(report.ConfigErr)},
+	)
+	if p := report.LastPanic; p != nil {
+		result = append(result, Field{"last_panic", Object{
+			{"handler", p.Handler},
+			{"value", p.Value},
+			{"time", strconv.FormatInt(p.Time.UnixNano()/int64(time.Millisecond), 10)},
+			{"stack", p.Stack},
+		}})
+	}
+	return result, nil
+}
+
+func okOr(err string) string {
+	if err == "" {
+		return "ok"
+	}
+	return err
+}
+
+// Takes the node out of safe mode.
+func safeModeExit(req Request) (interface{}, error) {
+	if !node.InSafeMode() {
+		return nil, errors.New("Not in safe mode")
+	}
+	node.ExitSafeMode()
+	return Object{{"safe_mode", "false"}}, nil
+}
+
+// Runs a background job now, or as soon as its current run finishes.
+func maintenanceRun(req Request) (interface{}, error) {
+	if err := node.Maintenance.Trigger(req["job"]); err != nil {
+		return nil, err
+	}
+	return Object{{"started", "1"}}, nil
+}
+
+// Votes received from representatives from "from" up to "to", unix
+// milliseconds defaulting to the last day, with hourly counts, signed by
+// the node's identity key. Only "representative"'s if it's given.
+func voteHistory(req Request) (interface{}, error) {
+	var rep types.Account
+	if req["representative"] != "" {
+		account, err := address.Parse(req["representative"])
+		if err != nil {
+			return nil, rpcclient.ErrBadAccount
+		}
+		rep = account
+	}
+	millis := func(key string, def time.Time) (time.Time, error) {
+		s, ok := req[key]
+		if !ok {
+			return def, nil
+		}
+		ms, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return time.Time{}, errors.Errorf("Bad %s", key)
+		}
+		return time.Unix(0, ms*int64(time.Millisecond)), nil
+	}
+	to, err := millis("to", node.Clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	from, err := millis("from", to.Add(-24*time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	if to.Before(from) {
+		return nil, errors.New("Bad range")
+	}
+	format := req["format"]
+	if format == "" {
+		format = node.VoteReportJSON
+	}
+
+	report, err := node.ExportVoteHistory(rep, from, to, format)
+	if err != nil {
+		return nil, err
+	}
+	return Object{
+		{"format", report.Format},
+		{"node_id", report.NodeID},
+		{"signature", report.Signature},
+		{"report", string(report.Body)},
+	}, nil
+}
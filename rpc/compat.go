@@ -0,0 +1,106 @@
+package rpc
+
+import (
+	"encoding/json"
+
+	"github.com/frankh/nano/uint128"
+	"github.com/pkg/errors"
+)
+
+// Amount is a raw amount in a response. It's encoded as a decimal string
+// unless the request's compat option asks for numbers.
+type Amount uint128.Uint128
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return json.Marshal(Raw(uint128.Uint128(a)))
+}
+
+type AmountFormat int
+
+const (
+	AmountString AmountFormat = iota
+	AmountNumber
+)
+
+// Which of the names from before and after the pending to receivable
+// rename responses use.
+type FieldNames int
+
+const (
+	ReceivableNames FieldNames = iota
+	PendingNames
+	BothNames
+)
+
+// Compat adapts responses to what older client libraries expect. A
+// server's Compat is the default for requests that don't set
+// "amount_format" or "compat".
+type Compat struct {
+	Amounts AmountFormat
+	Names   FieldNames
+}
+
+// Response fields renamed from their pending name, and what they were
+var pendingNames = map[string]string{
+	"receivable":        "pending",
+	"receivable_blocks": "pending_blocks",
+}
+
+// The server's compat with the request's options applied.
+func (s *Server) compat(req Request) (Compat, error) {
+	c := s.Compat
+	switch req["amount_format"] {
+	case "":
+	case "string":
+		c.Amounts = AmountString
+	case "number":
+		c.Amounts = AmountNumber
+	default:
+		return c, errors.New("Bad amount_format")
+	}
+
+	switch req["compat"] {
+	case "":
+	case "receivable":
+		c.Names = ReceivableNames
+	case "pending":
+		c.Names = PendingNames
+	case "both":
+		c.Names = BothNames
+	default:
+		return c, errors.New("Bad compat")
+	}
+	return c, nil
+}
+
+// Rewrites a response's amounts and field names. Responses are built
+// from Objects, lists of them and Amounts, anything else is left as is.
+func (c Compat) apply(v interface{}) interface{} {
+	switch v := v.(type) {
+	case Object:
+		result := make(Object, 0, len(v))
+		for _, f := range v {
+			value := c.apply(f.Value)
+			old, renamed := pendingNames[f.Key]
+			if !renamed || c.Names != PendingNames {
+				result = append(result, Field{f.Key, value})
+			}
+			if renamed && c.Names != ReceivableNames {
+				result = append(result, Field{old, value})
+			}
+		}
+		return result
+	case []Object:
+		result := make([]interface{}, len(v))
+		for i, o := range v {
+			result[i] = c.apply(o)
+		}
+		return result
+	case Amount:
+		if c.Amounts == AmountNumber {
+			return json.Number(Raw(uint128.Uint128(v)))
+		}
+		return Raw(uint128.Uint128(v))
+	}
+	return v
+}
@@ -0,0 +1,28 @@
+package rpc
+
+import (
+	"github.com/frankh/nano/rpcclient"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/wallet"
+	"github.com/pkg/errors"
+)
+
+// Internal errors that have a reference node equivalent, so clients
+// written against either node see the same string.
+var referenceErrors = map[error]error{
+	store.ErrAccountNotFound:      rpcclient.ErrAccountNotFound,
+	store.ErrFork:                 rpcclient.ErrFork,
+	store.ErrMissingParent:        rpcclient.ErrGapPrevious,
+	store.ErrMissingSource:        rpcclient.ErrGapSource,
+	store.ErrUnconnectedPoolFull:  rpcclient.ErrGapPrevious,
+	store.ErrInvalidWork:          rpcclient.ErrWorkLow,
+	wallet.ErrInsufficientBalance: rpcclient.ErrInsufficient,
+}
+
+// The error sent for err: its reference equivalent, if it has one.
+func referenceError(err error) error {
+	if ref, ok := referenceErrors[errors.Cause(err)]; ok {
+		return ref
+	}
+	return err
+}
@@ -0,0 +1,303 @@
+package rpc
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/node"
+	"github.com/pkg/errors"
+)
+
+// Defaults for acknowledged event delivery
+const (
+	// How long a session outlives its connection, for the client to
+	// reconnect and pick up where it left off
+	DefaultSessionTTL = 2 * time.Minute
+	// Events a session holds for its client to ack before it gives up
+	// and falls back to best effort
+	DefaultMaxUnacked = 10000
+	// Sessions held at once
+	DefaultMaxSessions = 100
+)
+
+// Longest session id a client may choose
+const maxSessionID = 64
+
+// Event stream messages about the session rather than the node
+const (
+	// The session held more unacked events than it could, and dropped
+	// them. From here on its events are best effort: sent once, and lost
+	// if the client isn't connected.
+	EventBestEffort = "best_effort"
+	// The client asked to resume a session that had expired, so the
+	// events since its last one are lost. This starts a new session.
+	EventSessionExpired = "session_expired"
+)
+
+var ErrUnknownSession = errors.New("Unknown session")
+var ErrTooManySessions = errors.New("Too many event sessions")
+
+// An event numbered within its session. Summaries aren't numbered.
+type sequencedEvent struct {
+	node.Event
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+// An eventSession keeps a client's events, numbered, until the client
+// acks them, across reconnects within its TTL.
+type eventSession struct {
+	lock sync.Mutex
+	sub  *node.EventSubscription
+	// Number of the latest event
+	seq uint64
+	// Events not yet acked, oldest first. Once best effort, only those
+	// not yet sent.
+	events     []sequencedEvent
+	bestEffort bool
+	// The connection serving the session, which an incoming one replaces
+	conn      uint64
+	connected bool
+	// Wakes the connection when there's something new, closed when it's
+	// replaced
+	wake    chan bool
+	expiry  *time.Timer
+	expired chan bool
+}
+
+type eventSessions struct {
+	lock     sync.Mutex
+	sessions map[string]*eventSession
+}
+
+func newEventSessions() *eventSessions {
+	return &eventSessions{sessions: make(map[string]*eventSession)}
+}
+
+// Returns the session with id, or starts one. Resumed is false for new
+// sessions.
+func (s *Server) session(id string) (session *eventSession, resumed bool, err error) {
+	s.sessions.lock.Lock()
+	defer s.sessions.lock.Unlock()
+	if session, ok := s.sessions.sessions[id]; ok {
+		return session, true, nil
+	}
+	if len(s.sessions.sessions) >= s.MaxSessions {
+		return nil, false, ErrTooManySessions
+	}
+	session = &eventSession{
+		sub:     node.Events.Subscribe(node.DefaultEventBuffer),
+		expired: make(chan bool),
+	}
+	s.sessions.sessions[id] = session
+	go s.collect(session)
+	return session, false, nil
+}
+
+// Numbers and holds a session's events until it expires.
+func (s *Server) collect(session *eventSession) {
+	for {
+		select {
+		case <-session.expired:
+			return
+		case e := <-session.sub.C:
+			session.lock.Lock()
+			session.add(e, s.MaxUnacked)
+			session.notify()
+			session.lock.Unlock()
+		}
+	}
+}
+
+// Called with the lock held.
+func (session *eventSession) add(e node.Event, max int) {
+	if session.bestEffort && !session.connected {
+		return
+	}
+	session.seq++
+	session.events = append(session.events, sequencedEvent{e, session.seq})
+	if len(session.events) <= max {
+		return
+	}
+	if !session.bestEffort {
+		session.bestEffort = true
+		session.seq++
+		session.events = []sequencedEvent{{sessionNotice(EventBestEffort), session.seq}}
+		return
+	}
+	// Too slow even for best effort
+	session.events = session.events[1:]
+}
+
+func sessionNotice(kind string) node.Event {
+	return node.Event{Type: kind, Time: node.Clock.Now().UnixNano() / int64(time.Millisecond)}
+}
+
+// Called with the lock held.
+func (session *eventSession) notify() {
+	if session.wake == nil {
+		return
+	}
+	select {
+	case session.wake <- true:
+	default:
+	}
+}
+
+// Drops events up to seq, which the client has.
+func (session *eventSession) ack(seq uint64) {
+	i := 0
+	for i < len(session.events) && session.events[i].Seq <= seq {
+		i++
+	}
+	session.events = session.events[i:]
+}
+
+// Starts the session's expiry once its connection is gone.
+func (s *Server) disconnect(id string, session *eventSession, conn uint64) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.conn != conn {
+		// Replaced by a newer connection
+		return
+	}
+	session.connected = false
+	session.expiry = time.AfterFunc(s.SessionTTL, func() {
+		s.sessions.lock.Lock()
+		defer s.sessions.lock.Unlock()
+		session.lock.Lock()
+		defer session.lock.Unlock()
+		if session.connected || s.sessions.sessions[id] != session {
+			return
+		}
+		delete(s.sessions.sessions, id)
+		session.sub.Close()
+		close(session.expired)
+	})
+}
+
+// Streams a session's events, starting after the client's last, and
+// keeps them until they're acked with the events_ack action. A later
+// connection for the same session takes over from this one.
+func (s *Server) serveSession(w http.ResponseWriter, r *http.Request, flusher http.Flusher, id string) {
+	if len(id) > maxSessionID {
+		http.Error(w, "Session id too long", http.StatusBadRequest)
+		return
+	}
+	var last uint64
+	if v := r.URL.Query().Get("last"); v != "" {
+		var err error
+		if last, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "Bad last", http.StatusBadRequest)
+			return
+		}
+	}
+	session, resumed, err := s.session(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	session.lock.Lock()
+	if session.expiry != nil {
+		session.expiry.Stop()
+	}
+	session.conn++
+	session.connected = true
+	if session.wake != nil {
+		// Kicks the connection this one replaces
+		close(session.wake)
+	}
+	session.wake = make(chan bool, 1)
+	conn, wake, sent := session.conn, session.wake, last
+	if !session.bestEffort {
+		session.ack(last)
+	}
+	session.lock.Unlock()
+	defer s.disconnect(id, session, conn)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	send := func(e sequencedEvent) bool {
+		if encoder.Encode(e) != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+	if !resumed && last > 0 && !send(sequencedEvent{Event: sessionNotice(EventSessionExpired)}) {
+		return
+	}
+	if !send(sequencedEvent{Event: node.SummaryEvent()}) {
+		return
+	}
+
+	ticker := time.NewTicker(s.SummaryInterval)
+	defer ticker.Stop()
+	for {
+		session.lock.Lock()
+		if session.conn != conn {
+			session.lock.Unlock()
+			return
+		}
+		var pending []sequencedEvent
+		for _, e := range session.events {
+			if e.Seq > sent {
+				pending = append(pending, e)
+			}
+		}
+		if session.bestEffort {
+			// Nothing is kept once sent
+			session.ack(session.seq)
+		}
+		session.lock.Unlock()
+
+		for _, e := range pending {
+			if !send(e) {
+				return
+			}
+			sent = e.Seq
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-session.expired:
+			return
+		case <-wake:
+		case <-ticker.C:
+			if !send(sequencedEvent{Event: node.SummaryEvent()}) {
+				return
+			}
+		}
+	}
+}
+
+// Acks a session's events up to "seq", so they aren't sent again.
+func (s *Server) eventsAck(req Request) (interface{}, error) {
+	s.sessions.lock.Lock()
+	session, ok := s.sessions.sessions[req["session"]]
+	s.sessions.lock.Unlock()
+	if !ok {
+		return nil, ErrUnknownSession
+	}
+	seq, err := strconv.ParseUint(req["seq"], 10, 64)
+	if err != nil {
+		return nil, errors.New("Bad seq")
+	}
+
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if seq > session.seq {
+		return nil, errors.New("Seq not sent yet")
+	}
+	if !session.bestEffort {
+		session.ack(seq)
+	}
+	return Object{
+		{"unacked", strconv.Itoa(len(session.events))},
+		{"best_effort", strconv.FormatBool(session.bestEffort)},
+	}, nil
+}
@@ -0,0 +1,58 @@
+package rpc
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/frankh/nano/node"
+)
+
+// How often the event stream reports the node's totals
+const DefaultSummaryInterval = time.Second
+
+// Streams node events as newline separated JSON, with a summary event
+// every SummaryInterval, until the client goes away. Events the client
+// is too slow for are dropped rather than held, unless it asks for
+// acknowledged delivery with ?session=<id>.
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	if id := r.URL.Query().Get("session"); id != "" {
+		s.serveSession(w, r, flusher, id)
+		return
+	}
+	sub := node.Events.Subscribe(node.DefaultEventBuffer)
+	defer sub.Close()
+	ticker := time.NewTicker(s.SummaryInterval)
+	defer ticker.Stop()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	send := func(e node.Event) bool {
+		if encoder.Encode(e) != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+	if !send(node.SummaryEvent()) {
+		return
+	}
+	for {
+		var e node.Event
+		select {
+		case <-r.Context().Done():
+			return
+		case e = <-sub.C:
+		case <-ticker.C:
+			e = node.SummaryEvent()
+		}
+		if !send(e) {
+			return
+		}
+	}
+}
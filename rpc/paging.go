@@ -0,0 +1,62 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Lists are returned a page at a time: at most "count" entries, with a
+// "cursor" in any response that has more to come, to be passed back in
+// the next request. Cursors are opaque to clients. Each holds the key of
+// the last entry returned, so the next page starts right after it even
+// if entries were added or removed in between, and no entry is returned
+// twice.
+const DefaultPageSize = 100
+
+// Larger counts are cut down to this
+const MaxPageSize = 1000
+
+func (r Request) Page() (count int, cursor []byte, err error) {
+	count, err = r.Int("count", DefaultPageSize)
+	if err != nil {
+		return 0, nil, err
+	}
+	if count <= 0 {
+		return 0, nil, errors.New("Bad count")
+	}
+	if count > MaxPageSize {
+		count = MaxPageSize
+	}
+
+	if s, ok := r["cursor"]; ok && s != "" {
+		cursor, err = base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(cursor) == 0 {
+			return 0, nil, errors.New("Bad cursor")
+		}
+	}
+	return count, cursor, nil
+}
+
+// Adds the cursor for the page after the one ending at last, if any.
+func withCursor(o Object, more bool, last []byte) Object {
+	if more {
+		o = append(o, Field{"cursor", base64.RawURLEncoding.EncodeToString(last)})
+	}
+	return o
+}
+
+// For lists held in memory and ordered by key: the bounds of the page
+// of up to count entries after the cursor.
+func pageAfter(n int, key func(i int) []byte, cursor []byte, count int) (start int, end int, more bool) {
+	if cursor != nil {
+		start = sort.Search(n, func(i int) bool { return bytes.Compare(key(i), cursor) > 0 })
+	}
+	end = start + count
+	if end >= n {
+		return start, n, false
+	}
+	return start, end, true
+}
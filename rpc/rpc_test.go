@@ -0,0 +1,1264 @@
+package rpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	goerrors "errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/frankh/crypto/ed25519"
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/metrics"
+	"github.com/frankh/nano/node"
+	"github.com/frankh/nano/protocol"
+	"github.com/frankh/nano/rpcclient"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/frankh/nano/utils"
+	"github.com/frankh/nano/wallet"
+	"github.com/pkg/errors"
+)
+
+func TestObject(t *testing.T) {
+	body, _ := json.Marshal(Object{{"z", 1}, {"a", Object{{"y", "2"}, {"b", nil}}}})
+	if string(body) != `{"z":1,"a":{"y":"2","b":null}}` {
+		t.Errorf("Fields out of order: %s", body)
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	a, _ := Canonicalize([]byte(`{"b": 1.50, "a": ["x", {"d": 340282366920938463463374607431768211455, "c": true}]}`))
+	b, _ := Canonicalize([]byte("{\n  \"a\": [\"x\", {\"c\": true, \"d\": 340282366920938463463374607431768211455}],\n  \"b\": 1.50\n}"))
+	if !bytes.Equal(a, b) || string(a) != `{"a":["x",{"c":true,"d":340282366920938463463374607431768211455}],"b":1.50}` {
+		t.Errorf("Canonical forms differ:\n%s\n%s", a, b)
+	}
+
+	if _, err := Canonicalize([]byte(`{} {}`)); err == nil {
+		t.Errorf("Trailing document accepted")
+	}
+}
+
+// Reformats JSON responses, as logging and API gateways sometimes do.
+func reindent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		next.ServeHTTP(rec, r)
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.Header().Del("Content-Length")
+		var buf bytes.Buffer
+		json.Indent(&buf, rec.Body.Bytes(), "", "    ")
+		w.WriteHeader(rec.Code)
+		w.Write(buf.Bytes())
+	})
+}
+
+func gzipped(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		next.ServeHTTP(rec, r)
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(rec.Code)
+		gz := gzip.NewWriter(w)
+		gz.Write(rec.Body.Bytes())
+		gz.Close()
+	})
+}
+
+func TestSignedResponses(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+
+	rpc := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteResponse(w, Object{{"balance", "340282366920938463463374607431768211455"}, {"block_count", 12}})
+	})
+	backend := httptest.NewServer(SignResponses(rpc, priv))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	proxy := httptest.NewServer(gzipped(reindent(httputil.NewSingleHostReverseProxy(backendURL))))
+	defer proxy.Close()
+
+	request := []byte(`{"action":"account_balance"}`)
+	resp, err := http.Post(proxy.URL, "application/json", bytes.NewReader(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if !strings.Contains(string(body), "\n    ") {
+		t.Fatalf("Response wasn't reformatted by the middleware: %s", body)
+	}
+	if err = VerifyResponse(body, resp.Header, pub); err != nil {
+		t.Errorf("Signature didn't survive middlewares: %s", err)
+	}
+	if resp.Header.Get(RequestHashHeader) != RequestHash(request) {
+		t.Errorf("Request hash doesn't match the request")
+	}
+
+	if VerifyResponse(body, resp.Header, otherPub) != ErrBadResponseSignature {
+		t.Errorf("Verified with the wrong key")
+	}
+	tampered := bytes.Replace(body, []byte("12"), []byte("13"), 1)
+	if VerifyResponse(tampered, resp.Header, pub) != ErrBadResponseSignature {
+		t.Errorf("Verified a tampered body")
+	}
+	resp.Header.Set(TimestampHeader, "0")
+	if VerifyResponse(body, resp.Header, pub) != ErrBadResponseSignature {
+		t.Errorf("Verified with a changed timestamp")
+	}
+}
+
+// Endless bytes of one value, so a huge body costs the test nothing.
+type repeatReader byte
+
+func (r repeatReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+// Hostile bodies must be turned away without the server's memory growing
+// with them.
+func TestRequestLimits(t *testing.T) {
+	s := NewServer(false)
+	_, priv, _ := ed25519.GenerateKey(nil)
+	signed := SignResponses(s, priv)
+
+	serve := func(handler http.Handler, body io.Reader) (*httptest.ResponseRecorder, uint64) {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/", body))
+		runtime.ReadMemStats(&after)
+		return rec, after.TotalAlloc - before.TotalAlloc
+	}
+	// Reading up to the limit, doubling the buffer as it goes, is the most
+	// a request should cost
+	const maxAlloc = 4 * DefaultMaxRequestSize
+
+	huge := func() io.Reader {
+		return io.MultiReader(strings.NewReader(`{"action": "`), io.LimitReader(repeatReader('a'), 64<<20))
+	}
+	for name, handler := range map[string]http.Handler{"server": s, "signed": signed} {
+		rec, alloc := serve(handler, huge())
+		if rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Body.String(), ErrRequestTooLarge.Error()) {
+			t.Errorf("%s: expected 413 for a huge body, got %d %s", name, rec.Code, rec.Body)
+		}
+		if alloc > maxAlloc {
+			t.Errorf("%s: allocated %d bytes for a huge body", name, alloc)
+		}
+	}
+
+	var fields []string
+	for i := 0; i < 10000; i++ {
+		fields = append(fields, fmt.Sprintf(`"f%d": ""`, i))
+	}
+	cases := map[string]string{
+		`{"action": ` + strings.Repeat("[", 100000) + `}`: utils.ErrJSONTooDeep.Error(),
+		`{"action": {"nested": "x"}}`:                     utils.ErrJSONTooDeep.Error(),
+		`{` + strings.Join(fields, ",") + `}`:             utils.ErrJSONTooManyFields.Error(),
+		// Brackets in strings don't count
+		`{"action": "nonexistent", "x": "\"{[[[[:"}`: ErrUnknownAction.Error(),
+	}
+	for body, expected := range cases {
+		if r := call(s, body); r["error"] != expected {
+			t.Errorf("Expected %q for %.40s, got %v", expected, body, r)
+		}
+	}
+
+	s.MaxRequestSize = 64
+	if rec, _ := serve(s, strings.NewReader(`{"action": "block_count", "padding": "`+strings.Repeat("x", 64)+`"}`)); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Configured limit not applied, got %d", rec.Code)
+	}
+	s.MaxRequestSize = DefaultMaxRequestSize
+
+	// Random bodies made of JSON's structural characters, up to twice the
+	// limit
+	random := rand.New(rand.NewSource(1))
+	alphabet := []byte(`{}[]":,\ a1-e.`)
+	for i := 0; i < 200; i++ {
+		body := make([]byte, random.Intn(2*DefaultMaxRequestSize))
+		for j := range body {
+			body[j] = alphabet[random.Intn(len(alphabet))]
+		}
+		rec, alloc := serve(s, bytes.NewReader(body))
+		if alloc > maxAlloc {
+			t.Errorf("Allocated %d bytes for a %d byte body", alloc, len(body))
+		}
+		var response map[string]string
+		if rec.Code != http.StatusRequestEntityTooLarge && (json.Unmarshal(rec.Body.Bytes(), &response) != nil || response["error"] == "") {
+			t.Errorf("Expected an error for a random body, got %d %s", rec.Code, rec.Body)
+		}
+	}
+}
+
+func call(s *Server, request string) map[string]string {
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(request)))
+	var response map[string]string
+	json.Unmarshal(rec.Body.Bytes(), &response)
+	return response
+}
+
+func TestAccountActivityAction(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	request := `{"action": "account_activity", "account": "` + string(blocks.TestGenesisBlock.Account) + `", "count": "10"}`
+
+	if r := call(NewServer(false), request); r["error"] != ErrControlDisabled.Error() {
+		t.Errorf("Expected control disabled error, got %v", r)
+	}
+
+	r := call(NewServer(true), request)
+	if r["block_count"] != "1" || r["received"] != Raw(blocks.GenesisAmount) || r["counterparties"] != "0" || r["truncated"] != "false" {
+		t.Errorf("Unexpected genesis activity %v", r)
+	}
+
+	if r = call(NewServer(true), `{"action": "account_activity", "account": "nano_1"}`); r["error"] != "Bad account number" {
+		t.Errorf("Expected bad account error, got %v", r)
+	}
+	if r = call(NewServer(true), `{"action": "nonsense"}`); r["error"] != ErrUnknownAction.Error() {
+		t.Errorf("Expected unknown action error, got %v", r)
+	}
+}
+
+func TestAccountInfoAction(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = protocol.WorkLiveThreshold }()
+
+	genesis := wallet.New(blocks.TestPrivateKey)
+	genesis.GeneratePowSync()
+	u := wallet.New(strings.Repeat("02", 32))
+	unopened := u.Address()
+	send, _ := genesis.Send(unopened, store.DustThreshold)
+	store.StoreBlock(send)
+
+	s := NewServer(false)
+	r := call(s, `{"action": "account_info", "account": "`+string(unopened)+`"}`)
+	if r["error"] != "Account not found" || r["receivable"] != store.DustThreshold.Decimal() || r["receivable_blocks"] != "1" {
+		t.Errorf("Unopened account should report its receivable, got %v", r)
+	}
+
+	if u.DescribeBalance() != "unopened, "+store.DustThreshold.Decimal()+" raw receivable" {
+		t.Errorf("Unexpected balance for unopened account %s", u.DescribeBalance())
+	}
+
+	pub, _ := address.GenerateKey()
+	r = call(s, `{"action": "account_info", "account": "`+string(address.PubKeyToAddress(pub))+`"}`)
+	if len(r) != 1 || r["error"] != "Account not found" {
+		t.Errorf("Unknown account should only be an error, got %v", r)
+	}
+
+	r = call(s, `{"action": "account_info", "account": "`+string(blocks.TestGenesisBlock.Account)+`", "receivable": "true", "include_confirmed": "true"}`)
+	if r["frontier"] != string(send.Hash()) || r["block_count"] != "2" || r["receivable"] != "0" || r["confirmed_height"] != "0" {
+		t.Errorf("Unexpected genesis account info %v", r)
+	}
+	if genesis.DescribeBalance() != blocks.GenesisAmount.Sub(store.DustThreshold).Decimal()+" raw" {
+		t.Errorf("Unexpected genesis balance %s", genesis.DescribeBalance())
+	}
+	w := wallet.New(strings.Repeat("01", 32))
+	if w.DescribeBalance() != "unopened" {
+		t.Errorf("Unexpected balance for unknown account %s", w.DescribeBalance())
+	}
+}
+
+func TestPaymentStatusAction(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = protocol.WorkLiveThreshold }()
+
+	genesis := wallet.New(blocks.TestPrivateKey)
+	genesis.GeneratePowSync()
+	u := wallet.New(strings.Repeat("02", 32))
+	send, _ := genesis.Send(u.Address(), store.DustThreshold)
+	store.StoreBlock(send)
+
+	s := NewServer(false)
+	request := `{"action": "payment_status", "hash": "` + string(send.Hash()) + `"`
+	r := call(s, request+`}`)
+	if r["cemented"] != "false" || r["confirmed"] != "false" || r["policy"] != "cemented" || r["account"] != string(blocks.TestGenesisBlock.Account) {
+		t.Errorf("Unexpected status before cementing %v", r)
+	}
+
+	cementer, _ := store.NewConfirmationHeightProcessor(store.DefaultCementBatchSize, nil)
+	cementer.Add(send.Hash())
+	cementer.Flush()
+	r = call(s, request+`}`)
+	if r["cemented"] != "true" || r["confirmed"] != "true" || r["cemented_at"] == "0" {
+		t.Errorf("Unexpected status once cemented %v", r)
+	}
+	r = call(s, request+`, "confirmation_policy": "depth:1"}`)
+	if r["cemented"] != "true" || r["confirmed"] != "false" || r["policy"] != "depth:1" {
+		t.Errorf("Expected a cemented frontier not to be one block deep, got %v", r)
+	}
+	r = call(s, request+`, "confirmation_policy": "votes:3"}`)
+	if r["error"] != "Bad confirmation_policy" {
+		t.Errorf("Expected a bad policy error, got %v", r)
+	}
+
+	r = call(s, `{"action": "account_info", "account": "`+string(blocks.TestGenesisBlock.Account)+`", "include_confirmed": "true", "confirmation_policy": "depth:1"}`)
+	if r["confirmed_balance"] != blocks.GenesisAmount.Decimal() || r["confirmed_frontier"] != string(send.Hash()) {
+		t.Errorf("Expected the genesis balance confirmed one block deep, got %v", r)
+	}
+}
+
+func TestProcessAction(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = protocol.WorkLiveThreshold }()
+
+	genesis := wallet.New(blocks.TestPrivateKey)
+	genesis.GeneratePowSync()
+	u := wallet.New(strings.Repeat("02", 32))
+	send, _ := genesis.Send(u.Address(), store.DustThreshold)
+	raw := func(block blocks.Block) string {
+		data, _ := json.Marshal(blocks.ToRaw(block))
+		b, _ := json.Marshal(string(data))
+		return string(b)
+	}
+
+	s := NewServer(false)
+	forged := *send
+	_, priv := address.KeypairFromPrivateKey(strings.Repeat("02", 32))
+	forged.Signature = send.Hash().Sign(priv)
+	if r := call(s, `{"action": "process", "block": `+raw(&forged)+`}`); r["error"] != "Bad signature" {
+		t.Errorf("Expected a bad signature, got %v", r)
+	}
+	if r := call(s, `{"action": "process", "block": `+raw(send)+`}`); r["hash"] != string(send.Hash()) || store.FetchBlock(send.Hash()) == nil {
+		t.Errorf("Expected the send processed, got %v", r)
+	}
+	if r := call(s, `{"action": "process", "block": `+raw(send)+`}`); r["error"] != "Old block" {
+		t.Errorf("Expected an old block, got %v", r)
+	}
+	if r := call(s, `{"action": "process", "block": "{}"}`); r["error"] != "Bad block" {
+		t.Errorf("Expected a bad block, got %v", r)
+	}
+}
+
+// Follows cursors until the last page, returning every page's list.
+func pages(t *testing.T, s *Server, request string, list string) []json.RawMessage {
+	var result []json.RawMessage
+	cursor := ""
+	for i := 0; i < 100; i++ {
+		req := request
+		if cursor != "" {
+			req = strings.TrimSuffix(request, "}") + `, "cursor": "` + cursor + `"}`
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(req)))
+		var response map[string]json.RawMessage
+		json.Unmarshal(rec.Body.Bytes(), &response)
+		if response[list] == nil {
+			t.Fatalf("No %s in %s", list, rec.Body.String())
+		}
+		result = append(result, response[list])
+		if response["cursor"] == nil {
+			return result
+		}
+		json.Unmarshal(response["cursor"], &cursor)
+	}
+	t.Fatalf("Paging didn't finish")
+	return nil
+}
+
+func TestListPaging(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = protocol.WorkLiveThreshold }()
+
+	genesis := wallet.New(blocks.TestPrivateKey)
+	u := wallet.New(strings.Repeat("02", 32))
+	unopened := u.Address()
+	var hashes []string
+	for i := 0; i < 5; i++ {
+		genesis.GeneratePowSync()
+		send, err := genesis.Send(unopened, store.DustThreshold)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.StoreBlock(send)
+		hashes = append(hashes, string(send.Hash()))
+	}
+
+	s := NewServer(false)
+	var pending []string
+	for _, page := range pages(t, s, `{"action": "pending", "account": "`+string(unopened)+`", "count": "2"}`, "blocks") {
+		var sends map[string]string
+		json.Unmarshal(page, &sends)
+		if len(sends) > 2 {
+			t.Errorf("Page larger than count")
+		}
+		for hash, amount := range sends {
+			if amount != store.DustThreshold.Decimal() {
+				t.Errorf("Wrong pending amount %s", amount)
+			}
+			pending = append(pending, hash)
+		}
+	}
+	sort.Strings(hashes)
+	sort.Strings(pending)
+	if strings.Join(pending, ",") != strings.Join(hashes, ",") {
+		t.Errorf("Paged pending %v, expected %v", pending, hashes)
+	}
+
+	var history []map[string]string
+	for _, page := range pages(t, s, `{"action": "account_history", "account": "`+string(blocks.TestGenesisBlock.Account)+`", "count": "4"}`, "history") {
+		var entries []map[string]string
+		json.Unmarshal(page, &entries)
+		history = append(history, entries...)
+	}
+	if len(history) != 6 || history[0]["hash"] != string(genesis.Head.Hash()) || history[5]["type"] != "open" || history[1]["amount"] != store.DustThreshold.Decimal() {
+		t.Errorf("Unexpected history %v", history)
+	}
+
+	node.PeerList = []node.Peer{
+		{net.ParseIP("10.0.0.3"), 7075, nil},
+		{net.ParseIP("10.0.0.1"), 7075, nil},
+		{net.ParseIP("10.0.0.2"), 7075, nil},
+	}
+	defer func() { node.PeerList = []node.Peer{node.DefaultPeer} }()
+	var peers []string
+	for _, page := range pages(t, s, `{"action": "peers", "count": "2"}`, "peers") {
+		var addresses []string
+		json.Unmarshal(page, &addresses)
+		peers = append(peers, addresses...)
+	}
+	if strings.Join(peers, ",") != "10.0.0.1:7075,10.0.0.2:7075,10.0.0.3:7075" {
+		t.Errorf("Unexpected peers %v", peers)
+	}
+
+	if r := call(s, `{"action": "representatives", "count": "0"}`); r["error"] != "Bad count" {
+		t.Errorf("Expected bad count error, got %v", r)
+	}
+	if r := call(s, `{"action": "pending", "account": "`+string(unopened)+`", "cursor": "AAAA"}`); r["error"] != "Bad cursor" {
+		t.Errorf("Expected bad cursor error, got %v", r)
+	}
+}
+
+func TestMemoryAction(t *testing.T) {
+	rec := httptest.NewRecorder()
+	NewServer(false).ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(`{"action": "memory"}`)))
+	var response struct {
+		Budget     string
+		Bytes      string
+		Structures map[string]map[string]string
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Bad response %s: %s", rec.Body.String(), err)
+	}
+	if response.Budget != "0" || response.Bytes == "" {
+		t.Errorf("Bad totals %+v", response)
+	}
+	// Registered by the node and store packages
+	for _, name := range []string{"publish_cache", "peers", "unchecked"} {
+		if response.Structures[name]["limit_bytes"] == "" {
+			t.Errorf("Missing %s in %s", name, rec.Body.String())
+		}
+	}
+}
+
+func TestCompat(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = protocol.WorkLiveThreshold }()
+
+	genesis := wallet.New(blocks.TestPrivateKey)
+	genesis.GeneratePowSync()
+	u := wallet.New(strings.Repeat("02", 32))
+	send, _ := genesis.Send(u.Address(), store.DustThreshold)
+	store.StoreBlock(send)
+
+	raw := func(s *Server, request string) string {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(request)))
+		return rec.Body.String()
+	}
+	info := `{"action": "account_info", "account": "` + string(u.Address()) + `"`
+
+	s := NewServer(false)
+	for _, c := range []struct{ request, expected string }{
+		{info + `}`, `{"error":"Account not found","receivable":"1000000000000000000000000","receivable_blocks":"1"}`},
+		{info + `, "compat": "receivable"}`, `{"error":"Account not found","receivable":"1000000000000000000000000","receivable_blocks":"1"}`},
+		{info + `, "compat": "pending"}`, `{"error":"Account not found","pending":"1000000000000000000000000","pending_blocks":"1"}`},
+		{info + `, "compat": "both"}`, `{"error":"Account not found","receivable":"1000000000000000000000000","pending":"1000000000000000000000000","receivable_blocks":"1","pending_blocks":"1"}`},
+		{info + `, "amount_format": "number"}`, `{"error":"Account not found","receivable":1000000000000000000000000,"receivable_blocks":"1"}`},
+		{info + `, "amount_format": "number", "compat": "pending"}`, `{"error":"Account not found","pending":1000000000000000000000000,"pending_blocks":"1"}`},
+		{info + `, "compat": "nonsense"}`, `{"error":"Bad compat"}`},
+		{info + `, "amount_format": "hex"}`, `{"error":"Bad amount_format"}`},
+	} {
+		if body := raw(s, c.request); body != c.expected {
+			t.Errorf("Wrong response to %s\ngot      %s\nexpected %s", c.request, body, c.expected)
+		}
+	}
+
+	// Requests override the server's default
+	s.Compat = Compat{AmountNumber, PendingNames}
+	if body := raw(s, info+`}`); body != `{"error":"Account not found","pending":1000000000000000000000000,"pending_blocks":"1"}` {
+		t.Errorf("Server default not applied: %s", body)
+	}
+	if body := raw(s, info+`, "amount_format": "string", "compat": "receivable"}`); body != `{"error":"Account not found","receivable":"1000000000000000000000000","receivable_blocks":"1"}` {
+		t.Errorf("Request didn't override the server default: %s", body)
+	}
+
+	body := raw(s, `{"action": "account_history", "account": "`+string(blocks.TestGenesisBlock.Account)+`", "count": "1"}`)
+	expected := `{"account":"` + string(blocks.TestGenesisBlock.Account) + `","history":[{"type":"send","account":"` + string(u.Address()) + `","amount":1000000000000000000000000,"hash":"` + string(send.Hash()) + `"}],"cursor":`
+	if !strings.HasPrefix(body, expected) {
+		t.Errorf("Amounts in lists not formatted\ngot      %s\nexpected %s", body, expected)
+	}
+}
+
+func FuzzBlockParams(f *testing.F) {
+	// Each fuzzing worker needs a store of its own
+	config := store.TestConfig
+	config.Path, _ = ioutil.TempDir("", "fuzz")
+	store.Init(config)
+	defer os.RemoveAll(config.Path)
+	genesis, _ := json.Marshal(blocks.ToRaw(blocks.TestGenesisBlock))
+	f.Add(string(blocks.TestGenesisBlock.Hash()), string(genesis))
+	f.Add(strings.ToLower(string(blocks.TestGenesisBlock.Hash())), `{}`)
+	f.Add("123", `{"type": "open", "source": "12"}`)
+
+	s := NewServer(false)
+	f.Fuzz(func(t *testing.T, hash string, block string) {
+		// Bad params are errors, never panics
+		for _, req := range []Request{
+			{"action": "block_info", "hash": hash},
+			{"action": "block_explain", "hash": hash},
+			{"action": "block_explain", "block": block},
+			{"action": "payment_status", "hash": hash},
+		} {
+			body, _ := json.Marshal(req)
+			call(s, string(body))
+		}
+	})
+}
+
+func TestForkProofAction(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = protocol.WorkLiveThreshold }()
+
+	// Two wallets on the same key both send from the genesis block
+	var sends []string
+	for i := uint64(1); i <= 2; i++ {
+		w := wallet.New(blocks.TestPrivateKey)
+		w.GeneratePowSync()
+		send, _ := w.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, i))
+		store.StoreBlock(send)
+		sends = append(sends, string(send.Hash()))
+	}
+
+	s := NewServer(false)
+	root := string(blocks.TestGenesisBlock.Hash())
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(`{"action": "fork_proof", "root": "`+strings.ToLower(root)+`"}`)))
+	var r struct {
+		Root    string
+		Account string
+		Valid   string
+		Blocks  []map[string]string
+	}
+	json.Unmarshal(rec.Body.Bytes(), &r)
+	if r.Root != root || r.Account != string(blocks.TestGenesisBlock.Account) || r.Valid != "true" || len(r.Blocks) != 2 {
+		t.Fatalf("Unexpected fork proof %s", rec.Body.String())
+	}
+	if r.Blocks[0]["hash"] != sends[0] || r.Blocks[1]["hash"] != sends[1] || r.Blocks[1]["balance"] != strings.ToUpper(blocks.GenesisAmount.Sub(uint128.FromInts(0, 2)).String()) {
+		t.Errorf("Wrong blocks in proof %v", r.Blocks)
+	}
+
+	if r := call(s, `{"action": "fork_proof", "root": "`+sends[0]+`"}`); r["error"] != "No fork proof for root" {
+		t.Errorf("Expected no proof, got %v", r)
+	}
+}
+
+// A block_info response, the contents as json_block gives them
+type legacyBlockInfo struct {
+	Hash         string            `json:"hash"`
+	BlockAccount string            `json:"block_account"`
+	Amount       string            `json:"amount"`
+	Balance      string            `json:"balance"`
+	Height       string            `json:"height"`
+	Contents     map[string]string `json:"contents"`
+}
+
+func TestBlockInfoLegacy(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+
+	// Legacy chains as the reference node reports them, with work for the
+	// live threshold
+	fixture, err := ioutil.ReadFile("../node/testdata/legacy_chains.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []legacyBlockInfo
+	if err = json.Unmarshal(fixture, &expected); err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range expected {
+		contents, _ := json.Marshal(info.Contents)
+		block, err := blocks.ParseJson(contents)
+		if err != nil {
+			t.Fatalf("Parsing %s: %s", info.Hash, err)
+		}
+		if err = store.StoreBlock(block); err != nil || string(block.Hash()) != info.Hash {
+			t.Fatalf("Storing %s as %s: %v", info.Hash, block.Hash(), err)
+		}
+	}
+
+	s := NewServer(false)
+	for _, info := range expected {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(`{"action": "block_info", "json_block": "true", "hash": "`+strings.ToLower(info.Hash)+`"}`)))
+		var actual legacyBlockInfo
+		json.Unmarshal(rec.Body.Bytes(), &actual)
+		actual.Hash = info.Hash
+		if !reflect.DeepEqual(actual, info) {
+			t.Errorf("Expected %+v, got %s", info, rec.Body.String())
+		}
+
+		// Without json_block the contents are a string of the same
+		r := call(s, `{"action": "block_info", "hash": "`+info.Hash+`"}`)
+		var contents map[string]string
+		if err := json.Unmarshal([]byte(r["contents"]), &contents); err != nil || !reflect.DeepEqual(contents, info.Contents) {
+			t.Errorf("Expected contents %v, got %v", info.Contents, r["contents"])
+		}
+	}
+
+	if r := call(s, `{"action": "block_info", "hash": "`+strings.Repeat("0", 64)+`"}`); r["error"] != "Block not found" {
+		t.Errorf("Expected block not found, got %v", r)
+	}
+	if r := call(s, `{"action": "block_info", "hash": "123"}`); r["error"] != rpcclient.ErrBadHash.Error() {
+		t.Errorf("Expected bad hash, got %v", r)
+	}
+}
+
+// A state block in the reference node's field order
+const referenceStateContents = `{"type":"state","account":"nano_3e3j5tkog48pnny9dmfzj1r16pg8t1e76dz5tmac6iq689wyjfpiij4txtdo","previous":"991CF190094C00F0B68E2E5F75F6BEE95A2E0BD93CEAA4A6734DB9F19B728948","representative":"nano_355z4uz75gjfjcb5ndydx9j5s5h9tko158hu47ff4eeyqajem5zjfhgzuo8m","balance":"1000000000000000000000000000000","link":"04270D7F11C4B2B472F2854C5A59F2A7E84226CE9ED799DE75744BD7D85FC9D9","link_as_account":"nano_13393ozj5j7kpjsh73cedbez7bzaaamex9pqm9h9cx4dtze7zkgswn7679cm","signature":"BF9360090ABDE803C3A92C07B3D4B55A1C1CC7B27B7D12C847D090556B1FF24B0BD81BF5898124C99CA266CB238A057DEFE8A6A5D6CADF6413622A2613797505","work":"7202df8a7c380578"}`
+
+func TestBlockContentsState(t *testing.T) {
+	block, err := blocks.ParseJson([]byte(referenceStateContents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := json.Marshal(blockContents(blocks.ToRaw(block))); string(body) != referenceStateContents {
+		t.Errorf("Expected %s, got %s", referenceStateContents, body)
+	}
+}
+
+func TestBlockExplainAction(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = protocol.WorkLiveThreshold }()
+
+	genesis := wallet.New(blocks.TestPrivateKey)
+	genesis.GeneratePowSync()
+	_, priv, _ := ed25519.GenerateKey(nil)
+	receiver := wallet.New(hex.EncodeToString(priv))
+	receiver.GeneratePowSync()
+	amount := uint128.FromInts(0, 1500)
+	send, _ := genesis.Send(receiver.Address(), amount)
+	store.StoreBlock(send)
+	open, _ := receiver.Open(send.Hash(), receiver.Address())
+	store.StoreBlock(open)
+
+	explain := func(request string) (r struct {
+		Amount    string
+		Height    string
+		Signature string
+		Confirmed string
+		Accounts  []map[string]string
+		Notes     []string
+		Text      string
+		Error     string
+	}) {
+		rec := httptest.NewRecorder()
+		NewServer(false).ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(request)))
+		json.Unmarshal(rec.Body.Bytes(), &r)
+		return
+	}
+
+	r := explain(`{"action": "block_explain", "hash": "` + string(open.Hash()) + `"}`)
+	if r.Amount != amount.Decimal() || r.Height != "1" || r.Signature != "yes" || r.Confirmed != "no" || len(r.Notes) != 0 {
+		t.Errorf("Unexpected open explanation %+v", r)
+	}
+	if len(r.Accounts) != 3 || r.Accounts[2]["role"] != "sender" || r.Accounts[2]["account"] != string(blocks.TestGenesisBlock.Account) {
+		t.Errorf("Expected the genesis account as sender, got %v", r.Accounts)
+	}
+
+	r = explain(`{"action": "block_explain", "hash": "` + string(send.Hash()) + `"}`)
+	if r.Amount != amount.Decimal() || r.Height != "2" || r.Signature != "yes" || !strings.Contains(r.Text, "send block") {
+		t.Errorf("Unexpected send explanation %+v", r)
+	}
+
+	// An unstored block given as json is explained from its chain
+	receiver.GeneratePowSync()
+	next, _ := receiver.Change(blocks.TestGenesisBlock.Account)
+	request, _ := json.Marshal(map[string]string{"action": "block_explain", "block": fmt.Sprintf(
+		`{"type": "change", "previous": "%s", "representative": "%s", "work": "%s", "signature": "%s"}`,
+		next.PreviousHash, next.Representative, next.Work, next.Signature)})
+	if r = explain(string(request)); r.Height != "2" || r.Signature != "yes" || r.Confirmed != "no" || len(r.Notes) != 0 {
+		t.Errorf("Unexpected unstored change explanation %+v", r)
+	}
+
+	if r = explain(`{"action": "block_explain", "hash": "` + string(next.Hash()) + `"}`); r.Error != "Block not found" {
+		t.Errorf("Expected block not found, got %+v", r)
+	}
+}
+
+func TestEventSessionReconnect(t *testing.T) {
+	s := NewServer(false)
+	s.SummaryInterval = 10 * time.Millisecond
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	votes := make(chan rpcclient.Event, 100)
+	connects := make(chan bool, 10)
+	client := rpcclient.New(server.URL)
+	client.Backoff = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := rpcclient.WatchOptions{Session: "reconnect", AckInterval: 5 * time.Millisecond}
+	go client.Watch(ctx, opts, func(e rpcclient.Event) {
+		switch e.Type {
+		case node.EventSummary:
+			select {
+			case connects <- true:
+			default:
+			}
+		case node.EventVote:
+			votes <- e
+		}
+	})
+	connected := func() {
+		select {
+		case <-connects:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Watch didn't connect")
+		}
+	}
+	connected()
+
+	var hashes []types.BlockHash
+	publish := func(n int) {
+		for i := 0; i < n; i++ {
+			hash := types.BlockHash(fmt.Sprintf("%064X", len(hashes)+1))
+			hashes = append(hashes, hash)
+			node.Events.Publish(node.Event{Type: node.EventVote, Hash: hash})
+		}
+	}
+	var got []rpcclient.Event
+	receive := func(n int) {
+		for len(got) < n {
+			select {
+			case e := <-votes:
+				got = append(got, e)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Got %d of %d events", len(got), n)
+			}
+		}
+	}
+
+	publish(3)
+	receive(3)
+	// Events published while the client is away are kept for it
+	server.CloseClientConnections()
+	publish(3)
+	receive(6)
+	for i, e := range got {
+		if e.Hash != hashes[i] || e.Seq != got[0].Seq+uint64(i) {
+			t.Errorf("Event %d is %s seq %d, expected %s in sequence", i, e.Hash, e.Seq, hashes[i])
+		}
+	}
+	select {
+	case e := <-votes:
+		t.Errorf("Unexpected extra event %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Everything given to fn is acked
+	time.Sleep(50 * time.Millisecond)
+	if r := call(s, `{"action": "events_ack", "session": "reconnect", "seq": "0"}`); r["unacked"] != "0" || r["best_effort"] != "false" {
+		t.Errorf("Expected nothing unacked, got %v", r)
+	}
+}
+
+// Opens a session's stream, returning its events as they arrive.
+func openSession(t *testing.T, url string, query string) (<-chan map[string]interface{}, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("GET", url+"/events?"+query, nil)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to open session: %v", err)
+	}
+	events := make(chan map[string]interface{}, 100)
+	go func() {
+		defer close(events)
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			var e map[string]interface{}
+			if decoder.Decode(&e) != nil {
+				return
+			}
+			events <- e
+		}
+	}()
+	return events, func() {
+		cancel()
+		resp.Body.Close()
+	}
+}
+
+func nextEvent(t *testing.T, events <-chan map[string]interface{}, kind string) map[string]interface{} {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e["type"] == kind {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("No %s event", kind)
+		}
+	}
+}
+
+func TestEventSessionOverflow(t *testing.T) {
+	s := NewServer(false)
+	s.MaxUnacked = 3
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	events, stop := openSession(t, server.URL, "session=slow")
+	defer stop()
+	nextEvent(t, events, node.EventSummary)
+	for i := 0; i < 5; i++ {
+		node.Events.Publish(node.Event{Type: node.EventVote, Hash: types.BlockHash(strings.Repeat("D4", 32))})
+	}
+	nextEvent(t, events, EventBestEffort)
+	if r := call(s, `{"action": "events_ack", "session": "slow", "seq": "1"}`); r["best_effort"] != "true" {
+		t.Errorf("Expected the session to be best effort, got %v", r)
+	}
+	if r := call(s, `{"action": "events_ack", "session": "slow", "seq": "100"}`); r["error"] == "" {
+		t.Errorf("Acked events that weren't sent")
+	}
+}
+
+func TestEventSessionExpiry(t *testing.T) {
+	s := NewServer(false)
+	s.SessionTTL = 10 * time.Millisecond
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	events, stop := openSession(t, server.URL, "session=brief")
+	nextEvent(t, events, node.EventSummary)
+	stop()
+	time.Sleep(100 * time.Millisecond)
+	if r := call(s, `{"action": "events_ack", "session": "brief", "seq": "0"}`); r["error"] != ErrUnknownSession.Error() {
+		t.Errorf("Expected the session to have expired, got %v", r)
+	}
+
+	events, stop = openSession(t, server.URL, "session=brief&last=5")
+	defer stop()
+	if e := <-events; e["type"] != EventSessionExpired {
+		t.Errorf("Expected the resumed session to report it expired, got %v", e)
+	}
+}
+
+func TestClient(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = protocol.WorkLiveThreshold }()
+
+	genesis := wallet.New(blocks.TestPrivateKey)
+	genesis.GeneratePowSync()
+	pub, _ := address.GenerateKey()
+	unopened := address.PubKeyToAddress(pub)
+	send, _ := genesis.Send(unopened, store.DustThreshold)
+	store.StoreBlock(send)
+
+	s := NewServer(false)
+	// Every internal error with a reference string reaches the client as
+	// its sentinel
+	for internal, reference := range referenceErrors {
+		internal := internal
+		s.Handle("fail", false, func(req Request) (interface{}, error) {
+			return nil, errors.Wrap(internal, "Wrapped")
+		})
+		server := httptest.NewServer(s)
+		err := rpcclient.New(server.URL).Call(context.Background(), "fail", nil, nil)
+		server.Close()
+		if !goerrors.Is(err, reference) || err.Error() != reference.Error() {
+			t.Errorf("%s reached the client as %v", internal, err)
+		}
+	}
+
+	server := httptest.NewServer(s)
+	defer server.Close()
+	client := rpcclient.New(server.URL)
+	info, err := client.AccountInfo(context.Background(), blocks.TestGenesisBlock.Account)
+	if err != nil || info.Frontier != send.Hash() || info.BlockCount != 2 || info.Balance != blocks.GenesisAmount.Sub(store.DustThreshold) {
+		t.Errorf("Unexpected genesis account info %+v, %v", info, err)
+	}
+	if _, err = client.AccountInfo(context.Background(), unopened); !goerrors.Is(err, rpcclient.ErrAccountNotFound) {
+		t.Errorf("Expected account not found, got %v", err)
+	}
+	if _, err = client.AccountInfo(context.Background(), "xrb_1"); !goerrors.Is(err, rpcclient.ErrBadAccount) {
+		t.Errorf("Expected bad account, got %v", err)
+	}
+
+	receivable, err := client.Pending(context.Background(), unopened, 10, "")
+	if err != nil || len(receivable.Blocks) != 1 || receivable.Blocks[0] != (rpcclient.Receivable{send.Hash(), store.DustThreshold}) {
+		t.Errorf("Unexpected pending %+v, %v", receivable, err)
+	}
+	history, err := client.AccountHistory(context.Background(), blocks.TestGenesisBlock.Account, 1, "")
+	if err != nil || len(history.History) != 1 || history.History[0].Hash != send.Hash() || history.Cursor == "" {
+		t.Errorf("Unexpected history page %+v, %v", history, err)
+	}
+	history, err = client.AccountHistory(context.Background(), blocks.TestGenesisBlock.Account, 1, history.Cursor)
+	if err != nil || len(history.History) != 1 || history.History[0].Hash != blocks.TestGenesisBlock.Hash() || history.Cursor != "" {
+		t.Errorf("Unexpected last history page %+v, %v", history, err)
+	}
+
+	// Numbers in compat mode decode the same
+	s.Compat.Amounts = AmountNumber
+	reps, err := client.Representatives(context.Background(), 10, "")
+	if err != nil || len(reps.Representatives) != 1 || reps.Representatives[0].Weight != blocks.GenesisAmount.Sub(store.DustThreshold) {
+		t.Errorf("Unexpected representatives %+v, %v", reps, err)
+	}
+}
+
+func TestTraceAction(t *testing.T) {
+	metrics.Traces.SetSampleRate(1)
+	defer metrics.Traces.SetSampleRate(metrics.DefaultTraceSampleRate)
+	hash := types.BlockHash(strings.Repeat("A1", 32))
+	start := time.Unix(1500000000, 0)
+	metrics.Traces.RecordAt(hash, metrics.StageReceived, start)
+	metrics.Traces.RecordAt(hash, metrics.StageProcessed, start.Add(1500*time.Microsecond))
+
+	rec := httptest.NewRecorder()
+	s := NewServer(false)
+	s.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(`{"action": "trace", "hash": "`+strings.ToLower(string(hash))+`"}`)))
+	expected := `{"hash":"` + string(hash) + `","stages":[{"stage":"received","time":"1500000000000","elapsed_ms":"0.000"},{"stage":"processed","time":"1500000000001","elapsed_ms":"1.500"}]}`
+	if body := strings.TrimSpace(rec.Body.String()); body != expected {
+		t.Errorf("Wrong trace\ngot      %s\nexpected %s", body, expected)
+	}
+
+	if r := call(s, `{"action": "trace", "hash": "`+strings.Repeat("B2", 32)+`"}`); r["error"] != "Block not traced" {
+		t.Errorf("Expected untraced block, got %v", r)
+	}
+	if r := call(s, `{"action": "trace", "hash": "xyz"}`); r["error"] != rpcclient.ErrBadHash.Error() {
+		t.Errorf("Expected bad hash, got %v", r)
+	}
+}
+
+func TestMinVersion(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = protocol.WorkLiveThreshold }()
+
+	s := NewServer(false)
+	genesis := wallet.New(blocks.TestPrivateKey)
+	account := string(genesis.Address())
+	var stale int32
+	for i := 0; i < 4; i++ {
+		result, err := genesis.BatchSend([]wallet.Recipient{{genesis.Address(), store.DustThreshold}}, wallet.BatchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := `{"action": "account_info", "account": "` + account + `", "min_version": "` + strconv.FormatUint(wallet.LastWrite(genesis.Address()), 10) + `"}`
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if r := call(s, request); r["frontier"] != string(result.Frontier) {
+					atomic.AddInt32(&stale, 1)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	if stale != 0 {
+		t.Errorf("%d stale reads", stale)
+	}
+
+	s.MinVersionWait = time.Millisecond
+	ahead := strconv.FormatUint(store.Version()+1, 10)
+	if r := call(s, `{"action": "account_info", "account": "`+account+`", "min_version": "`+ahead+`"}`); r["error"] != ErrMinVersionTimeout.Error() {
+		t.Errorf("Expected a min_version timeout, got %v", r)
+	}
+	if r := call(s, `{"action": "account_info", "account": "`+account+`", "min_version": "-1"}`); r["error"] != "Bad min_version" {
+		t.Errorf("Expected a bad min_version, got %v", r)
+	}
+}
+
+func TestReplicaReads(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = protocol.WorkLiveThreshold }()
+	replicaPath := store.TestConfig.Path + "-replica"
+	defer os.RemoveAll(replicaPath)
+
+	s := NewServer(false)
+	s.Replica = store.NewReplica(replicaPath, time.Hour)
+	if err := s.Replica.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	genesis := wallet.New(blocks.TestPrivateKey)
+	genesis.GeneratePowSync()
+	send, _ := genesis.Send(genesis.Address(), store.DustThreshold)
+	store.StoreBlock(send)
+
+	// The snapshot predates the send, unless the request needs it
+	request := `{"action": "block_info", "hash": "` + string(send.Hash()) + `"`
+	if r := call(s, request+`}`); r["error"] != "Block not found" {
+		t.Errorf("Expected the block lookup served from the snapshot, got %v", r)
+	}
+	version := strconv.FormatUint(store.Version(), 10)
+	if r := call(s, request+`, "min_version": "`+version+`"}`); r["block_account"] != string(genesis.Address()) {
+		t.Errorf("Expected a min_version read from the store, got %v", r)
+	}
+	s.Replica.Refresh()
+	if r := call(s, request+`}`); r["block_account"] != string(genesis.Address()) {
+		t.Errorf("Expected the block in a new snapshot, got %v", r)
+	}
+}
+
+func TestRepresentativesRecommended(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+
+	s := NewServer(false)
+	body := func(request string) string {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(request)))
+		return strings.TrimSpace(rec.Body.String())
+	}
+	// The genesis account holds all the weight and hasn't been seen voting
+	expected := `{"representatives":[{"account":"` + string(blocks.TestGenesisBlock.Account) + `","weight":"` + blocks.GenesisAmount.Decimal() + `","weight_share":"1.0000","participation":"0.0000","uptime":"0.0000","concentrated":"true","score":"0.0000"}]}`
+	if b := body(`{"action": "representatives_recommended"}`); b != expected {
+		t.Errorf("Wrong recommendations\ngot      %s\nexpected %s", b, expected)
+	}
+	if b := body(`{"action": "representatives_recommended", "exclude_top": "true"}`); b != `{"representatives":[]}` {
+		t.Errorf("Concentrated rep not excluded: %s", b)
+	}
+	if r := call(s, `{"action": "representatives_recommended", "count": "0"}`); r["error"] != "Bad count" {
+		t.Errorf("Expected a bad count, got %v", r)
+	}
+}
+
+func TestMaintenanceActions(t *testing.T) {
+	ran := make(chan bool, 1)
+	node.Maintenance.Register(node.MaintenanceJob{Name: "rpc_test", Group: "disk", Slice: func() (bool, error) {
+		ran <- true
+		return true, errors.New("Disk full")
+	}})
+	node.Maintenance.Load = func() (int, time.Duration) { return 0, 0 }
+	defer func() { node.Maintenance.Load = nil }()
+
+	s := NewServer(true)
+	if r := call(s, `{"action": "maintenance_run", "job": "nonsense"}`); r["error"] != node.ErrUnknownJob.Error() {
+		t.Errorf("Expected unknown job, got %v", r)
+	}
+	if r := call(s, `{"action": "maintenance_run", "job": "rpc_test"}`); r["started"] != "1" {
+		t.Fatalf("Job not started: %v", r)
+	}
+	<-ran
+
+	var status string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(`{"action": "maintenance_status"}`)))
+		status = strings.TrimSpace(rec.Body.String())
+		if strings.Contains(status, `"status":"failed"`) {
+			break
+		}
+	}
+	if !strings.Contains(status, `{"name":"rpc_test","group":"disk","status":"failed","runs":"1","slices":"1","backoffs":"0","last_run":"`) || !strings.Contains(status, `"error":"Disk full"}`) {
+		t.Errorf("Wrong status %s", status)
+	}
+}
+
+func TestBootstrapStatusAction(t *testing.T) {
+	node.Bootstrap.Start()
+	defer node.Bootstrap.Start()
+	node.Bootstrap.AddFrontier(store.Frontier{Blocks: 40})
+	node.Bootstrap.AddFrontier(store.Frontier{Blocks: 60})
+	node.Bootstrap.FrontiersDone()
+	node.Bootstrap.AddBlocks(25)
+
+	r := call(NewServer(false), `{"action": "bootstrap_status"}`)
+	if r["basis"] != node.BootstrapByBlocks || r["progress"] != "25.00" || r["blocks"] != "100" || r["pulled"] != "25" || r["frontiers_done"] != "true" || r["started"] == "0" {
+		t.Errorf("Unexpected status %v", r)
+	}
+}
+
+func TestDiskSpaceAction(t *testing.T) {
+	defer func(paths []string, probe func(string) (uint64, uint64, error)) {
+		node.Disk.Paths, node.Disk.Probe = paths, probe
+	}(node.Disk.Paths, node.Disk.Probe)
+	defer store.SetWritable()
+	node.Disk.Paths = []string{"store"}
+	node.Disk.Probe = func(string) (uint64, uint64, error) { return 1, 1000, nil }
+	node.Disk.Check()
+
+	r := call(NewServer(false), `{"action": "disk_space"}`)
+	if r["mode"] != store.LedgerReadOnly || !strings.Contains(r["reason"], "1 bytes free on store") || r["since"] == "0" {
+		t.Errorf("Unexpected disk space %v", r)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	s := NewServer(false)
+	s.SummaryInterval = 10 * time.Millisecond
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	events := make(chan rpcclient.Event, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rpcclient.New(server.URL).Watch(ctx, rpcclient.WatchOptions{}, func(e rpcclient.Event) { events <- e })
+
+	next := func(kind string) rpcclient.Event {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case e := <-events:
+				if e.Type == kind {
+					return e
+				}
+			case <-timeout:
+				t.Fatalf("No %s event", kind)
+			}
+		}
+	}
+	next(node.EventSummary)
+	next(node.EventSummary)
+
+	hash := types.BlockHash(strings.Repeat("C3", 32))
+	node.Events.Publish(node.Event{Type: node.EventVote, Hash: hash, Representative: blocks.TestGenesisBlock.Account})
+	if e := next(node.EventVote); e.Hash != hash || e.Representative != blocks.TestGenesisBlock.Account || e.Time == 0 {
+		t.Errorf("Wrong vote event %+v", e)
+	}
+}
+
+func TestSafeModeActions(t *testing.T) {
+	if r := call(NewServer(false), `{"action": "safe_mode"}`); r["safe_mode"] != "false" {
+		t.Errorf("Unexpected report outside safe mode %v", r)
+	}
+
+	exited := false
+	defer func() { node.OnSafeModeExit = nil }()
+	node.OnSafeModeExit = func() { exited = true }
+	node.EnterSafeMode(node.SafeModeReport{Crashes: 3, ConfigErr: "Bad max_peers"})
+	defer node.ExitSafeMode()
+
+	s := NewServer(true)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(`{"action": "safe_mode"}`)))
+	var report map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &report)
+	if report["safe_mode"] != "true" || report["crashes"] != "3" || report["store"] != "ok" || report["config"] != "Bad max_peers" {
+		t.Errorf("Unexpected report %v", report)
+	}
+
+	// Control actions other than leaving safe mode are refused
+	if r := call(s, `{"action": "maintenance_run", "job": "backlog"}`); r["error"] != node.ErrSafeMode.Error() {
+		t.Errorf("Expected safe mode error, got %v", r)
+	}
+	if r := call(NewServer(false), `{"action": "safe_mode_exit"}`); r["error"] != ErrControlDisabled.Error() {
+		t.Errorf("Expected control disabled error, got %v", r)
+	}
+	call(s, `{"action": "safe_mode_exit"}`)
+	if node.InSafeMode() || !exited {
+		t.Errorf("Safe mode not left")
+	}
+	if r := call(s, `{"action": "safe_mode_exit"}`); r["error"] != "Not in safe mode" {
+		t.Errorf("Expected not in safe mode error, got %v", r)
+	}
+}
+
+func TestVoteHistoryAction(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	rep := blocks.TestGenesisBlock.Account
+	now := time.Now()
+	store.StoreVote(store.VoteRecord{Root: blocks.TestGenesisBlock.Hash(), Hash: blocks.TestGenesisBlock.Hash(), Representative: rep, Received: now})
+
+	s := NewServer(false)
+	r := call(s, `{"action": "vote_history", "representative": "`+string(rep)+`", "format": "csv"}`)
+	if r["format"] != "csv" || !strings.Contains(r["report"], "vote,") {
+		t.Fatalf("Unexpected vote history %v", r)
+	}
+	if err := node.VerifyVoteReport([]byte(r["report"]), r["node_id"], r["signature"]); err != nil {
+		t.Errorf("Report signature didn't verify: %s", err)
+	}
+	// Ranges are in unix milliseconds
+	ms := func(t time.Time) string { return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10) }
+	if r := call(s, `{"action": "vote_history", "from": "`+ms(now.Add(time.Minute))+`", "to": "`+ms(now.Add(time.Hour))+`"}`); !strings.Contains(r["report"], `"votes":[]`) {
+		t.Errorf("Vote before the range reported %v", r)
+	}
+	if r := call(s, `{"action": "vote_history", "from": "`+ms(now)+`", "to": "`+ms(now.Add(-time.Hour))+`"}`); r["error"] != "Bad range" {
+		t.Errorf("Expected a bad range error, got %v", r)
+	}
+	if r := call(s, `{"action": "vote_history", "representative": "nano_bad"}`); r["error"] != rpcclient.ErrBadAccount.Error() {
+		t.Errorf("Expected a bad account error, got %v", r)
+	}
+}
+
+func TestSyncStatusAction(t *testing.T) {
+	rec := httptest.NewRecorder()
+	NewServer(false).ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(`{"action": "sync_status"}`)))
+	var r struct {
+		Status  string            `json:"status"`
+		Peers   string            `json:"peers"`
+		Network map[string]string `json:"network"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &r)
+	if r.Status != node.SyncUnknown || r.Peers != "0" || r.Network["blocks"] != "0" {
+		t.Errorf("Unexpected sync status %s", rec.Body.String())
+	}
+}
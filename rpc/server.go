@@ -0,0 +1,205 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/frankh/nano/node"
+	"github.com/frankh/nano/rpcclient"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/uint128"
+	"github.com/frankh/nano/utils"
+	"github.com/pkg/errors"
+)
+
+// Requests larger than this are rejected with 413 by default
+const DefaultMaxRequestSize = 1 << 20
+
+// Requests are a flat object of strings, with a field for each argument
+const maxRequestDepth = 1
+const maxRequestFields = 64
+
+// How long a request waits for its min_version before failing
+const DefaultMinVersionWait = 5 * time.Second
+
+var ErrMinVersionTimeout = errors.New("Timed out waiting for min_version")
+var ErrRequestTooLarge = errors.New("Request too large")
+
+var ErrControlDisabled = rpcclient.ErrControlDisabled
+var ErrUnknownAction = rpcclient.ErrUnknownAction
+
+// Control actions allowed in safe mode, when the rest are refused so
+// the rpc only reads
+var safeModeActions = map[string]bool{"safe_mode_exit": true}
+
+// Request holds the fields of an rpc request, which are strings in the
+// reference protocol.
+type Request map[string]string
+
+func (r Request) Int(key string, def int) (int, error) {
+	s, ok := r[key]
+	if !ok {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errors.Errorf("Bad %s", key)
+	}
+	return n, nil
+}
+
+type ActionFn func(req Request) (interface{}, error)
+
+type action struct {
+	fn ActionFn
+	// Only allowed with EnableControl
+	control bool
+}
+
+// Server dispatches JSON rpc requests by their "action" field. Errors
+// are returned as {"error": "..."} like the reference node. GET /events
+// streams the node's events.
+type Server struct {
+	EnableControl   bool
+	Compat          Compat
+	MaxRequestSize  int64
+	MinVersionWait  time.Duration
+	SummaryInterval time.Duration
+	// Acknowledged event delivery, see serveSession
+	SessionTTL  time.Duration
+	MaxUnacked  int
+	MaxSessions int
+	// Where block lookups are read from when it's fresh enough, nil for
+	// the primary store
+	Replica  *store.Replica
+	actions  map[string]action
+	sessions *eventSessions
+}
+
+func NewServer(enableControl bool) *Server {
+	s := &Server{
+		EnableControl:   enableControl,
+		MaxRequestSize:  DefaultMaxRequestSize,
+		MinVersionWait:  DefaultMinVersionWait,
+		SummaryInterval: DefaultSummaryInterval,
+		SessionTTL:      DefaultSessionTTL,
+		MaxUnacked:      DefaultMaxUnacked,
+		MaxSessions:     DefaultMaxSessions,
+		actions:         make(map[string]action),
+		sessions:        newEventSessions(),
+	}
+	registerActions(s)
+	return s
+}
+
+func (s *Server) Handle(name string, control bool, fn ActionFn) {
+	s.actions[name] = action{fn, control}
+}
+
+func (s *Server) call(req Request) (interface{}, error) {
+	a, ok := s.actions[req["action"]]
+	if !ok {
+		return nil, ErrUnknownAction
+	}
+	if a.control && !s.EnableControl {
+		return nil, ErrControlDisabled
+	}
+	if a.control && node.InSafeMode() && !safeModeActions[req["action"]] {
+		return nil, node.ErrSafeMode
+	}
+	if err := s.waitForVersion(req); err != nil {
+		return nil, err
+	}
+	return a.fn(req)
+}
+
+// The store a request's block lookups are read from: the replica unless
+// it's too stale or hasn't caught up with the request's min_version.
+func (s *Server) reader(req Request) store.Reader {
+	if s.Replica == nil {
+		return store.Primary
+	}
+	if version, err := strconv.ParseUint(req["min_version"], 10, 64); err == nil {
+		return s.Replica.ReaderAt(version)
+	}
+	return s.Replica.Reader(false)
+}
+
+// Any request can carry a min_version, e.g. from wallet.LastWrite, to be
+// answered only once the store has the writes up to it.
+func (s *Server) waitForVersion(req Request) error {
+	v, ok := req["min_version"]
+	if !ok {
+		return nil
+	}
+	version, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return errors.New("Bad min_version")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.MinVersionWait)
+	defer cancel()
+	if store.WaitForVersion(ctx, version) != nil {
+		return ErrMinVersionTimeout
+	}
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" && r.URL.Path == "/events" {
+		s.serveEvents(w, r)
+		return
+	}
+	var req Request
+	body, err := readRequest(w, r, s.MaxRequestSize)
+	if err == ErrRequestTooLarge {
+		requestTooLarge(w)
+		return
+	}
+	if err == nil {
+		err = utils.CheckJSONShape(body, maxRequestDepth, maxRequestFields)
+	}
+	if err == nil {
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			err = rpcclient.ErrBadJSON
+		}
+	}
+
+	var response interface{}
+	compat := s.Compat
+	if err == nil {
+		compat, err = s.compat(req)
+	}
+	if err == nil {
+		response, err = s.call(req)
+	}
+	if err != nil {
+		response = Object{{"error", referenceError(err).Error()}}
+	}
+	WriteResponse(w, compat.apply(response))
+}
+
+// Reads the request body, failing with ErrRequestTooLarge past limit
+// without reading any further.
+func readRequest(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if _, ok := err.(*http.MaxBytesError); ok {
+		return nil, ErrRequestTooLarge
+	}
+	return body, err
+}
+
+func requestTooLarge(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	json.NewEncoder(w).Encode(Object{{"error", ErrRequestTooLarge.Error()}})
+}
+
+// Decimal string of a raw amount, as the reference rpc returns them.
+func Raw(u uint128.Uint128) string {
+	return u.Decimal()
+}
@@ -0,0 +1,120 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/frankh/crypto/ed25519"
+	"github.com/golang/crypto/blake2b"
+	"github.com/pkg/errors"
+)
+
+const TimestampHeader = "X-Nano-Timestamp"
+const RequestHashHeader = "X-Nano-Request-Hash"
+const SignatureHeader = "X-Nano-Signature"
+
+var ErrBadResponseSignature = errors.New("Bad response signature")
+
+// Hex blake2b-256 of a request body, as sent in RequestHashHeader.
+func RequestHash(body []byte) string {
+	hash := blake2b.Sum256(body)
+	return hex.EncodeToString(hash[:])
+}
+
+// What's signed: the canonical body, the unix timestamp and the request
+// hash, newline separated.
+func signedMessage(body []byte, timestamp string, requestHash string) ([]byte, error) {
+	canonical, err := Canonicalize(body)
+	if err != nil {
+		return nil, err
+	}
+	message := append(canonical, '\n')
+	message = append(message, timestamp...)
+	message = append(message, '\n')
+	return append(message, requestHash...), nil
+}
+
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *bufferedResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *bufferedResponse) WriteHeader(status int) {
+	r.status = status
+}
+
+func (r *bufferedResponse) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+// SignResponses wraps an rpc handler so every JSON response carries a
+// detached ed25519 signature, for tamper-evident audit logs. Responses
+// that aren't valid JSON are passed through unsigned.
+func SignResponses(handler http.Handler, key ed25519.PrivateKey) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The request is held in memory, so is limited like the
+		// server's own
+		limit := int64(DefaultMaxRequestSize)
+		if s, ok := handler.(*Server); ok {
+			limit = s.MaxRequestSize
+		}
+		request, err := readRequest(w, r, limit)
+		if err == ErrRequestTooLarge {
+			requestTooLarge(w)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to read request", http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(request))
+
+		response := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+		handler.ServeHTTP(response, r)
+
+		for k, v := range response.header {
+			w.Header()[k] = v
+		}
+
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		requestHash := RequestHash(request)
+		message, err := signedMessage(response.body.Bytes(), timestamp, requestHash)
+		if err == nil {
+			w.Header().Set(TimestampHeader, timestamp)
+			w.Header().Set(RequestHashHeader, requestHash)
+			w.Header().Set(SignatureHeader, hex.EncodeToString(ed25519.Sign(key, message)))
+		}
+
+		w.WriteHeader(response.status)
+		w.Write(response.body.Bytes())
+	})
+}
+
+// VerifyResponse checks a signed response. The body may have been
+// reformatted in transit, since the signature covers its canonical form.
+// Callers should also compare the request hash header with RequestHash of
+// what they sent.
+func VerifyResponse(body []byte, headers http.Header, key ed25519.PublicKey) error {
+	signature, err := hex.DecodeString(headers.Get(SignatureHeader))
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return ErrBadResponseSignature
+	}
+
+	message, err := signedMessage(body, headers.Get(TimestampHeader), headers.Get(RequestHashHeader))
+	if err != nil {
+		return errors.Wrap(err, "Invalid response body")
+	}
+	if !ed25519.Verify(key, message, signature) {
+		return ErrBadResponseSignature
+	}
+	return nil
+}
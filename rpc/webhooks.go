@@ -0,0 +1,27 @@
+//go:build !light
+// +build !light
+
+package rpc
+
+import (
+	"strconv"
+
+	"github.com/frankh/nano/wallet"
+)
+
+// Delivery health of each webhook endpoint, in url order.
+func webhooks(req Request) (interface{}, error) {
+	endpoints := []Object{}
+	for _, h := range wallet.Webhooks.Health() {
+		endpoints = append(endpoints, Object{
+			{"url", h.URL},
+			{"state", h.State},
+			{"failures", strconv.Itoa(h.Failures)},
+			{"held", strconv.Itoa(h.Held)},
+			{"delivered", strconv.FormatUint(h.Delivered, 10)},
+			{"failed", strconv.FormatUint(h.Failed, 10)},
+			{"dead_lettered", strconv.FormatUint(h.DeadLettered, 10)},
+		})
+	}
+	return Object{{"endpoints", endpoints}}, nil
+}
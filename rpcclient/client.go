@@ -0,0 +1,325 @@
+// Package rpcclient is a Go client for the node's JSON rpc. It only uses
+// actions and fields the reference node has too, so it works against
+// either.
+package rpcclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/frankh/nano/utils"
+	"github.com/pkg/errors"
+)
+
+const DefaultRetries = 3
+const DefaultBackoff = 250 * time.Millisecond
+
+type Client struct {
+	URL  string
+	HTTP *http.Client
+	// Attempts after the first for transient failures: connection errors
+	// and 429 or 5xx responses. Error responses aren't retried.
+	Retries int
+	// Before the first retry, doubling for each one after
+	Backoff time.Duration
+}
+
+func New(url string) *Client {
+	return &Client{URL: url, HTTP: http.DefaultClient, Retries: DefaultRetries, Backoff: DefaultBackoff}
+}
+
+// Call sends an action with its params and decodes the response into
+// result, which may be nil. Error responses are returned as *Error.
+func (c *Client) Call(ctx context.Context, action string, params map[string]string, result interface{}) error {
+	request := map[string]string{"action": action}
+	for k, v := range params {
+		request[k] = v
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	var response []byte
+	err = c.retry().Do(ctx, func(ctx context.Context) error {
+		response, err = c.post(ctx, body)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return decode(action, response, result)
+}
+
+func (c *Client) retry() utils.RetryPolicy {
+	return utils.RetryPolicy{Component: "rpcclient", Base: c.Backoff, MaxAttempts: c.Retries + 1}
+}
+
+func (c *Client) post(ctx context.Context, body []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", c.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, utils.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.HTTP.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	response, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return nil, &utils.StatusError{Code: resp.StatusCode, Message: "Rpc returned " + resp.Status}
+	}
+	return response, nil
+}
+
+func decode(action string, response []byte, result interface{}) error {
+	var e struct {
+		Error *string `json:"error"`
+	}
+	if err := json.Unmarshal(response, &e); err != nil {
+		return errors.Wrap(err, "Bad rpc response")
+	}
+	if e.Error != nil {
+		return FromMessage(action, *e.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	return errors.Wrap(json.Unmarshal(response, result), "Bad rpc response")
+}
+
+// A raw amount, sent as a decimal string or, in compat mode, a number.
+type amount uint128.Uint128
+
+func (a *amount) UnmarshalJSON(b []byte) error {
+	u, err := uint128.FromDecimal(strings.Trim(string(b), `"`))
+	*a = amount(u)
+	return err
+}
+
+// Counts are sent as strings.
+type count int
+
+func (c *count) UnmarshalJSON(b []byte) error {
+	n, err := strconv.Atoi(strings.Trim(string(b), `"`))
+	*c = count(n)
+	return err
+}
+
+type AccountInfo struct {
+	Frontier   types.BlockHash
+	OpenBlock  types.BlockHash
+	Balance    uint128.Uint128
+	BlockCount int
+	Receivable uint128.Uint128
+}
+
+func (c *Client) AccountInfo(ctx context.Context, account types.Account) (AccountInfo, error) {
+	var r struct {
+		Frontier   types.BlockHash `json:"frontier"`
+		OpenBlock  types.BlockHash `json:"open_block"`
+		Balance    amount          `json:"balance"`
+		BlockCount count           `json:"block_count"`
+		// Both names, as only one is sent
+		Receivable *amount `json:"receivable"`
+		Pending    *amount `json:"pending"`
+	}
+	params := map[string]string{"account": string(account), "receivable": "true", "pending": "true"}
+	if err := c.Call(ctx, "account_info", params, &r); err != nil {
+		return AccountInfo{}, err
+	}
+
+	info := AccountInfo{r.Frontier, r.OpenBlock, uint128.Uint128(r.Balance), int(r.BlockCount), uint128.Uint128{}}
+	if r.Receivable != nil {
+		info.Receivable = uint128.Uint128(*r.Receivable)
+	} else if r.Pending != nil {
+		info.Receivable = uint128.Uint128(*r.Pending)
+	}
+	return info, nil
+}
+
+type HistoryEntry struct {
+	Type    string
+	Account types.Account
+	Amount  uint128.Uint128
+	Hash    types.BlockHash
+}
+
+// Lists come a page at a time. Cursor is empty on the last page, or from
+// a node that doesn't page lists.
+type HistoryPage struct {
+	History []HistoryEntry
+	Cursor  string
+}
+
+// AccountHistory returns up to n blocks newest first, starting after
+// cursor if it isn't empty.
+func (c *Client) AccountHistory(ctx context.Context, account types.Account, n int, cursor string) (HistoryPage, error) {
+	var r struct {
+		History []struct {
+			Type    string          `json:"type"`
+			Account types.Account   `json:"account"`
+			Amount  amount          `json:"amount"`
+			Hash    types.BlockHash `json:"hash"`
+		} `json:"history"`
+		Cursor string `json:"cursor"`
+	}
+	params := pageParams(n, cursor)
+	params["account"] = string(account)
+	if err := c.Call(ctx, "account_history", params, &r); err != nil {
+		return HistoryPage{}, err
+	}
+
+	page := HistoryPage{Cursor: r.Cursor}
+	for _, h := range r.History {
+		page.History = append(page.History, HistoryEntry{h.Type, h.Account, uint128.Uint128(h.Amount), h.Hash})
+	}
+	return page, nil
+}
+
+type Receivable struct {
+	Hash   types.BlockHash
+	Amount uint128.Uint128
+}
+
+type ReceivablePage struct {
+	Blocks []Receivable
+	Cursor string
+}
+
+// Pending returns unreceived sends to account. Nodes that list just the
+// hashes leave the amounts zero.
+func (c *Client) Pending(ctx context.Context, account types.Account, n int, cursor string) (ReceivablePage, error) {
+	var r struct {
+		Blocks json.RawMessage `json:"blocks"`
+		Cursor string          `json:"cursor"`
+	}
+	params := pageParams(n, cursor)
+	params["account"] = string(account)
+	if err := c.Call(ctx, "pending", params, &r); err != nil {
+		return ReceivablePage{}, err
+	}
+
+	page := ReceivablePage{Cursor: r.Cursor}
+	var amounts orderedAmounts
+	var hashes []types.BlockHash
+	if json.Unmarshal(r.Blocks, &amounts) == nil {
+		for _, a := range amounts {
+			page.Blocks = append(page.Blocks, Receivable{types.BlockHash(a.key), a.amount})
+		}
+	} else if json.Unmarshal(r.Blocks, &hashes) == nil {
+		for _, hash := range hashes {
+			page.Blocks = append(page.Blocks, Receivable{Hash: hash})
+		}
+	} else if len(bytes.TrimSpace(r.Blocks)) > 0 && string(r.Blocks) != `""` {
+		return ReceivablePage{}, errors.New("Bad rpc response: blocks")
+	}
+	return page, nil
+}
+
+type Weight struct {
+	Representative types.Account
+	Weight         uint128.Uint128
+}
+
+type RepresentativesPage struct {
+	Representatives []Weight
+	Cursor          string
+}
+
+func (c *Client) Representatives(ctx context.Context, n int, cursor string) (RepresentativesPage, error) {
+	var r struct {
+		Representatives orderedAmounts `json:"representatives"`
+		Cursor          string         `json:"cursor"`
+	}
+	if err := c.Call(ctx, "representatives", pageParams(n, cursor), &r); err != nil {
+		return RepresentativesPage{}, err
+	}
+
+	page := RepresentativesPage{Cursor: r.Cursor}
+	for _, a := range r.Representatives {
+		page.Representatives = append(page.Representatives, Weight{types.Account(a.key), a.amount})
+	}
+	return page, nil
+}
+
+type PeersPage struct {
+	Peers  []string
+	Cursor string
+}
+
+// Peers returns peer addresses. The reference node sends them as keys of
+// an object, in no particular order.
+func (c *Client) Peers(ctx context.Context, n int, cursor string) (PeersPage, error) {
+	var r struct {
+		Peers  json.RawMessage `json:"peers"`
+		Cursor string          `json:"cursor"`
+	}
+	if err := c.Call(ctx, "peers", pageParams(n, cursor), &r); err != nil {
+		return PeersPage{}, err
+	}
+
+	page := PeersPage{Cursor: r.Cursor}
+	var byAddress map[string]json.RawMessage
+	if json.Unmarshal(r.Peers, &page.Peers) != nil {
+		if err := json.Unmarshal(r.Peers, &byAddress); err != nil && string(r.Peers) != `""` {
+			return PeersPage{}, errors.Wrap(err, "Bad rpc response")
+		}
+		for peer := range byAddress {
+			page.Peers = append(page.Peers, peer)
+		}
+	}
+	return page, nil
+}
+
+func pageParams(n int, cursor string) map[string]string {
+	params := map[string]string{"count": strconv.Itoa(n)}
+	if cursor != "" {
+		params["cursor"] = cursor
+	}
+	return params
+}
+
+type keyedAmount struct {
+	key    string
+	amount uint128.Uint128
+}
+
+// An object of amounts, kept in the order sent since lists are ordered.
+type orderedAmounts []keyedAmount
+
+func (o *orderedAmounts) UnmarshalJSON(b []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	if t, err := decoder.Token(); err != nil || t != json.Delim('{') {
+		return errors.New("Expected an object of amounts")
+	}
+	*o = nil
+	for decoder.More() {
+		t, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		var a amount
+		if err = decoder.Decode(&a); err != nil {
+			return err
+		}
+		*o = append(*o, keyedAmount{t.(string), uint128.Uint128(a)})
+	}
+	return nil
+}
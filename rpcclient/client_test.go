@@ -0,0 +1,132 @@
+package rpcclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/frankh/nano/uint128"
+)
+
+func TestErrors(t *testing.T) {
+	for _, ref := range ReferenceErrors {
+		err := FromMessage("action", ref.Error())
+		if !errors.Is(err, ref) || err.Error() != ref.Error() {
+			t.Errorf("%q didn't map back to its error", ref)
+		}
+	}
+	if err := FromMessage("action", "Something else"); err.Err != nil || err.Error() != "Something else" {
+		t.Errorf("Unknown message mapped to %v", err.Err)
+	}
+}
+
+// Serves canned responses in turn, repeating the last.
+func replies(t *testing.T, responses ...string) (*Client, *int) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := responses[len(responses)-1]
+		if calls < len(responses) {
+			response = responses[calls]
+		}
+		calls++
+		if response == "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(response))
+	}))
+	t.Cleanup(server.Close)
+	c := New(server.URL)
+	c.Backoff = time.Millisecond
+	return c, &calls
+}
+
+func TestRetries(t *testing.T) {
+	c, calls := replies(t, "", "", `{"peers": ""}`)
+	if _, err := c.Peers(context.Background(), 10, ""); err != nil || *calls != 3 {
+		t.Errorf("Expected success on the third attempt, got %v after %d", err, *calls)
+	}
+
+	c, calls = replies(t, "")
+	if _, err := c.Peers(context.Background(), 10, ""); err == nil || *calls != DefaultRetries+1 {
+		t.Errorf("Expected failure after %d attempts, got %v after %d", DefaultRetries+1, err, *calls)
+	}
+
+	c, calls = replies(t, `{"error": "Unknown command"}`)
+	if _, err := c.Peers(context.Background(), 10, ""); !errors.Is(err, ErrUnknownAction) || *calls != 1 {
+		t.Errorf("Error responses shouldn't be retried, got %v after %d", err, *calls)
+	}
+
+	c, _ = replies(t, "")
+	c.Backoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.Peers(ctx, 10, ""); err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline to stop retries, got %v", err)
+	}
+}
+
+// Responses shaped like the reference node's.
+func TestReferenceResponses(t *testing.T) {
+	c, _ := replies(t, `{"blocks": ["000D1BAEC8EC208142C99059B393051BAC8380F9B5A2E6B2489A277D81789F3F"]}`)
+	pending, err := c.Pending(context.Background(), "xrb_1", 10, "")
+	if err != nil || len(pending.Blocks) != 1 || pending.Blocks[0].Hash != "000D1BAEC8EC208142C99059B393051BAC8380F9B5A2E6B2489A277D81789F3F" {
+		t.Errorf("Unexpected pending %+v, %v", pending, err)
+	}
+
+	c, _ = replies(t, `{"peers": {"[::ffff:172.17.0.1]:32841": "16", "[::ffff:10.0.0.1]:7075": "16"}}`)
+	peers, err := c.Peers(context.Background(), 10, "")
+	if err != nil || len(peers.Peers) != 2 {
+		t.Errorf("Unexpected peers %+v, %v", peers, err)
+	}
+
+	c, _ = replies(t, `{"frontier": "F", "open_block": "O", "balance": "340282366920938463463374607431768211455", "block_count": "33", "pending": "5"}`)
+	info, err := c.AccountInfo(context.Background(), "xrb_1")
+	max := uint128.FromInts(^uint64(0), ^uint64(0))
+	if err != nil || info.Balance != max || info.BlockCount != 33 || info.Receivable != uint128.FromInts(0, 5) {
+		t.Errorf("Unexpected account info %+v, %v", info, err)
+	}
+
+	c, _ = replies(t, `{"representatives": {"xrb_3": 3, "xrb_1": "1"}}`)
+	reps, err := c.Representatives(context.Background(), 10, "")
+	if err != nil || len(reps.Representatives) != 2 || reps.Representatives[0].Representative != "xrb_3" || reps.Representatives[1].Weight != uint128.FromInts(0, 1) {
+		t.Errorf("Unexpected representatives %+v, %v", reps, err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	stream := `{"type":"summary","confirmations":1}
+{"type":"confirmation","hash":"A","account":"nano_a","amount":"5"}
+{"type":"confirmation","hash":"B","account":"nano_b","amount":"500"}
+{"type":"vote","hash":"B","representative":"nano_a"}
+`
+	// Fails, then streams the events and hangs up each time
+	c, calls := replies(t, "", stream)
+
+	watch := func(opts WatchOptions, n int) (seen []string, drops int) {
+		ctx, cancel := context.WithCancel(context.Background())
+		opts.OnDisconnect = func(error) { drops++ }
+		c.Watch(ctx, opts, func(e Event) {
+			seen = append(seen, e.Type+" "+string(e.Hash))
+			if len(seen) == n {
+				cancel()
+			}
+		})
+		return seen, drops
+	}
+
+	seen, drops := watch(WatchOptions{}, 8)
+	if fmt.Sprint(seen) != "[summary  confirmation A confirmation B vote B summary  confirmation A confirmation B vote B]" || drops != 2 || *calls != 3 {
+		t.Errorf("Expected the stream twice over reconnects, got %v after %d drops", seen, drops)
+	}
+	if seen, _ = watch(WatchOptions{Account: "nano_a"}, 3); fmt.Sprint(seen) != "[summary  confirmation A vote B]" {
+		t.Errorf("Account not filtered, got %v", seen)
+	}
+	if seen, _ = watch(WatchOptions{MinAmount: uint128.FromInts(0, 100)}, 2); fmt.Sprint(seen) != "[summary  confirmation B]" {
+		t.Errorf("Amount not filtered, got %v", seen)
+	}
+}
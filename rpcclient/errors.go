@@ -0,0 +1,82 @@
+package rpcclient
+
+import "errors"
+
+// Errors the rpc returns, with the exact strings the reference node uses
+// so callers can match on them whichever node they talk to.
+var (
+	ErrAccountNotFound    = errors.New("Account not found")
+	ErrBadAccount         = errors.New("Bad account number")
+	ErrBlockNotFound      = errors.New("Block not found")
+	ErrBadHash            = errors.New("Bad hash number")
+	ErrFork               = errors.New("Fork")
+	ErrGapPrevious        = errors.New("Gap previous block")
+	ErrGapSource          = errors.New("Gap source block")
+	ErrOldBlock           = errors.New("Old block")
+	ErrBadSignature       = errors.New("Bad signature")
+	ErrWorkLow            = errors.New("Block work is less than threshold")
+	ErrInsufficient       = errors.New("Insufficient balance")
+	ErrBadJSON            = errors.New("Unable to parse JSON")
+	ErrUnknownAction      = errors.New("Unknown command")
+	ErrControlDisabled    = errors.New("RPC control is disabled")
+	ErrWalletNotFound     = errors.New("Wallet not found")
+	ErrWalletLocked       = errors.New("Wallet is locked")
+	ErrAccountNotInWallet = errors.New("Account not found in wallet")
+	ErrBadDifficulty      = errors.New("Bad difficulty")
+	ErrBadWork            = errors.New("Bad work")
+	ErrCancelled          = errors.New("Cancelled")
+)
+
+// Every error above, for looking them up by string
+var ReferenceErrors = []error{
+	ErrAccountNotFound,
+	ErrBadAccount,
+	ErrBlockNotFound,
+	ErrBadHash,
+	ErrFork,
+	ErrGapPrevious,
+	ErrGapSource,
+	ErrOldBlock,
+	ErrBadSignature,
+	ErrWorkLow,
+	ErrInsufficient,
+	ErrBadJSON,
+	ErrUnknownAction,
+	ErrControlDisabled,
+	ErrWalletNotFound,
+	ErrWalletLocked,
+	ErrAccountNotInWallet,
+	ErrBadDifficulty,
+	ErrBadWork,
+	ErrCancelled,
+}
+
+var byMessage = func() map[string]error {
+	m := make(map[string]error)
+	for _, err := range ReferenceErrors {
+		m[err.Error()] = err
+	}
+	return m
+}()
+
+// Error is an error response from the rpc. Err is the matching error
+// above, so errors.Is works against them, or nil for messages without
+// one.
+type Error struct {
+	Action  string
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// FromMessage is the error for a response's error string.
+func FromMessage(action string, message string) *Error {
+	return &Error{action, message, byMessage[message]}
+}
@@ -0,0 +1,212 @@
+package rpcclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/frankh/nano/utils"
+	"github.com/pkg/errors"
+)
+
+// Longest wait between reconnects
+const maxWatchBackoff = 30 * time.Second
+
+// How often a session's events are acked by default
+const DefaultAckInterval = time.Second
+
+// An Event from the node's /events stream, which the reference node
+// doesn't have. Only the fields that apply to its type are set.
+type Event struct {
+	Type string `json:"type"`
+	// Unix milliseconds
+	Time           int64           `json:"time"`
+	Hash           types.BlockHash `json:"hash"`
+	Account        types.Account   `json:"account"`
+	Representative types.Account   `json:"representative"`
+	Amount         string          `json:"amount"`
+	Peer           string          `json:"peer"`
+	Count          int             `json:"count"`
+	Confirmations  uint64          `json:"confirmations"`
+	Peers          int             `json:"peers"`
+	Backlog        int             `json:"backlog"`
+	// Bootstrap progress: a fraction of Basis, blocks a second and
+	// seconds left, zero if unknown
+	Basis    string  `json:"basis"`
+	Progress float64 `json:"progress"`
+	Rate     float64 `json:"rate"`
+	ETA      int64   `json:"eta"`
+	// Disk space events: the path short of space and bytes free on it
+	Path string `json:"path"`
+	Free uint64 `json:"free"`
+	// Sync status events: the new status
+	Status string `json:"status"`
+	// Numbers events within a session, zero for summaries and without one
+	Seq uint64 `json:"seq"`
+	// The event as sent
+	Raw json.RawMessage `json:"-"`
+}
+
+type WatchOptions struct {
+	// Only events for this account, as sender, representative or
+	// bootstrapped chain, and summaries
+	Account types.Account
+	// Only confirmations of sends of at least this much
+	MinAmount uint128.Uint128
+	// Called when the stream drops, before reconnecting
+	OnDisconnect func(error)
+
+	// Asks for acknowledged delivery: the node keeps the session's events
+	// until they're acked, and after a reconnect sends those after the
+	// last one fn was given, as long as it's back within the node's
+	// session TTL. If the node can't keep up it sends a "best_effort"
+	// event and goes back to sending each event once. Ids are up to 64
+	// bytes, and should be unique to the watcher.
+	Session string
+	// How often events given to fn are acked, DefaultAckInterval if zero
+	AckInterval time.Duration
+}
+
+func (o WatchOptions) match(e Event) bool {
+	switch e.Type {
+	case "summary", "best_effort", "session_expired":
+		return true
+	}
+	if o.Account != "" && e.Account != o.Account && e.Representative != o.Account {
+		return false
+	}
+	if o.MinAmount != (uint128.Uint128{}) {
+		amount, err := uint128.FromDecimal(e.Amount)
+		if e.Type != "confirmation" || err != nil || amount.Compare(o.MinAmount) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Watch streams the node's events to fn until ctx is done, reconnecting
+// with backoff whenever the stream drops. It only returns ctx's error.
+func (c *Client) Watch(ctx context.Context, opts WatchOptions, fn func(Event)) error {
+	retry := utils.RetryPolicy{
+		Component: "rpcclient_watch",
+		Base:      c.Backoff,
+		Max:       maxWatchBackoff,
+		// Whatever the node says, it's worth asking again
+		Classify: func(error) utils.RetryClass { return utils.RetryTransient },
+	}.Start(ctx)
+	// The last event of the session given to fn
+	var last uint64
+	for {
+		attemptCtx, cancel := retry.Attempt()
+		connected, err := c.watch(attemptCtx, opts, &last, fn)
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if opts.OnDisconnect != nil {
+			opts.OnDisconnect(err)
+		}
+		if connected {
+			retry.Reset()
+		}
+		if err := retry.Wait(err); err != nil {
+			return err
+		}
+	}
+}
+
+// Reads one connection's events, returning why it ended and whether any
+// arrived.
+func (c *Client) watch(ctx context.Context, opts WatchOptions, last *uint64, fn func(Event)) (bool, error) {
+	u := strings.TrimSuffix(c.URL, "/") + "/events"
+	if opts.Session != "" {
+		query := url.Values{"session": {opts.Session}, "last": {strconv.FormatUint(atomic.LoadUint64(last), 10)}}
+		u += "?" + query.Encode()
+		stop := c.ackEvents(ctx, opts, last)
+		defer stop()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.HTTP.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, errors.Errorf("Events returned %s", resp.Status)
+	}
+
+	connected := false
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return connected, errors.Wrap(err, "Bad event")
+		}
+		connected = true
+		if e.Type == "session_expired" {
+			atomic.StoreUint64(last, 0)
+		}
+		if e.Seq != 0 && e.Seq <= atomic.LoadUint64(last) {
+			// Sent again, but fn already has it
+			continue
+		}
+		e.Raw = append(json.RawMessage{}, scanner.Bytes()...)
+		if opts.match(e) {
+			fn(e)
+		}
+		if e.Seq != 0 {
+			atomic.StoreUint64(last, e.Seq)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return connected, err
+	}
+	return connected, errors.New("Event stream closed")
+}
+
+// Acks the session's events given to fn every AckInterval until stopped.
+// A lost ack only means events are sent again, which watch skips.
+func (c *Client) ackEvents(ctx context.Context, opts WatchOptions, last *uint64) (stop func()) {
+	interval := opts.AckInterval
+	if interval == 0 {
+		interval = DefaultAckInterval
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var acked uint64
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			seq := atomic.LoadUint64(last)
+			if seq == acked {
+				continue
+			}
+			params := map[string]string{"session": opts.Session, "seq": strconv.FormatUint(seq, 10)}
+			if c.Call(ctx, "events_ack", params, nil) == nil {
+				acked = seq
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
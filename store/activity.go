@@ -0,0 +1,206 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+)
+
+// Counterparties are only counted up to this many
+const MaxCounterparties = 1000
+
+var ErrAccountNotFound = errors.New("Account not found")
+
+type AccountActivity struct {
+	Account types.Account
+	// When we first saw the earliest and latest blocks that have local
+	// timestamps. Zero if none do.
+	FirstActive Timestamp
+	LastActive  Timestamp
+	Blocks      int
+	// Capped at MaxCounterparties, with MoreCounterparties set above it
+	Counterparties     int
+	MoreCounterparties bool
+	Received           uint128.Uint128
+	Sent               uint128.Uint128
+	Largest            uint128.Uint128
+	// Set if maxBlocks was reached before the frontier
+	Truncated bool
+}
+
+// Each block's account, keyed by its hash, so it's found without walking
+// the chain. Entries are kept when a block is pruned.
+const blockAccountPrefix = "blockaccount"
+
+const blockAccountIndexedKey = "blockaccountindexed"
+
+// Account that owns a block, from the index or else by walking back to
+// its open block.
+func accountOf(conn *badger.Txn, hash types.BlockHash) types.Account {
+	for {
+		var account types.Account
+		if fetchMeta(conn, blockAccountPrefix, hash.ToBytes(), &account) == nil {
+			return account
+		}
+		block := fetchBlock(conn, hash)
+		if block == nil {
+			var pruned prunedBlock
+			if fetchMeta(conn, prunedPrefix, hash.ToBytes(), &pruned) != nil {
+				return ""
+			}
+			hash = pruned.Previous
+			continue
+		}
+		if open, ok := block.(*blocks.OpenBlock); ok {
+			return open.Account
+		}
+		hash = block.PreviousBlockHash()
+	}
+}
+
+// Indexes a block's account, which is its previous block's.
+func storeBlockAccount(conn *badger.Txn, block blocks.Block) {
+	var account types.Account
+	if open, ok := block.(*blocks.OpenBlock); ok {
+		account = open.Account
+	} else {
+		account = accountOf(conn, block.PreviousBlockHash())
+	}
+	if account != "" {
+		storeMeta(conn, blockAccountPrefix, block.Hash().ToBytes(), account)
+	}
+}
+
+// Builds the account index for stores written before it existed.
+func indexBlockAccounts(conn *badger.Txn) {
+	var done bool
+	if fetchMeta(conn, blockAccountIndexedKey, nil, &done) == nil {
+		return
+	}
+	index := loadBlockIndex(conn)
+	for _, open := range index.opens {
+		hash := open.Hash()
+		for {
+			storeMeta(conn, blockAccountPrefix, hash.ToBytes(), open.Account)
+			next, ok := index.successors[hash]
+			if !ok {
+				break
+			}
+			hash = next
+		}
+	}
+	storeMeta(conn, blockAccountIndexedKey, nil, true)
+}
+
+// BlockAccount is the account a block belongs to and its balance before
+// the block, if its previous block is stored. Opens have no balance
+// before. The account is read from the index rather than walked for.
+func BlockAccount(block blocks.Block) (account types.Account, balance uint128.Uint128, ok bool) {
+	if open, ok := block.(*blocks.OpenBlock); ok {
+		return open.Account, uint128.Uint128{}, true
+	}
+
+	conn := getConn()
+	defer releaseConn(conn)
+	if fetchBlock(conn, block.PreviousBlockHash()) == nil {
+		return "", uint128.Uint128{}, false
+	}
+	return accountOf(conn, block.PreviousBlockHash()), balanceOf(conn, block.PreviousBlockHash()), true
+}
+
+// GetAccountActivity summarizes an account's history in one pass over its
+// chain, oldest first, reading at most maxBlocks blocks. It scans the
+// whole store to link the chain, so is comparatively expensive.
+func GetAccountActivity(account types.Account, maxBlocks int) (AccountActivity, error) {
+	conn := getConn()
+	defer releaseConn(conn)
+
+	activity := AccountActivity{Account: account}
+	open := fetchOpen(conn, account)
+	if open == nil {
+		return activity, ErrAccountNotFound
+	}
+
+	successors := loadBlockIndex(conn).successors
+	counterparties := make(map[types.Account]bool)
+	addCounterparty := func(a types.Account) {
+		if a == "" || counterparties[a] {
+			return
+		}
+		if len(counterparties) >= MaxCounterparties {
+			activity.MoreCounterparties = true
+			return
+		}
+		counterparties[a] = true
+	}
+
+	var previous uint128.Uint128
+	hash := open.Hash()
+	for {
+		if activity.Blocks >= maxBlocks {
+			activity.Truncated = true
+			break
+		}
+		activity.Blocks++
+
+		var balance uint128.Uint128
+		var source types.BlockHash
+		block := fetchBlock(conn, hash)
+		if block == nil {
+			var pruned prunedBlock
+			if fetchMeta(conn, prunedPrefix, hash.ToBytes(), &pruned) != nil {
+				return activity, ErrMissingBlock
+			}
+			balance, source = pruned.Balance, pruned.Source
+		} else {
+			balance = getBalance(conn, block)
+			switch b := block.(type) {
+			case *blocks.OpenBlock:
+				if b.SourceHash != Conf.GenesisBlock.SourceHash {
+					source = b.SourceHash
+				}
+			case *blocks.ReceiveBlock:
+				source = b.SourceHash
+			case *blocks.SendBlock:
+				amount := previous.Sub(balance)
+				activity.Sent = activity.Sent.Add(amount)
+				if amount.Compare(activity.Largest) > 0 {
+					activity.Largest = amount
+				}
+				addCounterparty(b.Destination)
+			}
+		}
+
+		if balance.Compare(previous) > 0 {
+			amount := balance.Sub(previous)
+			activity.Received = activity.Received.Add(amount)
+			if amount.Compare(activity.Largest) > 0 {
+				activity.Largest = amount
+			}
+			if source != "" {
+				addCounterparty(accountOf(conn, source))
+			}
+		}
+		previous = balance
+
+		var ts Timestamp
+		if fetchMeta(conn, timestampPrefix, hash.ToBytes(), &ts) == nil {
+			if activity.FirstActive.Wall == 0 {
+				activity.FirstActive = ts
+			}
+			activity.LastActive = ts
+		}
+
+		next, ok := successors[types.BlockHashFromBytes(hash.ToBytes())]
+		if !ok {
+			break
+		}
+		hash = next
+	}
+
+	activity.Counterparties = len(counterparties)
+	return activity, nil
+}
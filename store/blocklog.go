@@ -0,0 +1,374 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/pkg/errors"
+)
+
+type BlockLogOptions struct {
+	// A new file is started once the current one is this big
+	MaxFileSize int64
+	// Files not written to for this long are removed, zero keeps them all
+	Retention time.Duration
+	// Blocks waiting to be written. Beyond this they're dropped and
+	// counted rather than holding up the store.
+	Buffer int
+}
+
+var DefaultBlockLogOptions = BlockLogOptions{64 << 20, 7 * 24 * time.Hour, 10000}
+
+// crc32, then the length of the rest: unix nanoseconds and the block as
+// raw json
+const blockRecordHeader = 8
+
+const blockLogPrefix = "blocks-"
+const blockLogSuffix = ".log"
+
+type blockRecord struct {
+	at    time.Time
+	block blocks.Block
+}
+
+// BlockLogStats counts what a BlockLog has done since it opened.
+type BlockLogStats struct {
+	Written uint64
+	// Dropped for a full buffer, or a failed write
+	Dropped uint64
+	// Torn records cut off the end of the log when it opened
+	Truncated int64
+	Files     int
+}
+
+// A BlockLog appends every block the store accepts to rotating files in
+// a directory, to roll a restored backup forward with ReplayLog. Writes
+// happen in the background, so a slow disk can't hold up the store: the
+// log drops blocks rather than wait once its buffer is full. A record
+// torn by a crash is cut off the end when the log is next opened.
+type BlockLog struct {
+	dir  string
+	opts BlockLogOptions
+
+	queue  chan blockRecord
+	done   chan bool
+	closed chan bool
+	// Only touched by the writer once it's started
+	file *os.File
+	size int64
+
+	written   uint64
+	dropped   uint64
+	truncated int64
+}
+
+func blockLogName(start time.Time) string {
+	return fmt.Sprintf("%s%020d%s", blockLogPrefix, start.UnixNano(), blockLogSuffix)
+}
+
+// The log's files, oldest first.
+func blockLogFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, blockLogPrefix) && strings.HasSuffix(name, blockLogSuffix) {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func encodeBlockRecord(r blockRecord) ([]byte, error) {
+	raw, err := json.Marshal(blocks.ToRaw(r.block))
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, blockRecordHeader+8, blockRecordHeader+8+len(raw))
+	binary.BigEndian.PutUint32(record[4:], uint32(8+len(raw)))
+	binary.BigEndian.PutUint64(record[8:], uint64(r.at.UnixNano()))
+	record = append(record, raw...)
+	binary.BigEndian.PutUint32(record, crc32.ChecksumIEEE(record[4:]))
+	return record, nil
+}
+
+// Calls fn with each intact record in data, returning the length of the
+// intact part. fn returning false stops early.
+func readBlockRecords(data []byte, fn func(at time.Time, raw []byte) bool) int {
+	offset := 0
+	for len(data)-offset >= blockRecordHeader+8 {
+		length := int(binary.BigEndian.Uint32(data[offset+4:]))
+		end := offset + blockRecordHeader + length
+		if length < 8 || end > len(data) || end < offset {
+			break
+		}
+		if crc32.ChecksumIEEE(data[offset+4:end]) != binary.BigEndian.Uint32(data[offset:]) {
+			break
+		}
+		at := time.Unix(0, int64(binary.BigEndian.Uint64(data[offset+8:])))
+		if !fn(at, data[offset+blockRecordHeader+8:end]) {
+			break
+		}
+		offset = end
+	}
+	return offset
+}
+
+// OpenBlockLog carries on the log in dir, creating it if need be, and
+// cutting off a torn record at the end of its latest file.
+func OpenBlockLog(dir string, opts BlockLogOptions) (*BlockLog, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if opts.Buffer <= 0 {
+		opts.Buffer = DefaultBlockLogOptions.Buffer
+	}
+	l := &BlockLog{dir: dir, opts: opts, queue: make(chan blockRecord, opts.Buffer), done: make(chan bool), closed: make(chan bool)}
+
+	files, err := blockLogFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		if err = l.rotate(); err != nil {
+			return nil, err
+		}
+	} else {
+		latest := files[len(files)-1]
+		data, err := ioutil.ReadFile(latest)
+		if err != nil {
+			return nil, err
+		}
+		valid := readBlockRecords(data, func(time.Time, []byte) bool { return true })
+		if l.file, err = os.OpenFile(latest, os.O_RDWR, 0600); err != nil {
+			return nil, err
+		}
+		if valid < len(data) {
+			l.truncated = int64(len(data) - valid)
+			log.Printf("Cut %d bytes of a torn record off the block log %s", l.truncated, latest)
+			if err = l.file.Truncate(int64(valid)); err != nil {
+				l.file.Close()
+				return nil, err
+			}
+		}
+		if _, err = l.file.Seek(int64(valid), 0); err != nil {
+			l.file.Close()
+			return nil, err
+		}
+		l.size = int64(valid)
+	}
+	go l.write()
+	return l, nil
+}
+
+// Starts a new file, removing those past their retention. The current
+// one is kept on if a new one can't be made.
+func (l *BlockLog) rotate() error {
+	start := Clock.Now()
+	file, err := os.OpenFile(filepath.Join(l.dir, blockLogName(start)), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	for os.IsExist(err) {
+		start = start.Add(1)
+		file, err = os.OpenFile(filepath.Join(l.dir, blockLogName(start)), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	}
+	if err != nil {
+		return err
+	}
+	if l.file != nil {
+		l.file.Sync()
+		l.file.Close()
+	}
+	l.file, l.size = file, 0
+
+	if l.opts.Retention <= 0 {
+		return nil
+	}
+	files, err := blockLogFiles(l.dir)
+	if err != nil {
+		return err
+	}
+	for _, path := range files[:len(files)-1] {
+		if info, err := os.Stat(path); err == nil && Clock.Now().Sub(info.ModTime()) > l.opts.Retention {
+			os.Remove(path)
+		}
+	}
+	return nil
+}
+
+// Writes queued blocks until Close, syncing whenever it catches up.
+func (l *BlockLog) write() {
+	defer close(l.closed)
+	for {
+		var r blockRecord
+		select {
+		case r = <-l.queue:
+		case <-l.done:
+			// Whatever was queued before Close still goes in
+			for len(l.queue) > 0 {
+				l.append(<-l.queue)
+			}
+			l.file.Sync()
+			l.file.Close()
+			return
+		}
+		l.append(r)
+		if len(l.queue) == 0 {
+			l.file.Sync()
+		}
+	}
+}
+
+// Appends a record, cutting off anything partly written on failure so
+// later records aren't lost behind it.
+func (l *BlockLog) append(r blockRecord) {
+	record, err := encodeBlockRecord(r)
+	if err == nil && l.opts.MaxFileSize > 0 && l.size > 0 && l.size+int64(len(record)) > l.opts.MaxFileSize {
+		err = l.rotate()
+	}
+	if err == nil {
+		_, err = l.file.Write(record)
+	}
+	if err != nil {
+		l.file.Truncate(l.size)
+		l.file.Seek(l.size, 0)
+		atomic.AddUint64(&l.dropped, 1)
+		log.Printf("Failed to log block %s: %s", r.block.Hash(), err)
+		return
+	}
+	l.size += int64(len(record))
+	atomic.AddUint64(&l.written, 1)
+}
+
+// Append queues block to be logged, without waiting: it's dropped if the
+// buffer is full.
+func (l *BlockLog) Append(block blocks.Block) {
+	select {
+	case <-l.done:
+		atomic.AddUint64(&l.dropped, 1)
+		return
+	default:
+	}
+	select {
+	case l.queue <- blockRecord{Clock.Now(), block}:
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+	}
+}
+
+// Close writes out what's queued and closes the log.
+func (l *BlockLog) Close() {
+	select {
+	case <-l.done:
+	default:
+		close(l.done)
+	}
+	<-l.closed
+}
+
+func (l *BlockLog) Stats() BlockLogStats {
+	files, _ := blockLogFiles(l.dir)
+	return BlockLogStats{
+		Written:   atomic.LoadUint64(&l.written),
+		Dropped:   atomic.LoadUint64(&l.dropped),
+		Truncated: l.truncated,
+		Files:     len(files),
+	}
+}
+
+// Where the store logs the blocks it accepts, nil for nowhere
+var blockLog *BlockLog
+
+// SetBlockLog has the store log every block it accepts to l, or stop
+// logging if l is nil, returning the log it used before.
+func SetBlockLog(l *BlockLog) *BlockLog {
+	connLock.Lock()
+	defer connLock.Unlock()
+	previous := blockLog
+	blockLog = l
+	return previous
+}
+
+// ReplayStats counts what ReplayLog did with the logged blocks.
+type ReplayStats struct {
+	Stored int
+	// Already in the store, e.g. from the backup being rolled forward
+	Old int
+	// Waiting for a block missing from the log
+	Gaps   int
+	Failed int
+	// Records cut short, so left out
+	Torn int
+}
+
+// ReplayLog stores the blocks logged in dir up to upTo, or all of them if
+// it's zero, in the order they were accepted, e.g. to roll a restored
+// backup forward. Blocks already in the store are skipped, so replaying
+// again is harmless. The store's own block log is off while it runs.
+func ReplayLog(dir string, upTo time.Time) (ReplayStats, error) {
+	var stats ReplayStats
+	files, err := blockLogFiles(dir)
+	if err != nil {
+		return stats, err
+	}
+	defer SetBlockLog(SetBlockLog(nil))
+
+	for _, path := range files {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return stats, err
+		}
+		past := false
+		var failure error
+		valid := readBlockRecords(data, func(at time.Time, raw []byte) bool {
+			if !upTo.IsZero() && at.After(upTo) {
+				past = true
+				return false
+			}
+			block, err := blocks.ParseJson(raw)
+			if err != nil {
+				failure = errors.Wrapf(err, "Bad block in %s", path)
+				return false
+			}
+			if FetchBlock(block.Hash()) != nil {
+				stats.Old++
+				return true
+			}
+			switch err := StoreBlock(block); err {
+			case nil:
+				stats.Stored++
+			case ErrMissingParent, ErrMissingSource:
+				stats.Gaps++
+			case ErrDiskFull:
+				failure = err
+				return false
+			default:
+				stats.Failed++
+			}
+			return true
+		})
+		if failure != nil {
+			return stats, failure
+		}
+		if past {
+			break
+		}
+		if valid < len(data) {
+			stats.Torn++
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,308 @@
+package store
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/metrics"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/utils"
+)
+
+const cementedPrefix = "cemented"
+const confirmationHeightPrefix = "confheight"
+const DefaultCementBatchSize = 1000
+
+var ErrMissingBlock = errors.New("Block to cement is missing")
+var ErrBadBatchSize = errors.New("Cement batch size must be at least 1")
+
+type cementRecord struct {
+	Account types.Account
+	Height  uint64
+	// Zero for blocks cemented before it was recorded
+	Time time.Time
+}
+
+// CementedBlock is where a cemented block is in its account's chain,
+// and when it was cemented.
+type CementedBlock struct {
+	Account types.Account
+	Height  uint64
+	Time    time.Time
+}
+
+type ConfirmationHeight struct {
+	Height   uint64
+	Frontier types.BlockHash
+}
+
+type CementEvent struct {
+	Account types.Account
+	Hash    types.BlockHash
+	Height  uint64
+}
+
+func IsCemented(hash types.BlockHash) bool {
+	conn := getConn()
+	defer releaseConn(conn)
+	return isCemented(conn, hash)
+}
+
+func isCemented(conn *badger.Txn, hash types.BlockHash) bool {
+	var record cementRecord
+	return fetchMeta(conn, cementedPrefix, hash.ToBytes(), &record) == nil
+}
+
+func FetchCemented(hash types.BlockHash) (CementedBlock, bool) {
+	var record cementRecord
+	if FetchMeta(cementedPrefix, hash.ToBytes(), &record) != nil {
+		return CementedBlock{}, false
+	}
+	return CementedBlock(record), true
+}
+
+func FetchConfirmationHeight(account types.Account) (height ConfirmationHeight) {
+	pub, err := address.AddressToPub(account)
+	if err != nil {
+		return height
+	}
+	FetchMeta(confirmationHeightPrefix, pub, &height)
+	return height
+}
+
+// The send a block receives from, if it isn't cemented yet.
+func uncementedSource(conn *badger.Txn, block blocks.Block) types.BlockHash {
+	var source types.BlockHash
+	switch b := block.(type) {
+	case *blocks.OpenBlock:
+		if b.SourceHash == Conf.GenesisBlock.SourceHash {
+			return ""
+		}
+		source = b.SourceHash
+	case *blocks.ReceiveBlock:
+		source = b.SourceHash
+	default:
+		return ""
+	}
+
+	if isCemented(conn, source) {
+		return ""
+	}
+	return source
+}
+
+// Walks back from hash to the highest cemented block of the account,
+// returning the blocks above it oldest first and the height it's at.
+func uncementedChain(conn *badger.Txn, hash types.BlockHash) ([]blocks.Block, types.Account, uint64, error) {
+	var chain []blocks.Block
+	var account types.Account
+	var height uint64
+
+	for {
+		var record cementRecord
+		if fetchMeta(conn, cementedPrefix, hash.ToBytes(), &record) == nil {
+			account, height = record.Account, record.Height
+			break
+		}
+
+		block := fetchBlock(conn, hash)
+		if block == nil {
+			return nil, "", 0, ErrMissingBlock
+		}
+		chain = append(chain, block)
+
+		if open, ok := block.(*blocks.OpenBlock); ok {
+			account = open.Account
+			break
+		}
+		hash = block.PreviousBlockHash()
+	}
+
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain, account, height, nil
+}
+
+// ConfirmationHeightProcessor cements confirmed blocks along with every
+// block their confirmation implies: all their ancestors, and the sends
+// those ancestors receive from, which are cemented first.
+type ConfirmationHeightProcessor struct {
+	lock      sync.Mutex
+	batchSize int
+	pending   []types.BlockHash
+	// Called for each cemented block, in order, once its batch is stored
+	OnCemented func(CementEvent)
+	Tracer     *metrics.Tracer
+	guard      *utils.Guard
+}
+
+func NewConfirmationHeightProcessor(batchSize int, onCemented func(CementEvent)) (*ConfirmationHeightProcessor, error) {
+	if batchSize < 1 {
+		return nil, ErrBadBatchSize
+	}
+	return &ConfirmationHeightProcessor{
+		batchSize:  batchSize,
+		OnCemented: onCemented,
+		Tracer:     metrics.Traces,
+		guard:      utils.NewGuard("cemented", utils.DefaultMaxPanics),
+	}, nil
+}
+
+// Add queues a confirmed block for cementing.
+func (p *ConfirmationHeightProcessor) Add(hash types.BlockHash) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.pending = append(p.pending, hash)
+}
+
+// Flush cements everything queued. Blocks that fail stay queued.
+func (p *ConfirmationHeightProcessor) Flush() error {
+	p.lock.Lock()
+	pending := p.pending
+	p.pending = nil
+	p.lock.Unlock()
+
+	for i, hash := range pending {
+		err := p.cement(hash)
+		if err != nil {
+			p.lock.Lock()
+			p.pending = append(pending[i:], p.pending...)
+			p.lock.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *ConfirmationHeightProcessor) cement(hash types.BlockHash) error {
+	// Blocks whose sources have to be cemented first
+	stack := []types.BlockHash{hash}
+	onStack := map[types.BlockHash]bool{hash: true}
+
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+
+		conn := getConn()
+		chain, account, height, err := uncementedChain(conn, top)
+		var source types.BlockHash
+		ready := chain
+		for i, block := range chain {
+			source = uncementedSource(conn, block)
+			if source != "" {
+				ready = chain[:i]
+				break
+			}
+		}
+		releaseConn(conn)
+		if err != nil {
+			return err
+		}
+
+		err = p.write(ready, account, height)
+		if err != nil {
+			return err
+		}
+
+		if source == "" {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		source = types.BlockHashFromBytes(source.ToBytes())
+		if onStack[source] {
+			return ErrChainCycle
+		}
+		onStack[source] = true
+		stack = append(stack, source)
+	}
+	return nil
+}
+
+// Cements chain above height in batches, one store transaction each.
+func (p *ConfirmationHeightProcessor) write(chain []blocks.Block, account types.Account, height uint64) error {
+	pub, err := address.AddressToPub(account)
+	if err != nil {
+		return err
+	}
+
+	for len(chain) > 0 {
+		n := p.batchSize
+		if n > len(chain) {
+			n = len(chain)
+		}
+		batch := chain[:n]
+		chain = chain[n:]
+
+		var events []CementEvent
+		now := Clock.Now()
+		conn := getConn()
+		for _, block := range batch {
+			height++
+			hash := block.Hash()
+			err = storeMeta(conn, cementedPrefix, hash.ToBytes(), cementRecord{account, height, now})
+			if err != nil {
+				break
+			}
+			events = append(events, CementEvent{account, hash, height})
+		}
+		if err == nil {
+			err = storeMeta(conn, confirmationHeightPrefix, pub, ConfirmationHeight{height, batch[n-1].Hash()})
+		}
+		releaseConn(conn)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range events {
+			p.Tracer.Record(e.Hash, metrics.StageCemented)
+		}
+		if p.OnCemented != nil {
+			for _, e := range events {
+				p.guard.Call(func() { p.OnCemented(e) })
+			}
+		}
+	}
+	return nil
+}
+
+type UnconfirmedFrontier struct {
+	Account  types.Account
+	Frontier types.BlockHash
+	// Zero if nothing is cemented
+	ConfirmedHeight uint64
+}
+
+// UnconfirmedFrontiers lists the accounts whose frontier is above their
+// confirmation height, by account. It scans the whole store.
+func UnconfirmedFrontiers() []UnconfirmedFrontier {
+	conn := getConn()
+	defer releaseConn(conn)
+
+	var result []UnconfirmedFrontier
+	index := loadBlockIndex(conn)
+	for _, open := range index.opens {
+		frontier := open.Hash()
+		for {
+			next, ok := index.successors[frontier]
+			if !ok {
+				break
+			}
+			frontier = next
+		}
+
+		var confirmed ConfirmationHeight
+		pub, _ := address.AddressToPub(open.Account)
+		fetchMeta(conn, confirmationHeightPrefix, pub, &confirmed)
+		if confirmed.Frontier == frontier {
+			continue
+		}
+		result = append(result, UnconfirmedFrontier{open.Account, frontier, confirmed.Height})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Account < result[j].Account })
+	return result
+}
@@ -0,0 +1,85 @@
+package store
+
+import (
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/golang/crypto/blake2b"
+)
+
+// Each account's Checkpoint, keyed by public key
+const checkpointPrefix = "checkpoint"
+
+// A Checkpoint records that an account's chain verified cleanly up to
+// Hash, so Verify with Checkpoints set can start after it. Digest folds
+// in the hash and balance of every block from the open block up, so a
+// full verification can tell if anything below has changed since.
+type Checkpoint struct {
+	Hash   types.BlockHash
+	Height uint64
+	// After Hash, to carry on from without walking back down the chain
+	Balance uint128.Uint128
+	Digest  [32]byte
+}
+
+// Extends the checkpoint by block, whose hash is hash: the digest
+// becomes blake2b-256 of the digest so far, the block hash and the
+// balance after it, as 16 bytes big endian. The digest below the open
+// block is all zeros.
+func (c Checkpoint) next(hash types.BlockHash, balance uint128.Uint128) Checkpoint {
+	data := append(append(append([]byte{}, c.Digest[:]...), hash.ToBytes()...), balance.GetBytes()...)
+	return Checkpoint{Hash: hash, Height: c.Height + 1, Balance: balance, Digest: blake2b.Sum256(data)}
+}
+
+// The balance after block given the balance before it, working out
+// received amounts from their sends. A source that isn't a stored send
+// counts as nothing; Verify reports it separately.
+func (c Checkpoint) balanceAfter(block blocks.Block) uint128.Uint128 {
+	switch b := block.(type) {
+	case *blocks.OpenBlock:
+		if b.SourceHash == Conf.GenesisBlock.SourceHash {
+			return blocks.GenesisAmount
+		}
+		return sentAmount(b.SourceHash)
+	case *blocks.SendBlock:
+		return b.Balance
+	case *blocks.ReceiveBlock:
+		return c.Balance.Add(sentAmount(b.SourceHash))
+	}
+	return c.Balance
+}
+
+func sentAmount(source types.BlockHash) uint128.Uint128 {
+	conn := getConn()
+	defer releaseConn(conn)
+	send, ok := fetchBlock(conn, source).(*blocks.SendBlock)
+	if !ok {
+		return uint128.Uint128{}
+	}
+	return getSendAmount(conn, send)
+}
+
+// FetchCheckpoint returns the account's latest checkpoint, if it has one.
+func FetchCheckpoint(account types.Account) (Checkpoint, bool) {
+	pub, err := address.AddressToPub(account)
+	if err != nil {
+		return Checkpoint{}, false
+	}
+	var c Checkpoint
+	return c, FetchMeta(checkpointPrefix, pub, &c) == nil
+}
+
+// Whether the checkpoint is still on the chain from open, at its height.
+// It isn't once the chain's been rolled back past it.
+func onChain(open *blocks.OpenBlock, successors map[types.BlockHash]types.BlockHash, c Checkpoint) bool {
+	hash := open.Hash()
+	for height := uint64(1); height < c.Height; height++ {
+		next, ok := successors[hash]
+		if !ok {
+			return false
+		}
+		hash = next
+	}
+	return hash == c.Hash
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+)
+
+// Pending entries the cold policy moved out of the way, keyed like the
+// pending index. They're still receivable, just not listed by default.
+const coldPendingPrefix = "coldpending"
+
+// When the sweeper first saw entries whose send has no local timestamp
+const pendingSeenPrefix = "pendingseen"
+
+// ColdPendingPolicy picks the pending entries moved to the cold bucket:
+// smaller than Below and older than OlderThan, going by when we first saw
+// the send.
+type ColdPendingPolicy struct {
+	Below     uint128.Uint128
+	OlderThan time.Duration
+	// Entries looked at per transaction
+	Batch int
+}
+
+var DefaultColdPendingPolicy = ColdPendingPolicy{DustThreshold, 365 * 24 * time.Hour, 1000}
+
+// Where the sweep picks up, as a key in the pending index
+var coldSweepCursor []byte
+
+// The first time we saw the send of a pending entry.
+func pendingAge(conn *badger.Txn, key []byte, now time.Time) time.Duration {
+	send := key[32:]
+	var ts Timestamp
+	if fetchMeta(conn, timestampPrefix, send, &ts) == nil {
+		return now.Sub(ts.Time())
+	}
+	var seen int64
+	if fetchMeta(conn, pendingSeenPrefix, key, &seen) != nil {
+		seen = now.UnixNano()
+		storeMeta(conn, pendingSeenPrefix, key, seen)
+	}
+	return now.Sub(time.Unix(0, seen))
+}
+
+// SweepColdPending looks at the next batch of pending entries, moving
+// the ones the policy picks to the cold bucket. done is set once it has
+// been through the whole index, and the next sweep starts over.
+func SweepColdPending(policy ColdPendingPolicy, now time.Time) (moved int, done bool) {
+	conn := getConn()
+	defer releaseConn(conn)
+
+	prefix := metaKey(pendingPrefix, nil)
+	start := prefix
+	if coldSweepCursor != nil {
+		start = coldSweepCursor
+	}
+
+	type entry struct {
+		key   []byte
+		value []byte
+	}
+	var batch []entry
+	it := conn.NewIterator(badger.DefaultIteratorOptions)
+	for it.Seek(start); it.ValidForPrefix(prefix) && len(batch) < policy.Batch; it.Next() {
+		key := it.Item().Key()
+		if bytes.Equal(key, coldSweepCursor) {
+			continue
+		}
+		value, err := it.Item().Value()
+		if err != nil {
+			continue
+		}
+		batch = append(batch, entry{append([]byte{}, key...), append([]byte{}, value...)})
+	}
+	done = !it.ValidForPrefix(prefix)
+	it.Close()
+
+	for _, e := range batch {
+		key := e.key[len(prefix):]
+		var amount uint128.Uint128
+		if gob.NewDecoder(bytes.NewBuffer(e.value)).Decode(&amount) != nil || len(key) != 64 {
+			continue
+		}
+		if amount.Compare(policy.Below) >= 0 || pendingAge(conn, key, now) < policy.OlderThan {
+			continue
+		}
+		storeMeta(conn, coldPendingPrefix, key, amount)
+		deleteMeta(conn, pendingPrefix, key)
+		deleteMeta(conn, pendingSeenPrefix, key)
+		moved++
+	}
+
+	if done {
+		coldSweepCursor = nil
+	} else if len(batch) > 0 {
+		coldSweepCursor = batch[len(batch)-1].key
+	}
+	return moved, done
+}
+
+// ColdPendingPage is PendingPage over the entries moved to the cold
+// bucket.
+func ColdPendingPage(account types.Account, after types.BlockHash, count int) (page []Receivable, more bool, err error) {
+	return pendingPage(coldPendingPrefix, account, after, count)
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Each block stored by StoreBlock bumps the write version, so a reader
+// can wait until what it's been told about is visible. The version is
+// only kept in memory and starts from zero each run.
+var writes = struct {
+	sync.Mutex
+	version uint64
+	// Closed and replaced on each write
+	changed chan bool
+}{changed: make(chan bool)}
+
+// Called with the store lock held, so anything that reads the new version
+// and then the store sees the write.
+func wrote() {
+	writes.Lock()
+	writes.version++
+	close(writes.changed)
+	writes.changed = make(chan bool)
+	writes.Unlock()
+}
+
+// Version is the number of blocks StoreBlock has stored this run.
+func Version() uint64 {
+	writes.Lock()
+	defer writes.Unlock()
+	return writes.version
+}
+
+// WaitForVersion returns once the write version reaches version, or with
+// ctx's error if it's done first.
+func WaitForVersion(ctx context.Context, version uint64) error {
+	for {
+		writes.Lock()
+		current, changed := writes.version, writes.changed
+		writes.Unlock()
+		if current >= version {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Moving average of how long StoreBlock takes to store a block, in
+// nanoseconds, so background work can tell when the store is busy
+var writeLatency int64
+
+func noteWriteLatency(d time.Duration) {
+	for {
+		old := atomic.LoadInt64(&writeLatency)
+		// Each write counts for an eighth
+		updated := old + (int64(d)-old)/8
+		if atomic.CompareAndSwapInt64(&writeLatency, old, updated) {
+			return
+		}
+	}
+}
+
+// WriteLatency is the recent average time to store a block.
+func WriteLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&writeLatency))
+}
@@ -0,0 +1,54 @@
+package store
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/blocks"
+)
+
+// LedgerCounts sizes up the ledger, for comparing it with peers'.
+type LedgerCounts struct {
+	Blocks   uint64
+	Cemented uint64
+	Accounts uint64
+}
+
+// Counts walks the ledger counting its blocks and accounts, and adds up
+// the accounts' confirmation heights for the cemented blocks. It's a full
+// scan, so for periodic checks rather than every block.
+func Counts() LedgerCounts {
+	conn := getConn()
+	defer releaseConn(conn)
+
+	var counts LedgerCounts
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := conn.NewIterator(opts)
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if len(item.Key()) != 32 {
+			continue
+		}
+		// Opens are stored a second time keyed on their account
+		if item.UserMeta() == MetaOpen {
+			open := (&BlockItem{*item}).ToBlock().(*blocks.OpenBlock)
+			if !bytes.Equal(item.Key(), open.Hash().ToBytes()) {
+				counts.Accounts++
+				continue
+			}
+		}
+		counts.Blocks++
+	}
+	it.Close()
+
+	iterateMeta(conn, confirmationHeightPrefix, func(key []byte, value []byte) error {
+		var height ConfirmationHeight
+		if gob.NewDecoder(bytes.NewBuffer(value)).Decode(&height) == nil {
+			counts.Cemented += height.Height
+		}
+		return nil
+	})
+	return counts
+}
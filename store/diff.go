@@ -0,0 +1,235 @@
+package store
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+)
+
+type DiffKind string
+
+const (
+	DiffOnlyInA            DiffKind = "only_in_a"
+	DiffOnlyInB            DiffKind = "only_in_b"
+	DiffFrontier           DiffKind = "frontier"
+	DiffBalance            DiffKind = "balance"
+	DiffConfirmationHeight DiffKind = "confirmation_height"
+	// The first block of the account's chain that differs
+	DiffChain DiffKind = "chain"
+)
+
+// Difference is one way an account differs between two ledgers. A and B
+// are the value on each side, empty where the side has none.
+type Difference struct {
+	Kind    DiffKind
+	Account types.Account
+	A, B    string
+	// Position in the chain, for DiffChain, starting at 1 for the open
+	Height uint64
+}
+
+type DiffOptions struct {
+	// Walk both chains of accounts with different frontiers to find where
+	// they diverge. Reads every block of those accounts.
+	Chains bool
+}
+
+// What's compared per account.
+type accountSummary struct {
+	pub       []byte
+	account   types.Account
+	open      types.BlockHash
+	frontier  types.BlockHash
+	balance   uint128.Uint128
+	confirmed uint64
+}
+
+// Opens the store at path, or uses the open one if it's the same.
+func openLedger(path string) (db *badger.DB, close func(), err error) {
+	connLock.Lock()
+	open := globalConn
+	same := Conf != nil && Conf.Path == path
+	connLock.Unlock()
+	if open != nil && same {
+		return open, func() {}, nil
+	}
+
+	opts := badger.DefaultOptions
+	opts.Dir = path
+	opts.ValueDir = path
+	db, err = badger.Open(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	txn := db.NewTransaction(true)
+	indexSuccessors(txn)
+	if err = txn.Commit(nil); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return db, func() { db.Close() }, nil
+}
+
+// Sends each account's summary in account key order, until done closes.
+func summarize(txn *badger.Txn, out chan<- accountSummary, done chan bool) {
+	defer close(out)
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		// Opens are stored a second time keyed on their account
+		if len(item.Key()) != 32 || item.UserMeta() != MetaOpen {
+			continue
+		}
+		block := (&BlockItem{*item}).ToBlock()
+		if bytes.Equal(item.Key(), block.Hash().ToBytes()) {
+			continue
+		}
+		open := block.(*blocks.OpenBlock)
+
+		s := accountSummary{
+			pub:     append([]byte{}, item.Key()...),
+			account: open.Account,
+			open:    open.Hash(),
+		}
+		s.frontier = s.open
+		var next types.BlockHash
+		for fetchMeta(txn, successorPrefix, s.frontier.ToBytes(), &next) == nil {
+			s.frontier = next
+		}
+		s.balance = balanceOf(txn, s.frontier)
+		var confirmed ConfirmationHeight
+		fetchMeta(txn, confirmationHeightPrefix, s.pub, &confirmed)
+		s.confirmed = confirmed.Height
+
+		select {
+		case out <- s:
+		case <-done:
+			return
+		}
+	}
+}
+
+// Diff compares the stores at pathA and pathB account by account,
+// calling fn with each difference in account key order. Both sides are
+// read in step, so memory doesn't grow with the ledgers. fn returning an
+// error stops the diff.
+func Diff(pathA, pathB string, opts DiffOptions, fn func(Difference) error) error {
+	dbA, closeA, err := openLedger(pathA)
+	if err != nil {
+		return err
+	}
+	defer closeA()
+	dbB, closeB, err := openLedger(pathB)
+	if err != nil {
+		return err
+	}
+	defer closeB()
+
+	txnA, txnB := dbA.NewTransaction(false), dbB.NewTransaction(false)
+	defer txnA.Discard()
+	defer txnB.Discard()
+
+	// The summaries must be done reading before the transactions are
+	// discarded
+	done := make(chan bool)
+	var summarizing sync.WaitGroup
+	defer func() {
+		close(done)
+		summarizing.Wait()
+	}()
+	a, b := make(chan accountSummary, 100), make(chan accountSummary, 100)
+	summarizing.Add(2)
+	go func() {
+		defer summarizing.Done()
+		summarize(txnA, a, done)
+	}()
+	go func() {
+		defer summarizing.Done()
+		summarize(txnB, b, done)
+	}()
+
+	nextA, okA := <-a
+	nextB, okB := <-b
+	for okA || okB {
+		var cmp int
+		switch {
+		case !okA:
+			cmp = 1
+		case !okB:
+			cmp = -1
+		default:
+			cmp = bytes.Compare(nextA.pub, nextB.pub)
+		}
+
+		if cmp < 0 {
+			err = fn(Difference{DiffOnlyInA, nextA.account, string(nextA.frontier), "", 0})
+			nextA, okA = <-a
+		} else if cmp > 0 {
+			err = fn(Difference{DiffOnlyInB, nextB.account, "", string(nextB.frontier), 0})
+			nextB, okB = <-b
+		} else {
+			err = compareAccounts(dbA, dbB, nextA, nextB, opts, fn)
+			nextA, okA = <-a
+			nextB, okB = <-b
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func compareAccounts(dbA, dbB *badger.DB, a, b accountSummary, opts DiffOptions, fn func(Difference) error) error {
+	var diffs []Difference
+	if a.frontier != b.frontier {
+		diffs = append(diffs, Difference{DiffFrontier, a.account, string(a.frontier), string(b.frontier), 0})
+	}
+	if a.balance != b.balance {
+		diffs = append(diffs, Difference{DiffBalance, a.account, a.balance.Decimal(), b.balance.Decimal(), 0})
+	}
+	if a.confirmed != b.confirmed {
+		diffs = append(diffs, Difference{DiffConfirmationHeight, a.account,
+			strconv.FormatUint(a.confirmed, 10), strconv.FormatUint(b.confirmed, 10), 0})
+	}
+	if opts.Chains && a.frontier != b.frontier {
+		diffs = append(diffs, chainDivergence(dbA, dbB, a, b))
+	}
+
+	for _, d := range diffs {
+		if err := fn(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Walks both chains up from their opens to the first block that
+// differs. A side that ends first has an empty hash there. Uses its own
+// transactions, the summaries are still reading theirs.
+func chainDivergence(dbA, dbB *badger.DB, a, b accountSummary) Difference {
+	txnA, txnB := dbA.NewTransaction(false), dbB.NewTransaction(false)
+	defer txnA.Discard()
+	defer txnB.Discard()
+	successor := func(txn *badger.Txn, hash types.BlockHash) types.BlockHash {
+		var next types.BlockHash
+		if fetchMeta(txn, successorPrefix, hash.ToBytes(), &next) != nil {
+			return ""
+		}
+		return next
+	}
+
+	hashA, hashB := a.open, b.open
+	height := uint64(1)
+	for hashA == hashB {
+		hashA, hashB = successor(txnA, hashA), successor(txnB, hashB)
+		height++
+	}
+	return Difference{DiffChain, a.account, string(hashA), string(hashB), height}
+}
@@ -0,0 +1,182 @@
+package store
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+)
+
+const prunedPrefix = "pruned"
+
+// What's kept of a pruned block: enough to compute balances through it
+// and to keep walking the chain back to the open block.
+type prunedBlock struct {
+	Balance  uint128.Uint128
+	Previous types.BlockHash
+	// Set for receives, so the send isn't counted as pending again
+	Source types.BlockHash
+}
+
+type EmptyAccount struct {
+	Account  types.Account
+	Frontier types.BlockHash
+}
+
+// Every block in one pass, since the store has no account index.
+type blockIndex struct {
+	opens      []*blocks.OpenBlock
+	successors map[types.BlockHash]types.BlockHash
+	// Sends not yet received, by destination
+	pending map[types.Account][]*blocks.SendBlock
+}
+
+func loadBlockIndex(conn *badger.Txn) blockIndex {
+	index := blockIndex{
+		successors: make(map[types.BlockHash]types.BlockHash),
+		pending:    make(map[types.Account][]*blocks.SendBlock),
+	}
+	received := make(map[types.BlockHash]bool)
+	var sends []*blocks.SendBlock
+
+	it := conn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if len(item.Key()) != 32 || item.UserMeta() == MetaData {
+			continue
+		}
+
+		block := (&BlockItem{*item}).ToBlock()
+		hash := block.Hash()
+		if !bytes.Equal(item.Key(), hash.ToBytes()) {
+			continue
+		}
+
+		switch b := block.(type) {
+		case *blocks.OpenBlock:
+			index.opens = append(index.opens, b)
+			received[types.BlockHashFromBytes(b.SourceHash.ToBytes())] = true
+			continue
+		case *blocks.ReceiveBlock:
+			received[types.BlockHashFromBytes(b.SourceHash.ToBytes())] = true
+		case *blocks.SendBlock:
+			sends = append(sends, b)
+		}
+		index.successors[types.BlockHashFromBytes(block.PreviousBlockHash().ToBytes())] = hash
+	}
+
+	// Pruned blocks still link their chain together
+	iterateMeta(conn, prunedPrefix, func(key []byte, value []byte) error {
+		var pruned prunedBlock
+		err := gob.NewDecoder(bytes.NewBuffer(value)).Decode(&pruned)
+		if err == nil {
+			index.successors[pruned.Previous] = types.BlockHashFromBytes(key)
+			if pruned.Source != "" {
+				received[pruned.Source] = true
+			}
+		}
+		return nil
+	})
+
+	for _, send := range sends {
+		if !received[send.Hash()] {
+			index.pending[send.Destination] = append(index.pending[send.Destination], send)
+		}
+	}
+	return index
+}
+
+func (index blockIndex) frontier(open *blocks.OpenBlock) types.BlockHash {
+	hash := open.Hash()
+	for {
+		next, ok := index.successors[hash]
+		if !ok {
+			return hash
+		}
+		hash = next
+	}
+}
+
+// EmptyAccounts returns accounts with a zero balance and nothing pending,
+// which are candidates for PruneEmptyAccounts. Such accounts can still
+// receive later.
+func EmptyAccounts() []EmptyAccount {
+	conn := getConn()
+	defer releaseConn(conn)
+
+	var empty []EmptyAccount
+	index := loadBlockIndex(conn)
+	for _, open := range index.opens {
+		if len(index.pending[open.Account]) > 0 {
+			continue
+		}
+		frontier := index.frontier(open)
+		balance := balanceOf(conn, frontier)
+		if balance.Hi == 0 && balance.Lo == 0 {
+			empty = append(empty, EmptyAccount{open.Account, frontier})
+		}
+	}
+	return empty
+}
+
+// PruneEmptyAccounts drops the historical receive and change blocks of
+// every empty account, keeping the open block, the frontier and all sends,
+// which other accounts' balances are computed from. Returns the number of
+// blocks pruned.
+func PruneEmptyAccounts() int {
+	empty := EmptyAccounts()
+
+	conn := getConn()
+	defer releaseConn(conn)
+
+	count := 0
+	for _, account := range empty {
+		count += pruneChain(conn, account.Frontier)
+	}
+	return count
+}
+
+// Walks back from the frontier to the open block, replacing each receive
+// and change with its balance and previous hash.
+func pruneChain(conn *badger.Txn, frontier types.BlockHash) int {
+	count := 0
+	block := fetchBlock(conn, frontier)
+	if block.Type() == blocks.Open {
+		return 0
+	}
+	hash := block.PreviousBlockHash()
+
+	for {
+		block = fetchBlock(conn, hash)
+		if block == nil {
+			var pruned prunedBlock
+			if fetchMeta(conn, prunedPrefix, hash.ToBytes(), &pruned) != nil {
+				return count
+			}
+			hash = pruned.Previous
+			continue
+		}
+
+		switch block.Type() {
+		case blocks.Open:
+			return count
+		case blocks.Receive, blocks.Change:
+			previous := types.BlockHashFromBytes(block.PreviousBlockHash().ToBytes())
+			pruned := prunedBlock{getBalance(conn, block), previous, ""}
+			if receive, ok := block.(*blocks.ReceiveBlock); ok {
+				pruned.Source = types.BlockHashFromBytes(receive.SourceHash.ToBytes())
+			}
+			if storeMeta(conn, prunedPrefix, hash.ToBytes(), pruned) != nil {
+				return count
+			}
+			conn.Delete(hash.ToBytes())
+			count++
+		}
+		hash = block.PreviousBlockHash()
+	}
+}
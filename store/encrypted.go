@@ -0,0 +1,202 @@
+package store
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"sync"
+)
+
+// Encrypted values start with the magic then the format version, then
+// the nonce and the AES-256-GCM ciphertext. The key is authenticated
+// along with the value, so values can't be moved between keys.
+// Plaintext is told apart by not starting with the magic, whose zero
+// byte the values stored here don't start with.
+var encryptedMagic = []byte("\x00nkv")
+
+const encryptedVersion byte = 1
+
+var ErrBadEncryptionKey = errors.New("Encryption key must be 32 bytes")
+var ErrDecrypt = errors.New("Failed to decrypt value: wrong key or corrupted")
+var ErrUnknownEncryption = errors.New("Value encrypted in an unknown format")
+
+// A KeySource supplies the encryption key when a store is opened, e.g.
+// from the config, the environment or a KMS.
+type KeySource func() ([]byte, error)
+
+// HexKey is a key given as 64 hex characters.
+func HexKey(key string) KeySource {
+	return func() ([]byte, error) {
+		b, err := hex.DecodeString(key)
+		if err != nil || len(b) != 32 {
+			return nil, ErrBadEncryptionKey
+		}
+		return b, nil
+	}
+}
+
+// EnvKey reads a hex key from the environment variable name.
+func EnvKey(name string) KeySource {
+	return func() ([]byte, error) {
+		return HexKey(os.Getenv(name))()
+	}
+}
+
+// EncryptedKV encrypts the values, but not the keys, of another KV.
+// Values written before encryption was turned on are read as they are,
+// and Migrate encrypts them in place.
+type EncryptedKV struct {
+	kv  KV
+	gcm cipher.AEAD
+	// Held by writes, so Migrate never overwrites a newer value
+	lock sync.Mutex
+}
+
+func OpenEncryptedKV(kv KV, key KeySource) (*EncryptedKV, error) {
+	k, err := key()
+	if err != nil {
+		return nil, err
+	}
+	if len(k) != 32 {
+		return nil, ErrBadEncryptionKey
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedKV{kv: kv, gcm: gcm}, nil
+}
+
+func encrypted(value []byte) bool {
+	return bytes.HasPrefix(value, encryptedMagic)
+}
+
+func (kv *EncryptedKV) seal(key []byte, value []byte) ([]byte, error) {
+	header := len(encryptedMagic) + 1
+	out := make([]byte, header+kv.gcm.NonceSize(), header+kv.gcm.NonceSize()+len(value)+kv.gcm.Overhead())
+	copy(out, encryptedMagic)
+	out[len(encryptedMagic)] = encryptedVersion
+	nonce := out[header:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return kv.gcm.Seal(out, nonce, value, key), nil
+}
+
+func (kv *EncryptedKV) open(key []byte, value []byte) ([]byte, error) {
+	if !encrypted(value) {
+		return value, nil
+	}
+	header := len(encryptedMagic) + 1
+	if len(value) < header || value[len(encryptedMagic)] != encryptedVersion {
+		return nil, ErrUnknownEncryption
+	}
+	if len(value) < header+kv.gcm.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	nonce := value[header : header+kv.gcm.NonceSize()]
+	plain, err := kv.gcm.Open(nil, nonce, value[header+kv.gcm.NonceSize():], key)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
+
+func (kv *EncryptedKV) Get(key []byte) ([]byte, error) {
+	value, err := kv.kv.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return kv.open(key, value)
+}
+
+func (kv *EncryptedKV) Set(key []byte, value []byte) error {
+	sealed, err := kv.seal(key, value)
+	if err != nil {
+		return err
+	}
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	return kv.kv.Set(key, sealed)
+}
+
+func (kv *EncryptedKV) Delete(key []byte) error {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	return kv.kv.Delete(key)
+}
+
+func (kv *EncryptedKV) Iterate(prefix []byte, fn func(key []byte, value []byte) error) error {
+	return kv.kv.Iterate(prefix, func(key []byte, value []byte) error {
+		plain, err := kv.open(key, value)
+		if err != nil {
+			return err
+		}
+		return fn(key, plain)
+	})
+}
+
+func (kv *EncryptedKV) Close() error {
+	return kv.kv.Close()
+}
+
+// Migrate encrypts every value still in plaintext, returning how many it
+// did. Each is rewritten on its own, so an interrupted migration leaves
+// every value readable, and running it again finishes the job. It stops
+// early if done is closed.
+func (kv *EncryptedKV) Migrate(done chan bool) (int, error) {
+	var plain [][]byte
+	err := kv.kv.Iterate(nil, func(key []byte, value []byte) error {
+		if !encrypted(value) {
+			plain = append(plain, append([]byte{}, key...))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, key := range plain {
+		select {
+		case <-done:
+			return migrated, nil
+		default:
+		}
+		ok, err := kv.migrate(key)
+		if err != nil {
+			return migrated, err
+		}
+		if ok {
+			migrated++
+		}
+	}
+	return migrated, nil
+}
+
+// Encrypts key's value unless it's been written or deleted since.
+func (kv *EncryptedKV) migrate(key []byte) (bool, error) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	value, err := kv.kv.Get(key)
+	if err == ErrKeyNotFound || (err == nil && encrypted(value)) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	sealed, err := kv.seal(key, value)
+	if err != nil {
+		return false, err
+	}
+	return true, kv.kv.Set(key, sealed)
+}
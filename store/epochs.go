@@ -0,0 +1,76 @@
+package store
+
+import (
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/pkg/errors"
+)
+
+// Marks blocks of upgraded accounts from the upgrade on with their
+// version. There are no epoch blocks to carry it, so each block added on
+// top of a marked one is marked too.
+const versionPrefix = "version"
+
+var ErrVersionDowngrade = errors.New("Account is already at a later version")
+
+// UpgradeAccount moves an account to version from its current frontier.
+// Blocks after the frontier need that version's work, blocks up to it
+// keep the work they were made with.
+func UpgradeAccount(account types.Account, version blocks.AccountVersion) error {
+	conn := getConn()
+	defer releaseConn(conn)
+
+	open := fetchOpen(conn, account)
+	if open == nil {
+		return errors.New("Account not found")
+	}
+	frontier := open.Hash()
+	index := loadBlockIndex(conn)
+	for {
+		next, ok := index.successors[frontier]
+		if !ok {
+			break
+		}
+		frontier = next
+	}
+
+	if version < blockVersion(conn, frontier) {
+		return ErrVersionDowngrade
+	}
+	return storeMeta(conn, versionPrefix, frontier.ToBytes(), version)
+}
+
+// BlockVersion is the version a block on top of hash is validated at.
+func BlockVersion(hash types.BlockHash) blocks.AccountVersion {
+	conn := getConn()
+	defer releaseConn(conn)
+	return blockVersion(conn, hash)
+}
+
+// The version of the account as of block hash.
+func blockVersion(conn *badger.Txn, hash types.BlockHash) blocks.AccountVersion {
+	version := blocks.Epoch1
+	if fetchMeta(conn, versionPrefix, hash.ToBytes(), &version) != nil {
+		return blocks.Epoch1
+	}
+	return version
+}
+
+// The version a new block is validated at. Opens always start at the
+// first version, their previous hash is a send in another account.
+func versionFor(conn *badger.Txn, block blocks.Block) blocks.AccountVersion {
+	if block.Type() == blocks.Open {
+		return blocks.Epoch1
+	}
+	return blockVersion(conn, block.PreviousBlockHash())
+}
+
+// Marks a block stored on top of a marked one. Previous blocks stay
+// marked, so a fork of the block needs the same work.
+func markVersion(conn *badger.Txn, block blocks.Block, version blocks.AccountVersion) {
+	if version == blocks.Epoch1 {
+		return
+	}
+	storeMeta(conn, versionPrefix, block.Hash().ToBytes(), version)
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+)
+
+// ExplainSource looks up what blocks.Explain can't tell from a block
+// alone in the store.
+func ExplainSource() blocks.ExplainSource {
+	return blocks.ExplainSource{
+		FetchBlock: FetchBlock,
+		Balance: func(block blocks.Block) (uint128.Uint128, bool) {
+			return GetBalance(block), true
+		},
+		Position:  blockPosition,
+		Confirmed: IsCemented,
+	}
+}
+
+// The account a block belongs to and its height, which needn't be stored
+// itself as long as its previous block is.
+func blockPosition(block blocks.Block) (types.Account, uint64, bool) {
+	account, _, ok := BlockAccount(block)
+	if !ok {
+		return "", 0, false
+	}
+	if block.Type() == blocks.Open {
+		return account, 1, true
+	}
+	conn := getConn()
+	defer releaseConn(conn)
+	height, ok := chainHeight(conn, block.PreviousBlockHash())
+	return account, height + 1, ok
+}
+
+// Walks back to the open block, or the nearest cemented block, which
+// knows its height.
+func chainHeight(conn *badger.Txn, hash types.BlockHash) (uint64, bool) {
+	var steps uint64
+	for {
+		var record cementRecord
+		if fetchMeta(conn, cementedPrefix, hash.ToBytes(), &record) == nil {
+			return record.Height + steps, true
+		}
+		block := fetchBlock(conn, hash)
+		if block == nil {
+			var pruned prunedBlock
+			if fetchMeta(conn, prunedPrefix, hash.ToBytes(), &pruned) != nil {
+				return 0, false
+			}
+			hash = pruned.Previous
+			steps++
+			continue
+		}
+		steps++
+		if block.Type() == blocks.Open {
+			return steps, true
+		}
+		hash = block.PreviousBlockHash()
+	}
+}
@@ -0,0 +1,195 @@
+package store
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/utils"
+	"github.com/pkg/errors"
+)
+
+// The block stored on each previous block. Opens are found by account.
+const successorPrefix = "successor"
+const successorIndexedKey = "successorindexed"
+
+// Fork proofs keyed by root, holding the blocks that lost.
+const forkPrefix = "forks"
+
+// Proofs kept, the oldest are pruned beyond this
+var MaxForkProofs = 10000
+
+// Stamps fork proofs
+var Clock utils.Clock = utils.SystemClock{}
+
+var ErrFork = errors.New("Block forks a stored block")
+
+// Called, on its own goroutine, the first time a fork is recorded for a
+// root.
+var OnForkProof func(ForkProof)
+
+// ForkProof shows an account signed conflicting blocks on the same root.
+// The first block is the one we kept.
+type ForkProof struct {
+	Root    types.BlockHash
+	Account types.Account
+	Blocks  []blocks.RawBlock
+	// Unix nanoseconds
+	Recorded int64
+}
+
+// Verify checks a proof on its own, without the store: that it has at
+// least two different blocks, all on the root and signed by the account.
+func (p ForkProof) Verify() error {
+	if len(p.Blocks) < 2 {
+		return errors.New("Fork proof needs two blocks")
+	}
+	pub, err := address.AddressToPub(p.Account)
+	if err != nil {
+		return errors.Wrap(err, "Bad fork proof account")
+	}
+
+	seen := make(map[types.BlockHash]bool)
+	for i, raw := range p.Blocks {
+		if err := raw.Validate(); err != nil {
+			return errors.Wrapf(err, "Bad fork proof block %d", i)
+		}
+		block := raw.ToBlock()
+		if open, ok := block.(*blocks.OpenBlock); ok && open.Account != p.Account {
+			return errors.Errorf("Fork proof block %d opens another account", i)
+		}
+		if block.RootHash() != p.Root {
+			return errors.Errorf("Fork proof block %d is on another root", i)
+		}
+		if seen[block.Hash()] {
+			return errors.Errorf("Fork proof block %d is a duplicate", i)
+		}
+		seen[block.Hash()] = true
+		if !blocks.VerifyBlockSignature(block, pub) {
+			return errors.Errorf("Bad signature on fork proof block %d", i)
+		}
+	}
+	return nil
+}
+
+func storeSuccessor(conn *badger.Txn, block blocks.Block) {
+	if block.Type() != blocks.Open {
+		storeMeta(conn, successorPrefix, block.PreviousBlockHash().ToBytes(), block.Hash())
+	}
+}
+
+// The last block in the chain from hash on.
+func chainFrontier(conn *badger.Txn, hash types.BlockHash) types.BlockHash {
+	var next types.BlockHash
+	for fetchMeta(conn, successorPrefix, hash.ToBytes(), &next) == nil {
+		hash = next
+	}
+	return hash
+}
+
+// Builds the successor index for stores written before it existed.
+func indexSuccessors(conn *badger.Txn) {
+	var done bool
+	if fetchMeta(conn, successorIndexedKey, nil, &done) == nil {
+		return
+	}
+	for previous, hash := range loadBlockIndex(conn).successors {
+		storeMeta(conn, successorPrefix, previous.ToBytes(), hash)
+	}
+	storeMeta(conn, successorIndexedKey, nil, true)
+}
+
+// Conflicting is the stored block on the same root as block, nil if
+// there's none. Once block is stored that's block itself.
+func Conflicting(block blocks.Block) blocks.Block {
+	conn := getConn()
+	defer releaseConn(conn)
+	return conflicting(conn, block)
+}
+
+// The stored block on the same root as block, if there is one.
+func conflicting(conn *badger.Txn, block blocks.Block) blocks.Block {
+	if open, ok := block.(*blocks.OpenBlock); ok {
+		if existing := fetchOpen(conn, open.Account); existing != nil {
+			return existing
+		}
+		return nil
+	}
+
+	var hash types.BlockHash
+	if fetchMeta(conn, successorPrefix, block.PreviousBlockHash().ToBytes(), &hash) != nil {
+		return nil
+	}
+	return fetchBlock(conn, hash)
+}
+
+// Keeps a block that lost to kept in the root's proof. Losers that aren't
+// signed by the account aren't forks, just invalid.
+func recordFork(conn *badger.Txn, kept blocks.Block, loser blocks.Block) error {
+	account := accountOf(conn, kept.Hash())
+	pub, err := address.AddressToPub(account)
+	if err != nil || !blocks.VerifyBlockSignature(loser, pub) {
+		return errors.New("Bad signature on forked block")
+	}
+
+	root := kept.RootHash()
+	var proof ForkProof
+	first := fetchMeta(conn, forkPrefix, root.ToBytes(), &proof) != nil
+	if first {
+		proof = ForkProof{root, account, []blocks.RawBlock{blocks.ToRaw(kept)}, Clock.Now().UnixNano()}
+	}
+	for _, raw := range proof.Blocks {
+		if raw.ToBlock().Hash() == loser.Hash() {
+			return nil
+		}
+	}
+	proof.Blocks = append(proof.Blocks, blocks.ToRaw(loser))
+	if err = storeMeta(conn, forkPrefix, root.ToBytes(), proof); err != nil {
+		return err
+	}
+
+	if first {
+		pruneForkProofs(conn)
+		if OnForkProof != nil {
+			go OnForkProof(proof)
+		}
+	}
+	return nil
+}
+
+// Deletes the oldest proofs over MaxForkProofs.
+func pruneForkProofs(conn *badger.Txn) {
+	type entry struct {
+		root     []byte
+		recorded int64
+	}
+	var entries []entry
+	iterateMeta(conn, forkPrefix, func(key []byte, value []byte) error {
+		var p ForkProof
+		if gob.NewDecoder(bytes.NewBuffer(value)).Decode(&p) == nil {
+			entries = append(entries, entry{append([]byte{}, key...), p.Recorded})
+		}
+		return nil
+	})
+
+	for len(entries) > MaxForkProofs {
+		oldest := 0
+		for i, e := range entries {
+			if e.recorded < entries[oldest].recorded {
+				oldest = i
+			}
+		}
+		deleteMeta(conn, forkPrefix, entries[oldest].root)
+		entries = append(entries[:oldest], entries[oldest+1:]...)
+	}
+}
+
+// FetchForkProof returns the blocks seen conflicting on root, if any.
+func FetchForkProof(root types.BlockHash) (ForkProof, bool) {
+	var proof ForkProof
+	err := FetchMeta(forkPrefix, root.ToBytes(), &proof)
+	return proof, err == nil
+}
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/dgraph-io/badger"
+)
+
+var ErrKeyNotFound = errors.New("Key not found")
+
+// KV is the small key value store a light client needs for cached
+// frontiers and pending entries, without the full block store.
+type KV interface {
+	// Returns ErrKeyNotFound for missing keys
+	Get(key []byte) ([]byte, error)
+	Set(key []byte, value []byte) error
+	Delete(key []byte) error
+	// Calls fn for each key with the prefix, in key order
+	Iterate(prefix []byte, fn func(key []byte, value []byte) error) error
+	Close() error
+}
+
+// BadgerKV is a KV in its own badger database, for datasets too large
+// for a LogKV.
+type BadgerKV struct {
+	db *badger.DB
+}
+
+func OpenBadgerKV(path string) (*BadgerKV, error) {
+	opts := badger.DefaultOptions
+	opts.Dir = path
+	opts.ValueDir = path
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &BadgerKV{db}, nil
+}
+
+func (kv *BadgerKV) Get(key []byte) (value []byte, err error) {
+	err = kv.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			return ErrKeyNotFound
+		}
+		if err != nil {
+			return err
+		}
+		v, err := item.Value()
+		value = append([]byte{}, v...)
+		return err
+	})
+	return value, err
+}
+
+func (kv *BadgerKV) Set(key []byte, value []byte) error {
+	return kv.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(append([]byte{}, key...), append([]byte{}, value...))
+	})
+}
+
+func (kv *BadgerKV) Delete(key []byte) error {
+	return kv.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(key)
+	})
+}
+
+func (kv *BadgerKV) Iterate(prefix []byte, fn func(key []byte, value []byte) error) error {
+	return kv.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			value, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			err = fn(it.Item().Key(), value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (kv *BadgerKV) Close() error {
+	return kv.db.Close()
+}
@@ -0,0 +1,195 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+)
+
+type HistoryEntry struct {
+	Hash types.BlockHash
+	Type blocks.BlockType
+	// The other side of a send or receive, or the new representative
+	// of a change
+	Account types.Account
+	Amount  uint128.Uint128
+}
+
+func historyEntry(conn *badger.Txn, block blocks.Block) HistoryEntry {
+	entry := HistoryEntry{Hash: block.Hash(), Type: block.Type()}
+	switch b := block.(type) {
+	case *blocks.SendBlock:
+		entry.Account = b.Destination
+		entry.Amount = getSendAmount(conn, b)
+	case *blocks.ReceiveBlock:
+		entry.Account = accountOf(conn, b.SourceHash)
+		entry.Amount = getBalance(conn, b).Sub(balanceOf(conn, b.PreviousHash))
+	case *blocks.OpenBlock:
+		entry.Account = accountOf(conn, b.SourceHash)
+		entry.Amount = getBalance(conn, b)
+	case *blocks.ChangeBlock:
+		entry.Account = b.Representative
+	}
+	return entry
+}
+
+// AccountHistory returns up to count of an account's blocks, newest first,
+// starting with the block before the hash before or at the frontier if
+// before is empty. Pruned blocks are skipped. Only the first page needs
+// the frontier, found by following the successor index from the open
+// block; later pages walk back from their cursor directly.
+func AccountHistory(account types.Account, before types.BlockHash, count int) (page []HistoryEntry, more bool, err error) {
+	if !address.ValidateAddress(account) {
+		return nil, false, ErrAccountNotFound
+	}
+
+	conn := getConn()
+	defer releaseConn(conn)
+
+	open := fetchOpen(conn, account)
+	if open == nil {
+		return nil, false, ErrAccountNotFound
+	}
+
+	var hash types.BlockHash
+	if before == "" {
+		hash = chainFrontier(conn, open.Hash())
+	} else {
+		if before.Validate() != nil {
+			return nil, false, ErrBadCursor
+		}
+		var pruned prunedBlock
+		if block := fetchBlock(conn, before); block != nil {
+			if block.Type() == blocks.Open {
+				return nil, false, nil
+			}
+			hash = block.PreviousBlockHash()
+		} else if fetchMeta(conn, prunedPrefix, before.ToBytes(), &pruned) == nil {
+			// Pruned since the last page
+			hash = pruned.Previous
+		} else {
+			return nil, false, ErrBadCursor
+		}
+	}
+
+	for {
+		block := fetchBlock(conn, hash)
+		if block == nil {
+			var pruned prunedBlock
+			if fetchMeta(conn, prunedPrefix, hash.ToBytes(), &pruned) != nil {
+				return nil, false, errors.New("Missing block " + string(hash))
+			}
+			hash = pruned.Previous
+			continue
+		}
+		if len(page) == count {
+			return page, true, nil
+		}
+
+		page = append(page, historyEntry(conn, block))
+		if block.Type() == blocks.Open {
+			return page, false, nil
+		}
+		hash = block.PreviousBlockHash()
+	}
+}
+
+type RepresentativeWeight struct {
+	Representative types.Account
+	Weight         uint128.Uint128
+}
+
+// RepresentativeWeights totals the balances delegated to each
+// representative by the latest open or change block of every account,
+// heaviest first. The totals are kept as blocks are stored, so this only
+// reads one entry per representative.
+func RepresentativeWeights() []RepresentativeWeight {
+	conn := getConn()
+	defer releaseConn(conn)
+
+	result := storedWeights(conn)
+	sort.Slice(result, func(i, j int) bool {
+		if c := result[i].Weight.Compare(result[j].Weight); c != 0 {
+			return c > 0
+		}
+		return result[i].Representative < result[j].Representative
+	})
+	return result
+}
+
+// UncheckedBlocks returns the blocks waiting on a missing parent, in hash
+// order.
+func UncheckedBlocks() []blocks.Block {
+	conn := getConn()
+	defer releaseConn(conn)
+
+	var result []blocks.Block
+	for _, block := range unconnectedBlockPool {
+		result = append(result, block)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Hash() < result[j].Hash()
+	})
+	return result
+}
+
+type Frontier struct {
+	Account types.Account
+	Hash    types.BlockHash
+	// Blocks in the account's chain up to Hash, when a bootstrap peer
+	// sent it, otherwise zero
+	Blocks uint64
+}
+
+// Frontiers returns up to count accounts' frontiers in account key order,
+// from start on, or from the first account if start is empty. next is the
+// account the following page starts at, empty after the last page. Each
+// call is its own short transaction, so walking a large ledger a page at
+// a time never holds one open for long.
+func Frontiers(start types.Account, count int) (page []Frontier, next types.Account, err error) {
+	var seek []byte
+	if start != "" {
+		seek, err = address.AddressToPub(start)
+		if err != nil {
+			return nil, "", ErrBadCursor
+		}
+	}
+
+	conn := getConn()
+	defer releaseConn(conn)
+	it := conn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	for it.Seek(seek); it.Valid(); it.Next() {
+		item := it.Item()
+		// Opens are stored a second time keyed on their account
+		if len(item.Key()) != 32 || item.UserMeta() != MetaOpen {
+			continue
+		}
+		open := (&BlockItem{*item}).ToBlock().(*blocks.OpenBlock)
+		frontier := open.Hash()
+		if bytes.Equal(item.Key(), frontier.ToBytes()) {
+			continue
+		}
+		if len(page) >= count {
+			return page, open.Account, nil
+		}
+
+		page = append(page, Frontier{Account: open.Account, Hash: chainFrontier(conn, frontier)})
+	}
+	return page, "", nil
+}
+
+// ChainHeight is the number of blocks in the chain up to and including
+// hash, counting pruned ones.
+func ChainHeight(hash types.BlockHash) (uint64, bool) {
+	conn := getConn()
+	defer releaseConn(conn)
+	return chainHeight(conn, hash)
+}
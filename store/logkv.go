@@ -0,0 +1,267 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SyncPolicy int
+
+const (
+	// fsync after every write
+	SyncAlways SyncPolicy = iota
+	// fsync on the first write after SyncEvery has passed, and on Close
+	SyncInterval
+	// Leave it to the OS
+	SyncNever
+)
+
+type LogKVOptions struct {
+	Sync      SyncPolicy
+	SyncEvery time.Duration
+	// Writes of new keys beyond this many fail with ErrKVFull
+	MaxItems int
+	// The log is rewritten once it holds more than this many stale
+	// records, and more stale records than live ones
+	CompactAfter int
+}
+
+var DefaultLogKVOptions = LogKVOptions{SyncInterval, time.Second, 10000, 1000}
+
+var ErrKVFull = errors.New("Store is full: switch to the badger backend for larger datasets")
+
+const (
+	logSet byte = iota
+	logDelete
+)
+
+// crc32, op, key length, value length
+const logHeaderSize = 13
+
+// LogKV is a KV for small datasets kept in one append-only log file,
+// with everything held in memory. A write torn by a crash is dropped
+// when the log is next opened, along with anything after it.
+type LogKV struct {
+	lock  sync.Mutex
+	path  string
+	opts  LogKVOptions
+	file  *os.File
+	items map[string][]byte
+	// Bytes and records in the log
+	size     int64
+	records  int
+	lastSync time.Time
+}
+
+func OpenLogKV(path string, opts LogKVOptions) (*LogKV, error) {
+	kv := &LogKV{path: path, opts: opts, items: make(map[string][]byte)}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	valid := kv.replay(data)
+
+	kv.file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if valid < len(data) {
+		err = kv.file.Truncate(int64(valid))
+		if err != nil {
+			kv.file.Close()
+			return nil, err
+		}
+	}
+	_, err = kv.file.Seek(int64(valid), 0)
+	if err != nil {
+		kv.file.Close()
+		return nil, err
+	}
+	kv.size = int64(valid)
+	kv.lastSync = time.Now()
+	return kv, nil
+}
+
+func encodeLogRecord(op byte, key []byte, value []byte) []byte {
+	record := make([]byte, logHeaderSize, logHeaderSize+len(key)+len(value))
+	record[4] = op
+	binary.BigEndian.PutUint32(record[5:], uint32(len(key)))
+	binary.BigEndian.PutUint32(record[9:], uint32(len(value)))
+	record = append(append(record, key...), value...)
+	binary.BigEndian.PutUint32(record, crc32.ChecksumIEEE(record[4:]))
+	return record
+}
+
+// Applies the log's records, returning the length of the valid part.
+func (kv *LogKV) replay(data []byte) int {
+	offset := 0
+	for len(data)-offset >= logHeaderSize {
+		header := data[offset : offset+logHeaderSize]
+		keyLen := int(binary.BigEndian.Uint32(header[5:]))
+		valueLen := int(binary.BigEndian.Uint32(header[9:]))
+		end := offset + logHeaderSize + keyLen + valueLen
+		if keyLen < 0 || valueLen < 0 || end > len(data) || end < offset {
+			break
+		}
+		if crc32.ChecksumIEEE(data[offset+4:end]) != binary.BigEndian.Uint32(header) {
+			break
+		}
+
+		key := string(data[offset+logHeaderSize : offset+logHeaderSize+keyLen])
+		switch header[4] {
+		case logSet:
+			kv.items[key] = append([]byte{}, data[offset+logHeaderSize+keyLen:end]...)
+		case logDelete:
+			delete(kv.items, key)
+		default:
+			return offset
+		}
+		kv.records++
+		offset = end
+	}
+	return offset
+}
+
+// Appends a record, cutting off anything partly written on failure so
+// later records aren't lost behind it.
+func (kv *LogKV) append(op byte, key []byte, value []byte) error {
+	_, err := kv.file.Write(encodeLogRecord(op, key, value))
+	if err != nil {
+		kv.file.Truncate(kv.size)
+		kv.file.Seek(kv.size, 0)
+		return err
+	}
+	kv.size += int64(logHeaderSize + len(key) + len(value))
+	kv.records++
+	return nil
+}
+
+// Syncs and compacts as the options ask, after a write.
+func (kv *LogKV) settle() error {
+	if kv.opts.Sync == SyncAlways || (kv.opts.Sync == SyncInterval && time.Since(kv.lastSync) >= kv.opts.SyncEvery) {
+		err := kv.file.Sync()
+		if err != nil {
+			return err
+		}
+		kv.lastSync = time.Now()
+	}
+
+	stale := kv.records - len(kv.items)
+	if stale > kv.opts.CompactAfter && stale > len(kv.items) {
+		return kv.compact()
+	}
+	return nil
+}
+
+// Rewrites the log with only the live items, swapping it in once synced.
+func (kv *LogKV) compact() error {
+	var buf bytes.Buffer
+	for key, value := range kv.items {
+		buf.Write(encodeLogRecord(logSet, []byte(key), value))
+	}
+
+	tmp := kv.path + ".compact"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, kv.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	kv.file.Close()
+	kv.file = f
+	kv.size = int64(buf.Len())
+	kv.records = len(kv.items)
+	kv.lastSync = time.Now()
+	return nil
+}
+
+func (kv *LogKV) Get(key []byte) ([]byte, error) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	value, ok := kv.items[string(key)]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (kv *LogKV) Set(key []byte, value []byte) error {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	if _, ok := kv.items[string(key)]; !ok && len(kv.items) >= kv.opts.MaxItems {
+		return ErrKVFull
+	}
+	err := kv.append(logSet, key, value)
+	if err != nil {
+		return err
+	}
+	kv.items[string(key)] = append([]byte{}, value...)
+	return kv.settle()
+}
+
+func (kv *LogKV) Delete(key []byte) error {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	if _, ok := kv.items[string(key)]; !ok {
+		return nil
+	}
+	err := kv.append(logDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	delete(kv.items, string(key))
+	return kv.settle()
+}
+
+func (kv *LogKV) Iterate(prefix []byte, fn func(key []byte, value []byte) error) error {
+	kv.lock.Lock()
+	var keys []string
+	for key := range kv.items {
+		if strings.HasPrefix(key, string(prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = kv.items[key]
+	}
+	kv.lock.Unlock()
+
+	for i, key := range keys {
+		err := fn([]byte(key), append([]byte{}, values[i]...))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (kv *LogKV) Close() error {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	if kv.opts.Sync != SyncNever {
+		kv.file.Sync()
+	}
+	return kv.file.Close()
+}
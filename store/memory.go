@@ -0,0 +1,139 @@
+package store
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+)
+
+// Backend is what's read of a ledger: its blocks, balances and account
+// frontiers. Primary serves it from the store's database. Writes still go
+// through StoreBlock, which only the database implements.
+type Backend interface {
+	Reader
+	// The account's latest block, false if it isn't open
+	Frontier(account types.Account) (types.BlockHash, bool)
+}
+
+// MemoryBackend is a Backend held in memory, for tests and tools that read
+// a ledger without opening a database. It only checks blocks connect, not
+// their work or signatures.
+type MemoryBackend struct {
+	lock      sync.RWMutex
+	blocks    map[types.BlockHash]blocks.Block
+	balances  map[types.BlockHash]uint128.Uint128
+	accounts  map[types.BlockHash]types.Account
+	opens     map[types.Account]*blocks.OpenBlock
+	frontiers map[types.Account]types.BlockHash
+}
+
+// Starts the ledger with the genesis block, which holds every raw.
+func NewMemoryBackend(genesis *blocks.OpenBlock) *MemoryBackend {
+	m := &MemoryBackend{
+		blocks:    make(map[types.BlockHash]blocks.Block),
+		balances:  make(map[types.BlockHash]uint128.Uint128),
+		accounts:  make(map[types.BlockHash]types.Account),
+		opens:     make(map[types.Account]*blocks.OpenBlock),
+		frontiers: make(map[types.Account]types.BlockHash),
+	}
+	m.add(genesis, genesis.Account, blocks.GenesisAmount)
+	return m
+}
+
+func (m *MemoryBackend) add(block blocks.Block, account types.Account, balance uint128.Uint128) {
+	hash := block.Hash()
+	m.blocks[hash] = block
+	m.balances[hash] = balance
+	m.accounts[hash] = account
+	m.frontiers[account] = hash
+	if open, ok := block.(*blocks.OpenBlock); ok {
+		m.opens[account] = open
+	}
+}
+
+// Put adds a block on top of its account's frontier. Its previous block
+// and, for opens and receives, its source must already be in.
+func (m *MemoryBackend) Put(block blocks.Block) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	hash := block.Hash()
+	if m.blocks[hash] != nil {
+		return nil
+	}
+
+	sent := func(source types.BlockHash) (uint128.Uint128, error) {
+		send, ok := m.blocks[source].(*blocks.SendBlock)
+		if !ok {
+			return uint128.Uint128{}, ErrMissingSource
+		}
+		return m.balances[send.PreviousHash].Sub(send.Balance), nil
+	}
+
+	if open, ok := block.(*blocks.OpenBlock); ok {
+		if m.opens[open.Account] != nil {
+			return ErrFork
+		}
+		amount, err := sent(open.SourceHash)
+		if err != nil {
+			return err
+		}
+		m.add(block, open.Account, amount)
+		return nil
+	}
+
+	previous := block.PreviousBlockHash()
+	account, ok := m.accounts[previous]
+	if !ok {
+		return ErrMissingParent
+	}
+	if m.frontiers[account] != previous {
+		return ErrFork
+	}
+	balance := m.balances[previous]
+
+	switch b := block.(type) {
+	case *blocks.SendBlock:
+		balance = b.Balance
+	case *blocks.ReceiveBlock:
+		amount, err := sent(b.SourceHash)
+		if err != nil {
+			return err
+		}
+		balance = balance.Add(amount)
+	case *blocks.ChangeBlock:
+	default:
+		return errors.New("Unknown block type")
+	}
+	m.add(block, account, balance)
+	return nil
+}
+
+func (m *MemoryBackend) FetchBlock(hash types.BlockHash) blocks.Block {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.blocks[hash]
+}
+
+func (m *MemoryBackend) FetchOpen(account types.Account) *blocks.OpenBlock {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.opens[account]
+}
+
+// Zero for a block that was never put.
+func (m *MemoryBackend) GetBalance(block blocks.Block) uint128.Uint128 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.balances[block.Hash()]
+}
+
+func (m *MemoryBackend) Frontier(account types.Account) (types.BlockHash, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	frontier, ok := m.frontiers[account]
+	return frontier, ok
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/dgraph-io/badger"
+)
+
+// MetaData marks values that aren't blocks, e.g. wallet bookkeeping.
+const MetaData byte = 0xff
+
+// Non-block values are keyed with a string prefix so they can never
+// collide with the 32 byte block hash and account keys.
+func metaKey(prefix string, key []byte) []byte {
+	return append([]byte(prefix+":"), key...)
+}
+
+// Fetch a gob encoded value stored with StoreMeta into v.
+// Returns badger.ErrKeyNotFound if nothing has been stored.
+func FetchMeta(prefix string, key []byte, v interface{}) error {
+	conn := getConn()
+	defer releaseConn(conn)
+	return fetchMeta(conn, prefix, key, v)
+}
+
+func fetchMeta(conn *badger.Txn, prefix string, key []byte, v interface{}) error {
+	item, err := conn.Get(metaKey(prefix, key))
+	if err != nil {
+		return err
+	}
+
+	value, err := item.Value()
+	if err != nil {
+		return err
+	}
+
+	return gob.NewDecoder(bytes.NewBuffer(value)).Decode(v)
+}
+
+func StoreMeta(prefix string, key []byte, v interface{}) error {
+	conn := getConn()
+	defer releaseConn(conn)
+	return storeMeta(conn, prefix, key, v)
+}
+
+func storeMeta(conn *badger.Txn, prefix string, key []byte, v interface{}) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return err
+	}
+
+	return conn.SetWithMeta(metaKey(prefix, key), buf.Bytes(), MetaData)
+}
+
+// Calls fn with the key (without prefix) and raw value of every
+// meta value stored under prefix.
+func iterateMeta(conn *badger.Txn, prefix string, fn func(key []byte, value []byte) error) error {
+	start := metaKey(prefix, nil)
+	it := conn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	for it.Seek(start); it.ValidForPrefix(start); it.Next() {
+		item := it.Item()
+		value, err := item.Value()
+		if err != nil {
+			return err
+		}
+		err = fn(item.Key()[len(start):], value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func IterateMeta(prefix string, fn func(key []byte, value []byte) error) error {
+	conn := getConn()
+	defer releaseConn(conn)
+	return iterateMeta(conn, prefix, fn)
+}
+
+func deleteMeta(conn *badger.Txn, prefix string, key []byte) error {
+	return conn.Delete(metaKey(prefix, key))
+}
+
+func DeleteMeta(prefix string, key []byte) error {
+	conn := getConn()
+	defer releaseConn(conn)
+	return deleteMeta(conn, prefix, key)
+}
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+)
+
+// When each account last changed here, keyed by its frontier's hash so
+// it's kept without looking up whose chain a block is on. Moves to the
+// new frontier with each block.
+const modifiedPrefix = "modified"
+
+// When changes started being tracked. Accounts already stored then are
+// stamped with it.
+const modifiedSinceKey = "modifiedsince"
+
+func touchAccount(conn *badger.Txn, block blocks.Block) {
+	if block.Type() != blocks.Open {
+		deleteMeta(conn, modifiedPrefix, block.PreviousBlockHash().ToBytes())
+	}
+	storeMeta(conn, modifiedPrefix, block.Hash().ToBytes(), Clock.Now().Unix())
+}
+
+// Stamps every account with now for stores written before changes were
+// tracked, which can only say they changed no later than that.
+func indexModified(conn *badger.Txn) {
+	var since int64
+	if fetchMeta(conn, modifiedSinceKey, nil, &since) == nil {
+		return
+	}
+	now := Clock.Now().Unix()
+	index := loadBlockIndex(conn)
+	for _, open := range index.opens {
+		frontier := open.Hash()
+		for {
+			next, ok := index.successors[frontier]
+			if !ok {
+				break
+			}
+			frontier = next
+		}
+		storeMeta(conn, modifiedPrefix, frontier.ToBytes(), now)
+	}
+	storeMeta(conn, modifiedSinceKey, nil, now)
+}
+
+// AccountModified is when the account with frontier last changed here,
+// as far as the store knows. For accounts stored before changes were
+// tracked that's when tracking started.
+func AccountModified(frontier types.BlockHash) (time.Time, bool) {
+	var modified int64
+	if FetchMeta(modifiedPrefix, frontier.ToBytes(), &modified) != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(modified, 0), true
+}
+
+// ModifiedSince is when the store started tracking changes to accounts.
+func ModifiedSince() time.Time {
+	var since int64
+	FetchMeta(modifiedSinceKey, nil, &since)
+	return time.Unix(since, 0)
+}
@@ -0,0 +1,151 @@
+package store
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+)
+
+// Unreceived sends are indexed by destination public key then send hash,
+// so an account's pending blocks can be read in hash order from any point.
+const pendingPrefix = "pending"
+
+// Set once the pending index has been built for an existing store
+const pendingIndexedKey = "pendingindexed"
+
+var ErrBadCursor = errors.New("Bad cursor")
+
+func pendingKey(destination types.Account, send types.BlockHash) []byte {
+	pub, _ := address.AddressToPub(destination)
+	return append(pub, send.ToBytes()...)
+}
+
+// Adds the pending entry for a send, and its amount to the destination's
+// receivable total.
+func addPending(conn *badger.Txn, send *blocks.SendBlock) {
+	key := pendingKey(send.Destination, send.Hash())
+	_, existed := pendingAmount(conn, key)
+	amount := getSendAmount(conn, send)
+	storeMeta(conn, pendingPrefix, key, amount)
+	if !existed {
+		adjustReceivableTotal(conn, key[:32], amount, false)
+	}
+}
+
+// Drops the pending entry for the send a receive or open block claims,
+// whether or not it was moved to the cold bucket, and takes it off the
+// receivable total.
+func removePending(conn *badger.Txn, source types.BlockHash) {
+	send, ok := fetchBlock(conn, source).(*blocks.SendBlock)
+	if ok {
+		key := pendingKey(send.Destination, send.Hash())
+		if amount, ok := pendingAmount(conn, key); ok {
+			adjustReceivableTotal(conn, key[:32], amount, true)
+		}
+		deleteMeta(conn, pendingPrefix, key)
+		deleteMeta(conn, coldPendingPrefix, key)
+		deleteMeta(conn, pendingSeenPrefix, key)
+	}
+}
+
+func updatePending(conn *badger.Txn, block blocks.Block) {
+	switch b := block.(type) {
+	case *blocks.SendBlock:
+		addPending(conn, b)
+	case *blocks.ReceiveBlock:
+		removePending(conn, b.SourceHash)
+	case *blocks.OpenBlock:
+		removePending(conn, b.SourceHash)
+	}
+}
+
+// Builds the pending index for stores written before it existed.
+func indexPending(conn *badger.Txn) {
+	var done bool
+	if fetchMeta(conn, pendingIndexedKey, nil, &done) == nil {
+		return
+	}
+	for _, sends := range loadBlockIndex(conn).pending {
+		for _, send := range sends {
+			addPending(conn, send)
+		}
+	}
+	storeMeta(conn, pendingIndexedKey, nil, true)
+}
+
+// PendingPage returns up to count of an account's unreceived sends in
+// hash order, starting after the send hash after, or from the first if
+// after is empty. more is set if there are further entries. Sends stored
+// while paging show up in later pages only if their hash sorts after the
+// cursor, but no send is ever returned twice. Entries moved to the cold
+// bucket aren't included.
+func PendingPage(account types.Account, after types.BlockHash, count int) (page []Receivable, more bool, err error) {
+	return pendingPage(pendingPrefix, account, after, count)
+}
+
+func pendingPage(bucket string, account types.Account, after types.BlockHash, count int) (page []Receivable, more bool, err error) {
+	if !address.ValidateAddress(account) {
+		return nil, false, ErrAccountNotFound
+	}
+
+	conn := getConn()
+	defer releaseConn(conn)
+	return readPending(conn, bucket, account, after, count)
+}
+
+// Reads a page of a valid account's entries in bucket, or all of them if
+// count is negative.
+func readPending(conn *badger.Txn, bucket string, account types.Account, after types.BlockHash, count int) (page []Receivable, more bool, err error) {
+	prefix := metaKey(bucket, pendingKey(account, ""))
+	start := prefix
+	if after != "" {
+		if after.Validate() != nil {
+			return nil, false, ErrBadCursor
+		}
+		start = append(append([]byte{}, prefix...), after.ToBytes()...)
+	}
+
+	it := conn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Seek(start); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		if after != "" && bytes.Equal(item.Key(), start) {
+			continue
+		}
+		if len(page) == count {
+			return page, true, nil
+		}
+
+		value, err := item.Value()
+		if err != nil {
+			return nil, false, err
+		}
+		var amount uint128.Uint128
+		err = gob.NewDecoder(bytes.NewBuffer(value)).Decode(&amount)
+		if err != nil {
+			return nil, false, err
+		}
+		hash := types.BlockHashFromBytes(item.Key()[len(prefix):])
+		page = append(page, Receivable{hash, amount})
+	}
+	return page, false, nil
+}
+
+// IsPending reports whether the send source to account is still
+// unreceived, whether or not it's been moved to the cold bucket.
+func IsPending(account types.Account, source types.BlockHash) bool {
+	if !address.ValidateAddress(account) || source.Validate() != nil {
+		return false
+	}
+	conn := getConn()
+	defer releaseConn(conn)
+	key := pendingKey(account, source)
+	var amount uint128.Uint128
+	return fetchMeta(conn, pendingPrefix, key, &amount) == nil || fetchMeta(conn, coldPendingPrefix, key, &amount) == nil
+}
@@ -0,0 +1,97 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Write modes of the ledger
+const (
+	LedgerWritable = "writable"
+	// Blocks are refused with ErrDiskFull until it's writable again
+	LedgerReadOnly = "read_only"
+)
+
+var ErrDiskFull = errors.New("Ledger is read only, the disk is nearly full")
+var ErrNotOpen = errors.New("Store isn't open")
+
+// Where CheckWritable writes
+const healthPrefix = "health"
+
+// A LedgerMode is whether the ledger takes new blocks, and why not.
+type LedgerMode struct {
+	Mode string
+	// Set while read only
+	Reason string
+	// When it last changed mode, zero if it never has
+	Since time.Time
+}
+
+var ledgerMode = struct {
+	sync.Mutex
+	LedgerMode
+	// Closed while writable
+	writable chan bool
+}{LedgerMode: LedgerMode{Mode: LedgerWritable}, writable: closedChan()}
+
+func closedChan() chan bool {
+	c := make(chan bool)
+	close(c)
+	return c
+}
+
+// Mode is the ledger's current mode.
+func Mode() LedgerMode {
+	ledgerMode.Lock()
+	defer ledgerMode.Unlock()
+	return ledgerMode.LedgerMode
+}
+
+func ReadOnly() bool {
+	return Mode().Mode == LedgerReadOnly
+}
+
+// SetReadOnly stops the ledger storing blocks, e.g. before the disk fills
+// and a write fails halfway. Reads carry on.
+func SetReadOnly(reason string) {
+	ledgerMode.Lock()
+	defer ledgerMode.Unlock()
+	if ledgerMode.Mode != LedgerReadOnly {
+		ledgerMode.Since = Clock.Now()
+		ledgerMode.writable = make(chan bool)
+	}
+	ledgerMode.Mode, ledgerMode.Reason = LedgerReadOnly, reason
+}
+
+// SetWritable lets the ledger store blocks again.
+func SetWritable() {
+	ledgerMode.Lock()
+	defer ledgerMode.Unlock()
+	if ledgerMode.Mode == LedgerWritable {
+		return
+	}
+	ledgerMode.LedgerMode = LedgerMode{Mode: LedgerWritable, Since: Clock.Now()}
+	close(ledgerMode.writable)
+}
+
+// Writable returns a channel that's closed once the ledger is writable,
+// already if it is, for work that pauses while it's read only.
+func Writable() <-chan bool {
+	ledgerMode.Lock()
+	defer ledgerMode.Unlock()
+	return ledgerMode.writable
+}
+
+// CheckWritable fails unless the store is open and a write to it goes
+// through, e.g. for a health check.
+func CheckWritable() error {
+	if Conf == nil {
+		return ErrNotOpen
+	}
+	if ReadOnly() {
+		return ErrDiskFull
+	}
+	return StoreMeta(healthPrefix, []byte("written"), Clock.Now().Unix())
+}
@@ -0,0 +1,160 @@
+package store
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+)
+
+// Each account's receivable total, kept up to date with the pending
+// entries so it can be read without counting them. Only sends at or above
+// DustThreshold are included.
+const receivableTotalPrefix = "receivabletotal"
+
+// Holds the DustThreshold the totals were counted with, so they're
+// counted again if it changes
+const receivableIndexedKey = "receivableindexed"
+
+func countsTowardsTotal(amount uint128.Uint128) bool {
+	return amount.Compare(DustThreshold) >= 0
+}
+
+func fetchReceivableTotal(conn *badger.Txn, pub []byte) uint128.Uint128 {
+	var total uint128.Uint128
+	fetchMeta(conn, receivableTotalPrefix, pub, &total)
+	return total
+}
+
+// Adds a pending entry's amount to, or with remove takes it from, the
+// destination's total.
+func adjustReceivableTotal(conn *badger.Txn, pub []byte, amount uint128.Uint128, remove bool) {
+	if !countsTowardsTotal(amount) {
+		return
+	}
+	total := fetchReceivableTotal(conn, pub)
+	if remove {
+		total = total.Sub(amount)
+	} else {
+		total = total.Add(amount)
+	}
+	if total == uint128.FromInts(0, 0) {
+		deleteMeta(conn, receivableTotalPrefix, pub)
+		return
+	}
+	storeMeta(conn, receivableTotalPrefix, pub, total)
+}
+
+// The amount of a pending entry, hot or cold.
+func pendingAmount(conn *badger.Txn, key []byte) (uint128.Uint128, bool) {
+	var amount uint128.Uint128
+	if fetchMeta(conn, pendingPrefix, key, &amount) == nil || fetchMeta(conn, coldPendingPrefix, key, &amount) == nil {
+		return amount, true
+	}
+	return amount, false
+}
+
+// ReceivableTotal is what an account has waiting to be received, not
+// counting dust, read without counting its pending entries.
+func ReceivableTotal(account types.Account) uint128.Uint128 {
+	pub, err := address.AddressToPub(account)
+	if err != nil {
+		return uint128.FromInts(0, 0)
+	}
+	conn := getConn()
+	defer releaseConn(conn)
+	return fetchReceivableTotal(conn, pub)
+}
+
+// Counts every account's total from its pending entries, hot and cold,
+// keyed by public key.
+func recountReceivable(conn *badger.Txn) (map[string]uint128.Uint128, error) {
+	totals := make(map[string]uint128.Uint128)
+	for _, bucket := range []string{pendingPrefix, coldPendingPrefix} {
+		err := iterateMeta(conn, bucket, func(key []byte, value []byte) error {
+			var amount uint128.Uint128
+			if err := gob.NewDecoder(bytes.NewBuffer(value)).Decode(&amount); err != nil {
+				return err
+			}
+			if len(key) == 64 && countsTowardsTotal(amount) {
+				pub := string(key[:32])
+				totals[pub] = totals[pub].Add(amount)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return totals, nil
+}
+
+func storedReceivableTotals(conn *badger.Txn) (map[string]uint128.Uint128, error) {
+	totals := make(map[string]uint128.Uint128)
+	err := iterateMeta(conn, receivableTotalPrefix, func(key []byte, value []byte) error {
+		var total uint128.Uint128
+		if err := gob.NewDecoder(bytes.NewBuffer(value)).Decode(&total); err != nil {
+			return err
+		}
+		totals[string(key)] = total
+		return nil
+	})
+	return totals, err
+}
+
+// Counts the totals for stores written before they were kept, or with a
+// different DustThreshold.
+func indexReceivable(conn *badger.Txn) {
+	var threshold uint128.Uint128
+	if fetchMeta(conn, receivableIndexedKey, nil, &threshold) == nil && threshold == DustThreshold {
+		return
+	}
+	stale, err := storedReceivableTotals(conn)
+	if err != nil {
+		panic(err)
+	}
+	for pub := range stale {
+		deleteMeta(conn, receivableTotalPrefix, []byte(pub))
+	}
+	totals, err := recountReceivable(conn)
+	if err != nil {
+		panic(err)
+	}
+	for pub, total := range totals {
+		storeMeta(conn, receivableTotalPrefix, []byte(pub), total)
+	}
+	storeMeta(conn, receivableIndexedKey, nil, DustThreshold)
+}
+
+// Compares the stored totals against a recount of the pending entries.
+func verifyReceivableTotals() []VerifyError {
+	conn := getConn()
+	defer releaseConn(conn)
+
+	stored, err := storedReceivableTotals(conn)
+	if err != nil {
+		return []VerifyError{{"", err}}
+	}
+	counted, err := recountReceivable(conn)
+	if err != nil {
+		return []VerifyError{{"", err}}
+	}
+
+	var errs []VerifyError
+	for pub := range counted {
+		if _, ok := stored[pub]; !ok {
+			stored[pub] = uint128.FromInts(0, 0)
+		}
+	}
+	for pub, total := range stored {
+		if total != counted[pub] {
+			account := address.PubKeyToAddress([]byte(pub))
+			errs = append(errs, VerifyError{"", fmt.Errorf("Receivable total of %s is %s, recounted %s", account, total.Decimal(), counted[pub].Decimal())})
+		}
+	}
+	return errs
+}
@@ -0,0 +1,159 @@
+package store
+
+import (
+	"sync"
+
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/types"
+)
+
+// ConfirmedSince calls fn with the account's cemented blocks above
+// sinceHeight, oldest first, rebuilt from its confirmation height by
+// walking back from the confirmed frontier. fn is called outside the
+// store lock, and returning an error stops the replay.
+func ConfirmedSince(account types.Account, sinceHeight uint64, fn func(CementEvent) error) error {
+	pub, err := address.AddressToPub(account)
+	if err != nil {
+		return ErrAccountNotFound
+	}
+
+	conn := getConn()
+	var confirmed ConfirmationHeight
+	fetchMeta(conn, confirmationHeightPrefix, pub, &confirmed)
+
+	// Newest first
+	var hashes []types.BlockHash
+	hash := confirmed.Frontier
+	for height := confirmed.Height; height > sinceHeight; height-- {
+		// Same form as the hashes in live events
+		hash = types.BlockHashFromBytes(hash.ToBytes())
+		hashes = append(hashes, hash)
+
+		block := fetchBlock(conn, hash)
+		if block == nil {
+			var pruned prunedBlock
+			if fetchMeta(conn, prunedPrefix, hash.ToBytes(), &pruned) != nil {
+				releaseConn(conn)
+				return ErrMissingBlock
+			}
+			hash = pruned.Previous
+			continue
+		}
+		hash = block.PreviousBlockHash()
+	}
+	releaseConn(conn)
+
+	for i := len(hashes) - 1; i >= 0; i-- {
+		err := fn(CementEvent{account, hashes[i], confirmed.Height - uint64(i)})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConfirmationFeed passes cement events on to subscribers. Its Publish
+// method is meant as a ConfirmationHeightProcessor's OnCemented.
+type ConfirmationFeed struct {
+	lock sync.Mutex
+	subs map[*Subscription]bool
+}
+
+func NewConfirmationFeed() *ConfirmationFeed {
+	return &ConfirmationFeed{subs: make(map[*Subscription]bool)}
+}
+
+var Confirmations = NewConfirmationFeed()
+
+type Subscription struct {
+	feed *ConfirmationFeed
+	// Empty for every account
+	account types.Account
+	fn      func(CementEvent)
+
+	lock sync.Mutex
+	// Live events held back until the replay is done
+	replaying bool
+	buffer    []CementEvent
+}
+
+func (f *ConfirmationFeed) Publish(e CementEvent) {
+	f.lock.Lock()
+	var subs []*Subscription
+	for s := range f.subs {
+		if s.account == "" || s.account == e.Account {
+			subs = append(subs, s)
+		}
+	}
+	f.lock.Unlock()
+
+	for _, s := range subs {
+		s.deliver(e)
+	}
+}
+
+func (s *Subscription) deliver(e CementEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.replaying {
+		s.buffer = append(s.buffer, e)
+		return
+	}
+	s.fn(e)
+}
+
+// Subscribe calls fn with live cement events for account, or for every
+// account if it's empty.
+func (f *ConfirmationFeed) Subscribe(account types.Account, fn func(CementEvent)) *Subscription {
+	s := &Subscription{feed: f, account: account, fn: fn}
+	f.lock.Lock()
+	f.subs[s] = true
+	f.lock.Unlock()
+	return s
+}
+
+// SubscribeFrom first replays the account's confirmations from height
+// fromHeight on, then carries on with live events. Each block is passed
+// to fn exactly once, in height order, with no gap between the replay
+// and the live events: the subscription starts before the store is
+// read, so anything cemented after the read is caught live, and live
+// events that arrive during the replay are held back and dropped if the
+// replay already covered them.
+func (f *ConfirmationFeed) SubscribeFrom(account types.Account, fromHeight uint64, fn func(CementEvent)) (*Subscription, error) {
+	s := &Subscription{feed: f, account: account, fn: fn, replaying: true}
+	f.lock.Lock()
+	f.subs[s] = true
+	f.lock.Unlock()
+
+	replayed := make(map[types.BlockHash]bool)
+	since := uint64(0)
+	if fromHeight > 0 {
+		since = fromHeight - 1
+	}
+	err := ConfirmedSince(account, since, func(e CementEvent) error {
+		replayed[e.Hash] = true
+		fn(e)
+		return nil
+	})
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, e := range s.buffer {
+		if !replayed[e.Hash] && e.Height >= fromHeight {
+			fn(e)
+		}
+	}
+	s.buffer = nil
+	s.replaying = false
+	return s, nil
+}
+
+func (s *Subscription) Close() {
+	s.feed.lock.Lock()
+	defer s.feed.lock.Unlock()
+	delete(s.feed.subs, s)
+}
@@ -0,0 +1,237 @@
+package store
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+)
+
+// Keys copied per transaction, to stay under badger's transaction size
+const backupBatchSize = 1000
+
+// Opens a read only view of everything written so far. The store lock is
+// only held to wait out a write in progress, not while the view is read.
+func readView() *badger.Txn {
+	conn := getConn()
+	view := globalConn.NewTransaction(false)
+	releaseConn(conn)
+	return view
+}
+
+// Backup copies every key into a fresh database at path. It reads from a
+// view of the store, so writes carry on while it copies.
+func Backup(path string) error {
+	os.RemoveAll(path)
+	opts := badger.DefaultOptions
+	opts.Dir = path
+	opts.ValueDir = path
+	db, err := badger.Open(opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	conn := readView()
+	defer conn.Discard()
+
+	it := conn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	txn := db.NewTransaction(true)
+	count := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		value, err := item.Value()
+		if err != nil {
+			txn.Discard()
+			return err
+		}
+		key := append([]byte{}, item.Key()...)
+		err = txn.SetWithMeta(key, append([]byte{}, value...), item.UserMeta())
+		if err != nil {
+			txn.Discard()
+			return err
+		}
+
+		count++
+		if count%backupBatchSize == 0 {
+			err = txn.Commit(nil)
+			if err != nil {
+				return err
+			}
+			txn = db.NewTransaction(true)
+		}
+	}
+
+	return txn.Commit(nil)
+}
+
+// Reader is the read side of the store, served either by the primary or
+// by a replica.
+type Reader interface {
+	FetchBlock(hash types.BlockHash) blocks.Block
+	FetchOpen(account types.Account) *blocks.OpenBlock
+	GetBalance(block blocks.Block) uint128.Uint128
+}
+
+type primary struct{}
+
+func (primary) FetchBlock(hash types.BlockHash) blocks.Block {
+	return FetchBlock(hash)
+}
+
+func (primary) FetchOpen(account types.Account) *blocks.OpenBlock {
+	return FetchOpen(account)
+}
+
+func (primary) GetBalance(block blocks.Block) uint128.Uint128 {
+	return GetBalance(block)
+}
+
+func (primary) Frontier(account types.Account) (types.BlockHash, bool) {
+	return FetchFrontier(account)
+}
+
+var Primary Backend = primary{}
+
+// Replica is a periodically refreshed snapshot of the store, so heavy
+// read traffic doesn't queue behind writers on the store lock.
+type Replica struct {
+	lock  sync.RWMutex
+	path  string
+	db    *badger.DB
+	taken time.Time
+	// The write version the snapshot includes at least
+	version uint64
+	// Reads needing data newer than this go to the primary
+	MaxStaleness time.Duration
+}
+
+func NewReplica(path string, maxStaleness time.Duration) *Replica {
+	return &Replica{path: path, MaxStaleness: maxStaleness}
+}
+
+// Refresh takes a new snapshot and swaps it in once complete.
+func (r *Replica) Refresh() error {
+	taken, version := time.Now(), Version()
+	next := r.path + ".next"
+	err := Backup(next)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.db != nil {
+		r.db.Close()
+		r.db = nil
+	}
+	os.RemoveAll(r.path)
+	err = os.Rename(next, r.path)
+	if err != nil {
+		return err
+	}
+
+	opts := badger.DefaultOptions
+	opts.Dir = r.path
+	opts.ValueDir = r.path
+	r.db, err = badger.Open(opts)
+	if err != nil {
+		return err
+	}
+	r.taken, r.version = taken, version
+	return nil
+}
+
+// Refreshes every interval until done is closed.
+func (r *Replica) Run(interval time.Duration, done chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			r.Refresh()
+		}
+	}
+}
+
+// Age of the current snapshot.
+func (r *Replica) Age() time.Duration {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if r.db == nil {
+		return -1
+	}
+	return time.Since(r.taken)
+}
+
+// Reader picks where a read should be served from. Reads that need to see
+// the latest writes, such as the pending check before a receive, or any
+// read when the snapshot is too old, go to the primary.
+func (r *Replica) Reader(fresh bool) Reader {
+	age := r.Age()
+	if fresh || age < 0 || age > r.MaxStaleness {
+		return Primary
+	}
+	return r
+}
+
+// ReaderAt is like Reader, but reads go to the primary until a snapshot
+// includes the writes up to version, e.g. a wallet's last send.
+func (r *Replica) ReaderAt(version uint64) Reader {
+	r.lock.RLock()
+	behind := r.db != nil && r.version < version
+	r.lock.RUnlock()
+	if behind {
+		return Primary
+	}
+	return r.Reader(false)
+}
+
+func (r *Replica) view(fn func(conn *badger.Txn)) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if r.db == nil {
+		// No snapshot yet
+		conn := readView()
+		defer conn.Discard()
+		fn(conn)
+		return
+	}
+
+	conn := r.db.NewTransaction(false)
+	defer conn.Discard()
+	fn(conn)
+}
+
+func (r *Replica) FetchBlock(hash types.BlockHash) (b blocks.Block) {
+	r.view(func(conn *badger.Txn) {
+		b = fetchBlock(conn, hash)
+	})
+	return b
+}
+
+func (r *Replica) FetchOpen(account types.Account) (b *blocks.OpenBlock) {
+	r.view(func(conn *badger.Txn) {
+		b = fetchOpen(conn, account)
+	})
+	return b
+}
+
+func (r *Replica) GetBalance(block blocks.Block) (balance uint128.Uint128) {
+	r.view(func(conn *badger.Txn) {
+		balance = getBalance(conn, block)
+	})
+	return balance
+}
@@ -0,0 +1,125 @@
+package store
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/utils"
+)
+
+var ErrSelfReference = errors.New("Block references itself as previous")
+var ErrMissingParent = errors.New("Cannot find parent block")
+var ErrMissingSource = errors.New("Cannot find source block")
+var ErrUnconnectedPoolFull = errors.New("Unconnected block pool is full")
+var ErrChainTooLong = errors.New("Too many blocks pulled for account")
+var ErrChainCycle = errors.New("Cycle in account chain")
+var ErrInvalidWork = errors.New("Invalid work for block")
+
+// Blocks waiting for their parent beyond this are rejected
+var MaxUnconnectedBlocks = 10000
+
+// Rough bytes per block waiting in the unconnected pool
+const uncheckedEntrySize = 600
+
+func init() {
+	utils.RegisterMemory("unchecked", uncheckedEntrySize, MaxUnconnectedBlocks, uncheckedCount, setMaxUnchecked)
+}
+
+// The pool is only touched under the store lock, but these don't need a
+// transaction, and may run before Init.
+func uncheckedCount() int {
+	connLock.Lock()
+	defer connLock.Unlock()
+	return len(unconnectedBlockPool)
+}
+
+// Drops waiting blocks over the new limit. They'll be fetched again if
+// their parent turns up.
+func setMaxUnchecked(max int) {
+	connLock.Lock()
+	defer connLock.Unlock()
+
+	MaxUnconnectedBlocks = max
+	for previous := range unconnectedBlockPool {
+		if len(unconnectedBlockPool) <= max {
+			break
+		}
+		delete(unconnectedBlockPool, previous)
+	}
+}
+
+// Counts of blocks rejected by each sanity check
+type SanityCounters struct {
+	SelfReference uint64
+	PoolFull      uint64
+	ChainTooLong  uint64
+	ChainCycle    uint64
+}
+
+var sanityCounters SanityCounters
+
+func GetSanityCounters() SanityCounters {
+	return SanityCounters{
+		atomic.LoadUint64(&sanityCounters.SelfReference),
+		atomic.LoadUint64(&sanityCounters.PoolFull),
+		atomic.LoadUint64(&sanityCounters.ChainTooLong),
+		atomic.LoadUint64(&sanityCounters.ChainCycle),
+	}
+}
+
+// Cheap checks run before anything else when storing a block.
+func checkSanity(block blocks.Block, hash types.BlockHash) error {
+	if block.Type() != blocks.Open && block.PreviousBlockHash() == hash {
+		atomic.AddUint64(&sanityCounters.SelfReference, 1)
+		return ErrSelfReference
+	}
+	return nil
+}
+
+// A ChainGuard limits how many blocks are accepted per account during
+// one chain pull session, and detects previous links that loop.
+type ChainGuard struct {
+	lock      sync.Mutex
+	maxBlocks int
+	visited   map[types.Account]map[types.BlockHash]bool
+}
+
+func NewChainGuard(maxBlocks int) *ChainGuard {
+	return &ChainGuard{
+		maxBlocks: maxBlocks,
+		visited:   make(map[types.Account]map[types.BlockHash]bool),
+	}
+}
+
+func (g *ChainGuard) Check(account types.Account, hash types.BlockHash) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	seen := g.visited[account]
+	if seen == nil {
+		seen = make(map[types.BlockHash]bool)
+		g.visited[account] = seen
+	}
+
+	if seen[hash] {
+		atomic.AddUint64(&sanityCounters.ChainCycle, 1)
+		return ErrChainCycle
+	}
+	if len(seen) >= g.maxBlocks {
+		atomic.AddUint64(&sanityCounters.ChainTooLong, 1)
+		return ErrChainTooLong
+	}
+
+	seen[hash] = true
+	return nil
+}
+
+// Forgets an account once its pull is finished.
+func (g *ChainGuard) Done(account types.Account) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	delete(g.visited, account)
+}
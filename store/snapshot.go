@@ -0,0 +1,380 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/crypto/ed25519"
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/golang/crypto/blake2b"
+	"github.com/pkg/errors"
+)
+
+const snapshotPrefix = "snapshot"
+const snapshotVersion = 1
+
+// Blocks signature checked and committed together on import
+const snapshotBatchSize = 1000
+
+// Longest manifest or block line read
+const maxSnapshotLine = 4096
+
+var ErrUnsignedSnapshot = errors.New("Snapshot isn't signed")
+var ErrUntrustedSigner = errors.New("Snapshot signed by an untrusted key")
+var ErrBadSnapshotSignature = errors.New("Bad snapshot signature")
+var ErrSnapshotContent = errors.New("Snapshot content doesn't match its manifest")
+
+// SnapshotManifest is the first line of a snapshot. The rest is one JSON
+// block per line, each after the block it builds on.
+type SnapshotManifest struct {
+	Version int
+	Genesis types.BlockHash
+	Blocks  int
+	// Hex blake2b-256 of everything after the manifest line
+	ContentHash string
+	// Empty for unsigned snapshots
+	Creator   types.Account
+	Signature types.Signature
+}
+
+// What the creator signs.
+func (m SnapshotManifest) message() []byte {
+	return []byte(fmt.Sprintf("nano snapshot %d %s %d %s %s", m.Version, m.Genesis, m.Blocks, m.ContentHash, m.Creator))
+}
+
+// Where an imported snapshot came from.
+type SnapshotProvenance struct {
+	Creator     types.Account
+	ContentHash string
+	Blocks      int
+	Source      string
+	// Unix seconds
+	Imported int64
+}
+
+type SnapshotOptions struct {
+	Trusted []ed25519.PublicKey
+	// Accept unsigned snapshots and any signer
+	Insecure bool
+	// Recorded with the provenance, e.g. the download url
+	Source string
+}
+
+// The stored blocks in import order: every block after its previous block
+// and the send it receives. Chains are taken in turn, each as far as it
+// goes before it needs a send not yet taken.
+func snapshotOrder(conn *badger.Txn) ([]blocks.Block, error) {
+	index := loadBlockIndex(conn)
+	emitted := make(map[types.BlockHash]bool)
+	var result []blocks.Block
+
+	ready := func(block blocks.Block) bool {
+		switch b := block.(type) {
+		case *blocks.OpenBlock:
+			return b.Hash() == Conf.GenesisBlock.Hash() || emitted[b.SourceHash]
+		case *blocks.ReceiveBlock:
+			return emitted[b.SourceHash]
+		}
+		return true
+	}
+	// Takes a chain from block as far as it's ready, or all of it with
+	// force. Returns the block it stopped at, or nil at the end.
+	chain := func(block blocks.Block, force bool) (blocks.Block, error) {
+		for force || ready(block) {
+			result = append(result, block)
+			emitted[block.Hash()] = true
+			next, ok := index.successors[block.Hash()]
+			if !ok {
+				return nil, nil
+			}
+			if block = fetchBlock(conn, next); block == nil {
+				return nil, errors.Errorf("Block %s is pruned", next)
+			}
+		}
+		return block, nil
+	}
+
+	var remaining []blocks.Block
+	for _, open := range index.opens {
+		remaining = append(remaining, open)
+	}
+	for len(remaining) > 0 {
+		taken := len(result)
+		var waiting []blocks.Block
+		for _, block := range remaining {
+			next, err := chain(block, false)
+			if err != nil {
+				return nil, err
+			}
+			if next != nil {
+				waiting = append(waiting, next)
+			}
+		}
+		if len(result) == taken {
+			// Sources that aren't stored, they'll fail to import
+			for _, block := range waiting {
+				if _, err := chain(block, true); err != nil {
+					return nil, err
+				}
+			}
+			break
+		}
+		remaining = waiting
+	}
+	return result, nil
+}
+
+// ExportSnapshot writes every block to w, signed by priv if it isn't nil.
+func ExportSnapshot(w io.Writer, priv ed25519.PrivateKey) error {
+	conn := getConn()
+	order, err := snapshotOrder(conn)
+	releaseConn(conn)
+	if err != nil {
+		return err
+	}
+
+	var content bytes.Buffer
+	for _, block := range order {
+		line, err := json.Marshal(blocks.ToRaw(block))
+		if err != nil {
+			return err
+		}
+		content.Write(append(line, '\n'))
+	}
+
+	hash := blake2b.Sum256(content.Bytes())
+	manifest := SnapshotManifest{
+		Version:     snapshotVersion,
+		Genesis:     Conf.GenesisBlock.Hash(),
+		Blocks:      len(order),
+		ContentHash: hex.EncodeToString(hash[:]),
+	}
+	if priv != nil {
+		manifest.Creator = address.PubKeyToAddress(priv.Public().(ed25519.PublicKey))
+		sig := hex.EncodeToString(ed25519.Sign(priv, manifest.message()))
+		manifest.Signature = types.Signature(strings.ToUpper(sig))
+	}
+
+	line, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	_, err = w.Write(content.Bytes())
+	return err
+}
+
+func checkSigner(manifest SnapshotManifest, opts SnapshotOptions) error {
+	if manifest.Signature == "" {
+		if opts.Insecure {
+			return nil
+		}
+		return ErrUnsignedSnapshot
+	}
+
+	creator, err := address.AddressToPub(manifest.Creator)
+	if err != nil || manifest.Signature.Validate() != nil {
+		return ErrBadSnapshotSignature
+	}
+	if !ed25519.Verify(creator, manifest.message(), manifest.Signature.ToBytes()) {
+		return ErrBadSnapshotSignature
+	}
+	if opts.Insecure {
+		return nil
+	}
+	for _, trusted := range opts.Trusted {
+		if bytes.Equal(trusted, creator) {
+			return nil
+		}
+	}
+	return ErrUntrustedSigner
+}
+
+// ImportSnapshot checks a snapshot's manifest is signed by one of the
+// trusted keys and matches its content, then stores its blocks.
+func ImportSnapshot(r io.Reader, trustedSigners []ed25519.PublicKey) (SnapshotManifest, error) {
+	return ImportSnapshotWith(r, SnapshotOptions{Trusted: trustedSigners})
+}
+
+func ImportSnapshotWith(r io.Reader, opts SnapshotOptions) (SnapshotManifest, error) {
+	var manifest SnapshotManifest
+	in := bufio.NewReaderSize(r, maxSnapshotLine)
+	line, err := in.ReadSlice('\n')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			err = errors.New("Snapshot manifest too long")
+		}
+		return manifest, err
+	}
+	if err = json.Unmarshal(line, &manifest); err != nil {
+		return manifest, errors.Wrap(err, "Bad snapshot manifest")
+	}
+	if manifest.Version != snapshotVersion {
+		return manifest, errors.Errorf("Unsupported snapshot version %d", manifest.Version)
+	}
+	if manifest.Genesis != Conf.GenesisBlock.Hash() {
+		return manifest, errors.New("Snapshot is for another network")
+	}
+	if err = checkSigner(manifest, opts); err != nil {
+		return manifest, err
+	}
+
+	// The content is checked in full before anything is stored
+	content, err := ioutil.TempFile("", "snapshot")
+	if err != nil {
+		return manifest, err
+	}
+	defer os.Remove(content.Name())
+	defer content.Close()
+
+	hash, _ := blake2b.New256(nil)
+	var lines lineCounter
+	_, err = io.Copy(io.MultiWriter(content, hash, &lines), in)
+	if err != nil {
+		return manifest, err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != manifest.ContentHash || int(lines) != manifest.Blocks {
+		return manifest, ErrSnapshotContent
+	}
+	if _, err = content.Seek(0, io.SeekStart); err != nil {
+		return manifest, err
+	}
+
+	if err = importBlocks(content); err != nil {
+		return manifest, err
+	}
+
+	return manifest, StoreMeta(snapshotPrefix, []byte(manifest.ContentHash), SnapshotProvenance{
+		Creator:     manifest.Creator,
+		ContentHash: manifest.ContentHash,
+		Blocks:      manifest.Blocks,
+		Source:      opts.Source,
+		Imported:    time.Now().Unix(),
+	})
+}
+
+type lineCounter int
+
+func (c *lineCounter) Write(p []byte) (int, error) {
+	*c += lineCounter(bytes.Count(p, []byte{'\n'}))
+	return len(p), nil
+}
+
+// Stores blocks a batch at a time, checking the batch's signatures in
+// parallel first.
+func importBlocks(r io.Reader) error {
+	// Account of each chain's latest block, so most lookups don't walk
+	// the store
+	tips := map[types.BlockHash]types.Account{Conf.GenesisBlock.Hash(): Conf.GenesisBlock.Account}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxSnapshotLine)
+	count := 0
+
+	var batch []blocks.Block
+	var accounts []types.Account
+	flush := func() error {
+		if err := checkSignatures(batch, accounts); err != nil {
+			return err
+		}
+		conn := getConn()
+		defer releaseConn(conn)
+		for _, block := range batch {
+			if fetchBlock(conn, block.Hash()) != nil {
+				continue
+			}
+			if err := storeBlock(conn, block); err != nil {
+				return errors.Wrapf(err, "Block %s", block.Hash())
+			}
+		}
+		batch, accounts = batch[:0], accounts[:0]
+		return nil
+	}
+
+	for scanner.Scan() {
+		block, err := blocks.ParseJson(scanner.Bytes())
+		if err != nil {
+			return errors.Wrapf(err, "Snapshot block %d", count)
+		}
+		count++
+
+		var account types.Account
+		if open, ok := block.(*blocks.OpenBlock); ok {
+			account = open.Account
+		} else {
+			previous := block.PreviousBlockHash()
+			account = tips[previous]
+			delete(tips, previous)
+			if account == "" {
+				conn := getConn()
+				account = accountOf(conn, previous)
+				releaseConn(conn)
+			}
+		}
+		tips[block.Hash()] = account
+
+		batch = append(batch, block)
+		accounts = append(accounts, account)
+		if len(batch) == snapshotBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+func checkSignatures(batch []blocks.Block, accounts []types.Account) error {
+	failed := make([]bool, len(batch))
+	var wg sync.WaitGroup
+	workers := runtime.NumCPU()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(batch); i += workers {
+				pub, err := address.AddressToPub(accounts[i])
+				failed[i] = err != nil || !blocks.VerifyBlockSignature(batch[i], pub)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for i, bad := range failed {
+		if bad {
+			return errors.Errorf("Bad signature on snapshot block %s", batch[i].Hash())
+		}
+	}
+	return nil
+}
+
+// SnapshotProvenances lists the snapshots this store was built from.
+func SnapshotProvenances() []SnapshotProvenance {
+	var result []SnapshotProvenance
+	IterateMeta(snapshotPrefix, func(key []byte, value []byte) error {
+		var p SnapshotProvenance
+		if gob.NewDecoder(bytes.NewBuffer(value)).Decode(&p) == nil {
+			result = append(result, p)
+		}
+		return nil
+	})
+	return result
+}
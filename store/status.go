@@ -0,0 +1,94 @@
+package store
+
+import (
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+)
+
+type AccountState int
+
+const (
+	// Never opened and nothing receivable above the dust threshold
+	AccountUnknown AccountState = iota
+	// Never opened, but has sends waiting to be received
+	AccountPendingOnly
+	AccountOpened
+)
+
+func (s AccountState) String() string {
+	switch s {
+	case AccountPendingOnly:
+		return "pending only"
+	case AccountOpened:
+		return "opened"
+	default:
+		return "unknown"
+	}
+}
+
+// Receivable sends smaller than this are ignored, like the reference
+// node's receive_minimum. 10^24 raw.
+var DustThreshold = uint128.FromInts(0xd3c2, 0x1bcecceda1000000)
+
+type Receivable struct {
+	Hash   types.BlockHash
+	Amount uint128.Uint128
+}
+
+type AccountStatus struct {
+	State AccountState
+	// Only set for opened accounts
+	OpenBlock  types.BlockHash
+	Frontier   types.BlockHash
+	Balance    uint128.Uint128
+	BlockCount int
+	// Unreceived sends at or above DustThreshold
+	Receivable      []Receivable
+	ReceivableTotal uint128.Uint128
+	// Unreceived sends below DustThreshold, not included in the total
+	Dust int
+}
+
+// GetAccountStatus tells an account that was never opened but has funds
+// waiting apart from one that doesn't exist at all. Its receivable sends
+// are read from the pending index, hot and cold, and its chain is followed
+// by the successor index.
+func GetAccountStatus(account types.Account) AccountStatus {
+	conn := getConn()
+	defer releaseConn(conn)
+
+	var status AccountStatus
+	if address.ValidateAddress(account) {
+		for _, bucket := range []string{pendingPrefix, coldPendingPrefix} {
+			pending, _, _ := readPending(conn, bucket, account, "", -1)
+			for _, entry := range pending {
+				if entry.Amount.Compare(DustThreshold) < 0 {
+					status.Dust++
+					continue
+				}
+				status.Receivable = append(status.Receivable, entry)
+			}
+		}
+	}
+	if pub, err := address.AddressToPub(account); err == nil {
+		status.ReceivableTotal = fetchReceivableTotal(conn, pub)
+	}
+
+	open := fetchOpen(conn, account)
+	if open != nil {
+		status.State = AccountOpened
+		status.OpenBlock = open.Hash()
+		status.Frontier = status.OpenBlock
+		status.BlockCount = 1
+		var next types.BlockHash
+		for fetchMeta(conn, successorPrefix, status.Frontier.ToBytes(), &next) == nil {
+			status.Frontier = next
+			status.BlockCount++
+		}
+		status.Balance = balanceOf(conn, status.Frontier)
+	} else if len(status.Receivable) > 0 {
+		status.State = AccountPendingOnly
+	}
+	return status
+}
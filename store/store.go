@@ -6,10 +6,13 @@ import (
 	"errors"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dgraph-io/badger"
 	"github.com/frankh/nano/address"
 	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/metrics"
 	"github.com/frankh/nano/types"
 	"github.com/frankh/nano/uint128"
 )
@@ -106,7 +109,9 @@ func getConn() *badger.Txn {
 }
 
 func releaseConn(conn *badger.Txn) {
+	start := time.Now()
 	currentTxn.Commit(nil)
+	commitDuration.Since(start)
 	currentTxn = nil
 	connLock.Unlock()
 }
@@ -114,6 +119,10 @@ func releaseConn(conn *badger.Txn) {
 func Init(config Config) {
 	var err error
 	unconnectedBlockPool = make(map[types.BlockHash]blocks.Block)
+	timestampCount = -1
+	coldSweepCursor = nil
+	// A new store has its own disk
+	SetWritable()
 
 	if globalConn != nil {
 		globalConn.Close()
@@ -123,11 +132,17 @@ func Init(config Config) {
 	conn := getConn()
 	defer releaseConn(conn)
 
-	_, err = conn.Get(blocks.LiveGenesisBlockHash.ToBytes())
+	_, err = conn.Get(config.GenesisBlock.Hash().ToBytes())
 
 	if err != nil {
 		uncheckedStoreBlock(conn, config.GenesisBlock)
 	}
+	indexPending(conn)
+	indexReceivable(conn)
+	indexSuccessors(conn)
+	indexModified(conn)
+	indexWeights(conn)
+	indexBlockAccounts(conn)
 }
 
 func FetchOpen(account types.Account) (b *blocks.OpenBlock) {
@@ -151,6 +166,17 @@ func fetchOpen(conn *badger.Txn, account types.Account) (b *blocks.OpenBlock) {
 	return blockItem.ToBlock().(*blocks.OpenBlock)
 }
 
+// The account's latest block, false if it isn't open.
+func FetchFrontier(account types.Account) (types.BlockHash, bool) {
+	conn := getConn()
+	defer releaseConn(conn)
+	open := fetchOpen(conn, account)
+	if open == nil {
+		return "", false
+	}
+	return chainFrontier(conn, open.Hash()), true
+}
+
 func FetchBlock(hash types.BlockHash) (b blocks.Block) {
 	conn := getConn()
 	defer releaseConn(conn)
@@ -158,6 +184,10 @@ func FetchBlock(hash types.BlockHash) (b blocks.Block) {
 }
 
 func fetchBlock(conn *badger.Txn, hash types.BlockHash) (b blocks.Block) {
+	if hash.Validate() != nil {
+		return nil
+	}
+
 	item, err := conn.Get(hash.ToBytes())
 	if err != nil {
 		return nil
@@ -174,9 +204,22 @@ func GetBalance(block blocks.Block) uint128.Uint128 {
 }
 
 func getSendAmount(conn *badger.Txn, block *blocks.SendBlock) uint128.Uint128 {
-	prev := fetchBlock(conn, block.PreviousHash)
+	return balanceOf(conn, block.PreviousHash).Sub(getBalance(conn, block))
+}
+
+// Balance after the block with this hash, which may have been pruned.
+func balanceOf(conn *badger.Txn, hash types.BlockHash) uint128.Uint128 {
+	block := fetchBlock(conn, hash)
+	if block != nil {
+		return getBalance(conn, block)
+	}
 
-	return getBalance(conn, prev).Sub(getBalance(conn, block))
+	var pruned prunedBlock
+	err := fetchMeta(conn, prunedPrefix, hash.ToBytes(), &pruned)
+	if err != nil {
+		panic("Missing block " + string(hash))
+	}
+	return pruned.Balance
 }
 
 func getBalance(conn *badger.Txn, block blocks.Block) uint128.Uint128 {
@@ -195,14 +238,13 @@ func getBalance(conn *badger.Txn, block blocks.Block) uint128.Uint128 {
 
 	case blocks.Receive:
 		b := block.(*blocks.ReceiveBlock)
-		prev := fetchBlock(conn, b.PreviousHash)
 		source := fetchBlock(conn, b.SourceHash).(*blocks.SendBlock)
 		received := getSendAmount(conn, source)
-		return getBalance(conn, prev).Add(received)
+		return balanceOf(conn, b.PreviousHash).Add(received)
 
 	case blocks.Change:
 		b := block.(*blocks.ChangeBlock)
-		return getBalance(conn, fetchBlock(conn, b.PreviousHash))
+		return balanceOf(conn, b.PreviousHash)
 
 	default:
 		panic("Unknown block type")
@@ -212,30 +254,97 @@ func getBalance(conn *badger.Txn, block blocks.Block) uint128.Uint128 {
 
 // Validate and store a block
 // TODO: Validate signature and balance
+var processProgress = metrics.ProcessDuration.With("progress")
+var processGap = metrics.ProcessDuration.With("gap")
+var processRejected = metrics.ProcessDuration.With("rejected")
+
+var commitDuration = metrics.CommitDuration.With("")
+
 func StoreBlock(block blocks.Block) error {
+	start := time.Now()
+	if ReadOnly() {
+		processRejected.Since(start)
+		return ErrDiskFull
+	}
 	conn := getConn()
 	defer releaseConn(conn)
-	return storeBlock(conn, block)
+	err := storeBlock(conn, block)
+
+	switch err {
+	case nil:
+		wrote()
+		noteWriteLatency(time.Since(start))
+		processProgress.Since(start)
+	case ErrMissingParent, ErrMissingSource, ErrUnconnectedPoolFull:
+		processGap.Since(start)
+	default:
+		processRejected.Since(start)
+	}
+	return err
 }
 
 func storeBlock(conn *badger.Txn, block blocks.Block) error {
+	err := checkSanity(block, block.Hash())
+	if err != nil {
+		return err
+	}
+
 	if !blocks.ValidateBlockWork(block) {
-		return errors.New("Invalid work for block")
+		return ErrInvalidWork
 	}
+	metrics.Traces.Record(block.Hash(), metrics.StageWorkChecked)
 
 	if block.Type() != blocks.Open && block.Type() != blocks.Change && block.Type() != blocks.Send && block.Type() != blocks.Receive {
 		return errors.New("Unknown block type")
 	}
 
 	if fetchBlock(conn, block.PreviousBlockHash()) == nil {
+		if len(unconnectedBlockPool) >= MaxUnconnectedBlocks {
+			atomic.AddUint64(&sanityCounters.PoolFull, 1)
+			return ErrUnconnectedPoolFull
+		}
 		if unconnectedBlockPool[block.PreviousBlockHash()] == nil {
 			unconnectedBlockPool[block.PreviousBlockHash()] = block
 			log.Printf("Added block to unconnected pool, now %d", len(unconnectedBlockPool))
 		}
-		return errors.New("Cannot find parent block")
+		return ErrMissingParent
+	}
+	// A receive's amount comes from its send, which a bootstrap may pull
+	// after it with the sender's chain
+	if receive, ok := block.(*blocks.ReceiveBlock); ok && fetchBlock(conn, receive.SourceHash) == nil {
+		if len(unconnectedBlockPool) >= MaxUnconnectedBlocks {
+			atomic.AddUint64(&sanityCounters.PoolFull, 1)
+			return ErrUnconnectedPoolFull
+		}
+		if unconnectedBlockPool[receive.SourceHash] == nil {
+			unconnectedBlockPool[receive.SourceHash] = block
+			log.Printf("Added block to unconnected pool, now %d", len(unconnectedBlockPool))
+		}
+		return ErrMissingSource
+	}
+
+	// Only known once the previous block is
+	version := versionFor(conn, block)
+	if !blocks.ValidateBlockWorkAt(block, version) {
+		return ErrInvalidWork
+	}
+
+	// The first block seen on a root is kept
+	if kept := conflicting(conn, block); kept != nil && kept.Hash() != block.Hash() {
+		if err := recordFork(conn, kept, block); err != nil {
+			return err
+		}
+		return ErrFork
 	}
 
 	uncheckedStoreBlock(conn, block)
+	markVersion(conn, block, version)
+	touchAccount(conn, block)
+	storeBlockAccount(conn, block)
+	moveWeight(conn, block)
+	if blockLog != nil {
+		blockLog.Append(block)
+	}
 	dependentBlock := unconnectedBlockPool[block.Hash()]
 
 	if dependentBlock != nil {
@@ -298,4 +407,6 @@ func uncheckedStoreBlock(conn *badger.Txn, block blocks.Block) {
 	if err != nil {
 		panic("Failed to store block")
 	}
+	storeSuccessor(conn, block)
+	updatePending(conn, block)
 }
@@ -1,10 +1,28 @@
 package store
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/frankh/crypto/ed25519"
+	"github.com/frankh/nano/address"
 	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/protocol"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/frankh/nano/utils"
 )
 
 func TestInit(t *testing.T) {
@@ -34,3 +52,2188 @@ func TestMissingBlock(t *testing.T) {
 	}
 	os.RemoveAll(TestConfig.Path)
 }
+
+func signed(block blocks.Block, priv ed25519.PrivateKey) blocks.Block {
+	switch b := block.(type) {
+	case *blocks.OpenBlock:
+		b.Work = blocks.GenerateWorkForHash(b.RootHash())
+		b.Signature = b.Hash().Sign(priv)
+	case *blocks.SendBlock:
+		b.Work = blocks.GenerateWorkForHash(b.RootHash())
+		b.Signature = b.Hash().Sign(priv)
+	case *blocks.ReceiveBlock:
+		b.Work = blocks.GenerateWorkForHash(b.RootHash())
+		b.Signature = b.Hash().Sign(priv)
+	case *blocks.ChangeBlock:
+		b.Work = blocks.GenerateWorkForHash(b.RootHash())
+		b.Signature = b.Hash().Sign(priv)
+	}
+	return block
+}
+
+// Genesis sends to a second account, which opens and sends back,
+// and genesis receives it.
+func createTestChains(t *testing.T) (second ed25519.PrivateKey, receive *blocks.ReceiveBlock) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	_, genesisPriv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	pub, priv := address.GenerateKey()
+	account := address.PubKeyToAddress(pub)
+
+	send := signed(&blocks.SendBlock{
+		PreviousHash: blocks.TestGenesisBlock.Hash(),
+		Destination:  account,
+		Balance:      uint128.FromInts(0, 1000),
+	}, genesisPriv)
+	open := signed(&blocks.OpenBlock{
+		SourceHash:     send.Hash(),
+		Representative: account,
+		Account:        account,
+	}, priv)
+	sendBack := signed(&blocks.SendBlock{
+		PreviousHash: open.Hash(),
+		Destination:  blocks.TestGenesisBlock.Account,
+		Balance:      uint128.FromInts(0, 10),
+	}, priv)
+	receive = signed(&blocks.ReceiveBlock{
+		PreviousHash: send.Hash(),
+		SourceHash:   sendBack.Hash(),
+	}, genesisPriv).(*blocks.ReceiveBlock)
+
+	for _, b := range []blocks.Block{send, open, sendBack, receive} {
+		if err := StoreBlock(b); err != nil {
+			t.Fatalf("Failed to store block: %s", err)
+		}
+	}
+	return priv, receive
+}
+
+func TestVerify(t *testing.T) {
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+	priv, receive := createTestChains(t)
+	// Left spilled by an interrupted run
+	StoreMeta(verifyPairsPrefix, bytes.Repeat([]byte{1}, 32), receivePair{blocks.TestGenesisBlock.Account, receive.Hash()})
+
+	var last VerifyProgress
+	errs := Verify(VerifyOptions{
+		Workers:   2,
+		PairLimit: 1,
+		Progress:  func(p VerifyProgress) { last = p },
+	})
+	if len(errs) != 0 {
+		t.Errorf("Unexpected verify errors %v", errs)
+	}
+	if last.AccountsDone != 2 || last.AccountsTotal != 2 || last.BlocksChecked != 5 {
+		t.Errorf("Bad progress %+v", last)
+	}
+
+	// A second receive of the same send, signed by the wrong key
+	bad := signed(&blocks.ReceiveBlock{
+		PreviousHash: receive.Hash(),
+		SourceHash:   receive.SourceHash,
+	}, priv)
+	conn := getConn()
+	uncheckedStoreBlock(conn, bad)
+	releaseConn(conn)
+
+	errs = Verify(VerifyOptions{Workers: 2, PairLimit: 1})
+	if len(errs) != 2 {
+		t.Fatalf("Expected signature and double receive errors, got %v", errs)
+	}
+
+	// The second account's chain is unchanged, so resuming only
+	// re-checks the genesis chain
+	last = VerifyProgress{}
+	Verify(VerifyOptions{Resume: true, Progress: func(p VerifyProgress) { last = p }})
+	if last.BlocksChecked != 4 {
+		t.Errorf("Resume should skip verified accounts, checked %d blocks", last.BlocksChecked)
+	}
+
+	// A chain only failing the receive checks isn't recorded as verified,
+	// so resuming checks it again
+	second := FetchOpen(address.PubKeyToAddress(priv.Public().(ed25519.PublicKey)))
+	_, genesisPriv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	notSend := signed(&blocks.ReceiveBlock{PreviousHash: receive.Hash(), SourceHash: second.Hash()}, genesisPriv)
+	conn = getConn()
+	conn.Delete(bad.Hash().ToBytes())
+	uncheckedStoreBlock(conn, notSend)
+	releaseConn(conn)
+	for _, run := range []struct {
+		resume  bool
+		checked int
+	}{{false, 6}, {true, 4}} {
+		errs = Verify(VerifyOptions{Resume: run.resume, Progress: func(p VerifyProgress) { last = p }})
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), "Source is not a stored send") || last.BlocksChecked != run.checked {
+			t.Errorf("Expected the genesis chain's receive rejected, checked %d: %v", last.BlocksChecked, errs)
+		}
+	}
+}
+
+func TestVerifyCheckpoints(t *testing.T) {
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+	priv, receive := createTestChains(t)
+	_, genesisPriv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	genesis := blocks.TestGenesisBlock.Account
+	second := address.PubKeyToAddress(priv.Public().(ed25519.PublicKey))
+	var last VerifyProgress
+	progress := func(p VerifyProgress) { last = p }
+
+	if errs := Verify(VerifyOptions{}); len(errs) != 0 {
+		t.Fatalf("Unexpected verify errors %v", errs)
+	}
+	if c, ok := FetchCheckpoint(genesis); !ok || c.Hash != receive.Hash() || c.Height != 3 || c.Balance != GetBalance(receive) {
+		t.Errorf("Unexpected genesis checkpoint %+v", c)
+	}
+
+	// Only the new block is checked from the checkpoint, and the digest
+	// carried on from it matches a full run's
+	send := signed(&blocks.SendBlock{
+		PreviousHash: receive.Hash(),
+		Destination:  second,
+		Balance:      GetBalance(receive).Sub(uint128.FromInts(0, 1)),
+	}, genesisPriv)
+	if err := StoreBlock(send); err != nil {
+		t.Fatal(err)
+	}
+	if errs := Verify(VerifyOptions{Checkpoints: true, Progress: progress}); len(errs) != 0 || last.BlocksChecked != 1 {
+		t.Errorf("Expected one block checked, checked %d: %v", last.BlocksChecked, errs)
+	}
+	if errs := Verify(VerifyOptions{Progress: progress}); len(errs) != 0 || last.BlocksChecked != 6 {
+		t.Errorf("Expected a clean full run of 6 blocks, checked %d: %v", last.BlocksChecked, errs)
+	}
+
+	// A checkpoint off the chain, as after a rollback, is dropped, and the
+	// chain verified from its open block
+	c, _ := FetchCheckpoint(second)
+	pub, _ := address.AddressToPub(second)
+	StoreMeta(checkpointPrefix, pub, Checkpoint{Hash: send.Hash(), Height: c.Height})
+	if errs := Verify(VerifyOptions{Checkpoints: true, Progress: progress}); len(errs) != 0 || last.BlocksChecked != 2 {
+		t.Errorf("Expected the second chain checked from its open, checked %d: %v", last.BlocksChecked, errs)
+	}
+	if moved, _ := FetchCheckpoint(second); moved != c {
+		t.Errorf("Checkpoint not rewritten: %+v", moved)
+	}
+
+	// A digest that doesn't match is reported by a full run
+	tampered := c
+	tampered.Digest[0] ^= 1
+	StoreMeta(checkpointPrefix, pub, tampered)
+	if errs := Verify(VerifyOptions{}); len(errs) != 1 || !strings.Contains(errs[0].Error(), "Chain changed below its checkpoint") {
+		t.Errorf("Expected a digest mismatch, got %v", errs)
+	}
+	StoreMeta(checkpointPrefix, pub, c)
+
+	// A signature corrupted below the checkpoint is only caught by a full
+	// run
+	corrupted := *receive
+	corrupted.Signature = send.(*blocks.SendBlock).Signature
+	conn := getConn()
+	uncheckedStoreBlock(conn, &corrupted)
+	releaseConn(conn)
+	if errs := Verify(VerifyOptions{Checkpoints: true}); len(errs) != 0 {
+		t.Errorf("Unexpected errors from the checkpoints %v", errs)
+	}
+	if errs := Verify(VerifyOptions{}); len(errs) != 1 || errs[0].Hash != receive.Hash() || errs[0].Err.Error() != "Invalid signature" {
+		t.Errorf("Expected the corrupted signature, got %v", errs)
+	}
+}
+
+func TestTimestampPruning(t *testing.T) {
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+	MaxTimestamps = 10
+	defer func() { MaxTimestamps = 100000 }()
+
+	for i := 0; i < 11; i++ {
+		hash := types.BlockHashFromBytes(blocks.HashBytes([]byte{byte(i)}))
+		StoreTimestamp(hash, Timestamp{Wall: int64(i)})
+	}
+
+	if _, ok := LocalTimestamp(types.BlockHashFromBytes(blocks.HashBytes([]byte{0}))); ok {
+		t.Errorf("Oldest timestamp should have been pruned")
+	}
+	if _, ok := LocalTimestamp(types.BlockHashFromBytes(blocks.HashBytes([]byte{10}))); !ok {
+		t.Errorf("Newest timestamp should be kept")
+	}
+	if timestampCount != 9 {
+		t.Errorf("Expected 9 timestamps after pruning, got %d", timestampCount)
+	}
+}
+
+func TestSanityChecks(t *testing.T) {
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+
+	// The hash covers previous, so a genuine self reference can't be
+	// built; pass the previous in as the block's hash instead
+	block := &blocks.ChangeBlock{Representative: blocks.TestGenesisBlock.Account}
+	block.PreviousHash = block.Hash()
+	if checkSanity(block, block.PreviousHash) != ErrSelfReference {
+		t.Errorf("Self referencing block not rejected")
+	}
+
+	oldMax := MaxUnconnectedBlocks
+	MaxUnconnectedBlocks = 0
+	defer func() { MaxUnconnectedBlocks = oldMax }()
+	orphan := &blocks.ChangeBlock{PreviousHash: block.PreviousHash, Representative: blocks.TestGenesisBlock.Account}
+	orphan.Work = blocks.GenerateWorkForHash(orphan.RootHash())
+	if StoreBlock(orphan) != ErrUnconnectedPoolFull {
+		t.Errorf("Orphan accepted into full pool")
+	}
+
+	before := GetSanityCounters()
+	guard := NewChainGuard(2)
+	account := blocks.TestGenesisBlock.Account
+	a := blocks.TestGenesisBlock.Hash()
+	b := blocks.LiveGenesisBlockHash
+
+	if guard.Check(account, a) != nil || guard.Check(account, b) != nil {
+		t.Errorf("Chain guard rejected valid blocks")
+	}
+	if guard.Check(account, a) != ErrChainCycle {
+		t.Errorf("Chain guard missed a cycle")
+	}
+	if guard.Check(account, LiveConfig.GenesisBlock.RootHash()) != ErrChainTooLong {
+		t.Errorf("Chain guard didn't limit chain length")
+	}
+	guard.Done(account)
+	if guard.Check(account, a) != nil {
+		t.Errorf("Chain guard should reset once an account is done")
+	}
+
+	after := GetSanityCounters()
+	if after.ChainCycle != before.ChainCycle+1 || after.ChainTooLong != before.ChainTooLong+1 {
+		t.Errorf("Sanity counters not updated %+v", after)
+	}
+}
+
+// A receive pulled before its send waits for it
+func TestReceiveBeforeSource(t *testing.T) {
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+	defer func() { blocks.WorkThreshold = protocol.WorkLiveThreshold }()
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	_, genesisPriv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	pub, priv := address.GenerateKey()
+	account := address.PubKeyToAddress(pub)
+
+	send := signed(&blocks.SendBlock{PreviousHash: blocks.TestGenesisBlock.Hash(), Destination: account, Balance: uint128.FromInts(0, 1000)}, genesisPriv)
+	open := signed(&blocks.OpenBlock{SourceHash: send.Hash(), Representative: account, Account: account}, priv)
+	sendBack := signed(&blocks.SendBlock{PreviousHash: open.Hash(), Destination: blocks.TestGenesisBlock.Account, Balance: uint128.FromInts(0, 10)}, priv)
+	receive := signed(&blocks.ReceiveBlock{PreviousHash: send.Hash(), SourceHash: sendBack.Hash()}, genesisPriv)
+
+	StoreBlock(send)
+	if err := StoreBlock(receive); err != ErrMissingSource {
+		t.Fatalf("Expected the receive to wait for its source, got %v", err)
+	}
+	if FetchBlock(receive.Hash()) != nil {
+		t.Errorf("Receive stored without its source")
+	}
+	StoreBlock(open)
+	StoreBlock(sendBack)
+	if FetchBlock(receive.Hash()) == nil {
+		t.Fatalf("Receive not stored once its source was")
+	}
+	if balance := GetBalance(receive); balance != uint128.FromInts(0, 1000).Add(GetBalance(open).Sub(uint128.FromInts(0, 10))) {
+		t.Errorf("Wrong balance after the receive %s", balance.Decimal())
+	}
+	if errs := Verify(VerifyOptions{}); len(errs) != 0 {
+		t.Errorf("Ledger failed verification: %v", errs)
+	}
+}
+
+// Guards against the sanity checks adding cost to the normal path
+func BenchmarkCheckSanity(b *testing.B) {
+	block := blocks.TestGenesisBlock
+	hash := block.Hash()
+	for n := 0; n < b.N; n++ {
+		checkSanity(block, hash)
+	}
+}
+
+func TestReplica(t *testing.T) {
+	Init(TestConfig)
+	replicaPath := TestConfig.Path + "-replica"
+	defer os.RemoveAll(TestConfig.Path)
+	defer os.RemoveAll(replicaPath)
+
+	r := NewReplica(replicaPath, time.Minute)
+	if r.Reader(false) != Primary {
+		t.Errorf("Reads should go to the primary before the first snapshot")
+	}
+
+	err := r.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Reader(false) != Reader(r) || r.Reader(true) != Primary {
+		t.Errorf("Only reads not needing freshness should use the replica")
+	}
+
+	_, receive := createTestChains(t)
+	if r.FetchBlock(receive.Hash()) != nil {
+		t.Errorf("Replica saw a write made after the snapshot")
+	}
+	if r.Reader(true).FetchBlock(receive.Hash()) == nil {
+		t.Errorf("Fresh reads should see the latest writes")
+	}
+
+	r.Refresh()
+	block := r.FetchBlock(receive.Hash())
+	if block == nil || r.GetBalance(block) != GetBalance(block) {
+		t.Errorf("Replica not updated by refresh")
+	}
+	if r.FetchOpen(blocks.TestGenesisBlock.Account) == nil {
+		t.Errorf("Replica missing open block")
+	}
+
+	r.MaxStaleness = 0
+	if r.Reader(false) != Primary {
+		t.Errorf("Stale replica should fail over to the primary")
+	}
+}
+
+// A MemoryBackend reads the same as the store once given the same blocks
+func TestMemoryBackend(t *testing.T) {
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+	defer func() { blocks.WorkThreshold = protocol.WorkLiveThreshold }()
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	_, genesisPriv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	pub, priv := address.GenerateKey()
+	account := address.PubKeyToAddress(pub)
+	genesis := blocks.TestGenesisBlock
+
+	send := signed(&blocks.SendBlock{PreviousHash: genesis.Hash(), Destination: account, Balance: uint128.FromInts(0, 1000)}, genesisPriv)
+	open := signed(&blocks.OpenBlock{SourceHash: send.Hash(), Representative: account, Account: account}, priv)
+	sendBack := signed(&blocks.SendBlock{PreviousHash: open.Hash(), Destination: genesis.Account, Balance: uint128.FromInts(0, 10)}, priv)
+	receive := signed(&blocks.ReceiveBlock{PreviousHash: send.Hash(), SourceHash: sendBack.Hash()}, genesisPriv)
+	change := signed(&blocks.ChangeBlock{PreviousHash: sendBack.Hash(), Representative: genesis.Account}, priv)
+
+	m := NewMemoryBackend(genesis)
+	if err := m.Put(receive); err != ErrMissingParent {
+		t.Errorf("Expected the receive to need its previous, got %v", err)
+	}
+	if err := m.Put(send); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Put(receive); err != ErrMissingSource {
+		t.Errorf("Expected the receive to need its source, got %v", err)
+	}
+	for _, block := range []blocks.Block{open, sendBack, receive, change} {
+		if err := m.Put(block); err != nil {
+			t.Fatalf("Failed to put %s: %s", block.Hash(), err)
+		}
+	}
+	for _, block := range []blocks.Block{send, open, sendBack, receive, change} {
+		if err := StoreBlock(block); err != nil {
+			t.Fatalf("Failed to store %s: %s", block.Hash(), err)
+		}
+	}
+
+	fork := signed(&blocks.ChangeBlock{PreviousHash: open.Hash(), Representative: genesis.Account}, priv)
+	if err := m.Put(fork); err != ErrFork {
+		t.Errorf("Expected a fork, got %v", err)
+	}
+	if err := m.Put(signed(&blocks.OpenBlock{SourceHash: send.Hash(), Representative: genesis.Account, Account: account}, priv)); err != ErrFork {
+		t.Errorf("Expected a second open to fork, got %v", err)
+	}
+
+	for name, backend := range map[string]Backend{"primary": Primary, "memory": m} {
+		for _, block := range []blocks.Block{genesis, send, open, sendBack, receive, change} {
+			fetched := backend.FetchBlock(block.Hash())
+			if fetched == nil || fetched.Hash() != block.Hash() {
+				t.Fatalf("%s: missing block %s", name, block.Hash())
+			}
+			if balance := backend.GetBalance(fetched); balance != GetBalance(block) {
+				t.Errorf("%s: balance %s after %s, expected %s", name, balance.Decimal(), block.Hash(), GetBalance(block).Decimal())
+			}
+		}
+		if fetched := backend.FetchOpen(account); fetched == nil || fetched.Hash() != open.Hash() {
+			t.Errorf("%s: wrong open block %v", name, fetched)
+		}
+		for a, expected := range map[types.Account]types.BlockHash{genesis.Account: receive.Hash(), account: change.Hash()} {
+			if frontier, ok := backend.Frontier(a); !ok || frontier != expected {
+				t.Errorf("%s: frontier %s for %s, expected %s", name, frontier, a, expected)
+			}
+		}
+		if _, ok := backend.Frontier(address.PubKeyToAddress(make([]byte, 32))); ok {
+			t.Errorf("%s: frontier for an account that isn't open", name)
+		}
+		if backend.FetchBlock(fork.Hash()) != nil {
+			t.Errorf("%s: fork stored", name)
+		}
+	}
+}
+
+func TestReadYourWrites(t *testing.T) {
+	Init(TestConfig)
+	replicaPath := TestConfig.Path + "-replica"
+	defer os.RemoveAll(TestConfig.Path)
+	defer os.RemoveAll(replicaPath)
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	_, genesisPriv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+
+	r := NewReplica(replicaPath, time.Hour)
+	r.Refresh()
+	if r.ReaderAt(Version()) != Reader(r) {
+		t.Errorf("Reads the snapshot includes should use the replica")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if WaitForVersion(ctx, Version()+1) != context.DeadlineExceeded {
+		t.Errorf("Waited for a write that wasn't made")
+	}
+
+	done := make(chan bool)
+	var refreshing sync.WaitGroup
+	refreshing.Add(1)
+	go func() {
+		defer refreshing.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				r.Refresh()
+			}
+		}
+	}()
+
+	type write struct {
+		hash    types.BlockHash
+		version uint64
+	}
+	written := make(chan write)
+	var stale int32
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for w := range written {
+				if WaitForVersion(context.Background(), w.version) != nil || r.ReaderAt(w.version).FetchBlock(w.hash) == nil {
+					atomic.AddInt32(&stale, 1)
+				}
+			}
+		}()
+	}
+
+	previous := blocks.TestGenesisBlock.Hash()
+	for i := uint64(1); i <= 8; i++ {
+		send := signed(&blocks.SendBlock{
+			PreviousHash: previous,
+			Destination:  blocks.TestGenesisBlock.Account,
+			Balance:      blocks.GenesisAmount.Sub(uint128.FromInts(0, i)),
+		}, genesisPriv)
+		if err := StoreBlock(send); err != nil {
+			t.Fatal(err)
+		}
+		w := write{send.Hash(), Version()}
+		for j := 0; j < 4; j++ {
+			written <- w
+		}
+		previous = send.Hash()
+	}
+	close(written)
+	wg.Wait()
+	close(done)
+	refreshing.Wait()
+
+	if stale != 0 {
+		t.Errorf("%d stale reads", stale)
+	}
+}
+
+func benchmarkWritesUnderReads(b *testing.B, reader func() Reader) {
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+	defer os.RemoveAll(TestConfig.Path + "-replica")
+
+	done := make(chan bool)
+	for i := 0; i < 8; i++ {
+		go func() {
+			r := reader()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					r.GetBalance(r.FetchBlock(blocks.TestGenesisBlock.Hash()))
+				}
+			}
+		}()
+	}
+	defer close(done)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		StoreMeta("bench", []byte{byte(n)}, n)
+	}
+}
+
+func BenchmarkWritesUnderPrimaryReads(b *testing.B) {
+	benchmarkWritesUnderReads(b, func() Reader { return Primary })
+}
+
+func BenchmarkWritesUnderReplicaReads(b *testing.B) {
+	benchmarkWritesUnderReads(b, func() Reader {
+		r := NewReplica(TestConfig.Path+"-replica", time.Hour)
+		r.Refresh()
+		return r
+	})
+}
+
+// Blocks in the synthetic chain the read benchmarks walk. Raise it to
+// measure a ledger closer to the live one's size.
+var benchChainLength = 2000
+
+// Genesis sending length times to a throwaway account, oldest first.
+func benchChain(length int) []blocks.Block {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	_, priv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	pub, _ := address.GenerateKey()
+	destination := address.PubKeyToAddress(pub)
+	chain := make([]blocks.Block, length)
+	previous := blocks.TestGenesisBlock.Hash()
+	for i := range chain {
+		chain[i] = signed(&blocks.SendBlock{
+			PreviousHash: previous,
+			Destination:  destination,
+			Balance:      blocks.GenesisAmount.Sub(uint128.FromInts(0, uint64(i+1))),
+		}, priv)
+		previous = chain[i].Hash()
+	}
+	return chain
+}
+
+// Stores the synthetic chain, returning it.
+func benchLedger(b *testing.B) []blocks.Block {
+	Init(TestConfig)
+	chain := benchChain(benchChainLength)
+	for _, block := range chain {
+		if err := StoreBlock(block); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	return chain
+}
+
+// Appending to a chain, each block checked and written in its own
+// transaction as blocks arrive while bootstrapping.
+func BenchmarkStoreBlock(b *testing.B) {
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+	defer func() { blocks.WorkThreshold = protocol.WorkLiveThreshold }()
+	chain := benchChain(b.N)
+	b.ResetTimer()
+	for _, block := range chain {
+		if err := StoreBlock(block); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Blocks fetched by hash in no particular order, as votes and pulls ask
+// for them.
+func BenchmarkFetchBlockRandom(b *testing.B) {
+	defer os.RemoveAll(TestConfig.Path)
+	defer func() { blocks.WorkThreshold = protocol.WorkLiveThreshold }()
+	chain := benchLedger(b)
+	for n := 0; n < b.N; n++ {
+		if FetchBlock(chain[(n*7919)%len(chain)].Hash()) == nil {
+			b.Fatal("Missing block")
+		}
+	}
+}
+
+// A walk from the frontier back to the open block, one lookup per block,
+// per op.
+func BenchmarkChainWalkBack(b *testing.B) {
+	defer os.RemoveAll(TestConfig.Path)
+	defer func() { blocks.WorkThreshold = protocol.WorkLiveThreshold }()
+	chain := benchLedger(b)
+	frontier := chain[len(chain)-1].Hash()
+	for n := 0; n < b.N; n++ {
+		if height, ok := ChainHeight(frontier); !ok || height != uint64(len(chain)+1) {
+			b.Fatalf("Unexpected height %d", height)
+		}
+	}
+}
+
+// A walk from the open block up to the frontier through the successor
+// index, two lookups per block, per op.
+func BenchmarkChainWalkForward(b *testing.B) {
+	defer os.RemoveAll(TestConfig.Path)
+	defer func() { blocks.WorkThreshold = protocol.WorkLiveThreshold }()
+	chain := benchLedger(b)
+	for n := 0; n < b.N; n++ {
+		conn := getConn()
+		hash, count := blocks.TestGenesisBlock.Hash(), 0
+		var successor types.BlockHash
+		for fetchMeta(conn, successorPrefix, hash.ToBytes(), &successor) == nil {
+			hash = successor
+			if fetchBlock(conn, hash) == nil {
+				b.Fatal("Missing block")
+			}
+			count++
+		}
+		releaseConn(conn)
+		if count != len(chain) {
+			b.Fatalf("Walked %d blocks", count)
+		}
+	}
+}
+
+func TestAccountModified(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	clock := utils.NewFakeClock(start)
+	Clock = clock
+	defer func() { Clock = utils.SystemClock{} }()
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = protocol.WorkLiveThreshold }()
+	_, genesisPriv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	pub, priv := address.GenerateKey()
+	account := address.PubKeyToAddress(pub)
+
+	genesis := blocks.TestGenesisBlock.Hash()
+	if modified, ok := AccountModified(genesis); !ok || !modified.Equal(start) || !ModifiedSince().Equal(start) {
+		t.Errorf("Genesis should be stamped when the store starts, got %v", modified)
+	}
+
+	clock.Advance(time.Hour)
+	send := signed(&blocks.SendBlock{PreviousHash: genesis, Destination: account, Balance: blocks.GenesisAmount.Sub(uint128.FromInts(0, 1000))}, genesisPriv)
+	if err := StoreBlock(send); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Hour)
+	open := signed(&blocks.OpenBlock{SourceHash: send.Hash(), Representative: account, Account: account}, priv)
+	if err := StoreBlock(open); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := AccountModified(genesis); ok {
+		t.Errorf("Old frontier still has a change recorded")
+	}
+	if modified, _ := AccountModified(send.Hash()); !modified.Equal(start.Add(time.Hour)) {
+		t.Errorf("Expected genesis changed an hour in, got %v", modified)
+	}
+	if modified, _ := AccountModified(open.Hash()); !modified.Equal(start.Add(2 * time.Hour)) {
+		t.Errorf("Expected the account changed two hours in, got %v", modified)
+	}
+
+	// A store from before changes were tracked has every account stamped
+	// when it's opened
+	DeleteMeta(modifiedSinceKey, nil)
+	DeleteMeta(modifiedPrefix, send.Hash().ToBytes())
+	DeleteMeta(modifiedPrefix, open.Hash().ToBytes())
+	clock.Advance(time.Hour)
+	Init(TestConfig)
+	for _, hash := range []types.BlockHash{send.Hash(), open.Hash()} {
+		if modified, ok := AccountModified(hash); !ok || !modified.Equal(start.Add(3*time.Hour)) {
+			t.Errorf("Expected %s stamped by the migration, got %v", hash, modified)
+		}
+	}
+	if !ModifiedSince().Equal(start.Add(3 * time.Hour)) {
+		t.Errorf("Unexpected tracking start %v", ModifiedSince())
+	}
+}
+
+func TestEmptyAccounts(t *testing.T) {
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	_, genesisPriv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	pub, priv := address.GenerateKey()
+	account := address.PubKeyToAddress(pub)
+	amount := func(n uint64) uint128.Uint128 { return blocks.GenesisAmount.Sub(uint128.FromInts(0, n)) }
+
+	send1 := signed(&blocks.SendBlock{PreviousHash: blocks.TestGenesisBlock.Hash(), Destination: account, Balance: amount(1000)}, genesisPriv)
+	send2 := signed(&blocks.SendBlock{PreviousHash: send1.Hash(), Destination: account, Balance: amount(1050)}, genesisPriv)
+	open := signed(&blocks.OpenBlock{SourceHash: send1.Hash(), Representative: account, Account: account}, priv)
+	receive := signed(&blocks.ReceiveBlock{PreviousHash: open.Hash(), SourceHash: send2.Hash()}, priv)
+	change := signed(&blocks.ChangeBlock{PreviousHash: receive.Hash(), Representative: blocks.TestGenesisBlock.Account}, priv)
+	// Send everything back, emptying the account
+	sendBack := signed(&blocks.SendBlock{PreviousHash: change.Hash(), Destination: blocks.TestGenesisBlock.Account, Balance: uint128.FromInts(0, 0)}, priv)
+	genesisReceive := signed(&blocks.ReceiveBlock{PreviousHash: send2.Hash(), SourceHash: sendBack.Hash()}, genesisPriv)
+
+	for _, b := range []blocks.Block{send1, send2, open, receive, change, sendBack} {
+		if err := StoreBlock(b); err != nil {
+			t.Fatalf("Failed to store block: %s", err)
+		}
+	}
+
+	// Genesis has the send back pending, so only the emptied account counts
+	if empty := EmptyAccounts(); len(empty) != 1 || empty[0].Account != account || empty[0].Frontier != sendBack.Hash() {
+		t.Errorf("Expected only the emptied account, got %v", empty)
+	}
+	StoreBlock(genesisReceive)
+
+	if n := PruneEmptyAccounts(); n != 2 {
+		t.Errorf("Expected receive and change to be pruned, pruned %d", n)
+	}
+	if FetchBlock(receive.Hash()) != nil || FetchBlock(change.Hash()) != nil {
+		t.Errorf("Historical blocks not pruned")
+	}
+	if FetchBlock(open.Hash()) == nil || FetchBlock(sendBack.Hash()) == nil {
+		t.Errorf("Open and frontier should be kept")
+	}
+	if GetBalance(genesisReceive) != blocks.GenesisAmount {
+		t.Errorf("Balance through pruned blocks is wrong: %s", GetBalance(genesisReceive))
+	}
+	if len(EmptyAccounts()) != 1 || PruneEmptyAccounts() != 0 {
+		t.Errorf("Pruned account should still be empty with nothing left to prune")
+	}
+
+	// A closed account can still receive
+	send3 := signed(&blocks.SendBlock{PreviousHash: genesisReceive.Hash(), Destination: account, Balance: amount(7)}, genesisPriv)
+	StoreBlock(send3)
+	if len(EmptyAccounts()) != 0 {
+		t.Errorf("Account with a pending receive counted as empty")
+	}
+	reopen := signed(&blocks.ReceiveBlock{PreviousHash: sendBack.Hash(), SourceHash: send3.Hash()}, priv)
+	if err := StoreBlock(reopen); err != nil {
+		t.Fatalf("Failed to receive into closed account: %s", err)
+	}
+	if GetBalance(reopen) != uint128.FromInts(0, 7) {
+		t.Errorf("Wrong balance after receiving into closed account: %s", GetBalance(reopen))
+	}
+	if len(EmptyAccounts()) != 0 {
+		t.Errorf("Account no longer empty")
+	}
+}
+
+func TestConfirmationHeightProcessor(t *testing.T) {
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	_, genesisPriv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	aPub, aPriv := address.GenerateKey()
+	bPub, bPriv := address.GenerateKey()
+	a, b := address.PubKeyToAddress(aPub), address.PubKeyToAddress(bPub)
+	genesis := blocks.TestGenesisBlock
+
+	gs1 := signed(&blocks.SendBlock{PreviousHash: genesis.Hash(), Destination: a, Balance: uint128.FromInts(0, 100)}, genesisPriv)
+	gs2 := signed(&blocks.SendBlock{PreviousHash: gs1.Hash(), Destination: b, Balance: uint128.FromInts(0, 50)}, genesisPriv)
+	aOpen := signed(&blocks.OpenBlock{SourceHash: gs1.Hash(), Representative: a, Account: a}, aPriv)
+	as1 := signed(&blocks.SendBlock{PreviousHash: aOpen.Hash(), Destination: genesis.Account, Balance: uint128.FromInts(0, 90)}, aPriv)
+	bOpen := signed(&blocks.OpenBlock{SourceHash: gs2.Hash(), Representative: b, Account: b}, bPriv)
+	bs1 := signed(&blocks.SendBlock{PreviousHash: bOpen.Hash(), Destination: a, Balance: uint128.FromInts(0, 40)}, bPriv)
+	ar := signed(&blocks.ReceiveBlock{PreviousHash: as1.Hash(), SourceHash: bs1.Hash()}, aPriv)
+	gr := signed(&blocks.ReceiveBlock{PreviousHash: gs2.Hash(), SourceHash: as1.Hash()}, genesisPriv)
+
+	for _, block := range []blocks.Block{gs1, gs2, aOpen, as1, bOpen, bs1, ar, gr} {
+		if err := StoreBlock(block); err != nil {
+			t.Fatalf("Failed to store block: %s", err)
+		}
+	}
+
+	for _, size := range []int{0, -1} {
+		if _, err := NewConfirmationHeightProcessor(size, nil); err != ErrBadBatchSize {
+			t.Errorf("Batch size %d not rejected, got %v", size, err)
+		}
+	}
+
+	var cemented []types.BlockHash
+	p, _ := NewConfirmationHeightProcessor(1, func(e CementEvent) {
+		cemented = append(cemented, e.Hash)
+	})
+
+	// Confirming A's frontier implies its ancestors, the genesis sends
+	// that opened A and B, and B's send that A received
+	p.Add(ar.Hash())
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []blocks.Block{genesis, gs1, aOpen, as1, gs2, bOpen, bs1, ar}
+	if len(cemented) != len(expected) {
+		t.Fatalf("Expected %d blocks cemented, got %d", len(expected), len(cemented))
+	}
+	for i, block := range expected {
+		if cemented[i] != block.Hash() {
+			t.Errorf("Block %d cemented out of order", i)
+		}
+	}
+
+	height := FetchConfirmationHeight(genesis.Account)
+	if height.Height != 3 || height.Frontier != gs2.Hash() || IsCemented(gr.Hash()) {
+		t.Errorf("Wrong genesis confirmation height %+v", height)
+	}
+	if FetchConfirmationHeight(a).Height != 3 || FetchConfirmationHeight(b).Height != 2 {
+		t.Errorf("Wrong confirmation heights")
+	}
+	if counts := Counts(); counts != (LedgerCounts{Blocks: 9, Cemented: 8, Accounts: 3}) {
+		t.Errorf("Wrong ledger counts %+v", counts)
+	}
+
+	defer func() { Clock = utils.SystemClock{} }()
+	clock := utils.NewFakeClock(time.Unix(1600000000, 0))
+	Clock = clock
+	cemented = nil
+	p.Add(ar.Hash())
+	p.Add(gr.Hash())
+	p.Flush()
+	if len(cemented) != 1 || cemented[0] != gr.Hash() || FetchConfirmationHeight(genesis.Account).Height != 4 {
+		t.Errorf("Only the genesis receive should be newly cemented, got %v", cemented)
+	}
+	if c, ok := FetchCemented(gr.Hash()); !ok || c.Account != genesis.Account || c.Height != 4 || !c.Time.Equal(clock.Now()) {
+		t.Errorf("Wrong cementing recorded %+v", c)
+	}
+
+	missing := types.BlockHash(fmt.Sprintf("%064X", 1))
+	p.Add(missing)
+	if p.Flush() != ErrMissingBlock || len(p.pending) != 1 {
+		t.Errorf("Missing block should fail and stay queued")
+	}
+	if _, ok := FetchCemented(missing); ok {
+		t.Errorf("Missing block reported cemented")
+	}
+}
+
+func TestAccountActivity(t *testing.T) {
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	_, genesisPriv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	pub, priv := address.GenerateKey()
+	account := address.PubKeyToAddress(pub)
+	other, _ := address.GenerateKey()
+	amount := func(n uint64) uint128.Uint128 { return blocks.GenesisAmount.Sub(uint128.FromInts(0, n)) }
+
+	send1 := signed(&blocks.SendBlock{PreviousHash: blocks.TestGenesisBlock.Hash(), Destination: account, Balance: amount(1000)}, genesisPriv)
+	send2 := signed(&blocks.SendBlock{PreviousHash: send1.Hash(), Destination: account, Balance: amount(1050)}, genesisPriv)
+	open := signed(&blocks.OpenBlock{SourceHash: send1.Hash(), Representative: account, Account: account}, priv)
+	receive := signed(&blocks.ReceiveBlock{PreviousHash: open.Hash(), SourceHash: send2.Hash()}, priv)
+	sendOther := signed(&blocks.SendBlock{PreviousHash: receive.Hash(), Destination: address.PubKeyToAddress(other), Balance: uint128.FromInts(0, 1030)}, priv)
+	sendBack := signed(&blocks.SendBlock{PreviousHash: sendOther.Hash(), Destination: blocks.TestGenesisBlock.Account, Balance: uint128.FromInts(0, 1000)}, priv)
+
+	for i, b := range []blocks.Block{send1, send2, open, receive, sendOther, sendBack} {
+		if err := StoreBlock(b); err != nil {
+			t.Fatalf("Failed to store block: %s", err)
+		}
+		StoreTimestamp(b.Hash(), Timestamp{Wall: int64(i + 1)})
+	}
+
+	activity, err := GetAccountActivity(account, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := AccountActivity{
+		Account:        account,
+		FirstActive:    Timestamp{Wall: 3},
+		LastActive:     Timestamp{Wall: 6},
+		Blocks:         4,
+		Counterparties: 2,
+		Received:       uint128.FromInts(0, 1050),
+		Sent:           uint128.FromInts(0, 50),
+		Largest:        uint128.FromInts(0, 1000),
+	}
+	if activity != expected {
+		t.Errorf("Unexpected activity\n%+v\n%+v", activity, expected)
+	}
+
+	activity, _ = GetAccountActivity(account, 2)
+	if !activity.Truncated || activity.Blocks != 2 || activity.Sent != uint128.FromInts(0, 0) {
+		t.Errorf("Block cap not applied: %+v", activity)
+	}
+
+	if _, err = GetAccountActivity(address.PubKeyToAddress(other), 100); err != ErrAccountNotFound {
+		t.Errorf("Expected unopened account to be not found, got %v", err)
+	}
+}
+
+func TestAccountStatus(t *testing.T) {
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	_, genesisPriv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	pendingPub, _ := address.GenerateKey()
+	dustPub, _ := address.GenerateKey()
+	unknownPub, _ := address.GenerateKey()
+	pending := address.PubKeyToAddress(pendingPub)
+	dust := address.PubKeyToAddress(dustPub)
+
+	sent := DustThreshold.Add(DustThreshold)
+	send1 := signed(&blocks.SendBlock{PreviousHash: blocks.TestGenesisBlock.Hash(), Destination: pending, Balance: blocks.GenesisAmount.Sub(sent)}, genesisPriv)
+	send2 := signed(&blocks.SendBlock{PreviousHash: send1.Hash(), Destination: dust, Balance: blocks.GenesisAmount.Sub(sent).Sub(uint128.FromInts(0, 1))}, genesisPriv)
+	for _, b := range []blocks.Block{send1, send2} {
+		if err := StoreBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status := GetAccountStatus(blocks.TestGenesisBlock.Account)
+	if status.State != AccountOpened || status.Frontier != send2.Hash() || status.BlockCount != 3 || status.Balance != GetBalance(send2) {
+		t.Errorf("Unexpected genesis status %+v", status)
+	}
+
+	status = GetAccountStatus(pending)
+	if status.State != AccountPendingOnly || status.ReceivableTotal != sent || len(status.Receivable) != 1 || status.Receivable[0].Hash != send1.Hash() {
+		t.Errorf("Unexpected pending only status %+v", status)
+	}
+
+	status = GetAccountStatus(dust)
+	if status.State != AccountUnknown || status.Dust != 1 || len(status.Receivable) != 0 {
+		t.Errorf("Account with only dust pending should be unknown, got %+v", status)
+	}
+
+	if status = GetAccountStatus(address.PubKeyToAddress(unknownPub)); status.State != AccountUnknown || status.Dust != 0 {
+		t.Errorf("Unexpected unknown account status %+v", status)
+	}
+}
+
+func TestPendingPaging(t *testing.T) {
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+	pub, _ := address.GenerateKey()
+	account := address.PubKeyToAddress(pub)
+
+	randomHash := func() types.BlockHash {
+		b := make([]byte, 32)
+		rand.Read(b)
+		return types.BlockHashFromBytes(b)
+	}
+	insert := func(n int) []types.BlockHash {
+		conn := getConn()
+		defer releaseConn(conn)
+		var hashes []types.BlockHash
+		for i := 0; i < n; i++ {
+			hash := randomHash()
+			storeMeta(conn, pendingPrefix, pendingKey(account, hash), uint128.FromInts(0, uint64(i)))
+			hashes = append(hashes, hash)
+		}
+		return hashes
+	}
+
+	original := insert(10000)
+	seen := make(map[types.BlockHash]int)
+	var after types.BlockHash
+	for pages := 0; ; pages++ {
+		page, more, err := PendingPage(account, after, 137)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range page {
+			if r.Hash <= after {
+				t.Fatalf("Page out of order")
+			}
+			seen[r.Hash]++
+			after = r.Hash
+		}
+		if !more {
+			break
+		}
+		// Sends arriving mid-pagination
+		insert(20)
+		if pages > 200 {
+			t.Fatalf("Paging didn't finish")
+		}
+	}
+
+	for _, hash := range original {
+		if seen[hash] != 1 {
+			t.Fatalf("Pending block %s seen %d times", hash, seen[hash])
+		}
+	}
+	for hash, n := range seen {
+		if n != 1 {
+			t.Fatalf("Pending block %s seen %d times", hash, n)
+		}
+	}
+}
+
+func TestPendingIndex(t *testing.T) {
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	_, genesisPriv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	pub, priv := address.GenerateKey()
+	account := address.PubKeyToAddress(pub)
+	amount := func(n uint64) uint128.Uint128 { return blocks.GenesisAmount.Sub(uint128.FromInts(0, n)) }
+
+	send1 := signed(&blocks.SendBlock{PreviousHash: blocks.TestGenesisBlock.Hash(), Destination: account, Balance: amount(1000)}, genesisPriv)
+	send2 := signed(&blocks.SendBlock{PreviousHash: send1.Hash(), Destination: account, Balance: amount(1050)}, genesisPriv)
+	open := signed(&blocks.OpenBlock{SourceHash: send1.Hash(), Representative: account, Account: account}, priv)
+	for _, b := range []blocks.Block{send1, send2, open} {
+		if err := StoreBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(when string) {
+		page, more, err := PendingPage(account, "", 10)
+		if err != nil || more || len(page) != 1 || page[0] != (Receivable{send2.Hash(), uint128.FromInts(0, 50)}) {
+			t.Errorf("Unexpected pending %s: %+v %t %v", when, page, more, err)
+		}
+	}
+	check("after storing")
+
+	// Stores from before the index get it built on startup
+	conn := getConn()
+	deleteMeta(conn, pendingIndexedKey, nil)
+	deleteMeta(conn, pendingPrefix, pendingKey(account, send2.Hash()))
+	releaseConn(conn)
+	Init(TestConfig)
+	check("after rebuilding")
+
+	if _, _, err := PendingPage(account, "nonsense", 10); err != ErrBadCursor {
+		t.Errorf("Accepted a bad cursor")
+	}
+}
+
+func TestReceivableTotal(t *testing.T) {
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	_, genesisPriv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	pub, priv := address.GenerateKey()
+	account := address.PubKeyToAddress(pub)
+	dust := uint128.FromInts(0, 1)
+	balance := blocks.GenesisAmount
+
+	// Two sends over the dust threshold and one under
+	var sends []*blocks.SendBlock
+	previous := blocks.TestGenesisBlock.Hash()
+	for _, amount := range []uint128.Uint128{DustThreshold, dust, DustThreshold.Add(DustThreshold)} {
+		balance = balance.Sub(amount)
+		send := signed(&blocks.SendBlock{PreviousHash: previous, Destination: account, Balance: balance}, genesisPriv).(*blocks.SendBlock)
+		if err := StoreBlock(send); err != nil {
+			t.Fatal(err)
+		}
+		sends = append(sends, send)
+		previous = send.Hash()
+	}
+	triple := DustThreshold.Add(DustThreshold).Add(DustThreshold)
+	if total := ReceivableTotal(account); total != triple {
+		t.Errorf("Receivable total %s, expected %s", total.Decimal(), triple.Decimal())
+	}
+	if status := GetAccountStatus(account); status.ReceivableTotal != triple || status.Dust != 1 {
+		t.Errorf("Unexpected account status %+v", status)
+	}
+
+	// Storing a send again doesn't count it twice
+	StoreBlock(sends[0])
+	open := signed(&blocks.OpenBlock{SourceHash: sends[2].Hash(), Representative: account, Account: account}, priv)
+	if err := StoreBlock(open); err != nil {
+		t.Fatal(err)
+	}
+	if total := ReceivableTotal(account); total != DustThreshold {
+		t.Errorf("Receivable total %s after receiving", total.Decimal())
+	}
+	if errs := Verify(VerifyOptions{}); len(errs) != 0 {
+		t.Errorf("Verify failed: %v", errs)
+	}
+
+	// A wrong total is caught, and stores without totals are backfilled
+	conn := getConn()
+	storeMeta(conn, receivableTotalPrefix, pub, dust)
+	releaseConn(conn)
+	if errs := Verify(VerifyOptions{}); len(errs) != 1 || !strings.Contains(errs[0].Error(), "Receivable total of "+string(account)) {
+		t.Errorf("Verify missed a wrong total: %v", errs)
+	}
+	conn = getConn()
+	deleteMeta(conn, receivableIndexedKey, nil)
+	releaseConn(conn)
+	Init(TestConfig)
+	if total := ReceivableTotal(account); total != DustThreshold {
+		t.Errorf("Receivable total %s after backfill", total.Decimal())
+	}
+}
+
+func TestAccountHistory(t *testing.T) {
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	_, genesisPriv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	pub, priv := address.GenerateKey()
+	account := address.PubKeyToAddress(pub)
+	amount := func(n uint64) uint128.Uint128 { return blocks.GenesisAmount.Sub(uint128.FromInts(0, n)) }
+
+	send1 := signed(&blocks.SendBlock{PreviousHash: blocks.TestGenesisBlock.Hash(), Destination: account, Balance: amount(1000)}, genesisPriv)
+	send2 := signed(&blocks.SendBlock{PreviousHash: send1.Hash(), Destination: account, Balance: amount(1050)}, genesisPriv)
+	open := signed(&blocks.OpenBlock{SourceHash: send1.Hash(), Representative: account, Account: account}, priv)
+	receive := signed(&blocks.ReceiveBlock{PreviousHash: open.Hash(), SourceHash: send2.Hash()}, priv)
+	change := signed(&blocks.ChangeBlock{PreviousHash: receive.Hash(), Representative: blocks.TestGenesisBlock.Account}, priv)
+	sendBack := signed(&blocks.SendBlock{PreviousHash: change.Hash(), Destination: blocks.TestGenesisBlock.Account, Balance: uint128.FromInts(0, 1000)}, priv)
+	for _, b := range []blocks.Block{send1, send2, open, receive, change, sendBack} {
+		if err := StoreBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []HistoryEntry{
+		{sendBack.Hash(), blocks.Send, blocks.TestGenesisBlock.Account, uint128.FromInts(0, 50)},
+		{change.Hash(), blocks.Change, blocks.TestGenesisBlock.Account, uint128.Uint128{}},
+		{receive.Hash(), blocks.Receive, blocks.TestGenesisBlock.Account, uint128.FromInts(0, 50)},
+		{open.Hash(), blocks.Open, blocks.TestGenesisBlock.Account, uint128.FromInts(0, 1000)},
+	}
+	var history []HistoryEntry
+	var before types.BlockHash
+	for {
+		page, more, err := AccountHistory(account, before, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		history = append(history, page...)
+		if !more {
+			break
+		}
+		before = page[len(page)-1].Hash
+	}
+	if fmt.Sprint(history) != fmt.Sprint(expected) {
+		t.Errorf("Unexpected history\n%v\n%v", history, expected)
+	}
+
+	weights := RepresentativeWeights()
+	expectedWeights := []RepresentativeWeight{
+		{blocks.TestGenesisBlock.Representative, amount(1050).Add(uint128.FromInts(0, 1000))},
+	}
+	if fmt.Sprint(weights) != fmt.Sprint(expectedWeights) {
+		t.Errorf("Unexpected weights %v", weights)
+	}
+
+	if a, balance, ok := BlockAccount(sendBack); !ok || a != account || balance != uint128.FromInts(0, 1050) {
+		t.Errorf("Unexpected account %s and balance %s before the send back", a, balance.Decimal())
+	}
+
+	// Older stores have their weights counted and accounts indexed at Init
+	conn := getConn()
+	deleteMeta(conn, repWeightIndexedKey, nil)
+	adjustWeight(conn, account, uint128.FromInts(0, 1), false)
+	deleteMeta(conn, blockAccountIndexedKey, nil)
+	deleteMeta(conn, blockAccountPrefix, change.Hash().ToBytes())
+	releaseConn(conn)
+	Init(TestConfig)
+	if weights := RepresentativeWeights(); fmt.Sprint(weights) != fmt.Sprint(expectedWeights) {
+		t.Errorf("Unexpected weights after backfill %v", weights)
+	}
+	var indexed types.Account
+	conn = getConn()
+	fetchMeta(conn, blockAccountPrefix, change.Hash().ToBytes(), &indexed)
+	releaseConn(conn)
+	if indexed != account {
+		t.Errorf("Change block's account not indexed at Init, got %q", indexed)
+	}
+}
+
+func TestConfirmationReplay(t *testing.T) {
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	_, genesisPriv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	genesis := blocks.TestGenesisBlock
+
+	chain := []blocks.Block{genesis}
+	for i := 1; i <= 5; i++ {
+		send := signed(&blocks.SendBlock{
+			PreviousHash: chain[i-1].Hash(),
+			Destination:  genesis.Account,
+			Balance:      blocks.GenesisAmount.Sub(uint128.FromInts(0, uint64(i))),
+		}, genesisPriv)
+		if err := StoreBlock(send); err != nil {
+			t.Fatal(err)
+		}
+		chain = append(chain, send)
+	}
+
+	feed := NewConfirmationFeed()
+	p, _ := NewConfirmationHeightProcessor(1, feed.Publish)
+	p.Add(chain[2].Hash())
+	p.Flush()
+
+	var received []CementEvent
+	first := true
+	_, err := feed.SubscribeFrom(genesis.Account, 2, func(e CementEvent) {
+		received = append(received, e)
+		if !first {
+			return
+		}
+		first = false
+		// Cemented before the replay read the store but published late
+		feed.Publish(CementEvent{genesis.Account, chain[2].Hash(), 3})
+		// Cemented during the replay
+		p.Add(chain[4].Hash())
+		p.Flush()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Add(chain[5].Hash())
+	p.Flush()
+
+	if len(received) != 5 {
+		t.Fatalf("Expected heights 2 to 6 once each, got %v", received)
+	}
+	for i, e := range received {
+		if e.Height != uint64(i+2) || e.Hash != chain[i+1].Hash() || e.Account != genesis.Account {
+			t.Errorf("Unexpected event %d: %+v", i, e)
+		}
+	}
+
+	var replayed []uint64
+	ConfirmedSince(genesis.Account, 4, func(e CementEvent) error {
+		replayed = append(replayed, e.Height)
+		return nil
+	})
+	if fmt.Sprint(replayed) != "[5 6]" {
+		t.Errorf("Unexpected replay since height 4: %v", replayed)
+	}
+}
+
+// The behaviour every KV backend must share.
+func testKV(t *testing.T, open func(path string) (KV, error)) {
+	path := TestConfig.Path + "-kv"
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+
+	kv, err := open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = kv.Get([]byte("missing")); err != ErrKeyNotFound {
+		t.Errorf("Expected missing key to be not found, got %v", err)
+	}
+	for _, key := range []string{"b:2", "a:1", "b:1", "b:3", "c:1"} {
+		if err = kv.Set([]byte(key), []byte("old "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kv.Set([]byte("b:1"), []byte("new"))
+	kv.Delete([]byte("b:3"))
+	kv.Delete([]byte("never set"))
+
+	check := func(when string) {
+		var listed []string
+		kv.Iterate([]byte("b:"), func(key []byte, value []byte) error {
+			listed = append(listed, string(key)+"="+string(value))
+			return nil
+		})
+		if strings.Join(listed, ",") != "b:1=new,b:2=old b:2" {
+			t.Errorf("Unexpected items %s: %v", when, listed)
+		}
+		if _, err := kv.Get([]byte("b:3")); err != ErrKeyNotFound {
+			t.Errorf("Deleted key found %s", when)
+		}
+	}
+	check("before reopening")
+
+	kv.Close()
+	kv, err = open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	check("after reopening")
+
+	stop := errors.New("stop")
+	n := 0
+	err = kv.Iterate(nil, func(key []byte, value []byte) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("Iteration not stopped by error")
+	}
+}
+
+func TestBadgerKV(t *testing.T) {
+	testKV(t, func(path string) (KV, error) { return OpenBadgerKV(path) })
+}
+
+func TestLogKV(t *testing.T) {
+	for _, sync := range []SyncPolicy{SyncAlways, SyncInterval, SyncNever} {
+		opts := DefaultLogKVOptions
+		opts.Sync = sync
+		testKV(t, func(path string) (KV, error) {
+			os.MkdirAll(path, 0700)
+			return OpenLogKV(filepath.Join(path, "log"), opts)
+		})
+	}
+}
+
+func TestLogKVLimits(t *testing.T) {
+	path := TestConfig.Path + "-log"
+	defer os.Remove(path)
+	os.Remove(path)
+	kv, err := OpenLogKV(path, LogKVOptions{SyncNever, 0, 3, 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		kv.Set([]byte(key), []byte(key))
+	}
+	if kv.Set([]byte("d"), nil) != ErrKVFull {
+		t.Errorf("Wrote past the item limit")
+	}
+	if kv.Set([]byte("a"), []byte("a2")) != nil {
+		t.Errorf("Failed to overwrite at the item limit")
+	}
+
+	for i := 0; i < 20; i++ {
+		kv.Set([]byte("a"), []byte(fmt.Sprint(i)))
+	}
+	if kv.records > 3+10 {
+		t.Errorf("Log not compacted, %d records", kv.records)
+	}
+	info, _ := os.Stat(path)
+	if info.Size() != kv.size {
+		t.Errorf("Log is %d bytes, expected %d", info.Size(), kv.size)
+	}
+	kv.Close()
+	kv, _ = OpenLogKV(path, DefaultLogKVOptions)
+	if value, _ := kv.Get([]byte("a")); string(value) != "19" {
+		t.Errorf("Lost writes over compaction, got %s", value)
+	}
+}
+
+// Every prefix of the log, as a crash could leave it, opens with exactly
+// the writes that were completely in it.
+func TestLogKVRecovery(t *testing.T) {
+	path := TestConfig.Path + "-log"
+	defer os.Remove(path)
+	os.Remove(path)
+	opts := DefaultLogKVOptions
+	opts.Sync = SyncAlways
+	kv, err := OpenLogKV(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// State and log size after each write
+	states := []string{""}
+	sizes := []int64{0}
+	state := func(kv KV) string {
+		var items []string
+		kv.Iterate(nil, func(key []byte, value []byte) error {
+			items = append(items, string(key)+"="+string(value))
+			return nil
+		})
+		return strings.Join(items, ",")
+	}
+	for i := 0; i < 12; i++ {
+		key := []byte{'a' + byte(i%4)}
+		if i%5 == 4 {
+			kv.Delete(key)
+		} else {
+			kv.Set(key, bytes.Repeat([]byte{'x'}, i))
+		}
+		states = append(states, state(kv))
+		sizes = append(sizes, kv.size)
+	}
+	kv.Close()
+
+	data, _ := ioutil.ReadFile(path)
+	crashed := path + "-crashed"
+	defer os.Remove(crashed)
+	for offset := 0; offset <= len(data); offset++ {
+		ioutil.WriteFile(crashed, data[:offset], 0600)
+		kv, err := OpenLogKV(crashed, opts)
+		if err != nil {
+			t.Fatalf("Failed to open log cut at %d: %s", offset, err)
+		}
+		expected := 0
+		for expected+1 < len(sizes) && sizes[expected+1] <= int64(offset) {
+			expected++
+		}
+		if state(kv) != states[expected] {
+			t.Fatalf("Log cut at %d has %q, expected %q", offset, state(kv), states[expected])
+		}
+
+		// Writes after recovery aren't lost behind the torn record
+		kv.Set([]byte("z"), []byte("z"))
+		kv.Close()
+		kv, _ = OpenLogKV(crashed, opts)
+		if value, _ := kv.Get([]byte("z")); string(value) != "z" {
+			t.Fatalf("Lost a write after recovering from a cut at %d", offset)
+		}
+		kv.Close()
+	}
+}
+
+var testEncryptionKey = HexKey(strings.Repeat("4b", 32))
+
+func TestEncryptedKV(t *testing.T) {
+	testKV(t, func(path string) (KV, error) {
+		os.MkdirAll(path, 0700)
+		log, err := OpenLogKV(filepath.Join(path, "log"), DefaultLogKVOptions)
+		if err != nil {
+			return nil, err
+		}
+		return OpenEncryptedKV(log, testEncryptionKey)
+	})
+
+	path := TestConfig.Path + "-log"
+	defer os.Remove(path)
+	os.Remove(path)
+	log, _ := OpenLogKV(path, DefaultLogKVOptions)
+	defer log.Close()
+	kv, err := OpenEncryptedKV(log, testEncryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.Set([]byte("a"), []byte("secret"))
+	kv.Set([]byte("b"), []byte("secret"))
+	a, _ := log.Get([]byte("a"))
+	b, _ := log.Get([]byte("b"))
+	if bytes.Contains(a, []byte("secret")) || bytes.Equal(a, b) {
+		t.Errorf("Value not encrypted with a fresh nonce: %x", a)
+	}
+
+	log.Set([]byte("c"), a)
+	if _, err = kv.Get([]byte("c")); err != ErrDecrypt {
+		t.Errorf("Value moved to another key decrypted, %v", err)
+	}
+	log.Set([]byte("d"), []byte("plain"))
+	if value, _ := kv.Get([]byte("d")); string(value) != "plain" {
+		t.Errorf("Plaintext not passed through, got %q", value)
+	}
+
+	other, _ := OpenEncryptedKV(log, HexKey(strings.Repeat("4c", 32)))
+	if _, err = other.Get([]byte("a")); err != ErrDecrypt {
+		t.Errorf("Decrypted with the wrong key, %v", err)
+	}
+	if _, err = OpenEncryptedKV(log, HexKey("4b")); err != ErrBadEncryptionKey {
+		t.Errorf("Opened with a short key, %v", err)
+	}
+}
+
+// Every point a crash could cut the migration at leaves every value
+// readable, and migrating again encrypts the rest.
+func TestEncryptedKVMigration(t *testing.T) {
+	path := TestConfig.Path + "-log"
+	defer os.Remove(path)
+	os.Remove(path)
+	opts := DefaultLogKVOptions
+	opts.Sync = SyncAlways
+	log, err := OpenLogKV(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ""
+	for i := 0; i < 5; i++ {
+		log.Set([]byte{'a' + byte(i)}, bytes.Repeat([]byte{'x'}, i+1))
+		expected += fmt.Sprintf("%c=%s,", 'a'+i, strings.Repeat("x", i+1))
+	}
+	plainSize := log.size
+
+	kv, _ := OpenEncryptedKV(log, testEncryptionKey)
+	if n, err := kv.Migrate(nil); n != 5 || err != nil {
+		t.Fatalf("Migrated %d values, %v", n, err)
+	}
+	kv.Close()
+
+	state := func(kv KV) string {
+		s := ""
+		err := kv.Iterate(nil, func(key []byte, value []byte) error {
+			s += string(key) + "=" + string(value) + ","
+			return nil
+		})
+		if err != nil {
+			return err.Error()
+		}
+		return s
+	}
+
+	data, _ := ioutil.ReadFile(path)
+	crashed := path + "-crashed"
+	defer os.Remove(crashed)
+	for offset := int(plainSize); offset <= len(data); offset++ {
+		ioutil.WriteFile(crashed, data[:offset], 0600)
+		log, err := OpenLogKV(crashed, opts)
+		if err != nil {
+			t.Fatalf("Failed to open log cut at %d: %s", offset, err)
+		}
+		kv, _ := OpenEncryptedKV(log, testEncryptionKey)
+		if s := state(kv); s != expected {
+			t.Fatalf("Migration cut at %d reads %q", offset, s)
+		}
+		kv.Migrate(nil)
+		log.Iterate(nil, func(key []byte, value []byte) error {
+			if !encrypted(value) {
+				t.Fatalf("Value %s still plaintext after resuming a migration cut at %d", key, offset)
+			}
+			return nil
+		})
+		if s := state(kv); s != expected {
+			t.Fatalf("Resumed migration cut at %d reads %q", offset, s)
+		}
+		kv.Close()
+	}
+
+	done := make(chan bool)
+	close(done)
+	log, _ = OpenLogKV(path, opts)
+	defer log.Close()
+	log.Set([]byte("f"), []byte("plain"))
+	kv, _ = OpenEncryptedKV(log, testEncryptionKey)
+	if n, _ := kv.Migrate(done); n != 0 {
+		t.Errorf("Migration didn't stop when done")
+	}
+}
+
+func benchmarkKVSet(b *testing.B, wrap func(KV) KV) {
+	path := TestConfig.Path + "-log"
+	defer os.Remove(path)
+	os.Remove(path)
+	opts := DefaultLogKVOptions
+	opts.Sync = SyncNever
+	log, _ := OpenLogKV(path, opts)
+	kv := wrap(log)
+	defer kv.Close()
+	value := bytes.Repeat([]byte{'x'}, 200)
+
+	b.SetBytes(int64(len(value)))
+	for n := 0; n < b.N; n++ {
+		kv.Set([]byte{byte(n), byte(n >> 8)}, value)
+	}
+}
+
+func benchmarkKVGet(b *testing.B, wrap func(KV) KV) {
+	path := TestConfig.Path + "-log"
+	defer os.Remove(path)
+	os.Remove(path)
+	log, _ := OpenLogKV(path, DefaultLogKVOptions)
+	kv := wrap(log)
+	defer kv.Close()
+	value := bytes.Repeat([]byte{'x'}, 200)
+	for i := 0; i < 256; i++ {
+		kv.Set([]byte{byte(i)}, value)
+	}
+
+	b.SetBytes(int64(len(value)))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		kv.Get([]byte{byte(n)})
+	}
+}
+
+func plainKV(kv KV) KV { return kv }
+
+func encryptedKV(kv KV) KV {
+	e, _ := OpenEncryptedKV(kv, testEncryptionKey)
+	return e
+}
+
+func BenchmarkKVSet(b *testing.B)          { benchmarkKVSet(b, plainKV) }
+func BenchmarkEncryptedKVSet(b *testing.B) { benchmarkKVSet(b, encryptedKV) }
+func BenchmarkKVGet(b *testing.B)          { benchmarkKVGet(b, plainKV) }
+func BenchmarkEncryptedKVGet(b *testing.B) { benchmarkKVGet(b, encryptedKV) }
+
+func TestAccountVersion(t *testing.T) {
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	_, genesisPriv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	pub, priv := address.GenerateKey()
+	account := address.PubKeyToAddress(pub)
+	amount := func(n uint64) uint128.Uint128 { return blocks.GenesisAmount.Sub(uint128.FromInts(0, n)) }
+
+	// Work good enough for the first version but not the second
+	oldWork := func(b blocks.Block, priv ed25519.PrivateKey) blocks.Block {
+		low := blocks.RequiredDifficulty(blocks.Epoch1)
+		high := blocks.RequiredDifficulty(blocks.Epoch2)
+		for i := uint64(0); ; i++ {
+			work := types.Work(fmt.Sprintf("%016x", i))
+			value := blocks.RootWorkValue(b.RootHash(), work)
+			if value >= low && value < high {
+				switch block := b.(type) {
+				case *blocks.SendBlock:
+					block.Work = work
+					block.Signature = block.Hash().Sign(priv)
+				case *blocks.OpenBlock:
+					block.Work = work
+					block.Signature = block.Hash().Sign(priv)
+				}
+				return b
+			}
+		}
+	}
+	current := func(b *blocks.SendBlock) *blocks.SendBlock {
+		b.Work = blocks.GenerateWorkThreshold(b.RootHash(), blocks.RequiredDifficulty(blocks.CurrentVersion))
+		b.Signature = b.Hash().Sign(genesisPriv)
+		return b
+	}
+
+	send1 := oldWork(&blocks.SendBlock{PreviousHash: blocks.TestGenesisBlock.Hash(), Destination: account, Balance: amount(1000)}, genesisPriv)
+	if err := StoreBlock(send1); err != nil {
+		t.Fatalf("Failed to store a first version block: %s", err)
+	}
+
+	if err := UpgradeAccount(blocks.TestGenesisBlock.Account, blocks.Epoch2); err != nil {
+		t.Fatalf("Failed to upgrade: %s", err)
+	}
+	if UpgradeAccount(blocks.TestGenesisBlock.Account, blocks.Epoch1) != ErrVersionDowngrade {
+		t.Errorf("Downgraded an account")
+	}
+	if UpgradeAccount(account, blocks.Epoch2) == nil {
+		t.Errorf("Upgraded an account that isn't open")
+	}
+
+	send2 := &blocks.SendBlock{PreviousHash: send1.Hash(), Destination: account, Balance: amount(1050)}
+	if StoreBlock(oldWork(send2, genesisPriv)) == nil {
+		t.Errorf("Stored a block after the upgrade with old work")
+	}
+	if err := StoreBlock(current(send2)); err != nil {
+		t.Fatalf("Failed to store a block with current work: %s", err)
+	}
+	// The version follows the chain
+	send3 := &blocks.SendBlock{PreviousHash: send2.Hash(), Destination: account, Balance: amount(1100)}
+	if StoreBlock(oldWork(send3, genesisPriv)) == nil {
+		t.Errorf("Stored a later block with old work")
+	}
+	if err := StoreBlock(current(send3)); err != nil {
+		t.Fatalf("Failed to store a later block with current work: %s", err)
+	}
+
+	// Other accounts aren't affected
+	open := oldWork(&blocks.OpenBlock{SourceHash: send1.Hash(), Representative: account, Account: account}, priv)
+	if err := StoreBlock(open); err != nil {
+		t.Errorf("Failed to store an open with old work: %s", err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+	_, receive := createTestChains(t)
+	signerPub, signer := address.GenerateKey()
+	otherPub, _ := address.GenerateKey()
+
+	var signedSnapshot, unsigned bytes.Buffer
+	if err := ExportSnapshot(&signedSnapshot, signer); err != nil {
+		t.Fatal(err)
+	}
+	ExportSnapshot(&unsigned, nil)
+
+	fresh := func() {
+		os.RemoveAll(TestConfig.Path)
+		Init(TestConfig)
+	}
+	trusted := []ed25519.PublicKey{signerPub}
+
+	fresh()
+	// One byte changed in the last block
+	tampered := append([]byte{}, signedSnapshot.Bytes()...)
+	tampered[len(tampered)-3] ^= 1
+	if _, err := ImportSnapshot(bytes.NewReader(tampered), trusted); err != ErrSnapshotContent {
+		t.Errorf("Tampered snapshot imported: %v", err)
+	}
+	if _, err := ImportSnapshot(bytes.NewReader(signedSnapshot.Bytes()), []ed25519.PublicKey{otherPub}); err != ErrUntrustedSigner {
+		t.Errorf("Snapshot from the wrong signer imported: %v", err)
+	}
+	if _, err := ImportSnapshot(bytes.NewReader(unsigned.Bytes()), trusted); err != ErrUnsignedSnapshot {
+		t.Errorf("Unsigned snapshot imported: %v", err)
+	}
+	if FetchBlock(receive.Hash()) != nil || len(SnapshotProvenances()) != 0 {
+		t.Fatalf("Blocks stored from a rejected snapshot")
+	}
+
+	manifest, err := ImportSnapshot(bytes.NewReader(signedSnapshot.Bytes()), trusted)
+	if err != nil {
+		t.Fatalf("Failed to import: %s", err)
+	}
+	if manifest.Blocks != 5 || FetchBlock(receive.Hash()) == nil {
+		t.Errorf("Snapshot not imported, manifest %+v", manifest)
+	}
+	provenance := SnapshotProvenances()
+	if len(provenance) != 1 || provenance[0].Creator != address.PubKeyToAddress(signerPub) || provenance[0].ContentHash != manifest.ContentHash {
+		t.Errorf("Bad provenance %+v", provenance)
+	}
+
+	fresh()
+	if _, err := ImportSnapshotWith(bytes.NewReader(unsigned.Bytes()), SnapshotOptions{Insecure: true, Source: "test"}); err != nil {
+		t.Errorf("Insecure import of an unsigned snapshot failed: %s", err)
+	}
+	if p := SnapshotProvenances(); len(p) != 1 || p[0].Source != "test" || FetchBlock(receive.Hash()) == nil {
+		t.Errorf("Bad insecure import %+v", p)
+	}
+}
+
+func TestColdPending(t *testing.T) {
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	_, genesisPriv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	pub, priv := address.GenerateKey()
+	account := address.PubKeyToAddress(pub)
+	sent := func(n uint64) uint128.Uint128 { return blocks.GenesisAmount.Sub(uint128.FromInts(0, n)) }
+
+	old := signed(&blocks.SendBlock{PreviousHash: blocks.TestGenesisBlock.Hash(), Destination: account, Balance: sent(5)}, genesisPriv)
+	unstamped := signed(&blocks.SendBlock{PreviousHash: old.Hash(), Destination: account, Balance: sent(12)}, genesisPriv)
+	large := signed(&blocks.SendBlock{PreviousHash: unstamped.Hash(), Destination: account, Balance: sent(1012)}, genesisPriv)
+	for _, b := range []blocks.Block{old, unstamped, large} {
+		if err := StoreBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	yearsAgo := Timestamp{Wall: now.Add(-2 * 365 * 24 * time.Hour).UnixNano()}
+	StoreTimestamp(old.Hash(), yearsAgo)
+	StoreTimestamp(large.Hash(), yearsAgo)
+
+	policy := ColdPendingPolicy{uint128.FromInts(0, 100), 365 * 24 * time.Hour, 1}
+	sweep := func(at time.Time) int {
+		total := 0
+		for i := 0; i < 10; i++ {
+			moved, done := SweepColdPending(policy, at)
+			total += moved
+			if done {
+				return total
+			}
+		}
+		t.Fatalf("Sweep never finished")
+		return 0
+	}
+	list := func(page func(types.Account, types.BlockHash, int) ([]Receivable, bool, error)) map[types.BlockHash]bool {
+		entries, _, _ := page(account, "", 10)
+		result := make(map[types.BlockHash]bool)
+		for _, r := range entries {
+			result[r.Hash] = true
+		}
+		return result
+	}
+
+	// Only the old dust moves, the unstamped send's age starts now
+	if moved := sweep(now); moved != 1 {
+		t.Errorf("Moved %d entries", moved)
+	}
+	if hot, cold := list(PendingPage), list(ColdPendingPage); len(hot) != 2 || !hot[unstamped.Hash()] || len(cold) != 1 || !cold[old.Hash()] {
+		t.Errorf("Bad buckets, hot %v cold %v", hot, cold)
+	}
+	if moved := sweep(now.Add(2 * 365 * 24 * time.Hour)); moved != 1 || len(list(ColdPendingPage)) != 2 {
+		t.Errorf("Unstamped dust not moved once old, moved %d", moved)
+	}
+
+	// Still part of the account, and receivable as normal
+	if status := GetAccountStatus(account); status.Dust != 3 {
+		t.Errorf("Cold entries missing from the account status %+v", status)
+	}
+	open := signed(&blocks.OpenBlock{SourceHash: old.Hash(), Representative: account, Account: account}, priv)
+	receive := signed(&blocks.ReceiveBlock{PreviousHash: open.Hash(), SourceHash: unstamped.Hash()}, priv)
+	for _, b := range []blocks.Block{open, receive} {
+		if err := StoreBlock(b); err != nil {
+			t.Fatalf("Failed to receive a cold entry: %s", err)
+		}
+	}
+	if balance := GetBalance(receive); balance != uint128.FromInts(0, 12) {
+		t.Errorf("Wrong balance after receiving cold entries %s", balance.Decimal())
+	}
+	if cold := list(ColdPendingPage); len(cold) != 0 {
+		t.Errorf("Received entries left in the cold bucket %v", cold)
+	}
+	if hot := list(PendingPage); len(hot) != 1 || !hot[large.Hash()] {
+		t.Errorf("Bad pending after receiving %v", hot)
+	}
+}
+
+func TestForkProof(t *testing.T) {
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func(max int) { MaxForkProofs = max }(MaxForkProofs)
+	_, genesisPriv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	_, otherPriv := address.GenerateKey()
+	events := make(chan ForkProof, 10)
+	OnForkProof = func(p ForkProof) { events <- p }
+	defer func() { OnForkProof = nil }()
+
+	send := func(previous types.BlockHash, balance uint64, priv ed25519.PrivateKey) blocks.Block {
+		return signed(&blocks.SendBlock{
+			PreviousHash: previous,
+			Destination:  blocks.TestGenesisBlock.Account,
+			Balance:      uint128.FromInts(0, balance),
+		}, priv)
+	}
+	root := blocks.TestGenesisBlock.Hash()
+	kept := send(root, 1000, genesisPriv)
+	if err := StoreBlock(kept); err != nil {
+		t.Fatal(err)
+	}
+	if err := StoreBlock(kept); err != nil {
+		t.Errorf("Storing a block again isn't a fork: %s", err)
+	}
+	if err := StoreBlock(send(root, 999, genesisPriv)); err != ErrFork {
+		t.Errorf("Expected fork, got %v", err)
+	}
+	if err := StoreBlock(send(root, 998, otherPriv)); err == nil || err == ErrFork {
+		t.Errorf("Block signed by another key should be rejected, got %v", err)
+	}
+	if FetchBlock(send(root, 999, genesisPriv).Hash()) != nil {
+		t.Errorf("Losing block stored in the ledger")
+	}
+
+	proof, ok := FetchForkProof(root)
+	if !ok || len(proof.Blocks) != 2 || proof.Account != blocks.TestGenesisBlock.Account || proof.Root != root {
+		t.Fatalf("Bad fork proof %+v", proof)
+	}
+	if proof.Blocks[0].ToBlock().Hash() != kept.Hash() {
+		t.Errorf("Kept block should come first")
+	}
+	if err := proof.Verify(); err != nil {
+		t.Errorf("Proof didn't verify: %s", err)
+	}
+	select {
+	case p := <-events:
+		if p.Root != root {
+			t.Errorf("Event for the wrong root %s", p.Root)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("No event for the new proof")
+	}
+
+	tampered := proof
+	tampered.Blocks = append([]blocks.RawBlock{}, proof.Blocks...)
+	tampered.Blocks[1].Signature = tampered.Blocks[0].Signature
+	if tampered.Verify() == nil {
+		t.Errorf("Proof with a bad signature verified")
+	}
+	tampered.Blocks[1] = blocks.ToRaw(send(kept.Hash(), 10, genesisPriv))
+	if tampered.Verify() == nil {
+		t.Errorf("Proof across roots verified")
+	}
+	tampered.Blocks = tampered.Blocks[:1]
+	if tampered.Verify() == nil {
+		t.Errorf("Proof of one block verified")
+	}
+
+	// A second fork pushes the first proof out
+	MaxForkProofs = 1
+	StoreBlock(send(kept.Hash(), 10, genesisPriv))
+	if err := StoreBlock(send(kept.Hash(), 9, genesisPriv)); err != ErrFork {
+		t.Errorf("Expected fork, got %v", err)
+	}
+	if _, ok := FetchForkProof(root); ok {
+		t.Errorf("Oldest proof should have been pruned")
+	}
+	if _, ok := FetchForkProof(kept.Hash()); !ok {
+		t.Errorf("Newest proof missing")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	_, genesisPriv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	keys := make(map[string]ed25519.PrivateKey)
+	accounts := make(map[string]types.Account)
+	for _, name := range []string{"x", "y", "z"} {
+		pub, priv := address.GenerateKey()
+		keys[name], accounts[name] = priv, address.PubKeyToAddress(pub)
+	}
+	send := func(previous types.BlockHash, to string, balance uint64) blocks.Block {
+		return signed(&blocks.SendBlock{PreviousHash: previous, Destination: accounts[to], Balance: uint128.FromInts(0, balance)}, genesisPriv)
+	}
+	open := func(source blocks.Block, name string) blocks.Block {
+		return signed(&blocks.OpenBlock{SourceHash: source.Hash(), Representative: accounts[name], Account: accounts[name]}, keys[name])
+	}
+
+	sendX := send(blocks.TestGenesisBlock.Hash(), "x", 1000)
+	openX := open(sendX, "x")
+	sendY := send(sendX.Hash(), "y", 900)
+	openY := open(sendY, "y")
+	sendZ := send(sendX.Hash(), "z", 800)
+	openZ := open(sendZ, "z")
+
+	build := func(path string, chain ...blocks.Block) {
+		Init(Config{path, blocks.TestGenesisBlock})
+		for _, block := range chain {
+			if err := StoreBlock(block); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	pathA, pathB := TestConfig.Path+"_A", TestConfig.Path+"_B"
+	defer os.RemoveAll(pathA)
+	defer os.RemoveAll(pathB)
+	build(pathA, sendX, openX, sendY, openY)
+	build(pathB, sendX, openX, sendZ, openZ)
+	p, _ := NewConfirmationHeightProcessor(DefaultCementBatchSize, nil)
+	p.Add(openX.Hash())
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	genesis := blocks.TestGenesisBlock.Account
+	expected := map[types.Account][]Difference{
+		genesis: {
+			{DiffFrontier, genesis, string(sendY.Hash()), string(sendZ.Hash()), 0},
+			{DiffBalance, genesis, "900", "800", 0},
+			{DiffConfirmationHeight, genesis, "0", "2", 0},
+			{DiffChain, genesis, string(sendY.Hash()), string(sendZ.Hash()), 3},
+		},
+		accounts["x"]: {{DiffConfirmationHeight, accounts["x"], "0", "1", 0}},
+		accounts["y"]: {{DiffOnlyInA, accounts["y"], string(openY.Hash()), "", 0}},
+		accounts["z"]: {{DiffOnlyInB, accounts["z"], "", string(openZ.Hash()), 0}},
+	}
+
+	for _, opts := range []DiffOptions{{Chains: true}, {}} {
+		var got []Difference
+		// B is the open store, A is opened for the diff
+		err := Diff(pathA, pathB, opts, func(d Difference) error {
+			got = append(got, d)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var want []Difference
+		order := []types.Account{genesis, accounts["x"], accounts["y"], accounts["z"]}
+		sort.Slice(order, func(i, j int) bool {
+			a, _ := address.AddressToPub(order[i])
+			b, _ := address.AddressToPub(order[j])
+			return bytes.Compare(a, b) < 0
+		})
+		for _, account := range order {
+			for _, d := range expected[account] {
+				if d.Kind != DiffChain || opts.Chains {
+					want = append(want, d)
+				}
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("Wrong differences with %+v\ngot      %v\nexpected %v", opts, got, want)
+		}
+	}
+
+	stop := errors.New("Stop")
+	calls := 0
+	err := Diff(pathA, pathB, DiffOptions{}, func(d Difference) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("Diff should stop on the callback's error")
+	}
+	if err = Diff(pathB, pathB, DiffOptions{Chains: true}, func(d Difference) error {
+		t.Errorf("Store differs from itself: %+v", d)
+		return nil
+	}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFrontiers(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	os.RemoveAll(TestConfig.Path)
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+	_, genesisPriv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	send := signed(&blocks.SendBlock{PreviousHash: blocks.TestGenesisBlock.Hash(), Destination: blocks.TestGenesisBlock.Account, Balance: uint128.FromInts(0, 1)}, genesisPriv)
+	if err := StoreBlock(send); err != nil {
+		t.Fatal(err)
+	}
+
+	// Opens aren't checked, so the fixture needn't be a valid ledger
+	const accounts = 100000
+	expected := map[types.Account]types.BlockHash{blocks.TestGenesisBlock.Account: send.Hash()}
+	conn := getConn()
+	for len(expected) <= accounts {
+		pub := make([]byte, 32)
+		rand.Read(pub)
+		open := &blocks.OpenBlock{SourceHash: types.BlockHash(fmt.Sprintf("%X", pub)), Account: address.PubKeyToAddress(pub)}
+		uncheckedStoreBlock(conn, open)
+		expected[open.Account] = open.Hash()
+	}
+	releaseConn(conn)
+
+	var start types.Account
+	var last []byte
+	seen := 0
+	for pages := 0; ; pages++ {
+		page, next, err := Frontiers(start, 4999)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next != "" && len(page) != 4999 {
+			t.Fatalf("Short page %d of %d before the end", pages, len(page))
+		}
+		for _, f := range page {
+			pub, _ := address.AddressToPub(f.Account)
+			if last != nil && bytes.Compare(pub, last) <= 0 {
+				t.Fatalf("%s out of order", f.Account)
+			}
+			last = pub
+			if expected[f.Account] != f.Hash {
+				t.Fatalf("Wrong frontier for %s: %s, expected %s", f.Account, f.Hash, expected[f.Account])
+			}
+			seen++
+		}
+		if next == "" {
+			break
+		}
+		start = next
+	}
+	if seen != len(expected) {
+		t.Errorf("Expected %d frontiers, got %d", len(expected), seen)
+	}
+
+	if _, _, err := Frontiers("nano_bad", 1); err != ErrBadCursor {
+		t.Errorf("Expected a bad cursor, got %v", err)
+	}
+}
+
+func TestBlockLog(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	clock := utils.NewFakeClock(time.Now())
+	Clock = clock
+	defer func() { Clock = utils.SystemClock{} }()
+	_, genesisPriv := address.KeypairFromPrivateKey(blocks.TestPrivateKey)
+	dir, _ := ioutil.TempDir("", "blocklog")
+	defer os.RemoveAll(dir)
+	live, restored := TestConfig.Path+"_live", TestConfig.Path+"_restored"
+	defer os.RemoveAll(live)
+	defer os.RemoveAll(restored)
+
+	Init(Config{live, blocks.TestGenesisBlock})
+	opts := BlockLogOptions{MaxFileSize: 2000, Buffer: 100}
+	l, err := OpenBlockLog(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetBlockLog(l)
+	var chain []blocks.Block
+	previous := blocks.TestGenesisBlock.Hash()
+	for i := 0; i < 10; i++ {
+		send := signed(&blocks.SendBlock{PreviousHash: previous, Destination: blocks.TestGenesisBlock.Account, Balance: uint128.FromInts(0, uint64(100-i))}, genesisPriv)
+		chain, previous = append(chain, send), send.Hash()
+	}
+
+	// A backup partway, then more blocks a minute apart
+	var backup bytes.Buffer
+	var cutoff time.Time
+	for i, block := range chain {
+		if i == 4 {
+			if err := ExportSnapshot(&backup, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if i >= 4 {
+			clock.Advance(time.Minute)
+		}
+		if i == 6 {
+			cutoff = clock.Now()
+		}
+		if err := StoreBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	SetBlockLog(nil)
+	l.Close()
+	if stats := l.Stats(); stats.Written != 10 || stats.Dropped != 0 || stats.Files < 2 {
+		t.Fatalf("Unexpected block log stats %+v", stats)
+	}
+
+	// A crash mid-append leaves a torn record, cut off on reopening
+	files, _ := blockLogFiles(dir)
+	last := files[len(files)-1]
+	data, _ := ioutil.ReadFile(last)
+	ioutil.WriteFile(last, append(data, data[:20]...), 0600)
+	l, err = OpenBlockLog(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if stats := l.Stats(); stats.Truncated != 20 {
+		t.Errorf("Torn record not cut off: %+v", stats)
+	}
+	if data, _ := ioutil.ReadFile(last); readBlockRecords(data, func(time.Time, []byte) bool { return true }) != len(data) {
+		t.Errorf("Block log left torn")
+	}
+
+	// Restore the backup and roll it forward, to the cutoff then the end
+	Init(Config{restored, blocks.TestGenesisBlock})
+	if _, err := ImportSnapshotWith(bytes.NewReader(backup.Bytes()), SnapshotOptions{Insecure: true}); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := ReplayLog(dir, cutoff)
+	if err != nil || stats != (ReplayStats{Stored: 3, Old: 4}) || FetchBlock(chain[7].Hash()) != nil {
+		t.Fatalf("Unexpected replay to the cutoff %+v, %v", stats, err)
+	}
+	stats, err = ReplayLog(dir, time.Time{})
+	if err != nil || stats != (ReplayStats{Stored: 3, Old: 7}) {
+		t.Fatalf("Unexpected replay %+v, %v", stats, err)
+	}
+
+	err = Diff(live, restored, DiffOptions{Chains: true}, func(d Difference) error {
+		t.Errorf("Restored store differs: %+v", d)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVoteHistory(t *testing.T) {
+	Init(TestConfig)
+	defer os.RemoveAll(TestConfig.Path)
+	defer func(max int) { MaxVotesPerRoot = max }(MaxVotesPerRoot)
+	MaxVotesPerRoot = 3
+
+	rep := blocks.TestGenesisBlock.Account
+	otherPub, _ := address.GenerateKey()
+	other := address.PubKeyToAddress(otherPub)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rootA, rootB := blocks.TestGenesisBlock.Hash(), blocks.LiveGenesisBlock.Hash()
+	vote := func(root types.BlockHash, rep types.Account, at time.Time) {
+		if err := StoreVote(VoteRecord{Root: root, Hash: root, Representative: rep, Timestamp: uint64(at.Unix()), Received: at}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Five votes on A in the first hour, one each from both reps on B in
+	// the second
+	for i := 0; i < 5; i++ {
+		vote(rootA, rep, start.Add(time.Duration(i)*10*time.Minute))
+	}
+	vote(rootB, rep, start.Add(time.Hour))
+	vote(rootB, other, start.Add(time.Hour+time.Minute))
+
+	votes, hours, err := VoteHistory(rep, start, start.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the latest three on A are kept, but the hour counts all five
+	if len(votes) != 4 || !votes[0].Received.Equal(start.Add(20*time.Minute)) || votes[3].Root != rootB {
+		t.Errorf("Unexpected votes %+v", votes)
+	}
+	if len(hours) != 2 || hours[0].Votes != 5 || !hours[0].Hour.Equal(start) || hours[1].Votes != 1 || hours[1].Representative != rep {
+		t.Errorf("Unexpected hours %+v", hours)
+	}
+	if votes, hours, _ := VoteHistory("", start, start.Add(2*time.Hour)); len(votes) != 5 || len(hours) != 3 {
+		t.Errorf("Expected every rep's votes, got %d and %d hours", len(votes), len(hours))
+	}
+	// From is inclusive, to exclusive
+	if votes, hours, _ := VoteHistory(rep, start.Add(30*time.Minute), start.Add(time.Hour)); len(votes) != 2 || len(hours) != 1 {
+		t.Errorf("Wrong range boundaries, %d votes and %d hours", len(votes), len(hours))
+	}
+
+	compact := func(retention time.Duration, now time.Time) int {
+		total := 0
+		for {
+			dropped, done := CompactVotes(retention, now)
+			total += dropped
+			if done {
+				return total
+			}
+		}
+	}
+	// A vote exactly at the cutoff is kept
+	if dropped := compact(time.Hour, start.Add(90*time.Minute)); dropped != 1 {
+		t.Errorf("Dropped %d votes, expected 1", dropped)
+	}
+	if votes, _, _ := VoteHistory(rep, start, start.Add(2*time.Hour)); len(votes) != 3 || !votes[0].Received.Equal(start.Add(30*time.Minute)) {
+		t.Errorf("Unexpected votes after compaction %+v", votes)
+	}
+	if dropped := compact(time.Hour, start.Add(10*time.Hour)); dropped != 4 {
+		t.Errorf("Dropped %d votes, expected 4", dropped)
+	}
+	votes, hours, _ = VoteHistory("", start, start.Add(2*time.Hour))
+	if len(votes) != 0 || len(hours) != 3 || hours[0].Votes != 5 {
+		t.Errorf("Hourly counts should outlive the votes, got %+v and %+v", votes, hours)
+	}
+}
@@ -0,0 +1,112 @@
+package store
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/types"
+)
+
+const timestampPrefix = "timestamp"
+
+// Oldest timestamps are pruned once there are more than this many
+var MaxTimestamps = 100000
+
+// Timestamp of when we first observed a block.
+type Timestamp struct {
+	// Unix nanoseconds
+	Wall int64
+	// Identifies the process run Mono is relative to
+	Session int64
+	// Monotonic nanoseconds since the session started
+	Mono int64
+}
+
+func (t Timestamp) Time() time.Time {
+	return time.Unix(0, t.Wall)
+}
+
+// Time between two timestamps. Uses the monotonic offsets when both
+// were taken by the same process so clock steps don't affect it.
+func (t Timestamp) Sub(o Timestamp) time.Duration {
+	if t.Session == o.Session {
+		return time.Duration(t.Mono - o.Mono)
+	}
+	return time.Duration(t.Wall - o.Wall)
+}
+
+// -1 until counted
+var timestampCount = -1
+
+func LocalTimestamp(hash types.BlockHash) (Timestamp, bool) {
+	var ts Timestamp
+	if hash.Validate() != nil {
+		return ts, false
+	}
+	err := FetchMeta(timestampPrefix, hash.ToBytes(), &ts)
+	return ts, err == nil
+}
+
+// Records when we first saw a block, returning the earlier timestamp
+// if there is one.
+func StoreTimestamp(hash types.BlockHash, ts Timestamp) Timestamp {
+	conn := getConn()
+	defer releaseConn(conn)
+
+	var existing Timestamp
+	if fetchMeta(conn, timestampPrefix, hash.ToBytes(), &existing) == nil {
+		return existing
+	}
+
+	if timestampCount < 0 {
+		timestampCount = 0
+		iterateMeta(conn, timestampPrefix, func(key []byte, value []byte) error {
+			timestampCount++
+			return nil
+		})
+	}
+
+	if storeMeta(conn, timestampPrefix, hash.ToBytes(), ts) == nil {
+		timestampCount++
+	}
+	if timestampCount > MaxTimestamps {
+		pruneTimestamps(conn)
+	}
+
+	return ts
+}
+
+// Drops the oldest tenth of the timestamps, so pruning isn't needed
+// on every insert.
+func pruneTimestamps(conn *badger.Txn) {
+	type entry struct {
+		key  []byte
+		wall int64
+	}
+	var entries []entry
+
+	iterateMeta(conn, timestampPrefix, func(key []byte, value []byte) error {
+		var ts Timestamp
+		err := gob.NewDecoder(bytes.NewBuffer(value)).Decode(&ts)
+		if err == nil {
+			entries = append(entries, entry{append([]byte{}, key...), ts.Wall})
+		}
+		return nil
+	})
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].wall < entries[j].wall
+	})
+
+	remove := len(entries) - MaxTimestamps + MaxTimestamps/10
+	for i := 0; i < remove && i < len(entries); i++ {
+		deleteMeta(conn, timestampPrefix, entries[i].key)
+	}
+	timestampCount = len(entries) - remove
+	if timestampCount < 0 {
+		timestampCount = 0
+	}
+}
@@ -0,0 +1,410 @@
+package store
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/utils"
+)
+
+const verifiedPrefix = "verified"
+const verifyPairsPrefix = "verifypairs"
+const defaultPairLimit = 100000
+
+type VerifyOptions struct {
+	// Number of accounts verified concurrently, defaults to 1
+	Workers int
+	// Called from the workers after each account is finished
+	Progress func(VerifyProgress)
+	// Skip accounts whose frontier was already verified by an earlier,
+	// possibly interrupted, run
+	Resume bool
+	// Number of pending receives kept in memory for the second pass
+	// before they're spilled to the store
+	PairLimit int
+	// Start each chain after its checkpoint instead of its open block.
+	// Nothing below a checkpoint is checked again, including receives for
+	// double receives, so run without it now and then too: a full run
+	// also checks each checkpoint's digest.
+	Checkpoints bool
+}
+
+type VerifyProgress struct {
+	AccountsDone  int
+	AccountsTotal int
+	BlocksChecked int
+	ETA           time.Duration
+}
+
+type VerifyError struct {
+	Hash types.BlockHash
+	Err  error
+}
+
+func (e VerifyError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Hash, e.Err)
+}
+
+// A receive (or open) waiting to be matched against its source send
+type receivePair struct {
+	Account types.Account
+	Receive types.BlockHash
+}
+
+type pairSet struct {
+	sync.Mutex
+	limit   int
+	pairs   map[types.BlockHash]receivePair
+	spilled bool
+}
+
+func (p *pairSet) add(source types.BlockHash, pair receivePair) error {
+	p.Lock()
+	defer p.Unlock()
+
+	source = types.BlockHashFromBytes(source.ToBytes())
+	if _, ok := p.pairs[source]; ok {
+		return errors.New("Source already received")
+	}
+	if p.spilled {
+		var existing receivePair
+		if FetchMeta(verifyPairsPrefix, source.ToBytes(), &existing) == nil {
+			return errors.New("Source already received")
+		}
+	}
+
+	p.pairs[source] = pair
+	if len(p.pairs) >= p.limit {
+		return p.spill()
+	}
+	return nil
+}
+
+func (p *pairSet) spill() error {
+	conn := getConn()
+	defer releaseConn(conn)
+
+	for source, pair := range p.pairs {
+		err := storeMeta(conn, verifyPairsPrefix, source.ToBytes(), pair)
+		if err != nil {
+			return err
+		}
+	}
+
+	p.pairs = make(map[types.BlockHash]receivePair)
+	p.spilled = true
+	return nil
+}
+
+// Loads the spilled pairs back in batches, removing them from the store.
+func (p *pairSet) each(fn func(types.BlockHash, receivePair)) error {
+	for source, pair := range p.pairs {
+		fn(source, pair)
+	}
+
+	for p.spilled {
+		batch := make(map[types.BlockHash]receivePair)
+		conn := getConn()
+		err := iterateMeta(conn, verifyPairsPrefix, func(key []byte, value []byte) error {
+			var pair receivePair
+			err := gob.NewDecoder(bytes.NewBuffer(value)).Decode(&pair)
+			if err != nil {
+				return err
+			}
+			batch[types.BlockHashFromBytes(key)] = pair
+			if len(batch) >= p.limit {
+				return errBatchFull
+			}
+			return nil
+		})
+		for source := range batch {
+			deleteMeta(conn, verifyPairsPrefix, source.ToBytes())
+		}
+		releaseConn(conn)
+
+		if err != nil && err != errBatchFull {
+			return err
+		}
+		p.spilled = err == errBatchFull
+
+		for source, pair := range batch {
+			fn(source, pair)
+		}
+	}
+
+	return nil
+}
+
+var errBatchFull = errors.New("Batch full")
+
+// Drops pairs an interrupted run left spilled, in batches.
+func (p *pairSet) clear() error {
+	for {
+		var stale [][]byte
+		conn := getConn()
+		err := iterateMeta(conn, verifyPairsPrefix, func(key []byte, value []byte) error {
+			stale = append(stale, append([]byte{}, key...))
+			if len(stale) >= p.limit {
+				return errBatchFull
+			}
+			return nil
+		})
+		for _, key := range stale {
+			deleteMeta(conn, verifyPairsPrefix, key)
+		}
+		releaseConn(conn)
+		if err != errBatchFull {
+			return err
+		}
+	}
+}
+
+// Walks every block once to find open blocks and each block's successor,
+// which the store doesn't otherwise index.
+func loadChains() ([]*blocks.OpenBlock, map[types.BlockHash]types.BlockHash, []VerifyError) {
+	conn := getConn()
+	defer releaseConn(conn)
+
+	var opens []*blocks.OpenBlock
+	var errs []VerifyError
+	successors := make(map[types.BlockHash]types.BlockHash)
+
+	it := conn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if len(item.Key()) != 32 || item.UserMeta() == MetaData {
+			continue
+		}
+
+		block := (&BlockItem{*item}).ToBlock()
+		hash := block.Hash()
+		if !bytes.Equal(item.Key(), hash.ToBytes()) {
+			// The copy of an open block keyed on its account
+			continue
+		}
+
+		if block.Type() == blocks.Open {
+			opens = append(opens, block.(*blocks.OpenBlock))
+			continue
+		}
+
+		previous := types.BlockHashFromBytes(block.PreviousBlockHash().ToBytes())
+		if existing, ok := successors[previous]; ok {
+			errs = append(errs, VerifyError{hash, fmt.Errorf("Fork with %s", existing)})
+			continue
+		}
+		successors[previous] = hash
+	}
+
+	return opens, successors, errs
+}
+
+func frontier(open *blocks.OpenBlock, successors map[types.BlockHash]types.BlockHash) types.BlockHash {
+	hash := open.Hash()
+	for {
+		next, ok := successors[hash]
+		if !ok {
+			return hash
+		}
+		hash = next
+	}
+}
+
+// Checks work, signatures and links of one account chain, collecting
+// receives for the second pass. It starts after from if it's set,
+// otherwise at the open block, and returns the checkpoint at the chain's
+// head. If check is set, the chain's digest at its height must match.
+func verifyChain(open *blocks.OpenBlock, successors map[types.BlockHash]types.BlockHash, pairs *pairSet, from *Checkpoint, check *Checkpoint) (int, Checkpoint, []VerifyError) {
+	var errs []VerifyError
+	pub, err := address.AddressToPub(open.Account)
+	if err != nil {
+		return 0, Checkpoint{}, []VerifyError{{open.Hash(), err}}
+	}
+
+	checked := 0
+	genesis := Conf.GenesisBlock.Hash()
+	var block blocks.Block = open
+	var checkpoint Checkpoint
+	if from != nil {
+		checkpoint = *from
+		next, ok := successors[from.Hash]
+		if !ok {
+			return 0, checkpoint, nil
+		}
+		if block = FetchBlock(next); block == nil {
+			return 0, checkpoint, []VerifyError{{next, errors.New("Missing block")}}
+		}
+	}
+
+	for block != nil {
+		hash := block.Hash()
+		checked++
+		checkpoint = checkpoint.next(hash, checkpoint.balanceAfter(block))
+		if check != nil && checkpoint.Height == check.Height && checkpoint.Digest != check.Digest {
+			errs = append(errs, VerifyError{hash, errors.New("Chain changed below its checkpoint")})
+		}
+
+		if !blocks.ValidateBlockWork(block) {
+			errs = append(errs, VerifyError{hash, errors.New("Invalid work")})
+		}
+		if !blocks.VerifyBlockSignature(block, pub) {
+			errs = append(errs, VerifyError{hash, errors.New("Invalid signature")})
+		}
+
+		var source types.BlockHash
+		switch b := block.(type) {
+		case *blocks.OpenBlock:
+			if hash != genesis {
+				source = b.SourceHash
+			}
+		case *blocks.ReceiveBlock:
+			source = b.SourceHash
+		}
+		if source != "" {
+			err := pairs.add(source, receivePair{open.Account, hash})
+			if err != nil {
+				errs = append(errs, VerifyError{hash, err})
+			}
+		}
+
+		next, ok := successors[hash]
+		if !ok {
+			break
+		}
+		block = FetchBlock(next)
+		if block == nil {
+			errs = append(errs, VerifyError{next, errors.New("Missing block")})
+		}
+	}
+
+	return checked, checkpoint, errs
+}
+
+// Verify checks every account chain in parallel, then checks each receive
+// against its source send in a second pass, and the receivable totals
+// against a recount. Returns every problem found.
+//
+// With Resume set, accounts whose frontier was verified by an earlier run
+// are skipped, so their receives aren't checked for double receives.
+//
+// Every chain that verifies cleanly, receives included, is recorded as
+// verified for Resume and gets a checkpoint at its head. Checkpoints no
+// longer on their chain, as after a rollback past them, are dropped.
+func Verify(opts VerifyOptions) []VerifyError {
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	if opts.PairLimit < 1 {
+		opts.PairLimit = defaultPairLimit
+	}
+
+	opens, successors, errs := loadChains()
+	pairs := &pairSet{limit: opts.PairLimit, pairs: make(map[types.BlockHash]receivePair)}
+	if err := pairs.clear(); err != nil {
+		return append(errs, VerifyError{"", err})
+	}
+	// Chains that pass the first pass, recorded once their receives pass
+	// the second
+	type cleanChain struct {
+		pub        []byte
+		head       types.BlockHash
+		checkpoint Checkpoint
+	}
+	clean := make(map[types.Account]cleanChain)
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	progress := VerifyProgress{AccountsTotal: len(opens)}
+	progressGuard := utils.NewGuard("verify progress", utils.DefaultMaxPanics)
+	start := time.Now()
+	work := make(chan *blocks.OpenBlock)
+
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for open := range work {
+				pub, _ := address.AddressToPub(open.Account)
+				head := frontier(open, successors)
+
+				var from, check *Checkpoint
+				var stored Checkpoint
+				if FetchMeta(checkpointPrefix, pub, &stored) == nil {
+					switch {
+					case !onChain(open, successors, stored):
+						DeleteMeta(checkpointPrefix, pub)
+					case opts.Checkpoints:
+						from = &stored
+					default:
+						check = &stored
+					}
+				}
+
+				var checked int
+				var chainErrs []VerifyError
+				var verified types.BlockHash
+				if !opts.Resume || FetchMeta(verifiedPrefix, pub, &verified) != nil || verified != head {
+					var checkpoint Checkpoint
+					checked, checkpoint, chainErrs = verifyChain(open, successors, pairs, from, check)
+					if len(chainErrs) == 0 {
+						lock.Lock()
+						clean[open.Account] = cleanChain{pub, head, checkpoint}
+						lock.Unlock()
+					}
+				}
+
+				lock.Lock()
+				errs = append(errs, chainErrs...)
+				progress.AccountsDone++
+				progress.BlocksChecked += checked
+				elapsed := time.Since(start)
+				progress.ETA = elapsed / time.Duration(progress.AccountsDone) * time.Duration(progress.AccountsTotal-progress.AccountsDone)
+				if opts.Progress != nil {
+					progressGuard.Call(func() { opts.Progress(progress) })
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+
+	for _, open := range opens {
+		work <- open
+	}
+	close(work)
+	wg.Wait()
+
+	err := pairs.each(func(source types.BlockHash, pair receivePair) {
+		send, ok := FetchBlock(source).(*blocks.SendBlock)
+		if !ok {
+			errs = append(errs, VerifyError{pair.Receive, errors.New("Source is not a stored send")})
+			delete(clean, pair.Account)
+			return
+		}
+
+		destination, _ := address.AddressToPub(send.Destination)
+		account, _ := address.AddressToPub(pair.Account)
+		if !bytes.Equal(destination, account) {
+			errs = append(errs, VerifyError{pair.Receive, errors.New("Source send is for another account")})
+			delete(clean, pair.Account)
+		}
+	})
+	if err != nil {
+		return append(errs, VerifyError{"", err})
+	}
+	for _, chain := range clean {
+		StoreMeta(verifiedPrefix, chain.pub, chain.head)
+		StoreMeta(checkpointPrefix, chain.pub, chain.checkpoint)
+	}
+
+	return append(errs, verifyReceivableTotals()...)
+}
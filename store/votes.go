@@ -0,0 +1,202 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/types"
+)
+
+// Each root's latest votes, keyed by the root
+const votesPrefix = "votes"
+
+// Votes counted per hour and representative, keyed by the hour's unix
+// seconds then the representative's public key
+const voteHoursPrefix = "votehours"
+
+// Votes kept per root, the latest first
+var MaxVotesPerRoot = 16
+
+// Per root votes older than this are dropped by CompactVotes, leaving
+// only the hourly counts
+const DefaultVoteRetention = 30 * 24 * time.Hour
+
+// Roots looked at per CompactVotes transaction
+const voteCompactBatch = 1000
+
+// A VoteRecord is a vote as we received it.
+type VoteRecord struct {
+	Root           types.BlockHash
+	Hash           types.BlockHash
+	Representative types.Account
+	// Unix milliseconds for timestamped votes, zero for those with a
+	// Sequence
+	Timestamp uint64
+	Sequence  uint64
+	Received  time.Time
+}
+
+// VoteHour counts a representative's votes in the hour starting at Hour.
+type VoteHour struct {
+	Hour           time.Time
+	Representative types.Account
+	Votes          uint64
+}
+
+// Where CompactVotes picks up, as a key in the votes index
+var voteCompactCursor []byte
+
+func voteHourKey(hour time.Time, rep []byte) []byte {
+	key := make([]byte, 8, 8+len(rep))
+	binary.BigEndian.PutUint64(key, uint64(hour.Unix()))
+	return append(key, rep...)
+}
+
+// StoreVote records a vote, keeping only its root's latest
+// MaxVotesPerRoot and counting it in its hour.
+func StoreVote(v VoteRecord) error {
+	rep, err := address.AddressToPub(v.Representative)
+	if err != nil {
+		return err
+	}
+	conn := getConn()
+	defer releaseConn(conn)
+
+	var votes []VoteRecord
+	fetchMeta(conn, votesPrefix, v.Root.ToBytes(), &votes)
+	votes = append([]VoteRecord{v}, votes...)
+	if len(votes) > MaxVotesPerRoot {
+		votes = votes[:MaxVotesPerRoot]
+	}
+	if err = storeMeta(conn, votesPrefix, v.Root.ToBytes(), votes); err != nil {
+		return err
+	}
+
+	key := voteHourKey(v.Received.Truncate(time.Hour), rep)
+	var count uint64
+	fetchMeta(conn, voteHoursPrefix, key, &count)
+	return storeMeta(conn, voteHoursPrefix, key, count+1)
+}
+
+// VoteHistory is the votes kept that were received from from up to to,
+// oldest first, and the hourly counts over the same range. They're only
+// rep's if it's set.
+func VoteHistory(rep types.Account, from time.Time, to time.Time) (votes []VoteRecord, hours []VoteHour, err error) {
+	conn := getConn()
+	defer releaseConn(conn)
+
+	err = iterateMeta(conn, votesPrefix, func(key []byte, value []byte) error {
+		var records []VoteRecord
+		if err := gob.NewDecoder(bytes.NewBuffer(value)).Decode(&records); err != nil {
+			return err
+		}
+		for _, v := range records {
+			if (rep == "" || v.Representative == rep) && !v.Received.Before(from) && v.Received.Before(to) {
+				votes = append(votes, v)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.SliceStable(votes, func(i, j int) bool { return votes[i].Received.Before(votes[j].Received) })
+
+	// Keys start with the hour, so the range is one seek
+	prefix := metaKey(voteHoursPrefix, nil)
+	it := conn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Seek(append(prefix, voteHourKey(from.Truncate(time.Hour), nil)...)); it.ValidForPrefix(prefix); it.Next() {
+		key := it.Item().Key()[len(prefix):]
+		if len(key) != 8+32 {
+			continue
+		}
+		hour := time.Unix(int64(binary.BigEndian.Uint64(key)), 0)
+		if !hour.Before(to) {
+			break
+		}
+		account := address.PubKeyToAddress(key[8:])
+		if rep != "" && account != rep {
+			continue
+		}
+		value, err := it.Item().Value()
+		if err != nil {
+			return nil, nil, err
+		}
+		var count uint64
+		if err = gob.NewDecoder(bytes.NewBuffer(value)).Decode(&count); err != nil {
+			return nil, nil, err
+		}
+		hours = append(hours, VoteHour{hour, account, count})
+	}
+	return votes, hours, nil
+}
+
+// CompactVotes looks at the next batch of roots, dropping the votes on
+// them received more than retention before now. Hourly counts are kept.
+// done is set once it has been through every root, and the next
+// compaction starts over.
+func CompactVotes(retention time.Duration, now time.Time) (dropped int, done bool) {
+	conn := getConn()
+	defer releaseConn(conn)
+
+	prefix := metaKey(votesPrefix, nil)
+	start := prefix
+	if voteCompactCursor != nil {
+		start = voteCompactCursor
+	}
+	type entry struct {
+		key   []byte
+		value []byte
+	}
+	var batch []entry
+	it := conn.NewIterator(badger.DefaultIteratorOptions)
+	for it.Seek(start); it.ValidForPrefix(prefix) && len(batch) < voteCompactBatch; it.Next() {
+		key := it.Item().Key()
+		if bytes.Equal(key, voteCompactCursor) {
+			continue
+		}
+		value, err := it.Item().Value()
+		if err != nil {
+			continue
+		}
+		batch = append(batch, entry{append([]byte{}, key...), append([]byte{}, value...)})
+	}
+	done = !it.ValidForPrefix(prefix)
+	it.Close()
+
+	cutoff := now.Add(-retention)
+	for _, e := range batch {
+		root := e.key[len(prefix):]
+		var votes []VoteRecord
+		if gob.NewDecoder(bytes.NewBuffer(e.value)).Decode(&votes) != nil {
+			continue
+		}
+		// Latest first, so the old ones are at the end
+		kept := len(votes)
+		for kept > 0 && votes[kept-1].Received.Before(cutoff) {
+			kept--
+		}
+		if kept == len(votes) {
+			continue
+		}
+		dropped += len(votes) - kept
+		if kept == 0 {
+			deleteMeta(conn, votesPrefix, root)
+		} else {
+			storeMeta(conn, votesPrefix, root, votes[:kept])
+		}
+	}
+
+	if done {
+		voteCompactCursor = nil
+	} else if len(batch) > 0 {
+		voteCompactCursor = batch[len(batch)-1].key
+	}
+	return dropped, done
+}
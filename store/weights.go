@@ -0,0 +1,114 @@
+package store
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/dgraph-io/badger"
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+)
+
+// Each representative's weight, kept up to date as blocks are stored so
+// it can be read without walking every chain.
+const repWeightPrefix = "repweight"
+
+// Each account's representative, keyed by its frontier's hash so it's
+// kept without looking up whose chain a block is on. Moves to the new
+// frontier with each block.
+const frontierRepPrefix = "frontierrep"
+
+const repWeightIndexedKey = "repweightindexed"
+
+// Adds amount to, or with remove takes it from, rep's weight.
+func adjustWeight(conn *badger.Txn, rep types.Account, amount uint128.Uint128, remove bool) {
+	pub, err := address.AddressToPub(rep)
+	if err != nil {
+		return
+	}
+	var weight uint128.Uint128
+	fetchMeta(conn, repWeightPrefix, pub, &weight)
+	if remove {
+		weight = weight.Sub(amount)
+	} else {
+		weight = weight.Add(amount)
+	}
+	if weight == uint128.FromInts(0, 0) {
+		deleteMeta(conn, repWeightPrefix, pub)
+		return
+	}
+	storeMeta(conn, repWeightPrefix, pub, weight)
+}
+
+// Moves the account's balance at the block's previous to its balance at
+// the block, from its old representative to the one the block leaves it
+// with.
+func moveWeight(conn *badger.Txn, block blocks.Block) {
+	var rep types.Account
+	if block.Type() != blocks.Open {
+		previous := block.PreviousBlockHash()
+		fetchMeta(conn, frontierRepPrefix, previous.ToBytes(), &rep)
+		deleteMeta(conn, frontierRepPrefix, previous.ToBytes())
+		adjustWeight(conn, rep, balanceOf(conn, previous), true)
+	}
+	switch b := block.(type) {
+	case *blocks.OpenBlock:
+		rep = b.Representative
+	case *blocks.ChangeBlock:
+		rep = b.Representative
+	}
+	storeMeta(conn, frontierRepPrefix, block.Hash().ToBytes(), rep)
+	adjustWeight(conn, rep, getBalance(conn, block), false)
+}
+
+// Counts the weights for stores written before they were kept.
+func indexWeights(conn *badger.Txn) {
+	var done bool
+	if fetchMeta(conn, repWeightIndexedKey, nil, &done) == nil {
+		return
+	}
+	for _, prefix := range []string{repWeightPrefix, frontierRepPrefix} {
+		var stale [][]byte
+		iterateMeta(conn, prefix, func(key []byte, value []byte) error {
+			stale = append(stale, append([]byte{}, key...))
+			return nil
+		})
+		for _, key := range stale {
+			deleteMeta(conn, prefix, key)
+		}
+	}
+
+	index := loadBlockIndex(conn)
+	for _, open := range index.opens {
+		rep := open.Representative
+		hash := open.Hash()
+		for {
+			next, ok := index.successors[hash]
+			if !ok {
+				break
+			}
+			hash = next
+			if change, ok := fetchBlock(conn, hash).(*blocks.ChangeBlock); ok {
+				rep = change.Representative
+			}
+		}
+		storeMeta(conn, frontierRepPrefix, hash.ToBytes(), rep)
+		adjustWeight(conn, rep, balanceOf(conn, hash), false)
+	}
+	storeMeta(conn, repWeightIndexedKey, nil, true)
+}
+
+func storedWeights(conn *badger.Txn) []RepresentativeWeight {
+	var weights []RepresentativeWeight
+	iterateMeta(conn, repWeightPrefix, func(key []byte, value []byte) error {
+		var weight uint128.Uint128
+		if err := gob.NewDecoder(bytes.NewBuffer(value)).Decode(&weight); err != nil {
+			return err
+		}
+		weights = append(weights, RepresentativeWeight{address.PubKeyToAddress(key), weight})
+		return nil
+	})
+	return weights
+}
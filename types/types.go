@@ -2,6 +2,7 @@ package types
 
 import (
 	"encoding/hex"
+	"fmt"
 	"strings"
 
 	"github.com/frankh/crypto/ed25519"
@@ -12,6 +13,62 @@ type Account string
 type Work string
 type Signature string
 
+// Lengths of the hex encoded string types
+const (
+	BlockHashLength = 64
+	WorkLength      = 16
+	SignatureLength = 128
+)
+
+func validateHex(s string, length int, name string) error {
+	if len(s) != length {
+		return fmt.Errorf("%s must be %d hex characters, got %d", name, length, len(s))
+	}
+	if _, err := hex.DecodeString(s); err != nil {
+		return fmt.Errorf("%s is not valid hex", name)
+	}
+	return nil
+}
+
+func ParseBlockHash(s string) (BlockHash, error) {
+	hash := BlockHash(s)
+	err := hash.Validate()
+	if err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+func ParseWork(s string) (Work, error) {
+	work := Work(s)
+	err := work.Validate()
+	if err != nil {
+		return "", err
+	}
+	return work, nil
+}
+
+func ParseSignature(s string) (Signature, error) {
+	sig := Signature(s)
+	err := sig.Validate()
+	if err != nil {
+		return "", err
+	}
+	return sig, nil
+}
+
+func (hash BlockHash) Validate() error {
+	return validateHex(string(hash), BlockHashLength, "block hash")
+}
+
+func (work Work) Validate() error {
+	return validateHex(string(work), WorkLength, "work")
+}
+
+func (sig Signature) Validate() error {
+	return validateHex(string(sig), SignatureLength, "signature")
+}
+
 func (hash BlockHash) ToBytes() []byte {
 	bytes, err := hex.DecodeString(string(hash))
 	if err != nil {
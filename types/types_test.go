@@ -0,0 +1,49 @@
+package types
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseBlockHash(t *testing.T) {
+	valid := "991CF190094C00F0B68E2E5F75F6BEE95A2E0BD93CEAA4A6734DB9F19B728948"
+
+	if _, err := ParseBlockHash(valid); err != nil {
+		t.Errorf("Valid hash failed to parse: %s", err)
+	}
+
+	if _, err := ParseBlockHash(strings.ToLower(valid)); err != nil {
+		t.Errorf("Lower case hash failed to parse: %s", err)
+	}
+
+	invalid := []string{
+		"",
+		valid[:63],
+		valid + "00",
+		"Z" + valid[1:],
+	}
+
+	for _, s := range invalid {
+		if _, err := ParseBlockHash(s); err == nil {
+			t.Errorf("Invalid hash %q parsed", s)
+		}
+	}
+}
+
+func TestParseWorkAndSignature(t *testing.T) {
+	if _, err := ParseWork("9680625b39d3363d"); err != nil {
+		t.Errorf("Valid work failed to parse: %s", err)
+	}
+
+	if _, err := ParseWork("9680625b39d3363"); err == nil || !strings.Contains(err.Error(), "work") {
+		t.Errorf("Short work should fail with a work error, got %v", err)
+	}
+
+	if _, err := ParseSignature(strings.Repeat("AB", 64)); err != nil {
+		t.Errorf("Valid signature failed to parse: %s", err)
+	}
+
+	if _, err := ParseSignature(strings.Repeat("AG", 64)); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Errorf("Non hex signature should fail with a signature error, got %v", err)
+	}
+}
@@ -17,8 +17,9 @@ package uint128
 import (
 	"encoding/binary"
 	"encoding/hex"
-
-	"github.com/pkg/errors"
+	"encoding/json"
+	"fmt"
+	"math/big"
 )
 
 // Uint128 is a big-endian 128 bit unsigned integer which wraps two uint64s.
@@ -39,6 +40,11 @@ func (u Uint128) String() string {
 	return hex.EncodeToString(u.GetBytes())
 }
 
+// Decimal returns the base 10 representation, as raw amounts are shown.
+func (u Uint128) Decimal() string {
+	return new(big.Int).SetBytes(u.GetBytes()).String()
+}
+
 // Equal returns whether or not the Uint128 are equivalent.
 func (u Uint128) Equal(o Uint128) bool {
 	return u.Hi == o.Hi && u.Lo == o.Lo
@@ -87,11 +93,11 @@ func FromBytes(b []byte) Uint128 {
 // FromString parses a hexadecimal string as a 128-bit big-endian unsigned integer.
 func FromString(s string) (Uint128, error) {
 	if len(s) > 32 {
-		return Uint128{}, errors.Errorf("input string %s too large for uint128", s)
+		return Uint128{}, fmt.Errorf("input string %s too large for uint128", s)
 	}
 	bytes, err := hex.DecodeString(s)
 	if err != nil {
-		return Uint128{}, errors.Wrapf(err, "could not decode %s as hex", s)
+		return Uint128{}, fmt.Errorf("could not decode %s as hex: %v", s, err)
 	}
 
 	// Grow the byte slice if it's smaller than 16 bytes, by prepending 0s
@@ -104,6 +110,40 @@ func FromString(s string) (Uint128, error) {
 	return FromBytes(bytes), nil
 }
 
+// FromDecimal parses a base 10 string, as raw amounts are shown.
+func FromDecimal(s string) (Uint128, error) {
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok || n.Sign() < 0 || n.BitLen() > 128 {
+		return Uint128{}, fmt.Errorf("could not decode %s as a 128-bit decimal", s)
+	}
+	bytes := make([]byte, 16)
+	b := n.Bytes()
+	copy(bytes[16-len(b):], b)
+	return FromBytes(bytes), nil
+}
+
+// UnmarshalJSON accepts the 32 hex digits the reference node writes
+// legacy balances as, as well as the {"Hi", "Lo"} object Uint128 is
+// encoded as.
+func (u *Uint128) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		if len(s) != 32 {
+			return fmt.Errorf("input string %s isn't 32 hex digits", s)
+		}
+		*u, err = FromString(s)
+		return err
+	}
+	var fields struct {
+		Hi, Lo uint64
+	}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	*u = Uint128{fields.Hi, fields.Lo}
+	return nil
+}
+
 // FromInts takes in two unsigned 64-bit integers and constructs a Uint128.
 func FromInts(hi uint64, lo uint64) Uint128 {
 	return Uint128{hi, lo}
@@ -16,6 +16,7 @@ package uint128
 
 import (
 	"bytes"
+	"encoding/json"
 	"strings"
 	"testing"
 )
@@ -124,3 +125,40 @@ func TestEqual(t *testing.T) {
 		}
 	}
 }
+
+func TestFromDecimal(t *testing.T) {
+	for _, u := range []Uint128{{0, 0}, {0, 1}, {314, 15}, {18446744073709551615, 18446744073709551615}} {
+		if actual, err := FromDecimal(u.Decimal()); err != nil || actual != u {
+			t.Errorf("expected: %v from %s but got %v, %v", u, u.Decimal(), actual, err)
+		}
+	}
+	for _, s := range []string{"", "-1", "1.5", "340282366920938463463374607431768211456"} {
+		if _, err := FromDecimal(s); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+}
+
+func TestUnmarshalJSON(t *testing.T) {
+	expected := Uint128{0xffffceb239bb726c, 0xc73ea4f5ffffd2a0}
+	for _, s := range []string{`"FFFFCEB239BB726CC73EA4F5FFFFD2A0"`, `"ffffceb239bb726cc73ea4f5ffffd2a0"`, `{"Hi": 18446689863600927340, "Lo": 14357094038572618400}`} {
+		var u Uint128
+		if err := json.Unmarshal([]byte(s), &u); err != nil || u != expected {
+			t.Errorf("expected: %v from %s but got %v, %v", expected, s, u, err)
+		}
+	}
+	// Anything shorter could be a decimal amount
+	for _, s := range []string{`"1000"`, `""`, `"FFFFCEB239BB726CC73EA4F5FFFFD2AG"`, `1000`, `[]`} {
+		var u Uint128
+		if err := json.Unmarshal([]byte(s), &u); err == nil {
+			t.Errorf("expected an error for %s", s)
+		}
+	}
+
+	// What it's encoded as round trips
+	encoded, _ := json.Marshal(expected)
+	var u Uint128
+	if err := json.Unmarshal(encoded, &u); err != nil || u != expected {
+		t.Errorf("expected: %v from %s but got %v, %v", expected, encoded, u, err)
+	}
+}
@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock separates wall time, which can be stepped by NTP or the user,
+// from monotonic time which only moves forward.
+type Clock interface {
+	Now() time.Time
+	// Time since an arbitrary fixed point in this process
+	Monotonic() time.Duration
+}
+
+var processStart = time.Now()
+
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (SystemClock) Monotonic() time.Duration {
+	return time.Since(processStart)
+}
+
+// FakeClock only moves when told to, for tests.
+type FakeClock struct {
+	lock sync.Mutex
+	wall time.Time
+	mono time.Duration
+}
+
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{wall: start}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.wall
+}
+
+func (c *FakeClock) Monotonic() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.mono
+}
+
+// Moves both wall and monotonic time forward.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.wall = c.wall.Add(d)
+	c.mono += d
+}
+
+// Steps only the wall clock, like an NTP correction or suspend.
+func (c *FakeClock) Step(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.wall = c.wall.Add(d)
+}
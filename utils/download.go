@@ -0,0 +1,81 @@
+//go:build !light
+// +build !light
+
+package utils
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Retries of a download, each resuming where the last left off
+var DownloadRetry = RetryPolicy{
+	Component:   "download",
+	Base:        time.Second,
+	Max:         time.Minute,
+	MaxAttempts: 5,
+}
+
+// Download fetches url to path, resuming from the end of path if a
+// previous download was cut short. Servers that ignore the range get the
+// file restarted. Dials through Outbound, so it follows the proxy.
+// Failures are retried with DownloadRetry.
+func Download(ctx context.Context, url string, path string) error {
+	return DownloadRetry.Do(ctx, func(ctx context.Context) error {
+		return download(ctx, url, path)
+	})
+}
+
+func download(ctx context.Context, url string, path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return Permanent(err)
+	}
+	defer file.Close()
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return Permanent(err)
+	}
+	req = req.WithContext(ctx)
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+
+	client := &http.Client{Transport: &http.Transport{DialContext: Outbound.DialContext}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		if err = file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Already complete
+		if offset > 0 {
+			return nil
+		}
+		fallthrough
+	default:
+		return &StatusError{Code: resp.StatusCode, Message: "Download failed: " + resp.Status}
+	}
+
+	_, err = io.Copy(file, resp.Body)
+	return err
+}
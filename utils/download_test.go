@@ -0,0 +1,86 @@
+//go:build !light
+// +build !light
+
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDownload(t *testing.T) {
+	content := bytes.Repeat([]byte("snapshot "), 1000)
+	var ranges []string
+	ignoreRange := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if ignoreRange {
+			r.Header.Del("Range")
+		}
+		http.ServeContent(w, r, "snapshot", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "download")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot")
+	check := func(name string) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil || !bytes.Equal(data, content) {
+			t.Errorf("%s: downloaded %d bytes, %v", name, len(data), err)
+		}
+	}
+
+	if err := Download(context.Background(), server.URL, path); err != nil {
+		t.Fatal(err)
+	}
+	check("fresh")
+
+	// Resumed from where a cut download stopped
+	ioutil.WriteFile(path, content[:1234], 0600)
+	if err := Download(context.Background(), server.URL, path); err != nil {
+		t.Fatal(err)
+	}
+	check("resumed")
+	if ranges[1] != "bytes=1234-" {
+		t.Errorf("Didn't resume, range %q", ranges[1])
+	}
+
+	// Nothing left to fetch
+	if err := Download(context.Background(), server.URL, path); err != nil {
+		t.Errorf("Complete download failed: %s", err)
+	}
+	check("complete")
+
+	ignoreRange = true
+	ioutil.WriteFile(path, []byte("stale"), 0600)
+	if err := Download(context.Background(), server.URL, path); err != nil {
+		t.Fatal(err)
+	}
+	check("restarted")
+}
+
+func TestDownloadNotFound(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "download")
+	defer os.RemoveAll(dir)
+	err := Download(context.Background(), server.URL, filepath.Join(dir, "snapshot"))
+	var status *StatusError
+	if !errors.As(err, &status) || status.Code != 404 || requests != 1 {
+		t.Errorf("404 returned %v after %d requests", err, requests)
+	}
+}
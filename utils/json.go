@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"errors"
+)
+
+var ErrJSONTooDeep = errors.New("JSON nested too deeply")
+var ErrJSONTooManyFields = errors.New("JSON has too many fields")
+
+// CheckJSONShape fails if data nests objects and arrays deeper than
+// maxDepth, or has more than maxFields object fields in all. It scans
+// without decoding or allocating, so a hostile document can be turned
+// away before decoding it costs any memory. It doesn't check data is
+// well formed; the decoder still does that.
+func CheckJSONShape(data []byte, maxDepth int, maxFields int) error {
+	depth, fields := 0, 0
+	inString, escaped := false, false
+	for _, c := range data {
+		switch {
+		case inString:
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			depth++
+			if depth > maxDepth {
+				return ErrJSONTooDeep
+			}
+		case c == '}' || c == ']':
+			depth--
+		case c == ':':
+			fields++
+			if fields > maxFields {
+				return ErrJSONTooManyFields
+			}
+		}
+	}
+	return nil
+}
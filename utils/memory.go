@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"sort"
+	"sync"
+)
+
+// MemoryUsage is one bounded structure's share of memory. Bytes are
+// approximate, from the size registered per entry.
+type MemoryUsage struct {
+	Name       string
+	Entries    int
+	Limit      int
+	Bytes      int64
+	LimitBytes int64
+}
+
+type MemoryStats struct {
+	// Zero when every structure is at its default limit
+	Budget     int64
+	Bytes      int64
+	LimitBytes int64
+	Structures []MemoryUsage
+}
+
+type memoryUser struct {
+	name         string
+	entrySize    int64
+	defaultLimit int
+	limit        int
+	count        func() int
+	setLimit     func(limit int)
+}
+
+var memory struct {
+	lock   sync.Mutex
+	budget int64
+	users  []*memoryUser
+}
+
+// RegisterMemory adds a bounded structure to the accountant. count
+// returns its entries and setLimit changes its cap, dropping entries over
+// it. entrySize is a rough count of bytes per entry, overheads included.
+func RegisterMemory(name string, entrySize int64, defaultLimit int, count func() int, setLimit func(limit int)) {
+	memory.lock.Lock()
+	defer memory.lock.Unlock()
+
+	u := &memoryUser{name, entrySize, defaultLimit, defaultLimit, count, setLimit}
+	memory.users = append(memory.users, u)
+	if memory.budget > 0 {
+		scaleLimits()
+	}
+}
+
+// SetMemoryBudget scales every registered limit by the same factor so
+// their total fits in budget bytes. Zero restores the defaults. Some
+// structures live in the store, so call it once the store is open.
+func SetMemoryBudget(budget int64) {
+	memory.lock.Lock()
+	defer memory.lock.Unlock()
+
+	memory.budget = budget
+	scaleLimits()
+}
+
+func scaleLimits() {
+	var total int64
+	for _, u := range memory.users {
+		total += u.entrySize * int64(u.defaultLimit)
+	}
+
+	for _, u := range memory.users {
+		limit := u.defaultLimit
+		if memory.budget > 0 && total > 0 {
+			limit = int(float64(u.defaultLimit) * float64(memory.budget) / float64(total))
+			// Every structure needs room for something
+			if limit < 1 {
+				limit = 1
+			}
+		}
+		if limit != u.limit {
+			u.limit = limit
+			u.setLimit(limit)
+		}
+	}
+}
+
+func GetMemoryStats() MemoryStats {
+	memory.lock.Lock()
+	defer memory.lock.Unlock()
+
+	stats := MemoryStats{Budget: memory.budget}
+	for _, u := range memory.users {
+		usage := MemoryUsage{
+			Name:       u.name,
+			Entries:    u.count(),
+			Limit:      u.limit,
+			LimitBytes: u.entrySize * int64(u.limit),
+		}
+		usage.Bytes = u.entrySize * int64(usage.Entries)
+		stats.Bytes += usage.Bytes
+		stats.LimitBytes += usage.LimitBytes
+		stats.Structures = append(stats.Structures, usage)
+	}
+	sort.Slice(stats.Structures, func(i, j int) bool {
+		return stats.Structures[i].Name < stats.Structures[j].Name
+	})
+	return stats
+}
+
+func memorySeries(limit bool) map[string]float64 {
+	series := make(map[string]float64)
+	for _, usage := range GetMemoryStats().Structures {
+		if limit {
+			series[usage.Name] = float64(usage.LimitBytes)
+		} else {
+			series[usage.Name] = float64(usage.Bytes)
+		}
+	}
+	return series
+}
@@ -0,0 +1,14 @@
+//go:build !light
+// +build !light
+
+package utils
+
+import "github.com/frankh/nano/metrics"
+
+var memoryGauge = metrics.NewGaugeFunc("nano_memory_bytes", "Approximate memory used by each bounded structure.", "structure", func() map[string]float64 {
+	return memorySeries(false)
+})
+
+var memoryLimitGauge = metrics.NewGaugeFunc("nano_memory_limit_bytes", "Approximate memory each bounded structure may grow to.", "structure", func() map[string]float64 {
+	return memorySeries(true)
+})
@@ -0,0 +1,237 @@
+//go:build !light
+// +build !light
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dialer makes outbound connections. *net.Dialer is one.
+type Dialer interface {
+	DialContext(ctx context.Context, network string, addr string) (net.Conn, error)
+}
+
+// Every outbound tcp connection goes through this, so a proxy can be
+// set for all of them in one place.
+var Outbound Dialer = &net.Dialer{Timeout: 10 * time.Second}
+
+var ErrProxyUdp = errors.New("Udp can't be sent through a SOCKS5 proxy")
+
+// ProxyError is a failure of the proxy itself, as opposed to the
+// destination behind it.
+type ProxyError struct {
+	Proxy string
+	Err   error
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("Proxy %s: %s", e.Proxy, e.Err)
+}
+
+// DestinationError is the proxy reporting it couldn't reach the
+// destination.
+type DestinationError struct {
+	Addr  string
+	Reply byte
+}
+
+func (e *DestinationError) Error() string {
+	return fmt.Sprintf("Proxy couldn't reach %s: %s", e.Addr, socksReplies[e.Reply])
+}
+
+var socksReplies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// Replies about the destination rather than the proxy
+var destinationReplies = map[byte]bool{3: true, 4: true, 5: true, 6: true}
+
+// Socks5Dialer connects through a SOCKS5 proxy, except to destinations
+// matching a bypass rule. Host names are resolved by the proxy.
+type Socks5Dialer struct {
+	Proxy    string
+	Username string
+	Password string
+	// Hosts ("localhost"), domain suffixes (".lan"), networks
+	// ("10.0.0.0/8") or "*", dialed directly
+	Bypass []string
+	Direct Dialer
+}
+
+// Parses a socks5://[user:password@]host:port proxy URL.
+func NewSocks5Dialer(proxyURL string, bypass []string) (*Socks5Dialer, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil || u.Scheme != "socks5" || u.Port() == "" {
+		return nil, errors.New("Proxy must be a socks5://host:port URL")
+	}
+	d := &Socks5Dialer{Proxy: u.Host, Bypass: bypass, Direct: Outbound}
+	if u.User != nil {
+		d.Username = u.User.Username()
+		d.Password, _ = u.User.Password()
+	}
+	return d, nil
+}
+
+func (d *Socks5Dialer) bypassed(host string) bool {
+	ip := net.ParseIP(host)
+	for _, rule := range d.Bypass {
+		switch {
+		case rule == "*" || strings.EqualFold(rule, host):
+			return true
+		case strings.HasPrefix(rule, "."):
+			if strings.HasSuffix(strings.ToLower(host), strings.ToLower(rule)) {
+				return true
+			}
+		case strings.Contains(rule, "/"):
+			_, network, err := net.ParseCIDR(rule)
+			if err == nil && ip != nil && network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (d *Socks5Dialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.bypassed(host) {
+		return d.Direct.DialContext(ctx, network, addr)
+	}
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, ErrProxyUdp
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := d.Direct.DialContext(ctx, "tcp", d.Proxy)
+	if err != nil {
+		return nil, &ProxyError{d.Proxy, err}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	err = d.connect(conn, host, uint16(port))
+	if err != nil {
+		conn.Close()
+		if _, ok := err.(*DestinationError); ok {
+			return nil, err
+		}
+		return nil, &ProxyError{d.Proxy, err}
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// The SOCKS5 handshake and connect request, RFC 1928 and 1929.
+func (d *Socks5Dialer) connect(conn net.Conn, host string, port uint16) error {
+	methods := []byte{5, 1, 0}
+	if d.Username != "" {
+		methods = []byte{5, 2, 0, 2}
+	}
+	_, err := conn.Write(methods)
+	if err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+	if reply[0] != 5 {
+		return errors.New("Not a SOCKS5 proxy")
+	}
+
+	switch reply[1] {
+	case 0:
+	case 2:
+		if len(d.Username) > 255 || len(d.Password) > 255 {
+			return errors.New("Proxy credentials too long")
+		}
+		auth := []byte{1, byte(len(d.Username))}
+		auth = append(auth, d.Username...)
+		auth = append(append(auth, byte(len(d.Password))), d.Password...)
+		_, err = conn.Write(auth)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(conn, reply)
+		if err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("Proxy rejected the credentials")
+		}
+	default:
+		return errors.New("No acceptable authentication method")
+	}
+
+	request := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("Host name too long")
+		}
+		request = append(append(request, 3, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(append(request, 1), ip4...)
+	} else {
+		request = append(append(request, 4), ip.To16()...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	_, err = conn.Write(request)
+	if err != nil {
+		return err
+	}
+
+	// Version, reply, reserved, address type
+	header := make([]byte, 4)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		if destinationReplies[header[1]] {
+			return &DestinationError{net.JoinHostPort(host, strconv.Itoa(int(port))), header[1]}
+		}
+		return fmt.Errorf("Proxy refused the connection: %s", socksReplies[header[1]])
+	}
+
+	// Skip the bound address and port
+	var skip int
+	switch header[3] {
+	case 1:
+		skip = net.IPv4len
+	case 4:
+		skip = net.IPv6len
+	case 3:
+		_, err = io.ReadFull(conn, reply[:1])
+		if err != nil {
+			return err
+		}
+		skip = int(reply[0])
+	default:
+		return errors.New("Bad proxy reply")
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
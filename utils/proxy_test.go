@@ -0,0 +1,141 @@
+//go:build !light
+// +build !light
+
+package utils
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// A SOCKS5 proxy accepting user "u" with password "p", answering connect
+// requests for port 1 with reply.
+func socksProxy(t *testing.T, reply byte) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 512)
+				io.ReadFull(conn, buf[:4])
+				conn.Write([]byte{5, 2})
+				io.ReadFull(conn, buf[:2])
+				io.ReadFull(conn, buf[:buf[1]+1])
+				user := string(buf[:buf[1]])
+				io.ReadFull(conn, buf[:buf[len(user)]])
+				if user != "u" || string(buf[:1]) != "p" {
+					conn.Write([]byte{1, 1})
+					return
+				}
+				conn.Write([]byte{1, 0})
+
+				// Connect requests by IPv4 address or host name
+				io.ReadFull(conn, buf[:4])
+				named := buf[3] == 3
+				n := 4
+				if named {
+					io.ReadFull(conn, buf[:1])
+					n = int(buf[0])
+				}
+				io.ReadFull(conn, buf[:n+2])
+				host := net.IP(buf[:4]).String()
+				if named {
+					host = string(buf[:n])
+				}
+				port := int(buf[n])<<8 | int(buf[n+1])
+				if port == 1 {
+					conn.Write([]byte{5, reply, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				dest, err := net.Dial("tcp4", net.JoinHostPort(host, strconv.Itoa(port)))
+				if err != nil {
+					conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer dest.Close()
+				conn.Write([]byte{5, 0, 0, 3, 4, 'h', 'o', 's', 't', 0, 1})
+				go io.Copy(dest, conn)
+				io.Copy(conn, dest)
+			}(conn)
+		}
+	}()
+	return ln
+}
+
+func TestSocks5Dialer(t *testing.T) {
+	echo, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	_, echoPort, _ := net.SplitHostPort(echo.Addr().String())
+
+	proxy := socksProxy(t, 4)
+	defer proxy.Close()
+	d, err := NewSocks5Dialer("socks5://u:p@"+proxy.Addr().String(), []string{".direct"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The proxy resolves names
+	conn, err := d.DialContext(context.Background(), "tcp", "localhost:"+echoPort)
+	if err != nil {
+		t.Fatalf("Failed to dial through proxy: %s", err)
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	io.ReadFull(conn, buf)
+	conn.Close()
+	if string(buf) != "ping" {
+		t.Errorf("Connection through proxy didn't echo, got %q", buf)
+	}
+
+	if _, err = d.DialContext(context.Background(), "tcp", "127.0.0.1:1"); err == nil || err.(*DestinationError).Reply != 4 {
+		t.Errorf("Expected a destination error, got %v", err)
+	}
+	if _, err = d.DialContext(context.Background(), "udp", "127.0.0.1:7075"); err != ErrProxyUdp {
+		t.Errorf("Expected udp to be refused, got %v", err)
+	}
+
+	d.Password = "wrong"
+	if _, err = d.DialContext(context.Background(), "tcp", "127.0.0.1:"+echoPort); err == nil {
+		t.Errorf("Connected with wrong credentials")
+	} else if _, ok := err.(*ProxyError); !ok {
+		t.Errorf("Expected a proxy error for bad credentials, got %v", err)
+	}
+
+	// Bypassed destinations don't need the proxy at all
+	proxy.Close()
+	d.Bypass = []string{"127.0.0.0/8"}
+	conn, err = d.DialContext(context.Background(), "tcp", "127.0.0.1:"+echoPort)
+	if err != nil {
+		t.Fatalf("Bypassed dial failed: %s", err)
+	}
+	conn.Close()
+	d.Bypass = nil
+	if _, err = d.DialContext(context.Background(), "tcp", "127.0.0.1:"+echoPort); err == nil {
+		t.Errorf("Dialed through a closed proxy")
+	} else if _, ok := err.(*ProxyError); !ok {
+		t.Errorf("Expected a proxy error for an unreachable proxy, got %v", err)
+	}
+
+	if _, err = NewSocks5Dialer("http://proxy:8080", nil); err == nil {
+		t.Errorf("Accepted a non SOCKS5 proxy")
+	}
+}
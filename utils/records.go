@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// Longer lengths are taken as corruption rather than allocated
+const MaxRecordSize = 16 << 20
+
+var ErrRecordTooLarge = errors.New("Record too large")
+
+// Records are JSON values each preceded by its length as a 4 byte big
+// endian integer, so files of them can be appended to and read back
+// without scanning the JSON for where each ends.
+func WriteRecord(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	_, err = w.Write(append(record, data...))
+	return err
+}
+
+// ReadRecords calls fn with each record's JSON in turn. A record cut off
+// at the end, e.g. by a crash while it was appended, is ignored.
+func ReadRecords(r io.Reader, fn func(data []byte) error) error {
+	reader := bufio.NewReader(r)
+	var header [4]byte
+	for {
+		_, err := io.ReadFull(reader, header[:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		if size > MaxRecordSize {
+			return ErrRecordTooLarge
+		}
+		data := make([]byte, size)
+		_, err = io.ReadFull(reader, data)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(data); err != nil {
+			return err
+		}
+	}
+}
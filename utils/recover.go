@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Set to false to let handler panics crash the process, e.g. to get a
+// debugger onto them.
+var RecoverPanics = true
+
+const DefaultMaxPanics = 5
+
+var ErrHandlerDisabled = errors.New("Handler disabled after repeated panics")
+
+// Where the last panic is written, recovered or not, for the next start
+// to report. Empty for nowhere.
+var PanicFile string
+
+// A PanicRecord is a panic as written to PanicFile.
+type PanicRecord struct {
+	// The guard's name, or "crash" for one that took the process down
+	Handler string
+	Value   string
+	Stack   string
+	Time    time.Time
+}
+
+// RecordPanic writes a panic to PanicFile, replacing the one before.
+func RecordPanic(handler string, value interface{}, stack []byte) {
+	if PanicFile == "" {
+		return
+	}
+	data, _ := json.Marshal(PanicRecord{handler, fmt.Sprint(value), string(stack), time.Now()})
+	if err := ioutil.WriteFile(PanicFile, data, 0600); err != nil {
+		log.Printf("Failed to record panic: %s", err)
+	}
+}
+
+// LastPanic reads PanicFile.
+func LastPanic() (PanicRecord, bool) {
+	var r PanicRecord
+	if PanicFile == "" {
+		return r, false
+	}
+	data, err := ioutil.ReadFile(PanicFile)
+	if err != nil || json.Unmarshal(data, &r) != nil {
+		return r, false
+	}
+	return r, true
+}
+
+// RecordCrash, deferred at the top of a goroutine, records a panic that
+// would take the process down and carries on panicking.
+func RecordCrash() {
+	if r := recover(); r != nil {
+		RecordPanic("crash", r, debug.Stack())
+		panic(r)
+	}
+}
+
+type PanicEvent struct {
+	Handler string
+	Value   interface{}
+	Stack   []byte
+	// Panics so far, including this one
+	Panics int
+}
+
+// Called when a guard trips and its handler is disabled.
+var OnHandlerDisabled = func(e PanicEvent) {
+	log.Printf("Disabled handler %s after %d panics", e.Handler, e.Panics)
+}
+
+type PanicError struct {
+	PanicEvent
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("Handler %s panicked: %v", e.Handler, e.Value)
+}
+
+// A Guard runs an externally supplied callback, turning panics into
+// errors, and disables it once it has panicked MaxPanics times.
+type Guard struct {
+	Name string
+	// Zero never disables the handler
+	MaxPanics int
+	lock      sync.Mutex
+	panics    int
+	disabled  bool
+}
+
+func NewGuard(name string, maxPanics int) *Guard {
+	return &Guard{Name: name, MaxPanics: maxPanics}
+}
+
+func (g *Guard) Call(fn func()) (err error) {
+	if g.Disabled() {
+		return ErrHandlerDisabled
+	}
+	if !RecoverPanics {
+		fn()
+		return nil
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = g.recovered(r, debug.Stack())
+		}
+	}()
+	fn()
+	return nil
+}
+
+func (g *Guard) recovered(value interface{}, stack []byte) error {
+	g.lock.Lock()
+	g.panics++
+	e := PanicEvent{g.Name, value, stack, g.panics}
+	tripped := !g.disabled && g.MaxPanics > 0 && g.panics >= g.MaxPanics
+	if tripped {
+		g.disabled = true
+	}
+	g.lock.Unlock()
+
+	log.Printf("Recovered panic in handler %s: %v\n%s", g.Name, value, stack)
+	RecordPanic(g.Name, value, stack)
+	if tripped {
+		OnHandlerDisabled(e)
+	}
+	return &PanicError{e}
+}
+
+func (g *Guard) Panics() int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.panics
+}
+
+func (g *Guard) Disabled() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.disabled
+}
+
+// Re-enables a disabled handler and clears its count.
+func (g *Guard) Reset() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.panics = 0
+	g.disabled = false
+}
@@ -0,0 +1,260 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How a failed attempt is treated
+type RetryClass int
+
+const (
+	// Worth trying again, e.g. a refused connection or a 503
+	RetryTransient RetryClass = iota
+	// Will fail the same way every time, e.g. a 404
+	RetryPermanent
+	// The caller gave up: neither retried nor counted as a give up
+	RetryCanceled
+)
+
+// A StatusError is a failed request's status, for ClassifyError to tell
+// the client's mistakes from the server's.
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return e.Message
+}
+
+type permanentError struct {
+	error
+}
+
+// Permanent marks err as not worth retrying. Do returns err itself.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// ClassifyError is the default classification: 4xx statuses other than
+// timeouts and rate limits are permanent, as is anything marked
+// Permanent, cancellation stops, and everything else is retried.
+func ClassifyError(err error) RetryClass {
+	var permanent permanentError
+	var status *StatusError
+	switch {
+	case errors.As(err, &permanent):
+		return RetryPermanent
+	case errors.Is(err, context.Canceled):
+		return RetryCanceled
+	case errors.As(err, &status):
+		if status.Code >= 400 && status.Code < 500 && status.Code != 408 && status.Code != 429 {
+			return RetryPermanent
+		}
+	}
+	return RetryTransient
+}
+
+// A RetryPolicy retries an operation with exponential backoff and full
+// jitter: the wait after the nth failure is random, up to Base doubled n-1
+// times and capped at Max.
+type RetryPolicy struct {
+	// Names the caller in the retry metrics
+	Component string
+	Base      time.Duration
+	// Zero for no cap
+	Max time.Duration
+	// Limits on retrying, zero for none
+	MaxAttempts int
+	MaxElapsed  time.Duration
+	// Each attempt's context is done after this, zero for no limit
+	AttemptTimeout time.Duration
+	// ClassifyError if nil
+	Classify func(error) RetryClass
+
+	// For tests: SystemClock, a timer and math/rand if nil
+	Clock  Clock
+	Sleep  func(ctx context.Context, d time.Duration) error
+	Jitter func() float64
+}
+
+// Delay is the longest wait after the nth failure, before jitter.
+func (p RetryPolicy) Delay(n int) time.Duration {
+	d := p.Base
+	for i := 1; i < n && (p.Max <= 0 || d < p.Max); i++ {
+		if d > math.MaxInt64/2 {
+			d = math.MaxInt64
+			break
+		}
+		d *= 2
+	}
+	if p.Max > 0 && d > p.Max {
+		return p.Max
+	}
+	return d
+}
+
+// Backoff is the jittered wait after the nth failure, for callers that
+// schedule their own retries.
+func (p RetryPolicy) Backoff(n int) time.Duration {
+	jitter := p.Jitter
+	if jitter == nil {
+		jitter = rand.Float64
+	}
+	return time.Duration(jitter() * float64(p.Delay(n)))
+}
+
+// A Retrier is one run of a policy, for callers whose loop doesn't fit Do.
+type Retrier struct {
+	policy   RetryPolicy
+	ctx      context.Context
+	start    time.Time
+	failures int
+	counter  *retryCounter
+}
+
+func (p RetryPolicy) Start(ctx context.Context) *Retrier {
+	if p.Clock == nil {
+		p.Clock = SystemClock{}
+	}
+	if p.Classify == nil {
+		p.Classify = ClassifyError
+	}
+	if p.Sleep == nil {
+		p.Sleep = sleep
+	}
+	if p.Jitter == nil {
+		p.Jitter = rand.Float64
+	}
+	return &Retrier{policy: p, ctx: ctx, start: p.Clock.Now(), counter: retryCounterFor(p.Component)}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Attempt counts an attempt and returns its context.
+func (r *Retrier) Attempt() (context.Context, context.CancelFunc) {
+	r.counter.add(1, 0)
+	if r.policy.AttemptTimeout <= 0 {
+		return context.WithCancel(r.ctx)
+	}
+	return context.WithTimeout(r.ctx, r.policy.AttemptTimeout)
+}
+
+// Reset starts the backoff and limits over, e.g. once a dropped
+// connection has been made again.
+func (r *Retrier) Reset() {
+	r.failures = 0
+	r.start = r.policy.Clock.Now()
+}
+
+// Wait waits out the backoff after a failed attempt, returning nil to
+// try again, or the error to give up with.
+func (r *Retrier) Wait(err error) error {
+	if r.ctx.Err() != nil {
+		return r.ctx.Err()
+	}
+	switch r.policy.Classify(err) {
+	case RetryCanceled:
+		return err
+	case RetryPermanent:
+		r.counter.add(0, 1)
+		var permanent permanentError
+		if errors.As(err, &permanent) {
+			return permanent.error
+		}
+		return err
+	}
+
+	r.failures++
+	delay := r.policy.Backoff(r.failures)
+	elapsed := r.policy.Clock.Now().Sub(r.start)
+	if (r.policy.MaxAttempts > 0 && r.failures >= r.policy.MaxAttempts) ||
+		(r.policy.MaxElapsed > 0 && elapsed+delay > r.policy.MaxElapsed) {
+		r.counter.add(0, 1)
+		return err
+	}
+	return r.policy.Sleep(r.ctx, delay)
+}
+
+// Do calls fn until it succeeds, fails permanently, the policy gives up
+// or ctx is done, returning fn's last error or ctx's.
+func (p RetryPolicy) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	r := p.Start(ctx)
+	for {
+		attemptCtx, cancel := r.Attempt()
+		err := fn(attemptCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if err = r.Wait(err); err != nil {
+			return err
+		}
+	}
+}
+
+type retryCounter struct {
+	attempts, giveUps uint64
+}
+
+var retryCounters = struct {
+	sync.Mutex
+	byComponent map[string]*retryCounter
+}{byComponent: make(map[string]*retryCounter)}
+
+func retryCounterFor(component string) *retryCounter {
+	retryCounters.Lock()
+	defer retryCounters.Unlock()
+	c := retryCounters.byComponent[component]
+	if c == nil {
+		c = &retryCounter{}
+		retryCounters.byComponent[component] = c
+	}
+	return c
+}
+
+func (c *retryCounter) add(attempts, giveUps uint64) {
+	retryCounters.Lock()
+	c.attempts += attempts
+	c.giveUps += giveUps
+	retryCounters.Unlock()
+}
+
+// Attempts and give ups of outbound connections, by component.
+type RetryStats struct {
+	Component string
+	Attempts  uint64
+	GiveUps   uint64
+}
+
+// CountRetry adds to a component's stats, for callers that schedule
+// their own retries.
+func CountRetry(component string, attempts, giveUps uint64) {
+	retryCounterFor(component).add(attempts, giveUps)
+}
+
+func GetRetryStats() []RetryStats {
+	retryCounters.Lock()
+	defer retryCounters.Unlock()
+	var stats []RetryStats
+	for component, c := range retryCounters.byComponent {
+		stats = append(stats, RetryStats{component, c.attempts, c.giveUps})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Component < stats[j].Component })
+	return stats
+}
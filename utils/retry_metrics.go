@@ -0,0 +1,22 @@
+//go:build !light
+// +build !light
+
+package utils
+
+import "github.com/frankh/nano/metrics"
+
+var retryAttemptsGauge = metrics.NewGaugeFunc("nano_retry_attempts", "Outbound connection attempts, by component.", "component", func() map[string]float64 {
+	series := make(map[string]float64)
+	for _, s := range GetRetryStats() {
+		series[s.Component] = float64(s.Attempts)
+	}
+	return series
+})
+
+var retryGiveUpsGauge = metrics.NewGaugeFunc("nano_retry_give_ups", "Outbound connections given up on, by component.", "component", func() map[string]float64 {
+	series := make(map[string]float64)
+	for _, s := range GetRetryStats() {
+		series[s.Component] = float64(s.GiveUps)
+	}
+	return series
+})
@@ -2,7 +2,15 @@ package utils
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestEmpty(t *testing.T) {
@@ -36,3 +44,256 @@ func TestReverseUnordered(t *testing.T) {
 		t.Errorf("Failed on slice with single element")
 	}
 }
+
+func TestGuard(t *testing.T) {
+	var alerts []PanicEvent
+	OnHandlerDisabled = func(e PanicEvent) { alerts = append(alerts, e) }
+
+	g := NewGuard("test", 2)
+	if g.Call(func() {}) != nil {
+		t.Errorf("Handler that didn't panic returned an error")
+	}
+
+	err := g.Call(func() { panic("oops") })
+	if e, ok := err.(*PanicError); !ok || e.Value != "oops" || len(e.Stack) == 0 {
+		t.Errorf("Expected panic error with stack, got %v", err)
+	}
+	g.Call(func() { panic("oops") })
+	if !g.Disabled() || len(alerts) != 1 || alerts[0].Panics != 2 {
+		t.Errorf("Guard should trip and alert after 2 panics")
+	}
+
+	called := false
+	if g.Call(func() { called = true }) != ErrHandlerDisabled || called {
+		t.Errorf("Disabled handler was called")
+	}
+
+	g.Reset()
+	if g.Call(func() { called = true }) != nil || !called {
+		t.Errorf("Reset handler not called")
+	}
+}
+
+func TestPanicFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "panics")
+	defer os.RemoveAll(dir)
+	defer func(path string) { PanicFile = path }(PanicFile)
+	PanicFile = filepath.Join(dir, "panic")
+	if _, ok := LastPanic(); ok {
+		t.Errorf("Panic read before any was recorded")
+	}
+
+	NewGuard("handler", 0).Call(func() { panic("recovered") })
+	if r, ok := LastPanic(); !ok || r.Handler != "handler" || r.Value != "recovered" || r.Stack == "" {
+		t.Errorf("Unexpected recovered panic %+v", r)
+	}
+
+	// A crash is recorded, and still panics
+	func() {
+		defer func() {
+			if recover() != "down" {
+				t.Errorf("Crash didn't carry on panicking")
+			}
+		}()
+		defer RecordCrash()
+		panic("down")
+	}()
+	if r, ok := LastPanic(); !ok || r.Handler != "crash" || r.Value != "down" {
+		t.Errorf("Unexpected crash %+v", r)
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	defer func(users []*memoryUser) { memory.users, memory.budget = users, 0 }(memory.users)
+	memory.users = nil
+
+	limits := map[string]int{}
+	counts := map[string]int{"a": 100, "b": 10}
+	register := func(name string, size int64, limit int) {
+		limits[name] = limit
+		RegisterMemory(name, size, limit,
+			func() int { return counts[name] },
+			func(limit int) { limits[name] = limit })
+	}
+	register("a", 10, 1000)
+	register("b", 100, 100)
+
+	stats := GetMemoryStats()
+	if stats.Bytes != 2000 || stats.LimitBytes != 20000 || stats.Structures[1].Limit != 100 {
+		t.Errorf("Bad default usage %+v", stats)
+	}
+
+	// Limits scale together to fit
+	SetMemoryBudget(5000)
+	if limits["a"] != 250 || limits["b"] != 25 {
+		t.Errorf("Limits not scaled proportionally: %v", limits)
+	}
+	if GetMemoryStats().LimitBytes > 5000 {
+		t.Errorf("Limits over the budget")
+	}
+
+	// Late registrations are scaled too, and never to nothing
+	register("c", 1000000, 1)
+	if limits["c"] != 1 || limits["a"] >= 250 {
+		t.Errorf("Late registration not scaled: %v", limits)
+	}
+
+	SetMemoryBudget(0)
+	if limits["a"] != 1000 || limits["b"] != 100 || limits["c"] != 1 {
+		t.Errorf("Defaults not restored: %v", limits)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	ln.Close()
+	_, refused := net.Dial("tcp", ln.Addr().String())
+	if refused == nil {
+		t.Fatal("Dial to a closed port succeeded")
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want RetryClass
+	}{
+		{"refused", refused, RetryTransient},
+		{"500", &StatusError{Code: 500}, RetryTransient},
+		{"503", &StatusError{Code: 503}, RetryTransient},
+		{"404", &StatusError{Code: 404}, RetryPermanent},
+		{"400 wrapped", fmt.Errorf("post: %w", &StatusError{Code: 400}), RetryPermanent},
+		{"408", &StatusError{Code: 408}, RetryTransient},
+		{"429", &StatusError{Code: 429}, RetryTransient},
+		{"marked permanent", Permanent(errors.New("bad url")), RetryPermanent},
+		{"canceled", context.Canceled, RetryCanceled},
+		{"deadline", context.DeadlineExceeded, RetryTransient},
+	}
+	for _, test := range tests {
+		if got := ClassifyError(test.err); got != test.want {
+			t.Errorf("%s: classified %d, expected %d", test.name, got, test.want)
+		}
+	}
+}
+
+// A policy that sleeps on clock, with the longest jitter.
+func testRetryPolicy(clock *FakeClock, policy RetryPolicy) RetryPolicy {
+	policy.Clock = clock
+	policy.Jitter = func() float64 { return 1 }
+	policy.Sleep = func(ctx context.Context, d time.Duration) error {
+		clock.Advance(d)
+		return ctx.Err()
+	}
+	return policy
+}
+
+func TestRetryPolicy(t *testing.T) {
+	transient := &StatusError{Code: 503, Message: "unavailable"}
+	permanent := &StatusError{Code: 404, Message: "not found"}
+
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		// Errors of successive attempts, nil after the last
+		errs     []error
+		want     error
+		attempts int
+		elapsed  time.Duration
+	}{
+		{"succeeds", RetryPolicy{Base: time.Second}, []error{nil}, nil, 1, 0},
+		{"backs off", RetryPolicy{Base: time.Second, Max: 3 * time.Second},
+			[]error{transient, transient, transient, nil}, nil, 4, 6 * time.Second},
+		{"max attempts", RetryPolicy{Base: time.Second, MaxAttempts: 3},
+			[]error{transient, transient, transient, nil}, transient, 3, 3 * time.Second},
+		{"max elapsed", RetryPolicy{Base: time.Second, MaxElapsed: 5 * time.Second},
+			[]error{transient, transient, transient, transient, nil}, transient, 3, 3 * time.Second},
+		{"permanent", RetryPolicy{Base: time.Second},
+			[]error{transient, permanent, nil}, permanent, 2, time.Second},
+		{"marked permanent", RetryPolicy{Base: time.Second},
+			[]error{Permanent(transient), nil}, transient, 1, 0},
+		{"classified", RetryPolicy{Base: time.Second, Classify: func(error) RetryClass { return RetryTransient }},
+			[]error{permanent, nil}, nil, 2, time.Second},
+	}
+	for i, test := range tests {
+		clock := NewFakeClock(time.Unix(0, 0))
+		test.policy.Component = fmt.Sprintf("test%d", i)
+		attempts := 0
+		err := testRetryPolicy(clock, test.policy).Do(context.Background(), func(ctx context.Context) error {
+			attempts++
+			return test.errs[attempts-1]
+		})
+		if err != test.want || attempts != test.attempts {
+			t.Errorf("%s: %d attempts returned %v, expected %d returning %v", test.name, attempts, err, test.attempts, test.want)
+		}
+		if elapsed := clock.Now().Sub(time.Unix(0, 0)); elapsed != test.elapsed {
+			t.Errorf("%s: took %s, expected %s", test.name, elapsed, test.elapsed)
+		}
+		stats := GetRetryStats()
+		for _, s := range stats {
+			giveUps := uint64(0)
+			if test.want != nil {
+				giveUps = 1
+			}
+			if s.Component == test.policy.Component && (s.Attempts != uint64(test.attempts) || s.GiveUps != giveUps) {
+				t.Errorf("%s: stats %+v", test.name, s)
+			}
+		}
+	}
+}
+
+func TestRetryCancel(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := testRetryPolicy(clock, RetryPolicy{Component: "cancel", Base: time.Second})
+	attempts := 0
+	err := policy.Do(ctx, func(ctx context.Context) error {
+		attempts++
+		if attempts == 2 {
+			cancel()
+		}
+		return errors.New("refused")
+	})
+	if err != context.Canceled || attempts != 2 {
+		t.Errorf("Canceled retry returned %v after %d attempts", err, attempts)
+	}
+	for _, s := range GetRetryStats() {
+		if s.Component == "cancel" && s.GiveUps != 0 {
+			t.Errorf("Cancellation counted as a give up")
+		}
+	}
+
+	// Each attempt's context times out on its own
+	err = RetryPolicy{Base: time.Millisecond, MaxAttempts: 2, AttemptTimeout: time.Millisecond}.Do(context.Background(), func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("Attempt timeout returned %v", err)
+	}
+}
+
+func TestRetrierReset(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	r := testRetryPolicy(clock, RetryPolicy{Base: time.Second, Max: 8 * time.Second, MaxAttempts: 3}).Start(context.Background())
+	failure := errors.New("refused")
+	r.Wait(failure)
+	r.Wait(failure)
+	if clock.Now() != time.Unix(3, 0) {
+		t.Errorf("Backed off to %s", clock.Now())
+	}
+	r.Reset()
+	if r.Wait(failure) != nil || clock.Now() != time.Unix(4, 0) {
+		t.Errorf("Reset didn't restart the backoff")
+	}
+	if r.Wait(failure) != nil || r.Wait(failure) != failure {
+		t.Errorf("Reset didn't restart the attempt limit")
+	}
+
+	for n, want := range []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second} {
+		if n > 0 && r.policy.Delay(n) != want {
+			t.Errorf("Delay(%d) = %s, expected %s", n, r.policy.Delay(n), want)
+		}
+	}
+	if d := (RetryPolicy{Base: time.Second}).Delay(100); d <= 0 {
+		t.Errorf("Uncapped delay overflowed to %s", d)
+	}
+}
@@ -0,0 +1,269 @@
+package wallet
+
+import (
+	"context"
+	"runtime"
+	"sync"
+
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/pkg/errors"
+)
+
+type Recipient struct {
+	Address types.Account
+	Amount  uint128.Uint128
+}
+
+type BatchOptions struct {
+	// Defaults to storing the block locally. Should only return once the
+	// block is stored, so reads after the batch see it.
+	Publish func(*blocks.SendBlock) error
+}
+
+// Store write versions after each account's last send, by address
+var lastWrites = struct {
+	sync.Mutex
+	versions map[types.Account]uint64
+}{versions: make(map[types.Account]uint64)}
+
+func noteWrite(account types.Account) {
+	lastWrites.Lock()
+	lastWrites.versions[account] = DefaultLedger.Version()
+	lastWrites.Unlock()
+}
+
+// LastWrite returns a store version that includes account's last batch
+// send, for readers to wait for, e.g. the rpc's min_version. Zero if it
+// hasn't sent this run.
+func LastWrite(account types.Account) uint64 {
+	lastWrites.Lock()
+	defer lastWrites.Unlock()
+	return lastWrites.versions[account]
+}
+
+type RecipientResult struct {
+	Recipient
+	// Nil if the send wasn't published
+	Send *blocks.SendBlock
+	// Set on the recipient the batch stopped at
+	Err error
+}
+
+type BatchResult struct {
+	// One per recipient, in order
+	Results []RecipientResult
+	// The account's head after the last published send, where a resumed
+	// batch builds on
+	Frontier types.BlockHash
+	// Recipients not paid if the batch stopped early
+	Remaining []Recipient
+}
+
+// Checks every recipient and the total, and has the batch approved as
+// one request, before taking the account's locks. Returns the request.
+func (w *Wallet) checkBatch(ctx context.Context, recipients []Recipient) (SendRequest, error) {
+	req := SendRequest{Account: w.Address(), Recipients: recipients}
+	if DefaultLedger.ReadOnly() {
+		return req, ErrLedgerReadOnly
+	}
+
+	total := uint128.FromInts(0, 0)
+	for i, r := range recipients {
+		if !address.ValidateAddress(r.Address) {
+			return req, errors.Errorf("Invalid destination %s for recipient %d", r.Address, i)
+		}
+		if isZero(r.Amount) {
+			return req, errors.Errorf("Zero amount for recipient %d", i)
+		}
+		var ok bool
+		if total, ok = addAmounts(total, r.Amount); !ok {
+			return req, errors.Wrap(ErrInsufficientBalance, "Batch")
+		}
+	}
+
+	req.Amount = total
+	err := w.checkSend(ctx, req)
+	if err != nil {
+		w.audit(req, err)
+	}
+	return req, err
+}
+
+// Checks the batch can be paid in full before anything is signed. Called
+// with the account's locks held.
+func (w *Wallet) checkBatchFunds(total uint128.Uint128) error {
+	if w.Head == nil {
+		return errors.Errorf("Cannot send from empty account")
+	}
+	if total.Compare(w.GetBalance()) > 0 {
+		return errors.Wrap(ErrInsufficientBalance, "Batch")
+	}
+	// Other sends may have spent the budget while the batch was approved
+	return w.checkDaily(total)
+}
+
+// Generates work for each root in order on a few goroutines, until stop
+// is closed. The work for roots[i] arrives on the i'th channel.
+func (w *Wallet) batchWork(roots []types.BlockHash, stop chan bool) []chan types.Work {
+	threshold := w.workThreshold()
+	works := make([]chan types.Work, len(roots))
+	for i := range works {
+		works[i] = make(chan types.Work, 1)
+	}
+
+	next := make(chan int)
+	go func() {
+		defer close(next)
+		for i := range roots {
+			select {
+			case next <- i:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for n := 0; n < runtime.NumCPU(); n++ {
+		go func() {
+			for i := range next {
+				if work, ok := Works.Get(w.PublicKey, roots[i], threshold); ok {
+					works[i] <- work
+					continue
+				}
+				works[i] <- generateWork(roots[i], threshold)
+			}
+		}()
+	}
+	return works
+}
+
+// BatchSend pays every recipient or none of them at the outset: all
+// recipients and the total are checked, and every block is signed, before
+// the first is published. Publishing stops at the first failure, leaving
+// the later blocks unpublished, and the result says where to resume.
+// Work for later blocks is generated while earlier ones publish.
+func (w *Wallet) BatchSend(recipients []Recipient, opts BatchOptions) (BatchResult, error) {
+	result := BatchResult{Remaining: recipients}
+	for _, r := range recipients {
+		result.Results = append(result.Results, RecipientResult{Recipient: r})
+	}
+	req, err := w.checkBatch(context.Background(), recipients)
+	if err != nil {
+		return result, err
+	}
+
+	f := w.lockFrontier()
+	defer f.Unlock()
+	unlock := lockSpends(w.PublicKey)
+	defer unlock()
+	if err = w.checkBatchFunds(req.Amount); err != nil {
+		w.audit(req, err)
+		return result, err
+	}
+	w.audit(req, nil)
+	result.Frontier = w.Head.Hash()
+
+	publish := opts.Publish
+	if publish == nil {
+		publish = func(send *blocks.SendBlock) error { return DefaultLedger.StoreBlock(send) }
+	}
+
+	sends := make([]*blocks.SendBlock, len(recipients))
+	roots := make([]types.BlockHash, len(recipients))
+	previous, balance := w.Head.Hash(), w.GetBalance()
+	for i, r := range recipients {
+		balance = balance.Sub(r.Amount)
+		// The signature covers the hash, which doesn't include the work
+		send := &blocks.SendBlock{previous, r.Address, balance, blocks.CommonBlock{}}
+		send.Signature = send.Hash().Sign(w.privateKey)
+		sends[i], roots[i] = send, previous
+		previous = send.Hash()
+	}
+
+	stop := make(chan bool)
+	defer close(stop)
+	var works []chan types.Work
+	if w.hasWork() {
+		first := make(chan types.Work, 1)
+		first <- *w.Work
+		works = append([]chan types.Work{first}, w.batchWork(roots[1:], stop)...)
+	} else {
+		works = w.batchWork(roots, stop)
+	}
+
+	for i, send := range sends {
+		send.Work = <-works[i]
+		err := publish(send)
+		if err != nil {
+			// Kept for the resume, which builds on the same root
+			Works.Put(w.PublicKey, send.PreviousHash, send.Work)
+			result.Results[i].Err = err
+			return result, errors.Wrapf(err, "Failed to send to recipient %d", i)
+		}
+
+		noteWrite(w.Address())
+		if err = w.recordSend(recipients[i].Amount); err != nil {
+			return result, err
+		}
+		w.advance(f, send)
+
+		result.Results[i].Send = send
+		result.Frontier = send.Hash()
+		result.Remaining = recipients[i+1:]
+	}
+
+	return result, nil
+}
+
+// ResumeBatch pays the recipients a stopped batch didn't get to, building
+// on its frontier. Sends the store already has, e.g. because a publish
+// failed after the block got through, are skipped rather than paid twice.
+func (w *Wallet) ResumeBatch(stopped BatchResult, opts BatchOptions) (BatchResult, error) {
+	result := BatchResult{Frontier: stopped.Frontier, Remaining: stopped.Remaining}
+
+	frontier := DefaultLedger.FetchBlock(stopped.Frontier)
+	if frontier == nil {
+		return result, errors.Errorf("Batch frontier %s not found", stopped.Frontier)
+	}
+	balance := DefaultLedger.GetBalance(frontier)
+
+	for len(result.Remaining) > 0 {
+		r := result.Remaining[0]
+		if r.Amount.Compare(balance) > 0 {
+			break
+		}
+		// Signing is deterministic, so a published send has the same hash
+		send := blocks.SendBlock{frontier.Hash(), r.Address, balance.Sub(r.Amount), blocks.CommonBlock{}}
+		published := DefaultLedger.FetchBlock(send.Hash())
+		if published == nil {
+			break
+		}
+		noteWrite(w.Address())
+		unlock := lockSpends(w.PublicKey)
+		err := w.recordSend(r.Amount)
+		unlock()
+		if err != nil {
+			return result, err
+		}
+		result.Results = append(result.Results, RecipientResult{Recipient: r, Send: published.(*blocks.SendBlock)})
+		frontier, balance = published, send.Balance
+		result.Frontier = published.Hash()
+		result.Remaining = result.Remaining[1:]
+	}
+
+	if DefaultLedger.Account(w.Address()).Frontier != frontier.Hash() {
+		return result, errors.Errorf("Account has moved past the batch frontier %s", frontier.Hash())
+	}
+	if len(result.Remaining) == 0 {
+		return result, nil
+	}
+
+	w.Head = frontier
+	w.Work = nil
+	resumed, err := w.BatchSend(result.Remaining, opts)
+	resumed.Results = append(result.Results, resumed.Results...)
+	return resumed, err
+}
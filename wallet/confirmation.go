@@ -0,0 +1,188 @@
+package wallet
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/pkg/errors"
+)
+
+var ErrBadConfirmationPolicy = errors.New("Bad confirmation policy")
+
+// A ConfirmationPolicy decides when a block is final enough to count,
+// e.g. to credit a payment. Each builds on cementing, so a block that
+// meets one has every earlier block in its chain meet it too.
+type ConfirmationPolicy interface {
+	Confirmed(hash types.BlockHash) bool
+	// As ParseConfirmationPolicy takes it
+	String() string
+}
+
+// Cemented counts a block as soon as it's cemented.
+var Cemented ConfirmationPolicy = cemented{}
+
+type cemented struct{}
+
+func (cemented) Confirmed(hash types.BlockHash) bool {
+	_, ok := DefaultLedger.Cemented(hash)
+	return ok
+}
+
+func (cemented) String() string {
+	return "cemented"
+}
+
+// CementedPlusDepth counts a block once depth later blocks on its account
+// are cemented too. For a payment that's the receiving account's receive
+// or open, buried under the account's later blocks.
+func CementedPlusDepth(depth uint64) ConfirmationPolicy {
+	return cementedDepth(depth)
+}
+
+type cementedDepth uint64
+
+func (d cementedDepth) Confirmed(hash types.BlockHash) bool {
+	cement, ok := DefaultLedger.Cemented(hash)
+	if !ok {
+		return false
+	}
+	height, _ := DefaultLedger.ConfirmationHeight(cement.Account)
+	return height >= cement.Height+uint64(d)
+}
+
+func (d cementedDepth) String() string {
+	return "depth:" + strconv.FormatUint(uint64(d), 10)
+}
+
+// CementedPlusDelay counts a block delay after it was cemented. Blocks
+// cemented before the time was recorded count as cemented long ago.
+func CementedPlusDelay(delay time.Duration) ConfirmationPolicy {
+	return cementedDelay(delay)
+}
+
+type cementedDelay time.Duration
+
+func (d cementedDelay) Confirmed(hash types.BlockHash) bool {
+	cement, ok := DefaultLedger.Cemented(hash)
+	return ok && (cement.Time.IsZero() || !now().Before(cement.Time.Add(time.Duration(d))))
+}
+
+func (d cementedDelay) String() string {
+	return "delay:" + time.Duration(d).String()
+}
+
+// ParseConfirmationPolicy reads "cemented", "depth:<blocks>" or
+// "delay:<duration>", e.g. "delay:10m".
+func ParseConfirmationPolicy(s string) (ConfirmationPolicy, error) {
+	name, arg := s, ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		name, arg = s[:i], s[i+1:]
+	}
+	switch name {
+	case "cemented":
+		if arg == "" {
+			return Cemented, nil
+		}
+	case "depth":
+		if depth, err := strconv.ParseUint(arg, 10, 64); err == nil {
+			return CementedPlusDepth(depth), nil
+		}
+	case "delay":
+		if delay, err := time.ParseDuration(arg); err == nil && delay >= 0 {
+			return CementedPlusDelay(delay), nil
+		}
+	}
+	return nil, errors.Wrap(ErrBadConfirmationPolicy, s)
+}
+
+// ConfirmedBalance is account's balance after its latest block policy
+// counts, zero if it counts none. Only cemented blocks can count, so it
+// looks back from the account's highest cemented block.
+func ConfirmedBalance(account types.Account, policy ConfirmationPolicy) uint128.Uint128 {
+	_, hash := DefaultLedger.ConfirmationHeight(account)
+	for hash != "" {
+		block := DefaultLedger.FetchBlock(hash)
+		if block == nil {
+			break
+		}
+		if policy.Confirmed(hash) {
+			return DefaultLedger.GetBalance(block)
+		}
+		if block.Type() == blocks.Open {
+			break
+		}
+		hash = block.PreviousBlockHash()
+	}
+	return uint128.FromInts(0, 0)
+}
+
+func (w *Wallet) ConfirmedBalance(policy ConfirmationPolicy) uint128.Uint128 {
+	return ConfirmedBalance(w.Address(), policy)
+}
+
+type confirmationWatch struct {
+	policy ConfirmationPolicy
+	fn     func(types.BlockHash)
+}
+
+// A ConfirmationWatcher calls back once blocks meet their policies, e.g.
+// to credit payments. Blocks are looked at again on Check, which should
+// be called as blocks are cemented, and now and then for policies that
+// wait on time.
+type ConfirmationWatcher struct {
+	lock    sync.Mutex
+	watches map[types.BlockHash][]confirmationWatch
+}
+
+func NewConfirmationWatcher() *ConfirmationWatcher {
+	return &ConfirmationWatcher{watches: make(map[types.BlockHash][]confirmationWatch)}
+}
+
+// Watch calls fn once hash meets policy, straight away if it already
+// does.
+func (w *ConfirmationWatcher) Watch(hash types.BlockHash, policy ConfirmationPolicy, fn func(types.BlockHash)) {
+	if policy.Confirmed(hash) {
+		fn(hash)
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.watches[hash] = append(w.watches[hash], confirmationWatch{policy, fn})
+}
+
+// Check calls back for every watched block that now meets its policy,
+// returning how many are still waiting.
+func (w *ConfirmationWatcher) Check() int {
+	w.lock.Lock()
+	var ready []func()
+	waiting := 0
+	for hash, watches := range w.watches {
+		kept := watches[:0]
+		for _, watch := range watches {
+			if watch.policy.Confirmed(hash) {
+				hash, fn := hash, watch.fn
+				ready = append(ready, func() { fn(hash) })
+			} else {
+				kept = append(kept, watch)
+			}
+		}
+		if len(kept) == 0 {
+			delete(w.watches, hash)
+		} else {
+			w.watches[hash] = kept
+		}
+		waiting += len(kept)
+	}
+	w.lock.Unlock()
+
+	// Outside the lock, so callbacks can watch more blocks
+	for _, fn := range ready {
+		fn()
+	}
+	return waiting
+}
@@ -0,0 +1,206 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/types"
+	"github.com/pkg/errors"
+)
+
+const exportVersion = 1
+
+// An Export is a plaintext copy of a keystore for moving to or from other
+// wallet software. Anyone holding one with a seed or ad hoc keys can spend
+// from the wallet.
+type Export struct {
+	Version int `json:"version"`
+	// Only included when asked for
+	Seed        string                   `json:"seed,omitempty"`
+	Accounts    []ExportAccount          `json:"accounts"`
+	AdHoc       []ExportKey              `json:"adhoc"`
+	WatchOnly   []types.Account          `json:"watch_only"`
+	AddressBook map[string]types.Account `json:"address_book"`
+	Payments    json.RawMessage          `json:"payments,omitempty"`
+}
+
+// An account derived from the seed
+type ExportAccount struct {
+	Index   uint32        `json:"index"`
+	Address types.Account `json:"address"`
+}
+
+type ExportKey struct {
+	Private string        `json:"private"`
+	Address types.Account `json:"address"`
+}
+
+// An entry of an Export that couldn't be imported
+type ImportError struct {
+	Item string
+	Err  error
+}
+
+func (e ImportError) Error() string {
+	return e.Item + ": " + e.Err.Error()
+}
+
+func seedAddress(seed string, index uint32) types.Account {
+	pub, _ := address.KeypairFromSeed(seed, index)
+	return address.PubKeyToAddress(pub)
+}
+
+func keyAddress(private string) types.Account {
+	pub, _ := address.KeypairFromPrivateKey(private)
+	return address.PubKeyToAddress(pub)
+}
+
+// Whether two addresses are for the same key, whatever their prefix.
+func sameAccount(a, b types.Account) bool {
+	pubA, errA := address.AddressToPub(a)
+	pubB, errB := address.AddressToPub(b)
+	return errA == nil && errB == nil && bytes.Equal(pubA, pubB)
+}
+
+// ExportJSON returns the keystore as an indented Export, listing the
+// first accounts derived from the seed. The same keystore always exports
+// the same document. The seed is left out unless includeSeed is set.
+func (k *Keystore) ExportJSON(password string, includeSeed bool, accounts uint32) ([]byte, error) {
+	err := k.unlock(password)
+	if err != nil {
+		return nil, err
+	}
+
+	export := Export{
+		Version:     exportVersion,
+		Accounts:    []ExportAccount{},
+		AdHoc:       []ExportKey{},
+		WatchOnly:   append([]types.Account{}, k.file.WatchOnly...),
+		AddressBook: k.file.AddressBook,
+		Payments:    k.file.Payments,
+	}
+	if includeSeed {
+		export.Seed = k.seed
+	}
+	for i := uint32(0); i < accounts; i++ {
+		export.Accounts = append(export.Accounts, ExportAccount{i, seedAddress(k.seed, i)})
+	}
+	for _, private := range k.adHoc {
+		export.AdHoc = append(export.AdHoc, ExportKey{private, keyAddress(private)})
+	}
+	return json.MarshalIndent(export, "", "  ")
+}
+
+// ImportJSON creates a keystore at path from an Export, encrypted with
+// password. Every entry is checked, and those that are invalid are left
+// out and returned as ImportErrors rather than failing the import.
+//
+// Without a usable seed a new one is generated, and the exported seed
+// accounts are kept as watch-only.
+func ImportJSON(data []byte, path string, password string, params KDFParams) (*Keystore, []ImportError, error) {
+	var export Export
+	err := json.Unmarshal(data, &export)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Invalid wallet export")
+	}
+	if export.Version != exportVersion {
+		return nil, nil, errors.Errorf("Unknown wallet export version %d", export.Version)
+	}
+	if _, err = os.Stat(path); err == nil {
+		return nil, nil, errors.Errorf("Keystore already exists at %s", path)
+	}
+
+	var problems []ImportError
+	problem := func(item string, err error) {
+		problems = append(problems, ImportError{item, err})
+	}
+
+	k := &Keystore{
+		path: path,
+		file: keystoreFile{Version: keystoreVersion, AddressBook: make(map[string]types.Account)},
+		seed: export.Seed,
+	}
+	haveSeed := validKey(k.seed)
+	if !haveSeed {
+		if k.seed != "" {
+			problem("seed", errors.New("Invalid seed"))
+		}
+		seed := make([]byte, 32)
+		if _, err = rand.Read(seed); err != nil {
+			return nil, nil, err
+		}
+		k.seed = hex.EncodeToString(seed)
+	}
+
+	watched := make(map[string]bool)
+	watch := func(account types.Account) {
+		pub, _ := address.AddressToPub(account)
+		if !watched[string(pub)] {
+			watched[string(pub)] = true
+			k.file.WatchOnly = append(k.file.WatchOnly, account)
+		}
+	}
+
+	for _, account := range export.Accounts {
+		item := fmt.Sprintf("account %d", account.Index)
+		switch {
+		case !address.ValidateAddress(account.Address):
+			problem(item, errors.New("Invalid address"))
+		case !haveSeed:
+			watch(account.Address)
+		case !sameAccount(account.Address, seedAddress(k.seed, account.Index)):
+			problem(item, errors.Errorf("Not index %d of the seed", account.Index))
+		}
+	}
+
+	for i, key := range export.AdHoc {
+		item := fmt.Sprintf("ad hoc key %d", i)
+		switch {
+		case !validKey(key.Private):
+			problem(item, errors.New("Invalid private key"))
+		case key.Address != "" && !sameAccount(key.Address, keyAddress(key.Private)):
+			problem(item, errors.New("Private key doesn't match the address"))
+		default:
+			k.adHoc = append(k.adHoc, key.Private)
+		}
+	}
+
+	for _, account := range export.WatchOnly {
+		if !address.ValidateAddress(account) {
+			problem("watch-only "+string(account), errors.New("Invalid address"))
+			continue
+		}
+		watch(account)
+	}
+
+	var names []string
+	for name := range export.AddressBook {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		account := export.AddressBook[name]
+		if !address.ValidateAddress(account) {
+			problem("address book "+name, errors.Errorf("Invalid address %s", account))
+			continue
+		}
+		k.file.AddressBook[name] = account
+	}
+	k.file.Payments = export.Payments
+
+	err = k.rekey(password, params)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = k.Save()
+	if err != nil {
+		return nil, nil, err
+	}
+	return k, problems, nil
+}
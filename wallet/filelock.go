@@ -0,0 +1,148 @@
+package wallet
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often a held lock's heartbeat is refreshed
+var LockHeartbeat = 10 * time.Second
+
+// How long after its last heartbeat a lock held from another host may be
+// taken over
+var StaleLockAge = time.Minute
+
+// Who holds a lock, as written in the lock file.
+type LockHolder struct {
+	PID  int    `json:"pid"`
+	Host string `json:"host"`
+	// Unix seconds
+	Heartbeat int64 `json:"heartbeat"`
+}
+
+// A LockedError says who holds a wallet open.
+type LockedError struct {
+	Path   string
+	Holder LockHolder
+}
+
+func (e *LockedError) Error() string {
+	if e.Holder.PID == 0 {
+		return fmt.Sprintf("Wallet %s is in use by another process", e.Path)
+	}
+	return fmt.Sprintf("Wallet %s is in use by pid %d on %s, last seen %s", e.Path, e.Holder.PID, e.Holder.Host, time.Unix(e.Holder.Heartbeat, 0).Format(time.RFC3339))
+}
+
+// A FileLock keeps other processes from opening a wallet file.
+type FileLock struct {
+	file   *os.File
+	holder LockHolder
+	done   chan bool
+	wg     sync.WaitGroup
+}
+
+// LockFile takes an advisory lock on path, held in path+".lock", and
+// keeps its heartbeat fresh until Unlock.
+//
+// The lock is an flock on the lock file where the platform has one, which
+// the kernel drops if the process dies, so after a crash the wallet can be
+// opened again straight away on the same host. The file also records the
+// holder's pid, host and heartbeat, for the error others get and for
+// filesystems shared between hosts, where flock isn't reliable: a lock
+// held from another host is only taken over once its heartbeat is
+// StaleLockAge old. If a crashed holder's host is gone for good, deleting
+// the lock file releases it at once.
+func LockFile(path string) (*FileLock, error) {
+	lockPath := path + ".lock"
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	l := &FileLock{file: file, holder: LockHolder{PID: os.Getpid(), Host: host}, done: make(chan bool)}
+
+	locked, err := flock(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	previous := readHolder(file)
+	if !locked {
+		file.Close()
+		return nil, &LockedError{path, previous}
+	}
+	// Held from another host, or here without a kernel lock to tell the
+	// holder died
+	if previous.PID != 0 && (previous.Host != host || !kernelLocks) &&
+		now().Sub(time.Unix(previous.Heartbeat, 0)) < StaleLockAge {
+		funlock(file)
+		file.Close()
+		return nil, &LockedError{path, previous}
+	}
+
+	if err = l.heartbeat(); err != nil {
+		l.release()
+		return nil, err
+	}
+	l.wg.Add(1)
+	go l.beat()
+	return l, nil
+}
+
+func readHolder(file *os.File) LockHolder {
+	var holder LockHolder
+	file.Seek(0, io.SeekStart)
+	data, err := ioutil.ReadAll(file)
+	if err == nil {
+		json.Unmarshal(data, &holder)
+	}
+	return holder
+}
+
+func (l *FileLock) heartbeat() error {
+	l.holder.Heartbeat = now().Unix()
+	data, err := json.Marshal(l.holder)
+	if err != nil {
+		return err
+	}
+	if err = l.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = l.file.WriteAt(data, 0)
+	if err == nil {
+		err = l.file.Sync()
+	}
+	return err
+}
+
+func (l *FileLock) beat() {
+	defer l.wg.Done()
+	ticker := time.NewTicker(LockHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			l.heartbeat()
+		}
+	}
+}
+
+func (l *FileLock) release() error {
+	l.file.Truncate(0)
+	funlock(l.file)
+	return l.file.Close()
+}
+
+// Unlock stops the heartbeat and releases the lock.
+func (l *FileLock) Unlock() error {
+	close(l.done)
+	l.wg.Wait()
+	return l.release()
+}
@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package wallet
+
+import "os"
+
+// Without flock the heartbeat alone guards the lock, so a crashed
+// holder's lock is only taken over once it goes stale
+const kernelLocks = false
+
+func flock(file *os.File) (bool, error) {
+	return true, nil
+}
+
+func funlock(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,207 @@
+package wallet
+
+import (
+	"sync"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+)
+
+// Blocks built on per account remembered, enough for any wallet that has
+// fallen behind in one process to catch up
+const maxBuiltBlocks = 4096
+
+// The blocks built for an account, by the root they were built on.
+// Copies of a wallet, and the wallets a keystore hands out for the same
+// account, share one and queue on it to pick their frontier and build on
+// it, one at a time and in the order they asked, so they never build on
+// the same block.
+type accountFrontier struct {
+	lock sync.Mutex
+	// Whether a wallet is building, and the turns of those waiting,
+	// oldest first
+	held    bool
+	waiting []chan bool
+	// Receives being built, by source, for duplicates to wait on
+	receiving map[types.BlockHash]*receiveCall
+
+	// Only touched in turn
+	next  map[types.BlockHash]blocks.Block
+	roots []types.BlockHash
+	// The root of each receive or open built, by its source
+	received map[types.BlockHash]types.BlockHash
+}
+
+// A receive of one source, shared by every request for it.
+type receiveCall struct {
+	done  chan bool
+	block *blocks.ReceiveBlock
+	err   error
+}
+
+func newAccountFrontier() *accountFrontier {
+	return &accountFrontier{
+		next:      make(map[types.BlockHash]blocks.Block),
+		received:  make(map[types.BlockHash]types.BlockHash),
+		receiving: make(map[types.BlockHash]*receiveCall),
+	}
+}
+
+// Lock waits for the account's turn, first come first served.
+func (f *accountFrontier) Lock() {
+	f.lock.Lock()
+	if !f.held {
+		f.held = true
+		f.lock.Unlock()
+		return
+	}
+	turn := make(chan bool)
+	f.waiting = append(f.waiting, turn)
+	f.lock.Unlock()
+	<-turn
+}
+
+// Unlock hands the turn to the longest waiting.
+func (f *accountFrontier) Unlock() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(f.waiting) == 0 {
+		f.held = false
+		return
+	}
+	close(f.waiting[0])
+	f.waiting = f.waiting[1:]
+}
+
+// Blocks being built or waiting to be.
+func (f *accountFrontier) depth() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !f.held {
+		return 0
+	}
+	return len(f.waiting) + 1
+}
+
+// Returns the receive of source already under way, or starts one if
+// first is set. The first caller must finish it with endReceive.
+func (f *accountFrontier) startReceive(source types.BlockHash) (call *receiveCall, first bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if call, ok := f.receiving[source]; ok {
+		return call, false
+	}
+	call = &receiveCall{done: make(chan bool)}
+	f.receiving[source] = call
+	return call, true
+}
+
+func (f *accountFrontier) endReceive(source types.BlockHash, call *receiveCall) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.receiving, source)
+	close(call.done)
+}
+
+// Records block as built on root. Called in turn.
+func (f *accountFrontier) built(root types.BlockHash, block blocks.Block) {
+	f.next[root] = block
+	f.roots = append(f.roots, root)
+	if source, ok := receivedSource(block); ok {
+		f.received[source] = root
+	}
+	if len(f.roots) > maxBuiltBlocks {
+		f.forget(f.roots[0])
+		f.roots = f.roots[1:]
+	}
+}
+
+// Drops the block built on root. Called in turn.
+func (f *accountFrontier) forget(root types.BlockHash) {
+	if source, ok := receivedSource(f.next[root]); ok && f.received[source] == root {
+		delete(f.received, source)
+	}
+	delete(f.next, root)
+}
+
+// The send a receive or open claims.
+func receivedSource(block blocks.Block) (types.BlockHash, bool) {
+	switch b := block.(type) {
+	case *blocks.ReceiveBlock:
+		return b.SourceHash, true
+	case *blocks.OpenBlock:
+		return b.SourceHash, true
+	}
+	return "", false
+}
+
+// lockFrontier waits for the wallet's turn on its account and moves its
+// head past the blocks wallets sharing its frontier built on it. The
+// caller builds on the head and unlocks.
+func (w *Wallet) lockFrontier() *accountFrontier {
+	if w.frontier == nil {
+		w.frontier = newAccountFrontier()
+	}
+	f := w.frontier
+	f.Lock()
+
+	root := w.root()
+	for {
+		next, ok := f.next[w.root()]
+		if !ok {
+			break
+		}
+		w.Head = next
+	}
+	if w.root() != root {
+		// The work was for the old head
+		w.Work = nil
+	}
+	return f
+}
+
+// OnBuilt, if set, is called with every block a wallet builds, e.g. for
+// the node to keep track of. It's called in the account's turn, so must
+// be quick.
+var OnBuilt func(blocks.Block)
+
+// Moves the wallet on to a block it built, with the lock held.
+func (w *Wallet) advance(f *accountFrontier, block blocks.Block) {
+	if OnBuilt != nil {
+		OnBuilt(block)
+	}
+	f.built(w.root(), block)
+	w.Head = block
+	// The work was for the previous head
+	w.Work = nil
+	Works.Remove(w.PublicKey)
+}
+
+// rollBack returns the wallet to head after the block it last built
+// wasn't published, so neither it nor the wallets sharing its frontier
+// build on that block.
+func (w *Wallet) rollBack(head blocks.Block, work *types.Work) {
+	f := w.lockFrontier()
+	defer f.Unlock()
+	w.Head, w.Work = head, work
+	f.forget(w.root())
+}
+
+// alreadyReceived reports whether source, a send to the wallet's
+// account, has been received by a block built here or in the ledger.
+// Called in turn.
+func (w *Wallet) alreadyReceived(f *accountFrontier, source types.BlockHash) bool {
+	if _, ok := f.received[source]; ok {
+		return true
+	}
+	return !DefaultLedger.IsPending(w.Address(), source)
+}
+
+// QueueDepth is how many blocks are being built or waiting to be for the
+// wallet's account, across the wallets sharing its frontier.
+func (w *Wallet) QueueDepth() int {
+	if w.frontier == nil {
+		return 0
+	}
+	return w.frontier.depth()
+}
@@ -0,0 +1,425 @@
+package wallet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/types"
+	"github.com/golang/crypto/pbkdf2"
+	"github.com/pkg/errors"
+)
+
+const keystoreVersion = 1
+const saltSize = 16
+
+var ErrBadPassword = errors.New("Incorrect keystore password")
+
+type KDFParams struct {
+	Iterations int `json:"iterations"`
+}
+
+// Keystores with weaker parameters than this are flagged for upgrade on
+// load.
+var DefaultKDFParams = KDFParams{Iterations: 100000}
+
+// What's written to disk. Secrets are hex of nonce followed by AES-GCM
+// ciphertext.
+type keystoreFile struct {
+	Version     int                      `json:"version"`
+	KDF         KDFParams                `json:"kdf"`
+	Salt        string                   `json:"salt"`
+	Seed        string                   `json:"seed"`
+	AdHoc       []string                 `json:"adhoc"`
+	WatchOnly   []types.Account          `json:"watch_only"`
+	AddressBook map[string]types.Account `json:"address_book"`
+	// Kept as is, owned by whatever tracks payments
+	Payments json.RawMessage `json:"payments,omitempty"`
+}
+
+// A Keystore is a password encrypted wallet file holding a seed and ad
+// hoc private keys, plus unencrypted watch-only accounts, an address book
+// and payment tracking state.
+type Keystore struct {
+	path  string
+	file  keystoreFile
+	key   []byte
+	seed  string
+	adHoc []string
+	// Set on load if the file's KDF parameters are weaker than
+	// DefaultKDFParams
+	UpgradeRecommended bool
+
+	frontiers     map[types.Account]*accountFrontier
+	frontiersLock sync.Mutex
+	// Held from OpenKeystore until Close
+	lock *FileLock
+}
+
+func deriveKey(password string, salt []byte, params KDFParams) []byte {
+	return pbkdf2.Key([]byte(password), salt, params.Iterations, 32, sha256.New)
+}
+
+func encryptSecret(key []byte, secret string) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(gcm.Seal(nonce, nonce, []byte(secret), nil)), nil
+}
+
+func decryptSecret(key []byte, encrypted string) (string, error) {
+	data, err := hex.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", errors.Errorf("Encrypted secret too short")
+	}
+	secret, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", ErrBadPassword
+	}
+	return string(secret), nil
+}
+
+// Seeds and private keys are 32 bytes of hex.
+func validKey(key string) bool {
+	_, err := hex.DecodeString(key)
+	return err == nil && len(key) == 64
+}
+
+func CreateKeystore(path string, password string, seed string, params KDFParams) (*Keystore, error) {
+	if !validKey(seed) {
+		return nil, errors.Errorf("Invalid seed")
+	}
+
+	k := &Keystore{
+		path: path,
+		file: keystoreFile{Version: keystoreVersion, AddressBook: make(map[string]types.Account)},
+		seed: seed,
+	}
+	err := k.rekey(password, params)
+	if err != nil {
+		return nil, err
+	}
+	return k, k.Save()
+}
+
+func LoadKeystore(path string, password string) (*Keystore, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &Keystore{path: path}
+	err = json.Unmarshal(data, &k.file)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid keystore")
+	}
+	if k.file.Version != keystoreVersion {
+		return nil, errors.Errorf("Unknown keystore version %d", k.file.Version)
+	}
+	if k.file.AddressBook == nil {
+		k.file.AddressBook = make(map[string]types.Account)
+	}
+
+	err = k.unlock(password)
+	if err != nil {
+		return nil, err
+	}
+	k.UpgradeRecommended = k.file.KDF.Iterations < DefaultKDFParams.Iterations
+	return k, nil
+}
+
+// ReadAddressBook reads a keystore's address book, which isn't encrypted,
+// without its password or lock.
+func ReadAddressBook(path string) (map[string]types.Account, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file keystoreFile
+	if err = json.Unmarshal(data, &file); err != nil {
+		return nil, errors.Wrap(err, "Invalid keystore")
+	}
+	return file.AddressBook, nil
+}
+
+// OpenKeystore locks the keystore file with LockFile, then loads it. Other
+// processes opening it get a LockedError naming this one until Close.
+func OpenKeystore(path string, password string) (*Keystore, error) {
+	lock, err := LockFile(path)
+	if err != nil {
+		return nil, err
+	}
+	k, err := LoadKeystore(path, password)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	k.lock = lock
+	return k, nil
+}
+
+// Close releases the lock taken by OpenKeystore.
+func (k *Keystore) Close() error {
+	if k.lock == nil {
+		return nil
+	}
+	lock := k.lock
+	k.lock = nil
+	return lock.Unlock()
+}
+
+// Decrypts the secrets with the file's own parameters.
+func (k *Keystore) unlock(password string) error {
+	salt, err := hex.DecodeString(k.file.Salt)
+	if err != nil {
+		return errors.Wrap(err, "Invalid keystore salt")
+	}
+	key := deriveKey(password, salt, k.file.KDF)
+
+	seed, err := decryptSecret(key, k.file.Seed)
+	if err != nil {
+		return err
+	}
+	var adHoc []string
+	for _, encrypted := range k.file.AdHoc {
+		private, err := decryptSecret(key, encrypted)
+		if err != nil {
+			return err
+		}
+		adHoc = append(adHoc, private)
+	}
+
+	k.key, k.seed, k.adHoc = key, seed, adHoc
+	return nil
+}
+
+// Derives a new key with a fresh salt and re-encrypts every secret with it.
+func (k *Keystore) rekey(password string, params KDFParams) error {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	k.key = deriveKey(password, salt, params)
+	k.file.KDF = params
+	k.file.Salt = hex.EncodeToString(salt)
+	return k.encrypt()
+}
+
+func (k *Keystore) encrypt() error {
+	seed, err := encryptSecret(k.key, k.seed)
+	if err != nil {
+		return err
+	}
+	var adHoc []string
+	for _, private := range k.adHoc {
+		encrypted, err := encryptSecret(k.key, private)
+		if err != nil {
+			return err
+		}
+		adHoc = append(adHoc, encrypted)
+	}
+	k.file.Seed, k.file.AdHoc = seed, adHoc
+	return nil
+}
+
+// Save writes the keystore to a temporary file and renames it over the
+// old one, so a crash never leaves a partially written wallet.
+func (k *Keystore) Save() error {
+	data, err := json.MarshalIndent(k.file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(k.path), filepath.Base(k.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), k.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// UpgradeEncryption re-encrypts the keystore with new KDF parameters. The
+// password is checked against the stored parameters first.
+func (k *Keystore) UpgradeEncryption(password string, params KDFParams) error {
+	err := k.unlock(password)
+	if err != nil {
+		return err
+	}
+	err = k.rekey(password, params)
+	if err != nil {
+		return err
+	}
+	err = k.Save()
+	if err != nil {
+		return err
+	}
+	k.UpgradeRecommended = params.Iterations < DefaultKDFParams.Iterations
+	return nil
+}
+
+// ChangeSeed replaces the seed, e.g. after sweeping its accounts, keeping
+// ad hoc keys, watch-only accounts, the address book and payment state.
+func (k *Keystore) ChangeSeed(password string, seed string) error {
+	if !validKey(seed) {
+		return errors.Errorf("Invalid seed")
+	}
+	err := k.unlock(password)
+	if err != nil {
+		return err
+	}
+
+	k.seed = seed
+	err = k.encrypt()
+	if err != nil {
+		return err
+	}
+	return k.Save()
+}
+
+func (k *Keystore) Wallet(index uint32) Wallet {
+	_, priv := address.KeypairFromSeed(k.seed, index)
+	return k.wallet(hex.EncodeToString(priv))
+}
+
+func (k *Keystore) AdHocWallets() []Wallet {
+	var wallets []Wallet
+	for _, private := range k.adHoc {
+		wallets = append(wallets, k.wallet(private))
+	}
+	return wallets
+}
+
+// Wallets for the same account share a frontier, so sends from them in
+// different goroutines never fork.
+func (k *Keystore) wallet(private string) Wallet {
+	w := New(private)
+	k.frontiersLock.Lock()
+	defer k.frontiersLock.Unlock()
+	if k.frontiers == nil {
+		k.frontiers = make(map[types.Account]*accountFrontier)
+	}
+	if f, ok := k.frontiers[w.Address()]; ok {
+		w.frontier = f
+	} else {
+		k.frontiers[w.Address()] = w.frontier
+	}
+	return w
+}
+
+// QueueDepths is how many blocks are being built or waiting to be for each
+// account with any, for debugging stalls.
+func (k *Keystore) QueueDepths() map[types.Account]int {
+	k.frontiersLock.Lock()
+	defer k.frontiersLock.Unlock()
+	depths := make(map[types.Account]int)
+	for account, f := range k.frontiers {
+		if depth := f.depth(); depth > 0 {
+			depths[account] = depth
+		}
+	}
+	return depths
+}
+
+// PrimeWork loads cached work for the first accounts derived from the
+// seed and the ad hoc keys in the background, so the first sends after
+// a restart don't wait on the store.
+func (k *Keystore) PrimeWork(accounts uint32) {
+	var wallets []*Wallet
+	for i := uint32(0); i < accounts; i++ {
+		w := k.Wallet(i)
+		wallets = append(wallets, &w)
+	}
+	for _, w := range k.AdHocWallets() {
+		w := w
+		wallets = append(wallets, &w)
+	}
+	go Works.Prime(wallets)
+}
+
+func (k *Keystore) AddAdHoc(private string) error {
+	if !validKey(private) {
+		return errors.Errorf("Invalid private key")
+	}
+	k.adHoc = append(k.adHoc, private)
+	err := k.encrypt()
+	if err != nil {
+		return err
+	}
+	return k.Save()
+}
+
+func (k *Keystore) WatchOnly() []types.Account {
+	return k.file.WatchOnly
+}
+
+func (k *Keystore) AddWatchOnly(account types.Account) error {
+	if !address.ValidateAddress(account) {
+		return errors.Errorf("Invalid account %s", account)
+	}
+	k.file.WatchOnly = append(k.file.WatchOnly, account)
+	return k.Save()
+}
+
+func (k *Keystore) AddressBook() map[string]types.Account {
+	return k.file.AddressBook
+}
+
+func (k *Keystore) SetAddressBookEntry(name string, account types.Account) error {
+	if !address.ValidateAddress(account) {
+		return errors.Errorf("Invalid account %s", account)
+	}
+	k.file.AddressBook[name] = account
+	return k.Save()
+}
+
+func (k *Keystore) Payments() json.RawMessage {
+	return k.file.Payments
+}
+
+func (k *Keystore) SetPayments(state json.RawMessage) error {
+	k.file.Payments = state
+	return k.Save()
+}
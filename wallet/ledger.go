@@ -0,0 +1,201 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/pkg/errors"
+)
+
+var ErrNoLedger = errors.New("Wallet has no ledger to store blocks in")
+var ErrMetaNotFound = errors.New("Key not found")
+var ErrLedgerReadOnly = errors.New("Ledger is read only, not building blocks")
+
+// What a Ledger knows of an account.
+type LedgerAccount struct {
+	Opened   bool
+	Frontier types.BlockHash
+	Balance  uint128.Uint128
+	// Unreceived sends, when the account isn't open
+	Receivable uint128.Uint128
+}
+
+// Where a cemented block is in its account's chain, and when it was
+// cemented, zero if that wasn't recorded.
+type LedgerCement struct {
+	Account types.Account
+	Height  uint64
+	Time    time.Time
+}
+
+// A Ledger is what the wallet reads and writes of the node's ledger,
+// along with its own bookkeeping. The store is used unless the wallet is
+// built with the light tag, which leaves out the store, so light clients
+// signing offline don't pull in the node's dependencies.
+type Ledger interface {
+	FetchBlock(hash types.BlockHash) blocks.Block
+	FetchOpen(account types.Account) *blocks.OpenBlock
+	GetBalance(block blocks.Block) uint128.Uint128
+	Account(account types.Account) LedgerAccount
+	// Unreceived sends, without counting them one by one
+	ReceivableTotal(account types.Account) uint128.Uint128
+	// Hashes of the account's unreceived sends, as far as listed by default
+	Pending(account types.Account) []types.BlockHash
+	// Whether the send source to account is still unreceived
+	IsPending(account types.Account, source types.BlockHash) bool
+	// ok is false until the block's cemented
+	Cemented(hash types.BlockHash) (cement LedgerCement, ok bool)
+	// The account's highest cemented block and its height, 0 if none are
+	ConfirmationHeight(account types.Account) (height uint64, frontier types.BlockHash)
+	// The version work on top of hash is checked at, zero when unknown,
+	// which gets the current rules
+	BlockVersion(hash types.BlockHash) blocks.AccountVersion
+	// Must only return once the block can be read back
+	StoreBlock(block blocks.Block) error
+	// While set, wallets build no blocks, as they couldn't be stored
+	ReadOnly() bool
+	// Counts stored blocks, for readers to wait on
+	Version() uint64
+
+	// Gob encoded bookkeeping, as the store's meta values
+	FetchMeta(prefix string, key []byte, v interface{}) error
+	StoreMeta(prefix string, key []byte, v interface{}) error
+	DeleteMeta(prefix string, key []byte) error
+	IterateMeta(prefix string, fn func(key []byte, value []byte) error) error
+}
+
+// DefaultLedger is used by every wallet. Light builds start with an
+// OfflineLedger.
+var DefaultLedger Ledger = NewOfflineLedger()
+
+// OfflineLedger knows no blocks and keeps the wallet's bookkeeping in
+// memory, for wallets that only sign. Embed it to fill in the blocks from
+// elsewhere, e.g. a remote node.
+type OfflineLedger struct {
+	lock sync.Mutex
+	meta map[string][]byte
+}
+
+func NewOfflineLedger() *OfflineLedger {
+	return &OfflineLedger{meta: make(map[string][]byte)}
+}
+
+func (l *OfflineLedger) FetchBlock(hash types.BlockHash) blocks.Block {
+	return nil
+}
+
+func (l *OfflineLedger) FetchOpen(account types.Account) *blocks.OpenBlock {
+	return nil
+}
+
+func (l *OfflineLedger) GetBalance(block blocks.Block) uint128.Uint128 {
+	if send, ok := block.(*blocks.SendBlock); ok {
+		return send.Balance
+	}
+	return uint128.FromInts(0, 0)
+}
+
+func (l *OfflineLedger) Account(account types.Account) LedgerAccount {
+	return LedgerAccount{}
+}
+
+func (l *OfflineLedger) ReceivableTotal(account types.Account) uint128.Uint128 {
+	return uint128.FromInts(0, 0)
+}
+
+func (l *OfflineLedger) Pending(account types.Account) []types.BlockHash {
+	return nil
+}
+
+// Knowing nothing of what's been received, every send might still be.
+func (l *OfflineLedger) IsPending(account types.Account, source types.BlockHash) bool {
+	return true
+}
+
+func (l *OfflineLedger) Cemented(hash types.BlockHash) (LedgerCement, bool) {
+	return LedgerCement{}, false
+}
+
+func (l *OfflineLedger) ConfirmationHeight(account types.Account) (uint64, types.BlockHash) {
+	return 0, ""
+}
+
+func (l *OfflineLedger) BlockVersion(hash types.BlockHash) blocks.AccountVersion {
+	return 0
+}
+
+func (l *OfflineLedger) StoreBlock(block blocks.Block) error {
+	return ErrNoLedger
+}
+
+func (l *OfflineLedger) ReadOnly() bool {
+	return false
+}
+
+func (l *OfflineLedger) Version() uint64 {
+	return 0
+}
+
+func offlineMetaKey(prefix string, key []byte) string {
+	return prefix + ":" + string(key)
+}
+
+func (l *OfflineLedger) FetchMeta(prefix string, key []byte, v interface{}) error {
+	l.lock.Lock()
+	value, ok := l.meta[offlineMetaKey(prefix, key)]
+	l.lock.Unlock()
+	if !ok {
+		return ErrMetaNotFound
+	}
+	return gob.NewDecoder(bytes.NewReader(value)).Decode(v)
+}
+
+func (l *OfflineLedger) StoreMeta(prefix string, key []byte, v interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.meta[offlineMetaKey(prefix, key)] = buf.Bytes()
+	return nil
+}
+
+func (l *OfflineLedger) DeleteMeta(prefix string, key []byte) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.meta, offlineMetaKey(prefix, key))
+	return nil
+}
+
+// In key order, as the store does.
+func (l *OfflineLedger) IterateMeta(prefix string, fn func(key []byte, value []byte) error) error {
+	start := offlineMetaKey(prefix, nil)
+	l.lock.Lock()
+	var keys []string
+	for k := range l.meta {
+		if strings.HasPrefix(k, start) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	values := make([][]byte, len(keys))
+	for i, k := range keys {
+		values[i] = l.meta[k]
+	}
+	l.lock.Unlock()
+
+	for i, k := range keys {
+		if err := fn([]byte(k[len(start):]), values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
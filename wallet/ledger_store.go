@@ -0,0 +1,109 @@
+//go:build !light
+// +build !light
+
+package wallet
+
+import (
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+)
+
+// The node's own store.
+type storeLedger struct{}
+
+func init() {
+	DefaultLedger = storeLedger{}
+}
+
+func (storeLedger) FetchBlock(hash types.BlockHash) blocks.Block {
+	return store.FetchBlock(hash)
+}
+
+func (storeLedger) FetchOpen(account types.Account) *blocks.OpenBlock {
+	return store.FetchOpen(account)
+}
+
+func (storeLedger) GetBalance(block blocks.Block) uint128.Uint128 {
+	return store.GetBalance(block)
+}
+
+func (storeLedger) Account(account types.Account) LedgerAccount {
+	status := store.GetAccountStatus(account)
+	return LedgerAccount{
+		Opened:     status.State == store.AccountOpened,
+		Frontier:   status.Frontier,
+		Balance:    status.Balance,
+		Receivable: status.ReceivableTotal,
+	}
+}
+
+func (storeLedger) ReceivableTotal(account types.Account) uint128.Uint128 {
+	return store.ReceivableTotal(account)
+}
+
+// Leaves out the cold bucket, as the store's listings do.
+func (storeLedger) Pending(account types.Account) []types.BlockHash {
+	var hashes []types.BlockHash
+	var after types.BlockHash
+	for {
+		page, more, err := store.PendingPage(account, after, 1000)
+		if err != nil {
+			return hashes
+		}
+		for _, r := range page {
+			hashes = append(hashes, r.Hash)
+		}
+		if !more {
+			return hashes
+		}
+		after = page[len(page)-1].Hash
+	}
+}
+
+func (storeLedger) IsPending(account types.Account, source types.BlockHash) bool {
+	return store.IsPending(account, source)
+}
+
+func (storeLedger) Cemented(hash types.BlockHash) (LedgerCement, bool) {
+	cement, ok := store.FetchCemented(hash)
+	return LedgerCement(cement), ok
+}
+
+func (storeLedger) ConfirmationHeight(account types.Account) (uint64, types.BlockHash) {
+	confirmed := store.FetchConfirmationHeight(account)
+	return confirmed.Height, confirmed.Frontier
+}
+
+func (storeLedger) BlockVersion(hash types.BlockHash) blocks.AccountVersion {
+	return store.BlockVersion(hash)
+}
+
+func (storeLedger) StoreBlock(block blocks.Block) error {
+	return store.StoreBlock(block)
+}
+
+func (storeLedger) ReadOnly() bool {
+	return store.ReadOnly()
+}
+
+func (storeLedger) Version() uint64 {
+	return store.Version()
+}
+
+func (storeLedger) FetchMeta(prefix string, key []byte, v interface{}) error {
+	return store.FetchMeta(prefix, key, v)
+}
+
+func (storeLedger) StoreMeta(prefix string, key []byte, v interface{}) error {
+	return store.StoreMeta(prefix, key, v)
+}
+
+func (storeLedger) DeleteMeta(prefix string, key []byte) error {
+	return store.DeleteMeta(prefix, key)
+}
+
+func (storeLedger) IterateMeta(prefix string, fn func(key []byte, value []byte) error) error {
+	return store.IterateMeta(prefix, fn)
+}
@@ -0,0 +1,185 @@
+package wallet
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/frankh/nano/utils"
+	"github.com/pkg/errors"
+)
+
+const spendWindow = 24 * time.Hour
+const spendPrefix = "spends"
+
+var ErrOverTransactionLimit = errors.New("Send exceeds the per transaction limit")
+var ErrOverDailyLimit = errors.New("Send exceeds the rolling 24h limit")
+
+// Zero values disable the corresponding limit.
+type SpendingLimits struct {
+	PerTransaction uint128.Uint128
+	Daily          uint128.Uint128
+}
+
+// SendPolicy is what a wallet made by NewWithPolicy checks its sends
+// against, and who it tells about them.
+type SendPolicy struct {
+	Limits SpendingLimits
+	// Nil approves every send within the limits
+	Approve ApprovalFn
+	// Nil for no audit trail
+	Audit func(AuditEvent)
+}
+
+// SendRequest is what approval hooks and audit events see for a send
+// that is about to be signed.
+type SendRequest struct {
+	Account types.Account
+	// Empty for a batch
+	Destination types.Account
+	// The total, for a batch
+	Amount uint128.Uint128
+	// Set for a batch, which is approved as one request
+	Recipients []Recipient
+}
+
+// An ApprovalFn can veto a send by returning an error, e.g. to require
+// out-of-band confirmation before the block is signed.
+type ApprovalFn func(ctx context.Context, req SendRequest) error
+
+type AuditEvent struct {
+	SendRequest
+	Time    time.Time
+	Allowed bool
+	Err     error
+}
+
+type spendRecord struct {
+	Time   int64
+	Amount uint128.Uint128
+}
+
+// Overridden in tests
+var now = time.Now
+
+// Each account's lock on its spends, held from checking a send against
+// the daily limit until it's recorded, so sends at once, even from
+// separate wallets on the account, can't both fit in what's left.
+var spendLocks = struct {
+	sync.Mutex
+	byAccount map[string]*sync.Mutex
+}{byAccount: make(map[string]*sync.Mutex)}
+
+// Takes the account's spend lock, returning the unlock.
+func lockSpends(pub []byte) func() {
+	spendLocks.Lock()
+	lock := spendLocks.byAccount[string(pub)]
+	if lock == nil {
+		lock = &sync.Mutex{}
+		spendLocks.byAccount[string(pub)] = lock
+	}
+	spendLocks.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+func (w *Wallet) loadSpends() []spendRecord {
+	var spends []spendRecord
+	DefaultLedger.FetchMeta(spendPrefix, w.PublicKey, &spends)
+	return spends
+}
+
+// Sum of everything sent in the last 24h, dropping older records.
+func recentSpends(spends []spendRecord, at time.Time) ([]spendRecord, uint128.Uint128) {
+	cutoff := at.Add(-spendWindow).UnixNano()
+	total := uint128.FromInts(0, 0)
+	recent := spends[:0]
+
+	for _, s := range spends {
+		if s.Time > cutoff {
+			recent = append(recent, s)
+			total = total.Add(s.Amount)
+		}
+	}
+
+	return recent, total
+}
+
+func isZero(u uint128.Uint128) bool {
+	return u.Hi == 0 && u.Lo == 0
+}
+
+// Checks limits and the approval hook. Nothing is recorded here so a
+// denied send never consumes any of the rolling budget. Called before
+// taking the account's locks, so an approval that waits on a person
+// holds up no other sends. The daily limit is checked again under them.
+func (w *Wallet) checkSend(ctx context.Context, req SendRequest) error {
+	limits := w.policy.Limits
+	amounts := []uint128.Uint128{req.Amount}
+	if req.Recipients != nil {
+		amounts = amounts[:0]
+		for _, r := range req.Recipients {
+			amounts = append(amounts, r.Amount)
+		}
+	}
+	for _, amount := range amounts {
+		if !isZero(limits.PerTransaction) && amount.Compare(limits.PerTransaction) > 0 {
+			return ErrOverTransactionLimit
+		}
+	}
+
+	if err := w.checkDaily(req.Amount); err != nil {
+		return err
+	}
+
+	if w.policy.Approve != nil {
+		var err error
+		// A panicking or disabled hook denies the send
+		guardErr := w.hookGuard().Call(func() { err = w.policy.Approve(ctx, req) })
+		if guardErr != nil {
+			err = guardErr
+		}
+		if err != nil {
+			return errors.Wrap(err, "Send not approved")
+		}
+	}
+
+	return nil
+}
+
+func (w *Wallet) checkDaily(amount uint128.Uint128) error {
+	daily := w.policy.Limits.Daily
+	if isZero(daily) {
+		return nil
+	}
+	_, spent := recentSpends(w.loadSpends(), now())
+	// Compare via the remaining budget to avoid overflowing spent + amount
+	if spent.Compare(daily) > 0 || amount.Compare(daily.Sub(spent)) > 0 {
+		return ErrOverDailyLimit
+	}
+	return nil
+}
+
+// Adds a send to the rolling budget. Called with the spend lock held.
+func (w *Wallet) recordSend(amount uint128.Uint128) error {
+	at := now()
+	spends, _ := recentSpends(w.loadSpends(), at)
+	spends = append(spends, spendRecord{at.UnixNano(), amount})
+	return DefaultLedger.StoreMeta(spendPrefix, w.PublicKey, spends)
+}
+
+func (w *Wallet) audit(req SendRequest, err error) {
+	if w.policy.Audit == nil {
+		return
+	}
+	w.hookGuard().Call(func() { w.policy.Audit(AuditEvent{req, now(), err == nil, err}) })
+}
+
+func (w *Wallet) hookGuard() *utils.Guard {
+	if w.hooks == nil {
+		w.hooks = utils.NewGuard("wallet "+string(w.Address()), utils.DefaultMaxPanics)
+	}
+	return w.hooks
+}
@@ -0,0 +1,98 @@
+package wallet
+
+import (
+	"sort"
+	"time"
+
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+)
+
+// Share of the total weight above which a representative counts as
+// concentrated: delegating more to it harms decentralization
+var ConcentrationThreshold = 0.03
+
+// RepresentativeMetrics describes a representative from the ledger and
+// the node's own observations of its votes.
+type RepresentativeMetrics struct {
+	Representative types.Account
+	Weight         uint128.Uint128
+	// Share of the recent elections it voted in
+	Participation float64
+	// Share of the time since its first vote seen that it kept voting
+	Uptime              float64
+	FirstVote, LastVote time.Time
+
+	// Filled in when ranking
+	WeightShare  float64
+	Concentrated bool
+	Score        float64
+}
+
+// A RepScorer rates a representative, higher is better.
+type RepScorer func(RepresentativeMetrics) float64
+
+// Mostly voting when asked, partly having kept at it.
+func DefaultRepScore(m RepresentativeMetrics) float64 {
+	return 0.7*m.Participation + 0.3*m.Uptime
+}
+
+// Where representative metrics come from, set by the node, which sees the
+// votes. Nil for none.
+var RepresentativeSource func() []RepresentativeMetrics
+
+func toFloat(u uint128.Uint128) float64 {
+	return float64(u.Hi)*(1<<64) + float64(u.Lo)
+}
+
+// RankRepresentatives scores every representative from
+// RepresentativeSource with score, DefaultRepScore if nil, and returns
+// the best n. Ties go to the smaller representative. With excludeTop,
+// concentrated representatives are left out.
+func RankRepresentatives(n int, excludeTop bool, score RepScorer) []RepresentativeMetrics {
+	if RepresentativeSource == nil {
+		return nil
+	}
+	if score == nil {
+		score = DefaultRepScore
+	}
+
+	reps := RepresentativeSource()
+	total := uint128.FromInts(0, 0)
+	for _, m := range reps {
+		total = total.Add(m.Weight)
+	}
+
+	ranked := []RepresentativeMetrics{}
+	for _, m := range reps {
+		if !isZero(total) {
+			m.WeightShare = toFloat(m.Weight) / toFloat(total)
+		}
+		m.Concentrated = m.WeightShare > ConcentrationThreshold
+		if excludeTop && m.Concentrated {
+			continue
+		}
+		m.Score = score(m)
+		ranked = append(ranked, m)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if c := a.Weight.Compare(b.Weight); c != 0 {
+			return c < 0
+		}
+		return a.Representative < b.Representative
+	})
+	if n < len(ranked) {
+		ranked = ranked[:n]
+	}
+	return ranked
+}
+
+// RecommendRepresentatives ranks representatives for the wallet to pick
+// from, scored by ScoreRepresentative if it's set.
+func (w *Wallet) RecommendRepresentatives(n int, excludeTop bool) []RepresentativeMetrics {
+	return RankRepresentatives(n, excludeTop, w.ScoreRepresentative)
+}
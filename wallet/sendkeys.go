@@ -0,0 +1,47 @@
+package wallet
+
+import (
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/pkg/errors"
+)
+
+// The send each idempotency key made, by public key and idempotency key
+const sendKeyPrefix = "sendkeys"
+
+var ErrSendKeyReused = errors.New("Idempotency key already used for another send")
+
+type keyedSend struct {
+	Amount uint128.Uint128
+	Send   blocks.SendBlock
+}
+
+func (w *Wallet) sendKey(key string) []byte {
+	return append(append([]byte{}, w.PublicKey...), key...)
+}
+
+// The send key already made, nil if it hasn't been used. Reusing it for
+// a different send is an error.
+func (w *Wallet) keyedSend(key string, destination types.Account, amount uint128.Uint128) (*blocks.SendBlock, error) {
+	if key == "" {
+		return nil, nil
+	}
+	var sent keyedSend
+	if DefaultLedger.FetchMeta(sendKeyPrefix, w.sendKey(key), &sent) != nil {
+		return nil, nil
+	}
+	if sent.Send.Destination != destination || sent.Amount != amount {
+		return nil, ErrSendKeyReused
+	}
+	return &sent.Send, nil
+}
+
+// Uses up key on send. Called with the spend lock held, once the send is
+// signed, so a send that fails before then leaves the key unused.
+func (w *Wallet) recordSendKey(key string, amount uint128.Uint128, send *blocks.SendBlock) error {
+	if key == "" {
+		return nil
+	}
+	return DefaultLedger.StoreMeta(sendKeyPrefix, w.sendKey(key), keyedSend{amount, *send})
+}
@@ -0,0 +1,131 @@
+package wallet
+
+import (
+	"sort"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/pkg/errors"
+)
+
+type SplitStrategy int
+
+const (
+	// Fewest sends
+	LargestFirst SplitStrategy = iota
+	// Empties small accounts first to consolidate dust
+	SmallestFirst
+)
+
+type SplitOptions struct {
+	Strategy SplitStrategy
+	// Defaults to storing the block locally
+	Publish func(*blocks.SendBlock) error
+	// Optionally blocks until a send is confirmed before the next one
+	WaitConfirmed func(*blocks.SendBlock) error
+}
+
+type SplitPart struct {
+	Wallet *Wallet
+	Amount uint128.Uint128
+}
+
+type SplitResult struct {
+	// Sends that were published, in order
+	Sent []*blocks.SendBlock
+	// Amount still to send if the split stopped early
+	Remaining uint128.Uint128
+}
+
+// PlanSplit chooses which wallets pay how much of amount.
+func PlanSplit(wallets []*Wallet, amount uint128.Uint128, strategy SplitStrategy) ([]SplitPart, error) {
+	sorted := make([]*Wallet, 0, len(wallets))
+	balances := make(map[*Wallet]uint128.Uint128)
+	for _, w := range wallets {
+		balance := w.GetBalance()
+		if isZero(balance) {
+			continue
+		}
+		balances[w] = balance
+		sorted = append(sorted, w)
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		cmp := balances[sorted[i]].Compare(balances[sorted[j]])
+		if strategy == SmallestFirst {
+			return cmp < 0
+		}
+		return cmp > 0
+	})
+
+	var parts []SplitPart
+	remaining := amount
+	for _, w := range sorted {
+		if isZero(remaining) {
+			break
+		}
+		part := balances[w]
+		if part.Compare(remaining) > 0 {
+			part = remaining
+		}
+		parts = append(parts, SplitPart{w, part})
+		remaining = remaining.Sub(part)
+	}
+
+	if !isZero(remaining) {
+		return nil, errors.Errorf("Insufficient balance, short by %s", remaining)
+	}
+	return parts, nil
+}
+
+// SendFrom pays amount to destination from as many of the wallets as
+// needed, one send each. If a send fails the result says what was sent so
+// the caller can resume with the remaining amount.
+func SendFrom(wallets []*Wallet, destination types.Account, amount uint128.Uint128, opts SplitOptions) (SplitResult, error) {
+	result := SplitResult{Remaining: amount}
+	parts, err := PlanSplit(wallets, amount, opts.Strategy)
+	if err != nil {
+		return result, err
+	}
+
+	publish := opts.Publish
+	if publish == nil {
+		publish = func(send *blocks.SendBlock) error { return DefaultLedger.StoreBlock(send) }
+	}
+
+	for _, part := range parts {
+		w := part.Wallet
+		if w.Work == nil {
+			err = w.GeneratePowSync()
+			if err != nil {
+				return result, errors.Wrapf(err, "Failed to generate work for %s", w.Address())
+			}
+		}
+
+		head, work := w.Head, w.Work
+		send, err := w.Send(destination, part.Amount)
+		if err == nil {
+			err = publish(send)
+			if err != nil {
+				// Unpublished, so the wallet can retry from the same head
+				w.rollBack(head, work)
+			}
+		}
+		if err != nil {
+			return result, errors.Wrapf(err, "Failed to send from %s", w.Address())
+		}
+
+		result.Sent = append(result.Sent, send)
+		result.Remaining = result.Remaining.Sub(part.Amount)
+
+		if opts.WaitConfirmed != nil {
+			err = opts.WaitConfirmed(send)
+			if err != nil {
+				return result, errors.Wrapf(err, "Send %s not confirmed", send.Hash())
+			}
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,286 @@
+package wallet
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+
+	"github.com/frankh/crypto/ed25519"
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+	"github.com/pkg/errors"
+)
+
+var ErrBadFacts = errors.New("Bad account facts")
+
+// AccountFacts are what an offline machine sweeping an account needs to
+// know of it, exported by an online one with ExportAccountFacts. Amounts
+// are decimal raw.
+type AccountFacts struct {
+	// Where the account is derived from the seed
+	Index   uint32        `json:"index"`
+	Account types.Account `json:"account"`
+	// Empty for an account that was never opened
+	Frontier types.BlockHash `json:"frontier,omitempty"`
+	Balance  string          `json:"balance"`
+	Pending  []PendingFact   `json:"pending"`
+	// The sum of Pending, to check it by
+	Receivable string `json:"receivable"`
+	// What work on top of Frontier is checked at. Left out, it's the
+	// current rules, which are enough at any version.
+	Version blocks.AccountVersion `json:"version,omitempty"`
+}
+
+// An unreceived send to the account.
+type PendingFact struct {
+	Hash   types.BlockHash `json:"hash"`
+	Amount string          `json:"amount"`
+}
+
+// A WorkProvider finds work for root meeting threshold, e.g. from a work
+// server.
+type WorkProvider func(root types.BlockHash, threshold uint64) (types.Work, error)
+
+// ExportAccountFacts reads what OfflineSweep needs of the account at
+// index from the ledger, every pending send up to the ledger's default
+// listing.
+func ExportAccountFacts(index uint32, account types.Account) (AccountFacts, error) {
+	if _, err := address.AddressToPub(account); err != nil {
+		return AccountFacts{}, err
+	}
+	info := DefaultLedger.Account(account)
+	facts := AccountFacts{
+		Index:    index,
+		Account:  account,
+		Frontier: info.Frontier,
+		Balance:  info.Balance.Decimal(),
+		Pending:  []PendingFact{},
+	}
+	if !info.Opened {
+		facts.Frontier, facts.Balance = "", "0"
+	} else {
+		facts.Version = DefaultLedger.BlockVersion(info.Frontier)
+	}
+	receivable := uint128.FromInts(0, 0)
+	for _, hash := range DefaultLedger.Pending(account) {
+		send, ok := DefaultLedger.FetchBlock(hash).(*blocks.SendBlock)
+		if !ok {
+			return AccountFacts{}, errors.Errorf("Pending block %s isn't a send", hash)
+		}
+		previous := DefaultLedger.FetchBlock(send.PreviousHash)
+		if previous == nil {
+			return AccountFacts{}, errors.Errorf("Can't find the amount of %s", hash)
+		}
+		amount := DefaultLedger.GetBalance(previous).Sub(send.Balance)
+		facts.Pending = append(facts.Pending, PendingFact{hash, amount.Decimal()})
+		receivable = receivable.Add(amount)
+	}
+	facts.Receivable = receivable.Decimal()
+	return facts, nil
+}
+
+// Parses a decimal amount of the facts, naming field if it's bad.
+func factAmount(facts AccountFacts, field string, s string) (uint128.Uint128, error) {
+	amount, err := uint128.FromDecimal(s)
+	if err != nil {
+		return amount, errors.Wrapf(ErrBadFacts, "%s: bad %s %q", facts.Account, field, s)
+	}
+	return amount, nil
+}
+
+// Sums a and b, failing rather than wrapping.
+func addAmounts(a uint128.Uint128, b uint128.Uint128) (uint128.Uint128, bool) {
+	sum := a.Add(b)
+	return sum, sum.Compare(a) >= 0
+}
+
+// Checks the facts hang together, as there's no ledger to check them
+// against, returning the account's private key and the total to sweep.
+func checkFacts(seed string, facts AccountFacts, seen map[types.BlockHash]bool) (ed25519.PrivateKey, uint128.Uint128, error) {
+	zero := uint128.FromInts(0, 0)
+	bad := func(format string, args ...interface{}) (ed25519.PrivateKey, uint128.Uint128, error) {
+		return nil, zero, errors.Wrapf(ErrBadFacts, "%s: "+format, append([]interface{}{facts.Account}, args...)...)
+	}
+	if _, err := address.AddressToPub(facts.Account); err != nil {
+		return bad("bad account")
+	}
+	if seedAddress(seed, facts.Index) != facts.Account {
+		return bad("not index %d of the seed", facts.Index)
+	}
+	if facts.Frontier != "" && facts.Frontier.Validate() != nil {
+		return bad("bad frontier %q", facts.Frontier)
+	}
+
+	balance, err := factAmount(facts, "balance", facts.Balance)
+	if err != nil {
+		return nil, zero, err
+	}
+	if facts.Frontier == "" && balance.Compare(zero) != 0 {
+		return bad("balance without a frontier")
+	}
+	receivable := zero
+	for _, p := range facts.Pending {
+		if p.Hash.Validate() != nil {
+			return bad("bad pending hash %q", p.Hash)
+		}
+		if seen[p.Hash] {
+			return bad("pending %s listed twice", p.Hash)
+		}
+		seen[p.Hash] = true
+		amount, err := factAmount(facts, "pending amount", p.Amount)
+		if err != nil {
+			return nil, zero, err
+		}
+		if amount.Compare(zero) == 0 {
+			return bad("nothing pending in %s", p.Hash)
+		}
+		var ok bool
+		if receivable, ok = addAmounts(receivable, amount); !ok {
+			return bad("pending overflows")
+		}
+	}
+	expected, err := factAmount(facts, "receivable", facts.Receivable)
+	if err != nil {
+		return nil, zero, err
+	}
+	if expected.Compare(receivable) != 0 {
+		return bad("receivable %s isn't the pending sum %s", expected.Decimal(), receivable.Decimal())
+	}
+	total, ok := addAmounts(balance, receivable)
+	if !ok {
+		return bad("balance overflows")
+	}
+	_, priv := address.KeypairFromSeed(seed, facts.Index)
+	return priv, total, nil
+}
+
+// OfflineSweep builds the blocks moving everything in the accounts, held
+// and pending, to dest: for each account, receives of its pending sends,
+// opening it with dest as representative if need be, then a send of the
+// lot. It needs no ledger, only the facts, which are checked against
+// each other and the seed first. Every block is signed with work from
+// work, or generated here if it's nil, and they're in the order they must
+// be processed.
+func OfflineSweep(seed string, ledgerFacts []AccountFacts, dest types.Account, work WorkProvider) ([]blocks.Block, error) {
+	if !validKey(seed) {
+		return nil, errors.New("Bad seed")
+	}
+	if _, err := address.AddressToPub(dest); err != nil {
+		return nil, errors.Wrap(err, "Bad destination")
+	}
+	if work == nil {
+		work = func(root types.BlockHash, threshold uint64) (types.Work, error) {
+			return generateWork(root, threshold), nil
+		}
+	}
+
+	keys := make([]ed25519.PrivateKey, len(ledgerFacts))
+	totals := make([]uint128.Uint128, len(ledgerFacts))
+	accounts := make(map[types.Account]bool)
+	seen := make(map[types.BlockHash]bool)
+	for i, facts := range ledgerFacts {
+		if accounts[facts.Account] {
+			return nil, errors.Wrapf(ErrBadFacts, "%s: listed twice", facts.Account)
+		}
+		accounts[facts.Account] = true
+		var err error
+		if keys[i], totals[i], err = checkFacts(seed, facts, seen); err != nil {
+			return nil, err
+		}
+	}
+
+	var swept []blocks.Block
+	for i, facts := range ledgerFacts {
+		if facts.Account == dest || totals[i].Compare(uint128.FromInts(0, 0)) == 0 {
+			continue
+		}
+		priv := keys[i]
+		previous := facts.Frontier
+		// Opens, and so the rest of their chain, are at the first version
+		version := facts.Version
+		if previous == "" {
+			version = blocks.Epoch1
+		}
+		root := func() types.BlockHash {
+			if previous == "" {
+				pub, _ := address.AddressToPub(facts.Account)
+				return types.BlockHashFromBytes(pub)
+			}
+			return previous
+		}
+		sign := func(block blocks.Block) error {
+			w, err := work(root(), blocks.RequiredDifficulty(version))
+			if err != nil {
+				return errors.Wrapf(err, "No work for %s", facts.Account)
+			}
+			switch b := block.(type) {
+			case *blocks.OpenBlock:
+				b.Work = w
+				b.Signature = b.Hash().Sign(priv)
+			case *blocks.ReceiveBlock:
+				b.Work = w
+				b.Signature = b.Hash().Sign(priv)
+			case *blocks.SendBlock:
+				b.Work = w
+				b.Signature = b.Hash().Sign(priv)
+			}
+			if !blocks.ValidateBlockWorkAt(block, version) {
+				return errors.Errorf("Work for %s is too low", facts.Account)
+			}
+			swept = append(swept, block)
+			previous = block.Hash()
+			return nil
+		}
+
+		for _, p := range facts.Pending {
+			var block blocks.Block
+			if previous == "" {
+				block = &blocks.OpenBlock{SourceHash: p.Hash, Representative: dest, Account: facts.Account}
+			} else {
+				block = &blocks.ReceiveBlock{PreviousHash: previous, SourceHash: p.Hash}
+			}
+			if err := sign(block); err != nil {
+				return nil, err
+			}
+		}
+		if err := sign(&blocks.SendBlock{PreviousHash: previous, Destination: dest, Balance: uint128.FromInts(0, 0)}); err != nil {
+			return nil, err
+		}
+	}
+	return swept, nil
+}
+
+// WriteBlockFile writes blocks as JSON, one per line, as ReadBlockFile
+// and the process rpc read them.
+func WriteBlockFile(w io.Writer, swept []blocks.Block) error {
+	bw := bufio.NewWriter(w)
+	for _, block := range swept {
+		line, err := json.Marshal(blocks.ToRaw(block))
+		if err != nil {
+			return err
+		}
+		bw.Write(line)
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// ReadBlockFile reads the blocks WriteBlockFile wrote, in order.
+func ReadBlockFile(r io.Reader) ([]blocks.Block, error) {
+	var read []blocks.Block
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), blocks.MaxBlockJSONSize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		block, err := blocks.ParseJson(scanner.Bytes())
+		if err != nil {
+			return nil, errors.Wrapf(err, "Line %d", line)
+		}
+		read = append(read, block)
+	}
+	return read, scanner.Err()
+}
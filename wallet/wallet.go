@@ -1,23 +1,37 @@
 package wallet
 
 import (
+	"context"
 	"encoding/hex"
+	"fmt"
 
 	"github.com/frankh/crypto/ed25519"
 	"github.com/frankh/nano/address"
 	"github.com/frankh/nano/blocks"
-	"github.com/frankh/nano/store"
 	"github.com/frankh/nano/types"
 	"github.com/frankh/nano/uint128"
+	"github.com/frankh/nano/utils"
 	"github.com/pkg/errors"
 )
 
+var ErrInsufficientBalance = errors.New("Tried to send more than balance")
+var ErrAlreadyReceived = errors.New("Source already received")
+
 type Wallet struct {
 	privateKey ed25519.PrivateKey
 	PublicKey  ed25519.PublicKey
 	Head       blocks.Block
 	Work       *types.Work
 	PoWchan    chan types.Work
+	// Set by NewWithPolicy and fixed from then on
+	policy SendPolicy
+	// Ranks representatives for RecommendRepresentatives, DefaultRepScore
+	// if nil
+	ScoreRepresentative RepScorer
+	// Recovers panics in the policy's Approve and Audit
+	hooks *utils.Guard
+	// Shared by copies of the wallet, so they take turns building blocks
+	frontier *accountFrontier
 }
 
 func (w *Wallet) Address() types.Account {
@@ -26,9 +40,10 @@ func (w *Wallet) Address() types.Account {
 
 func New(private string) (w Wallet) {
 	w.PublicKey, w.privateKey = address.KeypairFromPrivateKey(private)
+	w.frontier = newAccountFrontier()
 	account := address.PubKeyToAddress(w.PublicKey)
 
-	open := store.FetchOpen(account)
+	open := DefaultLedger.FetchOpen(account)
 	if open != nil {
 		w.Head = open
 	}
@@ -36,6 +51,15 @@ func New(private string) (w Wallet) {
 	return w
 }
 
+// NewWithPolicy is New for a wallet whose sends are held to policy. The
+// policy can't be changed once the wallet is made, so whoever is handed
+// the wallet can't lift its limits or drop its hooks.
+func NewWithPolicy(private string, policy SendPolicy) Wallet {
+	w := New(private)
+	w.policy = policy
+	return w
+}
+
 // Returns true if the wallet has prepared proof of work,
 func (w *Wallet) HasPoW() bool {
 	select {
@@ -74,46 +98,125 @@ func (w *Wallet) GeneratePoWAsync() error {
 	}
 
 	w.PoWchan = make(chan types.Work)
+	threshold := w.workThreshold()
 
 	go func(c chan types.Work, w *Wallet) {
-		if w.Head == nil {
-			c <- blocks.GenerateWorkForHash(types.BlockHash(hex.EncodeToString(w.PublicKey)))
-		} else {
-			c <- blocks.GenerateWork(w.Head)
+		root := w.root()
+		if work, ok := Works.Get(w.PublicKey, root, threshold); ok {
+			c <- work
+			return
 		}
+		work := generateWork(root, threshold)
+		Works.Put(w.PublicKey, root, work)
+		c <- work
 	}(w.PoWchan, w)
 
 	return nil
 }
 
+// The hash the next block's work is computed over.
+func (w *Wallet) root() types.BlockHash {
+	if w.Head == nil {
+		return types.BlockHash(hex.EncodeToString(w.PublicKey))
+	}
+	return w.Head.Hash()
+}
+
+// The threshold the next block's work must meet, as the ledger will
+// check it: opens at the first version, anything else at the version of
+// the account as of its head.
+func (w *Wallet) workThreshold() uint64 {
+	if w.Head == nil {
+		return blocks.RequiredDifficulty(blocks.Epoch1)
+	}
+	return blocks.RequiredDifficulty(DefaultLedger.BlockVersion(w.Head.Hash()))
+}
+
+// Picks up work left in the cache, e.g. by an earlier run, if none has
+// been generated yet. Work that's too low for the next block, e.g. made
+// before the account was upgraded, is dropped.
+func (w *Wallet) hasWork() bool {
+	threshold := w.workThreshold()
+	if w.Work != nil {
+		if blocks.RootWorkValue(w.root(), *w.Work) >= threshold {
+			return true
+		}
+		w.Work = nil
+	}
+	work, ok := Works.Get(w.PublicKey, w.root(), threshold)
+	if ok {
+		w.Work = &work
+	}
+	return ok
+}
+
 func (w *Wallet) GetBalance() uint128.Uint128 {
 	if w.Head == nil {
 		return uint128.FromInts(0, 0)
 	}
 
-	return store.GetBalance(w.Head)
+	return DefaultLedger.GetBalance(w.Head)
 
 }
 
+// Receivable is the total of the account's unreceived sends, not
+// counting dust.
+func (w *Wallet) Receivable() uint128.Uint128 {
+	return DefaultLedger.ReceivableTotal(w.Address())
+}
+
+// For display, e.g. "unopened, 5 raw receivable" rather than a zero
+// balance for an account that has been sent to but never opened.
+func (w *Wallet) DescribeBalance() string {
+	account := DefaultLedger.Account(w.Address())
+	switch {
+	case account.Opened:
+		return fmt.Sprintf("%s raw", account.Balance.Decimal())
+	case w.Receivable() != uint128.FromInts(0, 0):
+		return fmt.Sprintf("unopened, %s raw receivable", w.Receivable().Decimal())
+	default:
+		return "unopened"
+	}
+}
+
 func (w *Wallet) Open(source types.BlockHash, representative types.Account) (*blocks.OpenBlock, error) {
+	f := w.lockFrontier()
+	defer f.Unlock()
+
+	if DefaultLedger.ReadOnly() {
+		return nil, ErrLedgerReadOnly
+	}
+
 	if w.Head != nil {
 		return nil, errors.Errorf("Cannot open a non empty account")
 	}
 
-	if w.Work == nil {
+	if !w.hasWork() {
 		return nil, errors.Errorf("No PoW")
 	}
 
-	existing := store.FetchOpen(w.Address())
+	if err := source.Validate(); err != nil {
+		return nil, errors.Wrap(err, "Invalid source")
+	}
+
+	if !address.ValidateAddress(representative) {
+		return nil, errors.Errorf("Invalid representative %s", representative)
+	}
+
+	existing := DefaultLedger.FetchOpen(w.Address())
 	if existing != nil {
 		return nil, errors.Errorf("Cannot open account, open block already exists")
 	}
 
-	send_block := store.FetchBlock(source)
+	send_block := DefaultLedger.FetchBlock(source)
 	if send_block == nil {
 		return nil, errors.Errorf("Could not find references send")
 	}
 
+	if w.alreadyReceived(f, source) {
+		return nil, ErrAlreadyReceived
+	}
+
 	common := blocks.CommonBlock{
 		Work:      *w.Work,
 		Signature: "",
@@ -132,21 +235,82 @@ func (w *Wallet) Open(source types.BlockHash, representative types.Account) (*bl
 		return nil, errors.Errorf("Invalid PoW")
 	}
 
-	w.Head = &block
+	w.advance(f, &block)
 	return &block, nil
 }
 
 func (w *Wallet) Send(destination types.Account, amount uint128.Uint128) (*blocks.SendBlock, error) {
+	return w.SendContext(context.Background(), destination, amount)
+}
+
+// Like Send, but the context is passed on to the approval hook.
+func (w *Wallet) SendContext(ctx context.Context, destination types.Account, amount uint128.Uint128) (*blocks.SendBlock, error) {
+	return w.send(ctx, "", destination, amount)
+}
+
+// SendKeyed is SendContext for a send that must be made at most once.
+// Retried with the same key it returns the send the key first made
+// rather than another, so a caller unsure whether a send went through
+// can ask again. The key is only used up once the send is signed, so a
+// send that's denied or fails can be retried with it.
+func (w *Wallet) SendKeyed(ctx context.Context, key string, destination types.Account, amount uint128.Uint128) (*blocks.SendBlock, error) {
+	if key == "" {
+		return nil, errors.Errorf("Empty idempotency key")
+	}
+	return w.send(ctx, key, destination, amount)
+}
+
+func (w *Wallet) send(ctx context.Context, key string, destination types.Account, amount uint128.Uint128) (*blocks.SendBlock, error) {
+	if sent, err := w.keyedSend(key, destination, amount); sent != nil || err != nil {
+		return sent, err
+	}
+
+	if DefaultLedger.ReadOnly() {
+		return nil, ErrLedgerReadOnly
+	}
+
+	if !address.ValidateAddress(destination) {
+		return nil, errors.Errorf("Invalid destination %s", destination)
+	}
+
+	req := SendRequest{Account: w.Address(), Destination: destination, Amount: amount}
+	err := w.checkSend(ctx, req)
+	if err != nil {
+		w.audit(req, err)
+		return nil, err
+	}
+
+	f := w.lockFrontier()
+	defer f.Unlock()
+	unlock := lockSpends(w.PublicKey)
+	defer unlock()
+
+	// The same key may have been used while this send was approved
+	if sent, err := w.keyedSend(key, destination, amount); sent != nil || err != nil {
+		return sent, err
+	}
+
+	// Approved sends that can't be made are audited too
+	deny := func(err error) (*blocks.SendBlock, error) {
+		w.audit(req, err)
+		return nil, err
+	}
+
 	if w.Head == nil {
-		return nil, errors.Errorf("Cannot send from empty account")
+		return deny(errors.Errorf("Cannot send from empty account"))
 	}
 
-	if w.Work == nil {
-		return nil, errors.Errorf("No PoW")
+	if !w.hasWork() {
+		return deny(errors.Errorf("No PoW"))
 	}
 
 	if amount.Compare(w.GetBalance()) > 0 {
-		return nil, errors.Errorf("Tried to send more than balance")
+		return deny(ErrInsufficientBalance)
+	}
+
+	// Other sends may have spent the budget while this one was approved
+	if err = w.checkDaily(amount); err != nil {
+		return deny(err)
 	}
 
 	common := blocks.CommonBlock{
@@ -163,20 +327,86 @@ func (w *Wallet) Send(destination types.Account, amount uint128.Uint128) (*block
 
 	block.Signature = block.Hash().Sign(w.privateKey)
 
-	w.Head = &block
+	err = w.recordSend(amount)
+	if err == nil {
+		err = w.recordSendKey(key, amount, &block)
+	}
+	if err != nil {
+		return deny(err)
+	}
+	w.audit(req, nil)
+
+	w.advance(f, &block)
 	return &block, nil
 }
 
+// Receive builds a block receiving source. Receives of the same source at
+// once, from this wallet or those sharing its frontier, are built once
+// and all return that block. A source already received gets
+// ErrAlreadyReceived.
 func (w *Wallet) Receive(source types.BlockHash) (*blocks.ReceiveBlock, error) {
+	return w.receive(source, false)
+}
+
+// AutoReceive is Receive for sends as they arrive, generating the work if
+// there is none. A source already received isn't an error, but returns no
+// block.
+func (w *Wallet) AutoReceive(source types.BlockHash) (*blocks.ReceiveBlock, error) {
+	block, err := w.receive(source, true)
+	if err == ErrAlreadyReceived {
+		return nil, nil
+	}
+	return block, err
+}
+
+// ReceiveAll receives every send to the account the ledger lists, in hash
+// order, generating work as it goes, and skipping those received
+// meanwhile. It stops at the first that fails.
+func (w *Wallet) ReceiveAll() ([]*blocks.ReceiveBlock, error) {
+	var received []*blocks.ReceiveBlock
+	for _, source := range DefaultLedger.Pending(w.Address()) {
+		block, err := w.AutoReceive(source)
+		if err != nil {
+			return received, errors.Wrapf(err, "Failed to receive %s", source)
+		}
+		if block != nil {
+			received = append(received, block)
+		}
+	}
+	return received, nil
+}
+
+func (w *Wallet) receive(source types.BlockHash, generate bool) (*blocks.ReceiveBlock, error) {
+	if w.frontier == nil {
+		w.frontier = newAccountFrontier()
+	}
+	call, first := w.frontier.startReceive(source)
+	if !first {
+		<-call.done
+		return call.block, call.err
+	}
+	call.block, call.err = w.buildReceive(source, generate)
+	w.frontier.endReceive(source, call)
+	return call.block, call.err
+}
+
+func (w *Wallet) buildReceive(source types.BlockHash, generate bool) (*blocks.ReceiveBlock, error) {
+	f := w.lockFrontier()
+	defer f.Unlock()
+
+	if DefaultLedger.ReadOnly() {
+		return nil, ErrLedgerReadOnly
+	}
+
 	if w.Head == nil {
 		return nil, errors.Errorf("Cannot receive to empty account")
 	}
 
-	if w.Work == nil {
-		return nil, errors.Errorf("No PoW")
+	if err := source.Validate(); err != nil {
+		return nil, errors.Wrap(err, "Invalid source")
 	}
 
-	send_block := store.FetchBlock(source)
+	send_block := DefaultLedger.FetchBlock(source)
 
 	if send_block == nil {
 		return nil, errors.Errorf("Source block not found")
@@ -190,6 +420,20 @@ func (w *Wallet) Receive(source types.BlockHash) (*blocks.ReceiveBlock, error) {
 		return nil, errors.Errorf("Send is not for this account")
 	}
 
+	if w.alreadyReceived(f, source) {
+		return nil, ErrAlreadyReceived
+	}
+
+	// Not generated until the receive is sure to be built
+	if !w.hasWork() {
+		if !generate {
+			return nil, errors.Errorf("No PoW")
+		}
+		work := generateWork(w.root(), w.workThreshold())
+		Works.Put(w.PublicKey, w.root(), work)
+		w.Work = &work
+	}
+
 	common := blocks.CommonBlock{
 		Work:      *w.Work,
 		Signature: "",
@@ -203,19 +447,30 @@ func (w *Wallet) Receive(source types.BlockHash) (*blocks.ReceiveBlock, error) {
 
 	block.Signature = block.Hash().Sign(w.privateKey)
 
-	w.Head = &block
+	w.advance(f, &block)
 	return &block, nil
 }
 
 func (w *Wallet) Change(representative types.Account) (*blocks.ChangeBlock, error) {
+	f := w.lockFrontier()
+	defer f.Unlock()
+
+	if DefaultLedger.ReadOnly() {
+		return nil, ErrLedgerReadOnly
+	}
+
 	if w.Head == nil {
 		return nil, errors.Errorf("Cannot change on empty account")
 	}
 
-	if w.Work == nil {
+	if !w.hasWork() {
 		return nil, errors.Errorf("No PoW")
 	}
 
+	if !address.ValidateAddress(representative) {
+		return nil, errors.Errorf("Invalid representative %s", representative)
+	}
+
 	common := blocks.CommonBlock{
 		Work:      *w.Work,
 		Signature: "",
@@ -229,6 +484,6 @@ func (w *Wallet) Change(representative types.Account) (*blocks.ChangeBlock, erro
 
 	block.Signature = block.Hash().Sign(w.privateKey)
 
-	w.Head = &block
+	w.advance(f, &block)
 	return &block, nil
 }
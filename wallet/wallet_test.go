@@ -1,13 +1,30 @@
 package wallet
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/frankh/nano/address"
 	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/protocol"
 	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
 	"github.com/frankh/nano/uint128"
+	"github.com/frankh/nano/utils"
+	"github.com/pkg/errors"
 )
 
 func TestNew(t *testing.T) {
@@ -20,7 +37,7 @@ func TestNew(t *testing.T) {
 }
 
 func TestPoW(t *testing.T) {
-	blocks.WorkThreshold = 0xff00000000000000
+	blocks.WorkThreshold = protocol.WorkTestThreshold
 	store.Init(store.TestConfig)
 	w := New(blocks.TestPrivateKey)
 
@@ -49,8 +66,9 @@ func TestPoW(t *testing.T) {
 }
 
 func TestSend(t *testing.T) {
-	blocks.WorkThreshold = 0xff00000000000000
+	blocks.WorkThreshold = protocol.WorkTestThreshold
 	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
 	w := New(blocks.TestPrivateKey)
 
 	w.GeneratePowSync()
@@ -67,10 +85,17 @@ func TestSend(t *testing.T) {
 		t.Errorf("Sent more than account balance")
 	}
 
+	_, err = w.Send(types.Account(hex.EncodeToString(w.PublicKey)), amount)
+	if err == nil {
+		t.Errorf("Sent to a public key instead of an address")
+	}
+
 	w.GeneratePowSync()
 	store.StoreBlock(send)
 	receive, _ := w.Receive(send.Hash())
-	store.StoreBlock(receive)
+	if err = store.StoreBlock(receive); err != nil {
+		t.Errorf("Failed to store receive with receive work: %s", err)
+	}
 
 	if w.GetBalance() != blocks.GenesisAmount {
 		t.Errorf("Balance not updated after receive, %x != %x", w.GetBalance().GetBytes(), blocks.GenesisAmount.GetBytes())
@@ -79,8 +104,9 @@ func TestSend(t *testing.T) {
 }
 
 func TestOpen(t *testing.T) {
-	blocks.WorkThreshold = 0xff00000000000000
+	blocks.WorkThreshold = protocol.WorkTestThreshold
 	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
 	amount := uint128.FromInts(1, 1)
 
 	sendW := New(blocks.TestPrivateKey)
@@ -116,3 +142,1193 @@ func TestOpen(t *testing.T) {
 	}
 
 }
+
+func TestUpgradedAccount(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	w := New(blocks.TestPrivateKey)
+	if err := store.UpgradeAccount(w.Address(), blocks.CurrentVersion); err != nil {
+		t.Fatal(err)
+	}
+
+	// Work only good enough for the first version is mostly rejected, so
+	// a few rounds make sure it isn't what's made
+	for i := 0; i < 4; i++ {
+		w.GeneratePowSync()
+		send, err := w.Send(w.Address(), uint128.FromInts(0, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.StoreBlock(send); err != nil {
+			t.Fatalf("Send from an upgraded account rejected: %s", err)
+		}
+
+		w.GeneratePowSync()
+		receive, err := w.Receive(send.Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.StoreBlock(receive); err != nil {
+			t.Fatalf("Receive in an upgraded account rejected: %s", err)
+		}
+	}
+	if !blocks.ValidateBlockWorkAt(w.Head, blocks.CurrentVersion) {
+		t.Errorf("Work below the upgraded threshold")
+	}
+}
+
+func TestSpendingLimits(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	store.Init(store.TestConfig)
+	var events []AuditEvent
+	denied := errors.New("Denied")
+	var deny error
+	policy := SendPolicy{
+		Limits:  SpendingLimits{uint128.FromInts(0, 10), uint128.FromInts(0, 15)},
+		Approve: func(ctx context.Context, req SendRequest) error { return deny },
+		Audit:   func(e AuditEvent) { events = append(events, e) },
+	}
+	w := NewWithPolicy(blocks.TestPrivateKey, policy)
+	w.GeneratePowSync()
+	// Earlier tests send from the same account
+	store.StoreMeta(spendPrefix, w.PublicKey, []spendRecord{})
+
+	_, err := w.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 11))
+	if err != ErrOverTransactionLimit {
+		t.Errorf("Expected per transaction limit error, got %v", err)
+	}
+
+	deny = denied
+	_, err = w.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 10))
+	if errors.Cause(err) != denied {
+		t.Errorf("Expected approval hook to deny send, got %v", err)
+	}
+	deny = nil
+
+	// Denied sends must not have used up any of the daily budget
+	if w.Work == nil {
+		t.Fatalf("Denied sends shouldn't use up the PoW")
+	}
+	work := *w.Work
+	_, err = w.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 10))
+	if err != nil {
+		t.Errorf("Send within limits failed: %s", err)
+	}
+
+	// Counters are persisted, so a fresh wallet still sees the spend
+	w2 := NewWithPolicy(blocks.TestPrivateKey, SendPolicy{Limits: policy.Limits})
+	w2.Work = &work
+	_, err = w2.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 6))
+	if err != ErrOverDailyLimit {
+		t.Errorf("Expected daily limit error, got %v", err)
+	}
+
+	now = func() time.Time { return time.Now().Add(25 * time.Hour) }
+	defer func() { now = time.Now }()
+	w2.Work = &work
+	_, err = w2.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 6))
+	if err != nil {
+		t.Errorf("Daily limit should reset after 24h: %s", err)
+	}
+
+	if len(events) != 3 || events[0].Allowed || events[1].Allowed || !events[2].Allowed {
+		t.Errorf("Unexpected audit events %v", events)
+	}
+}
+
+// Sends at once from separate wallets on one account share its daily
+// budget: only one of several that each fit can go through.
+func TestSpendingLimitsConcurrent(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	store.Init(store.TestConfig)
+	policy := SendPolicy{
+		Limits: SpendingLimits{Daily: uint128.FromInts(0, 15)},
+		// Holds each send between its first check and the one under the lock
+		Approve: func(ctx context.Context, req SendRequest) error {
+			time.Sleep(time.Millisecond)
+			return nil
+		},
+	}
+	store.StoreMeta(spendPrefix, New(blocks.TestPrivateKey).PublicKey, []spendRecord{})
+
+	wallets := make([]Wallet, 8)
+	for i := range wallets {
+		wallets[i] = NewWithPolicy(blocks.TestPrivateKey, policy)
+		wallets[i].GeneratePowSync()
+	}
+	errs := make(chan error, len(wallets))
+	start := make(chan bool)
+	var wg sync.WaitGroup
+	for i := range wallets {
+		wg.Add(1)
+		go func(w *Wallet) {
+			defer wg.Done()
+			<-start
+			_, err := w.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 10))
+			errs <- err
+		}(&wallets[i])
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+	sent := 0
+	for err := range errs {
+		if err == nil {
+			sent++
+		} else if err != ErrOverDailyLimit {
+			t.Errorf("Unexpected send error %v", err)
+		}
+	}
+	if sent != 1 {
+		t.Errorf("Expected one send within the daily limit, %d went through", sent)
+	}
+}
+
+// An approval waiting on a person holds up no other sends on the
+// account, and a batch is approved once.
+func TestApprovalOutsideLocks(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	store.StoreMeta(spendPrefix, New(blocks.TestPrivateKey).PublicKey, []spendRecord{})
+	waiting, release := make(chan bool), make(chan bool)
+	var requests []SendRequest
+	policy := SendPolicy{Approve: func(ctx context.Context, req SendRequest) error {
+		requests = append(requests, req)
+		if req.Amount == uint128.FromInts(0, 1) {
+			close(waiting)
+			<-release
+		}
+		return nil
+	}}
+	w := NewWithPolicy(blocks.TestPrivateKey, policy)
+	w.GeneratePowSync()
+	// Copies share the account's frontier
+	slow, fast := w, w
+
+	sent := make(chan *blocks.SendBlock)
+	go func() {
+		send, err := slow.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 1))
+		if err != nil {
+			t.Error(err)
+		}
+		sent <- send
+	}()
+	<-waiting
+	var first *blocks.SendBlock
+	done := make(chan error)
+	go func() {
+		var err error
+		first, err = fast.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 2))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Send held up by another's approval")
+	}
+	store.StoreBlock(first)
+	Works.Put(w.PublicKey, first.Hash(), blocks.GenerateWorkThreshold(first.Hash(), blocks.WorkThreshold))
+	close(release)
+	second := <-sent
+	if second == nil || second.PreviousHash != first.Hash() {
+		t.Fatalf("Approved send should build on the one made meanwhile")
+	}
+	store.StoreBlock(second)
+
+	var recipients []Recipient
+	for i := 1; i <= 3; i++ {
+		recipients = append(recipients, Recipient{blocks.TestGenesisBlock.Account, uint128.FromInts(0, 10)})
+	}
+	requests = nil
+	if _, err := fast.BatchSend(recipients, BatchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || len(requests[0].Recipients) != 3 || requests[0].Amount != uint128.FromInts(0, 30) {
+		t.Errorf("Expected the batch approved once for the total, got %v", requests)
+	}
+}
+
+// A keyed send is made once, however often it's retried, and a send
+// that's denied leaves its key for the retry.
+func TestSendKeyed(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	store.StoreMeta(spendPrefix, New(blocks.TestPrivateKey).PublicKey, []spendRecord{})
+	denied := errors.New("Denied")
+	deny := denied
+	w := NewWithPolicy(blocks.TestPrivateKey, SendPolicy{
+		Limits:  SpendingLimits{Daily: uint128.FromInts(0, 15)},
+		Approve: func(ctx context.Context, req SendRequest) error { return deny },
+	})
+	w.GeneratePowSync()
+	amount := uint128.FromInts(0, 10)
+	ctx := context.Background()
+
+	if _, err := w.SendKeyed(ctx, "payout-1", blocks.TestGenesisBlock.Account, amount); errors.Cause(err) != denied {
+		t.Fatalf("Expected the send denied, got %v", err)
+	}
+	deny = nil
+	send, err := w.SendKeyed(ctx, "payout-1", blocks.TestGenesisBlock.Account, amount)
+	if err != nil {
+		t.Fatalf("Denied send used up its key: %s", err)
+	}
+	store.StoreBlock(send)
+
+	// Retrying gets the same send, without spending the budget again
+	retried, err := w.SendKeyed(ctx, "payout-1", blocks.TestGenesisBlock.Account, amount)
+	if err != nil || retried.Hash() != send.Hash() {
+		t.Errorf("Retry made another send: %v", err)
+	}
+	if _, err := w.SendKeyed(ctx, "payout-1", blocks.TestGenesisBlock.Account, uint128.FromInts(0, 1)); err != ErrSendKeyReused {
+		t.Errorf("Expected a reused key error, got %v", err)
+	}
+	if _, err := w.SendKeyed(ctx, "", blocks.TestGenesisBlock.Account, amount); err == nil {
+		t.Errorf("Empty key accepted")
+	}
+	w.GeneratePowSync()
+	if _, err := w.SendKeyed(ctx, "payout-2", blocks.TestGenesisBlock.Account, uint128.FromInts(0, 5)); err != nil {
+		t.Errorf("Retries shouldn't use up the daily budget: %s", err)
+	}
+}
+
+func TestSendFrom(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	genesis := New(blocks.TestPrivateKey)
+
+	// Two accounts holding 10 and 5 raw
+	var sources []*Wallet
+	for i, amount := range []uint64{10, 5} {
+		w := New(strings.Repeat(fmt.Sprintf("%02x", i+1), 32))
+		genesis.GeneratePowSync()
+		send, err := genesis.Send(w.Address(), uint128.FromInts(0, amount))
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.StoreBlock(send)
+		w.GeneratePowSync()
+		open, err := w.Open(send.Hash(), w.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.StoreBlock(open)
+		sources = append(sources, &w)
+	}
+
+	parts, _ := PlanSplit(sources, uint128.FromInts(0, 12), SmallestFirst)
+	if len(parts) != 2 || parts[0].Wallet != sources[1] || parts[1].Amount != uint128.FromInts(0, 7) {
+		t.Errorf("Smallest first should empty the 5 raw account first, got %v", parts)
+	}
+
+	_, err := PlanSplit(sources, uint128.FromInts(0, 16), LargestFirst)
+	if err == nil {
+		t.Errorf("Planned a split over the total balance")
+	}
+
+	failed := errors.New("Failed")
+	calls := 0
+	opts := SplitOptions{Publish: func(send *blocks.SendBlock) error {
+		calls++
+		if calls == 2 {
+			return failed
+		}
+		return store.StoreBlock(send)
+	}}
+	result, err := SendFrom(sources, blocks.TestGenesisBlock.Account, uint128.FromInts(0, 12), opts)
+	if errors.Cause(err) != failed {
+		t.Errorf("Expected publish failure, got %v", err)
+	}
+	if len(result.Sent) != 1 || result.Remaining != uint128.FromInts(0, 2) {
+		t.Errorf("Expected one send of 10 raw and 2 remaining, got %d sends and %s", len(result.Sent), result.Remaining)
+	}
+
+	// Resume with what's left
+	result, err = SendFrom(sources, blocks.TestGenesisBlock.Account, result.Remaining, SplitOptions{})
+	if err != nil || len(result.Sent) != 1 || sources[1].GetBalance() != uint128.FromInts(0, 3) {
+		t.Errorf("Resume failed: %v", err)
+	}
+}
+
+func TestKeystoreUpgrade(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+
+	dir, _ := ioutil.TempDir("", "keystore")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "wallet.json")
+	fixture, _ := ioutil.ReadFile("testdata/keystore_1000.json")
+	ioutil.WriteFile(path, fixture, 0600)
+
+	_, err := LoadKeystore(path, "wrong")
+	if err != ErrBadPassword {
+		t.Errorf("Expected bad password error, got %v", err)
+	}
+
+	k, err := LoadKeystore(path, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !k.UpgradeRecommended {
+		t.Errorf("Upgrade not recommended for 1000 iterations")
+	}
+	w := k.Wallet(0)
+	account := w.Address()
+
+	if k.UpgradeEncryption("wrong", DefaultKDFParams) != ErrBadPassword {
+		t.Errorf("Upgraded with the wrong password")
+	}
+	err = k.UpgradeEncryption("password", DefaultKDFParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k, err = LoadKeystore(path, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = k.Wallet(0)
+	if k.UpgradeRecommended || w.Address() != account {
+		t.Errorf("Upgrade didn't keep the seed or still recommends upgrading")
+	}
+	adHoc := k.AdHocWallets()
+	if len(adHoc) != 1 || adHoc[0].Address() != blocks.TestGenesisBlock.Account {
+		t.Errorf("Ad hoc key lost in upgrade")
+	}
+
+	err = k.ChangeSeed("password", strings.Repeat("cd", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, _ = LoadKeystore(path, "password")
+	w = k.Wallet(0)
+	if w.Address() == account {
+		t.Errorf("Seed not changed")
+	}
+	if len(k.WatchOnly()) != 1 || k.AddressBook()["genesis"] != blocks.TestGenesisBlock.Account || len(k.Payments()) == 0 || len(k.AdHocWallets()) != 1 {
+		t.Errorf("Seed change lost watch-only, address book, payments or ad hoc keys")
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("Temporary files left behind: %d files", len(files))
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "export")
+	defer os.RemoveAll(dir)
+	params := KDFParams{Iterations: 1000}
+
+	k, err := CreateKeystore(filepath.Join(dir, "wallet.json"), "password", strings.Repeat("ab", 32), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.AddAdHoc(blocks.TestPrivateKey)
+	k.AddWatchOnly(blocks.TestGenesisBlock.Account)
+	k.SetAddressBookEntry("genesis", blocks.TestGenesisBlock.Account)
+	k.SetAddressBookEntry("first", seedAddress(k.seed, 0))
+	k.SetPayments(json.RawMessage(`{"pending":[]}`))
+
+	if _, err = k.ExportJSON("wrong", true, 3); err != ErrBadPassword {
+		t.Errorf("Exported with the wrong password")
+	}
+	exported, err := k.ExportJSON("password", true, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := k.ExportJSON("password", true, 3)
+	if string(exported) != string(again) {
+		t.Errorf("Export isn't deterministic")
+	}
+
+	path := filepath.Join(dir, "imported.json")
+	imported, problems, err := ImportJSON(exported, path, "other", params)
+	if err != nil || len(problems) != 0 {
+		t.Fatalf("Import failed: %v %v", err, problems)
+	}
+	if _, _, err = ImportJSON(exported, path, "other", params); err == nil {
+		t.Errorf("Import overwrote an existing keystore")
+	}
+	imported, err = LoadKeystore(path, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reexported, _ := imported.ExportJSON("other", true, 3)
+	if string(reexported) != string(exported) {
+		t.Errorf("Wallet didn't round trip\n%s\n%s", exported, reexported)
+	}
+
+	// Without the seed, its accounts can only be watched
+	exported, _ = k.ExportJSON("password", false, 2)
+	if strings.Contains(string(exported), k.seed) {
+		t.Errorf("Seed exported without being asked for")
+	}
+	imported, problems, err = ImportJSON(exported, filepath.Join(dir, "watching.json"), "other", params)
+	if err != nil || len(problems) != 0 {
+		t.Fatalf("Import failed: %v %v", err, problems)
+	}
+	if imported.seed == k.seed || len(imported.WatchOnly()) != 3 || len(imported.adHoc) != 1 {
+		t.Errorf("Expected a new seed, watching 3 accounts, got %v", imported.WatchOnly())
+	}
+
+	if _, _, err = ImportJSON([]byte(`{"version":2}`), filepath.Join(dir, "v2.json"), "other", params); err == nil {
+		t.Errorf("Imported an unknown version")
+	}
+}
+
+func TestImportBrokenExport(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "export")
+	defer os.RemoveAll(dir)
+
+	data, _ := ioutil.ReadFile("testdata/export_broken.json")
+	k, problems, err := ImportJSON(data, filepath.Join(dir, "wallet.json"), "password", KDFParams{Iterations: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []string
+	for _, problem := range problems {
+		items = append(items, problem.Item)
+	}
+	expected := []string{"account 5", "account 2", "ad hoc key 1", "ad hoc key 2", "watch-only nano_1111", "address book typo"}
+	if strings.Join(items, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected problems with %v, got %v", expected, problems)
+	}
+
+	if k.seed != strings.Repeat("0", 64) || len(k.adHoc) != 1 || len(k.WatchOnly()) != 1 || len(k.AddressBook()) != 1 || len(k.Payments()) == 0 {
+		t.Errorf("Valid entries not imported")
+	}
+}
+
+func TestWorkCache(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	os.RemoveAll(store.TestConfig.Path)
+	defer os.RemoveAll(store.TestConfig.Path)
+	defer func(g func(types.BlockHash, uint64) types.Work) { generateWork = g }(generateWork)
+	store.Init(store.TestConfig)
+	Works = NewWorkCache(DefaultWorkCacheSize)
+
+	w := New(blocks.TestPrivateKey)
+	w.GeneratePowSync()
+
+	// Restart with the same data directory
+	Works = NewWorkCache(DefaultWorkCacheSize)
+	store.Init(store.TestConfig)
+	generateWork = func(types.BlockHash, uint64) types.Work {
+		t.Fatalf("Generated work that was cached")
+		return ""
+	}
+
+	w = New(blocks.TestPrivateKey)
+	send, err := w.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 1))
+	if err != nil {
+		t.Fatalf("Failed to send with cached work: %s", err)
+	}
+	if !blocks.ValidateBlockWork(send) {
+		t.Errorf("Cached work is invalid")
+	}
+	if _, ok := Works.Get(w.PublicKey, send.Hash(), 0); ok {
+		t.Errorf("Used work left in the cache")
+	}
+
+	// Work for an old frontier is dropped
+	Works.Put(w.PublicKey, send.PreviousHash, send.Work)
+	if _, ok := Works.Get(w.PublicKey, send.Hash(), 0); ok {
+		t.Errorf("Returned work for a stale root")
+	}
+	if _, ok := Works.Get(w.PublicKey, send.PreviousHash, 0); ok {
+		t.Errorf("Stale work not removed")
+	}
+
+	Works = NewWorkCache(2)
+	now = func() time.Time { return time.Unix(1, 0) }
+	defer func() { now = time.Now }()
+	Works.Put([]byte("a"), send.PreviousHash, send.Work)
+	now = func() time.Time { return time.Unix(2, 0) }
+	Works.Put([]byte("b"), send.PreviousHash, send.Work)
+	now = func() time.Time { return time.Unix(3, 0) }
+	Works.Get([]byte("a"), send.PreviousHash, 0)
+	Works.Put([]byte("c"), send.PreviousHash, send.Work)
+
+	Works = NewWorkCache(2)
+	if _, ok := Works.Get([]byte("b"), send.PreviousHash, 0); ok {
+		t.Errorf("Least recently used work not evicted")
+	}
+	for _, pub := range []string{"a", "c"} {
+		if _, ok := Works.Get([]byte(pub), send.PreviousHash, 0); !ok {
+			t.Errorf("Evicted recently used work for %s", pub)
+		}
+	}
+	Works = NewWorkCache(DefaultWorkCacheSize)
+}
+
+func TestBatchSend(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	w := New(blocks.TestPrivateKey)
+	start := w.GetBalance()
+	before := store.GetAccountStatus(w.Address()).BlockCount
+
+	var recipients []Recipient
+	for i := 1; i <= 4; i++ {
+		pub, _ := address.KeypairFromPrivateKey(strings.Repeat(fmt.Sprintf("%02x", i), 32))
+		recipients = append(recipients, Recipient{address.PubKeyToAddress(pub), uint128.FromInts(0, uint64(i))})
+	}
+
+	_, err := w.BatchSend(append(recipients, Recipient{recipients[0].Address, start}), BatchOptions{})
+	if err == nil || store.GetAccountStatus(w.Address()).BlockCount != before {
+		t.Errorf("Batch over the balance should publish nothing")
+	}
+
+	// The second send gets through but its publish reports a failure, and
+	// the process dies before the third
+	calls := 0
+	failed := errors.New("Failed")
+	result, err := w.BatchSend(recipients, BatchOptions{Publish: func(send *blocks.SendBlock) error {
+		calls++
+		if calls > 2 {
+			t.Fatalf("Published after a failure")
+		}
+		store.StoreBlock(send)
+		if calls == 2 {
+			return failed
+		}
+		return nil
+	}})
+	if errors.Cause(err) != failed || result.Results[1].Err != failed || result.Results[1].Send != nil {
+		t.Errorf("Expected the second publish to fail, got %v", err)
+	}
+	if result.Results[0].Send == nil || result.Frontier != result.Results[0].Send.Hash() || len(result.Remaining) != 3 {
+		t.Errorf("Batch should stop after the first send, got %d remaining", len(result.Remaining))
+	}
+
+	restarted := New(blocks.TestPrivateKey)
+	resumed, err := restarted.ResumeBatch(result, BatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resumed.Results) != 3 || len(resumed.Remaining) != 0 {
+		t.Errorf("Resume should pay the 3 remaining recipients, got %d", len(resumed.Results))
+	}
+
+	status := store.GetAccountStatus(w.Address())
+	if status.BlockCount != before+4 || status.Frontier != resumed.Frontier {
+		t.Errorf("Expected exactly 4 sends, got %d", status.BlockCount-before)
+	}
+	if status.Balance != start.Sub(uint128.FromInts(0, 10)) {
+		t.Errorf("Wrong balance after batch %s", status.Balance)
+	}
+
+	// Nothing left to pay, and nothing sent twice
+	_, err = restarted.ResumeBatch(resumed, BatchOptions{})
+	if err != nil || store.GetAccountStatus(w.Address()).BlockCount != before+4 {
+		t.Errorf("Resuming a finished batch sent again: %v", err)
+	}
+}
+
+func TestRecommendRepresentatives(t *testing.T) {
+	rep := func(i int, weight uint64, participation float64) RepresentativeMetrics {
+		return RepresentativeMetrics{
+			Representative: types.Account(fmt.Sprintf("rep%d", i)),
+			Weight:         uint128.FromInts(0, weight),
+			Participation:  participation,
+			Uptime:         1,
+		}
+	}
+	RepresentativeSource = func() []RepresentativeMetrics {
+		return []RepresentativeMetrics{rep(0, 9000, 1), rep(1, 200, 0.5), rep(2, 150, 1), rep(3, 100, 1), rep(4, 50, 0)}
+	}
+	defer func() { RepresentativeSource = nil }()
+
+	names := func(ranked []RepresentativeMetrics) (s []string) {
+		for _, m := range ranked {
+			s = append(s, string(m.Representative))
+		}
+		return s
+	}
+
+	var w Wallet
+	ranked := w.RecommendRepresentatives(3, false)
+	if fmt.Sprint(names(ranked)) != "[rep3 rep2 rep0]" {
+		t.Errorf("Wrong ranking %v", names(ranked))
+	}
+	if !ranked[2].Concentrated || ranked[2].WeightShare < 0.9 || ranked[0].Concentrated {
+		t.Errorf("Wrong concentration %+v", ranked)
+	}
+	if ranked := w.RecommendRepresentatives(10, true); fmt.Sprint(names(ranked)) != "[rep3 rep2 rep1 rep4]" {
+		t.Errorf("Concentrated rep not excluded %v", names(ranked))
+	}
+
+	w.ScoreRepresentative = func(m RepresentativeMetrics) float64 { return m.WeightShare }
+	if ranked := w.RecommendRepresentatives(1, true); fmt.Sprint(names(ranked)) != "[rep1]" {
+		t.Errorf("Custom scorer not used %v", names(ranked))
+	}
+}
+
+// Without the store, a wallet still signs and keeps its bookkeeping in
+// memory.
+func TestOfflineLedger(t *testing.T) {
+	saved := DefaultLedger
+	defer func() { DefaultLedger = saved }()
+	offline := NewOfflineLedger()
+	DefaultLedger = offline
+
+	w := New(blocks.TestPrivateKey)
+	if w.Head != nil || w.DescribeBalance() != "unopened" {
+		t.Errorf("Offline wallet shouldn't know its account")
+	}
+	amount := uint128.FromInts(0, 5)
+	if err := w.recordSend(amount); err != nil {
+		t.Fatal(err)
+	}
+	if spends := w.loadSpends(); len(spends) != 1 || spends[0].Amount != amount {
+		t.Errorf("Spend not kept: %v", spends)
+	}
+
+	offline.StoreMeta("b", []byte("2"), 2)
+	offline.StoreMeta("b", []byte("1"), 1)
+	offline.StoreMeta("bb", []byte("3"), 3)
+	var keys []string
+	offline.IterateMeta("b", func(key []byte, value []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if strings.Join(keys, ",") != "1,2" {
+		t.Errorf("Expected keys 1,2 in order, got %v", keys)
+	}
+	if offline.DeleteMeta("b", []byte("1")); offline.FetchMeta("b", []byte("1"), new(int)) != ErrMetaNotFound {
+		t.Errorf("Deleted value still there")
+	}
+	if offline.StoreBlock(blocks.TestGenesisBlock) != ErrNoLedger {
+		t.Errorf("Expected no ledger")
+	}
+}
+
+// A payment to a new account, opened and then buried under two more
+// blocks, checked under each policy as its blocks are cemented and time
+// passes.
+func TestConfirmationPolicies(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	clock := utils.NewFakeClock(time.Unix(1600000000, 0))
+	store.Clock, now = clock, clock.Now
+	defer func() { store.Clock, now = utils.SystemClock{}, time.Now }()
+
+	amount := uint128.FromInts(0, 1000)
+	genesis := New(blocks.TestPrivateKey)
+	genesis.GeneratePowSync()
+	_, priv := address.GenerateKey()
+	w := New(hex.EncodeToString(priv))
+	send, _ := genesis.Send(w.Address(), amount)
+	store.StoreBlock(send)
+	var chain []blocks.Block
+	w.GeneratePowSync()
+	open, err := w.Open(send.Hash(), w.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain = append(chain, open)
+	for i := 0; i < 2; i++ {
+		w.GeneratePowSync()
+		change, err := w.Change(genesis.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain = append(chain, change)
+	}
+	for _, block := range chain {
+		store.StoreBlock(block)
+	}
+
+	watcher := NewConfirmationWatcher()
+	cementer, _ := store.NewConfirmationHeightProcessor(store.DefaultCementBatchSize, func(store.CementEvent) { watcher.Check() })
+	policies := []ConfirmationPolicy{Cemented, CementedPlusDepth(2), CementedPlusDelay(10 * time.Minute)}
+	confirmed := make(map[string]bool)
+	for _, policy := range policies {
+		policy := policy
+		watcher.Watch(open.Hash(), policy, func(types.BlockHash) { confirmed[policy.String()] = true })
+	}
+	check := func(stage string, expected ...bool) {
+		t.Helper()
+		for i, policy := range policies {
+			balance := uint128.FromInts(0, 0)
+			if expected[i] {
+				balance = amount
+			}
+			if confirmed[policy.String()] != expected[i] || policy.Confirmed(open.Hash()) != expected[i] || w.ConfirmedBalance(policy) != balance {
+				t.Errorf("%s: expected %s confirmed %v, got %v with %s", stage, policy, expected[i], confirmed[policy.String()], w.ConfirmedBalance(policy).Decimal())
+			}
+		}
+	}
+	check("Uncemented", false, false, false)
+
+	cementer.Add(open.Hash())
+	cementer.Flush()
+	check("Cemented", true, false, false)
+	clock.Advance(5 * time.Minute)
+	cementer.Add(chain[1].Hash())
+	cementer.Flush()
+	check("One block deep", true, false, false)
+	cementer.Add(chain[2].Hash())
+	cementer.Flush()
+	check("Two blocks deep", true, true, false)
+
+	// Nothing more is cemented, so only a periodic check sees the delay
+	// is up
+	clock.Advance(5 * time.Minute)
+	if watcher.Check() != 0 {
+		t.Errorf("Watches left once every policy is met")
+	}
+	check("Delayed", true, true, true)
+
+	for _, s := range []string{"cemented", "depth:3", "delay:1h0m0s"} {
+		if policy, err := ParseConfirmationPolicy(s); err != nil || policy.String() != s {
+			t.Errorf("Expected policy %s, got %v: %v", s, policy, err)
+		}
+	}
+	for _, s := range []string{"", "cemented:1", "depth", "depth:-1", "delay:-1s", "votes:3"} {
+		if _, err := ParseConfirmationPolicy(s); errors.Cause(err) != ErrBadConfirmationPolicy {
+			t.Errorf("Expected %q to be a bad policy, got %v", s, err)
+		}
+	}
+}
+
+// Facts exported from the store, swept with no ledger, and the blocks
+// carried back in a file and processed.
+func TestOfflineSweep(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+
+	seed := strings.Repeat("5A", 32)
+	opened, unopened := seedAddress(seed, 0), seedAddress(seed, 1)
+	genesis := New(blocks.TestPrivateKey)
+	send := func(to types.Account, amount uint64) *blocks.SendBlock {
+		genesis.GeneratePowSync()
+		block, err := genesis.Send(to, uint128.FromInts(0, amount))
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.StoreBlock(block)
+		return block
+	}
+	s1, s2, s3 := send(opened, 1000), send(opened, 200), send(unopened, 300)
+	_, priv := address.KeypairFromSeed(seed, 0)
+	w := New(hex.EncodeToString(priv))
+	w.GeneratePowSync()
+	open, err := w.Open(s1.Hash(), opened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.StoreBlock(open)
+
+	var facts []AccountFacts
+	for i, account := range []types.Account{opened, unopened} {
+		f, err := ExportAccountFacts(uint32(i), account)
+		if err != nil {
+			t.Fatal(err)
+		}
+		facts = append(facts, f)
+	}
+	if facts[0].Frontier != open.Hash() || facts[0].Balance != "1000" || facts[0].Receivable != "200" || len(facts[0].Pending) != 1 || facts[0].Pending[0].Hash != s2.Hash() {
+		t.Errorf("Unexpected facts for the opened account %+v", facts[0])
+	}
+	if facts[1].Frontier != "" || facts[1].Balance != "0" || facts[1].Receivable != "300" || len(facts[1].Pending) != 1 || facts[1].Pending[0].Hash != s3.Hash() {
+		t.Errorf("Unexpected facts for the unopened account %+v", facts[1])
+	}
+	data, _ := json.Marshal(facts)
+	var carried []AccountFacts
+	json.Unmarshal(data, &carried)
+
+	// No ledger at all on the offline side
+	saved := DefaultLedger
+	DefaultLedger = NewOfflineLedger()
+	pub, _ := address.GenerateKey()
+	dest := address.PubKeyToAddress(pub)
+	works := 0
+	swept, err := OfflineSweep(seed, carried, dest, func(root types.BlockHash, threshold uint64) (types.Work, error) {
+		works++
+		return blocks.GenerateWorkThreshold(root, threshold), nil
+	})
+	DefaultLedger = saved
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(swept) != 4 || works != 4 {
+		t.Fatalf("Expected a receive and an open, each with a send, got %d blocks with %d works", len(swept), works)
+	}
+	var file bytes.Buffer
+	if err = WriteBlockFile(&file, swept); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadBlockFile(&file)
+	if err != nil || len(read) != len(swept) {
+		t.Fatalf("Read back %d blocks: %v", len(read), err)
+	}
+	for i, block := range read {
+		if block.Hash() != swept[i].Hash() || block.GetSignature() != swept[i].GetSignature() {
+			t.Errorf("Block %d changed in the file", i)
+		}
+		if err := store.StoreBlock(block); err != nil {
+			t.Fatalf("Block %d not accepted: %s", i, err)
+		}
+	}
+	// Dust, so not in the receivable total
+	if pending := DefaultLedger.Pending(dest); len(pending) != 2 {
+		t.Errorf("Expected both sweeps pending at the destination, got %v", pending)
+	}
+	for _, account := range []types.Account{opened, unopened} {
+		if info := DefaultLedger.Account(account); !info.Opened || info.Balance != uint128.FromInts(0, 0) || len(DefaultLedger.Pending(account)) != 0 {
+			t.Errorf("%s not swept: %+v", account, info)
+		}
+	}
+
+	bad := map[string]func(f []AccountFacts){
+		"receivable":        func(f []AccountFacts) { f[0].Receivable = "100" },
+		"frontier":          func(f []AccountFacts) { f[0].Frontier = "ABC" },
+		"index":             func(f []AccountFacts) { f[0].Index = 5 },
+		"balance":           func(f []AccountFacts) { f[0].Balance = "1e3" },
+		"unopened balance":  func(f []AccountFacts) { f[1].Balance = "10" },
+		"duplicate pending": func(f []AccountFacts) { f[1].Pending[0] = f[0].Pending[0] },
+		"duplicate account": func(f []AccountFacts) { f[1] = f[0] },
+	}
+	for name, mutate := range bad {
+		var f []AccountFacts
+		json.Unmarshal(data, &f)
+		mutate(f)
+		if _, err := OfflineSweep(seed, f, dest, nil); errors.Cause(err) != ErrBadFacts {
+			t.Errorf("Expected bad facts for %s, got %v", name, err)
+		}
+	}
+}
+
+func TestFileLock(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "filelock")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "wallet.json")
+
+	lock, err := LockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LockFile(path)
+	locked, ok := err.(*LockedError)
+	if !ok || locked.Holder.PID != os.Getpid() || !strings.Contains(err.Error(), fmt.Sprintf("pid %d", os.Getpid())) {
+		t.Errorf("Expected an error naming this process, got %v", err)
+	}
+	lock.Unlock()
+
+	// A crashed holder on this host leaves its heartbeat behind
+	host, _ := os.Hostname()
+	holder := func(h LockHolder) {
+		data, _ := json.Marshal(h)
+		ioutil.WriteFile(path+".lock", data, 0600)
+	}
+	holder(LockHolder{PID: 1 << 30, Host: host, Heartbeat: time.Now().Unix()})
+	lock, err = LockFile(path)
+	if err != nil {
+		t.Errorf("Lock of a dead process not taken over: %s", err)
+	} else {
+		lock.Unlock()
+	}
+
+	// Another host's lock holds until it goes stale
+	holder(LockHolder{PID: 42, Host: "elsewhere", Heartbeat: time.Now().Unix()})
+	_, err = LockFile(path)
+	if err == nil || !strings.Contains(err.Error(), "pid 42 on elsewhere") {
+		t.Errorf("Took over a live lock from another host: %v", err)
+	}
+	holder(LockHolder{PID: 42, Host: "elsewhere", Heartbeat: time.Now().Add(-StaleLockAge - time.Second).Unix()})
+	lock, err = LockFile(path)
+	if err != nil {
+		t.Fatalf("Stale lock not taken over: %s", err)
+	}
+	data, _ := ioutil.ReadFile(path + ".lock")
+	var h LockHolder
+	if json.Unmarshal(data, &h) != nil || h.PID != os.Getpid() || h.Host != host {
+		t.Errorf("Lock file doesn't name its holder: %s", data)
+	}
+	lock.Unlock()
+
+	// OpenKeystore holds the lock until Close
+	CreateKeystore(path, "password", strings.Repeat("ab", 32), KDFParams{Iterations: 1000})
+	k, err := OpenKeystore(path, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenKeystore(path, "password"); err == nil {
+		t.Errorf("Opened a keystore twice")
+	}
+	k.Close()
+	if k, err = OpenKeystore(path, "password"); err != nil {
+		t.Errorf("Keystore still locked after Close: %s", err)
+	}
+	k.Close()
+}
+
+// Asserts the sends form one chain from root, with no two on the same
+// block.
+func checkNoForks(t *testing.T, root types.BlockHash, sends []*blocks.SendBlock) {
+	byPrevious := make(map[types.BlockHash]*blocks.SendBlock)
+	for _, send := range sends {
+		if other, ok := byPrevious[send.PreviousHash]; ok {
+			t.Fatalf("Forked on %s: %s and %s", send.PreviousHash, other.Hash(), send.Hash())
+		}
+		byPrevious[send.PreviousHash] = send
+	}
+	chain := 0
+	for send, ok := byPrevious[root]; ok; send, ok = byPrevious[send.Hash()] {
+		chain++
+	}
+	if chain != len(sends) {
+		t.Errorf("Chain of %d from %d sends", chain, len(sends))
+	}
+}
+
+func TestConcurrentSends(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+
+	dir, _ := ioutil.TempDir("", "sends")
+	defer os.RemoveAll(dir)
+	k, _ := CreateKeystore(filepath.Join(dir, "wallet.json"), "password", strings.Repeat("ab", 32), KDFParams{Iterations: 1000})
+	k.AddAdHoc(blocks.TestPrivateKey)
+	genesis := k.AdHocWallets()[0]
+
+	const workers, each = 4, 10
+	var lock sync.Mutex
+	var sends []*blocks.SendBlock
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		// Half from the keystore, half copies of one wallet
+		w := k.AdHocWallets()[0]
+		if i%2 == 1 {
+			w = genesis
+		}
+		wg.Add(1)
+		go func(w Wallet) {
+			defer wg.Done()
+			for n := 0; n < each; {
+				send, err := w.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 1))
+				if err != nil {
+					w.GeneratePowSync()
+					continue
+				}
+				lock.Lock()
+				sends = append(sends, send)
+				lock.Unlock()
+				n++
+			}
+		}(w)
+	}
+	wg.Wait()
+	checkNoForks(t, blocks.TestGenesisBlock.Hash(), sends)
+}
+
+// Receives racing each other and sends on one account, as when a burst of
+// sends lands while the user receives by hand, never fork it.
+func TestReceiveBurst(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+
+	genesis := New(blocks.TestPrivateKey)
+	_, priv := address.GenerateKey()
+	w := New(hex.EncodeToString(priv))
+	amount := uint128.FromInts(0, 10)
+	var sources []types.BlockHash
+	for i := 0; i < 21; i++ {
+		genesis.GeneratePowSync()
+		send, err := genesis.Send(w.Address(), amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.StoreBlock(send)
+		sources = append(sources, send.Hash())
+	}
+	w.GeneratePowSync()
+	open, err := w.Open(sources[0], w.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.StoreBlock(open)
+	sources = sources[1:]
+
+	var lock sync.Mutex
+	receives := make(map[types.BlockHash]types.BlockHash)
+	publish := func(block blocks.Block) {
+		// Blocks published ahead of their previous wait in the
+		// unconnected pool
+		if err := store.StoreBlock(block); err != nil && err != store.ErrMissingParent {
+			t.Errorf("Storing %s: %s", block.Hash(), err)
+		}
+		if receive, ok := block.(*blocks.ReceiveBlock); ok {
+			lock.Lock()
+			defer lock.Unlock()
+			if other, ok := receives[receive.SourceHash]; ok && other != receive.Hash() {
+				t.Errorf("Received %s twice", receive.SourceHash)
+			}
+			receives[receive.SourceHash] = receive.Hash()
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, source := range sources {
+		// Each source twice over
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func(w Wallet, source types.BlockHash) {
+				defer wg.Done()
+				receive, err := w.AutoReceive(source)
+				if err != nil {
+					t.Errorf("AutoReceive: %s", err)
+				} else if receive != nil {
+					publish(receive)
+				}
+			}(w, source)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(w Wallet) {
+			defer wg.Done()
+			received, err := w.ReceiveAll()
+			if err != nil {
+				t.Errorf("ReceiveAll: %s", err)
+			}
+			for _, receive := range received {
+				publish(receive)
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func(w Wallet) {
+		defer wg.Done()
+		for n := 0; n < 5; {
+			send, err := w.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 1))
+			if err != nil {
+				w.GeneratePowSync()
+				continue
+			}
+			publish(send)
+			n++
+		}
+	}(w)
+	wg.Wait()
+
+	if len(receives) != len(sources) {
+		t.Errorf("Received %d of %d sources", len(receives), len(sources))
+	}
+	for _, source := range sources {
+		if store.IsPending(w.Address(), source) {
+			t.Errorf("%s still pending", source)
+		}
+	}
+	if _, err := w.Receive(sources[0]); err != ErrAlreadyReceived {
+		t.Errorf("Expected ErrAlreadyReceived, got %v", err)
+	}
+	if depth := w.QueueDepth(); depth != 0 {
+		t.Errorf("Queue depth %d after the burst", depth)
+	}
+}
+
+var multiProcess = flag.Bool("wallet.processes", false, "Run the wallet lock tests across processes")
+
+const lockHelperEnv = "NANO_WALLET_LOCK_HELPER"
+
+// Two processes sending from one keystore, each building on the frontier
+// the other left in a shared file while it holds the keystore open.
+func TestProcessSends(t *testing.T) {
+	if !*multiProcess {
+		t.Skip("Run with -wallet.processes")
+	}
+	dir, _ := ioutil.TempDir("", "processes")
+	defer os.RemoveAll(dir)
+	CreateKeystore(filepath.Join(dir, "wallet.json"), "password", strings.Repeat("ab", 32), KDFParams{Iterations: 1000})
+	root := &blocks.SendBlock{PreviousHash: blocks.TestGenesisBlock.Hash(), Destination: blocks.TestGenesisBlock.Account, Balance: uint128.FromInts(0, 1000)}
+	data, _ := json.Marshal(root)
+	ioutil.WriteFile(filepath.Join(dir, "frontier"), data, 0600)
+
+	var procs []*exec.Cmd
+	for i := 0; i < 2; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=TestLockHelperProcess")
+		cmd.Env = append(os.Environ(), lockHelperEnv+"="+dir)
+		cmd.Stderr = os.Stderr
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		procs = append(procs, cmd)
+	}
+	for _, cmd := range procs {
+		if err := cmd.Wait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(dir, "sends"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var sends []*blocks.SendBlock
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var send blocks.SendBlock
+		if err := json.Unmarshal(scanner.Bytes(), &send); err != nil {
+			t.Fatal(err)
+		}
+		sends = append(sends, &send)
+	}
+	if len(sends) != 40 {
+		t.Errorf("Expected 40 sends, got %d", len(sends))
+	}
+	checkNoForks(t, root.Hash(), sends)
+}
+
+// Sends 20 blocks from the keystore in the helper's directory, opening it
+// for each.
+func TestLockHelperProcess(t *testing.T) {
+	dir := os.Getenv(lockHelperEnv)
+	if dir == "" {
+		return
+	}
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	DefaultLedger = NewOfflineLedger()
+	for sent := 0; sent < 20; {
+		k, err := OpenKeystore(filepath.Join(dir, "wallet.json"), "password")
+		if _, ok := err.(*LockedError); ok {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, _ := ioutil.ReadFile(filepath.Join(dir, "frontier"))
+		var frontier blocks.SendBlock
+		json.Unmarshal(data, &frontier)
+		w := k.Wallet(0)
+		w.Head = &frontier
+		w.GeneratePowSync()
+		send, err := w.Send(blocks.TestGenesisBlock.Account, uint128.FromInts(0, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ = json.Marshal(send)
+		log, _ := os.OpenFile(filepath.Join(dir, "sends"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		log.Write(append(data, '\n'))
+		log.Close()
+		ioutil.WriteFile(filepath.Join(dir, "frontier"), data, 0600)
+		k.Close()
+		sent++
+	}
+}
@@ -0,0 +1,508 @@
+//go:build !light
+// +build !light
+
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/metrics"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/utils"
+	"github.com/pkg/errors"
+)
+
+const webhookPrefix = "webhooks"
+
+const WebhookTimestampHeader = "X-Nano-Timestamp"
+const WebhookSignatureHeader = "X-Nano-Signature"
+
+// Receivers should reject requests signed longer ago than this.
+const DefaultReplayWindow = 5 * time.Minute
+
+const webhookQueueSize = 1000
+const webhookAttempts = 5
+const maxWebhookBackoff = 10 * time.Minute
+
+// Deliveries held per endpoint while it's failing
+const maxHeldWebhooks = 1000
+
+// Consecutive failures that open an endpoint's circuit
+var WebhookBreakerThreshold = 5
+
+// Deliveries older than this are dead lettered instead of retried
+var MaxWebhookRetryAge = time.Hour
+
+// Overridden in tests
+var webhookBackoff = time.Second
+var webhookProbeInterval = time.Minute
+var webhookTick = time.Second
+
+var ErrBadWebhookSignature = errors.New("Bad webhook signature")
+var ErrStaleWebhook = errors.New("Webhook timestamp outside replay window")
+
+type Webhook struct {
+	URL string
+	// Shared with the receiver to sign requests
+	Secret string
+}
+
+type WebhookEvent struct {
+	Account types.Account    `json:"account"`
+	Hash    types.BlockHash  `json:"hash"`
+	Type    blocks.BlockType `json:"type"`
+}
+
+func RegisterWebhook(account types.Account, hook Webhook) error {
+	pub, err := address.AddressToPub(account)
+	if err != nil {
+		return err
+	}
+	return DefaultLedger.StoreMeta(webhookPrefix, pub, hook)
+}
+
+func RemoveWebhook(account types.Account) error {
+	pub, err := address.AddressToPub(account)
+	if err != nil {
+		return err
+	}
+	return DefaultLedger.DeleteMeta(webhookPrefix, pub)
+}
+
+func FetchWebhook(account types.Account) (Webhook, bool) {
+	var hook Webhook
+	pub, err := address.AddressToPub(account)
+	if err != nil {
+		return hook, false
+	}
+	return hook, DefaultLedger.FetchMeta(webhookPrefix, pub, &hook) == nil
+}
+
+// Hex HMAC-SHA256 over the timestamp, a dot, and the body.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook is for receivers to check a request's signature and that
+// it was signed within window of now.
+func VerifyWebhook(secret string, header http.Header, body []byte, window time.Duration) error {
+	timestamp, err := strconv.ParseInt(header.Get(WebhookTimestampHeader), 10, 64)
+	if err != nil {
+		return ErrBadWebhookSignature
+	}
+
+	expected := SignWebhook(secret, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(header.Get(WebhookSignatureHeader))) {
+		return ErrBadWebhookSignature
+	}
+
+	age := now().Sub(time.Unix(timestamp, 0))
+	if age > window || age < -window {
+		return ErrStaleWebhook
+	}
+	return nil
+}
+
+type webhookDelivery struct {
+	hook     Webhook
+	body     []byte
+	attempts int
+	created  time.Time
+	// The block notified about, if any
+	hash types.BlockHash
+}
+
+// Consecutive failures of one endpoint, so a down endpoint isn't
+// hammered by every new event. Deliveries waiting on it are held here
+// and released by the dispatcher's ticks.
+type endpointState struct {
+	failures int
+	retryAt  time.Time
+	// Open after WebhookBreakerThreshold failures in a row. Only one held
+	// delivery is let through per probe interval until one succeeds.
+	open                            bool
+	held                            []*webhookDelivery
+	delivered, failed, deadLettered uint64
+}
+
+type WebhookHealth struct {
+	URL string
+	// closed, open or half_open
+	State string
+	// In a row
+	Failures int
+	Held     int
+	// Over the dispatcher's lifetime
+	Delivered    uint64
+	Failed       uint64
+	DeadLettered uint64
+}
+
+// A delivery given up on, kept to be replayed once its endpoint is back.
+type DeadLetter struct {
+	URL   string          `json:"url"`
+	Event json.RawMessage `json:"event"`
+	// Unix seconds
+	Created  int64  `json:"created"`
+	Attempts int    `json:"attempts"`
+	Reason   string `json:"reason"`
+}
+
+// WebhookDispatcher delivers events from a bounded queue, dropping new
+// events when the queue is full rather than blocking the caller.
+// Deliveries that keep failing, or are older than MaxWebhookRetryAge, are
+// appended to DeadLetterPath, or dropped if it's empty.
+type WebhookDispatcher struct {
+	DeadLetterPath string
+	// Where deliveries for blocks are recorded. Nil for none.
+	Tracer    *metrics.Tracer
+	lock      sync.Mutex
+	queue     chan *webhookDelivery
+	endpoints map[string]*endpointState
+	client    *http.Client
+	done      chan bool
+	deadLock  sync.Mutex
+}
+
+func NewWebhookDispatcher(size int) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		queue:     make(chan *webhookDelivery, size),
+		endpoints: make(map[string]*endpointState),
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+					return utils.Outbound.DialContext(ctx, network, addr)
+				},
+			},
+		},
+		done:   make(chan bool),
+		Tracer: metrics.Traces,
+	}
+}
+
+var Webhooks = NewWebhookDispatcher(webhookQueueSize)
+
+func (d *WebhookDispatcher) Start() {
+	go func() {
+		ticker := time.NewTicker(webhookTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.done:
+				return
+			case delivery := <-d.queue:
+				d.deliver(delivery)
+			case <-ticker.C:
+				d.release()
+			}
+		}
+	}()
+}
+
+func (d *WebhookDispatcher) Stop() {
+	d.done <- true
+}
+
+// Queues an event for the account's webhook, if it has one. Returns false
+// if the event was dropped.
+func (d *WebhookDispatcher) Notify(event WebhookEvent) bool {
+	hook, ok := FetchWebhook(event.Account)
+	if !ok {
+		return true
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return false
+	}
+	return d.enqueue(&webhookDelivery{hook, body, 0, now(), event.Hash})
+}
+
+// Notifies the destination of a send. Other block types don't name an
+// account we can notify without walking the chain.
+func (d *WebhookDispatcher) NotifyBlock(block blocks.Block) bool {
+	send, ok := block.(*blocks.SendBlock)
+	if !ok {
+		return true
+	}
+	return d.Notify(WebhookEvent{send.Destination, send.Hash(), send.Type()})
+}
+
+func (d *WebhookDispatcher) enqueue(delivery *webhookDelivery) bool {
+	select {
+	case d.queue <- delivery:
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *WebhookDispatcher) endpoint(url string) *endpointState {
+	state := d.endpoints[url]
+	if state == nil {
+		state = &endpointState{}
+		d.endpoints[url] = state
+	}
+	return state
+}
+
+// Keeps a delivery until its endpoint can be tried again, dead lettering
+// the oldest beyond maxHeldWebhooks. Called with the lock held.
+func (d *WebhookDispatcher) hold(state *endpointState, delivery *webhookDelivery) {
+	state.held = append(state.held, delivery)
+	if len(state.held) > maxHeldWebhooks {
+		d.deadLetter(state, state.held[0], "backlog full")
+		state.held = state.held[1:]
+	}
+}
+
+// Appends a delivery to the dead letter file. Called with the lock held.
+func (d *WebhookDispatcher) deadLetter(state *endpointState, delivery *webhookDelivery, reason string) {
+	state.deadLettered++
+	if d.DeadLetterPath == "" {
+		return
+	}
+
+	d.deadLock.Lock()
+	defer d.deadLock.Unlock()
+	f, err := os.OpenFile(d.DeadLetterPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("Failed to dead letter webhook for %s: %s", delivery.hook.URL, err)
+		return
+	}
+	defer f.Close()
+	err = utils.WriteRecord(f, DeadLetter{delivery.hook.URL, delivery.body, delivery.created.Unix(), delivery.attempts, reason})
+	if err != nil {
+		log.Printf("Failed to dead letter webhook for %s: %s", delivery.hook.URL, err)
+	}
+}
+
+func (d *WebhookDispatcher) deliver(delivery *webhookDelivery) {
+	d.lock.Lock()
+	state := d.endpoint(delivery.hook.URL)
+	if now().Sub(delivery.created) > MaxWebhookRetryAge {
+		d.deadLetter(state, delivery, "expired")
+		d.lock.Unlock()
+		return
+	}
+	if now().Before(state.retryAt) {
+		d.hold(state, delivery)
+		d.lock.Unlock()
+		return
+	}
+	if state.open {
+		// Half open: this delivery is the probe
+		state.retryAt = now().Add(webhookProbeInterval)
+	}
+	d.lock.Unlock()
+
+	delivery.attempts++
+	utils.CountRetry("webhook", 1, 0)
+	err := d.post(delivery)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err == nil {
+		d.Tracer.Record(delivery.hash, metrics.StageCallback)
+		state.delivered++
+		state.failures = 0
+		state.retryAt = time.Time{}
+		state.open = false
+		return
+	}
+
+	state.failed++
+	if utils.ClassifyError(err) == utils.RetryPermanent {
+		// The endpoint rejected this event: retrying won't help, and says
+		// nothing about the endpoint's health
+		utils.CountRetry("webhook", 0, 1)
+		d.deadLetter(state, delivery, err.Error())
+		return
+	}
+	state.failures++
+	if state.failures >= WebhookBreakerThreshold {
+		if !state.open {
+			log.Printf("Webhook endpoint %s failed %d times in a row, holding its events", delivery.hook.URL, state.failures)
+		}
+		state.open = true
+		state.retryAt = now().Add(webhookProbeInterval)
+	} else {
+		backoff := utils.RetryPolicy{Base: webhookBackoff, Max: maxWebhookBackoff}.Backoff(state.failures)
+		state.retryAt = now().Add(backoff)
+	}
+
+	// Endpoints with an open circuit keep their events until they expire
+	if delivery.attempts >= webhookAttempts && !state.open {
+		utils.CountRetry("webhook", 0, 1)
+		d.deadLetter(state, delivery, err.Error())
+		return
+	}
+	d.hold(state, delivery)
+}
+
+// Requeues held deliveries whose endpoints can be tried again, one at a
+// time for open circuits, and dead letters expired ones.
+func (d *WebhookDispatcher) release() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for _, state := range d.endpoints {
+		held := state.held[:0]
+		for _, delivery := range state.held {
+			if now().Sub(delivery.created) > MaxWebhookRetryAge {
+				d.deadLetter(state, delivery, "expired")
+			} else {
+				held = append(held, delivery)
+			}
+		}
+		state.held = held
+		if now().Before(state.retryAt) {
+			continue
+		}
+
+		for len(state.held) > 0 && d.enqueue(state.held[0]) {
+			state.held = state.held[1:]
+			if state.open {
+				break
+			}
+		}
+		if len(state.held) == 0 {
+			state.held = nil
+		}
+	}
+}
+
+func (d *WebhookDispatcher) Health() []WebhookHealth {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var health []WebhookHealth
+	for url, state := range d.endpoints {
+		h := WebhookHealth{url, "closed", state.failures, len(state.held), state.delivered, state.failed, state.deadLettered}
+		if state.open && now().Before(state.retryAt) {
+			h.State = "open"
+		} else if state.open {
+			h.State = "half_open"
+		}
+		health = append(health, h)
+	}
+	sort.Slice(health, func(i, j int) bool { return health[i].URL < health[j].URL })
+	return health
+}
+
+// Endpoints by circuit state, and the events they hold, for Webhooks.
+func webhookSeries(held bool) map[string]float64 {
+	series := map[string]float64{"closed": 0, "open": 0, "half_open": 0}
+	for _, h := range Webhooks.Health() {
+		if held {
+			series[h.State] += float64(h.Held)
+		} else {
+			series[h.State]++
+		}
+	}
+	return series
+}
+
+var webhookEndpointGauge = metrics.NewGaugeFunc("nano_webhook_endpoints", "Webhook endpoints by circuit state.", "state", func() map[string]float64 {
+	return webhookSeries(false)
+})
+
+var webhookHeldGauge = metrics.NewGaugeFunc("nano_webhook_held_events", "Webhook events held for failing endpoints.", "state", func() map[string]float64 {
+	return webhookSeries(true)
+})
+
+// ReplayDeadLetters delivers dead lettered events again, to their
+// account's current webhook, and rewrites the file with those that still
+// fail. Events for accounts without a webhook any more are dropped.
+func (d *WebhookDispatcher) ReplayDeadLetters(path string) (delivered int, remaining int, err error) {
+	d.deadLock.Lock()
+	defer d.deadLock.Unlock()
+
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer in.Close()
+	out, err := os.Create(path + ".replay")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	err = utils.ReadRecords(in, func(data []byte) error {
+		var letter DeadLetter
+		if err := json.Unmarshal(data, &letter); err != nil {
+			return errors.Wrap(err, "Bad dead letter")
+		}
+		var event WebhookEvent
+		if err := json.Unmarshal(letter.Event, &event); err != nil {
+			return errors.Wrap(err, "Bad dead letter event")
+		}
+		hook, ok := FetchWebhook(event.Account)
+		if !ok {
+			return nil
+		}
+
+		if d.post(&webhookDelivery{hook, letter.Event, letter.Attempts, time.Unix(letter.Created, 0), ""}) == nil {
+			delivered++
+			return nil
+		}
+		remaining++
+		letter.URL = hook.URL
+		letter.Attempts++
+		letter.Reason = "replay failed"
+		return utils.WriteRecord(out, letter)
+	})
+	if err != nil {
+		return delivered, remaining, err
+	}
+	if err = out.Close(); err != nil {
+		return delivered, remaining, err
+	}
+	return delivered, remaining, os.Rename(out.Name(), path)
+}
+
+func (d *WebhookDispatcher) post(delivery *webhookDelivery) error {
+	req, err := http.NewRequest("POST", delivery.hook.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return utils.Permanent(err)
+	}
+
+	timestamp := now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(delivery.hook.Secret, timestamp, delivery.body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &utils.StatusError{Code: resp.StatusCode, Message: "Webhook returned " + resp.Status}
+	}
+	return nil
+}
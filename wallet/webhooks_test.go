@@ -0,0 +1,227 @@
+//go:build !light
+// +build !light
+
+package wallet
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/frankh/nano/address"
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/protocol"
+	"github.com/frankh/nano/store"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/uint128"
+)
+
+func TestWebhooks(t *testing.T) {
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	store.Init(store.TestConfig)
+	webhookBackoff = 10 * time.Millisecond
+	defer func() { webhookBackoff = time.Second }()
+
+	type request struct {
+		header http.Header
+		body   []byte
+		err    error
+	}
+	requests := make(chan request, 10)
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- request{r.Header, body, VerifyWebhook("secret", r.Header, body, DefaultReplayWindow)}
+		// Fail the first delivery to exercise the retry
+		calls++
+		if calls == 1 {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	_, priv := address.GenerateKey()
+	merchant := New(hex.EncodeToString(priv))
+	err := RegisterWebhook(merchant.Address(), Webhook{server.URL, "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hook, ok := FetchWebhook(merchant.Address()); !ok || hook.URL != server.URL {
+		t.Errorf("Webhook not registered")
+	}
+
+	d := NewWebhookDispatcher(10)
+	d.Start()
+	defer d.Stop()
+
+	w := New(blocks.TestPrivateKey)
+	w.GeneratePowSync()
+	send, _ := w.Send(merchant.Address(), uint128.FromInts(0, 1))
+	d.NotifyBlock(send)
+
+	var req request
+	for i := 0; i < 2; i++ {
+		select {
+		case req = <-requests:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Webhook not delivered")
+		}
+		if req.err != nil {
+			t.Errorf("Webhook signature rejected: %s", req.err)
+		}
+	}
+
+	var event WebhookEvent
+	json.Unmarshal(req.body, &event)
+	if event.Hash != send.Hash() || event.Account != merchant.Address() {
+		t.Errorf("Unexpected event %v", event)
+	}
+
+	tampered := append([]byte{}, req.body...)
+	tampered[0] = ' '
+	if VerifyWebhook("secret", req.header, tampered, DefaultReplayWindow) != ErrBadWebhookSignature {
+		t.Errorf("Accepted tampered body")
+	}
+	if VerifyWebhook("other", req.header, req.body, DefaultReplayWindow) != ErrBadWebhookSignature {
+		t.Errorf("Accepted wrong secret")
+	}
+
+	// Replaying the captured request later is rejected
+	now = func() time.Time { return time.Now().Add(DefaultReplayWindow + time.Minute) }
+	defer func() { now = time.Now }()
+	if VerifyWebhook("secret", req.header, req.body, DefaultReplayWindow) != ErrStaleWebhook {
+		t.Errorf("Accepted replayed webhook")
+	}
+
+	RemoveWebhook(merchant.Address())
+	if _, ok := FetchWebhook(merchant.Address()); ok {
+		t.Errorf("Webhook not removed")
+	}
+}
+
+func TestWebhookCircuitBreaker(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+	webhookBackoff, webhookTick = time.Millisecond, time.Millisecond
+	defer func() { webhookBackoff, webhookTick = time.Second, time.Second }()
+
+	var lock sync.Mutex
+	clock := time.Now()
+	now = func() time.Time {
+		lock.Lock()
+		defer lock.Unlock()
+		return clock
+	}
+	defer func() { now = time.Now }()
+	advance := func(d time.Duration) {
+		lock.Lock()
+		clock = clock.Add(d)
+		lock.Unlock()
+	}
+
+	var down int32 = 1
+	var posts, received int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&posts, 1)
+		if atomic.LoadInt32(&down) == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		atomic.AddInt32(&received, 1)
+	}))
+	defer server.Close()
+
+	_, priv := address.GenerateKey()
+	merchant := New(hex.EncodeToString(priv))
+	RegisterWebhook(merchant.Address(), Webhook{server.URL, "secret"})
+
+	dir, _ := ioutil.TempDir("", "webhooks")
+	defer os.RemoveAll(dir)
+	d := NewWebhookDispatcher(10)
+	d.DeadLetterPath = filepath.Join(dir, "dead")
+	d.Start()
+
+	health := func() WebhookHealth {
+		for _, h := range d.Health() {
+			if h.URL == server.URL {
+				return h
+			}
+		}
+		return WebhookHealth{}
+	}
+
+	// Down for an hour, with an event every second
+	const events = 3600
+	for i := 0; i < events; i++ {
+		event := WebhookEvent{merchant.Address(), types.BlockHash(fmt.Sprintf("%064X", i)), blocks.Send}
+		for !d.Notify(event) {
+			time.Sleep(time.Millisecond)
+		}
+		advance(time.Second)
+		if h := health(); h.Held > maxHeldWebhooks {
+			t.Fatalf("Holding %d events", h.Held)
+		}
+	}
+	if h := health(); h.State == "closed" || h.Delivered != 0 {
+		t.Errorf("Circuit not open for a down endpoint: %+v", h)
+	}
+	// The threshold, then a probe a minute
+	if n := atomic.LoadInt32(&posts); n > int32(WebhookBreakerThreshold+70) {
+		t.Errorf("Down endpoint was posted %d times", n)
+	}
+
+	// Everything still held expires into the dead letters
+	advance(MaxWebhookRetryAge + time.Minute)
+	for i := 0; health().DeadLettered < events; i++ {
+		if i == 5000 {
+			t.Fatalf("Events not dead lettered: %+v", health())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	d.Stop()
+
+	atomic.StoreInt32(&down, 0)
+	delivered, remaining, err := d.ReplayDeadLetters(d.DeadLetterPath)
+	if err != nil || delivered != events || remaining != 0 || atomic.LoadInt32(&received) != events {
+		t.Errorf("Replayed %d with %d remaining, %d received: %v", delivered, remaining, received, err)
+	}
+	delivered, remaining, err = d.ReplayDeadLetters(d.DeadLetterPath)
+	if err != nil || delivered != 0 || remaining != 0 {
+		t.Errorf("Replayed events left in the dead letters")
+	}
+}
+
+// A rejected event is dead lettered at once, without tripping the breaker.
+func TestWebhookRejected(t *testing.T) {
+	store.Init(store.TestConfig)
+	defer os.RemoveAll(store.TestConfig.Path)
+
+	var posts int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&posts, 1)
+		rw.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	_, priv := address.GenerateKey()
+	merchant := New(hex.EncodeToString(priv))
+	RegisterWebhook(merchant.Address(), Webhook{server.URL, "secret"})
+
+	d := NewWebhookDispatcher(10)
+	d.Notify(WebhookEvent{merchant.Address(), types.BlockHash(fmt.Sprintf("%064X", 1)), blocks.Send})
+	d.deliver(<-d.queue)
+
+	h := d.Health()
+	if len(h) != 1 || h[0].DeadLettered != 1 || h[0].Failures != 0 || h[0].Held != 0 || atomic.LoadInt32(&posts) != 1 {
+		t.Errorf("Rejected webhook not dead lettered: %+v after %d posts", h, posts)
+	}
+}
@@ -0,0 +1,202 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sync"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/types"
+	"github.com/frankh/nano/utils"
+)
+
+const workCachePrefix = "workcache"
+const DefaultWorkCacheSize = 10000
+
+// Overridden in tests
+var generateWork = blocks.GenerateWorkThreshold
+
+// Work generated for an account's current root, kept across restarts.
+type cachedWork struct {
+	Root       types.BlockHash
+	Work       types.Work
+	Difficulty uint64
+	// Unix nanoseconds
+	Created  int64
+	LastUsed int64
+}
+
+// WorkCache keeps one precomputed work per account in memory, backed by
+// the store. Entries are dropped once the account's frontier moves past
+// their root.
+type WorkCache struct {
+	lock    sync.Mutex
+	max     int
+	entries map[string]*cachedWork
+	// Entries in the store, -1 until counted
+	count int
+}
+
+func NewWorkCache(max int) *WorkCache {
+	return &WorkCache{max: max, entries: make(map[string]*cachedWork), count: -1}
+}
+
+var Works = NewWorkCache(DefaultWorkCacheSize)
+
+// Rough bytes per entry held in memory
+const workEntrySize = 250
+
+func init() {
+	utils.RegisterMemory("work_cache", workEntrySize, DefaultWorkCacheSize,
+		func() int { return Works.len() },
+		func(limit int) { Works.setMax(limit) })
+}
+
+// Entries loaded into memory.
+func (c *WorkCache) len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries)
+}
+
+// Evicts entries over the new size, in memory and from the store.
+func (c *WorkCache) setMax(max int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.max = max
+	for len(c.entries) > max {
+		var oldest []byte
+		var lastUsed int64
+		for pub, entry := range c.entries {
+			if oldest == nil || entry.LastUsed < lastUsed {
+				oldest, lastUsed = []byte(pub), entry.LastUsed
+			}
+		}
+		c.remove(oldest)
+	}
+	if c.count > max {
+		c.evict()
+	}
+}
+
+// Loads the account's entry from the store if it isn't in memory yet.
+func (c *WorkCache) load(pub []byte) *cachedWork {
+	entry := c.entries[string(pub)]
+	if entry != nil {
+		return entry
+	}
+
+	var stored cachedWork
+	if DefaultLedger.FetchMeta(workCachePrefix, pub, &stored) != nil {
+		return nil
+	}
+	c.entries[string(pub)] = &stored
+	return &stored
+}
+
+// Get returns cached work for root if it meets threshold. Work for any
+// other root is stale and dropped.
+func (c *WorkCache) Get(pub []byte, root types.BlockHash, threshold uint64) (types.Work, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry := c.load(pub)
+	if entry == nil {
+		return "", false
+	}
+	if entry.Root != root {
+		c.remove(pub)
+		return "", false
+	}
+	if entry.Difficulty < threshold {
+		return "", false
+	}
+
+	entry.LastUsed = now().UnixNano()
+	DefaultLedger.StoreMeta(workCachePrefix, pub, entry)
+	return entry.Work, true
+}
+
+func (c *WorkCache) Put(pub []byte, root types.BlockHash, work types.Work) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.count < 0 {
+		c.count = 0
+		DefaultLedger.IterateMeta(workCachePrefix, func(key []byte, value []byte) error {
+			c.count++
+			return nil
+		})
+	}
+	existed := c.load(pub) != nil
+
+	at := now().UnixNano()
+	entry := &cachedWork{root, work, blocks.RootWorkValue(root, work), at, at}
+	c.entries[string(pub)] = entry
+	err := DefaultLedger.StoreMeta(workCachePrefix, pub, entry)
+	if err != nil {
+		return err
+	}
+	if !existed {
+		c.count++
+	}
+	if c.count > c.max {
+		c.evict()
+	}
+	return nil
+}
+
+// Remove drops an account's work, once it has been used in a block.
+func (c *WorkCache) Remove(pub []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.load(pub) != nil {
+		c.remove(pub)
+	}
+}
+
+// Only for entries known to exist.
+func (c *WorkCache) remove(pub []byte) {
+	delete(c.entries, string(pub))
+	DefaultLedger.DeleteMeta(workCachePrefix, pub)
+	if c.count > 0 {
+		c.count--
+	}
+}
+
+// Drops the least recently used entries over the size cap. Scans the
+// store, so only runs once the cap is hit.
+func (c *WorkCache) evict() {
+	type stored struct {
+		pub      []byte
+		lastUsed int64
+	}
+	var all []stored
+	DefaultLedger.IterateMeta(workCachePrefix, func(key []byte, value []byte) error {
+		var entry cachedWork
+		if gob.NewDecoder(bytes.NewBuffer(value)).Decode(&entry) == nil {
+			all = append(all, stored{append([]byte{}, key...), entry.LastUsed})
+		}
+		return nil
+	})
+
+	for len(all) > c.max {
+		oldest := 0
+		for i := range all {
+			if all[i].lastUsed < all[oldest].lastUsed {
+				oldest = i
+			}
+		}
+		c.remove(all[oldest].pub)
+		all = append(all[:oldest], all[oldest+1:]...)
+	}
+}
+
+// Prime loads the entries for the wallets' current roots into memory,
+// dropping stale ones. Meant to run in the background on startup.
+func (c *WorkCache) Prime(wallets []*Wallet) {
+	for _, w := range wallets {
+		c.Get(w.PublicKey, w.root(), 0)
+	}
+}
@@ -0,0 +1,638 @@
+// Package workserver generates proof of work for other nodes and wallets
+// over http, answering the reference node's work_generate, work_validate
+// and work_cancel actions. It needs no ledger, so a machine can run it on
+// its own with "nano work serve".
+package workserver
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/metrics"
+	"github.com/frankh/nano/rpcclient"
+	"github.com/frankh/nano/types"
+	"github.com/pkg/errors"
+)
+
+// Requests larger than this are rejected
+const maxRequestSize = 1 << 16
+
+// Requests one client may have queued or generating at once
+const DefaultMaxPerClient = 4
+
+var ErrUnauthorized = errors.New("Client not allowed")
+var ErrTooManyRequests = errors.New("Too many work requests")
+
+type ClientStats struct {
+	// Requests queued or generating
+	Active int
+	// Requests waiting for a worker
+	Queued    int
+	Generated uint64
+	Cancelled uint64
+	// Requests refused for being over the client's limit
+	Rejected uint64
+	// Time requests spent waiting for a worker, in total
+	Waited time.Duration
+}
+
+type Stats struct {
+	Queued  int
+	Running int
+	Clients map[string]ClientStats
+}
+
+type job struct {
+	root      types.BlockHash
+	threshold uint64
+	// Interactive requests go first, then higher priority, then earlier
+	interactive bool
+	priority    int
+	seq         uint64
+	queued      time.Time
+	client      string
+	ctx         context.Context
+	cancel      context.CancelFunc
+	done        chan result
+	index       int
+}
+
+type result struct {
+	work types.Work
+	err  error
+}
+
+type jobQueue []*job
+
+func (q jobQueue) Len() int { return len(q) }
+func (q jobQueue) Less(i, j int) bool {
+	if q[i].before(q[j]) || q[j].before(q[i]) {
+		return q[i].before(q[j])
+	}
+	return q[i].seq < q[j].seq
+}
+func (q jobQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+func (q *jobQueue) Push(x interface{}) {
+	j := x.(*job)
+	j.index = len(*q)
+	*q = append(*q, j)
+}
+func (q *jobQueue) Pop() interface{} {
+	old := *q
+	j := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	j.index = -1
+	return j
+}
+
+// Whether a's class goes ahead of b's, ignoring when they were queued.
+func (a *job) before(b *job) bool {
+	if a.interactive != b.interactive {
+		return a.interactive
+	}
+	return a.priority > b.priority
+}
+
+// A client's queued requests, and when it was last served. Kept while
+// empty, like the client's stats, so a client can't skip ahead by
+// letting its queue run dry between bursts.
+type clientQueue struct {
+	jobs   jobQueue
+	served uint64
+}
+
+// Server queues work requests per client and generates them on Workers
+// goroutines. Clients take turns: the next request is the best queued
+// one, interactive before batch and then by priority, from whichever
+// client with one that good was served longest ago. So a client with a
+// burst of requests only holds up the others by one request each. A
+// request is cancelled when its client disconnects or sends work_cancel
+// for its hash.
+//
+// Clients are told apart by IP, or by a token they present as
+// "Authorization: Bearer <token>".
+type Server struct {
+	// Client networks allowed to use the server, any if empty
+	Allow []*net.IPNet
+	// Client names by token. Clients with a token are let in from any
+	// address.
+	Tokens map[string]string
+	// Requests one client may have queued or generating, unlimited if zero
+	MaxPerClient int
+	Workers      int
+
+	lock    sync.Mutex
+	queues  map[string]*clientQueue
+	queued  int
+	served  uint64
+	jobs    map[types.BlockHash][]*job
+	clients map[string]*ClientStats
+	seq     uint64
+	running int
+	wake    chan bool
+	done    chan bool
+
+	generate func(context.Context, types.BlockHash, uint64) (types.Work, error)
+}
+
+func NewServer() *Server {
+	return &Server{
+		MaxPerClient: DefaultMaxPerClient,
+		Workers:      runtime.NumCPU(),
+		queues:       make(map[string]*clientQueue),
+		jobs:         make(map[types.BlockHash][]*job),
+		clients:      make(map[string]*ClientStats),
+		wake:         make(chan bool, 1),
+		generate:     blocks.GenerateWorkContext,
+	}
+}
+
+var Default = NewServer()
+
+// ParseAllow parses a comma separated list of IPs and CIDR networks.
+func ParseAllow(list string) ([]*net.IPNet, error) {
+	var allow []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.Errorf("Bad address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			allow = append(allow, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.Errorf("Bad network %q", s)
+		}
+		allow = append(allow, network)
+	}
+	return allow, nil
+}
+
+// Start generates queued work until Stop.
+func (s *Server) Start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.done != nil {
+		return
+	}
+	s.done = make(chan bool)
+	for i := 0; i < s.Workers; i++ {
+		go s.work(s.done)
+	}
+}
+
+func (s *Server) Stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.done != nil {
+		close(s.done)
+		s.done = nil
+	}
+}
+
+func (s *Server) work(done chan bool) {
+	for {
+		j := s.next()
+		if j == nil {
+			select {
+			case <-done:
+				return
+			case <-s.wake:
+			}
+			continue
+		}
+
+		work, err := s.generate(j.ctx, j.root, j.threshold)
+		j.done <- result{work, err}
+		s.lock.Lock()
+		s.running--
+		s.lock.Unlock()
+	}
+}
+
+// The next job that hasn't been cancelled while queued.
+func (s *Server) next() *job {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.queued > 0 {
+		j := s.dequeue()
+		if j.ctx.Err() == nil {
+			s.running++
+			// Let another worker look at the rest
+			if s.queued > 0 {
+				select {
+				case s.wake <- true:
+				default:
+				}
+			}
+			return j
+		}
+		j.done <- result{err: j.ctx.Err()}
+	}
+	return nil
+}
+
+// Takes the next job from the client whose turn it is. Called with the
+// lock held and something queued.
+func (s *Server) dequeue() *job {
+	var turn *clientQueue
+	for _, q := range s.queues {
+		if q.jobs.Len() == 0 {
+			continue
+		}
+		if turn == nil {
+			turn = q
+			continue
+		}
+		best, head := turn.jobs[0], q.jobs[0]
+		switch {
+		case head.before(best):
+			turn = q
+		case best.before(head):
+		case q.served < turn.served, q.served == turn.served && head.seq < best.seq:
+			// As good, and waiting longer for its turn
+			turn = q
+		}
+	}
+	j := heap.Pop(&turn.jobs).(*job)
+	s.unqueued(j)
+	s.served++
+	turn.served = s.served
+	return j
+}
+
+// Accounts for j leaving its client's queue. Called with the lock held.
+func (s *Server) unqueued(j *job) {
+	s.queued--
+	c := s.client(j.client)
+	c.Queued--
+	c.Waited += time.Since(j.queued)
+}
+
+func (s *Server) client(addr string) *ClientStats {
+	c := s.clients[addr]
+	if c == nil {
+		c = new(ClientStats)
+		s.clients[addr] = c
+	}
+	return c
+}
+
+// Generate queues work for root and waits for it, or for ctx to be done.
+// Interactive requests, for blocks someone is waiting on, go ahead of
+// batch ones precomputing work.
+func (s *Server) Generate(ctx context.Context, client string, root types.BlockHash, threshold uint64, priority int, interactive bool) (types.Work, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	j := &job{root: root, threshold: threshold, interactive: interactive, priority: priority, client: client, ctx: ctx, cancel: cancel, done: make(chan result, 1)}
+
+	s.lock.Lock()
+	c := s.client(client)
+	if s.MaxPerClient > 0 && c.Active >= s.MaxPerClient {
+		c.Rejected++
+		s.lock.Unlock()
+		return "", ErrTooManyRequests
+	}
+	c.Active++
+	c.Queued++
+	s.seq++
+	j.seq, j.queued = s.seq, time.Now()
+	q := s.queues[client]
+	if q == nil {
+		q = new(clientQueue)
+		s.queues[client] = q
+	}
+	heap.Push(&q.jobs, j)
+	s.queued++
+	s.jobs[root] = append(s.jobs[root], j)
+	s.lock.Unlock()
+	select {
+	case s.wake <- true:
+	default:
+	}
+
+	var r result
+	select {
+	case r = <-j.done:
+	case <-ctx.Done():
+		s.lock.Lock()
+		queued := j.index >= 0
+		if queued {
+			heap.Remove(&s.queues[client].jobs, j.index)
+			s.unqueued(j)
+		}
+		s.lock.Unlock()
+		if queued {
+			r.err = ctx.Err()
+		} else {
+			r = <-j.done
+		}
+	}
+
+	s.lock.Lock()
+	c.Active--
+	if r.err == nil {
+		c.Generated++
+	} else {
+		c.Cancelled++
+	}
+	jobs := s.jobs[root]
+	for i := range jobs {
+		if jobs[i] == j {
+			jobs = append(jobs[:i], jobs[i+1:]...)
+			break
+		}
+	}
+	if len(jobs) == 0 {
+		delete(s.jobs, root)
+	} else {
+		s.jobs[root] = jobs
+	}
+	s.lock.Unlock()
+	return r.work, r.err
+}
+
+// Cancel stops every request for root, returning how many there were.
+func (s *Server) Cancel(root types.BlockHash) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, j := range s.jobs[root] {
+		j.cancel()
+	}
+	return len(s.jobs[root])
+}
+
+func (s *Server) Stats() Stats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stats := Stats{Queued: s.queued, Running: s.running, Clients: make(map[string]ClientStats)}
+	for addr, c := range s.clients {
+		stats.Clients[addr] = *c
+	}
+	return stats
+}
+
+func (s *Server) allowed(ip net.IP) bool {
+	if len(s.Allow) == 0 {
+		return true
+	}
+	for _, network := range s.Allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Difficulty work needs when a request doesn't say
+func defaultThreshold() uint64 {
+	return blocks.RequiredDifficulty(blocks.CurrentVersion)
+}
+
+// The reference node's multiplier: how many times the base difficulty's
+// expected attempts difficulty needs.
+func multiplier(difficulty uint64, base uint64) string {
+	return strconv.FormatFloat(float64(-base)/float64(-difficulty), 'f', -1, 64)
+}
+
+// A request's difficulty, or failing that the one for its block_type
+// hint: the subtype of the state block the work is for. Only receives and
+// opens need less than the default, there being no legacy blocks left to
+// make at the current version.
+func parseDifficulty(req map[string]string) (uint64, error) {
+	s, ok := req["difficulty"]
+	if !ok {
+		switch req["block_type"] {
+		case "", "send", "change", "epoch":
+			return defaultThreshold(), nil
+		case "receive", "open":
+			return blocks.StateReceiveDifficulty(blocks.CurrentVersion), nil
+		}
+		return 0, errors.New("Bad block type")
+	}
+	d, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, rpcclient.ErrBadDifficulty
+	}
+	return d, nil
+}
+
+func parseHash(req map[string]string) (types.BlockHash, error) {
+	hash, err := types.ParseBlockHash(strings.ToUpper(req["hash"]))
+	if err != nil {
+		return "", rpcclient.ErrBadHash
+	}
+	return hash, nil
+}
+
+// ParseTokens parses a comma separated list of name:token pairs into
+// client names by token.
+func ParseTokens(list string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.Index(pair, ":")
+		if i <= 0 || i == len(pair)-1 {
+			return nil, errors.Errorf("Bad token %q, expected name:token", pair)
+		}
+		tokens[pair[i+1:]] = pair[:i]
+	}
+	return tokens, nil
+}
+
+// The client making r, by its token or else its IP, or "" if it isn't
+// let in.
+func (s *Server) identify(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		name, ok := s.Tokens[strings.TrimPrefix(auth, "Bearer ")]
+		if !ok {
+			return ""
+		}
+		return name
+	}
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	if ip == nil || !s.allowed(ip) {
+		return ""
+	}
+	return ip.String()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	client := s.identify(r)
+	if client == "" {
+		writeResponse(w, http.StatusForbidden, map[string]string{"error": ErrUnauthorized.Error()})
+		return
+	}
+
+	var req map[string]string
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err == nil && json.Unmarshal(body, &req) != nil {
+		err = rpcclient.ErrBadJSON
+	}
+	var response map[string]string
+	if err == nil {
+		response, err = s.call(r.Context(), client, req)
+	}
+	if r.Context().Err() != nil {
+		// The client's gone
+		return
+	}
+
+	status := http.StatusOK
+	if err == ErrTooManyRequests {
+		status = http.StatusTooManyRequests
+	}
+	if err != nil {
+		if err == context.Canceled {
+			err = rpcclient.ErrCancelled
+		}
+		response = map[string]string{"error": err.Error()}
+	}
+	writeResponse(w, status, response)
+}
+
+func (s *Server) call(ctx context.Context, client string, req map[string]string) (map[string]string, error) {
+	switch req["action"] {
+	case "work_generate", "work_validate", "work_cancel":
+	default:
+		return nil, rpcclient.ErrUnknownAction
+	}
+	hash, err := parseHash(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch req["action"] {
+	case "work_generate":
+		difficulty, err := parseDifficulty(req)
+		if err != nil {
+			return nil, err
+		}
+		priority, err := strconv.Atoi(req["priority"])
+		if err != nil && req["priority"] != "" {
+			return nil, errors.New("Bad priority")
+		}
+		interactive := req["interactive"] == "true"
+		work, err := s.Generate(ctx, client, hash, difficulty, priority, interactive)
+		if err != nil {
+			return nil, err
+		}
+		value := blocks.RootWorkValue(hash, work)
+		return map[string]string{
+			"hash":       string(hash),
+			"work":       string(work),
+			"difficulty": fmt.Sprintf("%016x", value),
+			"multiplier": multiplier(value, defaultThreshold()),
+		}, nil
+	case "work_validate":
+		work, err := types.ParseWork(strings.ToLower(req["work"]))
+		if err != nil {
+			return nil, rpcclient.ErrBadWork
+		}
+		difficulty, err := parseDifficulty(req)
+		if err != nil {
+			return nil, err
+		}
+		value := blocks.RootWorkValue(hash, work)
+		response := map[string]string{
+			"difficulty":    fmt.Sprintf("%016x", value),
+			"multiplier":    multiplier(value, defaultThreshold()),
+			"valid_all":     boolString(value >= blocks.RequiredDifficulty(blocks.CurrentVersion)),
+			"valid_receive": boolString(value >= blocks.StateReceiveDifficulty(blocks.CurrentVersion)),
+		}
+		if _, ok := req["difficulty"]; ok || req["block_type"] != "" {
+			response["valid"] = boolString(value >= difficulty)
+		}
+		return response, nil
+	case "work_cancel":
+		s.Cancel(hash)
+	}
+	return map[string]string{"success": ""}, nil
+}
+
+func boolString(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+func writeResponse(w http.ResponseWriter, status int, response map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+var queueGauge = metrics.NewGaugeFunc("nano_work_server_requests", "Work server requests queued and generating.", "state", func() map[string]float64 {
+	stats := Default.Stats()
+	return map[string]float64{"queued": float64(stats.Queued), "running": float64(stats.Running)}
+})
+
+var clientGauge = metrics.NewGaugeFunc("nano_work_server_client_active", "Work server requests queued or generating, by client.", "client", func() map[string]float64 {
+	series := make(map[string]float64)
+	for addr, c := range Default.Stats().Clients {
+		series[addr] = float64(c.Active)
+	}
+	return series
+})
+
+var clientGeneratedGauge = metrics.NewGaugeFunc("nano_work_server_client_generated", "Work generated for each client since starting.", "client", func() map[string]float64 {
+	series := make(map[string]float64)
+	for addr, c := range Default.Stats().Clients {
+		series[addr] = float64(c.Generated)
+	}
+	return series
+})
+
+var clientQueuedGauge = metrics.NewGaugeFunc("nano_work_server_client_queued", "Work server requests waiting for a worker, by client.", "client", func() map[string]float64 {
+	series := make(map[string]float64)
+	for addr, c := range Default.Stats().Clients {
+		series[addr] = float64(c.Queued)
+	}
+	return series
+})
+
+var clientRejectedGauge = metrics.NewGaugeFunc("nano_work_server_client_rejected", "Work requests refused for being over the client's limit since starting.", "client", func() map[string]float64 {
+	series := make(map[string]float64)
+	for addr, c := range Default.Stats().Clients {
+		series[addr] = float64(c.Rejected)
+	}
+	return series
+})
+
+var clientWaitGauge = metrics.NewGaugeFunc("nano_work_server_client_wait_seconds", "Time each client's work requests spent waiting for a worker since starting.", "client", func() map[string]float64 {
+	series := make(map[string]float64)
+	for addr, c := range Default.Stats().Clients {
+		series[addr] = c.Waited.Seconds()
+	}
+	return series
+})
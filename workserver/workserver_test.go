@@ -0,0 +1,328 @@
+package workserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/frankh/nano/blocks"
+	"github.com/frankh/nano/protocol"
+	"github.com/frankh/nano/rpcclient"
+	"github.com/frankh/nano/types"
+)
+
+var testRoot = types.BlockHash("991CF190094C00F0B68E2E5F75F6BEE95A2E0BD93CEAA4A6734DB9F19B728948")
+
+func post(s *Server, remote string, req map[string]string) (int, map[string]string) {
+	body, _ := json.Marshal(req)
+	r := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	r.RemoteAddr = remote
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	var response map[string]string
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w.Code, response
+}
+
+// Generation that waits to be released, recording the order roots start
+func blockingGenerate(started chan types.BlockHash, release chan bool) func(context.Context, types.BlockHash, uint64) (types.Work, error) {
+	return func(ctx context.Context, root types.BlockHash, threshold uint64) (types.Work, error) {
+		started <- root
+		select {
+		case <-release:
+			return "0000000000000000", nil
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestGenerateAndValidate(t *testing.T) {
+	s := NewServer()
+	s.Start()
+	defer s.Stop()
+
+	difficulty := "fffe000000000000"
+	code, response := post(s, "192.0.2.1:1000", map[string]string{"action": "work_generate", "hash": string(testRoot), "difficulty": difficulty})
+	if code != http.StatusOK || response["error"] != "" {
+		t.Fatalf("Generate failed: %d %v", code, response)
+	}
+	if blocks.RootWorkValue(testRoot, types.Work(response["work"])) < 0xfffe000000000000 {
+		t.Errorf("Work below the requested difficulty")
+	}
+
+	_, validated := post(s, "192.0.2.1:1000", map[string]string{"action": "work_validate", "hash": string(testRoot), "work": response["work"], "difficulty": difficulty})
+	if validated["valid"] != "1" || validated["difficulty"] != response["difficulty"] {
+		t.Errorf("Unexpected validation %v", validated)
+	}
+	_, validated = post(s, "192.0.2.1:1000", map[string]string{"action": "work_validate", "hash": string(testRoot), "work": "0000000000000000", "difficulty": difficulty})
+	if validated["valid"] != "0" {
+		t.Errorf("Zero work shouldn't be valid: %v", validated)
+	}
+
+	// A receive only needs the state receive difficulty
+	blocks.WorkThreshold = protocol.WorkTestThreshold
+	defer func() { blocks.WorkThreshold = protocol.WorkLiveThreshold }()
+	_, response = post(s, "192.0.2.1:1000", map[string]string{"action": "work_generate", "hash": string(testRoot), "block_type": "receive"})
+	if response["error"] != "" || blocks.RootWorkValue(testRoot, types.Work(response["work"])) < blocks.StateReceiveDifficulty(blocks.CurrentVersion) {
+		t.Errorf("Receive work below the receive difficulty: %v", response)
+	}
+	_, validated = post(s, "192.0.2.1:1000", map[string]string{"action": "work_validate", "hash": string(testRoot), "work": response["work"], "block_type": "receive"})
+	if validated["valid"] != "1" {
+		t.Errorf("Receive work not valid for a receive: %v", validated)
+	}
+	_, response = post(s, "192.0.2.1:1000", map[string]string{"action": "work_generate", "hash": string(testRoot), "block_type": "bogus"})
+	if response["error"] != "Bad block type" {
+		t.Errorf("Expected a bad block type, got %v", response)
+	}
+
+	_, response = post(s, "192.0.2.1:1000", map[string]string{"action": "work_generate", "hash": "xyz"})
+	if response["error"] != rpcclient.ErrBadHash.Error() {
+		t.Errorf("Expected a bad hash, got %v", response)
+	}
+	_, response = post(s, "192.0.2.1:1000", map[string]string{"action": "account_info", "hash": string(testRoot)})
+	if response["error"] != rpcclient.ErrUnknownAction.Error() {
+		t.Errorf("Expected an unknown action, got %v", response)
+	}
+	if s.Stats().Clients["192.0.2.1"].Generated != 2 {
+		t.Errorf("Generated work not counted: %v", s.Stats())
+	}
+}
+
+func TestAllowList(t *testing.T) {
+	s := NewServer()
+	s.Start()
+	defer s.Stop()
+	var err error
+	s.Allow, err = ParseAllow("10.0.0.0/8, 192.0.2.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ParseAllow("10.0.0.0/99"); err == nil {
+		t.Errorf("Bad network parsed")
+	}
+
+	req := map[string]string{"action": "work_validate", "hash": string(testRoot), "work": "0000000000000000"}
+	for remote, expected := range map[string]int{
+		"10.1.2.3:1000":  http.StatusOK,
+		"192.0.2.7:1000": http.StatusOK,
+		"192.0.2.8:1000": http.StatusForbidden,
+		"[::1]:1000":     http.StatusForbidden,
+	} {
+		if code, _ := post(s, remote, req); code != expected {
+			t.Errorf("%s: expected %d, got %d", remote, expected, code)
+		}
+	}
+}
+
+func TestPriorityAndLimits(t *testing.T) {
+	started, release := make(chan types.BlockHash, 10), make(chan bool)
+	s := NewServer()
+	s.Workers = 1
+	s.MaxPerClient = 2
+	s.generate = blockingGenerate(started, release)
+	s.Start()
+	defer s.Stop()
+
+	roots := []types.BlockHash{
+		types.BlockHash(strings.Repeat("1", 64)),
+		types.BlockHash(strings.Repeat("2", 64)),
+		types.BlockHash(strings.Repeat("3", 64)),
+	}
+	var wg sync.WaitGroup
+	generate := func(client string, root types.BlockHash, priority int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Generate(context.Background(), client, root, 0, priority, false)
+		}()
+	}
+
+	// The first occupies the only worker, then the rest queue
+	generate("a", roots[0], 0)
+	<-started
+	generate("b", roots[1], 0)
+	waitFor(t, func() bool { return s.Stats().Queued == 1 })
+	generate("c", roots[2], 5)
+	waitFor(t, func() bool { return s.Stats().Queued == 2 })
+
+	generate("a", roots[1], 0)
+	waitFor(t, func() bool { return s.Stats().Queued == 3 })
+	if _, err := s.Generate(context.Background(), "a", roots[2], 0, 0, false); err != ErrTooManyRequests {
+		t.Errorf("Expected the client's limit, got %v", err)
+	}
+	if s.Stats().Clients["a"].Rejected != 1 {
+		t.Errorf("Rejection not counted")
+	}
+
+	release <- true
+	if root := <-started; root != roots[2] {
+		t.Errorf("Expected the higher priority request next, got %s", root)
+	}
+	release <- true
+	if root := <-started; root != roots[1] {
+		t.Errorf("Expected the earlier request next, got %s", root)
+	}
+	release <- true
+	<-started
+	release <- true
+	wg.Wait()
+
+	stats := s.Stats()
+	if stats.Queued != 0 || stats.Clients["a"].Active != 0 || stats.Clients["a"].Generated != 2 {
+		t.Errorf("Unexpected stats %v", stats)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	started, release := make(chan types.BlockHash, 10), make(chan bool)
+	s := NewServer()
+	s.Workers = 1
+	s.generate = blockingGenerate(started, release)
+	s.Start()
+	defer s.Stop()
+
+	// Cancelled by work_cancel while generating
+	errs := make(chan error, 1)
+	go func() {
+		_, err := s.Generate(context.Background(), "a", testRoot, 0, 0, false)
+		errs <- err
+	}()
+	<-started
+	if _, response := post(s, "192.0.2.1:1000", map[string]string{"action": "work_cancel", "hash": strings.ToLower(string(testRoot))}); response["success"] != "" {
+		t.Errorf("Cancel failed: %v", response)
+	}
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("Expected a cancellation, got %v", err)
+	}
+
+	// Cancelled by the client disconnecting, while generating and queued
+	server := httptest.NewServer(s)
+	defer server.Close()
+	ctx, disconnect := context.WithCancel(context.Background())
+	for _, root := range []string{strings.Repeat("1", 64), strings.Repeat("2", 64)} {
+		body, _ := json.Marshal(map[string]string{"action": "work_generate", "hash": root})
+		req, _ := http.NewRequest("POST", server.URL, bytes.NewReader(body))
+		go http.DefaultClient.Do(req.WithContext(ctx))
+	}
+	<-started
+	waitFor(t, func() bool { return s.Stats().Queued == 1 })
+	disconnect()
+	waitFor(t, func() bool {
+		stats := s.Stats()
+		return stats.Queued == 0 && stats.Running == 0 && stats.Clients["127.0.0.1"].Active == 0
+	})
+	if stats := s.Stats(); stats.Clients["127.0.0.1"].Cancelled != 2 {
+		t.Errorf("Expected two cancellations, got %v", stats)
+	}
+}
+
+func TestFairness(t *testing.T) {
+	started, release := make(chan types.BlockHash, 100), make(chan bool)
+	s := NewServer()
+	s.Workers = 1
+	s.MaxPerClient = 0
+	s.generate = blockingGenerate(started, release)
+	s.Start()
+	defer s.Stop()
+
+	// Roots name their client: 1s for heavy, 2s for medium, 3s for light
+	var wg sync.WaitGroup
+	generate := func(client string, digit string, interactive bool) {
+		stats := s.Stats()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Generate(context.Background(), client, types.BlockHash(strings.Repeat(digit, 64)), 0, 0, interactive)
+		}()
+		waitFor(t, func() bool { return s.Stats().Queued+s.Stats().Running == stats.Queued+stats.Running+1 })
+	}
+
+	// Interleaved bursts, heavy's first and biggest
+	generate("heavy", "1", false)
+	<-started
+	for i := 0; i < 8; i++ {
+		generate("heavy", "1", false)
+	}
+	for i := 0; i < 4; i++ {
+		generate("medium", "2", false)
+		generate("heavy", "1", false)
+	}
+	generate("light", "3", false)
+
+	// Each client in turn while they all have requests queued, the light
+	// client's one within the first round
+	var order []byte
+	for i := 0; i < 9; i++ {
+		release <- true
+		order = append(order, (<-started)[0])
+	}
+	if string(order[:3]) != "231" && string(order[:3]) != "321" {
+		t.Errorf("Light client not served in the first round: %s", order)
+	}
+	if string(order[3:]) != "212121" {
+		t.Errorf("Expected medium and heavy to alternate, got %s", order)
+	}
+
+	// An interactive request goes ahead of the batch ones
+	generate("medium", "2", true)
+	release <- true
+	if root := <-started; root[0] != '2' {
+		t.Errorf("Expected the interactive request next, got %s", root)
+	}
+	for i := 0; i < 8; i++ {
+		release <- true
+		<-started
+	}
+	release <- true
+	wg.Wait()
+	if stats := s.Stats(); stats.Clients["heavy"].Generated != 13 || stats.Clients["light"].Generated != 1 || stats.Queued != 0 {
+		t.Errorf("Unexpected stats %v", stats)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	s := NewServer()
+	s.Start()
+	defer s.Stop()
+	var err error
+	if s.Tokens, err = ParseTokens("wallet:s3cret, exchange:0ther"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ParseTokens("wallet"); err == nil {
+		t.Errorf("Token without a name parsed")
+	}
+	s.Allow, _ = ParseAllow("10.0.0.0/8")
+
+	req := map[string]string{"action": "work_generate", "hash": string(testRoot), "difficulty": "ff00000000000000"}
+	body, _ := json.Marshal(req)
+	for token, expected := range map[string]int{"s3cret": http.StatusOK, "wrong": http.StatusForbidden} {
+		r := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+		r.RemoteAddr = "192.0.2.1:1000"
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != expected {
+			t.Errorf("%s: expected %d, got %d", token, expected, w.Code)
+		}
+	}
+	if stats := s.Stats(); stats.Clients["wallet"].Generated != 1 || len(stats.Clients) != 1 {
+		t.Errorf("Work not counted under the token's name: %v", stats)
+	}
+}